@@ -0,0 +1,166 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/auth"
+)
+
+type (
+	// ReadOnly toggles at runtime whether the APIs of a node accept writes.
+	ReadOnly struct {
+		enabled atomic.Bool
+	}
+	// ReadOnlyState is the body of requests and responses of the read-only
+	// mode action.
+	ReadOnlyState struct {
+		ReadOnly bool `json:"readOnly"`
+	}
+	// ActionResult is the outcome of an operational action.
+	ActionResult struct {
+		Action string `json:"action"`
+		Took   string `json:"took"`
+		// Path is the directory to which a checkpoint was written.
+		Path string `json:"path,omitempty"`
+		// Rewritten is the number of value log files rewritten by a store
+		// garbage collection.
+		Rewritten *int `json:"rewritten,omitempty"`
+	}
+
+	flusher interface {
+		Flush() error
+	}
+	compacter interface {
+		Compact() error
+	}
+	checkpointer interface {
+		Checkpoint(dir string) error
+	}
+	garbageCollector interface {
+		GC(ctx context.Context) (int, error)
+	}
+)
+
+// Enabled reports whether writes are currently rejected.
+func (r *ReadOnly) Enabled() bool {
+	return r.enabled.Load()
+}
+
+// Set sets whether writes are rejected.
+func (r *ReadOnly) Set(enabled bool) {
+	r.enabled.Store(enabled)
+}
+
+// serveAction serves operational actions, which are only available when
+// admin tokens or authorizers are configured, so that they cannot be triggered
+// anonymously.
+func (a *Admin) serveAction(w http.ResponseWriter, r *http.Request) {
+	if len(a.authorizers) == 0 && (a.tokens == nil || !a.tokens.Enabled(auth.GroupAdmin)) {
+		dhstore.HTTPError(w, "admin actions require admin tokens", http.StatusForbidden)
+		return
+	}
+	log.Infow("Admin action requested", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+	a.actions.ServeHTTP(w, r)
+}
+
+func (a *Admin) handleFlush(w http.ResponseWriter, _ *http.Request) {
+	f, ok := a.store.(flusher)
+	if !ok {
+		dhstore.HTTPError(w, "flush is not supported by store", http.StatusNotImplemented)
+		return
+	}
+	a.runAction(w, "flush", func(result *ActionResult) error {
+		return f.Flush()
+	})
+}
+
+func (a *Admin) handleCompact(w http.ResponseWriter, _ *http.Request) {
+	c, ok := a.store.(compacter)
+	if !ok {
+		dhstore.HTTPError(w, "compaction is not supported by store", http.StatusNotImplemented)
+		return
+	}
+	a.runAction(w, "compact", func(result *ActionResult) error {
+		return c.Compact()
+	})
+}
+
+func (a *Admin) handleCheckpoint(w http.ResponseWriter, _ *http.Request) {
+	c, ok := a.store.(checkpointer)
+	if !ok {
+		dhstore.HTTPError(w, "checkpoint is not supported by store", http.StatusNotImplemented)
+		return
+	}
+	if a.checkpointDir == "" {
+		dhstore.HTTPError(w, "checkpoint directory is not configured", http.StatusNotImplemented)
+		return
+	}
+	a.runAction(w, "checkpoint", func(result *ActionResult) error {
+		result.Path = filepath.Join(a.checkpointDir, fmt.Sprintf("checkpoint-%d", a.clock.Now().UnixNano()))
+		return c.Checkpoint(result.Path)
+	})
+}
+
+// handleGC runs the Go garbage collector and returns freed memory to the OS,
+// then garbage collects the store if it supports it.
+func (a *Admin) handleGC(w http.ResponseWriter, r *http.Request) {
+	a.runAction(w, "gc", func(result *ActionResult) error {
+		runtime.GC()
+		debug.FreeOSMemory()
+		if gc, ok := a.store.(garbageCollector); ok {
+			rewritten, err := gc.GC(r.Context())
+			result.Rewritten = &rewritten
+			return err
+		}
+		return nil
+	})
+}
+
+func (a *Admin) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	if a.readOnly == nil {
+		dhstore.HTTPError(w, "read-only mode toggle is not configured", http.StatusNotImplemented)
+		return
+	}
+	if r.Method == http.MethodPut {
+		var state ReadOnlyState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			dhstore.HTTPError(w, fmt.Sprintf("invalid read-only state: %s", err), http.StatusBadRequest)
+			return
+		}
+		a.readOnly.Set(state.ReadOnly)
+		log.Warnw("Read-only mode changed", "readOnly", state.ReadOnly)
+	}
+	writeJSON(w, ReadOnlyState{ReadOnly: a.readOnly.Enabled()})
+}
+
+func (a *Admin) handleReload(w http.ResponseWriter, _ *http.Request) {
+	if a.reload == nil {
+		dhstore.HTTPError(w, "reload is not configured", http.StatusNotImplemented)
+		return
+	}
+	a.runAction(w, "reload", func(*ActionResult) error {
+		return a.reload()
+	})
+}
+
+// runAction runs the given action, and writes its result or error.
+func (a *Admin) runAction(w http.ResponseWriter, action string, run func(*ActionResult) error) {
+	start := a.clock.Now()
+	result := ActionResult{Action: action}
+	if err := run(&result); err != nil {
+		log.Errorw("Admin action failed", "action", action, "err", err)
+		dhstore.HTTPError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result.Took = a.clock.Since(start).String()
+	log.Infow("Admin action completed", "action", action, "took", result.Took)
+	writeJSON(w, result)
+}
@@ -0,0 +1,293 @@
+// Package admin serves a minimal, read-only web UI for operators to eyeball
+// the state of a dhstore node without access to dashboards: store stats, LSM
+// health, job progress, and forms to look up and inspect records.
+//
+// When admin tokens are configured, it also serves an API of operational
+// actions, such as flushing, compacting and checkpointing the store, or
+// toggling read-only mode, without restarting the process.
+package admin
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/auth"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/metrics"
+	"github.com/ipni/dhstore/prune"
+	"github.com/mr-tron/base58"
+	"github.com/multiformats/go-multihash"
+)
+
+var log = logging.Logger("admin")
+
+// PathPrefix is the path under which the admin UI is served.
+const PathPrefix = "/admin/"
+
+//go:embed static
+var static embed.FS
+
+type (
+	// Admin serves the admin UI of a store.
+	Admin struct {
+		store         dhstore.DHStore
+		pruner        *prune.Pruner
+		config        *Config
+		tokens        *auth.Tokens
+		authorizers   []auth.Authorizer
+		readOnly      *ReadOnly
+		checkpointDir string
+		reload        func() error
+		clock         clock.Clock
+		started       time.Time
+		mux           *http.ServeMux
+		// actions serves operational actions.
+		actions *http.ServeMux
+		handler http.Handler
+	}
+
+	// Stats is the state of a store as shown by the admin UI. Fields that do
+	// not apply to the store type are omitted.
+	Stats struct {
+		Version       string                         `json:"version"`
+		StoreType     string                         `json:"storeType"`
+		Uptime        string                         `json:"uptime"`
+		Size          *int64                         `json:"size,omitempty"`
+		WritePressure *float64                       `json:"writePressure,omitempty"`
+		LSM           *LSMStats                      `json:"lsm,omitempty"`
+		Iterators     *metrics.PebbleIteratorMetrics `json:"iterators,omitempty"`
+		FDB           *metrics.FDBMetrics            `json:"fdb,omitempty"`
+	}
+	// LSMStats is the health of a pebble LSM.
+	LSMStats struct {
+		ReadAmp               int          `json:"readAmp"`
+		CompactionDebt        uint64       `json:"compactionDebt"`
+		CompactionsInProgress int64        `json:"compactionsInProgress"`
+		Flushes               int64        `json:"flushes"`
+		MemTableSize          uint64       `json:"memTableSize"`
+		MemTableCount         int64        `json:"memTableCount"`
+		DiskSpaceUsage        uint64       `json:"diskSpaceUsage"`
+		Levels                []LevelStats `json:"levels"`
+	}
+	// LevelStats is the shape of a level of a pebble LSM.
+	LevelStats struct {
+		Level     int     `json:"level"`
+		Files     int64   `json:"files"`
+		Size      int64   `json:"size"`
+		Sublevels int32   `json:"sublevels"`
+		Score     float64 `json:"score"`
+	}
+	// Jobs is the progress of the background jobs of a store.
+	Jobs struct {
+		PruneDryRun    bool             `json:"pruneDryRun"`
+		PruneCampaigns []prune.Campaign `json:"pruneCampaigns"`
+	}
+	// Inspection is the result of looking up a multihash or metadata key.
+	Inspection struct {
+		Key                string   `json:"key"`
+		Found              bool     `json:"found"`
+		EncryptedValueKeys [][]byte `json:"encryptedValueKeys,omitempty"`
+		EncryptedMetadata  []byte   `json:"encryptedMetadata,omitempty"`
+	}
+
+	sizer interface {
+		Size() (int64, error)
+	}
+	pebbleMetricsProvider interface {
+		Metrics() *pebble.Metrics
+	}
+	fdbMetricsProvider interface {
+		Metrics() *metrics.FDBMetrics
+	}
+	iteratorMetricsProvider interface {
+		IteratorMetrics() *metrics.PebbleIteratorMetrics
+	}
+)
+
+// New instantiates the admin UI of the given store.
+func New(store dhstore.DHStore, options ...Option) (*Admin, error) {
+	opts, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+	a := &Admin{
+		store:         store,
+		pruner:        opts.pruner,
+		config:        opts.config,
+		tokens:        opts.tokens,
+		authorizers:   opts.authorizers,
+		readOnly:      opts.readOnly,
+		checkpointDir: opts.checkpointDir,
+		reload:        opts.reload,
+		clock:         opts.clock,
+		started:       opts.clock.Now(),
+		mux:           http.NewServeMux(),
+		actions:       http.NewServeMux(),
+	}
+	staticFS, err := fs.Sub(static, "static")
+	if err != nil {
+		return nil, err
+	}
+	a.mux.Handle(PathPrefix, http.StripPrefix(PathPrefix, http.FileServer(http.FS(staticFS))))
+	a.mux.HandleFunc(PathPrefix+"config", a.handleConfig)
+	a.mux.HandleFunc(PathPrefix+"api/stats", a.handleStats)
+	a.mux.HandleFunc(PathPrefix+"api/jobs", a.handleJobs)
+	a.mux.HandleFunc(PathPrefix+"api/multihash/", a.handleInspectMultihash)
+	a.mux.HandleFunc(PathPrefix+"api/metadata/", a.handleInspectMetadata)
+	a.mux.HandleFunc(PathPrefix+"api/readonly", a.handleReadOnly)
+
+	a.actions.HandleFunc("POST "+PathPrefix+"api/flush", a.handleFlush)
+	a.actions.HandleFunc("POST "+PathPrefix+"api/compact", a.handleCompact)
+	a.actions.HandleFunc("POST "+PathPrefix+"api/checkpoint", a.handleCheckpoint)
+	a.actions.HandleFunc("POST "+PathPrefix+"api/gc", a.handleGC)
+	a.actions.HandleFunc("PUT "+PathPrefix+"api/readonly", a.handleReadOnly)
+	a.actions.HandleFunc("POST "+PathPrefix+"api/reload", a.handleReload)
+
+	a.handler = http.HandlerFunc(a.serve)
+	for i := len(a.authorizers) - 1; i >= 0; i-- {
+		a.handler = auth.Authorize(a.authorizers[i], adminGroup, a.handler)
+	}
+	if a.tokens != nil {
+		a.handler = a.tokens.Handler(adminGroup, a.handler)
+	}
+	return a, nil
+}
+
+// adminGroup returns the group of all admin requests.
+func adminGroup(*http.Request) auth.Group { return auth.GroupAdmin }
+
+// ServeHTTP serves the admin UI under PathPrefix. Requests require an admin
+// token if admin tokens are configured.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.handler.ServeHTTP(w, r)
+}
+
+// serve serves GET requests for the read-only UI, and other requests for
+// operational actions.
+func (a *Admin) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		a.serveAction(w, r)
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// Stats returns the current state of the store.
+func (a *Admin) Stats() (*Stats, error) {
+	stats := &Stats{
+		Version:   dhstore.Version,
+		StoreType: fmt.Sprintf("%T", a.store),
+		Uptime:    a.clock.Since(a.started).Round(time.Second).String(),
+	}
+	if s, ok := a.store.(sizer); ok {
+		size, err := s.Size()
+		if err != nil {
+			return nil, err
+		}
+		stats.Size = &size
+	}
+	if wpr, ok := a.store.(dhstore.WritePressureReporter); ok {
+		pressure := wpr.WritePressure()
+		stats.WritePressure = &pressure
+	}
+	if p, ok := a.store.(pebbleMetricsProvider); ok {
+		stats.LSM = lsmStats(p.Metrics())
+	}
+	if p, ok := a.store.(iteratorMetricsProvider); ok {
+		stats.Iterators = p.IteratorMetrics()
+	}
+	if p, ok := a.store.(fdbMetricsProvider); ok {
+		stats.FDB = p.Metrics()
+	}
+	return stats, nil
+}
+
+func lsmStats(m *pebble.Metrics) *LSMStats {
+	stats := &LSMStats{
+		ReadAmp:               m.ReadAmp(),
+		CompactionDebt:        m.Compact.EstimatedDebt,
+		CompactionsInProgress: m.Compact.NumInProgress,
+		Flushes:               m.Flush.Count,
+		MemTableSize:          m.MemTable.Size,
+		MemTableCount:         m.MemTable.Count,
+		DiskSpaceUsage:        m.DiskSpaceUsage(),
+		Levels:                make([]LevelStats, 0, len(m.Levels)),
+	}
+	for i, l := range m.Levels {
+		stats.Levels = append(stats.Levels, LevelStats{
+			Level:     i,
+			Files:     l.NumFiles,
+			Size:      l.Size,
+			Sublevels: l.Sublevels,
+			Score:     l.Score,
+		})
+	}
+	return stats
+}
+
+func (a *Admin) handleStats(w http.ResponseWriter, _ *http.Request) {
+	stats, err := a.Stats()
+	if err != nil {
+		log.Errorw("Failed to get store stats", "err", err)
+		dhstore.HTTPError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func (a *Admin) handleJobs(w http.ResponseWriter, _ *http.Request) {
+	jobs := Jobs{PruneCampaigns: []prune.Campaign{}}
+	if a.pruner != nil {
+		jobs.PruneDryRun = a.pruner.DryRun()
+		jobs.PruneCampaigns = a.pruner.Campaigns()
+	}
+	writeJSON(w, jobs)
+}
+
+func (a *Admin) handleInspectMultihash(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Path[len(PathPrefix+"api/multihash/"):]
+	mh, err := multihash.FromB58String(key)
+	if err != nil {
+		dhstore.HTTPError(w, fmt.Sprintf("invalid multihash: %s", err), http.StatusBadRequest)
+		return
+	}
+	evks, err := a.store.Lookup(mh)
+	if err != nil {
+		dhstore.HTTPError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	inspection := Inspection{Key: key, Found: len(evks) != 0}
+	for _, evk := range evks {
+		inspection.EncryptedValueKeys = append(inspection.EncryptedValueKeys, evk)
+	}
+	writeJSON(w, inspection)
+}
+
+func (a *Admin) handleInspectMetadata(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Path[len(PathPrefix+"api/metadata/"):]
+	hvk, err := base58.Decode(key)
+	if err != nil {
+		dhstore.HTTPError(w, fmt.Sprintf("invalid hashed value key: %s", err), http.StatusBadRequest)
+		return
+	}
+	emd, err := a.store.GetMetadata(hvk)
+	if err != nil {
+		dhstore.HTTPError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, Inspection{Key: key, Found: emd != nil, EncryptedMetadata: emd})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorw("Failed to write response", "err", err)
+	}
+}
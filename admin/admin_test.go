@@ -0,0 +1,191 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/admin"
+	"github.com/ipni/dhstore/auth"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/pebble"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}}))
+
+	clk := clock.NewMock(time.Unix(1_000, 0))
+	subject, err := admin.New(store, admin.WithClock(clk))
+	require.NoError(t, err)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, target, nil))
+		return got
+	}
+
+	t.Run("page", func(t *testing.T) {
+		got := get("/admin/")
+		require.Equal(t, http.StatusOK, got.Code)
+		require.Contains(t, got.Body.String(), "<h1>dhstore</h1>")
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		clk.Add(90 * time.Second)
+		got := get("/admin/api/stats")
+		require.Equal(t, http.StatusOK, got.Code)
+		var stats admin.Stats
+		require.NoError(t, json.Unmarshal(got.Body.Bytes(), &stats))
+		require.Equal(t, dhstore.Version, stats.Version)
+		require.Equal(t, "1m30s", stats.Uptime)
+		require.NotNil(t, stats.Size)
+		require.NotNil(t, stats.WritePressure)
+		require.NotNil(t, stats.LSM)
+		require.Len(t, stats.LSM.Levels, 7)
+		require.NotNil(t, stats.Iterators)
+		require.Nil(t, stats.FDB)
+	})
+
+	t.Run("jobs", func(t *testing.T) {
+		got := get("/admin/api/jobs")
+		require.Equal(t, http.StatusOK, got.Code)
+		require.JSONEq(t, `{"pruneDryRun":false,"pruneCampaigns":[]}`, got.Body.String())
+	})
+
+	t.Run("inspect", func(t *testing.T) {
+		got := get("/admin/api/multihash/" + mh.B58String())
+		require.Equal(t, http.StatusOK, got.Code)
+		var inspection admin.Inspection
+		require.NoError(t, json.Unmarshal(got.Body.Bytes(), &inspection))
+		require.True(t, inspection.Found)
+		require.Equal(t, [][]byte{[]byte("fish")}, inspection.EncryptedValueKeys)
+
+		got = get("/admin/api/metadata/2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+		require.Equal(t, http.StatusOK, got.Code)
+		require.JSONEq(t, `{"key":"2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82","found":false}`, got.Body.String())
+
+		require.Equal(t, http.StatusBadRequest, get("/admin/api/multihash/fish!").Code)
+	})
+
+	t.Run("actions require admin tokens", func(t *testing.T) {
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodPost, "/admin/api/flush", nil))
+		require.Equal(t, http.StatusForbidden, got.Code)
+	})
+}
+
+func TestAdmin_Authorizer(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = admin.New(store, admin.WithAuthorizer(nil))
+	require.ErrorContains(t, err, "must not be nil")
+
+	authorizer := auth.AuthorizerFunc(func(r *http.Request, group auth.Group) auth.Decision {
+		return auth.Decision{Allow: group == auth.GroupAdmin && r.RemoteAddr == "192.0.2.1:1234"}
+	})
+	subject, err := admin.New(store, admin.WithAuthorizer(authorizer))
+	require.NoError(t, err)
+	serve := func(method, target string) int {
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(method, target, nil))
+		return got.Code
+	}
+
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/admin/api/stats"))
+	// Actions are served without admin tokens, since they are authorized.
+	require.Equal(t, http.StatusOK, serve(http.MethodPost, "/admin/api/flush"))
+
+	authorizer = auth.AuthorizerFunc(func(*http.Request, auth.Group) auth.Decision {
+		return auth.Decision{}
+	})
+	subject, err = admin.New(store, admin.WithAuthorizer(authorizer))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, serve(http.MethodGet, "/admin/api/stats"))
+}
+
+func TestAdmin_Actions(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	tokens, err := auth.NewTokens(map[auth.Group][]string{auth.GroupAdmin: {"operator"}})
+	require.NoError(t, err)
+	readOnly := &admin.ReadOnly{}
+	checkpointDir := t.TempDir()
+	var reloads int
+	reload := func() error {
+		if reloads++; reloads > 1 {
+			return errors.New("invalid config")
+		}
+		return nil
+	}
+	subject, err := admin.New(store, admin.WithAuth(tokens), admin.WithReadOnly(readOnly), admin.WithCheckpointDir(checkpointDir), admin.WithReload(reload))
+	require.NoError(t, err)
+
+	serve := func(method, target, body, token string) *httptest.ResponseRecorder {
+		given := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			given.Header.Set("Authorization", "Bearer "+token)
+		}
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, given)
+		return got
+	}
+	action := func(name string) admin.ActionResult {
+		got := serve(http.MethodPost, "/admin/api/"+name, "", "operator")
+		require.Equal(t, http.StatusOK, got.Code, got.Body.String())
+		var result admin.ActionResult
+		require.NoError(t, json.Unmarshal(got.Body.Bytes(), &result))
+		require.Equal(t, name, result.Action)
+		return result
+	}
+
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodPost, "/admin/api/flush", "", "").Code)
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/admin/api/stats", "", "").Code)
+	require.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodDelete, "/admin/api/flush", "", "operator").Code)
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}}))
+	action("flush")
+	action("compact")
+	require.Nil(t, action("gc").Rewritten)
+
+	result := action("checkpoint")
+	require.Equal(t, checkpointDir, filepath.Dir(result.Path))
+	checkpoint, err := pebble.NewPebbleDHStore(result.Path, nil)
+	require.NoError(t, err)
+	evks, err := checkpoint.Lookup(mh)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("fish")}, evks)
+	require.NoError(t, checkpoint.Close())
+
+	got := serve(http.MethodGet, "/admin/api/readonly", "", "operator")
+	require.Equal(t, http.StatusOK, got.Code)
+	require.JSONEq(t, `{"readOnly":false}`, got.Body.String())
+	got = serve(http.MethodPut, "/admin/api/readonly", `{"readOnly":true}`, "operator")
+	require.Equal(t, http.StatusOK, got.Code)
+	require.JSONEq(t, `{"readOnly":true}`, got.Body.String())
+	require.True(t, readOnly.Enabled())
+
+	action("reload")
+	got = serve(http.MethodPost, "/admin/api/reload", "", "operator")
+	require.Equal(t, http.StatusInternalServerError, got.Code)
+	require.Contains(t, got.Body.String(), "invalid config")
+}
@@ -0,0 +1,160 @@
+package admin
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipni/dhstore"
+)
+
+const (
+	// redacted replaces the values of secrets in a Config.
+	redacted = "REDACTED"
+	// configSnapshotPrefix is the file name prefix of config snapshots.
+	configSnapshotPrefix = "runtime-config-"
+	// maxConfigSnapshots is the number of config snapshots retained in the
+	// store directory.
+	maxConfigSnapshots = 10
+)
+
+var (
+	// secretName matches the names of flags and environment variables whose
+	// values are secrets.
+	secretName = regexp.MustCompile(`(?i)(secret|passw|token|credential|api_?key|private|auth|dsn)`)
+	// keywordPassword matches the password of keyword/value connection
+	// strings, e.g. "host=db password=secret", whose value may be quoted.
+	keywordPassword = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s']\S*)`)
+	// envPrefixes are the prefixes of environment variables that affect the
+	// runtime configuration of dhstore.
+	envPrefixes = []string{"DHSTORE_", "GOLOG_", "GO_DEBUG_", "GOMAXPROCS", "GOMEMLIMIT", "GOGC", "GODEBUG", "FDB_"}
+)
+
+type (
+	// Config is a snapshot of the effective runtime configuration of a node,
+	// with secrets redacted.
+	Config struct {
+		Time    time.Time `json:"time"`
+		Version string    `json:"version"`
+		// Flags are the command-line flags by name.
+		Flags map[string]ConfigFlag `json:"flags"`
+		// Env are the environment variables that affect the configuration.
+		Env map[string]string `json:"env"`
+		// Features are the optional features by name, and whether each is
+		// enabled.
+		Features map[string]bool `json:"features,omitempty"`
+		// StoreOptions are the effective store options, after merging any
+		// config file over command-line flags.
+		StoreOptions string `json:"storeOptions,omitempty"`
+	}
+	// ConfigFlag is the value of a command-line flag.
+	ConfigFlag struct {
+		Value   string `json:"value"`
+		Default string `json:"default"`
+		// Set is whether the flag was set explicitly on the command line.
+		Set bool `json:"set"`
+	}
+)
+
+// NewConfig snapshots the flags of the given flag set, which must be parsed,
+// and the relevant variables of the given environment, formatted as
+// key=value.
+func NewConfig(fs *flag.FlagSet, environ []string) *Config {
+	c := &Config{
+		Time:    time.Now().UTC(),
+		Version: dhstore.Version,
+		Flags:   make(map[string]ConfigFlag),
+		Env:     make(map[string]string),
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	fs.VisitAll(func(f *flag.Flag) {
+		c.Flags[f.Name] = ConfigFlag{
+			Value:   redact(f.Name, f.Value.String()),
+			Default: redact(f.Name, f.DefValue),
+			Set:     set[f.Name],
+		}
+	})
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		for _, prefix := range envPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				c.Env[name] = redact(name, value)
+				break
+			}
+		}
+	}
+	return c
+}
+
+// redact returns the given value with secrets redacted: the whole value if the
+// name suggests a secret, and the password of any URLs or keyword/value
+// connection strings otherwise.
+func redact(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretName.MatchString(name) {
+		return redacted
+	}
+	value = keywordPassword.ReplaceAllString(value, "${1}"+redacted)
+	// Values may hold multiple URLs, e.g. repeated flags.
+	parts := strings.Split(value, ", ")
+	for i, part := range parts {
+		if u, err := url.Parse(part); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				parts[i] = u.String()
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// WriteTo writes the config as a timestamped JSON file in the given directory,
+// so that the configuration a node was running with can be reviewed after an
+// incident. Only the latest snapshots are retained.
+func (c *Config) WriteTo(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := configSnapshotPrefix + c.Time.Format("20060102T150405.000Z") + ".json"
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+
+	snapshots, err := filepath.Glob(filepath.Join(dir, configSnapshotPrefix+"*.json"))
+	if err != nil {
+		return path, err
+	}
+	// Names sort by time.
+	sort.Strings(snapshots)
+	for len(snapshots) > maxConfigSnapshots {
+		if err := os.Remove(snapshots[0]); err != nil {
+			return path, fmt.Errorf("failed to remove old config snapshot: %w", err)
+		}
+		snapshots = snapshots[1:]
+	}
+	return path, nil
+}
+
+func (a *Admin) handleConfig(w http.ResponseWriter, _ *http.Request) {
+	if a.config == nil {
+		dhstore.HTTPError(w, "config snapshot not available", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, a.config)
+}
@@ -0,0 +1,114 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ipni/dhstore/auth"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/prune"
+)
+
+// config contains all options for the admin UI.
+type config struct {
+	pruner        *prune.Pruner
+	config        *Config
+	tokens        *auth.Tokens
+	authorizers   []auth.Authorizer
+	readOnly      *ReadOnly
+	checkpointDir string
+	reload        func() error
+	clock         clock.Clock
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	cfg := config{
+		clock: clock.New(),
+	}
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d error: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithPruner shows the progress of the deletion campaigns of the given pruner.
+func WithPruner(p *prune.Pruner) Option {
+	return func(c *config) error {
+		c.pruner = p
+		return nil
+	}
+}
+
+// WithConfig serves the given runtime configuration snapshot at /admin/config.
+func WithConfig(c *Config) Option {
+	return func(cfg *config) error {
+		cfg.config = c
+		return nil
+	}
+}
+
+// WithAuth requires requests to carry an admin token, if admin tokens are
+// configured. Operational actions are only served when admin tokens are
+// configured.
+func WithAuth(tokens *auth.Tokens) Option {
+	return func(cfg *config) error {
+		cfg.tokens = tokens
+		return nil
+	}
+}
+
+// WithAuthorizer invokes the given authorizer on all requests, which are
+// rejected unless allowed, after admin tokens are checked. Operational actions
+// are also served when authorizers are configured without admin tokens.
+func WithAuthorizer(a auth.Authorizer) Option {
+	return func(cfg *config) error {
+		if a == nil {
+			return errors.New("authorizer must not be nil")
+		}
+		cfg.authorizers = append(cfg.authorizers, a)
+		return nil
+	}
+}
+
+// WithReadOnly exposes the given read-only mode toggle at
+// /admin/api/readonly, where it can be inspected via GET and set via PUT.
+func WithReadOnly(r *ReadOnly) Option {
+	return func(cfg *config) error {
+		cfg.readOnly = r
+		return nil
+	}
+}
+
+// WithCheckpointDir sets the directory under which checkpoints triggered via
+// POST /admin/api/checkpoint are written, each in a new subdirectory.
+// Checkpoints are disabled when unset.
+func WithCheckpointDir(dir string) Option {
+	return func(cfg *config) error {
+		cfg.checkpointDir = dir
+		return nil
+	}
+}
+
+// WithReload serves POST /admin/api/reload, which reloads the runtime-tunable
+// configuration of the node using the given function. Disabled when unset.
+func WithReload(reload func() error) Option {
+	return func(cfg *config) error {
+		cfg.reload = reload
+		return nil
+	}
+}
+
+// WithClock sets the clock used to report uptime, to time actions and to name
+// checkpoints. Defaults to the system clock.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) error {
+		cfg.clock = c
+		return nil
+	}
+}
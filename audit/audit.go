@@ -0,0 +1,178 @@
+// Package audit records the mutations of the store in an append-only log of
+// newline delimited JSON entries, identifying the client of each, so that bad
+// writes and deletions can be traced after the fact.
+//
+// Entries are written synchronously as mutations complete, to any io.Writer
+// such as standard output, or to a RotatingFile that bounds the disk space
+// taken by the log.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/clock"
+	"github.com/mr-tron/base58"
+)
+
+var log = logging.Logger("audit")
+
+// Op identifies the kind of mutation recorded by an Entry.
+type Op string
+
+const (
+	// OpMergeIndexes records merged encrypted value keys.
+	OpMergeIndexes Op = "mergeIndexes"
+	// OpDeleteIndexes records deleted encrypted value keys.
+	OpDeleteIndexes Op = "deleteIndexes"
+	// OpPutMetadata records put encrypted metadata.
+	OpPutMetadata Op = "putMetadata"
+	// OpDeleteMetadata records deleted encrypted metadata.
+	OpDeleteMetadata Op = "deleteMetadata"
+	// OpImport records a batch of bulk imported records.
+	OpImport Op = "import"
+)
+
+type (
+	// Client identifies the origin of a mutation, as far as it is known.
+	Client struct {
+		// API is the API through which the mutation was made; one of http,
+		// grpc, prune or importShard.
+		API string `json:"api"`
+		// Addr is the remote address of the client.
+		Addr string `json:"addr,omitempty"`
+		// RequestID is the ID of the request that made the mutation.
+		RequestID string `json:"requestID,omitempty"`
+		// Subject is the subject of the verified client certificate, if any.
+		Subject string `json:"subject,omitempty"`
+		// Tag is the writer tag of the request, if provenance is enabled.
+		Tag string `json:"tag,omitempty"`
+		// Annotations are the annotations attached by authorizers.
+		Annotations map[string]string `json:"annotations,omitempty"`
+	}
+	// Entry is a single mutation recorded in the log.
+	Entry struct {
+		Time   time.Time `json:"time"`
+		Op     Op        `json:"op"`
+		Client Client    `json:"client"`
+		// Count is the number of merges, deletions or metadata records of the
+		// mutation.
+		Count int `json:"count"`
+		// Keys are the distinct base58 encoded multihashes or hashed value
+		// keys of the mutation, in ascending order.
+		Keys []string `json:"keys"`
+		// Error is the error of the mutation if it failed, in which case some
+		// of its records may still have been applied.
+		Error string `json:"error,omitempty"`
+	}
+	// Log writes entries to an underlying writer.
+	Log struct {
+		clock clock.Clock
+
+		mu  sync.Mutex
+		w   io.Writer
+		enc *json.Encoder
+	}
+)
+
+// New returns a Log that writes entries to w as newline delimited JSON. w is
+// closed by Close if it implements io.Closer.
+func New(w io.Writer, options ...Option) (*Log, error) {
+	opts, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{
+		clock: opts.clock,
+		w:     w,
+		enc:   json.NewEncoder(w),
+	}, nil
+}
+
+// RecordIndexes records a mutation of the given indexes, which failed if err
+// is not nil.
+func (l *Log) RecordIndexes(op Op, client Client, indexes []dhstore.Index, err error) {
+	keys := make([][]byte, 0, len(indexes))
+	for _, index := range indexes {
+		keys = append(keys, index.Key)
+	}
+	l.record(op, client, len(indexes), keys, err)
+}
+
+// RecordMetadata records a mutation of the metadata of the given hashed value
+// keys, which failed if err is not nil.
+func (l *Log) RecordMetadata(op Op, client Client, hvks []dhstore.HashedValueKey, err error) {
+	keys := make([][]byte, 0, len(hvks))
+	for _, hvk := range hvks {
+		keys = append(keys, hvk)
+	}
+	l.record(op, client, len(hvks), keys, err)
+}
+
+// RecordImport records the import of a batch of exported records, which
+// failed if err is not nil. Keys are the multihashes, hashed value keys or
+// metadata keys of the records.
+func (l *Log) RecordImport(client Client, records []dhstore.ExportRecord, err error) {
+	keys := make([][]byte, 0, len(records))
+	for _, record := range records {
+		switch {
+		case record.Multihash != nil:
+			keys = append(keys, record.Multihash)
+		case record.HashedValueKey != nil:
+			keys = append(keys, record.HashedValueKey)
+		default:
+			keys = append(keys, record.MetadataKey)
+		}
+	}
+	l.record(OpImport, client, len(records), keys, err)
+}
+
+func (l *Log) record(op Op, client Client, count int, keys [][]byte, err error) {
+	entry := Entry{
+		Time:   l.clock.Now(),
+		Op:     op,
+		Client: client,
+		Count:  count,
+		Keys:   distinct(keys),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Failing to record a mutation does not fail the mutation, which may
+	// already be applied.
+	if err := l.enc.Encode(entry); err != nil {
+		log.Errorw("Failed to write audit log entry", "op", op, "count", count, "err", err)
+	}
+}
+
+// distinct returns the base58 encoding of the distinct keys, sorted.
+func distinct(keys [][]byte) []string {
+	seen := make(map[string]struct{}, len(keys))
+	encoded := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[string(key)]; ok {
+			continue
+		}
+		seen[string(key)] = struct{}{}
+		encoded = append(encoded, base58.Encode(key))
+	}
+	sort.Strings(encoded)
+	return encoded
+}
+
+// Close closes the underlying writer if it implements io.Closer.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package audit_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/audit"
+	"github.com/ipni/dhstore/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_Record(t *testing.T) {
+	var buf bytes.Buffer
+	clk := clock.NewMock(time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC))
+	subject, err := audit.New(&buf, audit.WithClock(clk))
+	require.NoError(t, err)
+
+	client := audit.Client{API: "http", Addr: "10.0.0.7:51234", RequestID: "fish", Annotations: map[string]string{"user": "lobster"}}
+	subject.RecordIndexes(audit.OpDeleteIndexes, client, []dhstore.Index{
+		{Key: []byte("fish"), Value: []byte("one")},
+		{Key: []byte("cod"), Value: []byte("two")},
+		{Key: []byte("fish"), Value: []byte("three")},
+	}, nil)
+	clk.Add(time.Second)
+	subject.RecordMetadata(audit.OpPutMetadata, audit.Client{API: "grpc"}, []dhstore.HashedValueKey{[]byte("fish")}, errors.New("store is read-only"))
+	require.NoError(t, subject.Close())
+
+	require.Equal(t, `{"time":"2026-10-16T10:00:00Z","op":"deleteIndexes","client":{"api":"http","addr":"10.0.0.7:51234","requestID":"fish","annotations":{"user":"lobster"}},"count":3,"keys":["3cqA6K","aQ9q"]}
+{"time":"2026-10-16T10:00:01Z","op":"putMetadata","client":{"api":"grpc"},"count":1,"keys":["3cqA6K"],"error":"store is read-only"}
+`, buf.String())
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	_, err := audit.OpenRotatingFile(path, 0, 1)
+	require.ErrorContains(t, err, "max size")
+	_, err = audit.OpenRotatingFile(path, 10, 0)
+	require.ErrorContains(t, err, "max files")
+
+	subject, err := audit.OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := subject.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	require.NoError(t, subject.Close())
+	_, err = subject.Write([]byte("six\n"))
+	require.ErrorIs(t, err, os.ErrClosed)
+
+	requireContent := func(path, want string) {
+		got, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, want, string(got))
+	}
+	requireContent(path, "four\nfive\n")
+	requireContent(path+".1", "three\n")
+	requireContent(path+".2", "one\ntwo\n")
+
+	// Reopened files are appended to, and rotated by their existing size,
+	// removing the oldest rotated file.
+	subject, err = audit.OpenRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+	_, err = subject.Write([]byte("six\n"))
+	require.NoError(t, err)
+	require.NoError(t, subject.Close())
+	requireContent(path, "six\n")
+	requireContent(path+".1", "four\nfive\n")
+	requireContent(path+".2", "three\n")
+	require.NoFileExists(t, path+".3")
+}
+
+func TestRotatingFile_RotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhstore.log")
+	_, err := audit.OpenRotatingFile(path, 100, 1, audit.WithMaxAge(-time.Hour))
+	require.ErrorContains(t, err, "max age")
+
+	clk := clock.NewMock(time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC))
+	subject, err := audit.OpenRotatingFile(path, 100, 2, audit.WithMaxAge(time.Hour), audit.WithClock(clk))
+	require.NoError(t, err)
+	write := func(line string) {
+		_, err := subject.Write([]byte(line))
+		require.NoError(t, err)
+	}
+	write("one\n")
+	clk.Add(30 * time.Minute)
+	write("two\n")
+	clk.Add(30 * time.Minute)
+	write("three\n")
+	require.NoError(t, subject.Sync())
+	require.NoError(t, subject.Close())
+
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "three\n", string(got))
+	got, err = os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	require.Equal(t, "one\ntwo\n", string(got))
+}
@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+)
+
+// config contains all options for the log and its rotating files.
+type config struct {
+	clock  clock.Clock
+	maxAge time.Duration
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	cfg := config{
+		clock: clock.New(),
+	}
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d error: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithClock sets the clock with which entries are timestamped, and by which
+// the age of rotating files is measured.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) error {
+		if c == nil {
+			return errors.New("clock cannot be nil")
+		}
+		cfg.clock = c
+		return nil
+	}
+}
+
+// WithMaxAge sets the age after which a RotatingFile is rotated, measured from
+// when it was opened. Files are rotated by size only when zero, which is the
+// default.
+func WithMaxAge(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return fmt.Errorf("max age cannot be negative, got: %s", d)
+		}
+		cfg.maxAge = d
+		return nil
+	}
+}
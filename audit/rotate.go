@@ -0,0 +1,141 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+)
+
+// RotatingFile is an append-only file that is rotated once it reaches a
+// maximum size, or optionally a maximum age, keeping a bounded number of
+// rotated files. The file at path is
+// renamed to path.1 upon rotation, path.1 to path.2 and so on, and the oldest
+// file beyond the kept number is removed.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	maxAge   time.Duration
+	clock    clock.Clock
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenRotatingFile opens the file at path for appending, creating it if it
+// does not exist. The file is rotated before a write would grow it beyond
+// maxSize bytes, or once it was opened longer ago than the age set by
+// WithMaxAge, keeping up to maxFiles rotated files.
+func OpenRotatingFile(path string, maxSize int64, maxFiles int, opts ...Option) (*RotatingFile, error) {
+	if maxSize < 1 {
+		return nil, fmt.Errorf("max size must be at least 1, got: %d", maxSize)
+	}
+	if maxFiles < 1 {
+		return nil, fmt.Errorf("max files must be at least 1, got: %d", maxFiles)
+	}
+	cfg, err := getOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	rf := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		maxAge:   cfg.maxAge,
+		clock:    cfg.clock,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	rf.f, rf.size, rf.opened = f, fi.Size(), rf.clock.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would grow it beyond
+// its maximum size or if it is older than its maximum age. Writes larger than the maximum size are written whole to a
+// new file.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size != 0 && (rf.size+int64(len(p)) > rf.maxSize || rf.expired()) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// expired reports whether the file was opened longer ago than its maximum age,
+// if any.
+func (rf *RotatingFile) expired() bool {
+	return rf.maxAge > 0 && rf.clock.Since(rf.opened) >= rf.maxAge
+}
+
+// Sync commits the written content of the file to stable storage.
+func (rf *RotatingFile) Sync() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return os.ErrClosed
+	}
+	return rf.f.Sync()
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rf.f = nil
+	if err := os.Remove(rf.rotatedPath(rf.maxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := rf.maxFiles - 1; i > 0; i-- {
+		if err := os.Rename(rf.rotatedPath(i), rf.rotatedPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(rf.path, rf.rotatedPath(1)); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *RotatingFile) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", rf.path, i)
+}
+
+// Close closes the file, after which writes fail.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,257 @@
+// Package auth authorizes requests by bearer tokens, also known as API keys,
+// configured per group of routes, i.e. reads, writes and admin.
+//
+// Tokens are read from a file with one token per line, prefixed by the group
+// it authorizes, e.g.:
+//
+//	# The indexer.
+//	write 6f2b8cbb2d0a...
+//	read  0c5f3ac1e11a...
+//
+// Tokens can be replaced at runtime, e.g. to rotate them without a restart. A
+// group without any tokens is open to all requests, and admin tokens also
+// authorize requests of the other groups that have tokens.
+//
+// Deployments may further plug in an Authorizer, e.g. to validate JWTs or HMAC
+// signatures, or to apply IP policies.
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+)
+
+var log = logging.Logger("auth")
+
+// APIKeyHeader is the request header from which a token is taken when the
+// request has no Authorization header.
+const APIKeyHeader = "X-Api-Key"
+
+// Group identifies a group of routes authorized by the same tokens.
+type Group string
+
+const (
+	// GroupRead covers lookups.
+	GroupRead Group = "read"
+	// GroupWrite covers mutations of the store.
+	GroupWrite Group = "write"
+	// GroupAdmin covers operational routes, such as exports and the admin UI.
+	GroupAdmin Group = "admin"
+)
+
+// Tokens holds the tokens authorized for each group.
+type Tokens struct {
+	// digests maps each group to the SHA-256 digests of its tokens, so that
+	// tokens are compared in constant time regardless of their length.
+	digests atomic.Pointer[map[Group][][sha256.Size]byte]
+}
+
+// NewTokens returns Tokens authorizing the given tokens per group.
+func NewTokens(tokens map[Group][]string) (*Tokens, error) {
+	t := &Tokens{}
+	if err := t.Set(tokens); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Set atomically replaces the authorized tokens with the given ones.
+func (t *Tokens) Set(tokens map[Group][]string) error {
+	digests := make(map[Group][][sha256.Size]byte, len(tokens))
+	for group, groupTokens := range tokens {
+		switch group {
+		case GroupRead, GroupWrite, GroupAdmin:
+		default:
+			return fmt.Errorf("unknown token group: %s", group)
+		}
+		for _, token := range groupTokens {
+			if token == "" {
+				return fmt.Errorf("empty %s token", group)
+			}
+			digests[group] = append(digests[group], sha256.Sum256([]byte(token)))
+		}
+	}
+	t.digests.Store(&digests)
+	return nil
+}
+
+// Enabled reports whether requests of the given group require a token.
+func (t *Tokens) Enabled(group Group) bool {
+	return len((*t.digests.Load())[group]) != 0
+}
+
+// Check reports whether the given token authorizes requests of the given
+// group. Any token is authorized for a group that is not enabled.
+func (t *Tokens) Check(group Group, token string) bool {
+	digests := *t.digests.Load()
+	if len(digests[group]) == 0 {
+		return true
+	}
+	digest := sha256.Sum256([]byte(token))
+	var ok int
+	for _, candidates := range [][][sha256.Size]byte{digests[group], digests[GroupAdmin]} {
+		for i := range candidates {
+			ok |= subtle.ConstantTimeCompare(digest[:], candidates[i][:])
+		}
+	}
+	return ok == 1
+}
+
+// Handler wraps the given handler such that requests are rejected with 401
+// Unauthorized unless they carry a token authorized for the group returned by
+// groupOf. Requests for which groupOf returns an empty group are let through.
+func (t *Tokens) Handler(groupOf func(*http.Request) Group, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group := groupOf(r)
+		if group != "" && !t.Check(group, RequestToken(r)) {
+			log.Warnw("Rejecting unauthorized request", "group", group, "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			dhstore.HTTPError(w, "", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequestToken returns the bearer token of the Authorization header of the
+// given request, falling back on the X-Api-Key header.
+func RequestToken(r *http.Request) string {
+	if authz := r.Header.Get("Authorization"); authz != "" {
+		scheme, token, _ := strings.Cut(authz, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return r.Header.Get(APIKeyHeader)
+}
+
+// ParseTokens parses tokens from the given reader, with one token per line
+// prefixed by its group. Empty lines and lines starting with # are ignored.
+func ParseTokens(r io.Reader) (map[Group][]string, error) {
+	tokens := make(map[Group][]string)
+	scanner := bufio.NewScanner(r)
+	var line int
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected group and token", line)
+		}
+		group := Group(fields[0])
+		tokens[group] = append(tokens[group], fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// LoadTokensFile parses the tokens in the file at the given path.
+func LoadTokensFile(path string) (map[Group][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTokens(f)
+}
+
+// Authorizer decides whether requests are authorized, e.g. by validating a JWT
+// or HMAC signature, or by the address of the client. It complements tokens,
+// and is only invoked for requests that carry an authorized token, if any.
+type Authorizer interface {
+	// Authorize returns the decision on the given request of the given
+	// group.
+	Authorize(r *http.Request, group Group) Decision
+}
+
+// AuthorizerFunc adapts a function to an Authorizer.
+type AuthorizerFunc func(r *http.Request, group Group) Decision
+
+// Authorize calls f(r, group).
+func (f AuthorizerFunc) Authorize(r *http.Request, group Group) Decision {
+	return f(r, group)
+}
+
+// Decision is the outcome of authorizing a request.
+type Decision struct {
+	// Allow is whether the request is authorized.
+	Allow bool
+	// Status is the status with which a denied request is rejected. Defaults
+	// to 403 Forbidden.
+	Status int
+	// Reason is the body of the response to a denied request.
+	Reason string
+	// Annotations are attached to the context of an allowed request, e.g. to
+	// identify the authorized subject to handlers, and are retrieved via
+	// AnnotationsFrom.
+	Annotations map[string]string
+}
+
+type annotationsKey struct{}
+
+// AnnotationsFrom returns the annotations attached to the given request
+// context by authorizers, or nil if there are none.
+func AnnotationsFrom(ctx context.Context) map[string]string {
+	annotations, _ := ctx.Value(annotationsKey{}).(map[string]string)
+	return annotations
+}
+
+// Authorize wraps the given handler such that requests are rejected unless
+// allowed by a, which is invoked for requests of the group returned by groupOf.
+// Requests for which groupOf returns an empty group are let through. The
+// annotations of an allowed request are added to the ones attached to its
+// context by preceding authorizers.
+func Authorize(a Authorizer, groupOf func(*http.Request) Group, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group := groupOf(r)
+		if group == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		d := a.Authorize(r, group)
+		if !d.Allow {
+			status := d.Status
+			if status == 0 {
+				status = http.StatusForbidden
+			}
+			log.Warnw("Rejecting request denied by authorizer", "group", group, "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "status", status, "reason", d.Reason)
+			dhstore.HTTPError(w, d.Reason, status)
+			return
+		}
+		if len(d.Annotations) != 0 {
+			r = r.WithContext(WithAnnotations(r.Context(), d.Annotations))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WithAnnotations returns a copy of ctx with the given annotations added to
+// the ones already attached to it, e.g. by preceding authorizers. It allows
+// APIs other than HTTP to attach the annotations of their decisions.
+func WithAnnotations(ctx context.Context, annotations map[string]string) context.Context {
+	merged := make(map[string]string, len(annotations))
+	for k, v := range AnnotationsFrom(ctx) {
+		merged[k] = v
+	}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, annotationsKey{}, merged)
+}
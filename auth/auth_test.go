@@ -0,0 +1,138 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipni/dhstore/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := auth.ParseTokens(strings.NewReader(`
+# The indexer.
+write fish
+read  lobster
+
+admin squid
+write octopus
+`))
+	require.NoError(t, err)
+	require.Equal(t, map[auth.Group][]string{
+		auth.GroupWrite: {"fish", "octopus"},
+		auth.GroupRead:  {"lobster"},
+		auth.GroupAdmin: {"squid"},
+	}, tokens)
+
+	_, err = auth.ParseTokens(strings.NewReader("fish"))
+	require.ErrorContains(t, err, "line 1")
+}
+
+func TestTokens(t *testing.T) {
+	_, err := auth.NewTokens(map[auth.Group][]string{"fish": {"lobster"}})
+	require.ErrorContains(t, err, "unknown token group")
+
+	subject, err := auth.NewTokens(map[auth.Group][]string{auth.GroupWrite: {"fish"}, auth.GroupAdmin: {"squid"}})
+	require.NoError(t, err)
+
+	require.True(t, subject.Enabled(auth.GroupWrite))
+	require.False(t, subject.Enabled(auth.GroupRead))
+	require.True(t, subject.Check(auth.GroupWrite, "fish"))
+	require.False(t, subject.Check(auth.GroupWrite, "lobster"))
+	require.False(t, subject.Check(auth.GroupWrite, ""))
+	// Admin tokens authorize other groups.
+	require.True(t, subject.Check(auth.GroupWrite, "squid"))
+	require.False(t, subject.Check(auth.GroupAdmin, "fish"))
+	// Groups without tokens are open.
+	require.True(t, subject.Check(auth.GroupRead, ""))
+
+	// Tokens are replaced at runtime.
+	require.NoError(t, subject.Set(map[auth.Group][]string{auth.GroupWrite: {"lobster"}}))
+	require.False(t, subject.Check(auth.GroupWrite, "fish"))
+	require.True(t, subject.Check(auth.GroupWrite, "lobster"))
+}
+
+func TestTokens_Handler(t *testing.T) {
+	tokens, err := auth.NewTokens(map[auth.Group][]string{auth.GroupWrite: {"fish"}})
+	require.NoError(t, err)
+	subject := tokens.Handler(func(r *http.Request) auth.Group {
+		if r.Method == http.MethodGet {
+			return ""
+		}
+		return auth.GroupWrite
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(method string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", nil)
+		if len(header) == 2 {
+			r.Header.Set(header[0], header[1])
+		}
+		w := httptest.NewRecorder()
+		subject.ServeHTTP(w, r)
+		return w
+	}
+
+	got := serve(http.MethodPut)
+	require.Equal(t, http.StatusUnauthorized, got.Code)
+	require.Equal(t, "Bearer", got.Header().Get("WWW-Authenticate"))
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodPut, "Authorization", "Bearer lobster").Code)
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodPut, "Authorization", "Basic fish").Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodPut, "Authorization", "Bearer fish").Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodPut, auth.APIKeyHeader, "fish").Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet).Code)
+}
+
+func TestAuthorize(t *testing.T) {
+	var gotGroup auth.Group
+	var gotAnnotations map[string]string
+	authorizer := auth.AuthorizerFunc(func(r *http.Request, group auth.Group) auth.Decision {
+		gotGroup = group
+		switch r.Header.Get("X-Signature") {
+		case "fish":
+			return auth.Decision{Allow: true, Annotations: map[string]string{"subject": "fish"}}
+		case "":
+			return auth.Decision{Status: http.StatusUnauthorized, Reason: "signature required"}
+		default:
+			return auth.Decision{Reason: "invalid signature"}
+		}
+	})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAnnotations = auth.AnnotationsFrom(r.Context())
+	})
+	subject := auth.Authorize(authorizer, func(r *http.Request) auth.Group {
+		if r.Method == http.MethodGet {
+			return ""
+		}
+		return auth.GroupWrite
+	}, auth.Authorize(auth.AuthorizerFunc(func(*http.Request, auth.Group) auth.Decision {
+		return auth.Decision{Allow: true, Annotations: map[string]string{"region": "sea"}}
+	}), func(*http.Request) auth.Group { return auth.GroupWrite }, next))
+
+	serve := func(method, signature string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", nil)
+		if signature != "" {
+			r.Header.Set("X-Signature", signature)
+		}
+		w := httptest.NewRecorder()
+		subject.ServeHTTP(w, r)
+		return w
+	}
+
+	// Requests without a group are not authorized.
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "").Code)
+	require.Empty(t, gotGroup)
+
+	got := serve(http.MethodPut, "")
+	require.Equal(t, http.StatusUnauthorized, got.Code)
+	require.JSONEq(t, `{"code":"unauthorized","message":"signature required"}`, got.Body.String())
+	require.Equal(t, auth.GroupWrite, gotGroup)
+	got = serve(http.MethodPut, "lobster")
+	require.Equal(t, http.StatusForbidden, got.Code)
+	require.JSONEq(t, `{"code":"forbidden","message":"invalid signature"}`, got.Body.String())
+
+	// Annotations of successive authorizers are merged.
+	require.Equal(t, http.StatusOK, serve(http.MethodPut, "fish").Code)
+	require.Equal(t, map[string]string{"subject": "fish", "region": "sea"}, gotAnnotations)
+}
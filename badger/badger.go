@@ -0,0 +1,404 @@
+// Package badger implements a DHStore backed by BadgerDB, a pure Go LSM that
+// keeps large values in a separate value log.
+//
+// The encrypted value keys of each multihash are stored as a list of varint
+// length-prefixed sections under a single key. Merges read the list, append
+// value keys in order while skipping duplicates in the same way as the pebble
+// merger, and write it back in the same transaction, which is retried on
+// conflict. The value log is garbage collected periodically; see WithGCInterval.
+package badger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+)
+
+var (
+	_ dhstore.DHStore             = (*BadgerDHStore)(nil)
+	_ dhstore.MetadataBatchPutter = (*BadgerDHStore)(nil)
+
+	logger = logging.Logger("store/badger")
+
+	errCodecOverflow = errors.New("overflow")
+)
+
+const (
+	// multihashKeyPrefix is the prefix of keys that map a multihash to its
+	// encrypted value keys.
+	multihashKeyPrefix byte = iota + 1
+	// metadataKeyPrefix is the prefix of keys that map a hashed value key to
+	// its encrypted metadata.
+	metadataKeyPrefix
+)
+
+type BadgerDHStore struct {
+	db             *badger.DB
+	maxRetries     int
+	gcDiscardRatio float64
+
+	// cancel stops the background value log garbage collection, and wg waits
+	// for it to return.
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewBadgerDHStore opens the Badger database at the given path, creating it
+// if it does not exist.
+func NewBadgerDHStore(path string, o ...Option) (*BadgerDHStore, error) {
+	opts, err := newOptions(o...)
+	if err != nil {
+		return nil, err
+	}
+	db, err := badger.Open(badger.DefaultOptions(path).
+		WithSyncWrites(opts.syncWrites).
+		WithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+	s := &BadgerDHStore{
+		db:             db,
+		maxRetries:     opts.maxRetries,
+		gcDiscardRatio: opts.gcDiscardRatio,
+	}
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	if opts.gcInterval > 0 {
+		s.wg.Add(1)
+		go s.runGC(ctx, opts.gcInterval)
+	}
+	return s, nil
+}
+
+// runGC garbage collects the value log at the given interval until the
+// context is done.
+func (s *BadgerDHStore) runGC(ctx context.Context, interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rewritten, err := s.GC(ctx)
+			if err != nil {
+				logger.Warnw("Failed to garbage collect value log", "err", err)
+				continue
+			}
+			logger.Debugw("Garbage collected value log", "rewritten", rewritten)
+		}
+	}
+}
+
+// GC garbage collects the value log once, rewriting value log files until
+// none has at least the configured ratio of stale data, and returns the number
+// of rewritten files.
+func (s *BadgerDHStore) GC(ctx context.Context) (int, error) {
+	var rewritten int
+	for ctx.Err() == nil {
+		if err := s.db.RunValueLogGC(s.gcDiscardRatio); err != nil {
+			if errors.Is(err, badger.ErrNoRewrite) {
+				break
+			}
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+// transact runs fn in a read-write transaction, retrying it up to maxRetries
+// times when it fails to commit due to a conflict with concurrent
+// transactions.
+func (s *BadgerDHStore) transact(fn func(*badger.Txn) error) error {
+	for attempt := 0; ; attempt++ {
+		err := s.db.Update(fn)
+		if err == nil || attempt >= s.maxRetries || !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+		logger.Debugw("Retrying transaction after conflict", "attempt", attempt+1, "err", err)
+	}
+}
+
+// updateEach calls fn for each of n items in as few transactions as fit them
+// all, starting a new transaction whenever one grows too big. Returns
+// dhstore.ErrPartialWrite if a transaction fails after others were committed.
+func (s *BadgerDHStore) updateEach(n int, fn func(txn *badger.Txn, i int) error) error {
+	var written int
+	for written < n {
+		var end int
+		if err := s.transact(func(txn *badger.Txn) error {
+			for end = written; end < n; end++ {
+				if err := fn(txn, end); err != nil {
+					if errors.Is(err, badger.ErrTxnTooBig) && end > written {
+						// Commit what fits, and continue in a new transaction.
+						return nil
+					}
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			if written == 0 {
+				return err
+			}
+			return dhstore.ErrPartialWrite{Written: written, Total: n, Err: err}
+		}
+		written = end
+	}
+	return nil
+}
+
+// valueKeys is the list of encrypted value keys of a multihash, in the order
+// they were merged.
+type valueKeys struct {
+	key    []byte
+	values [][]byte
+}
+
+// add appends the given value key unless it is already present, and returns
+// whether it was added.
+func (vks *valueKeys) add(evk []byte) bool {
+	if slices.ContainsFunc(vks.values, func(v []byte) bool { return bytes.Equal(v, evk) }) {
+		return false
+	}
+	vks.values = append(vks.values, evk)
+	return true
+}
+
+// remove removes the given value key while preserving the order of the rest,
+// and returns whether it was present.
+func (vks *valueKeys) remove(evk []byte) bool {
+	i := slices.IndexFunc(vks.values, func(v []byte) bool { return bytes.Equal(v, evk) })
+	if i < 0 {
+		return false
+	}
+	vks.values = slices.Delete(vks.values, i, i+1)
+	return true
+}
+
+// groupByKey groups the value keys of the given indexes by the store key of
+// their multihash, sorted by key.
+func groupByKey(indexes []dhstore.Index) []*valueKeys {
+	byKey := make(map[string]*valueKeys)
+	for _, index := range indexes {
+		vks, ok := byKey[string(index.Key)]
+		if !ok {
+			vks = &valueKeys{key: multihashKey(index.Key)}
+			byKey[string(index.Key)] = vks
+		}
+		vks.add(index.Value)
+	}
+	groups := make([]*valueKeys, 0, len(byKey))
+	for _, vks := range byKey {
+		groups = append(groups, vks)
+	}
+	slices.SortFunc(groups, func(a, b *valueKeys) int {
+		return bytes.Compare(a.key, b.key)
+	})
+	return groups
+}
+
+func (s *BadgerDHStore) MergeIndexes(indexes []dhstore.Index) error {
+	for _, index := range indexes {
+		if err := checkMultihash(index.Key); err != nil {
+			return err
+		}
+	}
+	groups := groupByKey(indexes)
+	return s.updateEach(len(groups), func(txn *badger.Txn, i int) error {
+		g := groups[i]
+		merged, err := getValueKeys(txn, g.key)
+		if err != nil {
+			return err
+		}
+		var changed bool
+		for _, evk := range g.values {
+			changed = merged.add(evk) || changed
+		}
+		if !changed {
+			return nil
+		}
+		return txn.Set(g.key, marshalValueKeys(merged.values))
+	})
+}
+
+// DeleteIndexes removes dh-multihash to encrypted-valueKey mappings, and
+// deletes multihashes left with no value keys. This is the inverse of
+// MergeIndexes.
+func (s *BadgerDHStore) DeleteIndexes(indexes []dhstore.Index) error {
+	for _, index := range indexes {
+		if err := checkMultihash(index.Key); err != nil {
+			return err
+		}
+	}
+	groups := groupByKey(indexes)
+	return s.updateEach(len(groups), func(txn *badger.Txn, i int) error {
+		g := groups[i]
+		remaining, err := getValueKeys(txn, g.key)
+		if err != nil {
+			return err
+		}
+		var changed bool
+		for _, evk := range g.values {
+			changed = remaining.remove(evk) || changed
+		}
+		switch {
+		case !changed:
+			return nil
+		case len(remaining.values) == 0:
+			return txn.Delete(g.key)
+		default:
+			return txn.Set(g.key, marshalValueKeys(remaining.values))
+		}
+	})
+}
+
+// getValueKeys reads the value keys stored at the given key, if any.
+func getValueKeys(txn *badger.Txn, key []byte) (*valueKeys, error) {
+	vks := &valueKeys{key: key}
+	item, err := txn.Get(key)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return vks, nil
+		}
+		return nil, err
+	}
+	if err := item.Value(func(b []byte) error {
+		vks.values, err = unmarshalValueKeys(b)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return vks, nil
+}
+
+func (s *BadgerDHStore) PutMetadata(hvk dhstore.HashedValueKey, em dhstore.EncryptedMetadata) error {
+	return s.transact(func(txn *badger.Txn) error {
+		return txn.Set(metadataKey(hvk), em)
+	})
+}
+
+// PutMetadataBatch stores the given metadata records in as few transactions
+// as fit them.
+func (s *BadgerDHStore) PutMetadataBatch(records []dhstore.Metadata) error {
+	return s.updateEach(len(records), func(txn *badger.Txn, i int) error {
+		return txn.Set(metadataKey(records[i].Key), records[i].Value)
+	})
+}
+
+func (s *BadgerDHStore) Lookup(mh multihash.Multihash) ([]dhstore.EncryptedValueKey, error) {
+	if err := checkMultihash(mh); err != nil {
+		return nil, err
+	}
+	var vks *valueKeys
+	if err := s.db.View(func(txn *badger.Txn) error {
+		var err error
+		vks, err = getValueKeys(txn, multihashKey(mh))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if len(vks.values) == 0 {
+		return nil, nil
+	}
+	evks := make([]dhstore.EncryptedValueKey, 0, len(vks.values))
+	for _, value := range vks.values {
+		evks = append(evks, value)
+	}
+	return evks, nil
+}
+
+func (s *BadgerDHStore) GetMetadata(hvk dhstore.HashedValueKey) (dhstore.EncryptedMetadata, error) {
+	var em dhstore.EncryptedMetadata
+	if err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(metadataKey(hvk))
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return nil
+			}
+			return err
+		}
+		em, err = item.ValueCopy(nil)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return em, nil
+}
+
+func (s *BadgerDHStore) DeleteMetadata(hvk dhstore.HashedValueKey) error {
+	return s.transact(func(txn *badger.Txn) error {
+		return txn.Delete(metadataKey(hvk))
+	})
+}
+
+func (s *BadgerDHStore) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return s.db.Close()
+}
+
+func multihashKey(mh multihash.Multihash) []byte {
+	return append([]byte{multihashKeyPrefix}, mh...)
+}
+
+func metadataKey(hvk dhstore.HashedValueKey) []byte {
+	return append([]byte{metadataKeyPrefix}, hvk...)
+}
+
+// marshalValueKeys encodes the given value keys as varint length-prefixed
+// sections.
+func marshalValueKeys(values [][]byte) []byte {
+	var size int
+	for _, value := range values {
+		size += varint.UvarintSize(uint64(len(value))) + len(value)
+	}
+	buf := make([]byte, 0, size)
+	for _, value := range values {
+		buf = append(buf, varint.ToUvarint(uint64(len(value)))...)
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+// unmarshalValueKeys decodes value keys encoded by marshalValueKeys, copying
+// them out of b.
+func unmarshalValueKeys(b []byte) ([][]byte, error) {
+	var values [][]byte
+	for len(b) != 0 {
+		usize, read, err := varint.FromUvarint(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[read:]
+		if usize > uint64(len(b)) {
+			return nil, errCodecOverflow
+		}
+		values = append(values, bytes.Clone(b[:usize]))
+		b = b[usize:]
+	}
+	return values, nil
+}
+
+func checkMultihash(mh multihash.Multihash) error {
+	dmh, err := multihash.Decode(mh)
+	if err != nil {
+		return dhstore.ErrMultihashDecode{Err: err, Mh: mh}
+	}
+	if dmh.Code != multihash.DBL_SHA2_256 {
+		return dhstore.ErrUnsupportedMulticodecCode{Code: multicodec.Code(dmh.Code)}
+	}
+	return nil
+}
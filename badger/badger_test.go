@@ -0,0 +1,84 @@
+package badger_test
+
+import (
+	"testing"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/badger"
+	"github.com/ipni/dhstore/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T, path string) *badger.BadgerDHStore {
+	subject, err := badger.NewBadgerDHStore(path, badger.WithGCInterval(0))
+	require.NoError(t, err)
+	return subject
+}
+
+func TestBadgerDHStore_MergeAndDeleteIndexes(t *testing.T) {
+	path := t.TempDir()
+	subject := newTestStore(t, path)
+	fish, lobster := testutil.RandomDblSha256(t), testutil.RandomDblSha256(t)
+
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("barreleye")},
+		{Key: lobster, Value: []byte("squat")},
+		{Key: fish, Value: []byte("barreleye")},
+	}))
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("anglerfish")},
+		{Key: fish, Value: []byte("dragonfish")},
+	}))
+	got, err := subject.Lookup(fish)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("barreleye"), []byte("anglerfish"), []byte("dragonfish")}, got)
+
+	require.NoError(t, subject.DeleteIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("anglerfish")},
+		{Key: lobster, Value: []byte("squat")},
+		{Key: testutil.RandomDblSha256(t), Value: []byte("vampire")},
+	}))
+	require.NoError(t, subject.Close())
+
+	// Reopen to check that writes were persisted.
+	subject = newTestStore(t, path)
+	defer subject.Close()
+	got, err = subject.Lookup(fish)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("barreleye"), []byte("dragonfish")}, got)
+	got, err = subject.Lookup(lobster)
+	require.NoError(t, err)
+	require.Nil(t, got)
+
+	err = subject.MergeIndexes([]dhstore.Index{{Key: []byte("fish"), Value: []byte("barreleye")}})
+	var decodeErr dhstore.ErrMultihashDecode
+	require.ErrorAs(t, err, &decodeErr)
+}
+
+func TestBadgerDHStore_Metadata(t *testing.T) {
+	subject := newTestStore(t, t.TempDir())
+	defer subject.Close()
+
+	require.NoError(t, subject.PutMetadata([]byte("fish"), []byte("barreleye")))
+	require.NoError(t, subject.PutMetadataBatch([]dhstore.Metadata{
+		{Key: []byte("lobster"), Value: []byte("squat")},
+		{Key: []byte("fish"), Value: []byte("anglerfish")},
+	}))
+	for key, want := range map[string]string{"fish": "anglerfish", "lobster": "squat"} {
+		got, err := subject.GetMetadata([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, dhstore.EncryptedMetadata(want), got)
+	}
+
+	require.NoError(t, subject.DeleteMetadata([]byte("fish")))
+	got, err := subject.GetMetadata([]byte("fish"))
+	require.NoError(t, err)
+	require.Nil(t, got)
+}
+
+func TestNewBadgerDHStore_RejectsInvalidOptions(t *testing.T) {
+	_, err := badger.NewBadgerDHStore(t.TempDir(), badger.WithGCDiscardRatio(1))
+	require.ErrorContains(t, err, "GC discard ratio")
+	_, err = badger.NewBadgerDHStore(t.TempDir(), badger.WithMaxRetries(-1))
+	require.ErrorContains(t, err, "max retries")
+}
@@ -0,0 +1,91 @@
+package badger
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultGCInterval is the default interval at which the value log is
+	// garbage collected.
+	defaultGCInterval = 10 * time.Minute
+	// defaultGCDiscardRatio is the default ratio of stale data in a value log
+	// file at which it is rewritten.
+	defaultGCDiscardRatio = 0.5
+	// defaultMaxRetries is the default maximum number of times a transaction
+	// is retried after a conflict.
+	defaultMaxRetries = 10
+)
+
+type (
+	Option  func(*options) error
+	options struct {
+		gcInterval     time.Duration
+		gcDiscardRatio float64
+		maxRetries     int
+		syncWrites     bool
+	}
+)
+
+func newOptions(o ...Option) (*options, error) {
+	opts := options{
+		gcInterval:     defaultGCInterval,
+		gcDiscardRatio: defaultGCDiscardRatio,
+		maxRetries:     defaultMaxRetries,
+	}
+	for _, apply := range o {
+		if err := apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	return &opts, nil
+}
+
+// WithGCInterval sets the interval at which value log files are garbage
+// collected, reclaiming the space of value keys and metadata that have been
+// overwritten or deleted. Disabled when zero. Defaults to 10 minutes.
+func WithGCInterval(interval time.Duration) Option {
+	return func(o *options) error {
+		if interval < 0 {
+			return fmt.Errorf("GC interval must not be negative, got: %s", interval)
+		}
+		o.gcInterval = interval
+		return nil
+	}
+}
+
+// WithGCDiscardRatio sets the ratio of stale data in a value log file, between
+// 0 and 1 exclusive, at which the file is rewritten during garbage collection.
+// Lower ratios reclaim more space at the cost of more write amplification.
+// Defaults to 0.5.
+func WithGCDiscardRatio(ratio float64) Option {
+	return func(o *options) error {
+		if ratio <= 0 || ratio >= 1 {
+			return fmt.Errorf("GC discard ratio must be between 0 and 1 exclusive, got: %v", ratio)
+		}
+		o.gcDiscardRatio = ratio
+		return nil
+	}
+}
+
+// WithMaxRetries sets the maximum number of times a transaction is retried
+// after failing due to a conflict with concurrent transactions. Defaults to
+// 10.
+func WithMaxRetries(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("max retries must not be negative, got: %d", n)
+		}
+		o.maxRetries = n
+		return nil
+	}
+}
+
+// WithSyncWrites sets whether writes are synced to disk before they are
+// acknowledged. Defaults to false.
+func WithSyncWrites(sync bool) Option {
+	return func(o *options) error {
+		o.syncWrites = sync
+		return nil
+	}
+}
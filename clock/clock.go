@@ -0,0 +1,64 @@
+// Package clock provides the time source used by time-dependent behaviour in
+// dhstore, such as TTLs, caches and periodic jobs.
+//
+// Production code uses the real clock returned by New. Tests use a Mock clock
+// that only moves when explicitly advanced, which makes time-based behaviour
+// deterministic without sleeping. Long-running soak tests may use a Scaled
+// clock that runs faster than wall time.
+package clock
+
+import (
+	"time"
+)
+
+var _ Clock = (*realClock)(nil)
+
+type (
+	// Clock is a source of time and of timer events.
+	Clock interface {
+		// Now returns the current time.
+		Now() time.Time
+		// Since returns the time elapsed since t.
+		Since(t time.Time) time.Duration
+		// After waits for the duration to elapse and then sends the current
+		// time on the returned channel.
+		After(d time.Duration) <-chan time.Time
+		// Sleep pauses the calling goroutine for at least the duration d.
+		Sleep(d time.Duration)
+		// NewTicker returns a new Ticker that ticks every d.
+		NewTicker(d time.Duration) Ticker
+		// NewTimer returns a new Timer that fires once after d.
+		NewTimer(d time.Duration) Timer
+	}
+	// Ticker delivers ticks at intervals; see time.Ticker.
+	Ticker interface {
+		C() <-chan time.Time
+		Reset(d time.Duration)
+		Stop()
+	}
+	// Timer delivers a single event after a duration; see time.Timer.
+	Timer interface {
+		C() <-chan time.Time
+		Reset(d time.Duration) bool
+		Stop() bool
+	}
+
+	realClock  struct{}
+	realTicker struct{ *time.Ticker }
+	realTimer  struct{ *time.Timer }
+)
+
+// New returns a Clock backed by the system time.
+func New() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+func (t realTimer) C() <-chan time.Time  { return t.Timer.C }
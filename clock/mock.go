@@ -0,0 +1,201 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	_ Clock  = (*Mock)(nil)
+	_ Ticker = (*mockTicker)(nil)
+	_ Timer  = (*mockTimer)(nil)
+)
+
+type (
+	// Mock is a Clock whose time only moves when advanced by Add or Set.
+	// Timers and tickers created from it fire synchronously as the mock time
+	// passes their deadline, which makes time-based behaviour testable without
+	// sleeping.
+	Mock struct {
+		mu      sync.Mutex
+		now     time.Time
+		waiters []*mockWaiter
+	}
+	mockWaiter struct {
+		deadline time.Time
+		// period is non-zero for tickers.
+		period time.Duration
+		c      chan time.Time
+		active bool
+	}
+	mockTicker struct {
+		m *Mock
+		w *mockWaiter
+	}
+	mockTimer struct {
+		m *Mock
+		w *mockWaiter
+	}
+)
+
+// NewMock returns a Mock clock set to the given start time.
+func NewMock(start time.Time) *Mock {
+	return &Mock{now: start}
+}
+
+func (m *Mock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+func (m *Mock) Since(t time.Time) time.Duration {
+	return m.Now().Sub(t)
+}
+
+func (m *Mock) After(d time.Duration) <-chan time.Time {
+	return m.NewTimer(d).C()
+}
+
+// Sleep blocks until the mock time has been advanced by at least d.
+func (m *Mock) Sleep(d time.Duration) {
+	<-m.After(d)
+}
+
+func (m *Mock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return &mockTicker{m: m, w: m.addWaiter(d, d)}
+}
+
+func (m *Mock) NewTimer(d time.Duration) Timer {
+	return &mockTimer{m: m, w: m.addWaiter(d, 0)}
+}
+
+// Add advances the mock time by d, firing any timers and tickers whose
+// deadlines are reached along the way in deadline order.
+func (m *Mock) Add(d time.Duration) {
+	m.Set(m.Now().Add(d))
+}
+
+// Set moves the mock time to t, firing any timers and tickers whose deadlines
+// are reached along the way in deadline order. Moving the time backwards
+// fires nothing.
+func (m *Mock) Set(t time.Time) {
+	for {
+		m.mu.Lock()
+		next := m.nextWaiter(t)
+		if next == nil {
+			if t.After(m.now) {
+				m.now = t
+			}
+			m.mu.Unlock()
+			return
+		}
+		m.now = next.deadline
+		if next.period > 0 {
+			next.deadline = next.deadline.Add(next.period)
+		} else {
+			next.active = false
+		}
+		m.removeInactive()
+		now := m.now
+		m.mu.Unlock()
+
+		// Drop the tick if the receiver is not keeping up, like time.Ticker.
+		select {
+		case next.c <- now:
+		default:
+		}
+	}
+}
+
+// nextWaiter returns the active waiter with the earliest deadline at or
+// before t, or nil if there is none.
+func (m *Mock) nextWaiter(t time.Time) *mockWaiter {
+	sort.SliceStable(m.waiters, func(i, j int) bool {
+		return m.waiters[i].deadline.Before(m.waiters[j].deadline)
+	})
+	for _, w := range m.waiters {
+		if w.active && !w.deadline.After(t) {
+			return w
+		}
+	}
+	return nil
+}
+
+func (m *Mock) addWaiter(d, period time.Duration) *mockWaiter {
+	m.mu.Lock()
+	w := &mockWaiter{
+		deadline: m.now.Add(d),
+		period:   period,
+		c:        make(chan time.Time, 1),
+		active:   true,
+	}
+	m.waiters = append(m.waiters, w)
+	m.mu.Unlock()
+	if d <= 0 {
+		// Fire immediately, like time.NewTimer with a non-positive duration.
+		m.Add(0)
+	}
+	return w
+}
+
+// reset reschedules w to fire d from now and reports whether it was active.
+func (m *Mock) reset(w *mockWaiter, d time.Duration, period time.Duration) bool {
+	m.mu.Lock()
+	wasActive := w.active
+	w.deadline = m.now.Add(d)
+	w.period = period
+	if !wasActive {
+		w.active = true
+		m.waiters = append(m.waiters, w)
+	}
+	m.mu.Unlock()
+	if d <= 0 {
+		m.Add(0)
+	}
+	return wasActive
+}
+
+// stop deactivates w and reports whether it was active.
+func (m *Mock) stop(w *mockWaiter) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wasActive := w.active
+	w.active = false
+	m.removeInactive()
+	return wasActive
+}
+
+func (m *Mock) removeInactive() {
+	active := m.waiters[:0]
+	for _, w := range m.waiters {
+		if w.active {
+			active = append(active, w)
+		}
+	}
+	for i := len(active); i < len(m.waiters); i++ {
+		m.waiters[i] = nil
+	}
+	m.waiters = active
+}
+
+func (t *mockTicker) C() <-chan time.Time { return t.w.c }
+
+func (t *mockTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for Ticker.Reset")
+	}
+	t.m.reset(t.w, d, d)
+}
+
+func (t *mockTicker) Stop() { t.m.stop(t.w) }
+
+func (t *mockTimer) C() <-chan time.Time { return t.w.c }
+
+func (t *mockTimer) Reset(d time.Duration) bool { return t.m.reset(t.w, d, 0) }
+
+func (t *mockTimer) Stop() bool { return t.m.stop(t.w) }
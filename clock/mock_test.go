@@ -0,0 +1,67 @@
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMock_TimerFiresOnlyWhenAdvanced(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	subject := clock.NewMock(start)
+
+	timer := subject.NewTimer(time.Minute)
+	subject.Add(59 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired before deadline")
+	default:
+	}
+
+	subject.Add(time.Second)
+	select {
+	case got := <-timer.C():
+		require.Equal(t, start.Add(time.Minute), got)
+	default:
+		t.Fatal("timer did not fire at deadline")
+	}
+	require.False(t, timer.Stop())
+	require.Equal(t, time.Minute, subject.Since(start))
+}
+
+func TestMock_TickerFiresInOrder(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	subject := clock.NewMock(start)
+
+	ticker := subject.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	timer := subject.NewTimer(15 * time.Second)
+
+	var got []time.Time
+	subject.Add(10 * time.Second)
+	got = append(got, <-ticker.C())
+	subject.Add(10 * time.Second)
+	got = append(got, <-ticker.C())
+
+	require.Equal(t, []time.Time{start.Add(10 * time.Second), start.Add(20 * time.Second)}, got)
+	require.Equal(t, start.Add(15*time.Second), <-timer.C())
+}
+
+func TestMock_StopAndReset(t *testing.T) {
+	subject := clock.NewMock(time.Unix(0, 0))
+
+	timer := subject.NewTimer(time.Second)
+	require.True(t, timer.Stop())
+	subject.Add(time.Hour)
+	select {
+	case <-timer.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	require.False(t, timer.Reset(time.Second))
+	subject.Add(time.Second)
+	require.Equal(t, time.Unix(0, 0).Add(time.Hour+time.Second), <-timer.C())
+}
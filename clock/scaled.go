@@ -0,0 +1,131 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+var _ Clock = (*Scaled)(nil)
+
+// Scaled is a Clock that runs faster (or slower) than wall time by a constant
+// factor. It is intended for soak tests that need to exercise hours of
+// time-based behaviour, such as TTL expiry and periodic jobs, in minutes.
+type Scaled struct {
+	start  time.Time
+	factor float64
+}
+
+// NewScaled returns a Clock that starts at the current time and advances
+// factor times faster than wall time. A factor of 60, for example, makes one
+// minute pass every wall second. It panics if factor is not positive.
+func NewScaled(factor float64) *Scaled {
+	if factor <= 0 {
+		panic("clock: scale factor must be positive")
+	}
+	return &Scaled{
+		start:  time.Now(),
+		factor: factor,
+	}
+}
+
+func (s *Scaled) Now() time.Time {
+	elapsed := time.Since(s.start)
+	return s.start.Add(time.Duration(float64(elapsed) * s.factor))
+}
+
+func (s *Scaled) Since(t time.Time) time.Duration {
+	return s.Now().Sub(t)
+}
+
+func (s *Scaled) After(d time.Duration) <-chan time.Time {
+	return s.NewTimer(d).C()
+}
+
+func (s *Scaled) Sleep(d time.Duration) {
+	time.Sleep(s.wallDuration(d))
+}
+
+func (s *Scaled) NewTicker(d time.Duration) Ticker {
+	t := &scaledTicker{
+		s:    s,
+		t:    time.NewTicker(s.wallDuration(d)),
+		c:    make(chan time.Time, 1),
+		done: make(chan struct{}),
+	}
+	go t.relay()
+	return t
+}
+
+func (s *Scaled) NewTimer(d time.Duration) Timer {
+	t := &scaledTimer{s: s, c: make(chan time.Time, 1)}
+	t.t = time.AfterFunc(s.wallDuration(d), t.fire)
+	return t
+}
+
+// wallDuration converts a duration in scaled time to wall time.
+func (s *Scaled) wallDuration(d time.Duration) time.Duration {
+	wd := time.Duration(float64(d) / s.factor)
+	if d > 0 && wd <= 0 {
+		wd = 1
+	}
+	return wd
+}
+
+type (
+	scaledTicker struct {
+		s    *Scaled
+		t    *time.Ticker
+		c    chan time.Time
+		done chan struct{}
+		stop sync.Once
+	}
+	scaledTimer struct {
+		s *Scaled
+		t *time.Timer
+		c chan time.Time
+	}
+)
+
+// C returns the ticker channel. Ticks carry the scaled time at which they
+// were delivered rather than the wall time.
+func (t *scaledTicker) C() <-chan time.Time { return t.c }
+
+func (t *scaledTicker) relay() {
+	for {
+		select {
+		case <-t.t.C:
+			select {
+			case t.c <- t.s.Now():
+			default:
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *scaledTicker) Reset(d time.Duration) {
+	t.t.Reset(t.s.wallDuration(d))
+}
+
+func (t *scaledTicker) Stop() {
+	t.t.Stop()
+	t.stop.Do(func() { close(t.done) })
+}
+
+func (t *scaledTimer) fire() {
+	select {
+	case t.c <- t.s.Now():
+	default:
+	}
+}
+
+func (t *scaledTimer) C() <-chan time.Time { return t.c }
+
+func (t *scaledTimer) Reset(d time.Duration) bool {
+	return t.t.Reset(t.s.wallDuration(d))
+}
+
+func (t *scaledTimer) Stop() bool {
+	return t.t.Stop()
+}
@@ -0,0 +1,92 @@
+package main
+
+import "flag"
+
+// systemResources are the resources of the host available to dhstore, as far
+// as they are known.
+type systemResources struct {
+	// memory is the memory in bytes available to the process, or zero if
+	// unknown.
+	memory uint64
+	// cpus is the number of CPUs available to the process.
+	cpus int
+	// disk is the type of the disk of the store; one of "ssd", "hdd" or empty
+	// if unknown.
+	disk string
+}
+
+// pebbleTuning are the pebble options derived from systemResources by
+// tunePebble. Zero values are not tuned.
+type pebbleTuning struct {
+	blockCacheSize           uint64
+	memTableSize             uint64
+	maxConcurrentCompactions int
+	l0CompactionThreshold    int
+	l0StopWritesThreshold    int
+}
+
+// tunePebble derives pebble options from the resources of the host.
+func tunePebble(r systemResources) pebbleTuning {
+	var t pebbleTuning
+	if r.memory != 0 {
+		// A quarter of memory for the block cache, as cockroachdb does by
+		// default, leaving the rest to memtables, the page cache and the heap.
+		t.blockCacheSize = r.memory / 4
+		// Up to MemTableStopWritesThreshold, i.e. 4, memtables are held at
+		// once, which are kept within an eighth of memory each, so that they
+		// take at most half of memory even on small hosts, and along with
+		// the block cache leave a quarter to the rest.
+		t.memTableSize = min(max(r.memory/64, 64<<20), 512<<20, r.memory/8)
+	}
+	cpus := max(r.cpus, 1)
+	if r.disk == "hdd" {
+		// Concurrent compactions contend for seeks on spinning disks, so
+		// compact fewer, larger batches of L0 files and tolerate a longer L0
+		// backlog before stalling writes.
+		t.maxConcurrentCompactions = min(cpus, 2)
+		t.l0CompactionThreshold = 4
+		t.l0StopWritesThreshold = 24
+	} else {
+		// L0 is drained in parallel by concurrent compactions, so a longer
+		// backlog can be tolerated the more there are.
+		t.maxConcurrentCompactions = cpus
+		t.l0CompactionThreshold = 2
+		t.l0StopWritesThreshold = max(12, 2*cpus)
+	}
+	return t
+}
+
+// autoTunePebble overrides the pebble options that are not explicitly set by
+// the flags of fs with the ones derived from the resources of the host of the
+// store at path, and logs the chosen values.
+func autoTunePebble(fs *flag.FlagSet, path string, blockCacheSize, memTableSize *uint64) {
+	r := detectResources(path)
+	t := tunePebble(r)
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if t.blockCacheSize != 0 && !set["blockCacheSize"] {
+		*blockCacheSize = t.blockCacheSize
+	}
+	if t.memTableSize != 0 {
+		*memTableSize = t.memTableSize
+	}
+	if !set["maxConcurrentCompactions"] {
+		maxConcurrentCompactions = t.maxConcurrentCompactions
+	}
+	if !set["l0CompactionThreshold"] {
+		*l0CompactionThreshold = t.l0CompactionThreshold
+	}
+	if !set["l0StopWritesThreshold"] {
+		*l0StopWritesThreshold = t.l0StopWritesThreshold
+	}
+	log.Infow("Auto-tuned pebble options",
+		"memory", r.memory,
+		"cpus", r.cpus,
+		"disk", r.disk,
+		"blockCacheSize", *blockCacheSize,
+		"memTableSize", *memTableSize,
+		"maxConcurrentCompactions", maxConcurrentCompactions,
+		"l0CompactionThreshold", *l0CompactionThreshold,
+		"l0StopWritesThreshold", *l0StopWritesThreshold)
+}
@@ -0,0 +1,120 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// detectResources detects the memory and CPUs available to the process, as
+// limited by its cgroup, if any, and whether the disk of the store at path is
+// rotational.
+func detectResources(path string) systemResources {
+	r := systemResources{
+		memory: memTotal(),
+		cpus:   runtime.NumCPU(),
+		disk:   diskType(path),
+	}
+	for _, limitPath := range []string{
+		"/sys/fs/cgroup/memory.max",                   // cgroup v2
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes", // cgroup v1
+	} {
+		if limit, err := readUint(limitPath); err == nil && limit != 0 && (r.memory == 0 || limit < r.memory) {
+			r.memory = limit
+		}
+	}
+	// The CPU quota of cgroup v2 is given as "<quota> <period>", or "max".
+	if b, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		if fields := strings.Fields(string(b)); len(fields) == 2 {
+			quota, qerr := strconv.ParseUint(fields[0], 10, 64)
+			period, perr := strconv.ParseUint(fields[1], 10, 64)
+			if qerr == nil && perr == nil && period != 0 {
+				r.cpus = min(r.cpus, max(int((quota+period-1)/period), 1))
+			}
+		}
+	}
+	return r
+}
+
+// memTotal returns the total memory of the host, or zero if unknown.
+func memTotal() uint64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// E.g. "MemTotal:        6158152 kB".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb << 10
+		}
+	}
+	return 0
+}
+
+// diskType returns "hdd" if the block device of the nearest existing
+// directory of path is rotational, "ssd" if not, or empty if unknown, e.g. for
+// overlay and network file systems.
+func diskType(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	var st syscall.Stat_t
+	for {
+		if err = syscall.Stat(path, &st); !errors.Is(err, syscall.ENOENT) {
+			break
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		path = parent
+	}
+	if err != nil {
+		return ""
+	}
+	// Dev is uint32 on some platforms.
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	sysPath := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+	// Partitions have no queue of their own, but share that of their disk.
+	for _, queue := range []string{"queue/rotational", "../queue/rotational"} {
+		// Not joined by filepath.Join, which would resolve .. lexically rather
+		// than relative to the target of the sysPath symlink.
+		rotational, err := readUint(sysPath + "/" + queue)
+		if err != nil {
+			continue
+		}
+		if rotational == 1 {
+			return "hdd"
+		}
+		return "ssd"
+	}
+	return ""
+}
+
+// readUint reads the unsigned integer in the file at path, as found in sysfs
+// and cgroupfs.
+func readUint(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "runtime"
+
+// detectResources detects the CPUs available to the process. Memory and disk
+// type are only detected on Linux.
+func detectResources(string) systemResources {
+	return systemResources{cpus: runtime.NumCPU()}
+}
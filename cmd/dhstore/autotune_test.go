@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunePebble(t *testing.T) {
+	const gi = 1 << 30
+	tests := []struct {
+		name string
+		r    systemResources
+		want pebbleTuning
+	}{
+		{
+			name: "ssd with large memory",
+			r:    systemResources{memory: 64 * gi, cpus: 16, disk: "ssd"},
+			want: pebbleTuning{blockCacheSize: 16 * gi, memTableSize: 512 << 20, maxConcurrentCompactions: 16, l0CompactionThreshold: 2, l0StopWritesThreshold: 32},
+		},
+		{
+			name: "ssd with moderate memory",
+			r:    systemResources{memory: 8 * gi, cpus: 4, disk: "ssd"},
+			want: pebbleTuning{blockCacheSize: 2 * gi, memTableSize: 128 << 20, maxConcurrentCompactions: 4, l0CompactionThreshold: 2, l0StopWritesThreshold: 12},
+		},
+		{
+			name: "ssd with small memory",
+			r:    systemResources{memory: 256 << 20, cpus: 1, disk: "ssd"},
+			want: pebbleTuning{blockCacheSize: 64 << 20, memTableSize: 32 << 20, maxConcurrentCompactions: 1, l0CompactionThreshold: 2, l0StopWritesThreshold: 12},
+		},
+		{
+			name: "hdd with large memory",
+			r:    systemResources{memory: 64 * gi, cpus: 16, disk: "hdd"},
+			want: pebbleTuning{blockCacheSize: 16 * gi, memTableSize: 512 << 20, maxConcurrentCompactions: 2, l0CompactionThreshold: 4, l0StopWritesThreshold: 24},
+		},
+		{
+			name: "hdd with small memory",
+			r:    systemResources{memory: 512 << 20, cpus: 1, disk: "hdd"},
+			want: pebbleTuning{blockCacheSize: 128 << 20, memTableSize: 64 << 20, maxConcurrentCompactions: 1, l0CompactionThreshold: 4, l0StopWritesThreshold: 24},
+		},
+		{
+			name: "unknown memory and disk",
+			r:    systemResources{cpus: 8},
+			want: pebbleTuning{maxConcurrentCompactions: 8, l0CompactionThreshold: 2, l0StopWritesThreshold: 16},
+		},
+		{
+			name: "unknown cpus",
+			r:    systemResources{memory: 4 * gi},
+			want: pebbleTuning{blockCacheSize: gi, memTableSize: 64 << 20, maxConcurrentCompactions: 1, l0CompactionThreshold: 2, l0StopWritesThreshold: 12},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := tunePebble(test.r)
+			require.Equal(t, test.want, got)
+			// The block cache and the memtables held at once leave a
+			// quarter of memory to the rest.
+			require.LessOrEqual(t, got.blockCacheSize+4*got.memTableSize, test.r.memory*3/4)
+		})
+	}
+}
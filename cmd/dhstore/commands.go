@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+	"github.com/urfave/cli/v2"
+)
+
+// errUsage is returned by commands given invalid flags, whose usage has
+// already been shown.
+var errUsage = errors.New("invalid usage")
+
+// command is a command of dhstore, whose flags are registered on a flag set of
+// its own, so that each command only accepts the flags it reads.
+type command struct {
+	name  string
+	usage string
+	args  string
+	// flags register the flags of the command on top of the log flags,
+	// which are shared by all commands.
+	flags []func(*flag.FlagSet)
+	// action runs the command with its flag set and arguments, from which it
+	// parses its flags via parseFlags.
+	action func(fs *flag.FlagSet, args []string) error
+}
+
+// commands are the commands of dhstore.
+var commands = []command{
+	{"serve", "Serve the store over HTTP, and optionally gRPC", "",
+		[]func(*flag.FlagSet){storeFlags, writeFlags, auditFlags, mirrorFlags, authFlags, tlsFlags, reloadFlags}, serve},
+	{"backup", "Write a consistent copy of a pebble store to a directory", "",
+		[]func(*flag.FlagSet){storeFlags}, backup},
+	{"restore", "Restore a pebble store from a copy written by backup", "",
+		[]func(*flag.FlagSet){storeFlags}, restore},
+	{"compact", "Compact the entire key space of a pebble store", "",
+		[]func(*flag.FlagSet){storeFlags}, compact},
+	{"check", "Verify the consistency of the store", "",
+		[]func(*flag.FlagSet){storeFlags}, check},
+	{"export", "Export the records of the store to shard files", "",
+		[]func(*flag.FlagSet){storeFlags}, export},
+	{"import", "Import the records of shard files into the store", " <shard>...",
+		[]func(*flag.FlagSet){storeFlags, writeFlags, auditFlags}, importRecords},
+	{"migrate", "Migrate the data of the store to the current format", "",
+		[]func(*flag.FlagSet){storeFlags}, migrate},
+	{"version", "Show version and build information", "", nil, showVersion},
+}
+
+// newApp returns the CLI of dhstore, whose commands take the flags of the
+// standard flag package, so that they can be set via environment variables.
+// Flags are parsed by each command rather than by the CLI, which only
+// dispatches to them.
+func newApp() *cli.App {
+	app := &cli.App{
+		Name:            "dhstore",
+		Usage:           "Store of double hashed IPNI index records",
+		HideHelpCommand: true,
+		HideVersion:     true,
+	}
+	for _, c := range commands {
+		app.Commands = append(app.Commands, &cli.Command{
+			Name:            c.name,
+			Usage:           c.usage,
+			UsageText:       "dhstore " + c.name + " [flags]" + c.args,
+			Description:     "Run 'dhstore " + c.name + " -h' for the flags of the command.",
+			SkipFlagParsing: true,
+			HideHelp:        true,
+			Action: func(cctx *cli.Context) error {
+				fs := flag.NewFlagSet("dhstore "+c.name, flag.ContinueOnError)
+				fs.SetOutput(cctx.App.ErrWriter)
+				logFlags(fs)
+				for _, register := range c.flags {
+					register(fs)
+				}
+				return c.action(fs, cctx.Args().Slice())
+			},
+		})
+	}
+	return app
+}
+
+func showVersion(fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, "", args); err != nil {
+		return err
+	}
+	printVersion()
+	return nil
+}
+
+// printVersion prints the build information of dhstore, along with the
+// formats of the stores it supports.
+func printVersion() {
+	fmt.Println(dhstore.ReadBuildInfo())
+	formats := []string{fmt.Sprintf("pebble %s-%s", pebble.FormatMostCompatible, pebble.FormatNewest)}
+	if f := fdbStoreFormat(); f != "" {
+		formats = append(formats, f)
+	}
+	fmt.Println("store formats: " + strings.Join(formats, ", "))
+}
+
+// withDefaultCommand returns the arguments of the process with the serve
+// command inserted if no command is given, so that dhstore is invoked as it
+// was before it had commands.
+func withDefaultCommand(args []string) []string {
+	if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		return args
+	}
+	if len(args) > 1 {
+		switch args[1] {
+		case "-h", "-help", "--help":
+			return args
+		}
+	}
+	return append([]string{args[0], "serve"}, args[1:]...)
+}
+
+// parseFlags parses the flags of fs from args and from the environment, and
+// applies the log format, file and level. Usage is shown for args, e.g. the
+// positional arguments of the command, on error or -h, upon which errUsage or
+// flag.ErrHelp is returned.
+func parseFlags(fs *flag.FlagSet, usage string, args []string) error {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags]%s\n", fs.Name(), usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if err := setFlagsFromEnv(fs, os.LookupEnv); err != nil {
+		return fmt.Errorf("failed to set flags from environment: %w", err)
+	}
+	if err := setupLogOutput(os.LookupEnv); err != nil {
+		return fmt.Errorf("failed to set up logging: %w", err)
+	}
+	if _, set := os.LookupEnv("GOLOG_LOG_LEVEL"); !set {
+		_ = logging.SetLogLevel("*", *logLevel)
+	}
+	return nil
+}
+
+// withStore opens the store selected by the flags of fs, calls f with it, and
+// closes it, returning the error of f, if any, or else of closing the store.
+func withStore(fs *flag.FlagSet, f func(dhstore.DHStore) error) error {
+	store := openStore(fs).store
+	err := f(store)
+	if cerr := store.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func backup(fs *flag.FlagSet, args []string) error {
+	dir := fs.String("dir", "", "Required. The directory to which to write the copy of the store, which must not exist. Files are hard-linked where possible, so the directory is best on the same volume as storePath.")
+	if err := parseFlags(fs, "", args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("dir must be set")
+	}
+	// Pebble fails to sync the parent directory of relative paths without
+	// one, e.g. backup.
+	path, err := filepath.Abs(*dir)
+	if err != nil {
+		return err
+	}
+	return withStore(fs, func(store dhstore.DHStore) error {
+		c, ok := store.(interface{ Checkpoint(dir string) error })
+		if !ok {
+			return errors.New("backup is not supported by store")
+		}
+		start := time.Now()
+		if err := c.Checkpoint(path); err != nil {
+			return err
+		}
+		log.Infow("Backed up store", "dir", path, "took", time.Since(start))
+		return nil
+	})
+}
+
+func restore(fs *flag.FlagSet, args []string) error {
+	from := fs.String("from", "", "Required. The directory of the copy of the store written by backup from which to restore the store at storePath, which must not exist.")
+	if err := parseFlags(fs, "", args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return errors.New("from must be set")
+	}
+	if *storeType != "pebble" {
+		return errors.New("restore is only supported by pebble")
+	}
+	path := filepath.Clean(*storePath)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("store path already exists: %s", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Copy to a temporary directory first, so that a failed restore does not
+	// leave a partial store behind at storePath.
+	tmp := path + ".restore"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := copyDir(*from, tmp); err != nil {
+		_ = os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	log.Infow("Restored store", "from", *from, "path", path, "took", time.Since(start))
+	return nil
+}
+
+// copyDir recursively copies the regular files and directories of src to dst.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("not a regular file: %s", path)
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func compact(fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, "", args); err != nil {
+		return err
+	}
+	return withStore(fs, func(store dhstore.DHStore) error {
+		c, ok := store.(interface{ Compact() error })
+		if !ok {
+			return errors.New("compaction is not supported by store")
+		}
+		log.Info("Compacting store")
+		start := time.Now()
+		if err := c.Compact(); err != nil {
+			return err
+		}
+		log.Infow("Compacted store", "took", time.Since(start))
+		return nil
+	})
+}
+
+func check(fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, "", args); err != nil {
+		return err
+	}
+	return withStore(fs, func(store dhstore.DHStore) error {
+		start := time.Now()
+		var checked int64
+		switch s := store.(type) {
+		case interface{ Check() (int64, error) }:
+			var err error
+			if checked, err = s.Check(); err != nil {
+				return err
+			}
+		case dhstore.Exporter:
+			// Stores that cannot check themselves are checked by reading
+			// every record.
+			if err := s.Export(context.Background(), dhstore.ExportOptions{}, func(dhstore.ExportRecord) error {
+				checked++
+				return nil
+			}); err != nil {
+				return err
+			}
+		default:
+			return errors.New("check is not supported by store")
+		}
+		log.Infow("Checked store", "checked", checked, "took", time.Since(start))
+		return nil
+	})
+}
+
+func export(fs *flag.FlagSet, args []string) error {
+	dir := fs.String("dir", "", "Required. Path to a directory to which to export the records of the store as shards, loadable via the import command.")
+	shards := fs.Int("shards", 16, "The number of shards exported in parallel, each covering a distinct range of digests.")
+	format := fs.String("format", "ndjson", "The format of the exported shards; one of `ndjson`, `binary` or `segment`. Binary shards are more compact and faster to import than ndjson. Segments can be served from S3 by the `s3` store type. Only pebble exports are supported as segments.")
+	if err := parseFlags(fs, "", args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("dir must be set")
+	}
+	return withStore(fs, func(store dhstore.DHStore) error {
+		return exportShardFiles(store, *dir, *shards, *format)
+	})
+}
+
+func importRecords(fs *flag.FlagSet, args []string) error {
+	workers := fs.Int("workers", runtime.NumCPU(), "The number of parallel workers that load the shards, each loading a distinct range of digests.")
+	ingest := fs.Bool("ingest", false, "Whether to load the shards by ingesting SSTs rather than through the regular write path. Only supported by pebble.")
+	if err := parseFlags(fs, " <shard>...", args); err != nil {
+		return err
+	}
+	paths := fs.Args()
+	if len(paths) == 0 {
+		return errors.New("at least one shard must be given")
+	}
+	valueKeySize, err := valueKeySizeLimit(fs, fdbMaxValueKeySize())
+	if err != nil {
+		return err
+	}
+	auditLog, err := newAuditLog()
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if auditLog != nil {
+		defer auditLog.Close()
+	}
+	return withStore(fs, func(store dhstore.DHStore) error {
+		return importShardFiles(store, paths, *workers, *ingest, valueKeySize, auditLog)
+	})
+}
+
+func migrate(fs *flag.FlagSet, args []string) error {
+	if err := parseFlags(fs, "", args); err != nil {
+		return err
+	}
+	// Opening an FDB store migrates its layout when set.
+	migrateLayout = true
+	return withStore(fs, func(store dhstore.DHStore) error {
+		u, ok := store.(interface {
+			UpgradeFormat() (from, to pebble.FormatMajorVersion, err error)
+		})
+		if !ok {
+			log.Info("Store is in the current format")
+			return nil
+		}
+		from, to, err := u.UpgradeFormat()
+		if err != nil {
+			return err
+		}
+		log.Infow("Migrated store format", "from", from, "to", to)
+		return nil
+	})
+}
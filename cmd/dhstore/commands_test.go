@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithDefaultCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"no args", []string{"dhstore"}, []string{"dhstore", "serve"}},
+		{"flags only", []string{"dhstore", "-storePath", "x"}, []string{"dhstore", "serve", "-storePath", "x"}},
+		{"command", []string{"dhstore", "compact", "-storePath", "x"}, []string{"dhstore", "compact", "-storePath", "x"}},
+		{"help", []string{"dhstore", "-h"}, []string{"dhstore", "-h"}},
+		{"long help", []string{"dhstore", "--help"}, []string{"dhstore", "--help"}},
+		{"serve help", []string{"dhstore", "-listenAddr", "x", "-h"}, []string{"dhstore", "serve", "-listenAddr", "x", "-h"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.want, withDefaultCommand(test.args))
+		})
+	}
+}
+
+// runApp runs the CLI with args, returning what it wrote and its error.
+func runApp(args ...string) (string, error) {
+	var out bytes.Buffer
+	app := newApp()
+	app.Writer = &out
+	app.ErrWriter = &out
+	err := app.Run(withDefaultCommand(append([]string{"dhstore"}, args...)))
+	return out.String(), err
+}
+
+// hasFlag returns whether the usage lists the named flag.
+func hasFlag(usage, name string) bool {
+	return strings.Contains(usage, "\n  "+name+" ") || strings.Contains(usage, "\n  "+name+"\n")
+}
+
+func TestCommandFlags(t *testing.T) {
+	tests := []struct {
+		command string
+		has     []string
+		hasNot  []string
+	}{
+		{"serve", []string{"-listenAddr", "-storePath", "-auditLog", "-authTokensFile", "-mirrorStoreType", "-tlsCert", "-runtimeTunables", "-logLevel"}, nil},
+		{"backup", []string{"-dir", "-storePath", "-logLevel"}, []string{"-listenAddr", "-auditLog", "-authTokensFile"}},
+		{"restore", []string{"-from", "-storePath"}, []string{"-listenAddr", "-dir"}},
+		{"compact", []string{"-storeType", "-storePath", "-blockCacheSize", "-logFormat"}, []string{"-listenAddr", "-auditLog", "-tlsCert", "-mirrorStoreType"}},
+		{"check", []string{"-storeType", "-storePath"}, []string{"-listenAddr", "-providersURL"}},
+		{"export", []string{"-dir", "-shards", "-format", "-storePath"}, []string{"-listenAddr", "-exportDir"}},
+		{"import", []string{"-workers", "-ingest", "-auditLog", "-maxValueKeySize", "-storePath"}, []string{"-listenAddr", "-importShard"}},
+		{"migrate", []string{"-storePath"}, []string{"-listenAddr"}},
+		{"version", []string{"-logLevel"}, []string{"-storePath", "-listenAddr"}},
+	}
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			usage, err := runApp(test.command, "-h")
+			require.ErrorIs(t, err, flag.ErrHelp)
+			require.Contains(t, usage, "Usage: dhstore "+test.command+" [flags]")
+			for _, f := range test.has {
+				require.True(t, hasFlag(usage, f), "missing %s", f)
+			}
+			for _, f := range test.hasNot {
+				require.False(t, hasFlag(usage, f), "unexpected %s", f)
+			}
+		})
+	}
+}
+
+func TestCommandDispatch(t *testing.T) {
+	t.Run("default command is serve", func(t *testing.T) {
+		usage, err := runApp("-h")
+		require.NoError(t, err)
+		require.Contains(t, usage, "COMMANDS:")
+
+		usage, err = runApp("-listenAddr", "0.0.0.0:0", "-h")
+		require.ErrorIs(t, err, flag.ErrHelp)
+		require.Contains(t, usage, "Usage: dhstore serve [flags]")
+	})
+
+	t.Run("unknown flag is rejected", func(t *testing.T) {
+		usage, err := runApp("compact", "-listenAddr", "0.0.0.0:0")
+		require.ErrorIs(t, err, errUsage)
+		require.Contains(t, usage, "flag provided but not defined: -listenAddr")
+		require.Contains(t, usage, "Usage: dhstore compact [flags]")
+	})
+
+	t.Run("command runs its action", func(t *testing.T) {
+		_, err := runApp("backup")
+		require.EqualError(t, err, "dir must be set")
+
+		_, err = runApp("import", "-workers", "2")
+		require.EqualError(t, err, "at least one shard must be given")
+	})
+
+	t.Run("positional arguments are passed", func(t *testing.T) {
+		usage, err := runApp("import", "-h")
+		require.ErrorIs(t, err, flag.ErrHelp)
+		require.Contains(t, usage, "Usage: dhstore import [flags] <shard>...")
+	})
+}
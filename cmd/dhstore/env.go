@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// envPrefix is the prefix of the environment variables from which flags are
+// set.
+const envPrefix = "DHSTORE_"
+
+// envName returns the name of the environment variable from which the flag of
+// the given name is set, i.e. the name in upper snake case prefixed with
+// envPrefix, e.g. DHSTORE_S3_ACCESS_KEY_ID for s3AccessKeyID.
+func envName(flagName string) string {
+	runes := []rune(flagName)
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			// Break words before an upper case letter that follows a lower
+			// case letter or a digit, e.g. storePath, or that starts a word
+			// after an acronym, e.g. the S of dhfindTLSSessionCacheSize.
+			if !unicode.IsUpper(prev) || (i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// setFlagsFromEnv sets the flags of fs that were not set on the command line
+// from the environment variables named after them by envName, as looked up by
+// lookupEnv, so that containers can be configured without templating their
+// arguments. Flags that may be repeated are set to each of the whitespace
+// separated values of their variable. The version flag is never set, since it
+// is an action rather than an option.
+func setFlagsFromEnv(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || f.Name == "version" {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := lookupEnv(name)
+		if !ok {
+			return
+		}
+		values := []string{value}
+		if _, repeated := f.Value.(*arrayFlags); repeated {
+			values = strings.Fields(value)
+		}
+		for _, v := range values {
+			if serr := fs.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("invalid value %q of %s for flag -%s: %w", v, name, f.Name, serr)
+				return
+			}
+		}
+	})
+	return err
+}
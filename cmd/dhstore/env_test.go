@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"storePath":                 "DHSTORE_STORE_PATH",
+		"s3AccessKeyID":             "DHSTORE_S3_ACCESS_KEY_ID",
+		"dhfindTLSSessionCacheSize": "DHSTORE_DHFIND_TLS_SESSION_CACHE_SIZE",
+		"l0CompactionThreshold":     "DHSTORE_L0_COMPACTION_THRESHOLD",
+		"providersURL":              "DHSTORE_PROVIDERS_URL",
+		"disableWAL":                "DHSTORE_DISABLE_WAL",
+	}
+	for flagName, want := range tests {
+		require.Equal(t, want, envName(flagName), flagName)
+	}
+}
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	type testFlags struct {
+		*flag.FlagSet
+		storePath     *string
+		maxWatchers   *int
+		drainTimeout  *time.Duration
+		disableWAL    *bool
+		providersURLs arrayFlags
+	}
+	newFlags := func(t *testing.T, args ...string) *testFlags {
+		f := &testFlags{FlagSet: flag.NewFlagSet("test", flag.ContinueOnError)}
+		f.storePath = f.String("storePath", "./dhstore/store", "")
+		f.maxWatchers = f.Int("maxWatchers", 0, "")
+		f.drainTimeout = f.Duration("drainTimeout", 30*time.Second, "")
+		f.disableWAL = f.Bool("disableWAL", false, "")
+		f.Var(&f.providersURLs, "providersURL", "")
+		f.Bool("version", false, "")
+		require.NoError(t, f.Parse(args))
+		return f
+	}
+	lookupEnv := func(env map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			v, ok := env[name]
+			return v, ok
+		}
+	}
+
+	t.Run("sets flags from environment", func(t *testing.T) {
+		f := newFlags(t)
+		require.NoError(t, setFlagsFromEnv(f.FlagSet, lookupEnv(map[string]string{
+			"DHSTORE_STORE_PATH":    "/data/store",
+			"DHSTORE_MAX_WATCHERS":  "16",
+			"DHSTORE_DRAIN_TIMEOUT": "1m",
+			"DHSTORE_DISABLE_WAL":   "true",
+			"DHSTORE_PROVIDERS_URL": "http://a:3000 http://b:3000;weight=2",
+			"STORE_PATH":            "/unprefixed",
+		})))
+		require.Equal(t, "/data/store", *f.storePath)
+		require.Equal(t, 16, *f.maxWatchers)
+		require.Equal(t, time.Minute, *f.drainTimeout)
+		require.True(t, *f.disableWAL)
+		require.Equal(t, arrayFlags{"http://a:3000", "http://b:3000;weight=2"}, f.providersURLs)
+	})
+
+	t.Run("unset variables keep defaults", func(t *testing.T) {
+		f := newFlags(t)
+		require.NoError(t, setFlagsFromEnv(f.FlagSet, lookupEnv(nil)))
+		require.Equal(t, "./dhstore/store", *f.storePath)
+		require.Zero(t, *f.maxWatchers)
+		require.Equal(t, 30*time.Second, *f.drainTimeout)
+		require.Empty(t, f.providersURLs)
+	})
+
+	t.Run("explicit flags take precedence", func(t *testing.T) {
+		f := newFlags(t, "-storePath", "/flag/store", "-providersURL", "http://flag:3000")
+		require.NoError(t, setFlagsFromEnv(f.FlagSet, lookupEnv(map[string]string{
+			"DHSTORE_STORE_PATH":    "/env/store",
+			"DHSTORE_MAX_WATCHERS":  "16",
+			"DHSTORE_PROVIDERS_URL": "http://env:3000",
+		})))
+		require.Equal(t, "/flag/store", *f.storePath)
+		require.Equal(t, 16, *f.maxWatchers)
+		require.Equal(t, arrayFlags{"http://flag:3000"}, f.providersURLs)
+	})
+
+	t.Run("version is never set", func(t *testing.T) {
+		f := newFlags(t)
+		require.NoError(t, setFlagsFromEnv(f.FlagSet, lookupEnv(map[string]string{"DHSTORE_VERSION": "true"})))
+		require.Equal(t, "false", f.Lookup("version").Value.String())
+	})
+
+	t.Run("invalid values fail", func(t *testing.T) {
+		for name, value := range map[string]string{
+			"DHSTORE_MAX_WATCHERS":  "many",
+			"DHSTORE_DRAIN_TIMEOUT": "30",
+			"DHSTORE_DISABLE_WAL":   "maybe",
+		} {
+			f := newFlags(t)
+			err := setFlagsFromEnv(f.FlagSet, lookupEnv(map[string]string{name: value}))
+			require.ErrorContains(t, err, `invalid value "`+value+`" of `+name+" for flag -")
+		}
+	})
+}
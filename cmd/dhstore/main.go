@@ -4,30 +4,55 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/cockroachdb/pebble"
-	"github.com/cockroachdb/pebble/bloom"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/admin"
+	"github.com/ipni/dhstore/audit"
+	"github.com/ipni/dhstore/grpcserver"
+	"github.com/ipni/dhstore/limit"
+	"github.com/ipni/dhstore/load"
 	"github.com/ipni/dhstore/metrics"
-	dhpebble "github.com/ipni/dhstore/pebble"
+	"github.com/ipni/dhstore/prune"
+	"github.com/ipni/dhstore/reload"
+	"github.com/ipni/dhstore/s3"
 	"github.com/ipni/dhstore/server"
+	"github.com/ipni/dhstore/systemd"
+	"github.com/ipni/dhstore/throttle"
+	"github.com/ipni/dhstore/tiered"
+	"github.com/ipni/dhstore/watch"
 )
 
 var (
 	log = logging.Logger("cmd/dhstore")
+
+	// httpClient makes the requests of dhfind, pruning and remote stores,
+	// propagating the IDs of the requests they are made on behalf of.
+	httpClient = &http.Client{Transport: server.RequestIDTransport{}}
 )
 
+// numLevels is the number of levels in the Pebble LSM.
+const numLevels = 7
+
 type arrayFlags []string
 
 func (a *arrayFlags) String() string {
@@ -49,131 +74,451 @@ func main() {
 		log.Infof("Go debug max threads is changed from %d to %d", previousMaxThreads, maxThreads)
 	}
 
+	switch err := newApp().Run(withDefaultCommand(os.Args)); {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+	case errors.Is(err, errUsage):
+		os.Exit(2)
+	default:
+		log.Fatal(err)
+	}
+}
+
+// serve serves the store selected by storeType until SIGTERM or SIGINT, as
+// configured by the flags in args.
+func serve(fs *flag.FlagSet, args []string) error {
 	var providersURLs arrayFlags
-	var maxConcurrentCompactions int
-	storePath := flag.String("storePath", "./dhstore/store", "The path at which the dhstore data persisted.")
-	listenAddr := flag.String("listenAddr", "0.0.0.0:40080", "The dhstore HTTP server listen address.")
-	metrcisAddr := flag.String("metricsAddr", "0.0.0.0:40081", "The dhstore metrics HTTP server listen address.")
-	flag.Var(&providersURLs, "providersURL", "Providers URL to enable dhfind. Multiple OK")
-	dwal := flag.Bool("disableWAL", false, "Weather to disable WAL in Pebble dhstore.")
-	flag.IntVar(&maxConcurrentCompactions, "maxConcurrentCompactions", 10, "Specifies the maximum number of concurrent Pebble compactions. As a rule of thumb set it to the number of the CPU cores.")
-	l0StopWritesThreshold := flag.Int("l0StopWritesThreshold", 12, "Hard limit on Pebble L0 read-amplification. Writes are stopped when this threshold is reached.")
-	l0CompactionThreshold := flag.Int("l0CompactionThreshold", 2, "The amount of L0 read-amplification necessary to trigger an L0 compaction.")
-	l0CompactionFileThreshold := flag.Int("l0CompactionFileThreshold", 500, "The count of L0 files necessary to trigger an L0 compaction.")
-	experimentalL0CompactionConcurrency := flag.Int("experimentalL0CompactionConcurrency", 10, "The threshold of L0 read-amplification at which compaction concurrency is enabled (if CompactionDebtConcurrency was not already exceeded). Every multiple of this value enables another concurrent compaction up to MaxConcurrentCompactions.")
-	blockCacheSize := flag.String("blockCacheSize", "1Gi", "Size of pebble block cache. Can be set in Mi or Gi.")
-	experimentalCompactionDebtConcurrency := flag.String("experimentalCompactionDebtConcurrency", "1Gi", "CompactionDebtConcurrency controls the threshold of compaction debt at which additional compaction concurrency slots are added. For every multiple of this value in compaction debt bytes, an additional concurrent compaction is added. This works \"on top\" of L0CompactionConcurrency, so the higher of the count of compaction concurrency slots as determined by the two options is chosen. Can be set in Mi or Gi.")
-
-	llvl := flag.String("logLevel", "info", "The logging level. Only applied if GOLOG_LOG_LEVEL environment variable is unset.")
-	storeType := flag.String("storeType", "pebble", "The store type to use. only `pebble` and `fdb` is supported. Defaults to `pebble`. When `fdb` is selected, all `fdb*` args must be set.")
-	version := flag.Bool("version", false, "Show version information,")
-
-	flag.Parse()
+	var importShards arrayFlags
+	listenAddr := fs.String("listenAddr", "0.0.0.0:40080", "The dhstore HTTP server listen address.")
+	http3ListenAddr := fs.String("http3ListenAddr", "", "The UDP listen address on which to serve lookups over HTTP/3, i.e. QUIC. Requires HTTPS, and dhstore to be built with the http3 build tag. Disabled when empty.")
+	writeListenAddr := fs.String("writeListenAddr", "", "The listen address of a separate HTTP server for writes, i.e. requests other than GET, HEAD and OPTIONS, so that writes can be firewalled separately from reads. When set, the server at listenAddr rejects writes with 405. Writes are served at listenAddr when empty.")
+	grpcListenAddr := fs.String("grpcListenAddr", "", "The dhstore gRPC server listen address, e.g. 0.0.0.0:40082. Served over TLS with the same certificates and write client CAs as the HTTP API, if configured. The gRPC API is disabled when empty.")
+	metrcisAddr := fs.String("metricsAddr", "0.0.0.0:40081", "The dhstore metrics HTTP server listen address.")
+	nativeHistograms := fs.Bool("nativeHistograms", false, "Whether to export latency histograms as prometheus native histograms, whose buckets adapt to observed latencies, instead of histograms of fixed buckets. Native histograms are only exposed to scrapers that negotiate the protobuf format.")
+	statsLogInterval := fs.Duration("statsLogInterval", 0, "How often to log a one-line summary of the requests served, their error rate and p50 and p99 latencies, and the size and compaction debt of the store, for installations that do not scrape metrics. Disabled when zero.")
+	fs.Var(&providersURLs, "providersURL", "Providers URL to enable dhfind. Multiple OK, as replicas serving the same providers, among which requests are spread by weight and failed over when one is down. A URL may be followed by ;weight=N to set its relative weight, which defaults to 1. URLs of weight 0 are only used when all others are down.")
+	providersCheckInterval := fs.Duration("providersCheckInterval", 10*time.Second, "The interval at which the health of each providersURL is checked via its /health endpoint. Disabled when zero, in which case providersURL are only considered down when requests to them fail.")
+	extendedProviders := fs.Bool("extendedProviders", true, "Whether dhfind lookups return a result for each extended provider of a provider, i.e. the additional peers and protocols by which its content is retrievable, as full IPNI find endpoints do.")
+	providersBreakerFailures := fs.Int("providersBreakerFailures", 0, "The number of consecutive requests for provider information that fail on all providersURL after which dhfind lookups fail fast with 503 for providersBreakerCooldown, while encrypted lookups are still served. Disabled when zero.")
+	providersBreakerCooldown := fs.Duration("providersBreakerCooldown", 30*time.Second, "How long dhfind lookups fail fast once providersBreakerFailures is reached.")
+	providerCacheMaxAge := fs.Duration("providerCacheMaxAge", 0, "Persist the provider cache of dhfind in the store, so that on start it is loaded from the store instead of from providersURL if the persisted provider information is at most this old. The persisted information is also used while all providersURL fail. Only supported by the pebble store. Disabled when zero.")
+	dhfindMissTTL := fs.Duration("dhfindMissTTL", 0, "How long multihashes that resolved to no results via dhfind are not looked up again, so that repeated lookups of popular multihashes that are not indexed neither hit the store nor the providersURL. Multihashes indexed meanwhile are only found once it elapses. Disabled when zero.")
+	dhfindTimeout := fs.Duration("dhfindTimeout", 0, "The maximum duration of each lookup via dhfind, including fetching metadata and provider information. Lookups that time out respond with the results found until then, or with 504 if there are none. Unlimited when zero.")
+	dhfindParallelism := fs.Int("dhfindParallelism", 1, "The number of value keys whose metadata and provider information are fetched concurrently by each lookup via dhfind. Results are returned in no particular order when greater than 1.")
+	dhfindMaxValueKeys := fs.Int("dhfindMaxValueKeys", 0, "The maximum number of value keys decrypted by each lookup via dhfind, beyond which the value keys of a multihash are ignored. Unlimited when zero.")
+	dhfindMaxIdleConnsPerHost := fs.Int("dhfindMaxIdleConnsPerHost", 0, "The maximum number of idle connections kept per providersURL by dhfind, so that lookups reuse connections rather than churning them. The default of the HTTP client is kept when zero.")
+	dhfindIdleConnTimeout := fs.Duration("dhfindIdleConnTimeout", 0, "How long idle connections to providersURL are kept by dhfind. The default of the HTTP client is kept when zero.")
+	dhfindKeepAlive := fs.Duration("dhfindKeepAlive", 0, "The interval between TCP keep-alive probes of the connections to providersURL. The default of the HTTP client is kept when zero.")
+	dhfindTLSSessionCacheSize := fs.Int("dhfindTLSSessionCacheSize", 0, "The number of TLS sessions of connections to providersURL cached by dhfind, so that new connections resume sessions rather than making full handshakes. The default of the HTTP client is kept when zero.")
+	dhfindDialTimeout := fs.Duration("dhfindDialTimeout", 0, "The maximum duration of connecting to a providersURL. The default of the HTTP client is kept when zero.")
+	dhfindTLSHandshakeTimeout := fs.Duration("dhfindTLSHandshakeTimeout", 0, "The maximum duration of TLS handshakes with a providersURL. The default of the HTTP client is kept when zero.")
+	dhfindResponseHeaderTimeout := fs.Duration("dhfindResponseHeaderTimeout", 0, "The maximum duration of waiting for the headers of responses of a providersURL. The default of the HTTP client is kept when zero.")
 
-	if *version {
-		fmt.Println(dhstore.Version)
-		return
+	provenanceHeader := fs.String("provenanceHeader", "", "The HTTP request header from which to take the writer tag of batches merged via PUT /multihash, or the gRPC metadata of the same name, case-insensitively, for batches merged via MergeIndexes. When set, the writer tag is recorded in the store, to trace where data came from. Only supported by pebble. Disabled when empty.")
+	provenanceSampleEvery := fs.Int("provenanceSampleEvery", 1, "Record the provenance of one in every given number of merged batches that carry a writer tag.")
+
+	pruneInterval := fs.Duration("pruneInterval", 0, "The interval at which to fetch providers from providersURL and launch deletion campaigns for the records of stale providers. Requires dhfind to be enabled. Disabled when zero.")
+	pruneMaxAge := fs.Duration("pruneMaxAge", 0, "The time since the last advertisement of a provider after which it is considered stale. Disabled when zero, in which case only providers removed from providersURL are considered stale.")
+	pruneRemovalGrace := fs.Duration("pruneRemovalGrace", 24*time.Hour, "How long a provider must be absent from all providersURL before it is considered stale.")
+	maintenanceRate := fs.Float64("maintenanceRate", 100, "The maximum rate, in operations per second, of background maintenance such as pruning stale providers.")
+	maintenanceTargetLatency := fs.Duration("maintenanceTargetLatency", 100*time.Millisecond, "The p99 lookup latency at which background maintenance is paused. Maintenance is slowed down as p99 latency approaches it. Maintenance always runs at maintenanceRate when zero.")
+	pruneDryRun := fs.Bool("pruneDryRun", false, "Whether to only log the records of stale providers instead of deleting them.")
+
+	writePressureThreshold := fs.Float64("writePressureThreshold", 0, "The proximity of the store to its stop-writes threshold, between 0 and 1, at which PUT /multihash requests are rejected with 503. Disabled when zero.")
+	writeRetryAfter := fs.Duration("writeRetryAfter", 5*time.Second, "The Retry-After duration of write requests rejected due to store write pressure at writePressureThreshold, which grows to twice that as writes approach being stopped.")
+
+	concurrencyLimit := fs.Int("concurrencyLimit", 0, "The maximum number of requests served concurrently across the HTTP and gRPC APIs. Excess requests are rejected with 503, or RESOURCE_EXHAUSTED over gRPC, unless a slot becomes available within concurrencyQueueTimeout. Unlimited when zero.")
+	preferJSON := fs.Bool("preferJSON", true, "Whether lookups that accept any media type, i.e. */*, are responded to with JSON rather than NDJSON, as are lookups without an Accept header unless defaultAccept is set. Lookups without an Accept header are rejected with 400 when false and defaultAccept is empty.")
+	defaultAccept := fs.String("defaultAccept", "", "The media type of responses to lookups without an Accept header; one of application/json, application/x-ndjson, application/protobuf or text/event-stream. Decided by preferJSON when empty.")
+	ndjsonFlushInterval := fs.Duration("ndjsonFlushInterval", 0, "The minimum interval between flushes of NDJSON lookup responses, so that encrypted value keys found in quick succession are written in fewer, larger writes. Each line is flushed as it is written when zero.")
+	lookupPageLimit := fs.Int("lookupPageLimit", 0, "The maximum number of encrypted value keys per lookup response, beyond which clients page through keys using the cursor in the X-Next-Cursor response header. NDJSON lookups are no longer streamed when set. Unbounded when zero.")
+	encryptedLookupsOnly := fs.Bool("encryptedLookupsOnly", false, "Whether to disable unencrypted lookups via /multihash/<multihash> and /cid/<cid>, which then respond with 404 even for DBL_SHA2_256 multihashes, so that only the encrypted API is exposed. Cannot be combined with providersURL.")
+	legacyFindAPI := fs.Bool("legacyFindAPI", false, "Whether to serve the batch finds of the storetheindex find API via POST /multihash, so that its clients can be pointed at dhstore during a migration. Cannot be combined with encryptedLookupsOnly.")
+	maxWatchers := fs.Int("maxWatchers", 0, "The maximum number of concurrent watches of multihashes via GET /encrypted/multihash/<multihash>?watch=true, which stream encrypted value keys as they are merged. Watching is disabled when zero.")
+	maxWebSockets := fs.Int("maxWebSockets", 0, "The maximum number of concurrent WebSocket connections to /encrypted/multihash/ws, over which clients submit many multihashes and receive their encrypted value keys as lookups complete. Each lookup counts towards concurrencyLimit. WebSocket lookups are disabled when zero.")
+	validateRequests := fs.Bool("validateRequests", false, "Whether to reject requests to the multihash and metadata endpoints with 400 unless they conform to the OpenAPI document served at /openapi.json.")
+	strictMerges := fs.Bool("strictMerges", false, "Whether to validate each merge of PUT /multihash requests before any is applied, rejecting requests with duplicate key and value pairs, non-DBL_SHA2_256 keys, or encrypted value keys whose length is not within minValueKeyLen and maxValueKeyLen with 400, detailing the error of each invalid merge.")
+	minValueKeyLen := fs.Int("minValueKeyLen", 28, "The minimum length in bytes of encrypted value keys accepted by strictMerges. Defaults to the length of the nonce and authentication tag of an empty encrypted value key.")
+	maxValueKeyLen := fs.Int("maxValueKeyLen", 1024, "The maximum length in bytes of encrypted value keys accepted by strictMerges.")
+	pidFile := fs.String("pidFile", "", "Path to a file to which to write the process ID once serving, e.g. for the PIDFile of systemd units. The file is removed on shutdown. Disabled when empty.")
+	drainTimeout := fs.Duration("drainTimeout", 30*time.Second, "How long in-flight requests are served upon SIGTERM or SIGINT before their connections are closed, in which time /ready responds with 503 and no new connections are accepted. The store is closed once requests are drained.")
+	concurrencyQueueTimeout := fs.Duration("concurrencyQueueTimeout", time.Second, "How long requests beyond concurrencyLimit wait for a slot before they are rejected. Requests are rejected without waiting when the wait estimated from recent request durations exceeds it. Rejected immediately when zero.")
+
+	fs.Var(&importShards, "importShard", "Path to a newline delimited JSON or binary file of exported records to load into the store before serving, e.g. to seed a new replica. Multiple OK")
+	importWorkers := fs.Int("importWorkers", runtime.NumCPU(), "The number of parallel workers that load importShard, each loading a distinct range of digests.")
+	importIngest := fs.Bool("importIngest", false, "Whether to load importShard by ingesting SSTs rather than through the regular write path. Only supported by pebble.")
+
+	exportDir := fs.String("exportDir", "", "Path to a directory to which to export the records of the store as newline delimited JSON shards, loadable via importShard, and exit. E.g. to migrate between store types. Deprecated: use the export command.")
+	exportShards := fs.Int("exportShards", 16, "The number of shards exported to exportDir in parallel, each covering a distinct range of digests.")
+	exportFormat := fs.String("exportFormat", "ndjson", "The format of the shards exported to exportDir; one of `ndjson`, `binary` or `segment`. Binary shards are more compact and faster to load via importShard than ndjson. Segments can be served from S3 by the `s3` store type. Only pebble exports are supported as segments.")
+
+	adminUI := fs.Bool("adminUI", false, "Whether to serve a read-only admin UI under /admin/ on the metrics listen address, showing store stats, LSM health and job progress, with forms to look up records. When admin tokens are set, operational actions such as flush, compact, checkpoint, GC and toggling read-only mode are also served under /admin/api/.")
+	checkpointDir := fs.String("checkpointDir", "./dhstore/checkpoints", "The directory under which checkpoints triggered via the admin API are written. Only supported by pebble.")
+
+	coldStoreType := fs.String("coldStoreType", "", "The store type on which to fall back for lookups that miss the store selected by storeType, so that the latter only keeps recent records; one of `s3` or `remote`. All writes go to the store selected by storeType. Disabled when empty.")
+	version := fs.Bool("version", false, "Show version information. Deprecated: use the version command.")
+
+	if err := parseFlags(fs, "", args); err != nil {
+		return err
 	}
 
-	if _, set := os.LookupEnv("GOLOG_LOG_LEVEL"); !set {
-		_ = logging.SetLogLevel("*", *llvl)
+	if *version {
+		printVersion()
+		return nil
+	}
+	valueKeySize, err := valueKeySizeLimit(fs, fdbMaxValueKeySize())
+	if err != nil {
+		return err
 	}
 
-	var store dhstore.DHStore
-	var pebbleMetricsProvider func() *pebble.Metrics
-	switch *storeType {
-	case "pebble":
-		parsedBlockCacheSize, err := parseBytesIEC(*blockCacheSize)
+	opened := openStore(fs)
+	store, pebbleMetricsProvider, blockCache, metricsOpts := opened.store, opened.pebbleMetrics, opened.blockCache, opened.metricsOpts
+
+	if *exportDir != "" {
+		err := exportShardFiles(store, *exportDir, *exportShards, *exportFormat)
+		if cerr := store.Close(); cerr != nil {
+			log.Warnw("Failed to close store", "err", cerr)
+		}
 		if err != nil {
-			log.Fatalw("Failed to parse block cache size", "err", err)
+			log.Fatalw("Failed to export shards", "err", err)
+		}
+		return nil
+	}
+
+	auditLog, err := newAuditLog()
+	if err != nil {
+		log.Fatalw("Failed to open audit log", "err", err)
+	}
+
+	if len(importShards) != 0 {
+		if err := importShardFiles(store, importShards, *importWorkers, *importIngest, valueKeySize, auditLog); err != nil {
+			log.Fatalw("Failed to import shards", "err", err)
+		}
+	}
+
+	if *coldStoreType != "" {
+		var cold dhstore.DHStore
+		var err error
+		switch *coldStoreType {
+		case "s3":
+			cold, err = newS3DHStore()
+		case "remote":
+			cold, err = newRemoteDHStore()
+		default:
+			panic("unknown coldStoreType: " + *coldStoreType)
 		}
-		parsedExperimentalCompactionDebtConcurrency, err := parseBytesIEC(*experimentalCompactionDebtConcurrency)
 		if err != nil {
-			log.Fatalw("Failed to parse experimental compaction debt concurrency", "err", err)
-		}
-
-		// Default options copied from cockroachdb with the addition of a custom sized block cache and configurable compaction options.
-		// See:
-		// - https://github.com/cockroachdb/cockroach/blob/v22.1.6/pkg/storage/pebble.go#L479
-		opts := &pebble.Options{
-			BytesPerSync:                10 << 20, // 10 MiB
-			WALBytesPerSync:             10 << 20, // 10 MiB
-			MaxConcurrentCompactions:    func() int { return maxConcurrentCompactions },
-			MemTableSize:                64 << 20, // 64 MiB
-			MemTableStopWritesThreshold: 4,
-			LBaseMaxBytes:               64 << 20, // 64 MiB
-			L0CompactionThreshold:       *l0CompactionThreshold,
-			L0StopWritesThreshold:       *l0StopWritesThreshold,
-			L0CompactionFileThreshold:   *l0CompactionFileThreshold,
-			DisableWAL:                  *dwal,
-			WALMinSyncInterval:          func() time.Duration { return 30 * time.Second },
-		}
-
-		opts.Experimental.ReadCompactionRate = 10 << 20 // 20 MiB
-		opts.Experimental.CompactionDebtConcurrency = parsedExperimentalCompactionDebtConcurrency
-		opts.Experimental.L0CompactionConcurrency = *experimentalL0CompactionConcurrency
-
-		const numLevels = 7
-		opts.Levels = make([]pebble.LevelOptions, numLevels)
-		for i := 0; i < numLevels; i++ {
-			l := &opts.Levels[i]
-			l.BlockSize = 32 << 10       // 32 KiB
-			l.IndexBlockSize = 256 << 10 // 256 KiB
-			l.FilterPolicy = bloom.FilterPolicy(10)
-			l.FilterType = pebble.TableFilter
-			if i > 0 {
-				l.TargetFileSize = opts.Levels[i-1].TargetFileSize * 2
-			}
-			l.EnsureDefaults()
+			panic(err)
 		}
-		opts.Levels[numLevels-1].FilterPolicy = nil
-		opts.Cache = pebble.NewCache(int64(parsedBlockCacheSize))
+		tieredStore := tiered.NewTieredDHStore(store, cold)
+		store = tieredStore
+		metricsOpts = append(metricsOpts, metrics.WithTieredMetrics(tieredStore.Metrics))
+		log.Infow("Using tiered store.", "hot", *storeType, "cold", *coldStoreType)
+	}
 
-		path := filepath.Clean(*storePath)
-		pbstore, err := dhpebble.NewPebbleDHStore(path, opts)
+	if len(mirrorStoreTypes) != 0 {
+		mirrorStore, err := newMirrorDHStore(store)
 		if err != nil {
 			panic(err)
 		}
-		store = pbstore
-		pebbleMetricsProvider = pbstore.Metrics
-		log.Infow("Store opened.", "path", path)
-	case "fdb":
+		store = mirrorStore
+		metricsOpts = append(metricsOpts, metrics.WithMirrorMetrics(mirrorStore.Metrics))
+		log.Infow("Mirroring writes.", "targets", mirrorStoreTypes.String(), "async", *mirrorQueueSize != 0)
+	}
+
+	var pruner *prune.Pruner
+	var maintenance *throttle.Throttle
+	if *pruneInterval != 0 {
+		if len(providersURLs) == 0 {
+			log.Fatal("Pruning stale providers requires providersURL to be set")
+		}
 		var err error
-		store, err = newFDBDHStore()
+		pruner, err = prune.New(providersURLs,
+			prune.WithInterval(*pruneInterval),
+			prune.WithMaxAge(*pruneMaxAge),
+			prune.WithRemovalGrace(*pruneRemovalGrace),
+			prune.WithDryRun(*pruneDryRun),
+			prune.WithHTTPClient(httpClient))
 		if err != nil {
 			panic(err)
 		}
-		log.Infow("Using FoundationDB backing store.")
-	default:
-		panic("unknown storeType: " + *storeType)
+		maintenance, err = throttle.New(
+			throttle.WithRate(*maintenanceRate, throttle.BurstForRate(*maintenanceRate)),
+			throttle.WithTargetLatency(*maintenanceTargetLatency))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	runtimeConfig := admin.NewConfig(fs, os.Environ())
+	runtimeConfig.StoreOptions = opened.options
+	runtimeConfig.Features = map[string]bool{
+		"adminUI":           *adminUI,
+		"dhfind":            len(providersURLs) != 0,
+		"provenance":        *provenanceHeader != "",
+		"prune":             pruner != nil,
+		"pruneDryRun":       pruner != nil && *pruneDryRun,
+		"writeBackpressure": *writePressureThreshold != 0,
+	}
+	if *storeType == "pebble" {
+		if path, err := runtimeConfig.WriteTo(filepath.Clean(*storePath)); err != nil {
+			log.Warnw("Failed to write runtime config snapshot", "err", err)
+		} else {
+			log.Infow("Wrote runtime config snapshot", "path", path)
+		}
 	}
 
-	m, err := metrics.New(*metrcisAddr, pebbleMetricsProvider)
+	authTokens, err := newAuthTokens()
+	if err != nil {
+		log.Fatalw("Failed to load auth tokens", "err", err)
+	}
+
+	var limiter *limit.Limiter
+	if *concurrencyLimit != 0 {
+		if limiter, err = limit.New(*concurrencyLimit, *concurrencyQueueTimeout); err != nil {
+			log.Fatalw("Failed to configure concurrency limit", "err", err)
+		}
+		metricsOpts = append(metricsOpts, metrics.WithLimiterMetrics(limiter.Metrics))
+	}
+
+	var watchHub *watch.Hub
+	if *maxWatchers != 0 {
+		if watchHub, err = watch.New(*maxWatchers); err != nil {
+			log.Fatalw("Failed to configure watching", "err", err)
+		}
+	}
+
+	tunables, err := reload.New(
+		reload.WithLimiter(limiter),
+		reload.WithMaintenanceThrottle(maintenance),
+		reload.WithPruner(pruner),
+		reload.WithBlockCache(blockCache))
 	if err != nil {
 		panic(err)
 	}
+	reloader := &reloader{authTokens: authTokens, tunables: tunables}
+
+	readOnly := &admin.ReadOnly{}
+	if *adminUI {
+		adm, err := admin.New(store,
+			admin.WithPruner(pruner),
+			admin.WithReload(reloader.reload),
+			admin.WithConfig(runtimeConfig),
+			admin.WithAuth(authTokens),
+			admin.WithReadOnly(readOnly),
+			admin.WithCheckpointDir(filepath.Clean(*checkpointDir)))
+		if err != nil {
+			panic(err)
+		}
+		metricsOpts = append(metricsOpts, metrics.WithHandler(admin.PathPrefix, adm))
+	}
 
-	svr, err := server.New(store, *listenAddr, server.WithMetrics(m), server.WithDHFind(providersURLs...))
+	metricsOpts = append(metricsOpts, metrics.WithNativeHistograms(*nativeHistograms), metrics.WithSummaryInterval(*statsLogInterval))
+	m, err := metrics.New(*metrcisAddr, pebbleMetricsProvider, metricsOpts...)
 	if err != nil {
 		panic(err)
 	}
 
+	svrOpts := []server.Option{
+		server.WithMetrics(m),
+		server.WithHTTPClient(httpClient),
+		server.WithDHFind(providersURLs...),
+		server.WithProvidersCheckInterval(*providersCheckInterval),
+		server.WithExtendedProviders(*extendedProviders),
+		server.WithProvidersCircuitBreaker(*providersBreakerFailures, *providersBreakerCooldown),
+		server.WithPersistentProviderCache(*providerCacheMaxAge),
+		server.WithReadOnly(readOnly.Enabled),
+		server.WithRequestValidation(*validateRequests),
+		server.WithPreferJSON(*preferJSON),
+		server.WithDefaultAccept(*defaultAccept),
+		server.WithNDJSONFlushInterval(*ndjsonFlushInterval),
+		server.WithMaxValueKeySize(valueKeySize),
+	}
+	if len(providersURLs) != 0 {
+		svrOpts = append(svrOpts,
+			server.WithDHFindMissTTL(*dhfindMissTTL),
+			server.WithDHFindTimeout(*dhfindTimeout),
+			server.WithDHFindParallelism(*dhfindParallelism),
+			server.WithDHFindMaxValueKeys(*dhfindMaxValueKeys),
+			server.WithDHFindConnections(*dhfindMaxIdleConnsPerHost, *dhfindIdleConnTimeout, *dhfindKeepAlive),
+			server.WithDHFindTLSSessionCache(*dhfindTLSSessionCacheSize),
+			server.WithDHFindTransportTimeouts(*dhfindDialTimeout, *dhfindTLSHandshakeTimeout, *dhfindResponseHeaderTimeout))
+	}
+	if *provenanceHeader != "" {
+		svrOpts = append(svrOpts, server.WithProvenance(*provenanceHeader, *provenanceSampleEvery))
+	}
+	if *writePressureThreshold != 0 {
+		svrOpts = append(svrOpts, server.WithWriteBackpressure(*writePressureThreshold, *writeRetryAfter))
+	}
+	if pruner != nil {
+		svrOpts = append(svrOpts, server.WithPruner(pruner), server.WithMaintenanceThrottle(maintenance))
+	}
+	if authTokens != nil {
+		svrOpts = append(svrOpts, server.WithAuth(authTokens))
+	}
+	if limiter != nil {
+		svrOpts = append(svrOpts, server.WithConcurrencyLimiter(limiter))
+	}
+	if *writeListenAddr != "" {
+		svrOpts = append(svrOpts, server.WithWriteListenAddr(*writeListenAddr))
+	}
+	if *lookupPageLimit != 0 {
+		svrOpts = append(svrOpts, server.WithLookupPageLimit(*lookupPageLimit))
+	}
+	if *strictMerges {
+		svrOpts = append(svrOpts, server.WithStrictMerges(*minValueKeyLen, *maxValueKeyLen))
+	}
+	if auditLog != nil {
+		svrOpts = append(svrOpts, server.WithAuditLog(auditLog))
+	}
+	if watchHub != nil {
+		svrOpts = append(svrOpts, server.WithWatchHub(watchHub))
+	}
+	if *encryptedLookupsOnly {
+		svrOpts = append(svrOpts, server.WithEncryptedLookupsOnly(true))
+	}
+	if *legacyFindAPI {
+		svrOpts = append(svrOpts, server.WithLegacyFindAPI(true))
+	}
+	if *maxWebSockets != 0 {
+		svrOpts = append(svrOpts, server.WithMaxWebSockets(*maxWebSockets))
+	}
+	if *http3ListenAddr != "" {
+		svrOpts = append(svrOpts, server.WithHTTP3ListenAddr(*http3ListenAddr))
+	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		log.Fatalw("Failed to configure TLS", "err", err)
+	}
+	if tlsConfig != nil {
+		svrOpts = append(svrOpts, server.WithTLSConfig(tlsConfig))
+	}
+	writeClientCAs, err := newWriteClientCAs()
+	if err != nil {
+		log.Fatalw("Failed to load write client CAs", "err", err)
+	}
+	if writeClientCAs != nil {
+		svrOpts = append(svrOpts, server.WithWriteClientCAs(writeClientCAs))
+	}
+	svr, err := server.New(store, *listenAddr, svrOpts...)
+	if err != nil {
+		panic(err)
+	}
+	tunables.SetProvidersSetter(svr)
+	if *runtimeTunablesPath != "" {
+		if err := reloader.reload(); err != nil {
+			log.Fatalw("Failed to apply runtime tunables", "err", err)
+		}
+	}
+	reloadOnSIGHUP(reloader.reload)
+
+	var grpcSvr *grpcserver.Server
+	if *grpcListenAddr != "" {
+		grpcOpts := []grpcserver.Option{grpcserver.WithMetrics(m), grpcserver.WithReadOnly(readOnly.Enabled), grpcserver.WithMaxValueKeySize(valueKeySize)}
+		if authTokens != nil {
+			grpcOpts = append(grpcOpts, grpcserver.WithAuth(authTokens))
+		}
+		if limiter != nil {
+			grpcOpts = append(grpcOpts, grpcserver.WithConcurrencyLimiter(limiter))
+		}
+		if watchHub != nil {
+			grpcOpts = append(grpcOpts, grpcserver.WithWatchHub(watchHub))
+		}
+		if auditLog != nil {
+			grpcOpts = append(grpcOpts, grpcserver.WithAuditLog(auditLog))
+		}
+		if tlsConfig != nil {
+			grpcOpts = append(grpcOpts, grpcserver.WithTLSConfig(tlsConfig))
+		}
+		if writeClientCAs != nil {
+			grpcOpts = append(grpcOpts, grpcserver.WithWriteClientCAs(writeClientCAs))
+		}
+		if *provenanceHeader != "" {
+			grpcOpts = append(grpcOpts, grpcserver.WithProvenance(*provenanceHeader, *provenanceSampleEvery))
+		}
+		if grpcSvr, err = grpcserver.New(store, *grpcListenAddr, grpcOpts...); err != nil {
+			panic(err)
+		}
+	}
+
 	ctx := context.Background()
 	if err := svr.Start(ctx); err != nil {
 		panic(err)
 	}
+	if grpcSvr != nil {
+		if err := grpcSvr.Start(ctx); err != nil {
+			panic(err)
+		}
+	}
 	if err := m.Start(ctx); err != nil {
 		panic(err)
 	}
+	if pruner != nil {
+		pruner.Start(ctx)
+	}
+	if *pidFile != "" {
+		if err := systemd.WritePIDFile(*pidFile); err != nil {
+			log.Fatalw("Failed to write pid file", "err", err)
+		}
+		defer os.Remove(*pidFile)
+	}
+
+	// Readiness and watchdog pings are only sent when run by systemd with
+	// Type=notify and WatchdogSec, respectively.
+	if notified, err := systemd.Notify(systemd.Ready); err != nil {
+		log.Warnw("Failed to notify systemd of readiness", "err", err)
+	} else if notified {
+		log.Info("Notified systemd of readiness.")
+	}
+	watchdogCtx, stopWatchdog := context.WithCancel(ctx)
+	if interval, err := systemd.WatchdogInterval(); err != nil {
+		log.Warnw("Failed to get systemd watchdog interval", "err", err)
+	} else if interval != 0 {
+		systemd.StartWatchdog(watchdogCtx, interval, svr.Live)
+		log.Infow("Pinging systemd watchdog while serving.", "interval", interval)
+	}
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	<-c
-	log.Info("Terminating...")
-	if err := svr.Shutdown(ctx); err != nil {
-		log.Warnw("Failure occurred while shutting down server.", "err", err)
-	} else {
-		log.Info("Shut down server successfully.")
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+	log.Infow("Terminating...", "signal", sig, "drainTimeout", *drainTimeout)
+	stopWatchdog()
+	if _, err := systemd.Notify(systemd.Stopping); err != nil {
+		log.Warnw("Failed to notify systemd of stopping", "err", err)
+	}
+
+	// Drain the APIs in parallel, so that in-flight requests of both are
+	// served within the same drain timeout before the store is closed.
+	drainCtx, cancelDrain := context.WithTimeout(ctx, *drainTimeout)
+	var drained sync.WaitGroup
+	drained.Add(1)
+	go func() {
+		defer drained.Done()
+		if err := svr.Shutdown(drainCtx); err != nil {
+			log.Warnw("Failure occurred while shutting down server.", "err", err)
+		} else {
+			log.Info("Shut down server successfully.")
+		}
+	}()
+	if grpcSvr != nil {
+		drained.Add(1)
+		go func() {
+			defer drained.Done()
+			if err := grpcSvr.Shutdown(drainCtx); err != nil {
+				log.Warnw("Failure occurred while shutting down gRPC server.", "err", err)
+			} else {
+				log.Info("Shut down gRPC server successfully.")
+			}
+		}()
+	}
+	drained.Wait()
+	cancelDrain()
+	if pruner != nil {
+		_ = pruner.Close()
+	}
+	if auditLog != nil {
+		if err := auditLog.Close(); err != nil {
+			log.Warnw("Failure occurred while closing audit log.", "err", err)
+		}
 	}
 	if err := m.Shutdown(ctx); err != nil {
 		log.Warnw("Failure occurred while shutting down metrics server.", "err", err)
@@ -186,6 +531,148 @@ func main() {
 	} else {
 		log.Info("Closed store successfully.")
 	}
+	return nil
+}
+
+func importShardFiles(store dhstore.DHStore, paths []string, workers int, ingest bool, maxValueKeySize int, auditLog *audit.Log) error {
+	importer, ok := store.(dhstore.Importer)
+	if !ok {
+		return fmt.Errorf("import is not supported by store")
+	}
+	loadOpts := []load.Option{load.WithWorkers(workers), load.WithIngest(ingest), load.WithMaxValueKeySize(maxValueKeySize)}
+	if ingest {
+		// Ingested SSTs are best kept large.
+		loadOpts = append(loadOpts, load.WithBatchSize(1<<20, 64<<20))
+	}
+	if auditLog != nil {
+		loadOpts = append(loadOpts, load.WithOnBatch(func(batch []dhstore.ExportRecord, err error) {
+			auditLog.RecordImport(audit.Client{API: "importShard"}, batch, err)
+		}))
+	}
+	loader, err := load.New(importer, loadOpts...)
+	if err != nil {
+		return err
+	}
+	shards := make([]io.Reader, 0, len(paths))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		shards = append(shards, f)
+	}
+	log.Infow("Importing shards", "count", len(shards), "workers", workers)
+	start := time.Now()
+	stats, err := loader.Load(context.Background(), shards...)
+	if err != nil {
+		return err
+	}
+	log.Infow("Imported shards", "records", stats.Records, "batches", stats.Batches, "throttled", stats.Throttled, "took", time.Since(start))
+	return nil
+}
+
+// exportShardFiles exports the records of the store to the given number of
+// shard files in dir concurrently, where each shard covers a distinct range of
+// digests by their first byte.
+func exportShardFiles(store dhstore.DHStore, dir string, shards int, format string) error {
+	exporter, ok := store.(dhstore.Exporter)
+	if !ok {
+		return fmt.Errorf("export is not supported by store")
+	}
+	if shards < 1 || shards > 256 {
+		return fmt.Errorf("export shards must be between 1 and 256, got: %d", shards)
+	}
+	var ext string
+	switch format {
+	case "ndjson":
+		ext = ".ndjson"
+	case "binary":
+		ext = ".dhrec"
+	case "segment":
+		ext = s3.SegmentExt
+	default:
+		return fmt.Errorf("unknown export format: %s", format)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	log.Infow("Exporting shards", "count", shards, "dir", dir)
+	start := time.Now()
+	var records atomic.Int64
+	var wg sync.WaitGroup
+	errs := make([]error, shards)
+	for i := 0; i < shards; i++ {
+		// Shard i covers digests with the first byte in [i*256/shards, (i+1)*256/shards).
+		var opts dhstore.ExportOptions
+		if i != 0 {
+			opts.Start = []byte{byte(i * 256 / shards)}
+		}
+		if i != shards-1 {
+			opts.End = []byte{byte((i + 1) * 256 / shards)}
+		}
+		path := filepath.Join(dir, fmt.Sprintf("shard-%03d", i)+ext)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			count, err := exportShardFile(exporter, path, opts, format)
+			records.Add(count)
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	log.Infow("Exported shards", "records", records.Load(), "took", time.Since(start))
+	return nil
+}
+
+// exportShardFile exports the records in the given range to a file at path in
+// the given format, which only appears once the export completes.
+func exportShardFile(exporter dhstore.Exporter, path string, opts dhstore.ExportOptions, format string) (int64, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var add func(dhstore.ExportRecord) error
+	var finish func() error
+	switch format {
+	case "segment":
+		sw := s3.NewSegmentWriter(w)
+		add, finish = sw.Add, sw.Close
+	case "binary":
+		bw := load.NewBinaryWriter(w)
+		add, finish = bw.Write, bw.Flush
+	default:
+		enc := json.NewEncoder(w)
+		add = func(record dhstore.ExportRecord) error { return enc.Encode(record) }
+		finish = func() error { return nil }
+	}
+	var count int64
+	if err := exporter.Export(context.Background(), opts, func(record dhstore.ExportRecord) error {
+		// Cursors are only meaningful to resume an export over HTTP.
+		record.Cursor = ""
+		count++
+		return add(record)
+	}); err != nil {
+		return count, err
+	}
+	if err := finish(); err != nil {
+		return count, err
+	}
+	if err := w.Flush(); err != nil {
+		return count, err
+	}
+	if err := f.Close(); err != nil {
+		return count, err
+	}
+	return count, os.Rename(tmp, path)
 }
 
 func parseBytesIEC(str string) (uint64, error) {
@@ -206,6 +693,9 @@ func parseBytesIEC(str string) (uint64, error) {
 	var n int
 	var err error
 	switch suffix {
+	case "ki":
+		n, err = strconv.Atoi(str[:len(str)-2])
+		multiplier = 1 << 10
 	case "mi":
 		n, err = strconv.Atoi(str[:len(str)-2])
 		multiplier = 1 << 20
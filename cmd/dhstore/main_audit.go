@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+
+	"github.com/ipni/dhstore/audit"
+)
+
+var (
+	auditLogPath     *string
+	auditLogMaxSize  *string
+	auditLogMaxFiles *int
+)
+
+// auditFlags registers the flags configuring the audit log on fs.
+func auditFlags(fs *flag.FlagSet) {
+	auditLogPath = fs.String("auditLog", "", "Path to an append-only file in which every merge, deletion and metadata mutation is recorded as newline delimited JSON, along with the identity of its client, e.g. to trace bad deletions. Written to stdout when set to -. Disabled when empty.")
+	auditLogMaxSize = fs.String("auditLogMaxSize", "100Mi", "The size at which the auditLog file is rotated. Can be set in Ki, Mi or Gi.")
+	auditLogMaxFiles = fs.Int("auditLogMaxFiles", 10, "The number of rotated auditLog files kept, beyond which the oldest is removed.")
+}
+
+// newAuditLog returns the audit log configured by the auditLog flags, or nil
+// if disabled.
+func newAuditLog() (*audit.Log, error) {
+	var w io.Writer
+	switch *auditLogPath {
+	case "":
+		return nil, nil
+	case "-":
+		// Hide os.Stdout.Close, so that stdout is not closed along with the
+		// log.
+		w = struct{ io.Writer }{os.Stdout}
+	default:
+		maxSize, err := parseBytesIEC(*auditLogMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		if w, err = audit.OpenRotatingFile(*auditLogPath, int64(maxSize), *auditLogMaxFiles); err != nil {
+			return nil, err
+		}
+	}
+	return audit.New(w)
+}
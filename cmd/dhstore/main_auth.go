@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/ipni/dhstore/auth"
+)
+
+var authTokensFile *string
+
+// authFlags registers the flags configuring request authorization on fs.
+func authFlags(fs *flag.FlagSet) {
+	authTokensFile = fs.String("authTokensFile", os.Getenv("DHSTORE_AUTH_TOKENS_FILE"), "Path to a file of tokens authorizing requests, one per line prefixed by its group; one of read, write or admin. Tokens are also taken from the comma separated DHSTORE_READ_TOKENS, DHSTORE_WRITE_TOKENS and DHSTORE_ADMIN_TOKENS. The file is reloaded on SIGHUP and POST /admin/api/reload. Groups without tokens are open. Overrides DHSTORE_AUTH_TOKENS_FILE.")
+}
+
+// newAuthTokens returns the tokens authorizing requests, or nil if there are
+// none, in which case all requests are authorized.
+func newAuthTokens() (*auth.Tokens, error) {
+	tokens, err := loadAuthTokens()
+	if err != nil {
+		return nil, err
+	}
+	if tokens == nil {
+		return nil, nil
+	}
+	return auth.NewTokens(tokens)
+}
+
+// reloadAuthTokens replaces the given tokens with the ones loaded from
+// authTokensFile and the environment. The previous tokens are kept on failure.
+func reloadAuthTokens(t *auth.Tokens) error {
+	if t == nil {
+		return errors.New("auth tokens file was not loaded at startup")
+	}
+	tokens, err := loadAuthTokens()
+	if err != nil {
+		return err
+	}
+	return t.Set(tokens)
+}
+
+// loadAuthTokens loads tokens from authTokensFile and the environment, or
+// returns nil if there are none.
+func loadAuthTokens() (map[auth.Group][]string, error) {
+	tokens := make(map[auth.Group][]string)
+	if *authTokensFile != "" {
+		var err error
+		if tokens, err = auth.LoadTokensFile(*authTokensFile); err != nil {
+			return nil, err
+		}
+	}
+	for group, env := range map[auth.Group]string{
+		auth.GroupRead:  "DHSTORE_READ_TOKENS",
+		auth.GroupWrite: "DHSTORE_WRITE_TOKENS",
+		auth.GroupAdmin: "DHSTORE_ADMIN_TOKENS",
+	} {
+		for _, token := range strings.Split(os.Getenv(env), ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens[group] = append(tokens[group], token)
+			}
+		}
+	}
+	if len(tokens) == 0 && *authTokensFile == "" {
+		return nil, nil
+	}
+	return tokens, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"time"
+
+	"github.com/ipni/dhstore"
+	dhbadger "github.com/ipni/dhstore/badger"
+)
+
+var badgerGCInterval *time.Duration
+var badgerGCDiscardRatio *float64
+var badgerSyncWrites *bool
+
+// badgerFlags registers the flags configuring the badger store on fs.
+func badgerFlags(fs *flag.FlagSet) {
+	badgerGCInterval = fs.Duration("badgerGCInterval", 10*time.Minute, "The interval at which the Badger value log is garbage collected. Disabled when zero.")
+	badgerGCDiscardRatio = fs.Float64("badgerGCDiscardRatio", 0.5, "The ratio of stale data in a Badger value log file, between 0 and 1 exclusive, at which the file is rewritten during garbage collection.")
+	badgerSyncWrites = fs.Bool("badgerSyncWrites", false, "Whether Badger writes are synced to disk before they are acknowledged.")
+}
+
+func newBadgerDHStore(path string) (dhstore.DHStore, error) {
+	return dhbadger.NewBadgerDHStore(filepath.Clean(path),
+		dhbadger.WithGCInterval(*badgerGCInterval),
+		dhbadger.WithGCDiscardRatio(*badgerGCDiscardRatio),
+		dhbadger.WithSyncWrites(*badgerSyncWrites))
+}
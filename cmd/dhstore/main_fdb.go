@@ -4,6 +4,7 @@ package main
 
 import (
 	"flag"
+	"time"
 
 	"github.com/ipni/dhstore"
 	"github.com/ipni/dhstore/fdb"
@@ -11,12 +12,56 @@ import (
 
 var fdbApiVersion *int
 var fdbClusterFile *string
+var fdbMaxTransactionBytes *int
+var fdbTransactionTimeout *time.Duration
+var fdbTransactionRetryLimit *int
+var fdbTransactionMaxRetryDelay *time.Duration
+var fdbTransactionPriority *string
+var fdbProbeInterval *time.Duration
+var fdbTenant *string
+var fdbMigrateLayout *bool
+var fdbHealthCheckInterval *time.Duration
+var fdbHealthCheckTimeout *time.Duration
 
-func init() {
-	fdbApiVersion = flag.Int("fdbApiVersion", 0, "Required. The FoundationDB API version as a numeric value")
-	fdbClusterFile = flag.String("fdbClusterFile", "", "Required. Path to ")
+// fdbFlags registers the flags configuring the FDB store on fs.
+func fdbFlags(fs *flag.FlagSet) {
+	fdbApiVersion = fs.Int("fdbApiVersion", 0, "Required. The FoundationDB API version as a numeric value")
+	fdbClusterFile = fs.String("fdbClusterFile", "", "Required. Path to ")
+	fdbTransactionTimeout = fs.Duration("fdbTransactionTimeout", 0, "The timeout after which FoundationDB transactions, including their retries, fail. No timeout when zero.")
+	fdbTransactionRetryLimit = fs.Int("fdbTransactionRetryLimit", -1, "The maximum number of times a FoundationDB transaction is retried. Retries indefinitely when negative.")
+	fdbTransactionMaxRetryDelay = fs.Duration("fdbTransactionMaxRetryDelay", 0, "The maximum backoff delay between FoundationDB transaction retries. Uses the FoundationDB default of 1s when zero.")
+	fdbTransactionPriority = fs.String("fdbTransactionPriority", fdb.PriorityDefault, "The priority of FoundationDB transactions; one of default, batch or immediate.")
+	fdbTenant = fs.String("fdbTenant", "", "The tenant under whose root directory data is stored, isolating it from other dhstore instances sharing the same FoundationDB cluster. Data is stored at the root when empty.")
+	fdbMigrateLayout = fs.Bool("fdbMigrateLayout", false, "Whether to migrate data stored in FoundationDB in an older layout to the current one on startup. Startup fails on older layouts otherwise.")
+	fdbProbeInterval = fs.Duration("fdbProbeInterval", 10*time.Second, "The interval at which FoundationDB client latency is probed and reported as metrics. Probing is disabled when zero.")
+	fdbHealthCheckInterval = fs.Duration("fdbHealthCheckInterval", 5*time.Second, "The interval at which FoundationDB cluster availability is checked. While unavailable, /ready and writes respond with 503. Health checks are disabled when zero.")
+	fdbHealthCheckTimeout = fs.Duration("fdbHealthCheckTimeout", 2*time.Second, "The time after which a FoundationDB health check fails.")
+	fdbMaxTransactionBytes = fs.Int("fdbMaxTransactionBytes", 1<<20, "The maximum size in bytes of index mutations written in a single FoundationDB transaction. Larger batches are split across multiple transactions.")
 }
 
 func newFDBDHStore() (dhstore.DHStore, error) {
-	return fdb.NewFDBDHStore(fdb.WithApiVersion(*fdbApiVersion), fdb.WithClusterFile(*fdbClusterFile))
+	return fdb.NewFDBDHStore(
+		fdb.WithApiVersion(*fdbApiVersion),
+		fdb.WithClusterFile(*fdbClusterFile),
+		fdb.WithMaxTransactionBytes(*fdbMaxTransactionBytes),
+		fdb.WithTransactionTimeout(*fdbTransactionTimeout),
+		fdb.WithTransactionRetryLimit(*fdbTransactionRetryLimit),
+		fdb.WithTransactionMaxRetryDelay(*fdbTransactionMaxRetryDelay),
+		fdb.WithTransactionPriority(*fdbTransactionPriority),
+		fdb.WithProbeInterval(*fdbProbeInterval),
+		fdb.WithHealthCheckInterval(*fdbHealthCheckInterval),
+		fdb.WithHealthCheckTimeout(*fdbHealthCheckTimeout),
+		fdb.WithTenant(*fdbTenant),
+		fdb.WithMigrateLayout(*fdbMigrateLayout || migrateLayout))
+}
+
+// fdbMaxValueKeySize returns the maximum size in bytes of the encrypted value
+// keys of FDB stores.
+func fdbMaxValueKeySize() int {
+	return fdb.MaxValueBytes
+}
+
+// fdbStoreFormat returns the format of the data of FDB stores.
+func fdbStoreFormat() string {
+	return fdb.StoreFormat
 }
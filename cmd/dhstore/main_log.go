@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore/audit"
+	"go.uber.org/zap"
+)
+
+// logFileScheme is the scheme of the zap sink through which logs are written
+// to the logFile.
+const logFileScheme = "dhstore-log"
+
+var (
+	logLevel        *string
+	logFormat       *string
+	logFile         *string
+	logFileMaxSize  *string
+	logFileMaxAge   *time.Duration
+	logFileMaxFiles *int
+)
+
+// logFlags registers the flags configuring logging on fs.
+func logFlags(fs *flag.FlagSet) {
+	logLevel = fs.String("logLevel", "info", "The logging level. Only applied if GOLOG_LOG_LEVEL environment variable is unset.")
+	logFormat = fs.String("logFormat", "console", "The format of logs; one of console or json. JSON logs carry their fields as JSON properties, e.g. for container log pipelines. Only applied if GOLOG_LOG_FMT environment variable is unset.")
+	logFile = fs.String("logFile", "", "Path to a file to which logs are written instead of stderr, rotated by logFileMaxSize and logFileMaxAge. Logs are written to stderr when empty.")
+	logFileMaxSize = fs.String("logFileMaxSize", "100Mi", "The size at which the logFile is rotated. Can be set in Ki, Mi or Gi.")
+	logFileMaxAge = fs.Duration("logFileMaxAge", 24*time.Hour, "The age at which the logFile is rotated, measured from when it was opened. Rotated by size only when set to 0.")
+	logFileMaxFiles = fs.Int("logFileMaxFiles", 10, "The number of rotated logFile files kept, beyond which the oldest is removed.")
+}
+
+// setupLogOutput applies the logFormat, unless GOLOG_LOG_FMT is set as looked up
+// by lookupEnv, and redirects logs from stderr to the logFile, if set.
+func setupLogOutput(lookupEnv func(string) (string, bool)) error {
+	cfg := logging.GetConfig()
+	format := cfg.Format
+	switch *logFormat {
+	case "console":
+	case "json":
+		if _, set := lookupEnv("GOLOG_LOG_FMT"); !set {
+			format = logging.JSONOutput
+		}
+	default:
+		return fmt.Errorf("unknown log format: %s", *logFormat)
+	}
+	if *logFile != "" {
+		maxSize, err := parseBytesIEC(*logFileMaxSize)
+		if err != nil {
+			return err
+		}
+		f, err := audit.OpenRotatingFile(*logFile, int64(maxSize), *logFileMaxFiles, audit.WithMaxAge(*logFileMaxAge))
+		if err != nil {
+			return err
+		}
+		if err := zap.RegisterSink(logFileScheme, func(*url.URL) (zap.Sink, error) { return f, nil }); err != nil {
+			_ = f.Close()
+			return err
+		}
+		cfg.Stderr = false
+		cfg.URL = logFileScheme + ":"
+		// Colors are meant for terminals.
+		if format == logging.ColorizedOutput {
+			format = logging.PlaintextOutput
+		}
+	} else if format == cfg.Format {
+		return nil
+	}
+	cfg.Format = format
+	logging.SetupLogging(cfg)
+	return nil
+}
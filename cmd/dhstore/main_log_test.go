@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupLogOutput(t *testing.T) {
+	original := logging.GetConfig()
+	original.Format = logging.ColorizedOutput
+	restore := func() { logging.SetupLogging(original) }
+	restore()
+	t.Cleanup(restore)
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    logging.LogFormat
+		wantErr string
+	}{
+		{name: "console by default", want: logging.ColorizedOutput},
+		{name: "console", args: []string{"-logFormat", "console"}, want: logging.ColorizedOutput},
+		{name: "json", args: []string{"-logFormat", "json"}, want: logging.JSONOutput},
+		{name: "GOLOG_LOG_FMT takes precedence", args: []string{"-logFormat", "json"}, env: map[string]string{"GOLOG_LOG_FMT": "nocolor"}, want: logging.ColorizedOutput},
+		{name: "unknown", args: []string{"-logFormat", "xml"}, wantErr: "unknown log format: xml"},
+		{name: "case sensitive", args: []string{"-logFormat", "JSON"}, wantErr: "unknown log format: JSON"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Cleanup(restore)
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			logFlags(fs)
+			require.NoError(t, fs.Parse(test.args))
+
+			err := setupLogOutput(func(name string) (string, bool) {
+				v, ok := test.env[name]
+				return v, ok
+			})
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				require.Equal(t, original.Format, logging.GetConfig().Format)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, logging.GetConfig().Format)
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/mirror"
+)
+
+var mirrorStoreTypes arrayFlags
+var mirrorQueueSize *int
+
+// mirrorFlags registers the flags configuring the mirroring of writes on fs.
+func mirrorFlags(fs *flag.FlagSet) {
+	mirrorStoreTypes = nil
+	fs.Var(&mirrorStoreTypes, "mirrorStoreType", "A store type to which all writes are mirrored, e.g. to dual-write into a new backend during a migration; one of `fdb`, `yugabyte-ycql`, `sql`, `redis` or `remote`, configured by the same args as the corresponding storeType. Lookups are served by the store selected by storeType. Multiple OK, with distinct types.")
+	mirrorQueueSize = fs.Int("mirrorQueueSize", 0, "The number of writes queued for each mirrorStoreType, making mirrored writes asynchronous. Writes to a store whose queue is full are dropped. Mirrored writes are synchronous when zero.")
+}
+
+func newMirrorDHStore(primary dhstore.DHStore) (*mirror.MirrorDHStore, error) {
+	opts := []mirror.Option{mirror.WithAsync(*mirrorQueueSize)}
+	for _, storeType := range mirrorStoreTypes {
+		var target dhstore.DHStore
+		var err error
+		switch storeType {
+		case "fdb":
+			target, err = newFDBDHStore()
+		case "yugabyte-ycql":
+			target, err = newYCQLDHStore()
+		case "sql":
+			target, err = newSQLDHStore()
+		case "redis":
+			target, err = newRedisDHStore()
+		case "remote":
+			target, err = newRemoteDHStore()
+		default:
+			err = fmt.Errorf("unsupported mirrorStoreType: %s", storeType)
+		}
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, mirror.WithTarget(storeType, target))
+	}
+	return mirror.NewMirrorDHStore(primary, opts...)
+}
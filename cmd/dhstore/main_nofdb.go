@@ -4,10 +4,24 @@ package main
 
 import (
 	"errors"
+	"flag"
 
 	"github.com/ipni/dhstore"
 )
 
+// fdbFlags registers no flags, since FDB stores are not supported.
+func fdbFlags(*flag.FlagSet) {}
+
 func newFDBDHStore() (dhstore.DHStore, error) {
 	return nil, errors.New("dhstore built without fdb support")
 }
+
+// fdbMaxValueKeySize returns no limit, since FDB stores are not supported.
+func fdbMaxValueKeySize() int {
+	return 0
+}
+
+// fdbStoreFormat returns no format, since FDB stores are not supported.
+func fdbStoreFormat() string {
+	return ""
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/redis"
+)
+
+var redisAddrs *string
+var redisMasterName *string
+var redisDB *int
+var redisUsername *string
+var redisPasswordFile *string
+var redisKeyPrefix *string
+var redisTimeout *time.Duration
+var redisMaxBatchSize *int
+
+// redisFlags registers the flags configuring the Redis store on fs.
+func redisFlags(fs *flag.FlagSet) {
+	redisAddrs = fs.String("redisAddrs", "127.0.0.1:6379", "Comma separated addresses of the Redis servers to connect to. Multiple addresses connect to a Redis Cluster, unless redisMasterName is set.")
+	redisMasterName = fs.String("redisMasterName", "", "The name of the master monitored by the Redis Sentinels at redisAddrs. Sentinels are not used when empty.")
+	redisDB = fs.Int("redisDB", 0, "The logical Redis database in which keys are stored. Not supported by Redis Cluster.")
+	redisUsername = fs.String("redisUsername", os.Getenv("DHSTORE_REDIS_USERNAME"), "The username with which to authenticate to Redis. Overrides DHSTORE_REDIS_USERNAME.")
+	redisPasswordFile = fs.String("redisPasswordFile", os.Getenv("DHSTORE_REDIS_PASSWORD_FILE"), "Path to a file containing the Redis password. Overrides DHSTORE_REDIS_PASSWORD_FILE. The password is taken from DHSTORE_REDIS_PASSWORD when empty.")
+	redisKeyPrefix = fs.String("redisKeyPrefix", "dhstore/", "The prefix of the Redis keys of the store.")
+	redisTimeout = fs.Duration("redisTimeout", 5*time.Second, "The timeout of Redis commands.")
+	redisMaxBatchSize = fs.Int("redisMaxBatchSize", 100, "The maximum number of commands sent in a single Redis pipeline. Larger batches of writes are split across multiple pipelines.")
+}
+
+func newRedisDHStore() (dhstore.DHStore, error) {
+	password := os.Getenv("DHSTORE_REDIS_PASSWORD")
+	if *redisPasswordFile != "" {
+		b, err := os.ReadFile(*redisPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis password file: %w", err)
+		}
+		password = strings.TrimSpace(string(b))
+	}
+	return redis.NewRedisDHStore(
+		redis.WithAddrs(strings.Split(*redisAddrs, ",")...),
+		redis.WithMasterName(*redisMasterName),
+		redis.WithDB(*redisDB),
+		redis.WithCredentials(*redisUsername, password),
+		redis.WithKeyPrefix(*redisKeyPrefix),
+		redis.WithTimeout(*redisTimeout),
+		redis.WithMaxBatchSize(*redisMaxBatchSize))
+}
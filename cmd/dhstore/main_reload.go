@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ipni/dhstore/auth"
+	"github.com/ipni/dhstore/reload"
+	"gopkg.in/yaml.v3"
+)
+
+var runtimeTunablesPath *string
+
+// reloadFlags registers the flags configuring runtime tunables on fs.
+func reloadFlags(fs *flag.FlagSet) {
+	runtimeTunablesPath = fs.String("runtimeTunables", "", "Path to a YAML or JSON file of settings that are applied at startup and reapplied, along with authTokensFile, on SIGHUP or POST /admin/api/reload without restarting; one of logLevel, concurrencyLimit, concurrencyQueueTimeout, maintenanceRate, providersURLs or blockCacheSize. Settings in the file override the corresponding flags.")
+}
+
+// runtimeTunables represents the settings that can be changed while running
+// via the file at runtimeTunablesPath. Unset settings are left unchanged.
+type runtimeTunables struct {
+	LogLevel                *string        `yaml:"logLevel"`
+	ConcurrencyLimit        *int           `yaml:"concurrencyLimit"`
+	ConcurrencyQueueTimeout *time.Duration `yaml:"concurrencyQueueTimeout"`
+	MaintenanceRate         *float64       `yaml:"maintenanceRate"`
+	ProvidersURLs           *[]string      `yaml:"providersURLs"`
+	// BlockCacheSize can be at most the pebble block cache size at startup.
+	BlockCacheSize *byteSize `yaml:"blockCacheSize"`
+}
+
+// loadRuntimeTunables reads the runtime tunables from the file at the given
+// path. Since JSON is a subset of YAML, the file may be in either format.
+func loadRuntimeTunables(path string) (*runtimeTunables, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t runtimeTunables
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&t); err != nil {
+		return nil, fmt.Errorf("failed to decode runtime tunables %s: %w", path, err)
+	}
+	return &t, nil
+}
+
+// tunables returns the runtime tunables to apply.
+func (t *runtimeTunables) tunables() *reload.Tunables {
+	rt := &reload.Tunables{
+		LogLevel:                t.LogLevel,
+		ConcurrencyLimit:        t.ConcurrencyLimit,
+		ConcurrencyQueueTimeout: t.ConcurrencyQueueTimeout,
+		MaintenanceRate:         t.MaintenanceRate,
+		ProvidersURLs:           t.ProvidersURLs,
+	}
+	if t.BlockCacheSize != nil {
+		size := int64(*t.BlockCacheSize)
+		rt.BlockCacheSize = &size
+	}
+	return rt
+}
+
+// reloader reloads auth tokens and applies the runtime tunables.
+type reloader struct {
+	mu         sync.Mutex
+	authTokens *auth.Tokens
+	tunables   *reload.Reloader
+}
+
+// reload reloads auth tokens from authTokensFile and applies the runtime
+// tunables at runtimeTunablesPath. The tunables are applied only if all are
+// valid, independently of reloading auth tokens.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	if *authTokensFile != "" {
+		if err := reloadAuthTokens(r.authTokens); err != nil {
+			errs = append(errs, fmt.Errorf("failed to reload auth tokens: %w", err))
+		} else {
+			log.Infow("Reloaded auth tokens", "path", *authTokensFile)
+		}
+	}
+	if *runtimeTunablesPath != "" {
+		t, err := loadRuntimeTunables(*runtimeTunablesPath)
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		if err := r.tunables.Apply(t.tunables()); err != nil {
+			errs = append(errs, err)
+		} else {
+			log.Infow("Applied runtime tunables", "path", *runtimeTunablesPath)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reloadOnSIGHUP calls reload on SIGHUP, logging failures.
+func reloadOnSIGHUP(reload func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reload(); err != nil {
+				log.Errorw("Failed to reload configuration", "err", err)
+			}
+		}
+	}()
+}
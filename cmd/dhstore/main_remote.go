@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/remotestore"
+)
+
+var remoteURL *string
+var remoteTimeout *time.Duration
+
+// remoteFlags registers the flags configuring the remote store on fs.
+func remoteFlags(fs *flag.FlagSet) {
+	remoteURL = fs.String("remoteURL", "", "The base URL of the HTTP API of the dhstore node backing the remote store type, e.g. http://dhstore:40080.")
+	remoteTimeout = fs.Duration("remoteTimeout", 30*time.Second, "The timeout of requests to remoteURL, excluding exports.")
+}
+
+func newRemoteDHStore() (dhstore.DHStore, error) {
+	return remotestore.NewRemoteDHStore(*remoteURL, remotestore.WithTimeout(*remoteTimeout), remotestore.WithHTTPClient(httpClient))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/s3"
+)
+
+var s3Endpoint *string
+var s3Bucket *string
+var s3Prefix *string
+var s3Region *string
+var s3AccessKeyID *string
+var s3SecretAccessKeyFile *string
+var s3CacheDir *string
+var s3Timeout *time.Duration
+var s3RefreshInterval *time.Duration
+
+// s3Flags registers the flags configuring the S3 store on fs.
+func s3Flags(fs *flag.FlagSet) {
+	s3Endpoint = fs.String("s3Endpoint", "https://s3.amazonaws.com", "The URL of the S3 compatible service from which segments are served. Objects are addressed path-style.")
+	s3Bucket = fs.String("s3Bucket", "", "The bucket in which segments are stored.")
+	s3Prefix = fs.String("s3Prefix", "", "The prefix of the keys of the segments in s3Bucket. All objects under it with the .seg extension are served.")
+	s3Region = fs.String("s3Region", "us-east-1", "The region of s3Bucket.")
+	s3AccessKeyID = fs.String("s3AccessKeyID", os.Getenv("DHSTORE_S3_ACCESS_KEY_ID"), "The access key ID with which S3 requests are signed. Requests are anonymous when empty. Overrides DHSTORE_S3_ACCESS_KEY_ID.")
+	s3SecretAccessKeyFile = fs.String("s3SecretAccessKeyFile", os.Getenv("DHSTORE_S3_SECRET_ACCESS_KEY_FILE"), "Path to a file containing the secret of s3AccessKeyID. Overrides DHSTORE_S3_SECRET_ACCESS_KEY_FILE. The secret is taken from DHSTORE_S3_SECRET_ACCESS_KEY when empty.")
+	s3CacheDir = fs.String("s3CacheDir", "", "The local directory in which the index and bloom filter of each segment are cached. Caching is disabled when empty.")
+	s3Timeout = fs.Duration("s3Timeout", 30*time.Second, "The timeout of S3 requests.")
+	s3RefreshInterval = fs.Duration("s3RefreshInterval", 10*time.Minute, "The interval at which s3Bucket is listed to pick up added or removed segments. Disabled when zero.")
+}
+
+func newS3DHStore() (dhstore.DHStore, error) {
+	secret := os.Getenv("DHSTORE_S3_SECRET_ACCESS_KEY")
+	if *s3SecretAccessKeyFile != "" {
+		b, err := os.ReadFile(*s3SecretAccessKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read S3 secret access key file: %w", err)
+		}
+		secret = strings.TrimSpace(string(b))
+	}
+	return s3.NewS3DHStore(
+		s3.WithEndpoint(*s3Endpoint),
+		s3.WithBucket(*s3Bucket),
+		s3.WithPrefix(*s3Prefix),
+		s3.WithRegion(*s3Region),
+		s3.WithCredentials(*s3AccessKeyID, secret),
+		s3.WithCacheDir(*s3CacheDir),
+		s3.WithTimeout(*s3Timeout),
+		s3.WithRefreshInterval(*s3RefreshInterval))
+}
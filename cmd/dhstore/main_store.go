@@ -0,0 +1,253 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/metrics"
+	dhpebble "github.com/ipni/dhstore/pebble"
+)
+
+var (
+	storeType                             *string
+	storePath                             *string
+	dwal                                  *bool
+	maxConcurrentCompactions              int
+	l0StopWritesThreshold                 *int
+	l0CompactionThreshold                 *int
+	l0CompactionFileThreshold             *int
+	experimentalL0CompactionConcurrency   *int
+	blockCacheSize                        *string
+	pebbleConfigPath                      *string
+	pebbleMaxIterators                    *int
+	pebbleIteratorLeakTimeout             *time.Duration
+	experimentalCompactionDebtConcurrency *string
+	autoTune                              *bool
+	maxValueKeySize                       *int
+
+	// migrateLayout is whether opening the store migrates the layout of its
+	// data to the current one, regardless of fdbMigrateLayout.
+	migrateLayout bool
+)
+
+// storeFlags registers the flags selecting the store and configuring each store
+// type on fs.
+func storeFlags(fs *flag.FlagSet) {
+	storeType = fs.String("storeType", "pebble", "The store type to use; one of `pebble`, `badger`, `fdb`, `yugabyte-ycql`, `sql`, `redis`, `s3` or `remote`. Defaults to `pebble`. When `badger` is selected, data is persisted at `storePath`. When `fdb` is selected, all `fdb*` args must be set. When `yugabyte-ycql` is selected, `ycql*` args configure the connection. When `sql` is selected, `sqlDSN` must be set. When `redis` is selected, `redis*` args configure the connection. When `s3` is selected, segments are served read-only from the bucket configured by `s3*` args. When `remote` is selected, requests are proxied to the dhstore node at `remoteURL`.")
+	storePath = fs.String("storePath", "./dhstore/store", "The path at which the dhstore data persisted.")
+	dwal = fs.Bool("disableWAL", false, "Weather to disable WAL in Pebble dhstore.")
+	fs.IntVar(&maxConcurrentCompactions, "maxConcurrentCompactions", 10, "Specifies the maximum number of concurrent Pebble compactions. As a rule of thumb set it to the number of the CPU cores.")
+	l0StopWritesThreshold = fs.Int("l0StopWritesThreshold", 12, "Hard limit on Pebble L0 read-amplification. Writes are stopped when this threshold is reached.")
+	l0CompactionThreshold = fs.Int("l0CompactionThreshold", 2, "The amount of L0 read-amplification necessary to trigger an L0 compaction.")
+	l0CompactionFileThreshold = fs.Int("l0CompactionFileThreshold", 500, "The count of L0 files necessary to trigger an L0 compaction.")
+	experimentalL0CompactionConcurrency = fs.Int("experimentalL0CompactionConcurrency", 10, "The threshold of L0 read-amplification at which compaction concurrency is enabled (if CompactionDebtConcurrency was not already exceeded). Every multiple of this value enables another concurrent compaction up to MaxConcurrentCompactions.")
+	autoTune = fs.Bool("autoTune", false, "Whether to derive the pebble block cache size, memtable size, maxConcurrentCompactions and L0 thresholds from the memory, CPUs and disk type of the host, and log the chosen values. Flags that are set explicitly take precedence, as do options of pebbleConfig.")
+	blockCacheSize = fs.String("blockCacheSize", "1Gi", "Size of pebble block cache. Can be set in Mi or Gi.")
+	pebbleConfigPath = fs.String("pebbleConfig", "", "Path to a YAML or JSON file specifying Pebble options. Options set in the file override the ones set via Pebble flags.")
+	pebbleMaxIterators = fs.Int("pebbleMaxIterators", 0, "The maximum number of Pebble iterators open at once, e.g. by exports. Requests that would exceed it are rejected with 503. Unlimited when zero.")
+	pebbleIteratorLeakTimeout = fs.Duration("pebbleIteratorLeakTimeout", 0, "The time an open Pebble iterator may go unused before it is considered leaked and force-closed. Disabled when zero.")
+	experimentalCompactionDebtConcurrency = fs.String("experimentalCompactionDebtConcurrency", "1Gi", "CompactionDebtConcurrency controls the threshold of compaction debt at which additional compaction concurrency slots are added. For every multiple of this value in compaction debt bytes, an additional concurrent compaction is added. This works \"on top\" of L0CompactionConcurrency, so the higher of the count of compaction concurrency slots as determined by the two options is chosen. Can be set in Mi or Gi.")
+
+	badgerFlags(fs)
+	fdbFlags(fs)
+	ycqlFlags(fs)
+	sqlFlags(fs)
+	redisFlags(fs)
+	s3Flags(fs)
+	remoteFlags(fs)
+}
+
+// writeFlags registers the flags limiting the records written to the store on
+// fs.
+func writeFlags(fs *flag.FlagSet) {
+	maxValueKeySize = fs.Int("maxValueKeySize", 0, "The maximum size in bytes of encrypted value keys, beyond which merges over HTTP and gRPC are rejected with 400 and InvalidArgument respectively, and imports fail, regardless of the store type. Defaults to the limit of the fdb store of 100000 bytes when storeType or mirrorStoreType is fdb, which it may not exceed, and to unbounded otherwise.")
+}
+
+// valueKeySizeLimit returns the maximum size of encrypted value keys set by the
+// maxValueKeySize flag of fs, defaulting to fdbLimit, the limit of the fdb
+// store, if storeType or a mirrorStoreType is fdb, in which case larger sizes
+// are rejected, since the store would fail the writes they let through. Zero
+// means unbounded.
+func valueKeySizeLimit(fs *flag.FlagSet, fdbLimit int) (int, error) {
+	size := *maxValueKeySize
+	if size < 0 {
+		return 0, fmt.Errorf("maxValueKeySize cannot be negative, got: %d", size)
+	}
+	usesFDB := *storeType == "fdb"
+	for _, t := range mirrorStoreTypes {
+		usesFDB = usesFDB || t == "fdb"
+	}
+	if !usesFDB || fdbLimit == 0 {
+		return size, nil
+	}
+	var set bool
+	fs.Visit(func(f *flag.Flag) { set = set || f.Name == "maxValueKeySize" })
+	switch {
+	case !set:
+		return fdbLimit, nil
+	case size == 0 || size > fdbLimit:
+		return 0, fmt.Errorf("maxValueKeySize must be between 1 and the limit of the fdb store of %d bytes, got: %d", fdbLimit, size)
+	}
+	return size, nil
+}
+
+// openedStore is the store selected by storeType, along with what is needed to
+// report on and tune it.
+type openedStore struct {
+	store         dhstore.DHStore
+	options       string
+	pebbleMetrics func() *pebble.Metrics
+	blockCache    *pebble.Cache
+	metricsOpts   []metrics.Option
+}
+
+// openStore opens the store selected by storeType, as configured by the flags
+// of fs.
+func openStore(fs *flag.FlagSet) *openedStore {
+	var o openedStore
+	switch *storeType {
+	case "pebble":
+		parsedBlockCacheSize, err := parseBytesIEC(*blockCacheSize)
+		if err != nil {
+			log.Fatalw("Failed to parse block cache size", "err", err)
+		}
+		parsedExperimentalCompactionDebtConcurrency, err := parseBytesIEC(*experimentalCompactionDebtConcurrency)
+		if err != nil {
+			log.Fatalw("Failed to parse experimental compaction debt concurrency", "err", err)
+		}
+		var memTableSize uint64 = 64 << 20 // 64 MiB
+		if *autoTune {
+			autoTunePebble(fs, *storePath, &parsedBlockCacheSize, &memTableSize)
+		}
+
+		// Default options copied from cockroachdb with the addition of a custom sized block cache and configurable compaction options.
+		// See:
+		// - https://github.com/cockroachdb/cockroach/blob/v22.1.6/pkg/storage/pebble.go#L479
+		opts := &pebble.Options{
+			BytesPerSync:                10 << 20, // 10 MiB
+			WALBytesPerSync:             10 << 20, // 10 MiB
+			MaxConcurrentCompactions:    func() int { return maxConcurrentCompactions },
+			MemTableSize:                memTableSize,
+			MemTableStopWritesThreshold: 4,
+			LBaseMaxBytes:               64 << 20, // 64 MiB
+			L0CompactionThreshold:       *l0CompactionThreshold,
+			L0StopWritesThreshold:       *l0StopWritesThreshold,
+			L0CompactionFileThreshold:   *l0CompactionFileThreshold,
+			DisableWAL:                  *dwal,
+			WALMinSyncInterval:          func() time.Duration { return 30 * time.Second },
+		}
+
+		opts.Experimental.ReadCompactionRate = 10 << 20 // 20 MiB
+		opts.Experimental.CompactionDebtConcurrency = parsedExperimentalCompactionDebtConcurrency
+		opts.Experimental.L0CompactionConcurrency = *experimentalL0CompactionConcurrency
+
+		opts.Levels = make([]pebble.LevelOptions, numLevels)
+		for i := 0; i < numLevels; i++ {
+			l := &opts.Levels[i]
+			l.BlockSize = 32 << 10       // 32 KiB
+			l.IndexBlockSize = 256 << 10 // 256 KiB
+			l.FilterPolicy = bloom.FilterPolicy(10)
+			l.FilterType = pebble.TableFilter
+			if i > 0 {
+				l.TargetFileSize = opts.Levels[i-1].TargetFileSize * 2
+			}
+			l.EnsureDefaults()
+		}
+		opts.Levels[numLevels-1].FilterPolicy = nil
+		opts.Cache = pebble.NewCache(int64(parsedBlockCacheSize))
+
+		if *pebbleConfigPath != "" {
+			pebbleCfg, err := loadPebbleConfig(*pebbleConfigPath)
+			if err != nil {
+				log.Fatalw("Failed to load pebble config", "err", err)
+			}
+			if err := pebbleCfg.apply(opts); err != nil {
+				log.Fatalw("Failed to apply pebble config", "path", *pebbleConfigPath, "err", err)
+			}
+			log.Infow("Applied pebble config", "path", *pebbleConfigPath)
+		}
+		o.blockCache = opts.Cache
+
+		// Report compactions, flushes, slow disk operations and write stalls
+		// as logs and metrics.
+		pebbleEvents := metrics.NewPebbleEvents(clock.New())
+		opts.AddEventListener(pebbleEvents.EventListener())
+		opts.WithFSDefaults()
+		o.metricsOpts = append(o.metricsOpts, metrics.WithPebbleEvents(pebbleEvents))
+
+		path := filepath.Clean(*storePath)
+		pbstore, err := dhpebble.NewPebbleDHStore(path, opts,
+			dhpebble.WithMaxIterators(*pebbleMaxIterators),
+			dhpebble.WithIteratorLeakTimeout(*pebbleIteratorLeakTimeout))
+		if err != nil {
+			panic(err)
+		}
+		o.store = pbstore
+		o.pebbleMetrics = pbstore.Metrics
+		o.metricsOpts = append(o.metricsOpts, metrics.WithPebbleIteratorMetrics(pbstore.IteratorMetrics), metrics.WithRecordCountMetrics(pbstore.RecordCounts),
+			metrics.WithDiskUsageMetrics(pbstore.DiskUsage))
+		o.options = opts.String()
+		log.Infow("Store opened.", "path", path)
+	case "badger":
+		var err error
+		o.store, err = newBadgerDHStore(*storePath)
+		if err != nil {
+			panic(err)
+		}
+		log.Infow("Using Badger backing store.", "path", filepath.Clean(*storePath))
+	case "fdb":
+		var err error
+		o.store, err = newFDBDHStore()
+		if err != nil {
+			panic(err)
+		}
+		if fdbStore, ok := o.store.(interface{ Metrics() *metrics.FDBMetrics }); ok {
+			o.metricsOpts = append(o.metricsOpts, metrics.WithFDBMetrics(fdbStore.Metrics))
+		}
+		log.Infow("Using FoundationDB backing store.")
+	case "yugabyte-ycql":
+		var err error
+		o.store, err = newYCQLDHStore()
+		if err != nil {
+			panic(err)
+		}
+		log.Infow("Using YugabyteDB YCQL backing store.")
+	case "sql":
+		var err error
+		o.store, err = newSQLDHStore()
+		if err != nil {
+			panic(err)
+		}
+		log.Infow("Using SQL backing store.", "dialect", *sqlDialect)
+	case "redis":
+		var err error
+		o.store, err = newRedisDHStore()
+		if err != nil {
+			panic(err)
+		}
+		log.Infow("Using Redis backing store.")
+	case "s3":
+		var err error
+		o.store, err = newS3DHStore()
+		if err != nil {
+			panic(err)
+		}
+		log.Infow("Using read-only S3 segment store.")
+	case "remote":
+		var err error
+		o.store, err = newRemoteDHStore()
+		if err != nil {
+			panic(err)
+		}
+		log.Infow("Using remote dhstore backing store.", "url", *remoteURL)
+	default:
+		panic("unknown storeType: " + *storeType)
+	}
+	return &o
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueKeySizeLimit(t *testing.T) {
+	const fdbLimit = 100_000
+	tests := []struct {
+		name    string
+		args    []string
+		want    int
+		wantErr string
+	}{
+		{name: "pebble is unbounded by default", want: 0},
+		{name: "pebble", args: []string{"-maxValueKeySize", "200000"}, want: 200_000},
+		{name: "fdb defaults to its limit", args: []string{"-storeType", "fdb"}, want: fdbLimit},
+		{name: "fdb mirror defaults to its limit", args: []string{"-mirrorStoreType", "fdb"}, want: fdbLimit},
+		{name: "fdb below its limit", args: []string{"-storeType", "fdb", "-maxValueKeySize", "1024"}, want: 1024},
+		{name: "fdb at its limit", args: []string{"-storeType", "fdb", "-maxValueKeySize", "100000"}, want: fdbLimit},
+		{name: "fdb above its limit", args: []string{"-storeType", "fdb", "-maxValueKeySize", "200000"}, wantErr: "maxValueKeySize must be between 1 and the limit of the fdb store of 100000 bytes, got: 200000"},
+		{name: "fdb unbounded", args: []string{"-storeType", "fdb", "-maxValueKeySize", "0"}, wantErr: "maxValueKeySize must be between 1 and the limit of the fdb store of 100000 bytes, got: 0"},
+		{name: "negative", args: []string{"-maxValueKeySize", "-1"}, wantErr: "maxValueKeySize cannot be negative, got: -1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			storeFlags(fs)
+			writeFlags(fs)
+			mirrorFlags(fs)
+			require.NoError(t, fs.Parse(test.args))
+
+			got, err := valueKeySizeLimit(fs, fdbLimit)
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var tlsCert *string
+var tlsKey *string
+var tlsAutocertHosts *string
+var tlsAutocertCacheDir *string
+var tlsAutocertEmail *string
+var tlsWriteClientCA *string
+
+// tlsFlags registers the flags configuring TLS on fs.
+func tlsFlags(fs *flag.FlagSet) {
+	tlsCert = fs.String("tlsCert", "", "Path to a PEM encoded certificate with which to serve the HTTP API over HTTPS, and the gRPC API over TLS. Requires tlsKey. Served over plaintext when neither tlsCert nor tlsAutocertHosts are set.")
+	tlsKey = fs.String("tlsKey", "", "Path to the PEM encoded private key of tlsCert.")
+	tlsAutocertHosts = fs.String("tlsAutocertHosts", "", "Comma separated host names for which to obtain certificates from Let's Encrypt via ACME, in order to serve the HTTP API over HTTPS, and the gRPC API over TLS. The TLS-ALPN-01 challenge is used, and so listenAddr must be reachable on port 443. Mutually exclusive with tlsCert.")
+	tlsAutocertCacheDir = fs.String("tlsAutocertCacheDir", "./dhstore/autocert", "The directory in which certificates obtained via ACME are cached across restarts.")
+	tlsAutocertEmail = fs.String("tlsAutocertEmail", "", "Optional contact email address registered with the ACME account, e.g. to be notified about certificate problems.")
+	tlsWriteClientCA = fs.String("tlsWriteClientCA", "", "Path to PEM encoded CA certificates against which to verify client certificates of write requests, e.g. PUT and DELETE, and of write RPCs. Writes without a verified client certificate are rejected with 403, or PermissionDenied over gRPC, while reads remain open. Requires HTTPS. Disabled when empty.")
+}
+
+// newTLSConfig returns the TLS configuration with which to serve the HTTP and
+// gRPC APIs, or nil if they are to be served over plaintext.
+func newTLSConfig() (*tls.Config, error) {
+	switch {
+	case *tlsCert != "" && *tlsAutocertHosts != "":
+		return nil, errors.New("tlsCert and tlsAutocertHosts are mutually exclusive")
+	case *tlsCert != "" || *tlsKey != "":
+		if *tlsCert == "" || *tlsKey == "" {
+			return nil, errors.New("tlsCert and tlsKey must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, nil
+	case *tlsAutocertHosts != "":
+		var hosts []string
+		for _, host := range strings.Split(*tlsAutocertHosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      autocert.DirCache(*tlsAutocertCacheDir),
+			Email:      *tlsAutocertEmail,
+		}
+		tlsConfig := m.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		return tlsConfig, nil
+	default:
+		return nil, nil
+	}
+}
+
+// newWriteClientCAs returns the pool of CAs against which to verify the client
+// certificates of write requests, or nil if writes need no client certificate.
+func newWriteClientCAs() (*x509.CertPool, error) {
+	if *tlsWriteClientCA == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(*tlsWriteClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", *tlsWriteClientCA)
+	}
+	return pool, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/ycql"
+)
+
+var ycqlHosts *string
+var ycqlKeyspace *string
+var ycqlConsistency *string
+var ycqlTimeout *time.Duration
+var ycqlMaxBatchSize *int
+var ycqlReplicationFactor *int
+var ycqlSSLMode *string
+var ycqlSSLRootCert *string
+var ycqlSSLCert *string
+var ycqlSSLKey *string
+var ycqlUsername *string
+var ycqlPasswordFile *string
+
+// ycqlFlags registers the flags configuring the YCQL store on fs.
+func ycqlFlags(fs *flag.FlagSet) {
+	ycqlHosts = fs.String("ycqlHosts", "127.0.0.1:9042", "Comma separated addresses of the YugabyteDB YCQL servers to connect to initially.")
+	ycqlKeyspace = fs.String("ycqlKeyspace", "dhstore", "The YCQL keyspace in which tables are stored. Created if it does not exist.")
+	ycqlConsistency = fs.String("ycqlConsistency", "QUORUM", "The consistency level of YCQL queries.")
+	ycqlTimeout = fs.Duration("ycqlTimeout", 10*time.Second, "The timeout of YCQL queries.")
+	ycqlMaxBatchSize = fs.Int("ycqlMaxBatchSize", 100, "The maximum number of statements sent in a single YCQL batch. Larger batches of index mutations are split across multiple batches.")
+	ycqlReplicationFactor = fs.Int("ycqlReplicationFactor", 3, "The replication factor of the YCQL keyspace, if it is created.")
+	ycqlSSLMode = fs.String("ycqlSSLMode", envOr("DHSTORE_YCQL_SSL_MODE", ycql.SSLModeDisable), "Whether to connect to YCQL over TLS, and how the server certificate is verified; one of disable, require, verify-ca or verify-full. Overrides DHSTORE_YCQL_SSL_MODE.")
+	ycqlSSLRootCert = fs.String("ycqlSSLRootCert", os.Getenv("DHSTORE_YCQL_SSL_ROOT_CERT"), "Path to the PEM encoded CA certificates trusted to sign the YCQL server certificate. The system CAs are trusted when empty. Overrides DHSTORE_YCQL_SSL_ROOT_CERT.")
+	ycqlSSLCert = fs.String("ycqlSSLCert", os.Getenv("DHSTORE_YCQL_SSL_CERT"), "Path to the PEM encoded client certificate presented to YCQL servers. Overrides DHSTORE_YCQL_SSL_CERT.")
+	ycqlSSLKey = fs.String("ycqlSSLKey", os.Getenv("DHSTORE_YCQL_SSL_KEY"), "Path to the PEM encoded key of ycqlSSLCert. Overrides DHSTORE_YCQL_SSL_KEY.")
+	ycqlUsername = fs.String("ycqlUsername", os.Getenv("DHSTORE_YCQL_USERNAME"), "The username with which to authenticate to YCQL. Authentication is disabled when empty. Overrides DHSTORE_YCQL_USERNAME.")
+	ycqlPasswordFile = fs.String("ycqlPasswordFile", os.Getenv("DHSTORE_YCQL_PASSWORD_FILE"), "Path to a file containing the password of ycqlUsername. Overrides DHSTORE_YCQL_PASSWORD_FILE. The password is taken from DHSTORE_YCQL_PASSWORD when empty.")
+}
+
+// envOr returns the value of the given environment variable, or def if it is
+// unset.
+func envOr(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+func newYCQLDHStore() (dhstore.DHStore, error) {
+	password := os.Getenv("DHSTORE_YCQL_PASSWORD")
+	if *ycqlPasswordFile != "" {
+		b, err := os.ReadFile(*ycqlPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read YCQL password file: %w", err)
+		}
+		password = strings.TrimSpace(string(b))
+	}
+	return ycql.NewYCQLDHStore(
+		ycql.WithHosts(strings.Split(*ycqlHosts, ",")...),
+		ycql.WithKeyspace(*ycqlKeyspace),
+		ycql.WithConsistency(*ycqlConsistency),
+		ycql.WithTimeout(*ycqlTimeout),
+		ycql.WithMaxBatchSize(*ycqlMaxBatchSize),
+		ycql.WithReplicationFactor(*ycqlReplicationFactor),
+		ycql.WithSSLMode(*ycqlSSLMode),
+		ycql.WithSSLRootCert(*ycqlSSLRootCert),
+		ycql.WithSSLClientCert(*ycqlSSLCert, *ycqlSSLKey),
+		ycql.WithCredentials(*ycqlUsername, password))
+}
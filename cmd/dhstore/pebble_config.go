@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// pebbleConfig represents the Pebble options that can be set via a YAML or
+	// JSON config file. Every field is optional; only the fields present in the
+	// file override the options derived from command-line flags.
+	pebbleConfig struct {
+		BytesPerSync                *byteSize           `yaml:"bytesPerSync"`
+		CacheSize                   *byteSize           `yaml:"cacheSize"`
+		DisableWAL                  *bool               `yaml:"disableWAL"`
+		FlushSplitBytes             *byteSize           `yaml:"flushSplitBytes"`
+		L0CompactionFileThreshold   *int                `yaml:"l0CompactionFileThreshold"`
+		L0CompactionThreshold       *int                `yaml:"l0CompactionThreshold"`
+		L0StopWritesThreshold       *int                `yaml:"l0StopWritesThreshold"`
+		LBaseMaxBytes               *byteSize           `yaml:"lBaseMaxBytes"`
+		MaxConcurrentCompactions    *int                `yaml:"maxConcurrentCompactions"`
+		MaxManifestFileSize         *byteSize           `yaml:"maxManifestFileSize"`
+		MaxOpenFiles                *int                `yaml:"maxOpenFiles"`
+		MemTableSize                *byteSize           `yaml:"memTableSize"`
+		MemTableStopWritesThreshold *int                `yaml:"memTableStopWritesThreshold"`
+		TargetByteDeletionRate      *byteSize           `yaml:"targetByteDeletionRate"`
+		WALBytesPerSync             *byteSize           `yaml:"walBytesPerSync"`
+		WALDir                      *string             `yaml:"walDir"`
+		WALMinSyncInterval          *time.Duration      `yaml:"walMinSyncInterval"`
+		Levels                      []pebbleLevelConfig `yaml:"levels"`
+		Experimental                struct {
+			CompactionDebtConcurrency *byteSize `yaml:"compactionDebtConcurrency"`
+			ForceWriterParallelism    *bool     `yaml:"forceWriterParallelism"`
+			L0CompactionConcurrency   *int      `yaml:"l0CompactionConcurrency"`
+			LevelMultiplier           *int      `yaml:"levelMultiplier"`
+			MaxWriterConcurrency      *int      `yaml:"maxWriterConcurrency"`
+			ReadCompactionRate        *int64    `yaml:"readCompactionRate"`
+			ReadSamplingMultiplier    *int64    `yaml:"readSamplingMultiplier"`
+			TableCacheShards          *int      `yaml:"tableCacheShards"`
+			ValidateOnIngest          *bool     `yaml:"validateOnIngest"`
+		} `yaml:"experimental"`
+	}
+	// pebbleLevelConfig represents the per-level options. The i-th entry
+	// applies to level i.
+	pebbleLevelConfig struct {
+		BlockRestartInterval *int      `yaml:"blockRestartInterval"`
+		BlockSize            *byteSize `yaml:"blockSize"`
+		BlockSizeThreshold   *int      `yaml:"blockSizeThreshold"`
+		// Compression is one of "default", "none", "snappy" or "zstd".
+		Compression *string `yaml:"compression"`
+		// FilterBitsPerKey sets the bloom filter bits per key. Zero disables
+		// the filter for the level.
+		FilterBitsPerKey *int      `yaml:"filterBitsPerKey"`
+		IndexBlockSize   *byteSize `yaml:"indexBlockSize"`
+		TargetFileSize   *byteSize `yaml:"targetFileSize"`
+	}
+	// byteSize is a size in bytes that can be specified either as a plain
+	// number or as a string with an IEC suffix, e.g. "64Mi".
+	byteSize uint64
+)
+
+func (b *byteSize) UnmarshalYAML(value *yaml.Node) error {
+	v, err := parseBytesIEC(strings.TrimSpace(value.Value))
+	if err != nil {
+		return fmt.Errorf("invalid byte size %q at line %d: %w", value.Value, value.Line, err)
+	}
+	*b = byteSize(v)
+	return nil
+}
+
+// loadPebbleConfig reads the pebble config from the file at the given path.
+// Since JSON is a subset of YAML, the file may be in either format.
+func loadPebbleConfig(path string) (*pebbleConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg pebbleConfig
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode pebble config %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// apply overrides the given options with the values set in the config.
+func (c *pebbleConfig) apply(opts *pebble.Options) error {
+	setInt(&opts.BytesPerSync, c.BytesPerSync)
+	setBool(&opts.DisableWAL, c.DisableWAL)
+	setInt64(&opts.FlushSplitBytes, c.FlushSplitBytes)
+	setIntValue(&opts.L0CompactionFileThreshold, c.L0CompactionFileThreshold)
+	setIntValue(&opts.L0CompactionThreshold, c.L0CompactionThreshold)
+	setIntValue(&opts.L0StopWritesThreshold, c.L0StopWritesThreshold)
+	setInt64(&opts.LBaseMaxBytes, c.LBaseMaxBytes)
+	setInt64(&opts.MaxManifestFileSize, c.MaxManifestFileSize)
+	setIntValue(&opts.MaxOpenFiles, c.MaxOpenFiles)
+	setIntValue(&opts.MemTableStopWritesThreshold, c.MemTableStopWritesThreshold)
+	setInt(&opts.TargetByteDeletionRate, c.TargetByteDeletionRate)
+	setInt(&opts.WALBytesPerSync, c.WALBytesPerSync)
+	if c.MemTableSize != nil {
+		opts.MemTableSize = uint64(*c.MemTableSize)
+	}
+	if c.MaxConcurrentCompactions != nil {
+		maxConcurrentCompactions := *c.MaxConcurrentCompactions
+		opts.MaxConcurrentCompactions = func() int { return maxConcurrentCompactions }
+	}
+	if c.WALDir != nil {
+		opts.WALDir = *c.WALDir
+	}
+	if c.WALMinSyncInterval != nil {
+		walMinSyncInterval := *c.WALMinSyncInterval
+		opts.WALMinSyncInterval = func() time.Duration { return walMinSyncInterval }
+	}
+	if c.CacheSize != nil {
+		if opts.Cache != nil {
+			opts.Cache.Unref()
+		}
+		opts.Cache = pebble.NewCache(int64(*c.CacheSize))
+	}
+
+	e := &c.Experimental
+	if e.CompactionDebtConcurrency != nil {
+		opts.Experimental.CompactionDebtConcurrency = uint64(*e.CompactionDebtConcurrency)
+	}
+	setBool(&opts.Experimental.ForceWriterParallelism, e.ForceWriterParallelism)
+	setIntValue(&opts.Experimental.L0CompactionConcurrency, e.L0CompactionConcurrency)
+	setIntValue(&opts.Experimental.LevelMultiplier, e.LevelMultiplier)
+	setIntValue(&opts.Experimental.MaxWriterConcurrency, e.MaxWriterConcurrency)
+	setIntValue(&opts.Experimental.TableCacheShards, e.TableCacheShards)
+	setBool(&opts.Experimental.ValidateOnIngest, e.ValidateOnIngest)
+	if e.ReadCompactionRate != nil {
+		opts.Experimental.ReadCompactionRate = *e.ReadCompactionRate
+	}
+	if e.ReadSamplingMultiplier != nil {
+		opts.Experimental.ReadSamplingMultiplier = *e.ReadSamplingMultiplier
+	}
+
+	if len(c.Levels) > numLevels {
+		return fmt.Errorf("at most %d levels can be configured, got: %d", numLevels, len(c.Levels))
+	}
+	for len(opts.Levels) < len(c.Levels) {
+		opts.Levels = append(opts.Levels, pebble.LevelOptions{})
+	}
+	for i, lc := range c.Levels {
+		if err := lc.apply(&opts.Levels[i]); err != nil {
+			return fmt.Errorf("level %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (lc *pebbleLevelConfig) apply(l *pebble.LevelOptions) error {
+	setIntValue(&l.BlockRestartInterval, lc.BlockRestartInterval)
+	setInt(&l.BlockSize, lc.BlockSize)
+	setIntValue(&l.BlockSizeThreshold, lc.BlockSizeThreshold)
+	setInt(&l.IndexBlockSize, lc.IndexBlockSize)
+	setInt64(&l.TargetFileSize, lc.TargetFileSize)
+	if lc.FilterBitsPerKey != nil {
+		if *lc.FilterBitsPerKey > 0 {
+			l.FilterPolicy = bloom.FilterPolicy(*lc.FilterBitsPerKey)
+			l.FilterType = pebble.TableFilter
+		} else {
+			l.FilterPolicy = nil
+		}
+	}
+	if lc.Compression != nil {
+		switch strings.ToLower(*lc.Compression) {
+		case "default":
+			l.Compression = pebble.DefaultCompression
+		case "none":
+			l.Compression = pebble.NoCompression
+		case "snappy":
+			l.Compression = pebble.SnappyCompression
+		case "zstd":
+			l.Compression = pebble.ZstdCompression
+		default:
+			return fmt.Errorf("unknown compression: %s", *lc.Compression)
+		}
+	}
+	l.EnsureDefaults()
+	return nil
+}
+
+func setInt(dst *int, v *byteSize) {
+	if v != nil {
+		*dst = int(*v)
+	}
+}
+
+func setInt64(dst *int64, v *byteSize) {
+	if v != nil {
+		*dst = int64(*v)
+	}
+}
+
+func setIntValue(dst *int, v *int) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func setBool(dst *bool, v *bool) {
+	if v != nil {
+		*dst = *v
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestLoadPebbleConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		check   func(t *testing.T, cfg *pebbleConfig)
+		wantErr string
+	}{
+		{
+			name: "yaml",
+			file: "pebble.yaml",
+			content: `
+cacheSize: 2Gi
+memTableSize: 128Mi
+l0CompactionThreshold: 4
+disableWAL: true
+walMinSyncInterval: 5s
+experimental:
+  l0CompactionConcurrency: 8
+levels:
+  - blockSize: 16Ki
+    compression: zstd
+`,
+			check: func(t *testing.T, cfg *pebbleConfig) {
+				require.Equal(t, byteSize(2<<30), *cfg.CacheSize)
+				require.Equal(t, byteSize(128<<20), *cfg.MemTableSize)
+				require.Equal(t, 4, *cfg.L0CompactionThreshold)
+				require.True(t, *cfg.DisableWAL)
+				require.Equal(t, 5*time.Second, *cfg.WALMinSyncInterval)
+				require.Equal(t, 8, *cfg.Experimental.L0CompactionConcurrency)
+				require.Len(t, cfg.Levels, 1)
+				require.Equal(t, byteSize(16<<10), *cfg.Levels[0].BlockSize)
+				require.Equal(t, "zstd", *cfg.Levels[0].Compression)
+				// Fields absent from the file are left unset.
+				require.Nil(t, cfg.BytesPerSync)
+				require.Nil(t, cfg.L0StopWritesThreshold)
+				require.Nil(t, cfg.Levels[0].TargetFileSize)
+			},
+		},
+		{
+			name:    "json",
+			file:    "pebble.json",
+			content: `{"bytesPerSync": 1048576, "lBaseMaxBytes": "64Mi", "maxOpenFiles": 1000, "experimental": {"readCompactionRate": 42}}`,
+			check: func(t *testing.T, cfg *pebbleConfig) {
+				require.Equal(t, byteSize(1<<20), *cfg.BytesPerSync)
+				require.Equal(t, byteSize(64<<20), *cfg.LBaseMaxBytes)
+				require.Equal(t, 1000, *cfg.MaxOpenFiles)
+				require.Equal(t, int64(42), *cfg.Experimental.ReadCompactionRate)
+				require.Nil(t, cfg.CacheSize)
+			},
+		},
+		{
+			name:    "unknown field",
+			file:    "pebble.yaml",
+			content: "cacheSize: 1Gi\nblockCache: 1Gi\n",
+			wantErr: "field blockCache not found",
+		},
+		{
+			name:    "unknown level field",
+			file:    "pebble.yaml",
+			content: "levels:\n  - blockSize: 4Ki\n    fish: true\n",
+			wantErr: "field fish not found",
+		},
+		{
+			name:    "invalid byte size",
+			file:    "pebble.yaml",
+			content: "memTableSize: lots\n",
+			wantErr: `invalid byte size "lots" at line 1`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.file)
+			require.NoError(t, os.WriteFile(path, []byte(test.content), 0o644))
+			cfg, err := loadPebbleConfig(path)
+			if test.wantErr != "" {
+				require.ErrorContains(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			test.check(t, cfg)
+		})
+	}
+
+	_, err := loadPebbleConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    byteSize
+		wantErr bool
+	}{
+		{value: "0", want: 0},
+		{value: "42", want: 42},
+		{value: "1048576", want: 1 << 20},
+		{value: "4Ki", want: 4 << 10},
+		{value: "64mi", want: 64 << 20},
+		{value: "2Gi", want: 2 << 30},
+		{value: `" 8Mi "`, want: 8 << 20},
+		{value: "fish", wantErr: true},
+		{value: "1.5Gi", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			var got byteSize
+			err := yaml.Unmarshal([]byte(test.value), &got)
+			if test.wantErr {
+				require.ErrorContains(t, err, "invalid byte size")
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestPebbleConfig_Apply(t *testing.T) {
+	// flagOptions returns options as derived from flags by openStore.
+	flagOptions := func() *pebble.Options {
+		opts := &pebble.Options{
+			BytesPerSync:                10 << 20,
+			MaxConcurrentCompactions:    func() int { return 10 },
+			MemTableSize:                64 << 20,
+			MemTableStopWritesThreshold: 4,
+			L0CompactionThreshold:       2,
+			L0StopWritesThreshold:       12,
+			DisableWAL:                  false,
+			Cache:                       pebble.NewCache(1 << 30),
+		}
+		opts.Levels = make([]pebble.LevelOptions, numLevels)
+		for i := range opts.Levels {
+			opts.Levels[i].BlockSize = 32 << 10
+			opts.Levels[i].EnsureDefaults()
+		}
+		return opts
+	}
+
+	t.Run("overrides flags", func(t *testing.T) {
+		opts := flagOptions()
+		defer func() { opts.Cache.Unref() }()
+		cfg := loadTestPebbleConfig(t, `
+bytesPerSync: 1Mi
+cacheSize: 256Mi
+maxConcurrentCompactions: 3
+memTableSize: 32Mi
+l0CompactionThreshold: 4
+disableWAL: true
+walDir: /wal
+experimental:
+  compactionDebtConcurrency: 2Gi
+levels:
+  - blockSize: 4Ki
+    compression: none
+    filterBitsPerKey: 0
+  - filterBitsPerKey: 12
+`)
+		require.NoError(t, cfg.apply(opts))
+
+		require.Equal(t, 1<<20, opts.BytesPerSync)
+		require.Equal(t, int64(256<<20), opts.Cache.MaxSize())
+		require.Equal(t, 3, opts.MaxConcurrentCompactions())
+		require.Equal(t, uint64(32<<20), opts.MemTableSize)
+		require.Equal(t, 4, opts.L0CompactionThreshold)
+		require.True(t, opts.DisableWAL)
+		require.Equal(t, "/wal", opts.WALDir)
+		require.Equal(t, uint64(2<<30), opts.Experimental.CompactionDebtConcurrency)
+		require.Equal(t, 4<<10, opts.Levels[0].BlockSize)
+		require.Equal(t, pebble.NoCompression, opts.Levels[0].Compression)
+		require.Nil(t, opts.Levels[0].FilterPolicy)
+		require.NotNil(t, opts.Levels[1].FilterPolicy)
+		require.Equal(t, pebble.TableFilter, opts.Levels[1].FilterType)
+
+		// Options absent from the config keep the values of flags.
+		require.Equal(t, 12, opts.L0StopWritesThreshold)
+		require.Equal(t, 4, opts.MemTableStopWritesThreshold)
+		require.Equal(t, 32<<10, opts.Levels[1].BlockSize)
+		require.Len(t, opts.Levels, numLevels)
+	})
+
+	t.Run("empty config keeps flags", func(t *testing.T) {
+		opts := flagOptions()
+		defer func() { opts.Cache.Unref() }()
+		cache := opts.Cache
+		require.NoError(t, loadTestPebbleConfig(t, "{}").apply(opts))
+		require.Equal(t, 10<<20, opts.BytesPerSync)
+		require.Same(t, cache, opts.Cache)
+		require.Equal(t, 10, opts.MaxConcurrentCompactions())
+		require.Equal(t, uint64(64<<20), opts.MemTableSize)
+	})
+
+	t.Run("unknown compression", func(t *testing.T) {
+		opts := flagOptions()
+		defer func() { opts.Cache.Unref() }()
+		err := loadTestPebbleConfig(t, "levels:\n  - compression: lz4\n").apply(opts)
+		require.EqualError(t, err, "level 0: unknown compression: lz4")
+	})
+
+	t.Run("too many levels", func(t *testing.T) {
+		opts := flagOptions()
+		defer func() { opts.Cache.Unref() }()
+		err := loadTestPebbleConfig(t, "levels: [{}, {}, {}, {}, {}, {}, {}, {}]\n").apply(opts)
+		require.EqualError(t, err, "at most 7 levels can be configured, got: 8")
+	})
+}
+
+// loadTestPebbleConfig writes the given content to a config file and loads it.
+func loadTestPebbleConfig(t *testing.T, content string) *pebbleConfig {
+	path := filepath.Join(t.TempDir(), "pebble.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	cfg, err := loadPebbleConfig(path)
+	require.NoError(t, err)
+	return cfg
+}
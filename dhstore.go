@@ -1,6 +1,7 @@
 package dhstore
 
 import (
+	"context"
 	"io"
 
 	"github.com/multiformats/go-multihash"
@@ -14,6 +15,11 @@ type (
 		Key   multihash.Multihash `json:"key"`
 		Value EncryptedValueKey   `json:"value"`
 	}
+	// Metadata is the encrypted metadata stored at a hashed value key.
+	Metadata struct {
+		Key   HashedValueKey    `json:"key"`
+		Value EncryptedMetadata `json:"value"`
+	}
 	DHStore interface {
 		io.Closer
 		MergeIndexes([]Index) error
@@ -23,8 +29,87 @@ type (
 		GetMetadata(HashedValueKey) (EncryptedMetadata, error)
 		DeleteMetadata(HashedValueKey) error
 	}
+	// WritePressureReporter is optionally implemented by DHStore
+	// implementations that can report how close they are to stopping writes.
+	WritePressureReporter interface {
+		// WritePressure returns the proximity of the store to its stop-writes
+		// threshold as a value between 0 and 1, where 1 means that writes are
+		// stopped.
+		WritePressure() float64
+	}
+	// HealthReporter is optionally implemented by DHStore implementations
+	// backed by a remote service whose availability can change at runtime.
+	HealthReporter interface {
+		// Healthy returns nil if the store backend is reachable, or
+		// ErrUnavailable otherwise.
+		Healthy() error
+	}
+	// MetadataBatchPutter is optionally implemented by DHStore
+	// implementations that can write many metadata records more efficiently
+	// than one at a time.
+	MetadataBatchPutter interface {
+		// PutMetadataBatch stores the given metadata records. Nothing is
+		// written if any of the records is invalid.
+		PutMetadataBatch([]Metadata) error
+	}
+	// MetadataBatchDeleter is optionally implemented by DHStore
+	// implementations that can delete many metadata records more efficiently
+	// than one at a time.
+	MetadataBatchDeleter interface {
+		// DeleteMetadataBatch deletes the metadata records of the given hashed
+		// value keys. Keys without metadata are ignored.
+		DeleteMetadataBatch([]HashedValueKey) error
+	}
+	// StreamingLookuper is optionally implemented by DHStore implementations
+	// that can yield the encrypted value keys of a multihash as they are read,
+	// rather than buffering them all in memory.
+	StreamingLookuper interface {
+		// LookupStream calls fn for each encrypted value key of the given
+		// multihash until there are no more keys, the context is done or fn
+		// returns an error.
+		LookupStream(ctx context.Context, mh multihash.Multihash, fn func(EncryptedValueKey) error) error
+	}
+	// FormatReporter is optionally implemented by DHStore implementations
+	// that persist data in a versioned format.
+	FormatReporter interface {
+		// StoreFormat returns the version of the format in which the store
+		// persists data, e.g. "pebble 016".
+		StoreFormat() string
+	}
 )
 
+// CheckValueKeySizes returns ErrValueKeyTooLarge for the first of the given
+// indexes whose encrypted value key is larger than maxSize bytes, if any.
+// Sizes are unbounded when maxSize is zero.
+func CheckValueKeySizes(indexes []Index, maxSize int) error {
+	if maxSize <= 0 {
+		return nil
+	}
+	for _, index := range indexes {
+		if len(index.Value) > maxSize {
+			return ErrValueKeyTooLarge{Size: len(index.Value), Max: maxSize}
+		}
+	}
+	return nil
+}
+
+// CheckRecordValueKeySizes returns ErrValueKeyTooLarge for the first encrypted
+// value key of the given records that is larger than maxSize bytes, if any, as
+// CheckValueKeySizes does for indexes.
+func CheckRecordValueKeySizes(records []ExportRecord, maxSize int) error {
+	if maxSize <= 0 {
+		return nil
+	}
+	for _, record := range records {
+		for _, evk := range record.EncryptedValueKeys {
+			if len(evk) > maxSize {
+				return ErrValueKeyTooLarge{Size: len(evk), Max: maxSize}
+			}
+		}
+	}
+	return nil
+}
+
 type EncryptedValueKeyResult struct {
 	EncryptedValueKey EncryptedValueKey `json:"EncryptedValueKey"`
 }
@@ -1,6 +1,7 @@
 package dhstore
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -21,10 +22,92 @@ type (
 		Key HashedValueKey
 		Err error
 	}
+	ErrInvalidExportCursor struct {
+		Cursor string
+		Err    error
+	}
+	// ErrPartialWrite signals that a batch was only partially written.
+	ErrPartialWrite struct {
+		Written int
+		Total   int
+		Err     error
+	}
+	// ErrTooManyIterators signals that the cap on open iterators is reached.
+	ErrTooManyIterators struct {
+		Limit int
+	}
+	// ErrUnavailable signals that the store backend is unreachable.
+	ErrUnavailable struct {
+		Err error
+	}
+	// ErrReadOnly signals that the store does not accept writes.
+	ErrReadOnly struct{}
+	// ErrValueKeyTooLarge signals an encrypted value key larger than the
+	// maximum size accepted by the store.
+	ErrValueKeyTooLarge struct {
+		Size int
+		Max  int
+	}
 	ErrHttpResponse struct {
 		Message string
 		Status  int
+		// Code is the error code of the response, if any.
+		Code string
 	}
+	// ErrorResponse is the JSON body of HTTP error responses, so that clients
+	// can branch on errors by their stable code rather than their message.
+	ErrorResponse struct {
+		// Code is one of the ErrorCode constants.
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		// Details optionally carries information specific to the error, e.g.
+		// how long to wait before retrying overloaded requests.
+		Details map[string]any `json:"details,omitempty"`
+	}
+)
+
+// Error codes of ErrorResponse. Codes are never changed once released, and new
+// codes may be added.
+const (
+	// ErrorCodeBadRequest signals a request that is invalid for reasons other
+	// than those with a more specific code.
+	ErrorCodeBadRequest = "bad_request"
+	// ErrorCodeBadMultihash signals a multihash or CID that cannot be decoded.
+	ErrorCodeBadMultihash = "bad_multihash"
+	// ErrorCodeUnsupportedCodec signals a multihash of a code that is not
+	// supported by the request, e.g. an unencrypted lookup without dhfind.
+	ErrorCodeUnsupportedCodec = "unsupported_codec"
+	// ErrorCodeBadKey signals a hashed value key that cannot be decoded.
+	ErrorCodeBadKey = "bad_key"
+	// ErrorCodeDuplicateMerge signals a merge of the same key and value as an
+	// earlier merge of the same request.
+	ErrorCodeDuplicateMerge = "duplicate_merge"
+	// ErrorCodeBadValueLength signals an encrypted value key whose length is
+	// out of bounds.
+	ErrorCodeBadValueLength = "bad_value_length"
+	// ErrorCodeNotFound signals that no records were found.
+	ErrorCodeNotFound = "not_found"
+	// ErrorCodeOverloaded signals a request that is shed due to load, and
+	// should be retried later.
+	ErrorCodeOverloaded = "overloaded"
+	// ErrorCodeUnavailable signals that the store cannot serve requests,
+	// e.g. because its backend is unreachable or it is shutting down.
+	ErrorCodeUnavailable = "unavailable"
+	// ErrorCodeReadOnly signals a write rejected by a read-only store.
+	ErrorCodeReadOnly = "read_only"
+	// ErrorCodeMethodNotAllowed signals a method not supported by the path.
+	ErrorCodeMethodNotAllowed = "method_not_allowed"
+	// ErrorCodeNotAcceptable signals that no accepted media type is supported.
+	ErrorCodeNotAcceptable = "not_acceptable"
+	// ErrorCodeUnauthorized signals a request without authorized credentials.
+	ErrorCodeUnauthorized = "unauthorized"
+	// ErrorCodeForbidden signals a request that is denied.
+	ErrorCodeForbidden = "forbidden"
+	// ErrorCodeNotImplemented signals a feature not supported by the store or
+	// configuration.
+	ErrorCodeNotImplemented = "not_implemented"
+	// ErrorCodeInternal signals an unexpected failure.
+	ErrorCodeInternal = "internal"
 )
 
 func (e ErrUnsupportedMulticodecCode) Error() string {
@@ -53,10 +136,105 @@ func (e ErrInvalidHashedValueKey) Unwrap() error {
 	return e.Err
 }
 
+func (e ErrInvalidExportCursor) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("invalid export cursor %q: %s", e.Cursor, e.Err.Error())
+	}
+	return fmt.Sprintf("invalid export cursor %q", e.Cursor)
+}
+
+func (e ErrInvalidExportCursor) Unwrap() error {
+	return e.Err
+}
+
+func (e ErrPartialWrite) Error() string {
+	return fmt.Sprintf("wrote %d of %d records: %s", e.Written, e.Total, e.Err.Error())
+}
+
+func (e ErrPartialWrite) Unwrap() error {
+	return e.Err
+}
+
+func (e ErrUnavailable) Error() string {
+	return fmt.Sprintf("store is unavailable: %s", e.Err.Error())
+}
+
+func (e ErrUnavailable) Unwrap() error {
+	return e.Err
+}
+
+func (e ErrTooManyIterators) Error() string {
+	return fmt.Sprintf("too many open iterators; limit is %d", e.Limit)
+}
+
+func (ErrReadOnly) Error() string {
+	return "store is read-only"
+}
+
+func (e ErrValueKeyTooLarge) Error() string {
+	return fmt.Sprintf("encrypted value key cannot be larger than %d bytes, got: %d", e.Max, e.Size)
+}
+
 func (e ErrHttpResponse) Error() string {
 	return e.Message
 }
 
 func (e ErrHttpResponse) WriteTo(w http.ResponseWriter) {
-	http.Error(w, e.Message, e.Status)
+	code := e.Code
+	if code == "" {
+		code = ErrorCodeOf(e.Status)
+	}
+	ErrorResponse{Code: code, Message: e.Message}.Write(w, e.Status)
+}
+
+// ErrorCodeOf returns the error code that corresponds to the given HTTP
+// status, in the absence of a more specific one.
+func ErrorCodeOf(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrorCodeBadRequest
+	case http.StatusUnauthorized:
+		return ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrorCodeForbidden
+	case http.StatusNotFound:
+		return ErrorCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return ErrorCodeMethodNotAllowed
+	case http.StatusNotAcceptable:
+		return ErrorCodeNotAcceptable
+	case http.StatusTooManyRequests:
+		return ErrorCodeOverloaded
+	case http.StatusNotImplemented:
+		return ErrorCodeNotImplemented
+	case http.StatusServiceUnavailable:
+		return ErrorCodeUnavailable
+	}
+	if status >= 400 && status < 500 {
+		return ErrorCodeBadRequest
+	}
+	return ErrorCodeInternal
+}
+
+// HTTPError replies to the request with an ErrorResponse of the given message
+// and status, with the error code that corresponds to the status. It is the
+// JSON counterpart of http.Error.
+func HTTPError(w http.ResponseWriter, message string, status int) {
+	ErrorResponse{Code: ErrorCodeOf(status), Message: message}.Write(w, status)
+}
+
+// Write replies to the request with the error response and given status. The
+// message defaults to the text of the status.
+func (e ErrorResponse) Write(w http.ResponseWriter, status int) {
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+	h := w.Header()
+	// Delete headers set for the response that the error replaces, as
+	// http.Error does.
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(e)
 }
@@ -0,0 +1,71 @@
+package dhstore
+
+import (
+	"context"
+
+	"github.com/multiformats/go-multihash"
+)
+
+type (
+	// ExportRecord is a single record of a store export. A record either
+	// represents a multihash and its encrypted value keys, or encrypted
+	// metadata.
+	ExportRecord struct {
+		// Multihash is the dh-multihash of an index record.
+		Multihash multihash.Multihash `json:"mh,omitempty"`
+		// EncryptedValueKeys are the encrypted value keys of an index record.
+		EncryptedValueKeys []EncryptedValueKey `json:"evks,omitempty"`
+		// HashedValueKey is the key of a metadata record, if known. Stores
+		// that only persist a hash of the hashed value key leave it empty and
+		// set MetadataKey instead.
+		HashedValueKey HashedValueKey `json:"hvk,omitempty"`
+		// MetadataKey is the store specific key of a metadata record when
+		// HashedValueKey is not recoverable.
+		MetadataKey []byte `json:"mdk,omitempty"`
+		// EncryptedMetadata is the encrypted metadata of a metadata record.
+		EncryptedMetadata EncryptedMetadata `json:"md,omitempty"`
+		// Cursor is an opaque value that resumes the export right after this
+		// record when set as ExportOptions.Cursor.
+		Cursor string `json:"cursor"`
+	}
+	// ExportOptions specifies which records to export.
+	ExportOptions struct {
+		// Cursor resumes an interrupted export right after the record with
+		// the given cursor. The remaining options must be the same as the
+		// ones of the interrupted export.
+		Cursor string
+		// Start is the inclusive lower bound of the record digests to export.
+		// The digest of an index record is the digest of its multihash. The
+		// digest of a metadata record is its store specific key. No lower
+		// bound is applied if empty.
+		Start []byte
+		// End is the exclusive upper bound of the record digests to export.
+		// No upper bound is applied if empty.
+		End []byte
+	}
+	// Exporter is optionally implemented by DHStore implementations that can
+	// export their records. Index records are exported in digest order,
+	// followed by metadata records in digest order.
+	Exporter interface {
+		// Export calls fn for each exported record until there are no more
+		// records, the context is done, or fn returns an error.
+		Export(ctx context.Context, opts ExportOptions, fn func(ExportRecord) error) error
+	}
+	// Importer is optionally implemented by DHStore implementations that can
+	// import records exported by an Exporter of the same kind.
+	Importer interface {
+		// Import stores the given records. Encrypted value keys of index
+		// records are merged with the existing ones, and metadata records
+		// overwrite existing metadata.
+		Import(records []ExportRecord) error
+	}
+	// Ingester is optionally implemented by DHStore implementations that can
+	// bulk load exported records by ingesting pre-built tables, bypassing the
+	// regular write path, while accepting live writes.
+	Ingester interface {
+		// Ingest stores the given records with the same semantics as
+		// Importer.Import, except that metadata written live is never
+		// overwritten by ingested metadata.
+		Ingest(records []ExportRecord) error
+	}
+)
@@ -0,0 +1,173 @@
+//go:build fdb
+
+package fdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/ipni/dhstore"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// exportCursorVersion is the version of the export cursor encoding.
+	exportCursorVersion = 1
+
+	exportSpanMultihash = 'm'
+	exportSpanMetadata  = 'd'
+)
+
+// Export calls fn for each record in the store, in the same order and format
+// as the pebble store: multihash records in digest order, followed by metadata
+// records in key order. See dhstore.Exporter.
+//
+// Records are read across as many transactions as needed, and therefore do
+// not reflect a single consistent snapshot of the store.
+func (f *FDBDHStore) Export(ctx context.Context, opts dhstore.ExportOptions, fn func(dhstore.ExportRecord) error) error {
+	span, after, err := decodeExportCursor(opts.Cursor)
+	if err != nil {
+		return dhstore.ErrInvalidExportCursor{Cursor: opts.Cursor, Err: err}
+	}
+
+	if span != exportSpanMetadata {
+		begin, end := exportBounds(f.mhdir, opts.Start, opts.End)
+		if span == exportSpanMultihash {
+			resume, err := fdb.Strinc(f.mhdir.Pack(tuple.Tuple{after}))
+			if err != nil {
+				return dhstore.ErrInvalidExportCursor{Cursor: opts.Cursor, Err: err}
+			}
+			if bytes.Compare(resume, begin) > 0 {
+				begin = resume
+			}
+		}
+		if err := f.exportMultihashes(ctx, begin, end, fn); err != nil {
+			return err
+		}
+	}
+
+	begin, end := exportBounds(f.mddir, opts.Start, opts.End)
+	if span == exportSpanMetadata {
+		resume := append(f.mddir.Pack(tuple.Tuple{after}), 0x00)
+		if bytes.Compare(resume, begin) > 0 {
+			begin = resume
+		}
+	}
+	return f.exportMetadata(ctx, begin, end, fn)
+}
+
+// exportBounds returns the inclusive begin and exclusive end keys of the given
+// directory for the given digest bounds.
+func exportBounds(dir directory.DirectorySubspace, start, end []byte) (fdb.Key, fdb.Key) {
+	beginKey, endKey := dir.FDBRangeKeys()
+	begin, stop := beginKey.FDBKey(), endKey.FDBKey()
+	if len(start) != 0 {
+		begin = dir.Pack(tuple.Tuple{start})
+	}
+	if len(end) != 0 {
+		stop = dir.Pack(tuple.Tuple{end})
+	}
+	return begin, stop
+}
+
+func (f *FDBDHStore) exportMultihashes(ctx context.Context, begin, end fdb.Key, fn func(dhstore.ExportRecord) error) error {
+	if bytes.Compare(begin, end) >= 0 {
+		return nil
+	}
+	// Mappings of a multihash are stored as consecutive keys prefixed by its
+	// digest, and are exported as one record once all have been read.
+	var digest []byte
+	var evks []dhstore.EncryptedValueKey
+	emit := func() error {
+		if digest == nil {
+			return nil
+		}
+		mh, err := multihash.Encode(digest, multihash.DBL_SHA2_256)
+		if err != nil {
+			return err
+		}
+		return fn(dhstore.ExportRecord{
+			Multihash:          mh,
+			EncryptedValueKeys: evks,
+			Cursor:             encodeExportCursor(exportSpanMultihash, digest),
+		})
+	}
+	err := f.streamRange(ctx, fdb.FirstGreaterOrEqual(begin), fdb.FirstGreaterOrEqual(end), func(kv fdb.KeyValue) error {
+		t, err := f.mhdir.Unpack(kv.Key)
+		if err != nil {
+			return err
+		}
+		d, ok := t[0].([]byte)
+		if len(t) != 2 || !ok {
+			return fmt.Errorf("unexpected multihash mapping key: %v", t)
+		}
+		if !bytes.Equal(d, digest) {
+			if err := emit(); err != nil {
+				return err
+			}
+			digest, evks = d, nil
+		}
+		evk, err := f.unpackEncryptedValueKey(kv)
+		if err != nil {
+			return err
+		}
+		evks = append(evks, evk)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return emit()
+}
+
+func (f *FDBDHStore) exportMetadata(ctx context.Context, begin, end fdb.Key, fn func(dhstore.ExportRecord) error) error {
+	if bytes.Compare(begin, end) >= 0 {
+		return nil
+	}
+	return f.streamRange(ctx, fdb.FirstGreaterOrEqual(begin), fdb.FirstGreaterOrEqual(end), func(kv fdb.KeyValue) error {
+		t, err := f.mddir.Unpack(kv.Key)
+		if err != nil {
+			return err
+		}
+		hvk, ok := t[0].([]byte)
+		if len(t) != 1 || !ok {
+			return fmt.Errorf("unexpected metadata key: %v", t)
+		}
+		return fn(dhstore.ExportRecord{
+			MetadataKey:       hvk,
+			EncryptedMetadata: kv.Value,
+			Cursor:            encodeExportCursor(exportSpanMetadata, hvk),
+		})
+	})
+}
+
+func encodeExportCursor(span byte, key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(append([]byte{exportCursorVersion, span}, key...))
+}
+
+// decodeExportCursor returns the span and the key of the last exported record
+// encoded in the given cursor, or a zero span if the cursor is empty.
+func decodeExportCursor(cursor string) (byte, []byte, error) {
+	if cursor == "" {
+		return 0, nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < 3 || b[0] != exportCursorVersion {
+		return 0, nil, errors.New("unknown cursor version")
+	}
+	switch b[1] {
+	case exportSpanMultihash, exportSpanMetadata:
+		return b[1], b[2:], nil
+	default:
+		return 0, nil, errors.New("unknown cursor span")
+	}
+}
@@ -3,22 +3,29 @@
 package fdb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
 	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/clock"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
 	"lukechampine.com/blake3"
 )
 
 var (
-	_ dhstore.DHStore = (*FDBDHStore)(nil)
+	_ dhstore.DHStore             = (*FDBDHStore)(nil)
+	_ dhstore.StreamingLookuper   = (*FDBDHStore)(nil)
+	_ dhstore.Exporter            = (*FDBDHStore)(nil)
+	_ dhstore.MetadataBatchPutter = (*FDBDHStore)(nil)
+	_ dhstore.HealthReporter      = (*FDBDHStore)(nil)
 
 	logger                   = logging.Logger("store/fdb")
 	fdbHasherPool            sync.Pool
@@ -27,20 +34,51 @@ var (
 
 	multihashDirectoryPath = []string{"mh"}
 	metadataDirectoryPath  = []string{"md"}
+	probeDirectoryPath     = []string{"probe"}
 )
 
 const (
-	maxValueBytes    = 100_000 // 100 KB
+	// MaxValueBytes is the maximum size in bytes of the values stored in
+	// FoundationDB, and so of encrypted value keys and metadata.
+	MaxValueBytes    = 100_000 // 100 KB
 	blake3HashLength = 32
 
 	// maxKeyPrefixLen is the threshold at which key prefixes are hashed if they are larger. Otherwise,
 	// the prefix is used as is. When used in the context of metadata keys, it represents the max accepted
 	// length for metadata key.
 	maxKeyPrefixLen = 32
+
+	// errCodeNotCommitted is the FDB error code of transactions that fail to
+	// commit due to a conflict.
+	errCodeNotCommitted = 1020
+
+	// readTransactionBudget is the maximum time spent reading a range in a
+	// single transaction, which leaves margin below the 5-second FDB
+	// transaction limit.
+	readTransactionBudget = 4 * time.Second
 )
 
 type FDBDHStore struct {
 	db fdb.Database
+	// maxTransactionBytes is the maximum size of the mutations written in a
+	// single transaction.
+	maxTransactionBytes int
+	// priority is the priority at which transactions run.
+	priority string
+	// stats counts transaction outcomes and records probe latencies.
+	stats stats
+	// probedir is the directory subspace used by latency probes.
+	probedir directory.DirectorySubspace
+
+	// health tracks the availability of the cluster.
+	health health
+	// clock schedules probes and health checks.
+	clock clock.Clock
+
+	// cancel stops the background probing and health checks, and wg waits
+	// for them to return.
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 
 	// mhdir is the directory subspace used to store all multihash mappings under a dedicated directory for future extensibility.
 	mhdir directory.DirectorySubspace
@@ -62,84 +100,263 @@ func NewFDBDHStore(o ...Option) (*FDBDHStore, error) {
 	if err := fdb.APIVersion(opts.apiVersion); err != nil {
 		return nil, err
 	}
-	var dhfdb FDBDHStore
+	dhfdb := &FDBDHStore{
+		maxTransactionBytes: opts.maxTransactionBytes,
+		priority:            opts.priority,
+		clock:               opts.clock,
+	}
 	if dhfdb.db, err = fdb.OpenDatabase(opts.clusterFile); err != nil {
 		return nil, err
 	}
-	if dhfdb.mhdir, err = directory.CreateOrOpen(dhfdb.db, multihashDirectoryPath, nil); err != nil {
+	if err := setDatabaseOptions(dhfdb.db, opts); err != nil {
 		return nil, err
 	}
-	if dhfdb.mddir, err = directory.CreateOrOpen(dhfdb.db, metadataDirectoryPath, nil); err != nil {
+	legacy, err := legacyLayout(dhfdb.db, opts.tenant)
+	if err != nil {
 		return nil, err
 	}
-	return &dhfdb, nil
+	if dhfdb.mhdir, err = directory.CreateOrOpen(dhfdb.db, tenantPath(opts.tenant, multihashDirectoryPath), nil); err != nil {
+		return nil, err
+	}
+	if dhfdb.mddir, err = directory.CreateOrOpen(dhfdb.db, tenantPath(opts.tenant, metadataDirectoryPath), nil); err != nil {
+		return nil, err
+	}
+	if err := dhfdb.checkLayout(opts.tenant, legacy, opts.migrateLayout); err != nil {
+		return nil, err
+	}
+	var ctx context.Context
+	ctx, dhfdb.cancel = context.WithCancel(context.Background())
+	if opts.probeInterval > 0 {
+		if dhfdb.probedir, err = directory.CreateOrOpen(dhfdb.db, tenantPath(opts.tenant, probeDirectoryPath), nil); err != nil {
+			dhfdb.cancel()
+			return nil, err
+		}
+		dhfdb.startProbing(ctx, opts.probeInterval)
+	}
+	if opts.healthCheckInterval > 0 {
+		dhfdb.startHealthChecks(ctx, opts.healthCheckInterval, opts.healthCheckTimeout)
+	}
+	return dhfdb, nil
 }
 
-func (f *FDBDHStore) MergeIndexes(indexes []dhstore.Index) error {
-	_, err := f.db.Transact(func(transaction fdb.Transaction) (any, error) {
-		for _, index := range indexes {
-			mh := index.Key
-			vk := index.Value
-
-			// Fail fast on invalid multihashes.
-			// TODO: make fail-fast optional.
-			dmh, err := multihash.Decode(mh)
-			if err != nil {
-				return nil, dhstore.ErrMultihashDecode{Err: err, Mh: mh}
-			}
-			if multicodec.Code(dmh.Code) != multicodec.DblSha2_256 {
-				return nil, dhstore.ErrUnsupportedMulticodecCode{Code: multicodec.Code(dmh.Code)}
-			}
-			if dmh.Length != 32 {
-				return nil, dhstore.ErrMultihashDecode{Err: errMultihashDigestLength, Mh: mh}
-			}
-			if len(vk) > maxValueBytes {
-				return nil, fmt.Errorf("value key cannot be larger than 100 KB, got: %d", len(vk))
+// tenantPath returns the given directory path under the root directory of the
+// given tenant, or the path as is if no tenant is set.
+func tenantPath(tenant string, path []string) []string {
+	if tenant == "" {
+		return path
+	}
+	return append([]string{tenant}, path...)
+}
+
+// setDatabaseOptions applies the transaction defaults configured in the given
+// options to all transactions of the database.
+func setDatabaseOptions(db fdb.Database, opts *options) error {
+	if opts.timeout > 0 {
+		if err := db.Options().SetTransactionTimeout(opts.timeout.Milliseconds()); err != nil {
+			return fmt.Errorf("failed to set transaction timeout: %w", err)
+		}
+	}
+	if opts.retryLimit >= 0 {
+		if err := db.Options().SetTransactionRetryLimit(int64(opts.retryLimit)); err != nil {
+			return fmt.Errorf("failed to set transaction retry limit: %w", err)
+		}
+	}
+	if opts.maxRetryDelay > 0 {
+		if err := db.Options().SetTransactionMaxRetryDelay(opts.maxRetryDelay.Milliseconds()); err != nil {
+			return fmt.Errorf("failed to set transaction max retry delay: %w", err)
+		}
+	}
+	return nil
+}
+
+// setPriority sets the configured priority on the given transaction. Priority
+// cannot be set as a database option, so it is set on every transaction.
+func (f *FDBDHStore) setPriority(transaction fdb.Transaction) error {
+	switch f.priority {
+	case PriorityBatch:
+		return transaction.Options().SetPriorityBatch()
+	case PriorityImmediate:
+		return transaction.Options().SetPrioritySystemImmediate()
+	default:
+		return nil
+	}
+}
+
+// transact runs fn in a transaction at the configured priority, retrying
+// retryable errors in the same way as fdb.Database.Transact while counting
+// commits, conflicts, retries and failures. Returns dhstore.ErrUnavailable
+// without running fn while the cluster is unavailable.
+func (f *FDBDHStore) transact(fn func(fdb.Transaction) (any, error)) (any, error) {
+	// Fail writes fast rather than have them retry until the cluster is
+	// reachable again.
+	if err := f.Healthy(); err != nil {
+		return nil, err
+	}
+	transaction, err := f.db.CreateTransaction()
+	if err != nil {
+		return nil, err
+	}
+	defer transaction.Cancel()
+	for {
+		var result any
+		err := f.setPriority(transaction)
+		if err == nil {
+			if result, err = fn(transaction); err == nil {
+				if err = transaction.Commit().Get(); err == nil {
+					f.stats.commits.Add(1)
+					return result, nil
+				}
 			}
-			key, value, err := f.makeFDBKeyValue(dmh.Digest, vk)
-			if err != nil {
-				return nil, err
+		}
+		if err = f.onError(transaction, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readTransact runs fn in a read-only transaction at the configured priority,
+// retrying retryable errors in the same way as fdb.Database.ReadTransact.
+func (f *FDBDHStore) readTransact(fn func(fdb.ReadTransaction) (any, error)) (any, error) {
+	transaction, err := f.db.CreateTransaction()
+	if err != nil {
+		return nil, err
+	}
+	defer transaction.Cancel()
+	for {
+		var result any
+		err := f.setPriority(transaction)
+		if err == nil {
+			if result, err = fn(transaction); err == nil {
+				return result, nil
 			}
-			transaction.Set(key, value)
 		}
-		return nil, nil
-	})
-	return err
+		if err = f.onError(transaction, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// onError prepares the transaction for a retry if the given error is
+// retryable, and returns nil. Otherwise, the error is returned.
+func (f *FDBDHStore) onError(transaction fdb.Transaction, err error) error {
+	var fdbErr fdb.Error
+	if !errors.As(err, &fdbErr) {
+		f.stats.failures.Add(1)
+		return err
+	}
+	if fdbErr.Code == errCodeNotCommitted {
+		f.stats.conflicts.Add(1)
+	}
+	if err := transaction.OnError(fdbErr).Get(); err != nil {
+		f.stats.failures.Add(1)
+		return err
+	}
+	f.stats.retries.Add(1)
+	return nil
+}
+
+func (f *FDBDHStore) MergeIndexes(indexes []dhstore.Index) error {
+	mutations, err := f.indexMutations(indexes, false)
+	if err != nil {
+		return err
+	}
+	return f.commitChunked(mutations)
 }
 
 func (f *FDBDHStore) DeleteIndexes(indexes []dhstore.Index) error {
-	_, err := f.db.Transact(func(transaction fdb.Transaction) (any, error) {
-		for _, index := range indexes {
-			mh := index.Key
-			vk := index.Value
-
-			// Fail fast on invalid multihashes.
-			// TODO: make fail-fast optional.
-			dmh, err := multihash.Decode(mh)
-			if err != nil {
-				return nil, dhstore.ErrMultihashDecode{Err: err, Mh: mh}
-			}
-			if multicodec.Code(dmh.Code) != multicodec.DblSha2_256 {
-				return nil, dhstore.ErrUnsupportedMulticodecCode{Code: multicodec.Code(dmh.Code)}
-			}
-			if dmh.Length != 32 {
-				return nil, dhstore.ErrMultihashDecode{Err: errMultihashDigestLength, Mh: mh}
+	mutations, err := f.indexMutations(indexes, true)
+	if err != nil {
+		return err
+	}
+	return f.commitChunked(mutations)
+}
+
+// mutation is a single set or clear of a key.
+type mutation struct {
+	key   fdb.Key
+	value []byte
+	clear bool
+}
+
+// indexMutations validates the given indexes and returns the corresponding
+// mutations. Nothing is written if any of the indexes is invalid.
+func (f *FDBDHStore) indexMutations(indexes []dhstore.Index, clear bool) ([]mutation, error) {
+	mutations := make([]mutation, 0, len(indexes))
+	for _, index := range indexes {
+		mh := index.Key
+		vk := index.Value
+
+		// Fail fast on invalid multihashes.
+		// TODO: make fail-fast optional.
+		dmh, err := multihash.Decode(mh)
+		if err != nil {
+			return nil, dhstore.ErrMultihashDecode{Err: err, Mh: mh}
+		}
+		if multicodec.Code(dmh.Code) != multicodec.DblSha2_256 {
+			return nil, dhstore.ErrUnsupportedMulticodecCode{Code: multicodec.Code(dmh.Code)}
+		}
+		if dmh.Length != 32 {
+			return nil, dhstore.ErrMultihashDecode{Err: errMultihashDigestLength, Mh: mh}
+		}
+		if len(vk) > MaxValueBytes {
+			return nil, dhstore.ErrValueKeyTooLarge{Size: len(vk), Max: MaxValueBytes}
+		}
+		key, value, err := f.makeFDBKeyValue(dmh.Digest, vk)
+		if err != nil {
+			return nil, err
+		}
+		if clear {
+			value = nil
+		}
+		mutations = append(mutations, mutation{key: key, value: value, clear: clear})
+	}
+	return mutations, nil
+}
+
+// commitChunked commits the given mutations in as many transactions as needed
+// to keep each transaction within maxTransactionBytes, so that large batches
+// stay clear of the FDB transaction size and time limits.
+//
+// Transactions are committed in order. If one fails, the mutations committed
+// by earlier transactions remain, and the returned error reports how many of
+// the mutations were written.
+func (f *FDBDHStore) commitChunked(mutations []mutation) error {
+	var written int
+	for written < len(mutations) {
+		end := written
+		var size int
+		for end < len(mutations) {
+			m := mutations[end]
+			// Always include at least one mutation per transaction.
+			if end > written && size+len(m.key)+len(m.value) > f.maxTransactionBytes {
+				break
 			}
-			if len(vk) > maxValueBytes {
-				return nil, fmt.Errorf("value key cannot be larger than 100 KB, got: %d", len(vk))
+			size += len(m.key) + len(m.value)
+			end++
+		}
+		chunk := mutations[written:end]
+		_, err := f.transact(func(transaction fdb.Transaction) (any, error) {
+			for _, m := range chunk {
+				if m.clear {
+					transaction.Clear(m.key)
+				} else {
+					transaction.Set(m.key, m.value)
+				}
 			}
-			key, _, err := f.makeFDBKeyValue(dmh.Digest, vk)
-			if err != nil {
+			return nil, nil
+		})
+		if err != nil {
+			if written == 0 {
 				return err
 			}
-			transaction.Clear(key)
+			return dhstore.ErrPartialWrite{Written: written, Total: len(mutations), Err: err}
 		}
-		return nil, nil
-	})
-	return err
+		written = end
+	}
+	return nil
 }
 
-func (f *FDBDHStore) makeFDBKeyValue(keyData []byte, vk EncryptedValueKey) (fdb.Key, []byte, error) {
+func (f *FDBDHStore) makeFDBKeyValue(keyData []byte, vk dhstore.EncryptedValueKey) (fdb.Key, []byte, error) {
 	// Check if vk is longer than the allowed max key prefix. If it is, then
 	// hash it and use the original as the value associated to the key. If not,
 	// then use vk as is as the prefix and leave value empty.
@@ -159,7 +376,7 @@ func (f *FDBDHStore) makeFDBKeyValue(keyData []byte, vk EncryptedValueKey) (fdb.
 		var err error
 		prefix, err = f.hash(vk)
 		if err != nil {
-			return
+			return nil, nil, err
 		}
 		value = vk
 	} else {
@@ -182,13 +399,10 @@ func (f *FDBDHStore) hash(vk []byte) ([]byte, error) {
 }
 
 func (f *FDBDHStore) PutMetadata(vk dhstore.HashedValueKey, md dhstore.EncryptedMetadata) error {
-	if len(vk) > maxKeyPrefixLen {
-		return dhstore.ErrInvalidHashedValueKey{Key: vk, Err: errMetadataKeyTooLong}
+	if err := validateMetadata(vk, md); err != nil {
+		return err
 	}
-	if len(md) > maxValueBytes {
-		return fmt.Errorf("value key cannot be larger than 100 KB, got: %d", len(vk))
-	}
-	_, err := f.db.Transact(func(transaction fdb.Transaction) (any, error) {
+	_, err := f.transact(func(transaction fdb.Transaction) (any, error) {
 		key := f.mddir.Pack(tuple.Tuple{[]byte(vk)})
 		transaction.Set(key, md)
 		return nil, nil
@@ -196,85 +410,167 @@ func (f *FDBDHStore) PutMetadata(vk dhstore.HashedValueKey, md dhstore.Encrypted
 	return err
 }
 
+// PutMetadataBatch stores the given metadata records in as few transactions as
+// the max transaction size allows. See commitChunked.
+func (f *FDBDHStore) PutMetadataBatch(records []dhstore.Metadata) error {
+	mutations := make([]mutation, 0, len(records))
+	for _, record := range records {
+		if err := validateMetadata(record.Key, record.Value); err != nil {
+			return err
+		}
+		mutations = append(mutations, mutation{
+			key:   f.mddir.Pack(tuple.Tuple{[]byte(record.Key)}),
+			value: record.Value,
+		})
+	}
+	return f.commitChunked(mutations)
+}
+
+func validateMetadata(vk dhstore.HashedValueKey, md dhstore.EncryptedMetadata) error {
+	if len(vk) > maxKeyPrefixLen {
+		return dhstore.ErrInvalidHashedValueKey{Key: vk, Err: errMetadataKeyTooLong}
+	}
+	if len(md) > MaxValueBytes {
+		return fmt.Errorf("metadata cannot be larger than %d bytes, got: %d", MaxValueBytes, len(md))
+	}
+	return nil
+}
+
 func (f *FDBDHStore) Lookup(mh multihash.Multihash) ([]dhstore.EncryptedValueKey, error) {
+	var evks []dhstore.EncryptedValueKey
+	err := f.LookupStream(context.Background(), mh, func(evk dhstore.EncryptedValueKey) error {
+		evks = append(evks, evk)
+		return nil
+	})
+	if err != nil {
+		// If error has occurred but we found some result, return whatever we found.
+		if len(evks) == 0 {
+			return nil, err
+		}
+		logger.Warnw("returning partial lookup result due to error", "mh", mh.B58String(), "found", len(evks), "err", err)
+	}
+	return evks, nil
+}
+
+// LookupStream calls fn with each encrypted value key of the given multihash
+// as it is read from FDB. See streamRange.
+func (f *FDBDHStore) LookupStream(ctx context.Context, mh multihash.Multihash, fn func(dhstore.EncryptedValueKey) error) error {
 	dmh, err := multihash.Decode(mh)
 	if err != nil {
-		return nil, dhstore.ErrMultihashDecode{Err: err, Mh: mh}
+		return dhstore.ErrMultihashDecode{Err: err, Mh: mh}
 	}
 	if dmh.Code != multihash.DBL_SHA2_256 {
-		return nil, dhstore.ErrUnsupportedMulticodecCode{Code: multicodec.Code(dmh.Code)}
+		return dhstore.ErrUnsupportedMulticodecCode{Code: multicodec.Code(dmh.Code)}
 	}
 	if dmh.Length != 32 {
-		return nil, dhstore.ErrMultihashDecode{Err: errMultihashDigestLength, Mh: mh}
-	}
-	v, err := f.db.ReadTransact(func(transaction fdb.ReadTransaction) (any, error) {
-		vks := transaction.GetRange(f.mhdir.Sub(dmh.Digest), fdb.RangeOptions{})
-		// TODO: implement streaming variation since we are dealing with a streaming iterator anyway.
-		iterator := vks.Iterator()
-		var evks []dhstore.EncryptedValueKey
-		var latestErr error
+		return dhstore.ErrMultihashDecode{Err: errMultihashDigestLength, Mh: mh}
+	}
+
+	begin, end := f.mhdir.Sub(dmh.Digest).FDBRangeKeySelectors()
+	return f.streamRange(ctx, begin, end, func(kv fdb.KeyValue) error {
+		evk, err := f.unpackEncryptedValueKey(kv)
+		if err != nil {
+			logger.Errorw("failed to extract encrypted value key for multihash", "mh", mh.B58String(), "err", err)
+			return nil
+		}
+		return fn(evk)
+	})
+}
+
+// streamRange calls fn with each key-value in the given range as it is read.
+//
+// Reads are spread across as many transactions as needed to stay within the
+// FDB transaction time limit; each transaction continues right after the last
+// key read by the previous one. Values are therefore not read from a single
+// consistent snapshot.
+func (f *FDBDHStore) streamRange(ctx context.Context, begin, end fdb.Selectable, fn func(fdb.KeyValue) error) error {
+	transaction, err := f.db.CreateTransaction()
+	if err != nil {
+		return err
+	}
+	defer transaction.Cancel()
+	if err := f.setPriority(transaction); err != nil {
+		return err
+	}
+
+	var last fdb.Key
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rng := fdb.SelectorRange{Begin: begin, End: end}
+		if last != nil {
+			rng.Begin = fdb.FirstGreaterThan(last)
+		}
+		deadline := time.Now().Add(readTransactionBudget)
+		iterator := transaction.Snapshot().GetRange(rng, fdb.RangeOptions{Mode: fdb.StreamingModeIterator}).Iterator()
+		var more bool
+		var rangeErr error
 		for iterator.Advance() {
 			kv, err := iterator.Get()
 			if err != nil {
-				latestErr = err
-				logger.Errorw("failed to list encrypted value keys for multihash", "mh", mh.B58String(), "err", err)
-				continue
+				rangeErr = err
+				break
 			}
-			// Check if value is empty, and if so then it means the original vk was shorter than the max
-			// accepted key prefix and was used as is. Therefore, the key suffix is the value.
-			if len(kv.Value) == 0 {
-				unpack, err := f.mhdir.Unpack(kv.Key)
-				if err != nil {
-					latestErr = err
-					logger.Errorw("failed to unpack key to extract value for multihash", "mh", mh.B58String(), "err", err)
-					continue
-				}
-				if len(unpack) != 2 {
-					logger.Errorw("expected unpacked key of length 2 ", "len", len(unpack), "mh", mh.B58String())
-					continue
-				}
-				v, ok := unpack[1].([]byte)
-				if !ok {
-					logger.Errorw("expected unpacked key type bytes ", "got", unpack[0], "mh", mh.B58String())
-					continue
-				}
-				evks = append(evks, v)
-			} else {
-				evks = append(evks, kv.Value)
+			last = kv.Key
+			if err := fn(kv); err != nil {
+				return err
+			}
+			if time.Now().After(deadline) {
+				more = true
+				break
 			}
 		}
-		return evks, latestErr
-	})
-	if err != nil {
-		// If error has occurred but we found some result, return whatever we found.
-		if v == nil {
-			return nil, err
-		}
-		evks, ok := v.([]dhstore.EncryptedValueKey)
-		if !ok || len(evks) <= 0 {
-			// Return the non-nil error.
-			logger.Warnw("unexpected result from lookup transaction", "v", v, "err", err)
-			return nil, err
+		switch {
+		case rangeErr != nil:
+			// Continue from the last key read if the error is retryable, e.g.
+			// when the transaction is too old. OnError resets the transaction,
+			// including its priority.
+			if err := f.onError(transaction, rangeErr); err != nil {
+				return err
+			}
+			if err := f.setPriority(transaction); err != nil {
+				return err
+			}
+		case more:
+			// Reset clears transaction options, including priority.
+			transaction.Reset()
+			if err := f.setPriority(transaction); err != nil {
+				return err
+			}
+		default:
+			return nil
 		}
-		return evks, nil
 	}
-	evks, ok := v.([]dhstore.EncryptedValueKey)
-	switch {
-	case !ok:
-		logger.Warnw("unexpected result from lookup transaction", "v", v)
-		return nil, fmt.Errorf("unexpected result from lookup")
-	case len(evks) <= 0:
-		return nil, nil
-	default:
-		return evks, nil
+}
+
+// unpackEncryptedValueKey extracts the encrypted value key from a multihash
+// mapping.
+func (f *FDBDHStore) unpackEncryptedValueKey(kv fdb.KeyValue) (dhstore.EncryptedValueKey, error) {
+	// Check if value is empty, and if so then it means the original vk was shorter than the max
+	// accepted key prefix and was used as is. Therefore, the key suffix is the value.
+	if len(kv.Value) != 0 {
+		return kv.Value, nil
+	}
+	unpack, err := f.mhdir.Unpack(kv.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unpack key: %w", err)
+	}
+	if len(unpack) != 2 {
+		return nil, fmt.Errorf("expected unpacked key of length 2, got: %d", len(unpack))
 	}
+	v, ok := unpack[1].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("expected unpacked key type bytes, got: %T", unpack[1])
+	}
+	return v, nil
 }
 
 func (f *FDBDHStore) GetMetadata(vk dhstore.HashedValueKey) (dhstore.EncryptedMetadata, error) {
 	if len(vk) > maxKeyPrefixLen {
 		return nil, dhstore.ErrInvalidHashedValueKey{Key: vk, Err: errMetadataKeyTooLong}
 	}
-	v, err := f.db.ReadTransact(func(transaction fdb.ReadTransaction) (any, error) {
+	v, err := f.readTransact(func(transaction fdb.ReadTransaction) (any, error) {
 		get := transaction.Get(f.mddir.Pack(tuple.Tuple{[]byte(vk)}))
 		return get.Get()
 	})
@@ -296,7 +592,7 @@ func (f *FDBDHStore) DeleteMetadata(vk dhstore.HashedValueKey) error {
 	if len(vk) > maxKeyPrefixLen {
 		return dhstore.ErrInvalidHashedValueKey{Key: vk, Err: errMetadataKeyTooLong}
 	}
-	_, err := f.db.Transact(func(transaction fdb.Transaction) (any, error) {
+	_, err := f.transact(func(transaction fdb.Transaction) (any, error) {
 		transaction.Clear(f.mddir.Pack(tuple.Tuple{[]byte(vk)}))
 		return nil, nil
 	})
@@ -304,5 +600,10 @@ func (f *FDBDHStore) DeleteMetadata(vk dhstore.HashedValueKey) error {
 }
 
 func (f *FDBDHStore) Close() error {
+	if f.cancel != nil {
+		f.cancel()
+		f.wg.Wait()
+		f.cancel = nil
+	}
 	return nil
 }
@@ -0,0 +1,90 @@
+//go:build fdb
+
+package fdb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipni/dhstore"
+)
+
+// health tracks the availability of the FDB cluster as observed by periodic
+// health checks.
+type health struct {
+	// unavailable is set while the last health check failed.
+	unavailable atomic.Bool
+	// failures counts the total number of failed health checks.
+	failures atomic.Int64
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+// Healthy returns nil if the last health check succeeded, or
+// dhstore.ErrUnavailable otherwise. Always returns nil when health checks are
+// disabled.
+func (f *FDBDHStore) Healthy() error {
+	if !f.health.unavailable.Load() {
+		return nil
+	}
+	f.health.mu.Lock()
+	defer f.health.mu.Unlock()
+	return dhstore.ErrUnavailable{Err: f.health.lastErr}
+}
+
+func (f *FDBDHStore) startHealthChecks(ctx context.Context, interval, timeout time.Duration) {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		ticker := f.clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				f.checkHealth(timeout)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// checkHealth gets a read version within the given timeout, which requires
+// the client to reach the cluster controller and a quorum of proxies. The FDB
+// client reconnects on its own once the cluster is reachable again, at which
+// point the next check marks the store available.
+func (f *FDBDHStore) checkHealth(timeout time.Duration) {
+	err := f.getReadVersion(timeout)
+	if err == nil {
+		if f.health.unavailable.Swap(false) {
+			logger.Info("FoundationDB cluster is available again")
+		}
+		return
+	}
+	f.health.failures.Add(1)
+	f.health.mu.Lock()
+	f.health.lastErr = err
+	f.health.mu.Unlock()
+	if !f.health.unavailable.Swap(true) {
+		logger.Errorw("FoundationDB cluster is unavailable", "err", err)
+	}
+}
+
+func (f *FDBDHStore) getReadVersion(timeout time.Duration) error {
+	transaction, err := f.db.CreateTransaction()
+	if err != nil {
+		return err
+	}
+	defer transaction.Cancel()
+	if err := transaction.Options().SetTimeout(timeout.Milliseconds()); err != nil {
+		return err
+	}
+	if err := transaction.Options().SetPrioritySystemImmediate(); err != nil {
+		return err
+	}
+	_, err = transaction.GetReadVersion().Get()
+	return err
+}
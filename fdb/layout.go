@@ -0,0 +1,129 @@
+//go:build fdb
+
+package fdb
+
+import (
+	"fmt"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/directory"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// currentLayoutVersion is the version of the layout of the multihash and
+// metadata subspaces written by this version of the store.
+//
+// Version 1 is the layout predating versioning: multihash mappings keyed by
+// (mh digest prefix or hash, encrypted value key hash), and metadata keyed by
+// the hashed value key.
+const currentLayoutVersion = 1
+
+var (
+	layoutDirectoryPath = []string{"layout"}
+	layoutVersionKey    = tuple.Tuple{"version"}
+
+	// layoutMigrations migrates the data of a store from the layout version
+	// at which a migration is indexed to the next version. Each migration
+	// must be idempotent, since it is re-run if interrupted before the
+	// version is bumped.
+	layoutMigrations = map[int]func(*FDBDHStore) error{}
+)
+
+// ErrLayoutVersion signals that the layout of the data in FDB is not the one
+// written by this version of the store.
+type ErrLayoutVersion struct {
+	Stored  int
+	Current int
+}
+
+func (e ErrLayoutVersion) Error() string {
+	if e.Stored > e.Current {
+		return fmt.Sprintf("layout version %d is newer than supported version %d", e.Stored, e.Current)
+	}
+	return fmt.Sprintf("layout version %d is older than current version %d and must be migrated", e.Stored, e.Current)
+}
+
+// StoreFormat returns the version of the layout of the data of the store,
+// which is migrated to or verified to be currentLayoutVersion when opened.
+func (f *FDBDHStore) StoreFormat() string {
+	return StoreFormat
+}
+
+// StoreFormat is the format of the data written by this version of the store.
+var StoreFormat = fmt.Sprintf("fdb layout %d", currentLayoutVersion)
+
+// legacyLayout returns true if the store has data written before the layout
+// was versioned. It must be called before the subspaces are created.
+func legacyLayout(db fdb.Database, tenant string) (bool, error) {
+	exists, err := directory.Exists(db, tenantPath(tenant, layoutDirectoryPath))
+	if err != nil || exists {
+		return false, err
+	}
+	return directory.Exists(db, tenantPath(tenant, multihashDirectoryPath))
+}
+
+// checkLayout records the layout version of a new store, and verifies that
+// the layout of an existing store is the current one. Older layouts are
+// migrated if migrate is true, and rejected otherwise.
+func (f *FDBDHStore) checkLayout(tenant string, legacy, migrate bool) error {
+	layoutdir, err := directory.CreateOrOpen(f.db, tenantPath(tenant, layoutDirectoryPath), nil)
+	if err != nil {
+		return err
+	}
+	key := layoutdir.Pack(layoutVersionKey)
+
+	initial := currentLayoutVersion
+	if legacy {
+		initial = 1
+	}
+	stored, err := f.transact(func(tr fdb.Transaction) (any, error) {
+		value, err := tr.Get(key).Get()
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			tr.Set(key, tuple.Tuple{int64(initial)}.Pack())
+			return initial, nil
+		}
+		return unpackLayoutVersion(value)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read layout version: %w", err)
+	}
+
+	for version := stored.(int); version != currentLayoutVersion; version++ {
+		if version > currentLayoutVersion || !migrate {
+			return ErrLayoutVersion{Stored: version, Current: currentLayoutVersion}
+		}
+		migration, ok := layoutMigrations[version]
+		if !ok {
+			return fmt.Errorf("no migration from layout version %d", version)
+		}
+		logger.Infow("Migrating layout", "from", version, "to", version+1)
+		if err := migration(f); err != nil {
+			return fmt.Errorf("failed to migrate layout from version %d: %w", version, err)
+		}
+		if _, err := f.transact(func(tr fdb.Transaction) (any, error) {
+			tr.Set(key, tuple.Tuple{int64(version + 1)}.Pack())
+			return nil, nil
+		}); err != nil {
+			return fmt.Errorf("failed to record layout version %d: %w", version+1, err)
+		}
+	}
+	return nil
+}
+
+func unpackLayoutVersion(value []byte) (int, error) {
+	t, err := tuple.Unpack(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid layout version: %w", err)
+	}
+	if len(t) != 1 {
+		return 0, fmt.Errorf("invalid layout version: %v", t)
+	}
+	version, ok := t[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("invalid layout version: %v", t[0])
+	}
+	return int(version), nil
+}
@@ -0,0 +1,92 @@
+//go:build fdb
+
+package fdb
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipni/dhstore/metrics"
+)
+
+// stats counts transaction outcomes and records the latencies of the last
+// client probe.
+type stats struct {
+	commits   atomic.Int64
+	conflicts atomic.Int64
+	retries   atomic.Int64
+	failures  atomic.Int64
+
+	grvLatency    atomic.Int64
+	readLatency   atomic.Int64
+	commitLatency atomic.Int64
+}
+
+// Metrics returns a snapshot of the FDB client metrics.
+func (f *FDBDHStore) Metrics() *metrics.FDBMetrics {
+	return &metrics.FDBMetrics{
+		Commits:             f.stats.commits.Load(),
+		Conflicts:           f.stats.conflicts.Load(),
+		Retries:             f.stats.retries.Load(),
+		Failures:            f.stats.failures.Load(),
+		GRVLatency:          time.Duration(f.stats.grvLatency.Load()),
+		ReadLatency:         time.Duration(f.stats.readLatency.Load()),
+		CommitLatency:       time.Duration(f.stats.commitLatency.Load()),
+		Available:           !f.health.unavailable.Load(),
+		HealthCheckFailures: f.health.failures.Load(),
+	}
+}
+
+func (f *FDBDHStore) startProbing(ctx context.Context, interval time.Duration) {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		ticker := f.clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := f.probe(); err != nil {
+				logger.Warnw("Failed to probe client latency", "err", err)
+			}
+			select {
+			case <-ticker.C():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// probe measures the latency of getting a read version, reading a key and
+// committing a write, in the same way as the FDB client latency probe does.
+func (f *FDBDHStore) probe() error {
+	transaction, err := f.db.CreateTransaction()
+	if err != nil {
+		return err
+	}
+	defer transaction.Cancel()
+	if err := f.setPriority(transaction); err != nil {
+		return err
+	}
+
+	start := f.clock.Now()
+	if _, err := transaction.GetReadVersion().Get(); err != nil {
+		return err
+	}
+	f.stats.grvLatency.Store(int64(f.clock.Since(start)))
+
+	key := f.probedir.Pack(nil)
+	start = f.clock.Now()
+	if _, err := transaction.Get(key).Get(); err != nil {
+		return err
+	}
+	f.stats.readLatency.Store(int64(f.clock.Since(start)))
+
+	transaction.Set(key, nil)
+	start = f.clock.Now()
+	if err := transaction.Commit().Get(); err != nil {
+		return err
+	}
+	f.stats.commitLatency.Store(int64(f.clock.Since(start)))
+	return nil
+}
@@ -2,16 +2,72 @@
 
 package fdb
 
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+)
+
+const (
+	// PriorityDefault runs transactions at the default FDB priority.
+	PriorityDefault = "default"
+	// PriorityBatch runs transactions at batch priority, which yields to
+	// default priority work when the cluster is saturated.
+	PriorityBatch = "batch"
+	// PriorityImmediate runs transactions at system immediate priority,
+	// which bypasses ratekeeper throttling.
+	PriorityImmediate = "immediate"
+)
+
+// defaultMaxTransactionBytes is the default maximum size of mutations written
+// in a single transaction. FDB rejects transactions larger than 10 MB, and
+// recommends keeping them under 1 MB for performance.
+const defaultMaxTransactionBytes = 1 << 20 // 1 MiB
+
+// defaultProbeInterval is the default interval at which client latency is
+// probed.
+const defaultProbeInterval = 10 * time.Second
+
+const (
+	// defaultHealthCheckInterval is the default interval at which the
+	// availability of the cluster is checked.
+	defaultHealthCheckInterval = 5 * time.Second
+	// defaultHealthCheckTimeout is the default time after which a health
+	// check fails.
+	defaultHealthCheckTimeout = 2 * time.Second
+)
+
 type (
 	Option  func(*options) error
 	options struct {
-		clusterFile string
-		apiVersion  int
+		clusterFile         string
+		apiVersion          int
+		maxTransactionBytes int
+		timeout             time.Duration
+		retryLimit          int
+		maxRetryDelay       time.Duration
+		priority            string
+		probeInterval       time.Duration
+		tenant              string
+		migrateLayout       bool
+		healthCheckInterval time.Duration
+		healthCheckTimeout  time.Duration
+		clock               clock.Clock
 	}
 )
 
 func newOptions(o ...Option) (*options, error) {
-	var opts options
+	opts := options{
+		maxTransactionBytes: defaultMaxTransactionBytes,
+		retryLimit:          -1,
+		priority:            PriorityDefault,
+		probeInterval:       defaultProbeInterval,
+		healthCheckInterval: defaultHealthCheckInterval,
+		healthCheckTimeout:  defaultHealthCheckTimeout,
+		clock:               clock.New(),
+	}
 	for _, apply := range o {
 		if err := apply(&opts); err != nil {
 			return nil, err
@@ -33,3 +89,137 @@ func WithClusterFile(f string) Option {
 		return nil
 	}
 }
+
+// WithMaxTransactionBytes sets the maximum size of the keys and values written
+// in a single transaction. Larger batches of index merges or deletions are
+// split across multiple transactions. Defaults to 1 MiB.
+func WithMaxTransactionBytes(n int) Option {
+	return func(o *options) error {
+		if n <= 0 || n > 10<<20 {
+			return fmt.Errorf("max transaction bytes must be between 1 and 10 MiB, got: %d", n)
+		}
+		o.maxTransactionBytes = n
+		return nil
+	}
+}
+
+// WithTransactionTimeout sets the timeout after which transactions, including
+// their retries, fail. Zero, which is the default, leaves the FDB default of
+// no timeout.
+func WithTransactionTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout < 0 {
+			return fmt.Errorf("transaction timeout must not be negative, got: %s", timeout)
+		}
+		o.timeout = timeout
+		return nil
+	}
+}
+
+// WithTransactionRetryLimit sets the maximum number of times a transaction is
+// retried. A negative value, which is the default, leaves the FDB default of
+// retrying indefinitely.
+func WithTransactionRetryLimit(limit int) Option {
+	return func(o *options) error {
+		o.retryLimit = limit
+		return nil
+	}
+}
+
+// WithTransactionMaxRetryDelay sets the maximum backoff delay between
+// transaction retries. Zero, which is the default, leaves the FDB default of
+// one second.
+func WithTransactionMaxRetryDelay(delay time.Duration) Option {
+	return func(o *options) error {
+		if delay < 0 {
+			return fmt.Errorf("transaction max retry delay must not be negative, got: %s", delay)
+		}
+		o.maxRetryDelay = delay
+		return nil
+	}
+}
+
+// WithTransactionPriority sets the priority of transactions; one of
+// PriorityDefault, PriorityBatch or PriorityImmediate. Defaults to
+// PriorityDefault.
+func WithTransactionPriority(priority string) Option {
+	return func(o *options) error {
+		switch priority {
+		case PriorityDefault, PriorityBatch, PriorityImmediate:
+			o.priority = priority
+			return nil
+		default:
+			return fmt.Errorf("unknown transaction priority: %s", priority)
+		}
+	}
+}
+
+// WithTenant isolates the store under a root directory named after the given
+// tenant, so that multiple logical stores can share one FDB cluster. Empty,
+// which is the default, stores data at the root of the directory layer.
+func WithTenant(tenant string) Option {
+	return func(o *options) error {
+		if strings.ContainsRune(tenant, '/') {
+			return fmt.Errorf("tenant must not contain '/', got: %s", tenant)
+		}
+		o.tenant = tenant
+		return nil
+	}
+}
+
+// WithProbeInterval sets the interval at which the latency of getting a read
+// version, reading and committing is probed. Zero disables probing. Defaults
+// to 10 seconds.
+func WithProbeInterval(interval time.Duration) Option {
+	return func(o *options) error {
+		if interval < 0 {
+			return fmt.Errorf("probe interval must not be negative, got: %s", interval)
+		}
+		o.probeInterval = interval
+		return nil
+	}
+}
+
+// WithMigrateLayout sets whether to migrate the data of a store written in an
+// older layout to the current one when the store is opened. Otherwise, opening
+// such a store fails with ErrLayoutVersion. Disabled by default.
+func WithMigrateLayout(migrate bool) Option {
+	return func(o *options) error {
+		o.migrateLayout = migrate
+		return nil
+	}
+}
+
+// WithHealthCheckInterval sets the interval at which the availability of the
+// cluster is checked. While unavailable, writes fail with
+// dhstore.ErrUnavailable. Zero disables health checks. Defaults to 5 seconds.
+func WithHealthCheckInterval(interval time.Duration) Option {
+	return func(o *options) error {
+		if interval < 0 {
+			return fmt.Errorf("health check interval must not be negative, got: %s", interval)
+		}
+		o.healthCheckInterval = interval
+		return nil
+	}
+}
+
+// WithHealthCheckTimeout sets the time after which a health check fails.
+// Defaults to 2 seconds.
+func WithHealthCheckTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout <= 0 {
+			return fmt.Errorf("health check timeout must be positive, got: %s", timeout)
+		}
+		o.healthCheckTimeout = timeout
+		return nil
+	}
+}
+
+// WithClock sets the clock used to schedule latency probes and health checks,
+// and to measure probe latencies. Defaults to the system clock.
+func WithClock(c clock.Clock) Option {
+	return func(o *options) error {
+		o.clock = c
+		return nil
+	}
+}
@@ -0,0 +1,251 @@
+package grpcserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/ipni/dhstore/audit"
+	"github.com/ipni/dhstore/auth"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/limit"
+	"github.com/ipni/dhstore/metrics"
+	"github.com/ipni/dhstore/watch"
+)
+
+const (
+	defaultLookupBatchSize = 1024
+	defaultMaxRecvMsgSize  = 16 << 20 // 16 MiB
+)
+
+// config contains all options for the server.
+type config struct {
+	metrics         *metrics.Metrics
+	clock           clock.Clock
+	lookupBatchSize int
+	maxRecvMsgSize  int
+	tokens          *auth.Tokens
+	authorizers     []auth.Authorizer
+	limiter         *limit.Limiter
+	readOnly        func() bool
+	watchHub        *watch.Hub
+	auditLog        *audit.Log
+	maxValueKeySize int
+	tlsConfig       *tls.Config
+	writeClientCAs  *x509.CertPool
+
+	provenanceHeader      string
+	provenanceSampleEvery int
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	cfg := config{
+		clock:           clock.New(),
+		lookupBatchSize: defaultLookupBatchSize,
+		maxRecvMsgSize:  defaultMaxRecvMsgSize,
+	}
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d error: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithMetrics configures metrics.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(c *config) error {
+		c.metrics = m
+		return nil
+	}
+}
+
+// WithClock sets the clock used to measure latency. Defaults to the system
+// clock.
+func WithClock(clk clock.Clock) Option {
+	return func(c *config) error {
+		c.clock = clk
+		return nil
+	}
+}
+
+// WithLookupBatchSize sets the maximum number of encrypted value keys sent in
+// a single lookup response message. Defaults to 1024.
+func WithLookupBatchSize(size int) Option {
+	return func(c *config) error {
+		if size <= 0 {
+			return fmt.Errorf("lookup batch size must be positive, got: %d", size)
+		}
+		c.lookupBatchSize = size
+		return nil
+	}
+}
+
+// WithMaxRecvMsgSize sets the maximum size of request messages in bytes, which
+// bounds the size of write batches. Defaults to 16 MiB.
+func WithMaxRecvMsgSize(size int) Option {
+	return func(c *config) error {
+		if size <= 0 {
+			return fmt.Errorf("max receive message size must be positive, got: %d", size)
+		}
+		c.maxRecvMsgSize = size
+		return nil
+	}
+}
+
+// WithAuth requires RPCs to carry a token authorized for their group in the
+// authorization metadata as a bearer token, or in the x-api-key metadata.
+// Lookup and GetMetadata belong to the read group, and all other RPCs to the
+// write group. Groups without tokens remain open. Disabled by default.
+func WithAuth(tokens *auth.Tokens) Option {
+	return func(c *config) error {
+		if tokens == nil {
+			return fmt.Errorf("tokens must not be nil")
+		}
+		c.tokens = tokens
+		return nil
+	}
+}
+
+// WithAuthorizers invokes the given authorizers on write RPCs, i.e. all RPCs
+// but Lookup and GetMetadata, which are rejected unless allowed. Authorizers
+// are invoked after tokens are checked, in the order in which they are given,
+// with the metadata of the RPC as request headers and its full method as the
+// request path. Denials with 401 Unauthorized fail with Unauthenticated, and
+// all others with PermissionDenied.
+func WithAuthorizers(authorizers ...auth.Authorizer) Option {
+	return func(c *config) error {
+		for _, a := range authorizers {
+			if a == nil {
+				return errors.New("authorizer must not be nil")
+			}
+		}
+		c.authorizers = append(c.authorizers, authorizers...)
+		return nil
+	}
+}
+
+// WithConcurrencyLimiter bounds the number of RPCs served concurrently using
+// the given limiter, which may be shared with other servers to bound requests
+// across APIs. RPCs for which no slot becomes available within the limiter
+// queue timeout fail with RESOURCE_EXHAUSTED. Unlimited by default.
+func WithConcurrencyLimiter(l *limit.Limiter) Option {
+	return func(c *config) error {
+		if l == nil {
+			return fmt.Errorf("limiter must not be nil")
+		}
+		c.limiter = l
+		return nil
+	}
+}
+
+// WithReadOnly rejects writes as if the store was read-only while the given
+// function returns true, so that read-only mode can be toggled at runtime.
+func WithReadOnly(readOnly func() bool) Option {
+	return func(c *config) error {
+		if readOnly == nil {
+			return fmt.Errorf("read-only function must not be nil")
+		}
+		c.readOnly = readOnly
+		return nil
+	}
+}
+
+// WithWatchHub publishes merged indexes to the watchers of the given hub,
+// which is typically shared with the HTTP server that serves watches.
+// Disabled by default.
+func WithWatchHub(h *watch.Hub) Option {
+	return func(c *config) error {
+		if h == nil {
+			return fmt.Errorf("watch hub must not be nil")
+		}
+		c.watchHub = h
+		return nil
+	}
+}
+
+// WithAuditLog records every merge and deletion of indexes, and every put and
+// deletion of metadata in the given log, along with the address of the client.
+// Disabled by default.
+func WithAuditLog(l *audit.Log) Option {
+	return func(cfg *config) error {
+		if l == nil {
+			return errors.New("audit log cannot be nil")
+		}
+		cfg.auditLog = l
+		return nil
+	}
+}
+
+// WithMaxValueKeySize rejects merges of encrypted value keys larger than the
+// given number of bytes with InvalidArgument, regardless of the limits of the
+// store, if any. Sizes are unbounded when zero, which is the default.
+func WithMaxValueKeySize(size int) Option {
+	return func(c *config) error {
+		if size < 0 {
+			return fmt.Errorf("maximum value key size cannot be negative, got: %d", size)
+		}
+		c.maxValueKeySize = size
+		return nil
+	}
+}
+
+// WithTLSConfig serves RPCs over TLS using the given TLS configuration, which
+// must provide a certificate, e.g. via Certificates or GetCertificate. Served
+// over plaintext by default.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *config) error {
+		if tlsConfig == nil {
+			return fmt.Errorf("tls config must not be nil")
+		}
+		if len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil {
+			return fmt.Errorf("tls config must provide a certificate")
+		}
+		c.tlsConfig = tlsConfig
+		return nil
+	}
+}
+
+// WithWriteClientCAs requires clients to present a certificate signed by one
+// of the given CAs in order to write to the store, i.e. for RPCs other than
+// Lookup and GetMetadata. RPCs without a verified certificate are rejected
+// with PermissionDenied, while reads remain open to all clients.
+//
+// Requires RPCs to be served over TLS via WithTLSConfig. Disabled by default.
+func WithWriteClientCAs(pool *x509.CertPool) Option {
+	return func(c *config) error {
+		if pool == nil {
+			return fmt.Errorf("write client CA pool must not be nil")
+		}
+		c.writeClientCAs = pool
+		return nil
+	}
+}
+
+// WithProvenance enables recording of the writer tag of batches merged via
+// MergeIndexes, so that operators can trace where data came from. The tag is
+// taken from the metadata of the given header name, matched case-insensitively,
+// and is recorded once every sampleEvery batches that carry it. A sampleEvery
+// of 1 records every batch. It is typically set to the provenance header of the
+// HTTP server, so that writers tag batches the same way over either API.
+//
+// New returns an error if the store does not implement
+// dhstore.ProvenanceRecorder. Disabled by default.
+func WithProvenance(header string, sampleEvery int) Option {
+	return func(c *config) error {
+		if header == "" {
+			return fmt.Errorf("provenance header must be specified")
+		}
+		if sampleEvery < 1 {
+			return fmt.Errorf("provenance sample rate must be at least 1, got: %d", sampleEvery)
+		}
+		c.provenanceHeader = header
+		c.provenanceSampleEvery = sampleEvery
+		return nil
+	}
+}
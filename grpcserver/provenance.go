@@ -0,0 +1,55 @@
+package grpcserver
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/ipni/dhstore"
+	"google.golang.org/grpc/metadata"
+)
+
+// provenance records the writer tag of merged batches.
+type provenance struct {
+	recorder dhstore.ProvenanceRecorder
+	// key is the metadata key of the writer tag, i.e. the lower case
+	// provenance header.
+	key         string
+	sampleEvery uint64
+	batches     atomic.Uint64
+}
+
+// provenanceTag returns the writer tag carried by the RPC of the given
+// context, truncated to dhstore.MaxProvenanceTagLen, or empty if provenance is
+// disabled.
+func (s *Server) provenanceTag(ctx context.Context) string {
+	if s.provenance == nil {
+		return ""
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(s.provenance.key); len(values) != 0 {
+		return dhstore.TruncateProvenanceTag(values[0])
+	}
+	return ""
+}
+
+// recordProvenance persists the provenance of the given merges if the RPC of
+// the given context carries a writer tag and the batch is sampled. Failure to
+// record provenance does not fail the merge, since the merges are already
+// committed.
+func (s *Server) recordProvenance(ctx context.Context, merges []dhstore.Index) {
+	p := s.provenance
+	if p == nil {
+		return
+	}
+	tag := s.provenanceTag(ctx)
+	if tag == "" {
+		return
+	}
+	if p.batches.Add(1)%p.sampleEvery != 0 {
+		return
+	}
+	record := dhstore.NewProvenance(tag, s.clock.Now(), merges)
+	if err := p.recorder.RecordProvenance(record); err != nil {
+		log.Warnw("Failed to record provenance", "tag", tag, "count", len(merges), "err", err)
+	}
+}
@@ -0,0 +1,643 @@
+// Package grpcserver serves the dhstore API over gRPC, as defined by the
+// DHStore service in package pb, alongside the HTTP API. It is intended for
+// high-volume writers such as indexers, which benefit from multiplexed
+// connections and binary encoding.
+package grpcserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/audit"
+	"github.com/ipni/dhstore/auth"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/limit"
+	"github.com/ipni/dhstore/metrics"
+	"github.com/ipni/dhstore/pb"
+	"github.com/ipni/dhstore/watch"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var log = logging.Logger("server/grpc")
+
+// requestIDMetadata is the metadata key of the request ID optionally set by
+// clients, which is recorded in the audit log.
+const requestIDMetadata = "x-request-id"
+
+type Server struct {
+	pb.UnimplementedDHStoreServer
+
+	s       *grpc.Server
+	addr    string
+	dhs     dhstore.DHStore
+	metrics *metrics.Metrics
+	clock   clock.Clock
+	tokens  *auth.Tokens
+	// authorizers optionally authorize write RPCs once tokens are checked.
+	authorizers []auth.Authorizer
+	limiter     *limit.Limiter
+	// readOnly optionally reports whether writes are to be rejected.
+	readOnly func() bool
+	// watchHub optionally notifies watchers of merged indexes.
+	watchHub *watch.Hub
+	// auditLog optionally records the mutations of the store.
+	auditLog *audit.Log
+	// provenance is optionally enabled to record the writer of merged batches.
+	provenance *provenance
+	// maxValueKeySize is the maximum size of merged encrypted value keys, if
+	// positive.
+	maxValueKeySize int
+	// requireWriteClientCerts is whether writes require a verified client
+	// certificate.
+	requireWriteClientCerts bool
+
+	lookupBatchSize int
+	// streamingLookuper is set when the store supports streaming lookups, in
+	// which case lookup responses are sent as keys are read.
+	streamingLookuper dhstore.StreamingLookuper
+}
+
+func New(dhs dhstore.DHStore, addr string, options ...Option) (*Server, error) {
+	opts, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		addr:            addr,
+		dhs:             dhs,
+		metrics:         opts.metrics,
+		clock:           opts.clock,
+		tokens:          opts.tokens,
+		authorizers:     opts.authorizers,
+		limiter:         opts.limiter,
+		readOnly:        opts.readOnly,
+		watchHub:        opts.watchHub,
+		auditLog:        opts.auditLog,
+		lookupBatchSize: opts.lookupBatchSize,
+		maxValueKeySize: opts.maxValueKeySize,
+	}
+	s.streamingLookuper, _ = dhs.(dhstore.StreamingLookuper)
+	if opts.provenanceHeader != "" {
+		recorder, ok := dhs.(dhstore.ProvenanceRecorder)
+		if !ok {
+			return nil, errors.New("provenance is not supported by store")
+		}
+		s.provenance = &provenance{
+			recorder:    recorder,
+			key:         strings.ToLower(opts.provenanceHeader),
+			sampleEvery: uint64(opts.provenanceSampleEvery),
+		}
+		log.Infow("Provenance recording enabled", "header", opts.provenanceHeader, "sampleEvery", opts.provenanceSampleEvery)
+	}
+	serverOpts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(opts.maxRecvMsgSize),
+		grpc.UnaryInterceptor(s.unaryInterceptor),
+		grpc.StreamInterceptor(s.streamInterceptor),
+	}
+	tlsConfig := opts.tlsConfig
+	if opts.writeClientCAs != nil {
+		if tlsConfig == nil {
+			return nil, errors.New("write client authentication requires TLS")
+		}
+		// Only verify client certificates when given, so that reads do not
+		// require one.
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ClientCAs = opts.writeClientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		s.requireWriteClientCerts = true
+		log.Info("Client certificates required for writes")
+	}
+	if tlsConfig != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s.s = grpc.NewServer(serverOpts...)
+	pb.RegisterDHStoreServer(s.s, s)
+	return s, nil
+}
+
+func (s *Server) Start(_ context.Context) error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	go func() { _ = s.Serve(ln) }()
+
+	log.Infow("Server started", "addr", ln.Addr())
+	return nil
+}
+
+// Serve accepts connections on the given listener until the server is shut
+// down.
+func (s *Server) Serve(ln net.Listener) error {
+	return s.s.Serve(ln)
+}
+
+// Shutdown stops accepting connections and waits for pending RPCs to finish,
+// or forcibly closes them once the given context is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.s.Stop()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) MergeIndexes(ctx context.Context, req *pb.MergeIndexesRequest) (*pb.MergeIndexesResponse, error) {
+	if len(req.GetMerges()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one merge must be specified")
+	}
+	merges := toIndexes(req.GetMerges())
+	if err := dhstore.CheckValueKeySizes(merges, s.maxValueKeySize); err != nil {
+		s.recordFailedWrite(ctx, "merge", err, len(merges))
+		return nil, toStatus(err)
+	}
+	err := s.dhs.MergeIndexes(merges)
+	s.auditIndexes(ctx, audit.OpMergeIndexes, merges, err)
+	if err != nil {
+		log.Errorw("Failed to merge indexes", "err", err)
+		s.recordFailedWrite(ctx, "merge", err, len(merges))
+		return nil, toStatus(err)
+	}
+	if s.metrics != nil {
+		var bytes int64
+		for _, merge := range merges {
+			bytes += int64(len(merge.Key) + len(merge.Value))
+		}
+		s.metrics.RecordMergeBatch(ctx, "grpc", len(merges), bytes)
+	}
+	s.recordProvenance(ctx, merges)
+	if s.watchHub != nil {
+		s.watchHub.Publish(merges)
+	}
+	return &pb.MergeIndexesResponse{}, nil
+}
+
+func (s *Server) DeleteIndexes(ctx context.Context, req *pb.DeleteIndexesRequest) (*pb.DeleteIndexesResponse, error) {
+	if len(req.GetDeletes()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one delete must be specified")
+	}
+	deletes := toIndexes(req.GetDeletes())
+	err := s.dhs.DeleteIndexes(deletes)
+	s.auditIndexes(ctx, audit.OpDeleteIndexes, deletes, err)
+	if err != nil {
+		log.Errorw("Failed to delete indexes", "err", err)
+		return nil, toStatus(err)
+	}
+	log.Infow("Deleted indexes", "count", len(req.GetDeletes()))
+	return &pb.DeleteIndexesResponse{}, nil
+}
+
+func (s *Server) Lookup(req *pb.LookupRequest, stream pb.DHStore_LookupServer) error {
+	mh := req.GetMultihash()
+	resp := &pb.LookupResponse{Multihash: mh}
+	var sent int
+	send := func(evk dhstore.EncryptedValueKey) error {
+		resp.EncryptedValueKeys = append(resp.EncryptedValueKeys, evk)
+		sent++
+		if len(resp.EncryptedValueKeys) < s.lookupBatchSize {
+			return nil
+		}
+		err := stream.Send(resp)
+		resp.EncryptedValueKeys = resp.EncryptedValueKeys[:0]
+		return err
+	}
+
+	var err error
+	if s.streamingLookuper != nil {
+		err = s.streamingLookuper.LookupStream(stream.Context(), mh, send)
+	} else {
+		var evks []dhstore.EncryptedValueKey
+		if evks, err = s.dhs.Lookup(mh); err == nil {
+			for _, evk := range evks {
+				if err = send(evk); err != nil {
+					break
+				}
+			}
+		}
+	}
+	switch {
+	case err != nil:
+		if sent != 0 {
+			log.Errorw("Lookup stream interrupted", "written", sent, "err", err)
+		}
+		return toStatus(err)
+	case sent == 0:
+		return status.Error(codes.NotFound, "no encrypted value keys found")
+	case len(resp.EncryptedValueKeys) != 0:
+		return stream.Send(resp)
+	}
+	return nil
+}
+
+func (s *Server) PutMetadata(ctx context.Context, req *pb.PutMetadataRequest) (*pb.PutMetadataResponse, error) {
+	records := req.GetMetadata()
+	var err error
+	switch len(records) {
+	case 0:
+		return nil, status.Error(codes.InvalidArgument, "at least one metadata record must be specified")
+	case 1:
+		err = s.dhs.PutMetadata(records[0].GetKey(), records[0].GetValue())
+	default:
+		err = s.putMetadataBatch(records)
+	}
+	if s.auditLog != nil {
+		hvks := make([]dhstore.HashedValueKey, 0, len(records))
+		for _, record := range records {
+			hvks = append(hvks, record.GetKey())
+		}
+		s.auditLog.RecordMetadata(audit.OpPutMetadata, s.auditClient(ctx), hvks, err)
+	}
+	if err != nil {
+		log.Errorw("Failed to put metadata", "err", err)
+		s.recordFailedWrite(ctx, "metadata", err, len(records))
+		return nil, toStatus(err)
+	}
+	return &pb.PutMetadataResponse{}, nil
+}
+
+func (s *Server) putMetadataBatch(records []*pb.Metadata) error {
+	if bp, ok := s.dhs.(dhstore.MetadataBatchPutter); ok {
+		batch := make([]dhstore.Metadata, 0, len(records))
+		for _, record := range records {
+			batch = append(batch, dhstore.Metadata{Key: record.GetKey(), Value: record.GetValue()})
+		}
+		return bp.PutMetadataBatch(batch)
+	}
+	for _, record := range records {
+		if err := s.dhs.PutMetadata(record.GetKey(), record.GetValue()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) GetMetadata(_ context.Context, req *pb.GetMetadataRequest) (*pb.GetMetadataResponse, error) {
+	emd, err := s.dhs.GetMetadata(req.GetKey())
+	if err != nil {
+		log.Errorw("Failed to get metadata", "err", err)
+		return nil, toStatus(err)
+	}
+	if len(emd) == 0 {
+		return nil, status.Error(codes.NotFound, "no metadata found")
+	}
+	return &pb.GetMetadataResponse{EncryptedMetadata: emd}, nil
+}
+
+func (s *Server) DeleteMetadata(ctx context.Context, req *pb.DeleteMetadataRequest) (*pb.DeleteMetadataResponse, error) {
+	err := s.dhs.DeleteMetadata(req.GetKey())
+	if s.auditLog != nil {
+		s.auditLog.RecordMetadata(audit.OpDeleteMetadata, s.auditClient(ctx), []dhstore.HashedValueKey{req.GetKey()}, err)
+	}
+	if err != nil {
+		log.Errorw("Failed to delete metadata", "err", err)
+		return nil, toStatus(err)
+	}
+	return &pb.DeleteMetadataResponse{}, nil
+}
+
+func (s *Server) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	defer s.observe(info.FullMethod, s.clock.Now(), &err)
+	if err = s.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	if ctx, err = s.applyAuthorizers(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	if err = s.requireWriteClientCert(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	if err = s.rejectWrite(info.FullMethod); err != nil {
+		return nil, err
+	}
+	release, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return handler(ctx, req)
+}
+
+func (s *Server) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer s.observe(info.FullMethod, s.clock.Now(), &err)
+	if err = s.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	if ctx, err := s.applyAuthorizers(ss.Context(), info.FullMethod); err != nil {
+		return err
+	} else if ctx != ss.Context() {
+		ss = annotatedStream{ServerStream: ss, ctx: ctx}
+	}
+	if err = s.requireWriteClientCert(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	if err = s.rejectWrite(info.FullMethod); err != nil {
+		return err
+	}
+	release, err := s.acquire(ss.Context())
+	if err != nil {
+		return err
+	}
+	defer release()
+	return handler(srv, ss)
+}
+
+// acquire waits for a slot of the concurrency limiter, if any, and returns a
+// function that releases it.
+func (s *Server) acquire(ctx context.Context) (func(), error) {
+	if s.limiter == nil {
+		return func() {}, nil
+	}
+	release, err := s.limiter.Acquire(ctx)
+	switch {
+	case err == nil:
+		return release, nil
+	case errors.Is(err, limit.ErrLimited):
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return nil, status.FromContextError(err).Err()
+	}
+}
+
+// isRead reports whether the RPC with the given method only reads from the
+// store.
+func isRead(fullMethod string) bool {
+	switch path.Base(fullMethod) {
+	case "Lookup", "GetMetadata":
+		return true
+	default:
+		return false
+	}
+}
+
+// rejectWrite returns the status of a read-only store error if the RPC with
+// the given method writes to the store while read-only mode is on.
+func (s *Server) rejectWrite(fullMethod string) error {
+	if s.readOnly != nil && !isRead(fullMethod) && s.readOnly() {
+		return toStatus(dhstore.ErrReadOnly{})
+	}
+	return nil
+}
+
+// auditIndexes records the mutation of indexes made by the RPC of the given
+// context in the audit log, if enabled.
+func (s *Server) auditIndexes(ctx context.Context, op audit.Op, indexes []dhstore.Index, err error) {
+	if s.auditLog != nil {
+		s.auditLog.RecordIndexes(op, s.auditClient(ctx), indexes, err)
+	}
+}
+
+// auditClient identifies the client of the RPC of the given context by its
+// address, verified client certificate, request ID, if set by the client,
+// provenance writer tag and authorizer annotations.
+func (s *Server) auditClient(ctx context.Context) audit.Client {
+	client := audit.Client{API: "grpc", Tag: s.provenanceTag(ctx), Annotations: auth.AnnotationsFrom(ctx)}
+	if p, ok := peer.FromContext(ctx); ok {
+		client.Addr = p.Addr.String()
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) != 0 {
+			client.Subject = tlsInfo.State.VerifiedChains[0][0].Subject.String()
+		}
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(requestIDMetadata); len(values) != 0 {
+		client.RequestID = values[0]
+	}
+	return client
+}
+
+// authorize returns an Unauthenticated error unless the RPC with the given
+// method carries a token authorized for its group, if tokens are configured.
+func (s *Server) authorize(ctx context.Context, fullMethod string) error {
+	if s.tokens == nil {
+		return nil
+	}
+	group := auth.GroupWrite
+	if isRead(fullMethod) {
+		group = auth.GroupRead
+	}
+	var token string
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) != 0 {
+		scheme, bearer, _ := strings.Cut(values[0], " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(bearer)
+		}
+	} else if values := md.Get(auth.APIKeyHeader); len(values) != 0 {
+		token = values[0]
+	}
+	if !s.tokens.Check(group, token) {
+		log.Warnw("Rejecting unauthorized RPC", "group", group, "method", fullMethod)
+		return status.Error(codes.Unauthenticated, "")
+	}
+	return nil
+}
+
+// applyAuthorizers invokes the authorizers, if any, on the RPC with the given
+// method if it writes to the store. It returns the context of the RPC with the
+// annotations of the authorizers attached, or the error with which to reject
+// the RPC if denied by any.
+func (s *Server) applyAuthorizers(ctx context.Context, fullMethod string) (context.Context, error) {
+	if len(s.authorizers) == 0 || isRead(fullMethod) {
+		return ctx, nil
+	}
+	r := authorizerRequest(ctx, fullMethod)
+	for _, a := range s.authorizers {
+		d := a.Authorize(r, auth.GroupWrite)
+		if !d.Allow {
+			code := codes.PermissionDenied
+			if d.Status == http.StatusUnauthorized {
+				code = codes.Unauthenticated
+			}
+			log.Warnw("Rejecting RPC denied by authorizer", "method", fullMethod, "remote", r.RemoteAddr, "code", code, "reason", d.Reason)
+			return nil, status.Error(code, d.Reason)
+		}
+		if len(d.Annotations) != 0 {
+			ctx = auth.WithAnnotations(ctx, d.Annotations)
+			r = r.WithContext(ctx)
+		}
+	}
+	return ctx, nil
+}
+
+// authorizerRequest returns the request that represents the RPC of the given
+// context and method to authorizers, with the metadata of the RPC as headers,
+// along with the address and TLS connection state of the client.
+func authorizerRequest(ctx context.Context, fullMethod string) *http.Request {
+	r := &http.Request{
+		Method:     http.MethodPost,
+		URL:        &url.URL{Path: fullMethod},
+		RequestURI: fullMethod,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if strings.HasPrefix(key, ":") {
+			if key == ":authority" && len(values) != 0 {
+				r.Host = values[0]
+			}
+			continue
+		}
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state := tlsInfo.State
+			r.TLS = &state
+		}
+	}
+	return r.WithContext(ctx)
+}
+
+// annotatedStream is a server stream with the context to which authorizers
+// attached their annotations.
+type annotatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s annotatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// requireWriteClientCert returns a PermissionDenied error if the RPC with the
+// given method writes to the store without the client having presented a
+// certificate verified against the write client CAs, if configured.
+func (s *Server) requireWriteClientCert(ctx context.Context, fullMethod string) error {
+	if !s.requireWriteClientCerts || isRead(fullMethod) {
+		return nil
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) != 0 {
+			return nil
+		}
+	}
+	log.Warnw("Rejecting write without verified client certificate", "method", fullMethod)
+	return status.Error(codes.PermissionDenied, "client certificate required")
+}
+
+// observe recovers a panic of the RPC with the given method as an internal
+// error, and records the latency of the RPC.
+func (s *Server) observe(fullMethod string, start time.Time, err *error) {
+	method := path.Base(fullMethod)
+	if r := recover(); r != nil {
+		log.Errorw("Recovered from panic in gRPC handler", "method", method, "panic", r, "stack", string(debug.Stack()))
+		*err = status.Error(codes.Internal, "")
+	}
+	if s.metrics != nil {
+		s.metrics.RecordGrpcLatency(context.Background(), s.clock.Since(start), method, status.Code(*err).String())
+	}
+}
+
+func toIndexes(indexes []*pb.Index) []dhstore.Index {
+	converted := make([]dhstore.Index, 0, len(indexes))
+	for _, index := range indexes {
+		converted = append(converted, dhstore.Index{Key: index.GetKey(), Value: index.GetValue()})
+	}
+	return converted
+}
+
+// toStatus converts an error returned by the store, which may wrap one of the
+// dhstore errors, into a gRPC status error with codes equivalent to the HTTP
+// statuses of the HTTP API.
+// recordFailedWrite records count merges or metadata writes, as per op, that
+// failed with the given error, if metrics are enabled.
+func (s *Server) recordFailedWrite(ctx context.Context, op string, err error, count int) {
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.RecordFailedWrite(ctx, op, "grpc", errorCode(err), count)
+}
+
+// errorCode returns the dhstore error code that corresponds to the given
+// error, consistently with the responses of the HTTP API.
+func errorCode(err error) string {
+	var httpErr dhstore.ErrHttpResponse
+	switch {
+	case errors.As(err, &dhstore.ErrUnsupportedMulticodecCode{}):
+		return dhstore.ErrorCodeUnsupportedCodec
+	case errors.As(err, &dhstore.ErrMultihashDecode{}):
+		return dhstore.ErrorCodeBadMultihash
+	case errors.As(err, &dhstore.ErrInvalidHashedValueKey{}):
+		return dhstore.ErrorCodeBadKey
+	case errors.As(err, &dhstore.ErrValueKeyTooLarge{}):
+		return dhstore.ErrorCodeBadValueLength
+	case errors.As(err, &dhstore.ErrTooManyIterators{}):
+		return dhstore.ErrorCodeOverloaded
+	case errors.As(err, &dhstore.ErrUnavailable{}):
+		return dhstore.ErrorCodeUnavailable
+	case errors.As(err, &dhstore.ErrReadOnly{}):
+		return dhstore.ErrorCodeReadOnly
+	case errors.As(err, &httpErr):
+		if httpErr.Code != "" {
+			return httpErr.Code
+		}
+		return dhstore.ErrorCodeOf(httpErr.Status)
+	}
+	return dhstore.ErrorCodeInternal
+}
+
+func toStatus(err error) error {
+	var code codes.Code
+	var httpErr dhstore.ErrHttpResponse
+	switch {
+	case errors.As(err, &dhstore.ErrUnsupportedMulticodecCode{}),
+		errors.As(err, &dhstore.ErrMultihashDecode{}),
+		errors.As(err, &dhstore.ErrInvalidHashedValueKey{}),
+		errors.As(err, &dhstore.ErrValueKeyTooLarge{}):
+		code = codes.InvalidArgument
+	case errors.As(err, &dhstore.ErrTooManyIterators{}), errors.As(err, &dhstore.ErrUnavailable{}):
+		code = codes.Unavailable
+	case errors.As(err, &dhstore.ErrReadOnly{}):
+		code = codes.PermissionDenied
+	case errors.As(err, &httpErr):
+		code = httpStatusCode(httpErr.Status)
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
+
+func httpStatusCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusMethodNotAllowed:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
@@ -0,0 +1,331 @@
+package grpcserver_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/audit"
+	"github.com/ipni/dhstore/auth"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/grpcserver"
+	"github.com/ipni/dhstore/internal/testutil"
+	"github.com/ipni/dhstore/pb"
+	"github.com/ipni/dhstore/pebble"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newClient serves the given store over gRPC, and returns a client of it.
+func newClient(t *testing.T, store dhstore.DHStore, opts ...grpcserver.Option) pb.DHStoreClient {
+	return dial(t, serve(t, store, opts...), insecure.NewCredentials())
+}
+
+// serve serves the given store over gRPC, and returns the address of the
+// server.
+func serve(t *testing.T, store dhstore.DHStore, opts ...grpcserver.Option) string {
+	s, err := grpcserver.New(store, "", opts...)
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(func() { require.NoError(t, s.Shutdown(context.Background())) })
+	return ln.Addr().String()
+}
+
+// dial returns a client of the server at the given address, connected with
+// the given credentials.
+func dial(t *testing.T, addr string, creds credentials.TransportCredentials) pb.DHStoreClient {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return pb.NewDHStoreClient(conn)
+}
+
+func lookup(ctx context.Context, client pb.DHStoreClient, mh multihash.Multihash) ([][]byte, int, error) {
+	stream, err := client.Lookup(ctx, &pb.LookupRequest{Multihash: mh})
+	if err != nil {
+		return nil, 0, err
+	}
+	var evks [][]byte
+	var messages int
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return evks, messages, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		messages++
+		evks = append(evks, resp.GetEncryptedValueKeys()...)
+	}
+}
+
+func TestServer_RoundTrip(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	client := newClient(t, store, grpcserver.WithLookupBatchSize(2))
+	ctx := context.Background()
+
+	mh := testutil.RandomDblSha256(t)
+	_, err = client.MergeIndexes(ctx, &pb.MergeIndexesRequest{Merges: []*pb.Index{
+		{Key: mh, Value: []byte("fish")},
+		{Key: mh, Value: []byte("lobster")},
+		{Key: mh, Value: []byte("squid")},
+	}})
+	require.NoError(t, err)
+	evks, messages, err := lookup(ctx, client, mh)
+	require.NoError(t, err)
+	require.ElementsMatch(t, [][]byte{[]byte("fish"), []byte("lobster"), []byte("squid")}, evks)
+	require.Equal(t, 2, messages)
+
+	_, err = client.DeleteIndexes(ctx, &pb.DeleteIndexesRequest{Deletes: []*pb.Index{{Key: mh, Value: []byte("lobster")}}})
+	require.NoError(t, err)
+	evks, _, err = lookup(ctx, client, mh)
+	require.NoError(t, err)
+	require.ElementsMatch(t, [][]byte{[]byte("fish"), []byte("squid")}, evks)
+
+	_, _, err = lookup(ctx, client, testutil.RandomDblSha256(t))
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.PutMetadata(ctx, &pb.PutMetadataRequest{Metadata: []*pb.Metadata{
+		{Key: []byte("barreleye"), Value: []byte("anglerfish")},
+		{Key: []byte("cuttlefish"), Value: []byte("squid")},
+	}})
+	require.NoError(t, err)
+	resp, err := client.GetMetadata(ctx, &pb.GetMetadataRequest{Key: []byte("cuttlefish")})
+	require.NoError(t, err)
+	require.Equal(t, []byte("squid"), resp.GetEncryptedMetadata())
+	_, err = client.DeleteMetadata(ctx, &pb.DeleteMetadataRequest{Key: []byte("cuttlefish")})
+	require.NoError(t, err)
+	_, err = client.GetMetadata(ctx, &pb.GetMetadataRequest{Key: []byte("cuttlefish")})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestServer_MapsErrors(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	client := newClient(t, store)
+	ctx := context.Background()
+
+	_, err = client.MergeIndexes(ctx, &pb.MergeIndexesRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.PutMetadata(ctx, &pb.PutMetadataRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	notDblMh, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	_, err = client.MergeIndexes(ctx, &pb.MergeIndexesRequest{Merges: []*pb.Index{{Key: notDblMh, Value: []byte("fish")}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, _, err = lookup(ctx, client, notDblMh)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestServer_MaxValueKeySize(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = grpcserver.New(store, "", grpcserver.WithMaxValueKeySize(-1))
+	require.ErrorContains(t, err, "cannot be negative")
+	client := newClient(t, store, grpcserver.WithMaxValueKeySize(4))
+	ctx := context.Background()
+
+	mh := testutil.RandomDblSha256(t)
+	_, err = client.MergeIndexes(ctx, &pb.MergeIndexesRequest{Merges: []*pb.Index{
+		{Key: mh, Value: []byte("fish")},
+		{Key: mh, Value: []byte("lobster")},
+	}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, _, err = lookup(ctx, client, mh)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestServer_Auth(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	tokens, err := auth.NewTokens(map[auth.Group][]string{auth.GroupWrite: {"indexer"}})
+	require.NoError(t, err)
+	client := newClient(t, store, grpcserver.WithAuth(tokens))
+	ctx := context.Background()
+
+	mh := testutil.RandomDblSha256(t)
+	merge := &pb.MergeIndexesRequest{Merges: []*pb.Index{{Key: mh, Value: []byte("fish")}}}
+	_, err = client.MergeIndexes(ctx, merge)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.MergeIndexes(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer nemo"), merge)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.MergeIndexes(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer indexer"), merge)
+	require.NoError(t, err)
+	_, err = client.MergeIndexes(metadata.AppendToOutgoingContext(ctx, "x-api-key", "indexer"), merge)
+	require.NoError(t, err)
+
+	// Reads are open, since the read group has no tokens.
+	evks, _, err := lookup(ctx, client, mh)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("fish")}, evks)
+}
+
+func TestServer_WriteClientCerts(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = grpcserver.New(store, "", grpcserver.WithWriteClientCAs(x509.NewCertPool()))
+	require.ErrorContains(t, err, "requires TLS")
+
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	clientCert, cas := testutil.NewClientCert(t, "indexer")
+	addr := serve(t, store,
+		grpcserver.WithTLSConfig(&tls.Config{Certificates: ts.TLS.Certificates}),
+		grpcserver.WithWriteClientCAs(cas))
+	roots := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	anonymous := dial(t, addr, credentials.NewTLS(&tls.Config{RootCAs: roots}))
+	authorized := dial(t, addr, credentials.NewTLS(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}))
+	ctx := context.Background()
+
+	mh := testutil.RandomDblSha256(t)
+	merge := &pb.MergeIndexesRequest{Merges: []*pb.Index{{Key: mh, Value: []byte("fish")}}}
+	_, err = anonymous.MergeIndexes(ctx, merge)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = anonymous.DeleteMetadata(ctx, &pb.DeleteMetadataRequest{Key: []byte("fish")})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = authorized.MergeIndexes(ctx, merge)
+	require.NoError(t, err)
+
+	// Reads need no client certificate.
+	evks, _, err := lookup(ctx, anonymous, mh)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("fish")}, evks)
+
+	// Plaintext clients cannot connect at all.
+	_, err = dial(t, addr, insecure.NewCredentials()).MergeIndexes(ctx, merge)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestServer_Authorizers(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = grpcserver.New(store, "", grpcserver.WithAuthorizers(nil))
+	require.ErrorContains(t, err, "authorizer must not be nil")
+
+	var gotPaths []string
+	authorizer := auth.AuthorizerFunc(func(r *http.Request, group auth.Group) auth.Decision {
+		require.Equal(t, auth.GroupWrite, group)
+		gotPaths = append(gotPaths, r.URL.Path)
+		switch r.Header.Get("x-signature") {
+		case "fish":
+			return auth.Decision{Allow: true, Annotations: map[string]string{"subject": "fish"}}
+		case "":
+			return auth.Decision{Status: http.StatusUnauthorized, Reason: "signature required"}
+		default:
+			return auth.Decision{Reason: "invalid signature"}
+		}
+	})
+	var auditLog bytes.Buffer
+	al, err := audit.New(&auditLog)
+	require.NoError(t, err)
+	client := newClient(t, store, grpcserver.WithAuthorizers(authorizer), grpcserver.WithAuditLog(al))
+	ctx := context.Background()
+
+	mh := testutil.RandomDblSha256(t)
+	merge := &pb.MergeIndexesRequest{Merges: []*pb.Index{{Key: mh, Value: []byte("fish")}}}
+	_, err = client.MergeIndexes(ctx, merge)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Equal(t, "signature required", status.Convert(err).Message())
+	_, err = client.MergeIndexes(metadata.AppendToOutgoingContext(ctx, "x-signature", "lobster"), merge)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	require.Equal(t, "invalid signature", status.Convert(err).Message())
+	require.Empty(t, auditLog.String())
+	_, err = client.MergeIndexes(metadata.AppendToOutgoingContext(ctx, "x-signature", "fish"), merge)
+	require.NoError(t, err)
+	require.Equal(t, []string{pb.DHStore_MergeIndexes_FullMethodName, pb.DHStore_MergeIndexes_FullMethodName, pb.DHStore_MergeIndexes_FullMethodName}, gotPaths)
+
+	// Annotations of allowed RPCs are recorded in the audit log.
+	var entry audit.Entry
+	require.NoError(t, json.Unmarshal(auditLog.Bytes(), &entry))
+	require.Equal(t, map[string]string{"subject": "fish"}, entry.Client.Annotations)
+
+	// Reads are not authorized.
+	evks, _, err := lookup(ctx, client, mh)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("fish")}, evks)
+	require.Len(t, gotPaths, 3)
+}
+
+func TestServer_Provenance(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = grpcserver.New(struct{ dhstore.DHStore }{store}, "", grpcserver.WithProvenance("X-Writer", 1))
+	require.EqualError(t, err, "provenance is not supported by store")
+	_, err = grpcserver.New(store, "", grpcserver.WithProvenance("X-Writer", 0))
+	require.ErrorContains(t, err, "sample rate must be at least 1")
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewMock(start)
+	var auditLog bytes.Buffer
+	al, err := audit.New(&auditLog)
+	require.NoError(t, err)
+	client := newClient(t, store, grpcserver.WithClock(clk), grpcserver.WithProvenance("X-Writer", 2), grpcserver.WithAuditLog(al))
+	ctx := context.Background()
+
+	mh1 := testutil.RandomDblSha256(t)
+	mh2 := testutil.RandomDblSha256(t)
+	merge := &pb.MergeIndexesRequest{Merges: []*pb.Index{{Key: mh1, Value: []byte("fish")}, {Key: mh2, Value: []byte("lobster")}}}
+	tagged := metadata.AppendToOutgoingContext(ctx, "x-writer", "indexer-1")
+
+	// Batches without writer tag are neither recorded nor sampled, and only
+	// every second tagged batch is recorded.
+	_, err = client.MergeIndexes(ctx, merge)
+	require.NoError(t, err)
+	_, err = client.MergeIndexes(tagged, merge)
+	require.NoError(t, err)
+	clk.Add(time.Minute)
+	_, err = client.MergeIndexes(tagged, merge)
+	require.NoError(t, err)
+
+	records, err := store.Provenance(start, start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "indexer-1", records[0].Tag)
+	require.Equal(t, start.Add(time.Minute), records[0].Time.UTC())
+	require.Equal(t, 2, records[0].Count)
+	first, last := mh1, mh2
+	if bytes.Compare(first, last) > 0 {
+		first, last = last, first
+	}
+	require.Equal(t, first, records[0].FirstKey)
+	require.Equal(t, last, records[0].LastKey)
+
+	// The writer tag of every batch is recorded in the audit log.
+	var tags []string
+	for dec := json.NewDecoder(&auditLog); dec.More(); {
+		var entry audit.Entry
+		require.NoError(t, dec.Decode(&entry))
+		tags = append(tags, entry.Client.Tag)
+	}
+	require.Equal(t, []string{"", "indexer-1", "indexer-1"}, tags)
+}
@@ -0,0 +1,64 @@
+// Package testutil provides helpers shared by the tests of dhstore packages.
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+// RandomDblSha256 returns a random multihash of the double SHA-256 code that
+// dhstore keys are encoded with, so that tests against persistent stores do
+// not collide with the records of previous runs.
+func RandomDblSha256(t testing.TB) multihash.Multihash {
+	digest := make([]byte, 32)
+	_, err := rand.Read(digest)
+	require.NoError(t, err)
+	mh, err := multihash.Encode(digest, multihash.DBL_SHA2_256)
+	require.NoError(t, err)
+	return mh
+}
+
+// NewClientCert issues a client certificate with the given common name from a
+// throwaway CA, and returns the certificate along with a pool of the CA.
+func NewClientCert(t testing.TB, commonName string) (tls.Certificate, *x509.CertPool) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	clientTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTmpl, caCert, &clientKey.PublicKey, caKey)
+	require.NoError(t, err)
+	cas := x509.NewCertPool()
+	cas.AddCert(caCert)
+	return tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}, cas
+}
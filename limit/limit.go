@@ -0,0 +1,217 @@
+// Package limit bounds the number of requests served concurrently across the
+// dhstore APIs, so that load spikes are shed quickly rather than piling up
+// goroutines waiting on the store until memory is exhausted.
+//
+// Requests beyond the limit wait in a queue for up to a timeout, after which
+// they are rejected with ErrLimited. Requests are rejected without queueing
+// when the wait estimated from the average time slots are held exceeds the
+// timeout, since they would likely time out anyway.
+package limit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/metrics"
+)
+
+// ErrLimited is returned by Acquire when no slot became available within the
+// queue timeout.
+var ErrLimited = errors.New("too many concurrent requests")
+
+const (
+	// minRetryAfter and maxRetryAfter bound the duration returned by
+	// RetryAfter.
+	minRetryAfter = time.Second
+	maxRetryAfter = time.Minute
+	// holdWeight is the weight of the latest hold time in the moving average
+	// of hold times.
+	holdWeight = 0.125
+)
+
+// Limiter hands out a bounded number of slots to concurrent requests.
+type Limiter struct {
+	clock clock.Clock
+
+	mu       sync.Mutex
+	limit    int
+	inFlight int
+	// waiters are the channels of queued requests in arrival order, closed
+	// once a slot is handed to the request.
+	waiters []chan struct{}
+
+	queueTimeout atomic.Int64
+	rejected     atomic.Int64
+	// hold is the exponentially weighted moving average of the time slots
+	// are held for, in nanoseconds.
+	hold atomic.Int64
+}
+
+// New returns a Limiter that lets up to limit requests run concurrently, with
+// excess requests waiting up to queueTimeout for a slot. Excess requests are
+// rejected immediately when queueTimeout is zero.
+func New(limit int, queueTimeout time.Duration, options ...Option) (*Limiter, error) {
+	opts, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+	l := &Limiter{clock: opts.clock}
+	if err := l.SetLimit(limit); err != nil {
+		return nil, err
+	}
+	if err := l.SetQueueTimeout(queueTimeout); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetLimit changes the number of requests let run concurrently. Queued
+// requests are handed the slots added by raising the limit, whereas lowering
+// it takes effect as requests in flight release their slots.
+func (l *Limiter) SetLimit(limit int) error {
+	if limit < 1 {
+		return fmt.Errorf("concurrency limit must be at least 1, got: %d", limit)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.handOff()
+	return nil
+}
+
+// SetQueueTimeout changes how long excess requests wait for a slot, which
+// applies to requests queued from then on.
+func (l *Limiter) SetQueueTimeout(queueTimeout time.Duration) error {
+	if queueTimeout < 0 {
+		return fmt.Errorf("queue timeout must not be negative, got: %s", queueTimeout)
+	}
+	l.queueTimeout.Store(int64(queueTimeout))
+	return nil
+}
+
+// Acquire waits for a slot, and returns a function that releases it once the
+// request is done. It returns ErrLimited if no slot becomes available within
+// the queue timeout, or the context error if ctx is done first.
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	l.mu.Lock()
+	if l.inFlight < l.limit {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.newRelease(), nil
+	}
+	queueTimeout := time.Duration(l.queueTimeout.Load())
+	if queueTimeout == 0 || l.estimateWait() > queueTimeout {
+		l.mu.Unlock()
+		l.rejected.Add(1)
+		return nil, ErrLimited
+	}
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	l.mu.Unlock()
+
+	timer := l.clock.NewTimer(queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return l.newRelease(), nil
+	case <-timer.C():
+		err = ErrLimited
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if !l.dequeue(ready) {
+		// The slot was handed to the request as it gave up waiting.
+		return l.newRelease(), nil
+	}
+	if err == ErrLimited {
+		l.rejected.Add(1)
+	}
+	return nil, err
+}
+
+// dequeue removes the given waiter from the queue, and reports whether it was
+// still queued.
+func (l *Limiter) dequeue(ready chan struct{}) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range l.waiters {
+		if w == ready {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// handOff hands free slots to queued requests in arrival order. It must be
+// called with mu held.
+func (l *Limiter) handOff() {
+	for l.inFlight < l.limit && len(l.waiters) != 0 {
+		l.inFlight++
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+	}
+}
+
+// newRelease returns a function that releases an acquired slot, and records
+// how long it was held for.
+func (l *Limiter) newRelease() func() {
+	start := l.clock.Now()
+	return func() {
+		l.observeHold(l.clock.Since(start))
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.inFlight--
+		l.handOff()
+	}
+}
+
+func (l *Limiter) observeHold(d time.Duration) {
+	for {
+		old := l.hold.Load()
+		updated := int64(d)
+		if old != 0 {
+			updated = old + int64(holdWeight*float64(int64(d)-old))
+		}
+		if l.hold.CompareAndSwap(old, updated) {
+			return
+		}
+	}
+}
+
+// estimateWait returns the estimated time a newly queued request waits for a
+// slot, assuming that slots are held for the average hold time. It must be
+// called with mu held.
+func (l *Limiter) estimateWait() time.Duration {
+	return time.Duration(l.hold.Load() * int64(len(l.waiters)+1) / int64(l.limit))
+}
+
+// RetryAfter returns how long rejected requests should wait before retrying,
+// estimated from the number of queued requests and the average hold time.
+// It is rounded up to whole seconds and bounded to between one second and a
+// minute.
+func (l *Limiter) RetryAfter() time.Duration {
+	l.mu.Lock()
+	wait := l.estimateWait()
+	l.mu.Unlock()
+	wait = (wait + time.Second - 1).Truncate(time.Second)
+	return min(max(wait, minRetryAfter), maxRetryAfter)
+}
+
+// Metrics returns a snapshot of the limiter metrics.
+func (l *Limiter) Metrics() *metrics.LimiterMetrics {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &metrics.LimiterMetrics{
+		Limit:    int64(l.limit),
+		InFlight: int64(l.inFlight),
+		Queued:   int64(len(l.waiters)),
+		Rejected: l.rejected.Load(),
+	}
+}
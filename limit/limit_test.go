@@ -0,0 +1,151 @@
+package limit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/limit"
+	"github.com/ipni/dhstore/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	_, err := limit.New(0, time.Second)
+	require.ErrorContains(t, err, "at least 1")
+	_, err = limit.New(1, -time.Second)
+	require.ErrorContains(t, err, "negative")
+}
+
+func TestLimiter_RejectsImmediatelyWithoutQueue(t *testing.T) {
+	subject, err := limit.New(2, 0)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	release1, err := subject.Acquire(ctx)
+	require.NoError(t, err)
+	release2, err := subject.Acquire(ctx)
+	require.NoError(t, err)
+	_, err = subject.Acquire(ctx)
+	require.ErrorIs(t, err, limit.ErrLimited)
+	require.Equal(t, &metrics.LimiterMetrics{Limit: 2, InFlight: 2, Rejected: 1}, subject.Metrics())
+
+	release1()
+	release3, err := subject.Acquire(ctx)
+	require.NoError(t, err)
+	release2()
+	release3()
+	require.Equal(t, &metrics.LimiterMetrics{Limit: 2, Rejected: 1}, subject.Metrics())
+}
+
+func TestLimiter_Queues(t *testing.T) {
+	subject, err := limit.New(1, time.Minute)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	release, err := subject.Acquire(ctx)
+	require.NoError(t, err)
+
+	acquired := make(chan error, 1)
+	go func() {
+		release, err := subject.Acquire(ctx)
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	require.Eventually(t, func() bool { return subject.Metrics().Queued == 1 }, time.Second, time.Millisecond)
+	release()
+	require.NoError(t, <-acquired)
+
+	// Waiting is cut short by the context.
+	release, err = subject.Acquire(ctx)
+	require.NoError(t, err)
+	defer release()
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = subject.Acquire(cctx)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Zero(t, subject.Metrics().Rejected)
+}
+
+func TestLimiter_QueueTimeout(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1_000, 0))
+	subject, err := limit.New(1, 10*time.Millisecond, limit.WithClock(clk))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	release, err := subject.Acquire(ctx)
+	require.NoError(t, err)
+	defer release()
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := subject.Acquire(ctx)
+		acquired <- err
+	}()
+	require.Eventually(t, func() bool { return subject.Metrics().Queued == 1 }, time.Second, time.Millisecond)
+	clk.Add(10 * time.Millisecond)
+	require.ErrorIs(t, <-acquired, limit.ErrLimited)
+	require.Equal(t, int64(1), subject.Metrics().Rejected)
+}
+
+func TestLimiter_ShedsWhenEstimatedWaitExceedsQueueTimeout(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1_000, 0))
+	subject, err := limit.New(1, 20*time.Millisecond, limit.WithClock(clk))
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.Equal(t, time.Second, subject.RetryAfter())
+
+	// Slots held for longer than the queue timeout.
+	release, err := subject.Acquire(ctx)
+	require.NoError(t, err)
+	clk.Add(50 * time.Millisecond)
+	release()
+
+	// Shed without queueing, i.e. without waiting for the clock to advance.
+	release, err = subject.Acquire(ctx)
+	require.NoError(t, err)
+	defer release()
+	_, err = subject.Acquire(ctx)
+	require.ErrorIs(t, err, limit.ErrLimited)
+	require.Zero(t, subject.Metrics().Queued)
+	require.Equal(t, int64(1), subject.Metrics().Rejected)
+	require.Equal(t, time.Second, subject.RetryAfter())
+}
+
+func TestLimiter_SetLimit(t *testing.T) {
+	subject, err := limit.New(1, time.Minute)
+	require.NoError(t, err)
+	require.ErrorContains(t, subject.SetLimit(0), "at least 1")
+	require.ErrorContains(t, subject.SetQueueTimeout(-time.Second), "negative")
+	ctx := context.Background()
+
+	release1, err := subject.Acquire(ctx)
+	require.NoError(t, err)
+	acquired := make(chan func(), 1)
+	go func() {
+		release, err := subject.Acquire(ctx)
+		if err == nil {
+			acquired <- release
+		}
+	}()
+	require.Eventually(t, func() bool { return subject.Metrics().Queued == 1 }, time.Second, time.Millisecond)
+
+	// Raising the limit hands the added slot to the queued request.
+	require.NoError(t, subject.SetLimit(2))
+	release2 := <-acquired
+	require.Equal(t, &metrics.LimiterMetrics{Limit: 2, InFlight: 2}, subject.Metrics())
+
+	// Lowering the limit takes effect as slots are released.
+	require.NoError(t, subject.SetLimit(1))
+	require.NoError(t, subject.SetQueueTimeout(0))
+	release1()
+	_, err = subject.Acquire(ctx)
+	require.ErrorIs(t, err, limit.ErrLimited)
+	release2()
+	release3, err := subject.Acquire(ctx)
+	require.NoError(t, err)
+	release3()
+	require.Equal(t, &metrics.LimiterMetrics{Limit: 1, Rejected: 1}, subject.Metrics())
+}
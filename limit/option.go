@@ -0,0 +1,37 @@
+package limit
+
+import (
+	"fmt"
+
+	"github.com/ipni/dhstore/clock"
+)
+
+// config contains all options for the limiter.
+type config struct {
+	clock clock.Clock
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	cfg := config{
+		clock: clock.New(),
+	}
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d error: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithClock sets the clock used to time out queued requests and to measure how
+// long slots are held. Defaults to the system clock.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) error {
+		cfg.clock = c
+		return nil
+	}
+}
@@ -0,0 +1,181 @@
+package load
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipni/dhstore"
+)
+
+// BinaryMagic starts every stream of records in the binary format, which
+// identifies the format and its version.
+//
+// The binary format is a compact alternative to newline delimited JSON that
+// avoids the base64 encoding and parsing of JSON. Following the magic, each
+// record is a kind byte followed by varint length-prefixed sections:
+//
+//   - Index records: the multihash, a varint count of encrypted value keys,
+//     and the keys.
+//   - Metadata records: the hashed value key, or the store specific metadata
+//     key, and the encrypted metadata.
+//
+// Record cursors are not encoded.
+const BinaryMagic = "dhsrec\x00\x01"
+
+const (
+	binaryKindIndex       byte = 1
+	binaryKindMetadata    byte = 2
+	binaryKindMetadataKey byte = 3
+
+	// maxBinarySectionLen bounds the length of decoded sections, so that a
+	// corrupt length cannot exhaust memory.
+	maxBinarySectionLen = 16 << 20
+)
+
+var errInvalidBinaryRecord = errors.New("invalid binary record")
+
+// BinaryWriter writes records in the binary format.
+type BinaryWriter struct {
+	w       *bufio.Writer
+	started bool
+	buf     [binary.MaxVarintLen64]byte
+}
+
+// NewBinaryWriter returns a writer of records in the binary format to w.
+func NewBinaryWriter(w io.Writer) *BinaryWriter {
+	return &BinaryWriter{w: bufio.NewWriter(w)}
+}
+
+// Write writes the given record, preceded by BinaryMagic if it is the first.
+func (bw *BinaryWriter) Write(record dhstore.ExportRecord) error {
+	if !bw.started {
+		if _, err := bw.w.WriteString(BinaryMagic); err != nil {
+			return err
+		}
+		bw.started = true
+	}
+	switch {
+	case record.Multihash != nil:
+		_ = bw.w.WriteByte(binaryKindIndex)
+		bw.writeSection(record.Multihash)
+		bw.writeUvarint(uint64(len(record.EncryptedValueKeys)))
+		for _, evk := range record.EncryptedValueKeys {
+			bw.writeSection(evk)
+		}
+	case record.HashedValueKey != nil:
+		_ = bw.w.WriteByte(binaryKindMetadata)
+		bw.writeSection(record.HashedValueKey)
+		bw.writeSection(record.EncryptedMetadata)
+	case record.MetadataKey != nil:
+		_ = bw.w.WriteByte(binaryKindMetadataKey)
+		bw.writeSection(record.MetadataKey)
+		bw.writeSection(record.EncryptedMetadata)
+	default:
+		return fmt.Errorf("%w: record has no key", errInvalidBinaryRecord)
+	}
+	// Errors are sticky, and so are reported by the last write.
+	_, err := bw.w.Write(nil)
+	return err
+}
+
+// Flush writes any buffered records to the underlying writer, including
+// BinaryMagic if no records were written.
+func (bw *BinaryWriter) Flush() error {
+	if !bw.started {
+		if _, err := bw.w.WriteString(BinaryMagic); err != nil {
+			return err
+		}
+		bw.started = true
+	}
+	return bw.w.Flush()
+}
+
+func (bw *BinaryWriter) writeUvarint(v uint64) {
+	n := binary.PutUvarint(bw.buf[:], v)
+	_, _ = bw.w.Write(bw.buf[:n])
+}
+
+func (bw *BinaryWriter) writeSection(b []byte) {
+	bw.writeUvarint(uint64(len(b)))
+	_, _ = bw.w.Write(b)
+}
+
+// binaryReader reads records in the binary format, following BinaryMagic.
+type binaryReader struct {
+	r *bufio.Reader
+}
+
+// next returns the next record, or io.EOF if there are no more records.
+func (br *binaryReader) next() (dhstore.ExportRecord, error) {
+	var record dhstore.ExportRecord
+	kind, err := br.r.ReadByte()
+	if err != nil {
+		return record, err
+	}
+	switch kind {
+	case binaryKindIndex:
+		if record.Multihash, err = br.readSection(); err != nil {
+			return record, err
+		}
+		count, err := br.readUvarint()
+		if err != nil {
+			return record, err
+		}
+		if count > maxBinarySectionLen {
+			return record, fmt.Errorf("%w: too many encrypted value keys: %d", errInvalidBinaryRecord, count)
+		}
+		record.EncryptedValueKeys = make([]dhstore.EncryptedValueKey, 0, count)
+		for i := uint64(0); i < count; i++ {
+			evk, err := br.readSection()
+			if err != nil {
+				return record, err
+			}
+			record.EncryptedValueKeys = append(record.EncryptedValueKeys, evk)
+		}
+	case binaryKindMetadata, binaryKindMetadataKey:
+		key, err := br.readSection()
+		if err != nil {
+			return record, err
+		}
+		if kind == binaryKindMetadata {
+			record.HashedValueKey = key
+		} else {
+			record.MetadataKey = key
+		}
+		if record.EncryptedMetadata, err = br.readSection(); err != nil {
+			return record, err
+		}
+	default:
+		return record, fmt.Errorf("%w: unknown kind: %d", errInvalidBinaryRecord, kind)
+	}
+	return record, nil
+}
+
+func (br *binaryReader) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(br.r)
+	if errors.Is(err, io.EOF) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (br *binaryReader) readSection() ([]byte, error) {
+	n, err := br.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > maxBinarySectionLen {
+		return nil, fmt.Errorf("%w: section too long: %d", errInvalidBinaryRecord, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br.r, b); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
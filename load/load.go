@@ -0,0 +1,307 @@
+// Package load bulk loads records exported by dhstore into a store, for
+// example to seed a new replica.
+//
+// Records are read from any number of input shards concurrently, and are
+// partitioned by digest range across parallel workers. Each worker imports its
+// records in bounded batches, backing off whenever the store reports that it
+// is close to stalling writes.
+package load
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/clock"
+	"github.com/multiformats/go-multihash"
+)
+
+var log = logging.Logger("load")
+
+type (
+	// Loader loads exported records into a store.
+	Loader struct {
+		store    dhstore.Importer
+		ingester dhstore.Ingester
+		pressure dhstore.WritePressureReporter
+		clock    clock.Clock
+
+		workers           int
+		batchSize         int
+		maxBatchBytes     int
+		queueSize         int
+		pressureThreshold float64
+		pressureBackoff   time.Duration
+		maxValueKeySize   int
+		onBatch           func([]dhstore.ExportRecord, error)
+	}
+	// Stats summarises a load.
+	Stats struct {
+		// Records is the number of imported records.
+		Records int64
+		// Batches is the number of imported batches.
+		Batches int64
+		// Throttled is the total time workers spent backing off due to
+		// write pressure.
+		Throttled time.Duration
+	}
+	// ErrDecode signals that the records of a shard cannot be decoded, as
+	// opposed to errors of the store they are imported into.
+	ErrDecode struct {
+		Shard int
+		Err   error
+	}
+)
+
+func (e ErrDecode) Error() string {
+	return fmt.Sprintf("shard %d: %s", e.Shard, e.Err.Error())
+}
+
+func (e ErrDecode) Unwrap() error {
+	return e.Err
+}
+
+// New instantiates a new Loader that imports records into the given store.
+func New(store dhstore.Importer, options ...Option) (*Loader, error) {
+	opts, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+	l := &Loader{
+		store:             store,
+		clock:             opts.clock,
+		workers:           opts.workers,
+		batchSize:         opts.batchSize,
+		maxBatchBytes:     opts.maxBatchBytes,
+		queueSize:         opts.queueSize,
+		pressureThreshold: opts.pressureThreshold,
+		pressureBackoff:   opts.pressureBackoff,
+		maxValueKeySize:   opts.maxValueKeySize,
+		onBatch:           opts.onBatch,
+	}
+	if opts.ingest {
+		if l.ingester, _ = store.(dhstore.Ingester); l.ingester == nil {
+			log.Warn("Ingestion is not supported by store; importing instead")
+		}
+	}
+	if opts.pressureThreshold != 0 {
+		l.pressure, _ = store.(dhstore.WritePressureReporter)
+	}
+	return l, nil
+}
+
+// Load imports the records read from the given shards, as produced by the
+// export API. Each shard is either newline delimited JSON or in the binary
+// format, which is detected by its leading BinaryMagic. Load returns once all shards are fully read
+// and imported, or at the first error.
+func (l *Loader) Load(ctx context.Context, shards ...io.Reader) (Stats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		errOnce  sync.Once
+		firstErr error
+		records  atomic.Int64
+		batches  atomic.Int64
+		throttle atomic.Int64
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	queues := make([]chan dhstore.ExportRecord, l.workers)
+	var workers sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan dhstore.ExportRecord, l.queueSize)
+		workers.Add(1)
+		go func(queue <-chan dhstore.ExportRecord) {
+			defer workers.Done()
+			w := worker{Loader: l, records: &records, batches: &batches, throttle: &throttle}
+			if err := w.run(ctx, queue); err != nil {
+				fail(err)
+			}
+		}(queues[i])
+	}
+
+	var readers sync.WaitGroup
+	for i, shard := range shards {
+		readers.Add(1)
+		go func(i int, shard io.Reader) {
+			defer readers.Done()
+			if err := l.read(ctx, i, shard, queues); err != nil {
+				fail(err)
+			}
+		}(i, shard)
+	}
+	readers.Wait()
+	for _, queue := range queues {
+		close(queue)
+	}
+	workers.Wait()
+
+	stats := Stats{
+		Records:   records.Load(),
+		Batches:   batches.Load(),
+		Throttled: time.Duration(throttle.Load()),
+	}
+	if firstErr != nil {
+		return stats, firstErr
+	}
+	return stats, ctx.Err()
+}
+
+// read decodes the records of the i-th shard and routes each to the worker of
+// its digest range.
+func (l *Loader) read(ctx context.Context, i int, shard io.Reader, queues []chan dhstore.ExportRecord) error {
+	br := bufio.NewReader(shard)
+	next := newJSONDecoder(br)
+	if magic, _ := br.Peek(len(BinaryMagic)); string(magic) == BinaryMagic {
+		_, _ = br.Discard(len(BinaryMagic))
+		next = (&binaryReader{r: br}).next
+	}
+	for {
+		record, err := next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return ErrDecode{Shard: i, Err: err}
+		}
+		select {
+		case queues[partition(record, len(queues))] <- record:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// newJSONDecoder returns a function that decodes the next newline delimited
+// JSON record read from r.
+func newJSONDecoder(r io.Reader) func() (dhstore.ExportRecord, error) {
+	dec := json.NewDecoder(r)
+	return func() (dhstore.ExportRecord, error) {
+		var record dhstore.ExportRecord
+		err := dec.Decode(&record)
+		return record, err
+	}
+}
+
+// partition returns the index of the digest range, out of n equal ranges,
+// that the given record belongs to.
+func partition(record dhstore.ExportRecord, n int) int {
+	var digest []byte
+	switch {
+	case record.Multihash != nil:
+		digest = record.Multihash
+		if dmh, err := multihash.Decode(record.Multihash); err == nil {
+			digest = dmh.Digest
+		}
+	case record.HashedValueKey != nil:
+		digest = record.HashedValueKey
+		if dmh, err := multihash.Decode(record.HashedValueKey); err == nil {
+			digest = dmh.Digest
+		}
+	default:
+		digest = record.MetadataKey
+	}
+	if len(digest) == 0 {
+		return 0
+	}
+	return int(digest[0]) * n / 256
+}
+
+type worker struct {
+	*Loader
+	records  *atomic.Int64
+	batches  *atomic.Int64
+	throttle *atomic.Int64
+
+	batch      []dhstore.ExportRecord
+	batchBytes int
+}
+
+func (w *worker) run(ctx context.Context, queue <-chan dhstore.ExportRecord) error {
+	for record := range queue {
+		w.batch = append(w.batch, record)
+		w.batchBytes += recordSize(record)
+		if len(w.batch) >= w.batchSize || w.batchBytes >= w.maxBatchBytes {
+			if err := w.flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	// Queue is closed either because all shards are read or because the
+	// load has failed, in which case the remaining records are discarded.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return w.flush(ctx)
+}
+
+func (w *worker) flush(ctx context.Context) error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := w.awaitPressure(ctx); err != nil {
+		return err
+	}
+	err := dhstore.CheckRecordValueKeySizes(w.batch, w.maxValueKeySize)
+	if err == nil {
+		if w.ingester != nil {
+			err = w.ingester.Ingest(w.batch)
+		} else {
+			err = w.store.Import(w.batch)
+		}
+	}
+	if w.onBatch != nil {
+		w.onBatch(w.batch, err)
+	}
+	if err != nil {
+		return err
+	}
+	w.records.Add(int64(len(w.batch)))
+	w.batches.Add(1)
+	w.batch = w.batch[:0]
+	w.batchBytes = 0
+	return nil
+}
+
+// awaitPressure blocks while the store write pressure is at or above the
+// threshold.
+func (w *worker) awaitPressure(ctx context.Context) error {
+	if w.pressure == nil {
+		return nil
+	}
+	for w.pressure.WritePressure() >= w.pressureThreshold {
+		log.Debugw("Backing off due to write pressure", "backoff", w.pressureBackoff)
+		select {
+		case <-w.clock.After(w.pressureBackoff):
+			w.throttle.Add(int64(w.pressureBackoff))
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func recordSize(record dhstore.ExportRecord) int {
+	size := len(record.Multihash) + len(record.HashedValueKey) + len(record.MetadataKey) + len(record.EncryptedMetadata)
+	for _, evk := range record.EncryptedValueKeys {
+		size += len(evk)
+	}
+	return size
+}
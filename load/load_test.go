@@ -0,0 +1,169 @@
+package load_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/load"
+	"github.com/ipni/dhstore/pebble"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoader_LoadsShardsInParallel(t *testing.T) {
+	t.Run("import", func(t *testing.T) { testLoadShardsInParallel(t, false, false) })
+	t.Run("ingest", func(t *testing.T) { testLoadShardsInParallel(t, true, false) })
+	t.Run("binary", func(t *testing.T) { testLoadShardsInParallel(t, false, true) })
+}
+
+func testLoadShardsInParallel(t *testing.T, ingest, binary bool) {
+	source, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer source.Close()
+
+	for i := 0; i < 500; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprint("fish-", i)), multihash.DBL_SHA2_256, -1)
+		require.NoError(t, err)
+		require.NoError(t, source.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte{byte(i)}}}))
+	}
+	require.NoError(t, source.PutMetadata([]byte("lobster"), []byte("barreleye")))
+
+	ctx := context.Background()
+	// Export two shards by digest range.
+	var shards []io.Reader
+	for _, r := range [][2][]byte{{nil, {0x80}}, {{0x80}, nil}} {
+		var shard bytes.Buffer
+		write := json.NewEncoder(&shard).Encode
+		bw := load.NewBinaryWriter(&shard)
+		if binary {
+			write = func(v any) error { return bw.Write(v.(dhstore.ExportRecord)) }
+		}
+		require.NoError(t, source.Export(ctx, dhstore.ExportOptions{Start: r[0], End: r[1]}, func(record dhstore.ExportRecord) error {
+			return write(record)
+		}))
+		if binary {
+			require.NoError(t, bw.Flush())
+		}
+		shards = append(shards, &shard)
+	}
+
+	target, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer target.Close()
+
+	subject, err := load.New(target, load.WithWorkers(4), load.WithBatchSize(16, 1<<20), load.WithIngest(ingest))
+	require.NoError(t, err)
+	stats, err := subject.Load(ctx, shards...)
+	require.NoError(t, err)
+	require.Equal(t, int64(501), stats.Records)
+	require.Greater(t, stats.Batches, int64(4))
+
+	exportAll := func(s dhstore.Exporter) []dhstore.ExportRecord {
+		var records []dhstore.ExportRecord
+		require.NoError(t, s.Export(ctx, dhstore.ExportOptions{}, func(record dhstore.ExportRecord) error {
+			records = append(records, record)
+			return nil
+		}))
+		return records
+	}
+	require.Equal(t, exportAll(source), exportAll(target))
+
+	md, err := target.GetMetadata([]byte("lobster"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("barreleye"), md)
+}
+
+type pressuredImporter struct {
+	mu       sync.Mutex
+	imported []dhstore.ExportRecord
+	pressure atomic.Int32
+}
+
+func (p *pressuredImporter) Import(records []dhstore.ExportRecord) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.imported = append(p.imported, records...)
+	return nil
+}
+
+// WritePressure reports full pressure for the first few calls.
+func (p *pressuredImporter) WritePressure() float64 {
+	if p.pressure.Add(1) <= 3 {
+		return 1
+	}
+	return 0
+}
+
+func TestLoader_BacksOffUnderWritePressure(t *testing.T) {
+	var store pressuredImporter
+	subject, err := load.New(&store, load.WithWorkers(1), load.WithWritePressure(0.5, time.Millisecond))
+	require.NoError(t, err)
+
+	shard := strings.NewReader(`{"mdk":"AQI=","md":"ZmlzaA=="}` + "\n")
+	stats, err := subject.Load(context.Background(), shard)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stats.Records)
+	require.Equal(t, 3*time.Millisecond, stats.Throttled)
+	require.Len(t, store.imported, 1)
+	require.Equal(t, dhstore.EncryptedMetadata("fish"), store.imported[0].EncryptedMetadata)
+}
+
+func TestLoader_FailsOnInvalidShard(t *testing.T) {
+	var store pressuredImporter
+	subject, err := load.New(&store)
+	require.NoError(t, err)
+	_, err = subject.Load(context.Background(), strings.NewReader(`{"mdk":"AQI=","md":"ZmlzaA=="}`+"\n"), strings.NewReader("not json"))
+	var decodeErr load.ErrDecode
+	require.ErrorAs(t, err, &decodeErr)
+	require.Equal(t, 1, decodeErr.Shard)
+	require.ErrorContains(t, err, "shard 1")
+}
+
+func TestLoader_FailsOnTruncatedBinaryShard(t *testing.T) {
+	var shard bytes.Buffer
+	bw := load.NewBinaryWriter(&shard)
+	require.NoError(t, bw.Write(dhstore.ExportRecord{MetadataKey: []byte{1, 2}, EncryptedMetadata: []byte("fish")}))
+	require.NoError(t, bw.Flush())
+
+	var store pressuredImporter
+	subject, err := load.New(&store)
+	require.NoError(t, err)
+	stats, err := subject.Load(context.Background(), bytes.NewReader(shard.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stats.Records)
+
+	_, err = subject.Load(context.Background(), bytes.NewReader(shard.Bytes()[:shard.Len()-1]))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestLoader_FailsOnOversizedValueKey(t *testing.T) {
+	var shard bytes.Buffer
+	bw := load.NewBinaryWriter(&shard)
+	require.NoError(t, bw.Write(dhstore.ExportRecord{
+		Multihash:          []byte{1, 2},
+		EncryptedValueKeys: []dhstore.EncryptedValueKey{[]byte("fish"), []byte("barreleye")},
+	}))
+	require.NoError(t, bw.Flush())
+
+	var store pressuredImporter
+	subject, err := load.New(&store, load.WithMaxValueKeySize(8))
+	require.NoError(t, err)
+	_, err = subject.Load(context.Background(), bytes.NewReader(shard.Bytes()))
+	require.ErrorAs(t, err, &dhstore.ErrValueKeyTooLarge{})
+	require.Empty(t, store.imported)
+
+	subject, err = load.New(&store, load.WithMaxValueKeySize(9))
+	require.NoError(t, err)
+	stats, err := subject.Load(context.Background(), bytes.NewReader(shard.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stats.Records)
+}
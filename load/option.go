@@ -0,0 +1,157 @@
+package load
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/clock"
+)
+
+const (
+	defaultBatchSize         = 4096
+	defaultMaxBatchBytes     = 16 << 20 // 16 MiB
+	defaultQueueSize         = 1024
+	defaultPressureThreshold = 0.8
+	defaultPressureBackoff   = 100 * time.Millisecond
+)
+
+// config contains all options for the loader.
+type config struct {
+	clock             clock.Clock
+	workers           int
+	batchSize         int
+	maxBatchBytes     int
+	queueSize         int
+	pressureThreshold float64
+	pressureBackoff   time.Duration
+	ingest            bool
+	maxValueKeySize   int
+	onBatch           func([]dhstore.ExportRecord, error)
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	cfg := config{
+		clock:             clock.New(),
+		workers:           runtime.NumCPU(),
+		batchSize:         defaultBatchSize,
+		maxBatchBytes:     defaultMaxBatchBytes,
+		queueSize:         defaultQueueSize,
+		pressureThreshold: defaultPressureThreshold,
+		pressureBackoff:   defaultPressureBackoff,
+	}
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d error: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithClock sets the clock used to back off under write pressure. Defaults
+// to the system clock.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) error {
+		cfg.clock = c
+		return nil
+	}
+}
+
+// WithWorkers sets the number of parallel workers, each of which loads a
+// distinct range of digests. Defaults to the number of CPUs.
+func WithWorkers(n int) Option {
+	return func(cfg *config) error {
+		if n < 1 || n > 256 {
+			return fmt.Errorf("workers must be between 1 and 256, got: %d", n)
+		}
+		cfg.workers = n
+		return nil
+	}
+}
+
+// WithBatchSize sets the maximum number of records and the maximum total size
+// in bytes of the records imported in a single batch by each worker. Defaults
+// to 4096 records and 16 MiB.
+func WithBatchSize(records, maxBytes int) Option {
+	return func(cfg *config) error {
+		if records < 1 {
+			return fmt.Errorf("batch size must be at least 1, got: %d", records)
+		}
+		if maxBytes < 1 {
+			return fmt.Errorf("max batch bytes must be at least 1, got: %d", maxBytes)
+		}
+		cfg.batchSize = records
+		cfg.maxBatchBytes = maxBytes
+		return nil
+	}
+}
+
+// WithQueueSize sets the number of records queued for each worker, which
+// bounds the memory used by records read from shards but not yet imported.
+// Defaults to 1024.
+func WithQueueSize(n int) Option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return fmt.Errorf("queue size must not be negative, got: %d", n)
+		}
+		cfg.queueSize = n
+		return nil
+	}
+}
+
+// WithWritePressure sets the store write pressure, between 0 and 1, at or
+// above which workers back off for the given duration before importing the
+// next batch. Only applies to stores that report write pressure. Zero
+// threshold disables backing off. Defaults to 0.8 and 100ms.
+func WithWritePressure(threshold float64, backoff time.Duration) Option {
+	return func(cfg *config) error {
+		if threshold < 0 || threshold > 1 {
+			return fmt.Errorf("write pressure threshold must be between 0 and 1, got: %f", threshold)
+		}
+		if backoff <= 0 {
+			return fmt.Errorf("write pressure backoff must be positive, got: %s", backoff)
+		}
+		cfg.pressureThreshold = threshold
+		cfg.pressureBackoff = backoff
+		return nil
+	}
+}
+
+// WithIngest sets whether batches are ingested rather than imported, when the
+// store supports it. Ingestion bypasses the regular write path of the store,
+// which is faster for large batches. Defaults to false.
+func WithIngest(ingest bool) Option {
+	return func(cfg *config) error {
+		cfg.ingest = ingest
+		return nil
+	}
+}
+
+// WithOnBatch sets a function called with every batch once it is imported, or
+// has failed to import with the given error, e.g. to audit imports. It is
+// called concurrently by workers, and must not retain the batch.
+func WithOnBatch(f func(batch []dhstore.ExportRecord, err error)) Option {
+	return func(cfg *config) error {
+		cfg.onBatch = f
+		return nil
+	}
+}
+
+// WithMaxValueKeySize sets the maximum size in bytes of the encrypted value
+// keys of loaded records, beyond which the load fails with
+// dhstore.ErrValueKeyTooLarge before the batch holding them is imported, as
+// merges do. Sizes are unbounded when zero, which is the default.
+func WithMaxValueKeySize(n int) Option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return fmt.Errorf("max value key size must not be negative, got: %d", n)
+		}
+		cfg.maxValueKeySize = n
+		return nil
+	}
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"context"
+
+	cmetric "go.opentelemetry.io/otel/metric"
+)
+
+// DiskUsageMetrics is a snapshot of the disk usage of a store.
+type DiskUsageMetrics struct {
+	// Size is the estimated size of the store on disk in bytes.
+	Size int64
+	// VolumeAvailable is the number of bytes available to the store on the
+	// volume it is stored on.
+	VolumeAvailable int64
+	// VolumeTotal is the size of the volume the store is stored on in bytes.
+	VolumeTotal int64
+}
+
+// diskUsageMetrics asynchronously reports the disk usage of a store, so that
+// capacity exhaustion is visible before writes start failing.
+type diskUsageMetrics struct {
+	metricsProvider func() *DiskUsageMetrics
+	meter           cmetric.Meter
+	health          *health
+
+	// size reports the estimated size of the store on disk.
+	size cmetric.Int64ObservableGauge
+	// volumeAvailable reports the bytes available on the store volume.
+	volumeAvailable cmetric.Int64ObservableGauge
+	// volumeTotal reports the size of the store volume.
+	volumeTotal cmetric.Int64ObservableGauge
+}
+
+func (dm *diskUsageMetrics) start() error {
+	var err error
+
+	if dm.size, err = dm.meter.Int64ObservableGauge(
+		"ipni_dhstore_store_size",
+		cmetric.WithUnit("By"),
+		cmetric.WithDescription("The estimated size of the store on disk in bytes."),
+	); err != nil {
+		return err
+	}
+
+	if dm.volumeAvailable, err = dm.meter.Int64ObservableGauge(
+		"ipni_dhstore_store_volume_available",
+		cmetric.WithUnit("By"),
+		cmetric.WithDescription("The number of bytes available to the store on the volume it is stored on."),
+	); err != nil {
+		return err
+	}
+
+	if dm.volumeTotal, err = dm.meter.Int64ObservableGauge(
+		"ipni_dhstore_store_volume_total",
+		cmetric.WithUnit("By"),
+		cmetric.WithDescription("The size of the volume the store is stored on in bytes."),
+	); err != nil {
+		return err
+	}
+
+	_, err = dm.meter.RegisterCallback(
+		dm.health.guard("disk_usage", dm.reportAsyncMetrics),
+		dm.size,
+		dm.volumeAvailable,
+		dm.volumeTotal,
+	)
+	return err
+}
+
+func (dm *diskUsageMetrics) reportAsyncMetrics(_ context.Context, o cmetric.Observer) error {
+	m := dm.metricsProvider()
+	if m == nil {
+		// Disk usage is unknown, e.g. because it could not be read; report
+		// nothing rather than misleading zeros.
+		return nil
+	}
+
+	o.ObserveInt64(dm.size, m.Size)
+	o.ObserveInt64(dm.volumeAvailable, m.VolumeAvailable)
+	o.ObserveInt64(dm.volumeTotal, m.VolumeTotal)
+	return nil
+}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	cmetric "go.opentelemetry.io/otel/metric"
+)
+
+// FDBMetrics is a snapshot of FoundationDB client metrics.
+type FDBMetrics struct {
+	// Commits is the total number of committed transactions.
+	Commits int64
+	// Conflicts is the total number of transaction attempts that failed due
+	// to a conflict.
+	Conflicts int64
+	// Retries is the total number of retried transaction attempts.
+	Retries int64
+	// Failures is the total number of transactions that failed after
+	// exhausting their retries, or with a non-retryable error.
+	Failures int64
+	// GRVLatency is the latency of the last get read version probe.
+	GRVLatency time.Duration
+	// ReadLatency is the latency of the last read probe.
+	ReadLatency time.Duration
+	// CommitLatency is the latency of the last commit probe.
+	CommitLatency time.Duration
+	// Available is whether the last health check succeeded.
+	Available bool
+	// HealthCheckFailures is the total number of failed health checks.
+	HealthCheckFailures int64
+}
+
+// fdbMetrics asynchronously reports metrics of the FoundationDB client.
+type fdbMetrics struct {
+	metricsProvider func() *FDBMetrics
+	meter           cmetric.Meter
+	health          *health
+
+	// commits reports the total number of committed transactions.
+	commits cmetric.Int64ObservableCounter
+	// conflicts reports the total number of transaction attempts that failed
+	// due to a conflict.
+	conflicts cmetric.Int64ObservableCounter
+	// retries reports the total number of retried transaction attempts.
+	retries cmetric.Int64ObservableCounter
+	// failures reports the total number of failed transactions.
+	failures cmetric.Int64ObservableCounter
+	// probeLatency reports the latency of the last client probe, tagged by
+	// probe operation; one of grv, read or commit.
+	probeLatency cmetric.Int64ObservableGauge
+	// available reports 1 if the cluster is available, and 0 otherwise.
+	available cmetric.Int64ObservableGauge
+	// healthCheckFailures reports the total number of failed health checks.
+	healthCheckFailures cmetric.Int64ObservableCounter
+}
+
+func (fm *fdbMetrics) start() error {
+	var err error
+
+	if fm.commits, err = fm.meter.Int64ObservableCounter(
+		"ipni_dhstore_fdb_commits",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of committed transactions."),
+	); err != nil {
+		return err
+	}
+
+	if fm.conflicts, err = fm.meter.Int64ObservableCounter(
+		"ipni_dhstore_fdb_conflicts",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of transaction attempts that failed due to a conflict."),
+	); err != nil {
+		return err
+	}
+
+	if fm.retries, err = fm.meter.Int64ObservableCounter(
+		"ipni_dhstore_fdb_retries",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of retried transaction attempts."),
+	); err != nil {
+		return err
+	}
+
+	if fm.failures, err = fm.meter.Int64ObservableCounter(
+		"ipni_dhstore_fdb_failures",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of transactions that failed after exhausting their retries, or with a non-retryable error."),
+	); err != nil {
+		return err
+	}
+
+	if fm.probeLatency, err = fm.meter.Int64ObservableGauge(
+		"ipni_dhstore_fdb_probe_latency",
+		cmetric.WithUnit("ms"),
+		cmetric.WithDescription("The latency of the last client probe, tagged by probe operation."),
+	); err != nil {
+		return err
+	}
+
+	if fm.available, err = fm.meter.Int64ObservableGauge(
+		"ipni_dhstore_fdb_available",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("Whether the cluster is available; 1 if the last health check succeeded and 0 otherwise."),
+	); err != nil {
+		return err
+	}
+
+	if fm.healthCheckFailures, err = fm.meter.Int64ObservableCounter(
+		"ipni_dhstore_fdb_health_check_failures",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of failed cluster health checks."),
+	); err != nil {
+		return err
+	}
+
+	_, err = fm.meter.RegisterCallback(
+		fm.health.guard("fdb", fm.reportAsyncMetrics),
+		fm.commits,
+		fm.conflicts,
+		fm.retries,
+		fm.failures,
+		fm.probeLatency,
+		fm.available,
+		fm.healthCheckFailures,
+	)
+	return err
+}
+
+func (fm *fdbMetrics) reportAsyncMetrics(_ context.Context, o cmetric.Observer) error {
+	m := fm.metricsProvider()
+
+	o.ObserveInt64(fm.commits, m.Commits)
+	o.ObserveInt64(fm.conflicts, m.Conflicts)
+	o.ObserveInt64(fm.retries, m.Retries)
+	o.ObserveInt64(fm.failures, m.Failures)
+
+	o.ObserveInt64(fm.probeLatency, m.GRVLatency.Milliseconds(), cmetric.WithAttributes(attribute.String("op", "grv")))
+	o.ObserveInt64(fm.probeLatency, m.ReadLatency.Milliseconds(), cmetric.WithAttributes(attribute.String("op", "read")))
+	o.ObserveInt64(fm.probeLatency, m.CommitLatency.Milliseconds(), cmetric.WithAttributes(attribute.String("op", "commit")))
+
+	var available int64
+	if m.Available {
+		available = 1
+	}
+	o.ObserveInt64(fm.available, available)
+	o.ObserveInt64(fm.healthCheckFailures, m.HealthCheckFailures)
+	return nil
+}
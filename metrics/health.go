@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	cmetric "go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// failureSourceExporter is the failure source of errors reported by the
+	// OpenTelemetry SDK and the prometheus exporter.
+	failureSourceExporter = "exporter"
+	// failureSourceStart is the failure source of errors that occur while
+	// registering instruments.
+	failureSourceStart = "start"
+)
+
+// health tracks failures of the metrics subsystem itself, such as panics in
+// async metric callbacks and errors reported by the exporter.
+//
+// Failures are logged and counted rather than propagated, since a metrics bug
+// must never take down the data path.
+type health struct {
+	meter cmetric.Meter
+
+	mu sync.Mutex
+	// failures is the count of failures by source.
+	failures map[string]int64
+
+	// failuresCounter reports the total number of failures of the metrics
+	// subsystem, tagged by source.
+	failuresCounter cmetric.Int64ObservableCounter
+}
+
+func newHealth(meter cmetric.Meter) *health {
+	h := &health{
+		meter:    meter,
+		failures: make(map[string]int64),
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		h.recordFailure(failureSourceExporter, err)
+	}))
+	return h
+}
+
+func (h *health) start() error {
+	var err error
+	if h.failuresCounter, err = h.meter.Int64ObservableCounter(
+		"ipni_dhstore_metrics_failures",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of failures of the metrics subsystem itself, such as panics in metric callbacks or exporter errors."),
+	); err != nil {
+		return err
+	}
+	_, err = h.meter.RegisterCallback(h.reportAsyncMetrics, h.failuresCounter)
+	return err
+}
+
+func (h *health) reportAsyncMetrics(_ context.Context, o cmetric.Observer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for source, count := range h.failures {
+		o.ObserveInt64(h.failuresCounter, count, cmetric.WithAttributes(attribute.String("source", source)))
+	}
+	return nil
+}
+
+// recordFailure logs and counts a failure from the given source.
+func (h *health) recordFailure(source string, err error) {
+	h.mu.Lock()
+	h.failures[source]++
+	h.mu.Unlock()
+	log.Errorw("Metrics failure", "source", source, "err", err)
+}
+
+// guard wraps an async metrics callback such that a panic is recovered and
+// recorded as a failure of the given source, instead of propagating into the
+// goroutine that collects metrics.
+func (h *health) guard(source string, callback cmetric.Callback) cmetric.Callback {
+	return func(ctx context.Context, o cmetric.Observer) error {
+		defer func() {
+			if r := recover(); r != nil {
+				h.recordFailure(source, fmt.Errorf("panic in metrics callback: %v", r))
+				log.Debugw("Metrics callback panic stack", "source", source, "stack", string(debug.Stack()))
+			}
+		}()
+		return callback(ctx, o)
+	}
+}
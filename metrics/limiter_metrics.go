@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"context"
+
+	cmetric "go.opentelemetry.io/otel/metric"
+)
+
+// LimiterMetrics is a snapshot of the limiter of concurrent requests.
+type LimiterMetrics struct {
+	// Limit is the maximum number of requests served concurrently.
+	Limit int64
+	// InFlight is the number of requests currently being served.
+	InFlight int64
+	// Queued is the number of requests currently waiting for a slot.
+	Queued int64
+	// Rejected is the total number of requests rejected because no slot
+	// became available within the queue timeout.
+	Rejected int64
+}
+
+// limiterMetrics asynchronously reports metrics of the limiter of concurrent
+// requests.
+type limiterMetrics struct {
+	metricsProvider func() *LimiterMetrics
+	meter           cmetric.Meter
+	health          *health
+
+	// limit reports the maximum number of concurrent requests.
+	limit cmetric.Int64ObservableGauge
+	// inFlight reports the number of requests being served.
+	inFlight cmetric.Int64ObservableGauge
+	// queued reports the number of requests waiting for a slot.
+	queued cmetric.Int64ObservableGauge
+	// rejected reports the total number of rejected requests.
+	rejected cmetric.Int64ObservableCounter
+}
+
+func (lm *limiterMetrics) start() error {
+	var err error
+
+	if lm.limit, err = lm.meter.Int64ObservableGauge(
+		"ipni_dhstore_limiter_limit",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The maximum number of requests served concurrently."),
+	); err != nil {
+		return err
+	}
+
+	if lm.inFlight, err = lm.meter.Int64ObservableGauge(
+		"ipni_dhstore_limiter_in_flight",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of requests currently being served."),
+	); err != nil {
+		return err
+	}
+
+	if lm.queued, err = lm.meter.Int64ObservableGauge(
+		"ipni_dhstore_limiter_queued",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of requests currently waiting for a slot."),
+	); err != nil {
+		return err
+	}
+
+	if lm.rejected, err = lm.meter.Int64ObservableCounter(
+		"ipni_dhstore_limiter_rejected",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of requests rejected because no slot became available within the queue timeout."),
+	); err != nil {
+		return err
+	}
+
+	_, err = lm.meter.RegisterCallback(
+		lm.health.guard("limiter", lm.reportAsyncMetrics),
+		lm.limit,
+		lm.inFlight,
+		lm.queued,
+		lm.rejected,
+	)
+	return err
+}
+
+func (lm *limiterMetrics) reportAsyncMetrics(_ context.Context, o cmetric.Observer) error {
+	m := lm.metricsProvider()
+
+	o.ObserveInt64(lm.limit, m.Limit)
+	o.ObserveInt64(lm.inFlight, m.InFlight)
+	o.ObserveInt64(lm.queued, m.Queued)
+	o.ObserveInt64(lm.rejected, m.Rejected)
+	return nil
+}
@@ -2,92 +2,390 @@ package metrics
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"time"
 
 	"github.com/cockroachdb/pebble"
 	logging "github.com/ipfs/go-log/v2"
+	prom "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/prometheus"
-	"go.opentelemetry.io/otel/metric/instrument"
-	"go.opentelemetry.io/otel/metric/instrument/syncint64"
-	"go.opentelemetry.io/otel/metric/unit"
+	cmetric "go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/sdk/metric"
-	"go.opentelemetry.io/otel/sdk/metric/aggregation"
-	"go.opentelemetry.io/otel/sdk/metric/view"
 )
 
 var (
 	log = logging.Logger("metrics")
 )
 
+// The stages of dhfind lookups, whose latency and errors are recorded
+// separately so that regressions can be attributed to the right dependency.
+const (
+	// DHFindStageStoreLookup is the lookup of the encrypted value keys of a
+	// multihash in the store.
+	DHFindStageStoreLookup = "store_lookup"
+	// DHFindStageDecrypt is the decryption of a value key or of metadata.
+	DHFindStageDecrypt = "decrypt"
+	// DHFindStageMetadata is the lookup of encrypted metadata in the store.
+	DHFindStageMetadata = "metadata"
+	// DHFindStageProviders is the fetching of provider information.
+	DHFindStageProviders = "providers"
+)
+
+var dhfindStages = []string{DHFindStageStoreLookup, DHFindStageDecrypt, DHFindStageMetadata, DHFindStageProviders}
+
 type Metrics struct {
 	exporter      *prometheus.Exporter
-	dhfindLatency syncint64.Histogram
-	httpLatency   syncint64.Histogram
+	dhfindLatency cmetric.Int64Histogram
+	dhfindStages  map[string]cmetric.Int64Histogram
+	dhfindErrors  cmetric.Int64Counter
+	lookupKeys    cmetric.Int64Histogram
+	lookupBytes   cmetric.Int64Histogram
+	mergeBatches  cmetric.Int64Histogram
+	mergeBytes    cmetric.Int64Histogram
+	failedWrites  cmetric.Int64Counter
+	httpLatency   cmetric.Int64Histogram
+	grpcLatency   cmetric.Int64Histogram
+	httpPanics    cmetric.Int64Counter
+	httpShed      cmetric.Int64Counter
+	httpInFlight  cmetric.Int64UpDownCounter
 	s             *http.Server
 	pebbleMetrics *pebbleMetrics
+	pebbleEvents  *pebbleEventMetrics
+	fdbMetrics    *fdbMetrics
+	pebbleIters   *pebbleIteratorMetrics
+	tiered        *tieredMetrics
+	mirror        *mirrorMetrics
+	limiter       *limiterMetrics
+	records       *recordCountMetrics
+	diskUsage     *diskUsageMetrics
+	summary       *summary
+	health        *health
 }
 
-func aggregationSelector(ik view.InstrumentKind) aggregation.Aggregation {
-	if ik == view.SyncHistogram {
-		return aggregation.ExplicitBucketHistogram{
-			Boundaries: []float64{0, 10, 50, 100, 200, 500, 1000, 2000, 5000, 10_000, 20_000, 30_000, 50_000},
-			NoMinMax:   false,
+// latencyBoundaries are the histogram buckets of latencies in milliseconds.
+var latencyBoundaries = []float64{0, 10, 50, 100, 200, 500, 1000, 2000, 5000, 10_000, 20_000, 30_000, 50_000}
+
+// aggregationSelector returns the selector of the aggregation of instruments,
+// which aggregates histograms, such as those of latencies, either into
+// latencyBoundaries or, if native is set, into exponential histograms that are
+// exported as prometheus native histograms.
+func aggregationSelector(native bool) metric.AggregationSelector {
+	return func(ik metric.InstrumentKind) metric.Aggregation {
+		if ik != metric.InstrumentKindHistogram {
+			return metric.DefaultAggregationSelector(ik)
+		}
+		if native {
+			return metric.AggregationBase2ExponentialHistogram{MaxSize: 160, MaxScale: 20}
 		}
+		return metric.AggregationExplicitBucketHistogram{Boundaries: latencyBoundaries}
+	}
+}
+
+var (
+	// countBoundaries are the histogram buckets of numbers of records.
+	countBoundaries = []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10_000, 50_000, 100_000}
+	// byteBoundaries are the histogram buckets of numbers of bytes.
+	byteBoundaries = []float64{0, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+)
+
+// sizeViews aggregate the histograms of sizes, such as those of lookup results
+// and merge batches, into buckets of their own, since the buckets of
+// aggregationSelector are suited to latencies.
+func sizeViews() []metric.View {
+	boundaries := map[string][]float64{
+		"ipni_dhstore_lookup_value_keys":    countBoundaries,
+		"ipni_dhstore_lookup_response_size": byteBoundaries,
+		"ipni_dhstore_merge_batch_size":     countBoundaries,
+		"ipni_dhstore_merge_batch_bytes":    byteBoundaries,
+	}
+	views := make([]metric.View, 0, len(boundaries))
+	for name, b := range boundaries {
+		views = append(views, metric.NewView(
+			metric.Instrument{Name: name},
+			metric.Stream{Aggregation: metric.AggregationExplicitBucketHistogram{Boundaries: b}}))
 	}
-	return metric.DefaultAggregationSelector(ik)
+	return views
 }
 
-func New(metricsAddr string, pebbleMetricsProvider func() *pebble.Metrics) (*Metrics, error) {
+func New(metricsAddr string, pebbleMetricsProvider func() *pebble.Metrics, options ...Option) (*Metrics, error) {
+	opts, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+
 	var m Metrics
-	var err error
+	// Scope info is omitted so that the names and labels of metrics are those
+	// exported before the labelling of scopes was introduced.
 	if m.exporter, err = prometheus.New(
 		prometheus.WithoutUnits(),
-		prometheus.WithAggregationSelector(aggregationSelector)); err != nil {
+		prometheus.WithoutScopeInfo(),
+		prometheus.WithAggregationSelector(aggregationSelector(opts.nativeHistograms))); err != nil {
 		return nil, err
 	}
 
-	provider := metric.NewMeterProvider(metric.WithReader(m.exporter))
+	provider := metric.NewMeterProvider(metric.WithReader(m.exporter), metric.WithView(sizeViews()...))
+	// Instruments are named with underscores rather than slashes, so that they
+	// are exported under the same names whether or not scrapers negotiate
+	// UTF-8 metric names, as they do for native histograms.
 	meter := provider.Meter("ipni/dhstore")
+	m.health = newHealth(meter)
+
+	if m.httpLatency, err = meter.Int64Histogram("ipni_dhstore_http_latency",
+		cmetric.WithUnit("ms"),
+		cmetric.WithDescription("Latency of DHStore HTTP API")); err != nil {
+		return nil, err
+	}
+
+	if m.httpPanics, err = meter.Int64Counter("ipni_dhstore_http_panics",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("Number of panics recovered in DHStore HTTP API handlers")); err != nil {
+		return nil, err
+	}
+
+	if m.httpShed, err = meter.Int64Counter("ipni_dhstore_http_shed",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("Number of DHStore HTTP API requests rejected with 503 due to overload")); err != nil {
+		return nil, err
+	}
+
+	if m.httpInFlight, err = meter.Int64UpDownCounter("ipni_dhstore_http_in_flight",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("Number of DHStore HTTP API requests currently being served")); err != nil {
+		return nil, err
+	}
+
+	if m.grpcLatency, err = meter.Int64Histogram("ipni_dhstore_grpc_latency",
+		cmetric.WithUnit("ms"),
+		cmetric.WithDescription("Latency of DHStore gRPC API")); err != nil {
+		return nil, err
+	}
+
+	if m.dhfindLatency, err = meter.Int64Histogram("ipni_dhstore_dhfind_latency",
+		cmetric.WithUnit("ms"),
+		cmetric.WithDescription("Latency of DHFind HTTP API")); err != nil {
+		return nil, err
+	}
+
+	m.dhfindStages = make(map[string]cmetric.Int64Histogram, len(dhfindStages))
+	for _, stage := range dhfindStages {
+		if m.dhfindStages[stage], err = meter.Int64Histogram("ipni_dhstore_dhfind_"+stage+"_latency",
+			cmetric.WithUnit("ms"),
+			cmetric.WithDescription(fmt.Sprintf("Latency of the %s stage of DHFind lookups", stage))); err != nil {
+			return nil, err
+		}
+	}
+
+	if m.dhfindErrors, err = meter.Int64Counter("ipni_dhstore_dhfind_errors",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("Number of failures of the stages of DHFind lookups")); err != nil {
+		return nil, err
+	}
+
+	if m.lookupKeys, err = meter.Int64Histogram("ipni_dhstore_lookup_value_keys",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("Number of encrypted value keys returned per lookup")); err != nil {
+		return nil, err
+	}
+
+	if m.lookupBytes, err = meter.Int64Histogram("ipni_dhstore_lookup_response_size",
+		cmetric.WithUnit("By"),
+		cmetric.WithDescription("Number of bytes written per lookup response")); err != nil {
+		return nil, err
+	}
+
+	if m.mergeBatches, err = meter.Int64Histogram("ipni_dhstore_merge_batch_size",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("Number of merges per batch committed to the store")); err != nil {
+		return nil, err
+	}
 
-	if m.httpLatency, err = meter.SyncInt64().Histogram("ipni/dhstore/http_latency",
-		instrument.WithUnit(unit.Milliseconds),
-		instrument.WithDescription("Latency of DHStore HTTP API")); err != nil {
+	if m.mergeBytes, err = meter.Int64Histogram("ipni_dhstore_merge_batch_bytes",
+		cmetric.WithUnit("By"),
+		cmetric.WithDescription("Number of bytes of the keys and values of merges per batch committed to the store")); err != nil {
 		return nil, err
 	}
 
-	if m.dhfindLatency, err = meter.SyncInt64().Histogram("ipni/dhstore/dhfind_latency",
-		instrument.WithUnit(unit.Milliseconds),
-		instrument.WithDescription("Latency of DHFind HTTP API")); err != nil {
+	if m.failedWrites, err = meter.Int64Counter("ipni_dhstore_failed_writes",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("Number of merges and metadata writes that were rejected or failed to commit")); err != nil {
 		return nil, err
 	}
 
 	m.s = &http.Server{
 		Addr:    metricsAddr,
-		Handler: metricsMux(),
+		Handler: m.metricsMux(opts.handlers),
 	}
 
 	if pebbleMetricsProvider != nil {
 		m.pebbleMetrics = &pebbleMetrics{
 			metricsProvider: pebbleMetricsProvider,
 			meter:           meter,
+			health:          m.health,
+		}
+	}
+
+	if opts.pebbleEvents != nil {
+		m.pebbleEvents = &pebbleEventMetrics{
+			events: opts.pebbleEvents,
+			meter:  meter,
+			health: m.health,
+		}
+	}
+
+	if opts.fdbMetricsProvider != nil {
+		m.fdbMetrics = &fdbMetrics{
+			metricsProvider: opts.fdbMetricsProvider,
+			meter:           meter,
+			health:          m.health,
+		}
+	}
+
+	if opts.pebbleIteratorMetricsProvider != nil {
+		m.pebbleIters = &pebbleIteratorMetrics{
+			metricsProvider: opts.pebbleIteratorMetricsProvider,
+			meter:           meter,
+			health:          m.health,
+		}
+	}
+
+	if opts.tieredMetricsProvider != nil {
+		m.tiered = &tieredMetrics{
+			metricsProvider: opts.tieredMetricsProvider,
+			meter:           meter,
+			health:          m.health,
+		}
+	}
+
+	if opts.mirrorMetricsProvider != nil {
+		m.mirror = &mirrorMetrics{
+			metricsProvider: opts.mirrorMetricsProvider,
+			meter:           meter,
+			health:          m.health,
+		}
+	}
+
+	if opts.limiterMetricsProvider != nil {
+		m.limiter = &limiterMetrics{
+			metricsProvider: opts.limiterMetricsProvider,
+			meter:           meter,
+			health:          m.health,
+		}
+	}
+
+	if opts.recordCountMetricsProvider != nil {
+		m.records = &recordCountMetrics{
+			metricsProvider: opts.recordCountMetricsProvider,
+			meter:           meter,
+			health:          m.health,
+		}
+	}
+
+	if opts.diskUsageMetricsProvider != nil {
+		m.diskUsage = &diskUsageMetrics{
+			metricsProvider: opts.diskUsageMetricsProvider,
+			meter:           meter,
+			health:          m.health,
 		}
 	}
 
+	if opts.summaryInterval != 0 {
+		m.summary = newSummary(opts.summaryInterval)
+		m.summary.pebbleMetricsProvider = pebbleMetricsProvider
+		m.summary.diskUsageProvider = opts.diskUsageMetricsProvider
+	}
+
 	return &m, nil
 }
 
 func (m *Metrics) RecordHttpLatency(ctx context.Context, t time.Duration, method, path string, status int) {
 	m.httpLatency.Record(ctx, t.Milliseconds(),
-		attribute.String("method", method), attribute.String("path", path), attribute.Int("status", status))
+		cmetric.WithAttributes(attribute.String("method", method), attribute.String("path", path), attribute.Int("status", status)))
+	if m.summary != nil {
+		m.summary.observe(t, status >= http.StatusInternalServerError)
+	}
+}
+
+func (m *Metrics) RecordGrpcLatency(ctx context.Context, t time.Duration, method, code string) {
+	m.grpcLatency.Record(ctx, t.Milliseconds(),
+		cmetric.WithAttributes(attribute.String("method", method), attribute.String("code", code)))
+	if m.summary != nil {
+		m.summary.observe(t, grpcServerErrors[code])
+	}
+}
+
+// grpcServerErrors are the gRPC status codes that are counted as errors by the
+// periodic summary, which, like 5xx HTTP responses, are due to the server
+// rather than the request.
+var grpcServerErrors = map[string]bool{
+	"Unknown":          true,
+	"DeadlineExceeded": true,
+	"Unimplemented":    true,
+	"Internal":         true,
+	"Unavailable":      true,
+	"DataLoss":         true,
+}
+
+func (m *Metrics) RecordHttpPanic(ctx context.Context, method, path string) {
+	m.httpPanics.Add(ctx, 1,
+		cmetric.WithAttributes(attribute.String("method", method), attribute.String("path", path)))
+}
+
+// RecordHttpShed records a request rejected due to overload, where reason is
+// either "concurrency" or "write_pressure".
+func (m *Metrics) RecordHttpShed(ctx context.Context, method, path, reason string) {
+	m.httpShed.Add(ctx, 1,
+		cmetric.WithAttributes(attribute.String("method", method), attribute.String("path", path), attribute.String("reason", reason)))
+}
+
+// RecordHttpInFlight adds delta to the number of requests being served, i.e.
+// 1 once a request is received and -1 once it is served.
+func (m *Metrics) RecordHttpInFlight(ctx context.Context, method, path string, delta int64) {
+	m.httpInFlight.Add(ctx, delta,
+		cmetric.WithAttributes(attribute.String("method", method), attribute.String("path", path)))
 }
 
 func (m *Metrics) RecordDHFindLatency(ctx context.Context, t time.Duration, method, path string, status int, firstResult bool) {
 	m.dhfindLatency.Record(ctx, t.Milliseconds(),
-		attribute.String("method", method), attribute.String("path", path), attribute.Int("status", status), attribute.Bool("ttfr", firstResult))
+		cmetric.WithAttributes(attribute.String("method", method), attribute.String("path", path), attribute.Int("status", status), attribute.Bool("ttfr", firstResult)))
+}
+
+// RecordDHFindStage records the latency of a stage of a dhfind lookup, which is
+// one of the DHFindStage constants, and counts it as an error if failed.
+func (m *Metrics) RecordDHFindStage(ctx context.Context, stage string, t time.Duration, failed bool) {
+	m.dhfindStages[stage].Record(ctx, t.Milliseconds())
+	if failed {
+		m.dhfindErrors.Add(ctx, 1, cmetric.WithAttributes(attribute.String("stage", stage)))
+	}
+}
+
+// RecordLookupSize records the number of encrypted value keys returned by a
+// lookup, and the number of bytes of its response, so that the distribution of
+// multihashes with many records can be observed.
+func (m *Metrics) RecordLookupSize(ctx context.Context, path string, valueKeys int, bytes int64) {
+	m.lookupKeys.Record(ctx, int64(valueKeys), cmetric.WithAttributes(attribute.String("path", path)))
+	m.lookupBytes.Record(ctx, bytes, cmetric.WithAttributes(attribute.String("path", path)))
+}
+
+// RecordMergeBatch records the number of merges, and the number of bytes of
+// their keys and values, of a batch committed to the store, where source is
+// the API via which the batch was received, e.g. "put", "stream" or "grpc".
+func (m *Metrics) RecordMergeBatch(ctx context.Context, source string, merges int, bytes int64) {
+	m.mergeBatches.Record(ctx, int64(merges), cmetric.WithAttributes(attribute.String("source", source)))
+	m.mergeBytes.Record(ctx, bytes, cmetric.WithAttributes(attribute.String("source", source)))
+}
+
+// RecordFailedWrite records count writes that were rejected or failed to
+// commit, where op is either "merge" or "metadata", source is the API via which
+// they were received, as for RecordMergeBatch, and reason is the error code of
+// the failure, e.g. "bad_multihash" or "internal".
+func (m *Metrics) RecordFailedWrite(ctx context.Context, op, source, reason string, count int) {
+	m.failedWrites.Add(ctx, int64(count),
+		cmetric.WithAttributes(attribute.String("op", op), attribute.String("source", source), attribute.String("reason", reason)))
 }
 
 func (m *Metrics) Start(_ context.Context) error {
@@ -96,13 +394,70 @@ func (m *Metrics) Start(_ context.Context) error {
 		return err
 	}
 
+	// Failure to register instruments only degrades the reported metrics, and
+	// must not prevent the data path from starting.
+	if err = m.health.start(); err != nil {
+		m.health.recordFailure(failureSourceStart, err)
+	}
+
 	if m.pebbleMetrics != nil {
-		err = m.pebbleMetrics.start()
-		if err != nil {
-			return err
+		if err = m.pebbleMetrics.start(); err != nil {
+			m.health.recordFailure(failureSourceStart, err)
 		}
 	}
 
+	if m.pebbleEvents != nil {
+		if err = m.pebbleEvents.start(); err != nil {
+			m.health.recordFailure(failureSourceStart, err)
+		}
+	}
+
+	if m.fdbMetrics != nil {
+		if err = m.fdbMetrics.start(); err != nil {
+			m.health.recordFailure(failureSourceStart, err)
+		}
+	}
+
+	if m.pebbleIters != nil {
+		if err = m.pebbleIters.start(); err != nil {
+			m.health.recordFailure(failureSourceStart, err)
+		}
+	}
+
+	if m.tiered != nil {
+		if err = m.tiered.start(); err != nil {
+			m.health.recordFailure(failureSourceStart, err)
+		}
+	}
+
+	if m.mirror != nil {
+		if err = m.mirror.start(); err != nil {
+			m.health.recordFailure(failureSourceStart, err)
+		}
+	}
+
+	if m.limiter != nil {
+		if err = m.limiter.start(); err != nil {
+			m.health.recordFailure(failureSourceStart, err)
+		}
+	}
+
+	if m.records != nil {
+		if err = m.records.start(); err != nil {
+			m.health.recordFailure(failureSourceStart, err)
+		}
+	}
+
+	if m.diskUsage != nil {
+		if err = m.diskUsage.start(); err != nil {
+			m.health.recordFailure(failureSourceStart, err)
+		}
+	}
+
+	if m.summary != nil {
+		m.summary.start()
+	}
+
 	go func() { _ = m.s.Serve(mln) }()
 
 	log.Infow("Metrics server started", "addr", mln.Addr())
@@ -110,11 +465,47 @@ func (m *Metrics) Start(_ context.Context) error {
 }
 
 func (s *Metrics) Shutdown(ctx context.Context) error {
+	if s.summary != nil {
+		s.summary.shutdown()
+	}
 	return s.s.Shutdown(ctx)
 }
 
-func metricsMux() *http.ServeMux {
+// Failures returns the total number of failures of the metrics subsystem
+// itself, such as panics in metric callbacks or exporter errors.
+func (m *Metrics) Failures() int64 {
+	m.health.mu.Lock()
+	defer m.health.mu.Unlock()
+	var total int64
+	for _, count := range m.health.failures {
+		total += count
+	}
+	return total
+}
+
+func (m *Metrics) metricsMux(handlers map[string]http.Handler) *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	for pattern, handler := range handlers {
+		mux.Handle(pattern, handler)
+	}
+	// Continue serving the metrics that could be gathered on error, rather
+	// than failing the whole scrape. OpenMetrics is enabled since exemplars,
+	// which link latencies to the traces of requests, are only exposed in it.
+	handler := promhttp.HandlerFor(prom.DefaultGatherer, promhttp.HandlerOpts{
+		ErrorLog:          promErrorLogger{m.health},
+		ErrorHandling:     promhttp.ContinueOnError,
+		EnableOpenMetrics: true,
+	})
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prom.DefaultRegisterer, handler))
 	return mux
 }
+
+// promErrorLogger records errors encountered while gathering or serving
+// prometheus metrics as failures.
+type promErrorLogger struct {
+	health *health
+}
+
+func (l promErrorLogger) Println(v ...interface{}) {
+	l.health.recordFailure(failureSourceExporter, errors.New(fmt.Sprint(v...)))
+}
@@ -0,0 +1,475 @@
+package metrics_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipni/dhstore/metrics"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMetrics_PanickingProviderIsReportedAsFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	subject, err := metrics.New(addr, func() *pebble.Metrics { panic("fish") })
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "target_info")
+	require.Equal(t, int64(1), subject.Failures())
+
+	// The failure is itself reported as a metric.
+	resp, err = http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Contains(t, string(body), `ipni_dhstore_metrics_failures_total{source="pebble"} 1`)
+}
+
+func TestMetrics_FDBMetricsAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	fdbMetrics := func() *metrics.FDBMetrics {
+		return &metrics.FDBMetrics{
+			Commits:             5,
+			Conflicts:           2,
+			Retries:             3,
+			Failures:            1,
+			GRVLatency:          4 * time.Millisecond,
+			ReadLatency:         6 * time.Millisecond,
+			CommitLatency:       12 * time.Millisecond,
+			Available:           true,
+			HealthCheckFailures: 7,
+		}
+	}
+	subject, err := metrics.New(addr, nil, metrics.WithFDBMetrics(fdbMetrics))
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "ipni_dhstore_fdb_commits_total 5")
+	require.Contains(t, string(body), "ipni_dhstore_fdb_conflicts_total 2")
+	require.Contains(t, string(body), "ipni_dhstore_fdb_retries_total 3")
+	require.Contains(t, string(body), "ipni_dhstore_fdb_failures_total 1")
+	require.Contains(t, string(body), `ipni_dhstore_fdb_probe_latency{op="commit"} 12`)
+	require.Contains(t, string(body), "ipni_dhstore_fdb_available 1")
+	require.Contains(t, string(body), "ipni_dhstore_fdb_health_check_failures_total 7")
+}
+
+func TestMetrics_TieredMetricsAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	tieredMetrics := func() *metrics.TieredMetrics {
+		return &metrics.TieredMetrics{
+			Multihash:    metrics.TieredLookups{Hot: 8, Cold: 3, Miss: 2},
+			Metadata:     metrics.TieredLookups{Hot: 5, Cold: 1},
+			ColdFailures: 4,
+		}
+	}
+	subject, err := metrics.New(addr, nil, metrics.WithTieredMetrics(tieredMetrics))
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "ipni_dhstore_tiered_multihash_lookups_hot_total 8")
+	require.Contains(t, string(body), "ipni_dhstore_tiered_multihash_lookups_cold_total 3")
+	require.Contains(t, string(body), "ipni_dhstore_tiered_multihash_lookups_miss_total 2")
+	require.Contains(t, string(body), "ipni_dhstore_tiered_metadata_lookups_hot_total 5")
+	require.Contains(t, string(body), "ipni_dhstore_tiered_metadata_lookups_cold_total 1")
+	require.Contains(t, string(body), "ipni_dhstore_tiered_cold_failures_total 4")
+}
+
+func TestMetrics_MirrorMetricsAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	mirrorMetrics := func() *metrics.MirrorMetrics {
+		return &metrics.MirrorMetrics{Targets: []metrics.MirrorTargetMetrics{
+			{Name: "primary", Writes: 9},
+			{Name: "fish", Writes: 8, Failures: 2, Dropped: 1, Pending: 3},
+		}}
+	}
+	subject, err := metrics.New(addr, nil, metrics.WithMirrorMetrics(mirrorMetrics))
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), `ipni_dhstore_mirror_writes{target="primary"} 9`)
+	require.Contains(t, string(body), `ipni_dhstore_mirror_writes{target="fish"} 8`)
+	require.Contains(t, string(body), `ipni_dhstore_mirror_failures{target="fish"} 2`)
+	require.Contains(t, string(body), `ipni_dhstore_mirror_dropped{target="fish"} 1`)
+	require.Contains(t, string(body), `ipni_dhstore_mirror_pending{target="fish"} 3`)
+}
+
+func TestMetrics_LimiterMetricsAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	limiterMetrics := func() *metrics.LimiterMetrics {
+		return &metrics.LimiterMetrics{Limit: 8, InFlight: 5, Queued: 2, Rejected: 3}
+	}
+	subject, err := metrics.New(addr, nil, metrics.WithLimiterMetrics(limiterMetrics))
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "ipni_dhstore_limiter_limit 8")
+	require.Contains(t, string(body), "ipni_dhstore_limiter_in_flight 5")
+	require.Contains(t, string(body), "ipni_dhstore_limiter_queued 2")
+	require.Contains(t, string(body), "ipni_dhstore_limiter_rejected_total 3")
+}
+
+func TestMetrics_DHFindStagesAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	subject, err := metrics.New(addr, nil)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	subject.RecordDHFindStage(context.Background(), metrics.DHFindStageStoreLookup, 3*time.Millisecond, false)
+	subject.RecordDHFindStage(context.Background(), metrics.DHFindStageProviders, 70*time.Millisecond, true)
+	subject.RecordDHFindStage(context.Background(), metrics.DHFindStageProviders, 30*time.Millisecond, false)
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "ipni_dhstore_dhfind_store_lookup_latency_count 1")
+	require.Contains(t, string(body), "ipni_dhstore_dhfind_providers_latency_sum 100")
+	require.Contains(t, string(body), `ipni_dhstore_dhfind_errors_total{stage="providers"} 1`)
+	require.NotContains(t, string(body), `ipni_dhstore_dhfind_errors_total{stage="store_lookup"}`)
+}
+
+func TestMetrics_RecordCountMetricsAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	recordCounts := func() *metrics.RecordCountMetrics {
+		return &metrics.RecordCountMetrics{Multihashes: 1413, Metadata: 42}
+	}
+	subject, err := metrics.New(addr, nil, metrics.WithRecordCountMetrics(recordCounts))
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "ipni_dhstore_records_multihashes 1413")
+	require.Contains(t, string(body), "ipni_dhstore_records_metadata 42")
+}
+
+func TestMetrics_DiskUsageMetricsAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	var known atomic.Bool
+	diskUsage := func() *metrics.DiskUsageMetrics {
+		if !known.Load() {
+			return nil
+		}
+		return &metrics.DiskUsageMetrics{Size: 1024, VolumeAvailable: 2048, VolumeTotal: 4096}
+	}
+	subject, err := metrics.New(addr, nil, metrics.WithDiskUsageMetrics(diskUsage))
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	scrape := func() string {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return string(body)
+	}
+	require.NotContains(t, scrape(), "ipni_dhstore_store_size")
+
+	known.Store(true)
+	body := scrape()
+	require.Contains(t, body, "ipni_dhstore_store_size 1024")
+	require.Contains(t, body, "ipni_dhstore_store_volume_available 2048")
+	require.Contains(t, body, "ipni_dhstore_store_volume_total 4096")
+}
+
+func TestMetrics_LookupSizesAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	subject, err := metrics.New(addr, nil)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	subject.RecordLookupSize(context.Background(), "multihash", 3, 300)
+	subject.RecordLookupSize(context.Background(), "multihash", 4000, 2<<20)
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	// Sizes are aggregated into buckets of their own rather than those of
+	// latencies.
+	require.Contains(t, string(body), `ipni_dhstore_lookup_value_keys_bucket{path="multihash",le="5"} 1`)
+	require.Contains(t, string(body), `ipni_dhstore_lookup_value_keys_sum{path="multihash"} 4003`)
+	require.Contains(t, string(body), `ipni_dhstore_lookup_response_size_bucket{path="multihash",le="4.194304e+06"} 2`)
+	require.Contains(t, string(body), `ipni_dhstore_lookup_response_size_sum{path="multihash"} 2.097452e+06`)
+}
+
+func TestMetrics_MergeBatchesAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	subject, err := metrics.New(addr, nil)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	subject.RecordMergeBatch(context.Background(), "stream", 8, 512)
+	subject.RecordMergeBatch(context.Background(), "stream", 1500, 96<<10)
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), `ipni_dhstore_merge_batch_size_bucket{source="stream",le="10"} 1`)
+	require.Contains(t, string(body), `ipni_dhstore_merge_batch_size_sum{source="stream"} 1508`)
+	require.Contains(t, string(body), `ipni_dhstore_merge_batch_bytes_bucket{source="stream",le="1024"} 1`)
+	require.Contains(t, string(body), `ipni_dhstore_merge_batch_bytes_count{source="stream"} 2`)
+}
+
+func TestMetrics_FailedWritesAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	subject, err := metrics.New(addr, nil)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	subject.RecordFailedWrite(context.Background(), "merge", "put", "bad_multihash", 3)
+	subject.RecordFailedWrite(context.Background(), "merge", "put", "bad_multihash", 2)
+	subject.RecordFailedWrite(context.Background(), "metadata", "grpc", "internal", 1)
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), `ipni_dhstore_failed_writes_total{op="merge",reason="bad_multihash",source="put"} 5`)
+	require.Contains(t, string(body), `ipni_dhstore_failed_writes_total{op="metadata",reason="internal",source="grpc"} 1`)
+}
+
+func TestMetrics_HttpInFlightIsExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	subject, err := metrics.New(addr, nil)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	subject.RecordHttpInFlight(context.Background(), http.MethodGet, "multihash", 1)
+	subject.RecordHttpInFlight(context.Background(), http.MethodGet, "multihash", 1)
+	subject.RecordHttpInFlight(context.Background(), http.MethodGet, "multihash", -1)
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "# TYPE ipni_dhstore_http_in_flight gauge")
+	require.Contains(t, string(body), `ipni_dhstore_http_in_flight{method="GET",path="multihash"} 1`)
+}
+
+func TestMetrics_PebbleWALMetricsAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	db, err := pebble.Open(t.TempDir(), &pebble.Options{})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Set([]byte("fish"), []byte("lobster"), pebble.Sync))
+
+	subject, err := metrics.New(addr, db.Metrics)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "ipni_dhstore_pebble_wal_files 1")
+	require.Contains(t, string(body), "ipni_dhstore_pebble_wal_bytes_written_total")
+	require.Contains(t, string(body), "ipni_dhstore_pebble_wal_fsync_count_total")
+	require.Contains(t, string(body), "ipni_dhstore_pebble_memtable_count 1")
+	require.NotContains(t, string(body), "ipni_dhstore_pebble_wal_fsync_count_total 0")
+}
+
+func TestMetrics_NativeHistogramsAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	subject, err := metrics.New(addr, nil, metrics.WithNativeHistograms(true))
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	subject.RecordHttpLatency(context.Background(), 3*time.Millisecond, http.MethodGet, "native", http.StatusOK)
+	subject.RecordHttpLatency(context.Background(), 700*time.Millisecond, http.MethodGet, "native", http.StatusOK)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/metrics", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", string(expfmt.NewFormat(expfmt.TypeProtoDelim)))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var found bool
+	dec := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	for {
+		var mf dto.MetricFamily
+		if err := dec.Decode(&mf); err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+		if mf.GetName() != "ipni_dhstore_http_latency" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "path" && label.GetValue() == "native" {
+					found = true
+					require.Equal(t, uint64(2), m.GetHistogram().GetSampleCount())
+					require.NotEmpty(t, m.GetHistogram().GetPositiveSpan())
+				}
+			}
+		}
+	}
+	require.True(t, found)
+}
+
+func TestMetrics_LatencyExemplarsAreExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	subject, err := metrics.New(addr, nil)
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	traceID, err := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	require.NoError(t, err)
+	spanID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+	require.NoError(t, err)
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+	subject.RecordHttpLatency(ctx, 42*time.Millisecond, http.MethodGet, "exemplar", http.StatusOK)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/metrics", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736",span_id="00f067aa0ba902b7"} 42`)
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	cmetric "go.opentelemetry.io/otel/metric"
+)
+
+// MirrorTargetMetrics is a snapshot of the metrics of a single target of a
+// mirroring store.
+type MirrorTargetMetrics struct {
+	// Name identifies the target.
+	Name string
+	// Writes is the total number of writes applied to the target.
+	Writes int64
+	// Failures is the total number of writes that failed on the target.
+	Failures int64
+	// Dropped is the total number of asynchronous writes that were dropped
+	// because the queue of the target was full.
+	Dropped int64
+	// Pending is the number of asynchronous writes queued for the target.
+	Pending int64
+}
+
+// MirrorMetrics is a snapshot of the metrics of a mirroring store.
+type MirrorMetrics struct {
+	Targets []MirrorTargetMetrics
+}
+
+// mirrorMetrics asynchronously reports metrics of a mirroring store.
+//
+// Totals are reported as gauges tagged by target rather than counters, which
+// earlier versions of the prometheus exporter mangled the names of when tagged,
+// so that the names of the metrics remain stable.
+type mirrorMetrics struct {
+	metricsProvider func() *MirrorMetrics
+	meter           cmetric.Meter
+	health          *health
+
+	// writes reports the total number of writes applied to each target.
+	writes cmetric.Int64ObservableGauge
+	// failures reports the total number of failed writes of each target.
+	failures cmetric.Int64ObservableGauge
+	// dropped reports the total number of dropped writes of each target.
+	dropped cmetric.Int64ObservableGauge
+	// pending reports the number of queued writes of each target.
+	pending cmetric.Int64ObservableGauge
+}
+
+func (mm *mirrorMetrics) start() error {
+	var err error
+
+	if mm.writes, err = mm.meter.Int64ObservableGauge(
+		"ipni_dhstore_mirror_writes",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of writes applied to each mirror target, tagged by target."),
+	); err != nil {
+		return err
+	}
+
+	if mm.failures, err = mm.meter.Int64ObservableGauge(
+		"ipni_dhstore_mirror_failures",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of writes that failed on each mirror target, tagged by target."),
+	); err != nil {
+		return err
+	}
+
+	if mm.dropped, err = mm.meter.Int64ObservableGauge(
+		"ipni_dhstore_mirror_dropped",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of asynchronous writes dropped because the queue of the mirror target was full, tagged by target."),
+	); err != nil {
+		return err
+	}
+
+	if mm.pending, err = mm.meter.Int64ObservableGauge(
+		"ipni_dhstore_mirror_pending",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of asynchronous writes queued for each mirror target, tagged by target."),
+	); err != nil {
+		return err
+	}
+
+	_, err = mm.meter.RegisterCallback(
+		mm.health.guard("mirror", mm.reportAsyncMetrics),
+		mm.writes,
+		mm.failures,
+		mm.dropped,
+		mm.pending,
+	)
+	return err
+}
+
+func (mm *mirrorMetrics) reportAsyncMetrics(_ context.Context, o cmetric.Observer) error {
+	m := mm.metricsProvider()
+
+	for _, target := range m.Targets {
+		attr := attribute.String("target", target.Name)
+		o.ObserveInt64(mm.writes, target.Writes, cmetric.WithAttributes(attr))
+		o.ObserveInt64(mm.failures, target.Failures, cmetric.WithAttributes(attr))
+		o.ObserveInt64(mm.dropped, target.Dropped, cmetric.WithAttributes(attr))
+		o.ObserveInt64(mm.pending, target.Pending, cmetric.WithAttributes(attr))
+	}
+	return nil
+}
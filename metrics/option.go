@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// config contains all options for the metrics.
+type config struct {
+	pebbleEvents       *PebbleEvents
+	fdbMetricsProvider func() *FDBMetrics
+
+	pebbleIteratorMetricsProvider func() *PebbleIteratorMetrics
+	tieredMetricsProvider         func() *TieredMetrics
+	mirrorMetricsProvider         func() *MirrorMetrics
+	limiterMetricsProvider        func() *LimiterMetrics
+	recordCountMetricsProvider    func() *RecordCountMetrics
+	diskUsageMetricsProvider      func() *DiskUsageMetrics
+
+	handlers map[string]http.Handler
+
+	nativeHistograms bool
+	summaryInterval  time.Duration
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	var cfg config
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d error: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithPebbleEvents configures reporting of pebble events, such as compactions
+// and write stalls, observed by the given PebbleEvents.
+func WithPebbleEvents(e *PebbleEvents) Option {
+	return func(c *config) error {
+		c.pebbleEvents = e
+		return nil
+	}
+}
+
+// WithFDBMetrics configures reporting of FoundationDB client metrics, such as
+// commit, conflict and retry counts and probe latencies, as provided by the
+// given function.
+func WithFDBMetrics(provider func() *FDBMetrics) Option {
+	return func(c *config) error {
+		c.fdbMetricsProvider = provider
+		return nil
+	}
+}
+
+// WithPebbleIteratorMetrics configures reporting of the iterators open on
+// pebble DB, such as the number of open and leaked iterators, as provided by
+// the given function.
+func WithPebbleIteratorMetrics(provider func() *PebbleIteratorMetrics) Option {
+	return func(c *config) error {
+		c.pebbleIteratorMetricsProvider = provider
+		return nil
+	}
+}
+
+// WithTieredMetrics configures reporting of the metrics of a tiered store,
+// such as the number of lookups served by each tier, as provided by the given
+// function.
+func WithTieredMetrics(provider func() *TieredMetrics) Option {
+	return func(c *config) error {
+		c.tieredMetricsProvider = provider
+		return nil
+	}
+}
+
+// WithMirrorMetrics configures reporting of the metrics of a mirroring store,
+// such as the number of failed writes of each target, as provided by the given
+// function.
+func WithMirrorMetrics(provider func() *MirrorMetrics) Option {
+	return func(c *config) error {
+		c.mirrorMetricsProvider = provider
+		return nil
+	}
+}
+
+// WithLimiterMetrics configures reporting of the metrics of the limiter of
+// concurrent requests, such as the number of rejected requests, as provided by
+// the given function.
+func WithLimiterMetrics(provider func() *LimiterMetrics) Option {
+	return func(c *config) error {
+		c.limiterMetricsProvider = provider
+		return nil
+	}
+}
+
+// WithRecordCountMetrics configures reporting of the estimated number of
+// multihash index and metadata records in the store, as provided by the given
+// function.
+func WithRecordCountMetrics(provider func() *RecordCountMetrics) Option {
+	return func(c *config) error {
+		c.recordCountMetricsProvider = provider
+		return nil
+	}
+}
+
+// WithDiskUsageMetrics configures reporting of the disk usage of the store,
+// such as its size and the space available on its volume, as provided by the
+// given function. Nothing is reported while the function returns nil.
+func WithDiskUsageMetrics(provider func() *DiskUsageMetrics) Option {
+	return func(c *config) error {
+		c.diskUsageMetricsProvider = provider
+		return nil
+	}
+}
+
+// WithNativeHistograms configures whether histograms of latencies are exported
+// as prometheus native histograms, whose buckets adapt to the observed
+// latencies, rather than as histograms of fixed buckets. Native histograms are
+// only exposed to scrapers that negotiate the protobuf format.
+func WithNativeHistograms(native bool) Option {
+	return func(c *config) error {
+		c.nativeHistograms = native
+		return nil
+	}
+}
+
+// WithSummaryInterval configures logging a one-line summary of the requests
+// served, their error rate and p50 and p99 latencies, the size of the store and
+// its compaction debt at the given interval, for installations that do not
+// scrape metrics. Disabled when zero.
+func WithSummaryInterval(interval time.Duration) Option {
+	return func(c *config) error {
+		if interval < 0 {
+			return fmt.Errorf("summary interval must not be negative: %s", interval)
+		}
+		c.summaryInterval = interval
+		return nil
+	}
+}
+
+// WithHandler serves the given handler on the metrics server at the given
+// pattern, e.g. to expose admin tooling on the same port as metrics.
+func WithHandler(pattern string, handler http.Handler) Option {
+	return func(c *config) error {
+		if pattern == "/metrics" {
+			return fmt.Errorf("pattern %s is reserved", pattern)
+		}
+		if c.handlers == nil {
+			c.handlers = make(map[string]http.Handler)
+		}
+		c.handlers[pattern] = handler
+		return nil
+	}
+}
@@ -0,0 +1,247 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore/clock"
+	"go.opentelemetry.io/otel/attribute"
+	cmetric "go.opentelemetry.io/otel/metric"
+)
+
+var eventsLog = logging.Logger("store/pebble/events")
+
+// PebbleEvents listens to notable pebble DB events, such as compactions,
+// flushes, slow disk operations and write stalls. Each event is logged and
+// counted so that it can be reported as metrics.
+//
+// Write stalls are of particular interest since they are otherwise invisible
+// until clients start to time out.
+type PebbleEvents struct {
+	clock clock.Clock
+
+	compactions         atomic.Int64
+	compactionErrors    atomic.Int64
+	flushes             atomic.Int64
+	flushErrors         atomic.Int64
+	backgroundErrors    atomic.Int64
+	writeStalls         atomic.Int64
+	writeStallDuration  atomic.Int64
+	writeStallStartedAt atomic.Int64
+
+	// diskSlowOps tracks the count of slow disk operations by operation type.
+	diskSlowOpsLock sync.Mutex
+	diskSlowOps     map[string]int64
+}
+
+// NewPebbleEvents instantiates a new PebbleEvents listener, which measures the
+// duration of write stalls with the given clock.
+func NewPebbleEvents(clk clock.Clock) *PebbleEvents {
+	return &PebbleEvents{
+		clock:       clk,
+		diskSlowOps: make(map[string]int64),
+	}
+}
+
+// EventListener returns the pebble.EventListener that reports events to this
+// PebbleEvents. It should be added to the pebble options before the DB is
+// opened.
+func (e *PebbleEvents) EventListener() pebble.EventListener {
+	return pebble.EventListener{
+		BackgroundError: e.onBackgroundError,
+		CompactionBegin: e.onCompactionBegin,
+		CompactionEnd:   e.onCompactionEnd,
+		DiskSlow:        e.onDiskSlow,
+		FlushEnd:        e.onFlushEnd,
+		WriteStallBegin: e.onWriteStallBegin,
+		WriteStallEnd:   e.onWriteStallEnd,
+	}
+}
+
+// WriteStalled returns whether writes are currently stalled.
+func (e *PebbleEvents) WriteStalled() bool {
+	return e.writeStallStartedAt.Load() != 0
+}
+
+func (e *PebbleEvents) onBackgroundError(err error) {
+	e.backgroundErrors.Add(1)
+	eventsLog.Errorw("Background error", "err", err)
+}
+
+func (e *PebbleEvents) onCompactionBegin(info pebble.CompactionInfo) {
+	eventsLog.Debugw("Compaction started", "job", info.JobID, "reason", info.Reason, "outputLevel", info.Output.Level)
+}
+
+func (e *PebbleEvents) onCompactionEnd(info pebble.CompactionInfo) {
+	e.compactions.Add(1)
+	if info.Err != nil {
+		e.compactionErrors.Add(1)
+		eventsLog.Errorw("Compaction failed", "job", info.JobID, "reason", info.Reason, "duration", info.TotalDuration, "err", info.Err)
+		return
+	}
+	eventsLog.Infow("Compaction finished", "job", info.JobID, "reason", info.Reason, "outputLevel", info.Output.Level, "duration", info.TotalDuration)
+}
+
+func (e *PebbleEvents) onDiskSlow(info pebble.DiskSlowInfo) {
+	// This callback must not block or do any IO; logging is buffered by zap.
+	op := info.OpType.String()
+	e.diskSlowOpsLock.Lock()
+	e.diskSlowOps[op]++
+	e.diskSlowOpsLock.Unlock()
+	eventsLog.Warnw("Slow disk operation", "op", op, "path", info.Path, "writeSize", info.WriteSize, "duration", info.Duration)
+}
+
+func (e *PebbleEvents) onFlushEnd(info pebble.FlushInfo) {
+	e.flushes.Add(1)
+	if info.Err != nil {
+		e.flushErrors.Add(1)
+		eventsLog.Errorw("Flush failed", "job", info.JobID, "reason", info.Reason, "duration", info.TotalDuration, "err", info.Err)
+		return
+	}
+	eventsLog.Infow("Flush finished", "job", info.JobID, "reason", info.Reason, "inputBytes", info.InputBytes, "duration", info.TotalDuration)
+}
+
+func (e *PebbleEvents) onWriteStallBegin(info pebble.WriteStallBeginInfo) {
+	e.writeStalls.Add(1)
+	e.writeStallStartedAt.Store(e.clock.Now().UnixNano())
+	eventsLog.Warnw("Write stall started", "reason", info.Reason)
+}
+
+func (e *PebbleEvents) onWriteStallEnd() {
+	startedAt := e.writeStallStartedAt.Swap(0)
+	if startedAt == 0 {
+		return
+	}
+	duration := e.clock.Since(time.Unix(0, startedAt))
+	e.writeStallDuration.Add(duration.Milliseconds())
+	eventsLog.Warnw("Write stall ended", "duration", duration)
+}
+
+// pebbleEventMetrics asynchronously reports the counts of pebble events.
+type pebbleEventMetrics struct {
+	events *PebbleEvents
+	meter  cmetric.Meter
+	health *health
+
+	// compactions reports the total number of finished compactions, tagged by
+	// whether they failed.
+	compactions cmetric.Int64ObservableCounter
+	// flushes reports the total number of finished flushes, tagged by whether
+	// they failed.
+	flushes cmetric.Int64ObservableCounter
+	// diskSlow reports the total number of disk operations that exceeded the
+	// slowness threshold, tagged by operation type.
+	diskSlow cmetric.Int64ObservableCounter
+	// backgroundErrors reports the total number of background errors.
+	backgroundErrors cmetric.Int64ObservableCounter
+	// writeStalls reports the total number of write stalls.
+	writeStalls cmetric.Int64ObservableCounter
+	// writeStallDuration reports the total time spent in write stalls.
+	writeStallDuration cmetric.Int64ObservableCounter
+	// writeStalled reports 1 if writes are currently stalled, 0 otherwise.
+	writeStalled cmetric.Int64ObservableGauge
+}
+
+func (pem *pebbleEventMetrics) start() error {
+	var err error
+
+	if pem.compactions, err = pem.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_events_compactions",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of finished compactions."),
+	); err != nil {
+		return err
+	}
+
+	if pem.flushes, err = pem.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_events_flushes",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of finished flushes."),
+	); err != nil {
+		return err
+	}
+
+	if pem.diskSlow, err = pem.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_events_disk_slow",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of disk operations that exceeded the slowness threshold."),
+	); err != nil {
+		return err
+	}
+
+	if pem.backgroundErrors, err = pem.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_events_background_errors",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of errors that occurred during background operations."),
+	); err != nil {
+		return err
+	}
+
+	if pem.writeStalls, err = pem.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_events_write_stalls",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of write stalls."),
+	); err != nil {
+		return err
+	}
+
+	if pem.writeStallDuration, err = pem.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_events_write_stall_duration",
+		cmetric.WithUnit("ms"),
+		cmetric.WithDescription("The total time writes have been stalled."),
+	); err != nil {
+		return err
+	}
+
+	if pem.writeStalled, err = pem.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_events_write_stalled",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("Whether writes are currently stalled; 1 if stalled, 0 otherwise."),
+	); err != nil {
+		return err
+	}
+
+	_, err = pem.meter.RegisterCallback(
+		pem.health.guard("pebble_events", pem.reportAsyncMetrics),
+		pem.compactions,
+		pem.flushes,
+		pem.diskSlow,
+		pem.backgroundErrors,
+		pem.writeStalls,
+		pem.writeStallDuration,
+		pem.writeStalled,
+	)
+	return err
+}
+
+func (pem *pebbleEventMetrics) reportAsyncMetrics(_ context.Context, o cmetric.Observer) error {
+	e := pem.events
+
+	compactionErrors := e.compactionErrors.Load()
+	o.ObserveInt64(pem.compactions, e.compactions.Load()-compactionErrors, cmetric.WithAttributes(attribute.Bool("failed", false)))
+	o.ObserveInt64(pem.compactions, compactionErrors, cmetric.WithAttributes(attribute.Bool("failed", true)))
+
+	flushErrors := e.flushErrors.Load()
+	o.ObserveInt64(pem.flushes, e.flushes.Load()-flushErrors, cmetric.WithAttributes(attribute.Bool("failed", false)))
+	o.ObserveInt64(pem.flushes, flushErrors, cmetric.WithAttributes(attribute.Bool("failed", true)))
+
+	e.diskSlowOpsLock.Lock()
+	for op, count := range e.diskSlowOps {
+		o.ObserveInt64(pem.diskSlow, count, cmetric.WithAttributes(attribute.String("op", op)))
+	}
+	e.diskSlowOpsLock.Unlock()
+
+	o.ObserveInt64(pem.backgroundErrors, e.backgroundErrors.Load())
+	o.ObserveInt64(pem.writeStalls, e.writeStalls.Load())
+	o.ObserveInt64(pem.writeStallDuration, e.writeStallDuration.Load())
+	var stalled int64
+	if e.WriteStalled() {
+		stalled = 1
+	}
+	o.ObserveInt64(pem.writeStalled, stalled)
+	return nil
+}
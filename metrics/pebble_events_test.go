@@ -0,0 +1,68 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/vfs"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebbleEvents_AreCountedAndExported(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	clk := clock.NewMock(time.Now())
+	events := metrics.NewPebbleEvents(clk)
+	listener := events.EventListener()
+	listener.CompactionBegin(pebble.CompactionInfo{JobID: 1, Reason: "default"})
+	listener.CompactionEnd(pebble.CompactionInfo{JobID: 1, Reason: "default"})
+	listener.CompactionEnd(pebble.CompactionInfo{JobID: 2, Reason: "default", Err: errors.New("fish")})
+	listener.FlushEnd(pebble.FlushInfo{JobID: 3, Reason: "forced"})
+	listener.FlushEnd(pebble.FlushInfo{JobID: 4, Reason: "forced"})
+	listener.DiskSlow(pebble.DiskSlowInfo{Path: "000001.log", OpType: vfs.OpTypeSync, Duration: time.Second})
+	listener.BackgroundError(errors.New("lobster"))
+
+	// Write stalls are measured from their beginning to their end, and an end
+	// without a beginning is ignored.
+	require.False(t, events.WriteStalled())
+	listener.WriteStallBegin(pebble.WriteStallBeginInfo{Reason: "memtable count limit reached"})
+	require.True(t, events.WriteStalled())
+	clk.Add(1500 * time.Millisecond)
+	listener.WriteStallEnd()
+	require.False(t, events.WriteStalled())
+	listener.WriteStallEnd()
+	listener.WriteStallBegin(pebble.WriteStallBeginInfo{Reason: "L0 file count limit exceeded"})
+	require.True(t, events.WriteStalled())
+
+	subject, err := metrics.New(addr, nil, metrics.WithPebbleEvents(events))
+	require.NoError(t, err)
+	require.NoError(t, subject.Start(context.Background()))
+	defer subject.Shutdown(context.Background())
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), `ipni_dhstore_pebble_events_compactions_total{failed="false"} 1`)
+	require.Contains(t, string(body), `ipni_dhstore_pebble_events_compactions_total{failed="true"} 1`)
+	require.Contains(t, string(body), `ipni_dhstore_pebble_events_flushes_total{failed="false"} 2`)
+	require.Contains(t, string(body), `ipni_dhstore_pebble_events_flushes_total{failed="true"} 0`)
+	require.Contains(t, string(body), `ipni_dhstore_pebble_events_disk_slow_total{op="sync"} 1`)
+	require.Contains(t, string(body), "ipni_dhstore_pebble_events_background_errors_total 1")
+	require.Contains(t, string(body), "ipni_dhstore_pebble_events_write_stalls_total 2")
+	require.Contains(t, string(body), "ipni_dhstore_pebble_events_write_stall_duration_total 1500")
+	require.Contains(t, string(body), "ipni_dhstore_pebble_events_write_stalled 1")
+}
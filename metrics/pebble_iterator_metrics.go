@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	cmetric "go.opentelemetry.io/otel/metric"
+)
+
+// PebbleIteratorMetrics is a snapshot of the iterators open on a pebble DB.
+type PebbleIteratorMetrics struct {
+	// Open is the number of currently open iterators.
+	Open int64
+	// Leaked is the total number of iterators that were force-closed after
+	// being left idle.
+	Leaked int64
+	// Rejected is the total number of iterators that were not opened because
+	// the cap on open iterators was reached.
+	Rejected int64
+	// OldestAge is the age of the oldest open iterator.
+	OldestAge time.Duration
+}
+
+// pebbleIteratorMetrics asynchronously reports metrics of iterators open on
+// pebble DB. Open iterators pin memtables and SSTs, and leaks show up as disk
+// growth that is otherwise hard to explain.
+type pebbleIteratorMetrics struct {
+	metricsProvider func() *PebbleIteratorMetrics
+	meter           cmetric.Meter
+	health          *health
+
+	// open reports the number of currently open iterators.
+	open cmetric.Int64ObservableGauge
+	// leaked reports the total number of force-closed leaked iterators.
+	leaked cmetric.Int64ObservableCounter
+	// rejected reports the total number of iterators rejected due to the cap.
+	rejected cmetric.Int64ObservableCounter
+	// oldestAge reports the age of the oldest open iterator.
+	oldestAge cmetric.Int64ObservableGauge
+}
+
+func (im *pebbleIteratorMetrics) start() error {
+	var err error
+
+	if im.open, err = im.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_iterators_open",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of currently open iterators."),
+	); err != nil {
+		return err
+	}
+
+	if im.leaked, err = im.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_iterators_leaked",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of iterators that were force-closed after being left idle."),
+	); err != nil {
+		return err
+	}
+
+	if im.rejected, err = im.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_iterators_rejected",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of iterators that were not opened because the cap on open iterators was reached."),
+	); err != nil {
+		return err
+	}
+
+	if im.oldestAge, err = im.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_iterators_oldest_age",
+		cmetric.WithUnit("ms"),
+		cmetric.WithDescription("The age of the oldest open iterator."),
+	); err != nil {
+		return err
+	}
+
+	_, err = im.meter.RegisterCallback(
+		im.health.guard("pebble_iterators", im.reportAsyncMetrics),
+		im.open,
+		im.leaked,
+		im.rejected,
+		im.oldestAge,
+	)
+	return err
+}
+
+func (im *pebbleIteratorMetrics) reportAsyncMetrics(_ context.Context, o cmetric.Observer) error {
+	m := im.metricsProvider()
+
+	o.ObserveInt64(im.open, m.Open)
+	o.ObserveInt64(im.leaked, m.Leaked)
+	o.ObserveInt64(im.rejected, m.Rejected)
+	o.ObserveInt64(im.oldestAge, m.OldestAge.Milliseconds())
+	return nil
+}
@@ -2,208 +2,343 @@ package metrics
 
 import (
 	"context"
+	"time"
 
 	"github.com/cockroachdb/pebble"
+	dto "github.com/prometheus/client_model/go"
 	"go.opentelemetry.io/otel/attribute"
 	cmetric "go.opentelemetry.io/otel/metric"
-	"go.opentelemetry.io/otel/metric/instrument"
-	"go.opentelemetry.io/otel/metric/instrument/asyncint64"
-	"go.opentelemetry.io/otel/metric/unit"
 )
 
 // pebbleMetrics asynchronously reports metrics of pebble DB
 type pebbleMetrics struct {
 	metricsProvider func() *pebble.Metrics
 	meter           cmetric.Meter
+	health          *health
 
 	// flushCount reports the total number of flushes
-	flushCount asyncint64.Gauge
+	flushCount cmetric.Int64ObservableGauge
 	// readAdmp reports current read amplification of the database.
 	// It's computed as the number of sublevels in L0 + the number of non-empty
 	// levels below L0.
 	// Read amplification factor should be in the single digits. A value exceeding 50 for 1 hour
 	// strongly suggests that the LSM tree has an unhealthy shape.
-	readAmp asyncint64.Gauge
+	readAmp cmetric.Int64ObservableGauge
 
 	// NOTE: cache metrics report tagged values for both block and table caches
 	// cacheSize reports the number of bytes inuse by the cache
-	cacheSize asyncint64.Gauge
+	cacheSize cmetric.Int64ObservableGauge
 	// cacheCount reports the count of objects (blocks or tables) in the cache
-	cacheCount asyncint64.Gauge
+	cacheCount cmetric.Int64ObservableGauge
 	// cacheHits reports number of cache hits
-	cacheHits asyncint64.Gauge
+	cacheHits cmetric.Int64ObservableGauge
 	// cacheMisses reports number of cache misses.
-	cacheMisses asyncint64.Gauge
+	cacheMisses cmetric.Int64ObservableGauge
 
 	// compactCount is the total number of compactions, and per-compaction type counts.
-	compactCount asyncint64.Gauge
+	compactCount cmetric.Int64ObservableGauge
 	// compactEstimatedDebt is an estimate of the number of bytes that need to be compacted for the LSM
 	// to reach a stable state.
-	compactEstimatedDebt asyncint64.Gauge
+	compactEstimatedDebt cmetric.Int64ObservableGauge
 	// compactInProgressBytes is a number of bytes present in sstables being written by in-progress
 	// compactions. This value will be zero if there are no in-progress
 	// compactions.
-	compactInProgressBytes asyncint64.Gauge
+	compactInProgressBytes cmetric.Int64ObservableGauge
 	// compactNumInProgress is a number of compactions that are in-progress.
-	compactNumInProgress asyncint64.Gauge
+	compactNumInProgress cmetric.Int64ObservableGauge
 	// compactMarkedFiles is a count of files that are marked for
 	// compaction. Such files are compacted in a rewrite compaction
 	// when no other compactions are picked.
-	compactMarkedFiles asyncint64.Gauge
+	compactMarkedFiles cmetric.Int64ObservableGauge
 
 	// l0NumFiles is the total number of files in L0. The number of L0 files should not be in the high thousands.
 	// High values indicate heavy write load that is causing accumulation of files in level 0. These files are not
 	// being compacted quickly enough to lower levels, resulting in a misshapen LSM.
-	l0NumFiles asyncint64.Gauge
+	l0NumFiles cmetric.Int64ObservableGauge
+	// l0Sublevels is the number of sublevels in L0. Writes are stalled once it
+	// reaches the L0StopWritesThreshold.
+	l0Sublevels cmetric.Int64ObservableGauge
+
+	// walFiles is the number of live WAL files.
+	walFiles cmetric.Int64ObservableGauge
+	// walSize is the size of the live data in the WAL files.
+	walSize cmetric.Int64ObservableGauge
+	// walBytesIn is the number of logical bytes written to the WAL.
+	walBytesIn cmetric.Int64ObservableCounter
+	// walBytesWritten is the number of physical bytes written to the WAL.
+	walBytesWritten cmetric.Int64ObservableCounter
+	// walFsyncCount is the number of WAL fsyncs.
+	walFsyncCount cmetric.Int64ObservableCounter
+	// walFsyncLatency is the total time spent in WAL fsyncs. Together with
+	// walFsyncCount it gives the mean fsync latency.
+	walFsyncLatency cmetric.Int64ObservableCounter
+
+	// memTableSize is the number of bytes allocated by memtables and large
+	// batches. Writes are stalled once the number of memtables queued for flush
+	// reaches the MemTableStopWritesThreshold.
+	memTableSize cmetric.Int64ObservableGauge
+	// memTableCount is the number of memtables.
+	memTableCount cmetric.Int64ObservableGauge
+	// memTableZombieCount is the number of memtables no longer referenced by
+	// the current DB state but still in use by an iterator.
+	memTableZombieCount cmetric.Int64ObservableGauge
 }
 
 func (pm *pebbleMetrics) start() error {
 	var err error
 
-	if pm.flushCount, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/flush_count",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("The total number of flushes."),
+	if pm.flushCount, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_flush_count",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of flushes."),
 	); err != nil {
 		return err
 	}
 
-	if pm.readAmp, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/read_amp",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("current read amplification of the database. "+
+	if pm.readAmp, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_read_amp",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("current read amplification of the database. "+
 			"It's computed as the number of sublevels in L0 + the number of non-empty"+
 			" levels below L0."),
 	); err != nil {
 		return err
 	}
 
-	if pm.cacheSize, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/cache_size",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("The number of bytes inuse by the cache."),
+	if pm.cacheSize, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_cache_size",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of bytes inuse by the cache."),
 	); err != nil {
 		return err
 	}
 
-	if pm.cacheCount, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/cache_count",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("The count of objects (blocks or tables) in the cache."),
+	if pm.cacheCount, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_cache_count",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The count of objects (blocks or tables) in the cache."),
 	); err != nil {
 		return err
 	}
 
-	if pm.cacheHits, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/cache_hits",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("The number of cache hits."),
+	if pm.cacheHits, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_cache_hits",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of cache hits."),
 	); err != nil {
 		return err
 	}
 
-	if pm.cacheMisses, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/cache_misses",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("The number of cache misses."),
+	if pm.cacheMisses, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_cache_misses",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of cache misses."),
 	); err != nil {
 		return err
 	}
 
-	if pm.compactCount, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/compact_count",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("The total number of compactions, and per-compaction type counts."),
+	if pm.compactCount, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_compact_count",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of compactions, and per-compaction type counts."),
 	); err != nil {
 		return err
 	}
 
-	if pm.compactEstimatedDebt, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/compact_estimated_debt",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("An estimate of the number of bytes that need to be compacted for the LSM"+
+	if pm.compactEstimatedDebt, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_compact_estimated_debt",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("An estimate of the number of bytes that need to be compacted for the LSM"+
 			" to reach a stable state."),
 	); err != nil {
 		return err
 	}
 
-	if pm.compactInProgressBytes, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/compact_in_progress_bytes",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("A number of bytes present in sstables being written by in-progress"+
+	if pm.compactInProgressBytes, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_compact_in_progress_bytes",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("A number of bytes present in sstables being written by in-progress"+
 			" compactions. This value will be zero if there are no in-progress"+
 			" compactions."),
 	); err != nil {
 		return err
 	}
 
-	if pm.compactNumInProgress, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/compact_num_in_progress",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("A number of compactions that are in-progress."),
+	if pm.compactNumInProgress, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_compact_num_in_progress",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("A number of compactions that are in-progress."),
 	); err != nil {
 		return err
 	}
 
-	if pm.compactMarkedFiles, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/compact_marked_files",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("A count of files that are marked for"+
+	if pm.compactMarkedFiles, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_compact_marked_files",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("A count of files that are marked for"+
 			" compaction. Such files are compacted in a rewrite compaction"+
 			" when no other compactions are picked."),
 	); err != nil {
 		return err
 	}
 
-	if pm.l0NumFiles, err = pm.meter.AsyncInt64().Gauge(
-		"ipni/dhstore/pebble/compact_l0_num_files",
-		instrument.WithUnit(unit.Dimensionless),
-		instrument.WithDescription("The total number of files in L0. The number of L0 files should not be in the high thousands."+
+	if pm.l0NumFiles, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_compact_l0_num_files",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of files in L0. The number of L0 files should not be in the high thousands."+
 			" High values indicate heavy write load that is causing accumulation of files in level 0. These files are not"+
 			" being compacted quickly enough to lower levels, resulting in a misshapen LSM."),
 	); err != nil {
 		return err
 	}
 
-	return pm.meter.RegisterCallback(
-		[]instrument.Asynchronous{
-			pm.flushCount,
-			pm.readAmp,
-			pm.cacheCount,
-			pm.cacheSize,
-			pm.cacheHits,
-			pm.cacheMisses,
-			pm.compactCount,
-			pm.compactEstimatedDebt,
-			pm.compactInProgressBytes,
-			pm.compactNumInProgress,
-			pm.compactMarkedFiles,
-			pm.l0NumFiles,
-		},
-		pm.reportAsyncMetrics,
+	if pm.l0Sublevels, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_l0_sublevels",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of sublevels in L0. Writes are stalled once it reaches the L0 stop writes threshold."),
+	); err != nil {
+		return err
+	}
+
+	if pm.walFiles, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_wal_files",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of live WAL files."),
+	); err != nil {
+		return err
+	}
+
+	if pm.walSize, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_wal_size",
+		cmetric.WithUnit("By"),
+		cmetric.WithDescription("The size of the live data in the WAL files."),
+	); err != nil {
+		return err
+	}
+
+	if pm.walBytesIn, err = pm.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_wal_bytes_in",
+		cmetric.WithUnit("By"),
+		cmetric.WithDescription("The number of logical bytes written to the WAL."),
+	); err != nil {
+		return err
+	}
+
+	if pm.walBytesWritten, err = pm.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_wal_bytes_written",
+		cmetric.WithUnit("By"),
+		cmetric.WithDescription("The number of physical bytes written to the WAL."),
+	); err != nil {
+		return err
+	}
+
+	if pm.walFsyncCount, err = pm.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_wal_fsync_count",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of WAL fsyncs."),
+	); err != nil {
+		return err
+	}
+
+	if pm.walFsyncLatency, err = pm.meter.Int64ObservableCounter(
+		"ipni_dhstore_pebble_wal_fsync_latency",
+		cmetric.WithUnit("ms"),
+		cmetric.WithDescription("The total time spent in WAL fsyncs."),
+	); err != nil {
+		return err
+	}
+
+	if pm.memTableSize, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_memtable_size",
+		cmetric.WithUnit("By"),
+		cmetric.WithDescription("The number of bytes allocated by memtables and large batches."),
+	); err != nil {
+		return err
+	}
+
+	if pm.memTableCount, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_memtable_count",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of memtables."),
+	); err != nil {
+		return err
+	}
+
+	if pm.memTableZombieCount, err = pm.meter.Int64ObservableGauge(
+		"ipni_dhstore_pebble_memtable_zombie_count",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The number of memtables no longer referenced by the current DB state but still in use by an iterator."),
+	); err != nil {
+		return err
+	}
+
+	_, err = pm.meter.RegisterCallback(
+		pm.health.guard("pebble", pm.reportAsyncMetrics),
+		pm.flushCount,
+		pm.readAmp,
+		pm.cacheCount,
+		pm.cacheSize,
+		pm.cacheHits,
+		pm.cacheMisses,
+		pm.compactCount,
+		pm.compactEstimatedDebt,
+		pm.compactInProgressBytes,
+		pm.compactNumInProgress,
+		pm.compactMarkedFiles,
+		pm.l0NumFiles,
+		pm.l0Sublevels,
+		pm.walFiles,
+		pm.walSize,
+		pm.walBytesIn,
+		pm.walBytesWritten,
+		pm.walFsyncCount,
+		pm.walFsyncLatency,
+		pm.memTableSize,
+		pm.memTableCount,
+		pm.memTableZombieCount,
 	)
+	return err
 }
 
-func (pm *pebbleMetrics) reportAsyncMetrics(ctx context.Context) {
+func (pm *pebbleMetrics) reportAsyncMetrics(_ context.Context, o cmetric.Observer) error {
 	m := pm.metricsProvider()
 
-	pm.flushCount.Observe(ctx, m.Flush.Count)
-	pm.readAmp.Observe(ctx, int64(m.ReadAmp()))
-	pm.cacheCount.Observe(ctx, m.BlockCache.Count, attribute.String("cache", "block"))
-	pm.cacheSize.Observe(ctx, m.BlockCache.Size, attribute.String("cache", "block"))
-	pm.cacheHits.Observe(ctx, m.BlockCache.Hits, attribute.String("cache", "block"))
-	pm.cacheMisses.Observe(ctx, m.BlockCache.Misses, attribute.String("cache", "block"))
-
-	pm.cacheCount.Observe(ctx, m.TableCache.Count, attribute.String("cache", "table"))
-	pm.cacheSize.Observe(ctx, m.TableCache.Size, attribute.String("cache", "table"))
-	pm.cacheHits.Observe(ctx, m.TableCache.Hits, attribute.String("cache", "table"))
-	pm.cacheMisses.Observe(ctx, m.TableCache.Misses, attribute.String("cache", "table"))
-
-	pm.compactCount.Observe(ctx, int64(m.Compact.Count))
-	pm.compactEstimatedDebt.Observe(ctx, int64(m.Compact.EstimatedDebt))
-	pm.compactInProgressBytes.Observe(ctx, int64(m.Compact.InProgressBytes))
-	pm.compactNumInProgress.Observe(ctx, int64(m.Compact.NumInProgress))
-	pm.compactMarkedFiles.Observe(ctx, int64(m.Compact.MarkedFiles))
-
-	pm.l0NumFiles.Observe(ctx, int64(m.Levels[0].NumFiles))
+	o.ObserveInt64(pm.flushCount, m.Flush.Count)
+	o.ObserveInt64(pm.readAmp, int64(m.ReadAmp()))
+	o.ObserveInt64(pm.cacheCount, m.BlockCache.Count, cmetric.WithAttributes(attribute.String("cache", "block")))
+	o.ObserveInt64(pm.cacheSize, m.BlockCache.Size, cmetric.WithAttributes(attribute.String("cache", "block")))
+	o.ObserveInt64(pm.cacheHits, m.BlockCache.Hits, cmetric.WithAttributes(attribute.String("cache", "block")))
+	o.ObserveInt64(pm.cacheMisses, m.BlockCache.Misses, cmetric.WithAttributes(attribute.String("cache", "block")))
+
+	o.ObserveInt64(pm.cacheCount, m.TableCache.Count, cmetric.WithAttributes(attribute.String("cache", "table")))
+	o.ObserveInt64(pm.cacheSize, m.TableCache.Size, cmetric.WithAttributes(attribute.String("cache", "table")))
+	o.ObserveInt64(pm.cacheHits, m.TableCache.Hits, cmetric.WithAttributes(attribute.String("cache", "table")))
+	o.ObserveInt64(pm.cacheMisses, m.TableCache.Misses, cmetric.WithAttributes(attribute.String("cache", "table")))
+
+	o.ObserveInt64(pm.compactCount, int64(m.Compact.Count))
+	o.ObserveInt64(pm.compactEstimatedDebt, int64(m.Compact.EstimatedDebt))
+	o.ObserveInt64(pm.compactInProgressBytes, int64(m.Compact.InProgressBytes))
+	o.ObserveInt64(pm.compactNumInProgress, int64(m.Compact.NumInProgress))
+	o.ObserveInt64(pm.compactMarkedFiles, int64(m.Compact.MarkedFiles))
+
+	o.ObserveInt64(pm.l0NumFiles, int64(m.Levels[0].NumFiles))
+	o.ObserveInt64(pm.l0Sublevels, int64(m.Levels[0].Sublevels))
+
+	o.ObserveInt64(pm.walFiles, m.WAL.Files)
+	o.ObserveInt64(pm.walSize, int64(m.WAL.Size))
+	o.ObserveInt64(pm.walBytesIn, int64(m.WAL.BytesIn))
+	o.ObserveInt64(pm.walBytesWritten, int64(m.WAL.BytesWritten))
+	if m.LogWriter.FsyncLatency != nil {
+		var fsync dto.Metric
+		if err := m.LogWriter.FsyncLatency.Write(&fsync); err == nil && fsync.Histogram != nil {
+			o.ObserveInt64(pm.walFsyncCount, int64(fsync.Histogram.GetSampleCount()))
+			// Pebble records fsync latencies in nanoseconds.
+			o.ObserveInt64(pm.walFsyncLatency, int64(fsync.Histogram.GetSampleSum())/int64(time.Millisecond))
+		}
+	}
+
+	o.ObserveInt64(pm.memTableSize, int64(m.MemTable.Size))
+	o.ObserveInt64(pm.memTableCount, m.MemTable.Count)
+	o.ObserveInt64(pm.memTableZombieCount, m.MemTable.ZombieCount)
+	return nil
 }
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"context"
+
+	cmetric "go.opentelemetry.io/otel/metric"
+)
+
+// RecordCountMetrics is a snapshot of the estimated number of records in a
+// store.
+type RecordCountMetrics struct {
+	// Multihashes is the estimated number of multihash index records.
+	Multihashes int64
+	// Metadata is the estimated number of metadata records.
+	Metadata int64
+}
+
+// recordCountMetrics asynchronously reports the estimated number of records in
+// a store, so that the growth of the index can be tracked over time.
+type recordCountMetrics struct {
+	metricsProvider func() *RecordCountMetrics
+	meter           cmetric.Meter
+	health          *health
+
+	// multihashes reports the estimated number of multihash index records.
+	multihashes cmetric.Int64ObservableGauge
+	// metadata reports the estimated number of metadata records.
+	metadata cmetric.Int64ObservableGauge
+}
+
+func (rm *recordCountMetrics) start() error {
+	var err error
+
+	if rm.multihashes, err = rm.meter.Int64ObservableGauge(
+		"ipni_dhstore_records_multihashes",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The estimated number of multihash index records in the store."),
+	); err != nil {
+		return err
+	}
+
+	if rm.metadata, err = rm.meter.Int64ObservableGauge(
+		"ipni_dhstore_records_metadata",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The estimated number of metadata records in the store."),
+	); err != nil {
+		return err
+	}
+
+	_, err = rm.meter.RegisterCallback(
+		rm.health.guard("records", rm.reportAsyncMetrics),
+		rm.multihashes,
+		rm.metadata,
+	)
+	return err
+}
+
+func (rm *recordCountMetrics) reportAsyncMetrics(_ context.Context, o cmetric.Observer) error {
+	m := rm.metricsProvider()
+
+	o.ObserveInt64(rm.multihashes, m.Multihashes)
+	o.ObserveInt64(rm.metadata, m.Metadata)
+	return nil
+}
@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// maxSummarySamples is the maximum number of request latencies sampled per
+// summary interval, from which the percentiles of the summary are computed.
+const maxSummarySamples = 4096
+
+// summary accumulates the requests served in between periodic summaries,
+// which are logged for installations that do not scrape metrics.
+type summary struct {
+	interval              time.Duration
+	pebbleMetricsProvider func() *pebble.Metrics
+	diskUsageProvider     func() *DiskUsageMetrics
+
+	mu       sync.Mutex
+	requests int64
+	errors   int64
+	// samples is a uniform sample of the latencies of requests, maintained by
+	// reservoir sampling so that memory is bounded regardless of load.
+	samples []time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// summarySnapshot is the summary of the requests served in an interval.
+type summarySnapshot struct {
+	requests int64
+	errors   int64
+	p50      time.Duration
+	p99      time.Duration
+}
+
+func newSummary(interval time.Duration) *summary {
+	return &summary{
+		interval: interval,
+		samples:  make([]time.Duration, 0, maxSummarySamples),
+	}
+}
+
+// observe records a request served in latency, which is counted as an error
+// if failed.
+func (s *summary) observe(latency time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if failed {
+		s.errors++
+	}
+	if len(s.samples) < maxSummarySamples {
+		s.samples = append(s.samples, latency)
+	} else if i := rand.Int64N(s.requests); i < maxSummarySamples {
+		s.samples[i] = latency
+	}
+}
+
+// reset returns the summary of the requests observed since the last reset.
+func (s *summary) reset() summarySnapshot {
+	s.mu.Lock()
+	snap := summarySnapshot{requests: s.requests, errors: s.errors}
+	samples := slices.Clone(s.samples)
+	s.requests, s.errors = 0, 0
+	s.samples = s.samples[:0]
+	s.mu.Unlock()
+
+	if len(samples) != 0 {
+		slices.Sort(samples)
+		snap.p50 = percentile(samples, 0.5)
+		snap.p99 = percentile(samples, 0.99)
+	}
+	return snap
+}
+
+// percentile returns the p-th percentile of the sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func (s *summary) start() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.log()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// shutdown stops logging summaries, if started.
+func (s *summary) shutdown() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+func (s *summary) log() {
+	snap := s.reset()
+	var errorRate float64
+	if snap.requests != 0 {
+		errorRate = float64(snap.errors) / float64(snap.requests)
+	}
+	kvs := []interface{}{
+		"interval", s.interval,
+		"requests", snap.requests,
+		"errorRate", errorRate,
+		"p50", snap.p50,
+		"p99", snap.p99,
+	}
+	// Store size and compaction debt are only known for pebble stores.
+	if s.diskUsageProvider != nil {
+		if du := s.diskUsageProvider(); du != nil {
+			kvs = append(kvs, "storeSize", du.Size)
+		}
+	}
+	if s.pebbleMetricsProvider != nil {
+		kvs = append(kvs, "compactionDebt", s.pebbleMetricsProvider().Compact.EstimatedDebt)
+	}
+	log.Infow("Stats summary", kvs...)
+}
@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummary_ResetSummarizesRequestsSinceLastReset(t *testing.T) {
+	s := newSummary(time.Minute)
+	for i := 1; i <= 100; i++ {
+		s.observe(time.Duration(i)*time.Millisecond, i%10 == 0)
+	}
+
+	snap := s.reset()
+	require.Equal(t, int64(100), snap.requests)
+	require.Equal(t, int64(10), snap.errors)
+	require.Equal(t, 50*time.Millisecond, snap.p50)
+	require.Equal(t, 99*time.Millisecond, snap.p99)
+
+	require.Equal(t, summarySnapshot{}, s.reset())
+}
+
+func TestSummary_SamplesAreBounded(t *testing.T) {
+	s := newSummary(time.Minute)
+	for i := 0; i < 3*maxSummarySamples; i++ {
+		s.observe(time.Millisecond, false)
+	}
+	require.Len(t, s.samples, maxSummarySamples)
+	require.Equal(t, int64(3*maxSummarySamples), s.reset().requests)
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"context"
+
+	cmetric "go.opentelemetry.io/otel/metric"
+)
+
+// TieredLookups counts the lookups of a tiered store by the tier that served
+// them.
+type TieredLookups struct {
+	// Hot is the total number of lookups served by the hot tier.
+	Hot int64
+	// Cold is the total number of lookups that missed the hot tier and were
+	// served by the cold tier.
+	Cold int64
+	// Miss is the total number of lookups that missed both tiers.
+	Miss int64
+}
+
+// TieredMetrics is a snapshot of the metrics of a tiered store.
+type TieredMetrics struct {
+	// Multihash counts multihash lookups.
+	Multihash TieredLookups
+	// Metadata counts metadata lookups.
+	Metadata TieredLookups
+	// ColdFailures is the total number of failed cold tier operations.
+	ColdFailures int64
+}
+
+// tieredMetrics asynchronously reports metrics of a tiered store.
+//
+// Lookups are reported by one counter per type of lookup and tier rather than
+// a single counter tagged with attributes, which earlier versions of the
+// prometheus exporter mangled the names of, so that the names of the metrics
+// remain stable.
+type tieredMetrics struct {
+	metricsProvider func() *TieredMetrics
+	meter           cmetric.Meter
+	health          *health
+
+	// lookups reports the total number of lookups of each type served by
+	// each tier, keyed by type of lookup.
+	lookups map[string]tieredLookupCounters
+	// coldFailures reports the total number of failed cold tier operations.
+	coldFailures cmetric.Int64ObservableCounter
+}
+
+type tieredLookupCounters struct {
+	hot  cmetric.Int64ObservableCounter
+	cold cmetric.Int64ObservableCounter
+	miss cmetric.Int64ObservableCounter
+}
+
+func (tm *tieredMetrics) start() error {
+	tm.lookups = make(map[string]tieredLookupCounters, 2)
+	instruments := make([]cmetric.Observable, 0, 7)
+	for _, typ := range []string{"multihash", "metadata"} {
+		var counters tieredLookupCounters
+		for _, c := range []struct {
+			counter     *cmetric.Int64ObservableCounter
+			name        string
+			description string
+		}{
+			{&counters.hot, "hot", "served by the hot tier"},
+			{&counters.cold, "cold", "that missed the hot tier and were served by the cold tier"},
+			{&counters.miss, "miss", "that missed both tiers"},
+		} {
+			var err error
+			if *c.counter, err = tm.meter.Int64ObservableCounter(
+				"ipni_dhstore_tiered_"+typ+"_lookups_"+c.name,
+				cmetric.WithUnit("1"),
+				cmetric.WithDescription("The total number of "+typ+" lookups "+c.description+"."),
+			); err != nil {
+				return err
+			}
+			instruments = append(instruments, *c.counter)
+		}
+		tm.lookups[typ] = counters
+	}
+
+	var err error
+	if tm.coldFailures, err = tm.meter.Int64ObservableCounter(
+		"ipni_dhstore_tiered_cold_failures",
+		cmetric.WithUnit("1"),
+		cmetric.WithDescription("The total number of failed cold tier operations."),
+	); err != nil {
+		return err
+	}
+	instruments = append(instruments, tm.coldFailures)
+
+	_, err = tm.meter.RegisterCallback(tm.health.guard("tiered", tm.reportAsyncMetrics), instruments...)
+	return err
+}
+
+func (tm *tieredMetrics) reportAsyncMetrics(_ context.Context, o cmetric.Observer) error {
+	m := tm.metricsProvider()
+
+	for typ, lookups := range map[string]TieredLookups{"multihash": m.Multihash, "metadata": m.Metadata} {
+		counters := tm.lookups[typ]
+		o.ObserveInt64(counters.hot, lookups.Hot)
+		o.ObserveInt64(counters.cold, lookups.Cold)
+		o.ObserveInt64(counters.miss, lookups.Miss)
+	}
+	o.ObserveInt64(tm.coldFailures, m.ColdFailures)
+	return nil
+}
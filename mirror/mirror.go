@@ -0,0 +1,249 @@
+// Package mirror implements a composite DHStore that applies every write to a
+// primary store and to a set of target stores, e.g. to dual-write into a new
+// backend during a live migration.
+//
+// Reads are served by the primary store only. Writes to targets are either
+// synchronous, in which case the failures of all stores are returned, or
+// asynchronous, in which case they are queued per target and failures are
+// only logged. Either way, writes and failures are counted per target.
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/metrics"
+	"github.com/multiformats/go-multihash"
+)
+
+// primaryName identifies the primary store in logs and metrics.
+const primaryName = "primary"
+
+var (
+	_ dhstore.DHStore               = (*MirrorDHStore)(nil)
+	_ dhstore.MetadataBatchPutter   = (*MirrorDHStore)(nil)
+	_ dhstore.WritePressureReporter = (*MirrorDHStore)(nil)
+	_ dhstore.HealthReporter        = (*MirrorDHStore)(nil)
+
+	logger = logging.Logger("store/mirror")
+)
+
+type MirrorDHStore struct {
+	primary *target
+	targets []*target
+	async   bool
+	wg      sync.WaitGroup
+}
+
+// write applies a write to a store.
+type write func(dhstore.DHStore) error
+
+type target struct {
+	name  string
+	store dhstore.DHStore
+	queue chan write
+
+	writes   atomic.Int64
+	failures atomic.Int64
+	dropped  atomic.Int64
+}
+
+// apply applies the given write to the target, counting it and its failure.
+func (t *target) apply(w write) error {
+	t.writes.Add(1)
+	if err := w(t.store); err != nil {
+		t.failures.Add(1)
+		return fmt.Errorf("failed to write to %s: %w", t.name, err)
+	}
+	return nil
+}
+
+func (t *target) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for w := range t.queue {
+		if err := t.apply(w); err != nil {
+			logger.Warnw("Failed to mirror write", "err", err)
+		}
+	}
+}
+
+// NewMirrorDHStore returns a store that serves reads from primary, and applies
+// writes to both primary and the targets set via WithTarget. Closing the
+// returned store closes primary and all targets.
+func NewMirrorDHStore(primary dhstore.DHStore, o ...Option) (*MirrorDHStore, error) {
+	opts, err := newOptions(o...)
+	if err != nil {
+		return nil, err
+	}
+	s := &MirrorDHStore{
+		primary: &target{name: primaryName, store: primary},
+		async:   opts.queueSize > 0,
+	}
+	for _, t := range opts.targets {
+		if s.async {
+			t.queue = make(chan write, opts.queueSize)
+			s.wg.Add(1)
+			go t.run(&s.wg)
+		}
+		s.targets = append(s.targets, t)
+	}
+	return s, nil
+}
+
+// mirror applies the given write to the primary store, then to all targets.
+func (s *MirrorDHStore) mirror(w write) error {
+	if err := s.primary.apply(w); err != nil {
+		return err
+	}
+	if s.async {
+		for _, t := range s.targets {
+			select {
+			case t.queue <- w:
+			default:
+				t.dropped.Add(1)
+				logger.Warnw("Dropped mirrored write; queue is full", "target", t.name)
+			}
+		}
+		return nil
+	}
+	errs := make([]error, len(s.targets))
+	var wg sync.WaitGroup
+	for i, t := range s.targets {
+		wg.Add(1)
+		go func(i int, t *target) {
+			defer wg.Done()
+			errs[i] = t.apply(w)
+		}(i, t)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *MirrorDHStore) MergeIndexes(indexes []dhstore.Index) error {
+	return s.mirror(func(store dhstore.DHStore) error {
+		return store.MergeIndexes(indexes)
+	})
+}
+
+func (s *MirrorDHStore) DeleteIndexes(indexes []dhstore.Index) error {
+	return s.mirror(func(store dhstore.DHStore) error {
+		return store.DeleteIndexes(indexes)
+	})
+}
+
+func (s *MirrorDHStore) PutMetadata(hvk dhstore.HashedValueKey, em dhstore.EncryptedMetadata) error {
+	return s.mirror(func(store dhstore.DHStore) error {
+		return store.PutMetadata(hvk, em)
+	})
+}
+
+func (s *MirrorDHStore) PutMetadataBatch(records []dhstore.Metadata) error {
+	return s.mirror(func(store dhstore.DHStore) error {
+		if batcher, ok := store.(dhstore.MetadataBatchPutter); ok {
+			return batcher.PutMetadataBatch(records)
+		}
+		for _, record := range records {
+			if err := store.PutMetadata(record.Key, record.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *MirrorDHStore) DeleteMetadata(hvk dhstore.HashedValueKey) error {
+	return s.mirror(func(store dhstore.DHStore) error {
+		return store.DeleteMetadata(hvk)
+	})
+}
+
+func (s *MirrorDHStore) DeleteMetadataBatch(hvks []dhstore.HashedValueKey) error {
+	return s.mirror(func(store dhstore.DHStore) error {
+		if batcher, ok := store.(dhstore.MetadataBatchDeleter); ok {
+			return batcher.DeleteMetadataBatch(hvks)
+		}
+		for _, hvk := range hvks {
+			if err := store.DeleteMetadata(hvk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *MirrorDHStore) Lookup(mh multihash.Multihash) ([]dhstore.EncryptedValueKey, error) {
+	return s.primary.store.Lookup(mh)
+}
+
+func (s *MirrorDHStore) GetMetadata(hvk dhstore.HashedValueKey) (dhstore.EncryptedMetadata, error) {
+	return s.primary.store.GetMetadata(hvk)
+}
+
+// WritePressure reports the highest write pressure of the primary store and,
+// unless writes to targets are asynchronous, of the targets.
+func (s *MirrorDHStore) WritePressure() float64 {
+	var pressure float64
+	for _, t := range s.syncTargets() {
+		if reporter, ok := t.store.(dhstore.WritePressureReporter); ok {
+			pressure = max(pressure, reporter.WritePressure())
+		}
+	}
+	return pressure
+}
+
+// Healthy returns the first error reported by the primary store or, unless
+// writes to targets are asynchronous, by a target.
+func (s *MirrorDHStore) Healthy() error {
+	for _, t := range s.syncTargets() {
+		if reporter, ok := t.store.(dhstore.HealthReporter); ok {
+			if err := reporter.Healthy(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syncTargets returns the stores whose writes block the caller.
+func (s *MirrorDHStore) syncTargets() []*target {
+	if s.async {
+		return []*target{s.primary}
+	}
+	return append([]*target{s.primary}, s.targets...)
+}
+
+// Metrics returns a snapshot of the write counters of the primary store and
+// each target.
+func (s *MirrorDHStore) Metrics() *metrics.MirrorMetrics {
+	var m metrics.MirrorMetrics
+	for _, t := range append([]*target{s.primary}, s.targets...) {
+		m.Targets = append(m.Targets, metrics.MirrorTargetMetrics{
+			Name:     t.name,
+			Writes:   t.writes.Load(),
+			Failures: t.failures.Load(),
+			Dropped:  t.dropped.Load(),
+			Pending:  int64(len(t.queue)),
+		})
+	}
+	return &m
+}
+
+// Close waits for queued writes to be applied, then closes the primary store
+// and all targets.
+func (s *MirrorDHStore) Close() error {
+	for _, t := range s.targets {
+		if t.queue != nil {
+			close(t.queue)
+		}
+	}
+	s.wg.Wait()
+	errs := []error{s.primary.store.Close()}
+	for _, t := range s.targets {
+		errs = append(errs, t.store.Close())
+	}
+	return errors.Join(errs...)
+}
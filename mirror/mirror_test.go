@@ -0,0 +1,114 @@
+package mirror_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/internal/testutil"
+	"github.com/ipni/dhstore/metrics"
+	"github.com/ipni/dhstore/mirror"
+	"github.com/ipni/dhstore/pebble"
+	"github.com/stretchr/testify/require"
+)
+
+// failingStore is a target whose writes all fail.
+type failingStore struct {
+	*pebble.PebbleDHStore
+}
+
+func (failingStore) MergeIndexes([]dhstore.Index) error {
+	return errors.New("fish")
+}
+
+func newPebbleStore(t *testing.T) *pebble.PebbleDHStore {
+	return newPebbleStoreAt(t, t.TempDir())
+}
+
+func newPebbleStoreAt(t *testing.T, path string) *pebble.PebbleDHStore {
+	s, err := pebble.NewPebbleDHStore(path, nil)
+	require.NoError(t, err)
+	return s
+}
+
+func TestMirrorDHStore_MirrorsWrites(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		name := "sync"
+		if async {
+			name = "async"
+		}
+		t.Run(name, func(t *testing.T) {
+			primaryPath, targetPath := t.TempDir(), t.TempDir()
+			primary, target := newPebbleStoreAt(t, primaryPath), newPebbleStoreAt(t, targetPath)
+			opts := []mirror.Option{mirror.WithTarget("target", target)}
+			if async {
+				opts = append(opts, mirror.WithAsync(10))
+			}
+			subject, err := mirror.NewMirrorDHStore(primary, opts...)
+			require.NoError(t, err)
+
+			mh := testutil.RandomDblSha256(t)
+			require.NoError(t, subject.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}, {Key: mh, Value: []byte("lobster")}}))
+			require.NoError(t, subject.DeleteIndexes([]dhstore.Index{{Key: mh, Value: []byte("lobster")}}))
+			require.NoError(t, subject.PutMetadataBatch([]dhstore.Metadata{{Key: []byte("barreleye"), Value: []byte("anglerfish")}}))
+			require.NoError(t, subject.PutMetadata([]byte("squid"), []byte("cuttlefish")))
+			require.NoError(t, subject.DeleteMetadata([]byte("squid")))
+
+			// Closing waits for queued writes to be applied.
+			require.NoError(t, subject.Close())
+
+			for _, path := range []string{primaryPath, targetPath} {
+				s := newPebbleStoreAt(t, path)
+				got, err := s.Lookup(mh)
+				require.NoError(t, err)
+				require.Equal(t, []dhstore.EncryptedValueKey{[]byte("fish")}, got)
+				md, err := s.GetMetadata([]byte("barreleye"))
+				require.NoError(t, err)
+				require.Equal(t, dhstore.EncryptedMetadata("anglerfish"), md)
+				md, err = s.GetMetadata([]byte("squid"))
+				require.NoError(t, err)
+				require.Nil(t, md)
+				require.NoError(t, s.Close())
+			}
+			require.Equal(t, &metrics.MirrorMetrics{Targets: []metrics.MirrorTargetMetrics{
+				{Name: "primary", Writes: 5},
+				{Name: "target", Writes: 5},
+			}}, subject.Metrics())
+		})
+	}
+}
+
+func TestMirrorDHStore_CountsTargetFailures(t *testing.T) {
+	primary := newPebbleStore(t)
+	subject, err := mirror.NewMirrorDHStore(primary,
+		mirror.WithTarget("healthy", newPebbleStore(t)),
+		mirror.WithTarget("failing", failingStore{newPebbleStore(t)}))
+	require.NoError(t, err)
+	defer subject.Close()
+
+	mh := testutil.RandomDblSha256(t)
+	err = subject.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}})
+	require.ErrorContains(t, err, "failed to write to failing: fish")
+	got, err := subject.Lookup(mh)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("fish")}, got)
+
+	require.Equal(t, &metrics.MirrorMetrics{Targets: []metrics.MirrorTargetMetrics{
+		{Name: "primary", Writes: 1},
+		{Name: "healthy", Writes: 1},
+		{Name: "failing", Writes: 1, Failures: 1},
+	}}, subject.Metrics())
+}
+
+func TestNewMirrorDHStore_RejectsInvalidOptions(t *testing.T) {
+	primary := newPebbleStore(t)
+	defer primary.Close()
+	_, err := mirror.NewMirrorDHStore(primary)
+	require.ErrorContains(t, err, "at least one target")
+	_, err = mirror.NewMirrorDHStore(primary, mirror.WithTarget("primary", primary))
+	require.ErrorContains(t, err, "target name")
+	_, err = mirror.NewMirrorDHStore(primary, mirror.WithTarget("fish", primary), mirror.WithTarget("fish", primary))
+	require.ErrorContains(t, err, "already specified")
+	_, err = mirror.NewMirrorDHStore(primary, mirror.WithTarget("fish", primary), mirror.WithAsync(-1))
+	require.ErrorContains(t, err, "queue size")
+}
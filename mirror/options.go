@@ -0,0 +1,63 @@
+package mirror
+
+import (
+	"fmt"
+
+	"github.com/ipni/dhstore"
+)
+
+type (
+	Option  func(*options) error
+	options struct {
+		targets   []*target
+		queueSize int
+	}
+)
+
+func newOptions(o ...Option) (*options, error) {
+	var opts options
+	for _, apply := range o {
+		if err := apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.targets) == 0 {
+		return nil, fmt.Errorf("at least one target must be specified")
+	}
+	return &opts, nil
+}
+
+// WithTarget adds a store to which writes are mirrored, identified by the
+// given name in logs and metrics. Required at least once, and may be repeated
+// with distinct names.
+func WithTarget(name string, store dhstore.DHStore) Option {
+	return func(o *options) error {
+		if name == "" || name == primaryName {
+			return fmt.Errorf("target name must be non-empty and not %q", primaryName)
+		}
+		if store == nil {
+			return fmt.Errorf("target %s must not be nil", name)
+		}
+		for _, t := range o.targets {
+			if t.name == name {
+				return fmt.Errorf("target %s is already specified", name)
+			}
+		}
+		o.targets = append(o.targets, &target{name: name, store: store})
+		return nil
+	}
+}
+
+// WithAsync sets the number of writes queued for each target, and makes writes
+// to targets asynchronous. Writes then return once applied to the primary
+// store, and writes to a target whose queue is full are dropped. Writes are
+// synchronous when zero, which is the default.
+func WithAsync(queueSize int) Option {
+	return func(o *options) error {
+		if queueSize < 0 {
+			return fmt.Errorf("queue size must not be negative; got: %d", queueSize)
+		}
+		o.queueSize = queueSize
+		return nil
+	}
+}
@@ -0,0 +1,352 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             v4.25.3
+// source: dhstore.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	DHStore_MergeIndexes_FullMethodName   = "/ipni.dhstore.v1.DHStore/MergeIndexes"
+	DHStore_DeleteIndexes_FullMethodName  = "/ipni.dhstore.v1.DHStore/DeleteIndexes"
+	DHStore_Lookup_FullMethodName         = "/ipni.dhstore.v1.DHStore/Lookup"
+	DHStore_PutMetadata_FullMethodName    = "/ipni.dhstore.v1.DHStore/PutMetadata"
+	DHStore_GetMetadata_FullMethodName    = "/ipni.dhstore.v1.DHStore/GetMetadata"
+	DHStore_DeleteMetadata_FullMethodName = "/ipni.dhstore.v1.DHStore/DeleteMetadata"
+)
+
+// DHStoreClient is the client API for DHStore service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// DHStore serves the encrypted index records and metadata of a dhstore.
+type DHStoreClient interface {
+	// MergeIndexes merges the given encrypted value keys into the ones stored
+	// for their multihashes.
+	MergeIndexes(ctx context.Context, in *MergeIndexesRequest, opts ...grpc.CallOption) (*MergeIndexesResponse, error)
+	// DeleteIndexes removes the given encrypted value keys from the ones stored
+	// for their multihashes.
+	DeleteIndexes(ctx context.Context, in *DeleteIndexesRequest, opts ...grpc.CallOption) (*DeleteIndexesResponse, error)
+	// Lookup streams the encrypted value keys of a multihash in batches. It
+	// fails with NOT_FOUND if there are none.
+	Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (DHStore_LookupClient, error)
+	// PutMetadata stores the given encrypted metadata records.
+	PutMetadata(ctx context.Context, in *PutMetadataRequest, opts ...grpc.CallOption) (*PutMetadataResponse, error)
+	// GetMetadata returns the encrypted metadata of a hashed value key. It
+	// fails with NOT_FOUND if there is none.
+	GetMetadata(ctx context.Context, in *GetMetadataRequest, opts ...grpc.CallOption) (*GetMetadataResponse, error)
+	// DeleteMetadata removes the encrypted metadata of a hashed value key.
+	DeleteMetadata(ctx context.Context, in *DeleteMetadataRequest, opts ...grpc.CallOption) (*DeleteMetadataResponse, error)
+}
+
+type dHStoreClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDHStoreClient(cc grpc.ClientConnInterface) DHStoreClient {
+	return &dHStoreClient{cc}
+}
+
+func (c *dHStoreClient) MergeIndexes(ctx context.Context, in *MergeIndexesRequest, opts ...grpc.CallOption) (*MergeIndexesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(MergeIndexesResponse)
+	err := c.cc.Invoke(ctx, DHStore_MergeIndexes_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dHStoreClient) DeleteIndexes(ctx context.Context, in *DeleteIndexesRequest, opts ...grpc.CallOption) (*DeleteIndexesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteIndexesResponse)
+	err := c.cc.Invoke(ctx, DHStore_DeleteIndexes_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dHStoreClient) Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (DHStore_LookupClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &DHStore_ServiceDesc.Streams[0], DHStore_Lookup_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dHStoreLookupClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DHStore_LookupClient interface {
+	Recv() (*LookupResponse, error)
+	grpc.ClientStream
+}
+
+type dHStoreLookupClient struct {
+	grpc.ClientStream
+}
+
+func (x *dHStoreLookupClient) Recv() (*LookupResponse, error) {
+	m := new(LookupResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dHStoreClient) PutMetadata(ctx context.Context, in *PutMetadataRequest, opts ...grpc.CallOption) (*PutMetadataResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PutMetadataResponse)
+	err := c.cc.Invoke(ctx, DHStore_PutMetadata_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dHStoreClient) GetMetadata(ctx context.Context, in *GetMetadataRequest, opts ...grpc.CallOption) (*GetMetadataResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetMetadataResponse)
+	err := c.cc.Invoke(ctx, DHStore_GetMetadata_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dHStoreClient) DeleteMetadata(ctx context.Context, in *DeleteMetadataRequest, opts ...grpc.CallOption) (*DeleteMetadataResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteMetadataResponse)
+	err := c.cc.Invoke(ctx, DHStore_DeleteMetadata_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DHStoreServer is the server API for DHStore service.
+// All implementations must embed UnimplementedDHStoreServer
+// for forward compatibility
+//
+// DHStore serves the encrypted index records and metadata of a dhstore.
+type DHStoreServer interface {
+	// MergeIndexes merges the given encrypted value keys into the ones stored
+	// for their multihashes.
+	MergeIndexes(context.Context, *MergeIndexesRequest) (*MergeIndexesResponse, error)
+	// DeleteIndexes removes the given encrypted value keys from the ones stored
+	// for their multihashes.
+	DeleteIndexes(context.Context, *DeleteIndexesRequest) (*DeleteIndexesResponse, error)
+	// Lookup streams the encrypted value keys of a multihash in batches. It
+	// fails with NOT_FOUND if there are none.
+	Lookup(*LookupRequest, DHStore_LookupServer) error
+	// PutMetadata stores the given encrypted metadata records.
+	PutMetadata(context.Context, *PutMetadataRequest) (*PutMetadataResponse, error)
+	// GetMetadata returns the encrypted metadata of a hashed value key. It
+	// fails with NOT_FOUND if there is none.
+	GetMetadata(context.Context, *GetMetadataRequest) (*GetMetadataResponse, error)
+	// DeleteMetadata removes the encrypted metadata of a hashed value key.
+	DeleteMetadata(context.Context, *DeleteMetadataRequest) (*DeleteMetadataResponse, error)
+	mustEmbedUnimplementedDHStoreServer()
+}
+
+// UnimplementedDHStoreServer must be embedded to have forward compatible implementations.
+type UnimplementedDHStoreServer struct {
+}
+
+func (UnimplementedDHStoreServer) MergeIndexes(context.Context, *MergeIndexesRequest) (*MergeIndexesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MergeIndexes not implemented")
+}
+func (UnimplementedDHStoreServer) DeleteIndexes(context.Context, *DeleteIndexesRequest) (*DeleteIndexesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteIndexes not implemented")
+}
+func (UnimplementedDHStoreServer) Lookup(*LookupRequest, DHStore_LookupServer) error {
+	return status.Errorf(codes.Unimplemented, "method Lookup not implemented")
+}
+func (UnimplementedDHStoreServer) PutMetadata(context.Context, *PutMetadataRequest) (*PutMetadataResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PutMetadata not implemented")
+}
+func (UnimplementedDHStoreServer) GetMetadata(context.Context, *GetMetadataRequest) (*GetMetadataResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMetadata not implemented")
+}
+func (UnimplementedDHStoreServer) DeleteMetadata(context.Context, *DeleteMetadataRequest) (*DeleteMetadataResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteMetadata not implemented")
+}
+func (UnimplementedDHStoreServer) mustEmbedUnimplementedDHStoreServer() {}
+
+// UnsafeDHStoreServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DHStoreServer will
+// result in compilation errors.
+type UnsafeDHStoreServer interface {
+	mustEmbedUnimplementedDHStoreServer()
+}
+
+func RegisterDHStoreServer(s grpc.ServiceRegistrar, srv DHStoreServer) {
+	s.RegisterService(&DHStore_ServiceDesc, srv)
+}
+
+func _DHStore_MergeIndexes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MergeIndexesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DHStoreServer).MergeIndexes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DHStore_MergeIndexes_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DHStoreServer).MergeIndexes(ctx, req.(*MergeIndexesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DHStore_DeleteIndexes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteIndexesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DHStoreServer).DeleteIndexes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DHStore_DeleteIndexes_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DHStoreServer).DeleteIndexes(ctx, req.(*DeleteIndexesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DHStore_Lookup_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(LookupRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DHStoreServer).Lookup(m, &dHStoreLookupServer{ServerStream: stream})
+}
+
+type DHStore_LookupServer interface {
+	Send(*LookupResponse) error
+	grpc.ServerStream
+}
+
+type dHStoreLookupServer struct {
+	grpc.ServerStream
+}
+
+func (x *dHStoreLookupServer) Send(m *LookupResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _DHStore_PutMetadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutMetadataRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DHStoreServer).PutMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DHStore_PutMetadata_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DHStoreServer).PutMetadata(ctx, req.(*PutMetadataRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DHStore_GetMetadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMetadataRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DHStoreServer).GetMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DHStore_GetMetadata_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DHStoreServer).GetMetadata(ctx, req.(*GetMetadataRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DHStore_DeleteMetadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteMetadataRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DHStoreServer).DeleteMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DHStore_DeleteMetadata_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DHStoreServer).DeleteMetadata(ctx, req.(*DeleteMetadataRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// DHStore_ServiceDesc is the grpc.ServiceDesc for DHStore service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DHStore_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ipni.dhstore.v1.DHStore",
+	HandlerType: (*DHStoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "MergeIndexes",
+			Handler:    _DHStore_MergeIndexes_Handler,
+		},
+		{
+			MethodName: "DeleteIndexes",
+			Handler:    _DHStore_DeleteIndexes_Handler,
+		},
+		{
+			MethodName: "PutMetadata",
+			Handler:    _DHStore_PutMetadata_Handler,
+		},
+		{
+			MethodName: "GetMetadata",
+			Handler:    _DHStore_GetMetadata_Handler,
+		},
+		{
+			MethodName: "DeleteMetadata",
+			Handler:    _DHStore_DeleteMetadata_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Lookup",
+			Handler:       _DHStore_Lookup_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "dhstore.proto",
+}
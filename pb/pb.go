@@ -0,0 +1,5 @@
+// Package pb holds the protocol buffer messages and gRPC service of the
+// dhstore API, generated from dhstore.proto.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative dhstore.proto
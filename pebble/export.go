@@ -0,0 +1,132 @@
+package pebble
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipni/dhstore"
+	"github.com/multiformats/go-multihash"
+	"github.com/multiformats/go-varint"
+)
+
+var _ dhstore.Exporter = (*PebbleDHStore)(nil)
+
+// exportCursorVersion prefixes export cursors so that their encoding can
+// evolve.
+const exportCursorVersion = 1
+
+// dblSha2256Header is the multihash header of a dbl-sha2-256 multihash with
+// 32-byte digest, which is what all multihash keys begin with.
+var dblSha2256Header = append(varint.ToUvarint(multihash.DBL_SHA2_256), varint.ToUvarint(32)...)
+
+// Export calls fn for each record in the store; multihash records in digest
+// order followed by metadata records in key order. The cursor of each record
+// can be used to resume the export right after that record.
+func (s *PebbleDHStore) Export(ctx context.Context, opts dhstore.ExportOptions, fn func(dhstore.ExportRecord) error) error {
+	var resumeAfter []byte
+	if opts.Cursor != "" {
+		var err error
+		if resumeAfter, err = decodeExportCursor(opts.Cursor); err != nil {
+			return err
+		}
+	}
+
+	for _, span := range exportSpans(opts.Start, opts.End) {
+		lower := span[0]
+		if resumeAfter != nil {
+			if bytes.Compare(resumeAfter, span[1]) >= 0 {
+				// The whole span has already been exported.
+				continue
+			}
+			if bytes.Compare(resumeAfter, lower) >= 0 {
+				// Resume from the key immediately after the cursor.
+				lower = append(bytes.Clone(resumeAfter), 0)
+			}
+		}
+		if err := s.exportSpan(ctx, lower, span[1], fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PebbleDHStore) exportSpan(ctx context.Context, lower, upper []byte, fn func(dhstore.ExportRecord) error) error {
+	iter, err := s.newIter("export", &pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := iter.Key()
+		record := dhstore.ExportRecord{
+			Cursor: encodeExportCursor(key),
+		}
+		switch keyPrefix(key[0]) {
+		case multihashKeyPrefix:
+			value, err := iter.ValueAndErr()
+			if err != nil {
+				return err
+			}
+			if record.EncryptedValueKeys, err = s.unmarshalEncryptedIndexKeys(value); err != nil {
+				return err
+			}
+			record.Multihash = bytes.Clone(key[1:])
+		case hashedValueKeyKeyPrefix:
+			value, err := iter.ValueAndErr()
+			if err != nil {
+				return err
+			}
+			record.MetadataKey = bytes.Clone(key[1:])
+			record.EncryptedMetadata = bytes.Clone(value)
+		default:
+			continue
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// exportSpans returns the key spans to export, as pairs of inclusive lower
+// and exclusive upper bounds, given the digest bounds.
+func exportSpans(start, end []byte) [][2][]byte {
+	mhPrefix := append([]byte{byte(multihashKeyPrefix)}, dblSha2256Header...)
+	mdPrefix := []byte{byte(hashedValueKeyKeyPrefix)}
+
+	mhSpan := [2][]byte{{byte(multihashKeyPrefix)}, {byte(multihashKeyPrefix + 1)}}
+	mdSpan := [2][]byte{{byte(hashedValueKeyKeyPrefix)}, {byte(hashedValueKeyKeyPrefix + 1)}}
+	if len(start) != 0 {
+		mhSpan[0] = append(bytes.Clone(mhPrefix), start...)
+		mdSpan[0] = append(bytes.Clone(mdPrefix), start...)
+	}
+	if len(end) != 0 {
+		mhSpan[1] = append(bytes.Clone(mhPrefix), end...)
+		mdSpan[1] = append(bytes.Clone(mdPrefix), end...)
+	}
+	return [][2][]byte{mhSpan, mdSpan}
+}
+
+func encodeExportCursor(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(append([]byte{exportCursorVersion}, key...))
+}
+
+func decodeExportCursor(cursor string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, dhstore.ErrInvalidExportCursor{Cursor: cursor, Err: err}
+	}
+	if len(b) < 2 || b[0] != exportCursorVersion {
+		return nil, dhstore.ErrInvalidExportCursor{Cursor: cursor}
+	}
+	return b[1:], nil
+}
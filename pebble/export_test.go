@@ -0,0 +1,78 @@
+package pebble_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ipni/dhstore"
+	dhpebble "github.com/ipni/dhstore/pebble"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebbleDHStore_ExportResumesFromCursor(t *testing.T) {
+	subject, err := dhpebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	const count = 50
+	indexes := make([]dhstore.Index, 0, count)
+	for i := 0; i < count; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprint("fish-", i)), multihash.DBL_SHA2_256, -1)
+		require.NoError(t, err)
+		indexes = append(indexes, dhstore.Index{Key: mh, Value: []byte{byte(i)}})
+	}
+	require.NoError(t, subject.MergeIndexes(indexes))
+	require.NoError(t, subject.PutMetadata([]byte("lobster"), []byte("barreleye")))
+
+	ctx := context.Background()
+	var all []dhstore.ExportRecord
+	require.NoError(t, subject.Export(ctx, dhstore.ExportOptions{}, func(record dhstore.ExportRecord) error {
+		all = append(all, record)
+		return nil
+	}))
+	require.Len(t, all, count+1)
+	for i := 1; i < count; i++ {
+		require.Negative(t, bytes.Compare(all[i-1].Multihash, all[i].Multihash), "records must be in digest order")
+	}
+	require.Equal(t, dhstore.EncryptedMetadata("barreleye"), all[count].EncryptedMetadata)
+
+	// Interrupt the export repeatedly and resume from the last cursor.
+	errInterrupt := errors.New("interrupted")
+	var resumed []dhstore.ExportRecord
+	var cursor string
+	for {
+		var batch int
+		err := subject.Export(ctx, dhstore.ExportOptions{Cursor: cursor}, func(record dhstore.ExportRecord) error {
+			resumed = append(resumed, record)
+			cursor = record.Cursor
+			if batch++; batch == 7 {
+				return errInterrupt
+			}
+			return nil
+		})
+		if err == nil {
+			break
+		}
+		require.ErrorIs(t, err, errInterrupt)
+	}
+	require.Equal(t, all, resumed)
+
+	// Exporting disjoint ranges covers all index records.
+	var ranged []dhstore.ExportRecord
+	for _, r := range [][2][]byte{{nil, {0x80}}, {{0x80}, nil}} {
+		require.NoError(t, subject.Export(ctx, dhstore.ExportOptions{Start: r[0], End: r[1]}, func(record dhstore.ExportRecord) error {
+			if record.Multihash != nil {
+				ranged = append(ranged, record)
+			}
+			return nil
+		}))
+	}
+	require.Equal(t, all[:count], ranged)
+
+	err = subject.Export(ctx, dhstore.ExportOptions{Cursor: "not a cursor"}, func(dhstore.ExportRecord) error { return nil })
+	require.ErrorAs(t, err, &dhstore.ErrInvalidExportCursor{})
+}
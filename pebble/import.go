@@ -0,0 +1,81 @@
+package pebble
+
+import (
+	"bytes"
+	"slices"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipni/dhstore"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+var _ dhstore.Importer = (*PebbleDHStore)(nil)
+
+// Import stores the given exported records in a single batch. Index records
+// are merged in the same way as MergeIndexes, and metadata records are set
+// by their exported key, such that the last of duplicate metadata records
+// wins. The given records are not modified.
+func (s *PebbleDHStore) Import(records []dhstore.ExportRecord) error {
+	s.ingestBarrier.RLock()
+	defer s.ingestBarrier.RUnlock()
+
+	// Sort a copy of records to reduce cursor churn, stably so that metadata
+	// records, which have no multihash, keep their order.
+	records = slices.Clone(records)
+	slices.SortStableFunc(records, func(a, b dhstore.ExportRecord) int {
+		return bytes.Compare(a.Multihash, b.Multihash)
+	})
+
+	keygen := s.p.leaseSimpleKeyer()
+	defer keygen.Close()
+	batch := s.db.NewBatch()
+	defer batch.Close()
+
+	for _, record := range records {
+		switch {
+		case record.Multihash != nil:
+			dmh, err := multihash.Decode(record.Multihash)
+			if err != nil {
+				return dhstore.ErrMultihashDecode{Err: err, Mh: record.Multihash}
+			}
+			if multicodec.Code(dmh.Code) != multicodec.DblSha2_256 {
+				return dhstore.ErrUnsupportedMulticodecCode{Code: multicodec.Code(dmh.Code)}
+			}
+			if len(record.EncryptedValueKeys) == 0 {
+				continue
+			}
+			mhk, err := keygen.multihashKey(record.Multihash)
+			if err != nil {
+				return err
+			}
+			mevks, closer, err := s.marshalEncryptedIndexKeys(record.EncryptedValueKeys)
+			if err != nil {
+				_ = mhk.Close()
+				return err
+			}
+			err = batch.Merge(mhk.buf, mevks, pebble.NoSync)
+			_ = mhk.Close()
+			_ = closer.Close()
+			if err != nil {
+				return err
+			}
+		case record.HashedValueKey != nil:
+			hvkk, err := keygen.hashedValueKeyKey(record.HashedValueKey)
+			if err != nil {
+				return err
+			}
+			err = batch.Set(hvkk.buf, record.EncryptedMetadata, pebble.NoSync)
+			_ = hvkk.Close()
+			if err != nil {
+				return err
+			}
+		case record.MetadataKey != nil:
+			mdk := append([]byte{byte(hashedValueKeyKeyPrefix)}, record.MetadataKey...)
+			if err := batch.Set(mdk, record.EncryptedMetadata, pebble.NoSync); err != nil {
+				return err
+			}
+		}
+	}
+	return batch.Commit(pebble.NoSync)
+}
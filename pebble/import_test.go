@@ -0,0 +1,40 @@
+package pebble_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/ipni/dhstore"
+	dhpebble "github.com/ipni/dhstore/pebble"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebbleDHStore_ImportKeepsRecordOrder(t *testing.T) {
+	subject, err := dhpebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	// Interleave index records with enough duplicate metadata records that an
+	// unstable sort would reorder them.
+	hvk := dhstore.HashedValueKey("lobster")
+	var records []dhstore.ExportRecord
+	for i := 0; i < 32; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprint("fish-", i)), multihash.DBL_SHA2_256, -1)
+		require.NoError(t, err)
+		records = append(records,
+			dhstore.ExportRecord{Multihash: mh, EncryptedValueKeys: []dhstore.EncryptedValueKey{[]byte{byte(i)}}},
+			dhstore.ExportRecord{HashedValueKey: hvk, EncryptedMetadata: []byte(fmt.Sprint("barreleye-", i))})
+	}
+	given := slices.Clone(records)
+	require.NoError(t, subject.Import(records))
+	require.Equal(t, given, records, "records must not be modified")
+
+	md, err := subject.GetMetadata(hvk)
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("barreleye-31"), md)
+	evks, err := subject.Lookup(records[0].Multihash)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte{0}}, evks)
+}
@@ -0,0 +1,63 @@
+package pebble
+
+import (
+	"testing"
+
+	"github.com/ipni/dhstore"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebbleDHStore_IngestDoesNotUndoConcurrentMetadataDeletes(t *testing.T) {
+	subject, err := NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	// Put and delete the metadata after the SST is built with it, which must
+	// take effect after ingestion rather than be undone by it.
+	errs := make(chan error, 1)
+	subject.ingestHook = func() {
+		go func() {
+			if err := subject.PutMetadata([]byte("lobster"), []byte("live")); err != nil {
+				errs <- err
+				return
+			}
+			errs <- subject.DeleteMetadata([]byte("lobster"))
+		}()
+	}
+	require.NoError(t, subject.Ingest([]dhstore.ExportRecord{
+		{HashedValueKey: []byte("lobster"), EncryptedMetadata: []byte("bulk")},
+	}))
+	require.NoError(t, <-errs)
+
+	md, err := subject.GetMetadata([]byte("lobster"))
+	require.NoError(t, err)
+	require.Nil(t, md)
+}
+
+func TestPebbleDHStore_IngestDoesNotUndoConcurrentIndexDeletes(t *testing.T) {
+	subject, err := NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	mh, err := multihash.Sum([]byte("fish"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("a")}}))
+
+	// Delete a value key after the SST is built with it, which must take
+	// effect after ingestion rather than be undone by it.
+	errs := make(chan error, 1)
+	subject.ingestHook = func() {
+		go func() {
+			errs <- subject.DeleteIndexes([]dhstore.Index{{Key: mh, Value: []byte("a")}})
+		}()
+	}
+	require.NoError(t, subject.Ingest([]dhstore.ExportRecord{
+		{Multihash: mh, EncryptedValueKeys: []dhstore.EncryptedValueKey{[]byte("a"), []byte("b")}},
+	}))
+	require.NoError(t, <-errs)
+
+	evks, err := subject.Lookup(mh)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("b")}, evks)
+}
@@ -0,0 +1,94 @@
+package pebble_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ipni/dhstore"
+	dhpebble "github.com/ipni/dhstore/pebble"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebbleDHStore_IngestDoesNotLoseConcurrentMerges(t *testing.T) {
+	subject, err := dhpebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	const keyCount = 100
+	mhs := make([]multihash.Multihash, 0, keyCount)
+	for i := 0; i < keyCount; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprint("fish-", i)), multihash.DBL_SHA2_256, -1)
+		require.NoError(t, err)
+		mhs = append(mhs, mh)
+	}
+
+	// Merge live writes for the same keys while SSTs are ingested.
+	const liveRounds = 50
+	liveErrs := make(chan error, 1)
+	go func() {
+		defer close(liveErrs)
+		for round := 0; round < liveRounds; round++ {
+			indexes := make([]dhstore.Index, 0, keyCount)
+			for _, mh := range mhs {
+				indexes = append(indexes, dhstore.Index{Key: mh, Value: []byte(fmt.Sprint("live-", round))})
+			}
+			if err := subject.MergeIndexes(indexes); err != nil {
+				liveErrs <- err
+				return
+			}
+		}
+	}()
+	const ingestRounds = 10
+	for round := 0; round < ingestRounds; round++ {
+		records := make([]dhstore.ExportRecord, 0, keyCount)
+		for _, mh := range mhs {
+			records = append(records, dhstore.ExportRecord{
+				Multihash:          mh,
+				EncryptedValueKeys: []dhstore.EncryptedValueKey{[]byte(fmt.Sprint("bulk-", round))},
+			})
+		}
+		require.NoError(t, subject.Ingest(records))
+	}
+	require.NoError(t, <-liveErrs)
+
+	for _, mh := range mhs {
+		evks, err := subject.Lookup(mh)
+		require.NoError(t, err)
+		require.Len(t, evks, liveRounds+ingestRounds)
+	}
+}
+
+func TestPebbleDHStore_IngestKeepsLiveMetadata(t *testing.T) {
+	subject, err := dhpebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	require.NoError(t, subject.PutMetadata([]byte("lobster"), []byte("live")))
+	require.NoError(t, subject.Ingest([]dhstore.ExportRecord{
+		{HashedValueKey: []byte("lobster"), EncryptedMetadata: []byte("bulk")},
+		{HashedValueKey: []byte("fish"), EncryptedMetadata: []byte("bulk")},
+	}))
+
+	md, err := subject.GetMetadata([]byte("lobster"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("live"), md)
+	md, err = subject.GetMetadata([]byte("fish"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("bulk"), md)
+
+	// Ingested index records are visible to lookups and deletable.
+	mh, err := multihash.Sum([]byte("fish"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+	require.NoError(t, subject.Ingest([]dhstore.ExportRecord{
+		{Multihash: mh, EncryptedValueKeys: []dhstore.EncryptedValueKey{[]byte("a"), []byte("b")}},
+		{Multihash: mh, EncryptedValueKeys: []dhstore.EncryptedValueKey{[]byte("b")}},
+	}))
+	evks, err := subject.Lookup(mh)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []dhstore.EncryptedValueKey{[]byte("a"), []byte("b")}, evks)
+	require.NoError(t, subject.DeleteIndexes([]dhstore.Index{{Key: mh, Value: []byte("a")}}))
+	evks, err = subject.Lookup(mh)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("b")}, evks)
+}
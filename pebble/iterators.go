@@ -0,0 +1,252 @@
+package pebble
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/metrics"
+)
+
+var (
+	logger = logging.Logger("store/pebble")
+
+	errIteratorForceClosed = errors.New("iterator was force-closed after being left idle")
+)
+
+// iterators tracks the iterators open on the DB, enforcing a cap on their
+// number and force-closing the ones left idle for longer than leakTimeout.
+type iterators struct {
+	max         int
+	leakTimeout time.Duration
+	clock       clock.Clock
+
+	mu       sync.Mutex
+	open     map[*trackedIter]struct{}
+	leaked   atomic.Int64
+	rejected atomic.Int64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// trackedIter wraps a pebble iterator such that it can be safely force-closed
+// while in use. Once force-closed, the iterator is no longer valid and its
+// Error returns errIteratorForceClosed.
+type trackedIter struct {
+	owner    *iterators
+	purpose  string
+	openedAt time.Time
+	lastUsed atomic.Int64
+
+	mu     sync.Mutex
+	iter   *pebble.Iterator
+	closed bool
+	forced bool
+}
+
+func newIterators(max int, leakTimeout time.Duration, clk clock.Clock) *iterators {
+	its := &iterators{
+		max:         max,
+		leakTimeout: leakTimeout,
+		clock:       clk,
+		open:        make(map[*trackedIter]struct{}),
+	}
+	if leakTimeout > 0 {
+		var ctx context.Context
+		ctx, its.cancel = context.WithCancel(context.Background())
+		its.done = make(chan struct{})
+		go its.reapLeaked(ctx, clk.NewTicker(leakTimeout/2))
+	}
+	return its
+}
+
+// newIter opens a tracked iterator on the DB for the given purpose, or fails
+// with dhstore.ErrTooManyIterators if the cap on open iterators is reached.
+func (s *PebbleDHStore) newIter(purpose string, opts *pebble.IterOptions) (*trackedIter, error) {
+	its := s.iterators
+	its.mu.Lock()
+	defer its.mu.Unlock()
+	if its.max > 0 && len(its.open) >= its.max {
+		its.rejected.Add(1)
+		return nil, dhstore.ErrTooManyIterators{Limit: its.max}
+	}
+	iter, err := s.db.NewIter(opts)
+	if err != nil {
+		return nil, err
+	}
+	now := its.clock.Now()
+	ti := &trackedIter{
+		owner:    its,
+		purpose:  purpose,
+		openedAt: now,
+		iter:     iter,
+	}
+	ti.lastUsed.Store(now.UnixNano())
+	its.open[ti] = struct{}{}
+	return ti, nil
+}
+
+func (its *iterators) reapLeaked(ctx context.Context, ticker clock.Ticker) {
+	defer close(its.done)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return
+		}
+		its.mu.Lock()
+		var leaked []*trackedIter
+		for ti := range its.open {
+			if its.clock.Since(time.Unix(0, ti.lastUsed.Load())) > its.leakTimeout {
+				leaked = append(leaked, ti)
+			}
+		}
+		its.mu.Unlock()
+		for _, ti := range leaked {
+			logger.Warnw("Force-closing leaked iterator", "purpose", ti.purpose, "age", its.clock.Since(ti.openedAt), "idle", its.clock.Since(time.Unix(0, ti.lastUsed.Load())))
+			if ti.forceClose() {
+				its.leaked.Add(1)
+			}
+		}
+	}
+}
+
+// closeAll stops reaping leaked iterators and closes all open ones, since the
+// DB cannot be closed while iterators are open on it.
+func (its *iterators) closeAll() {
+	if its.cancel != nil {
+		its.cancel()
+		<-its.done
+		its.cancel = nil
+	}
+	its.mu.Lock()
+	open := make([]*trackedIter, 0, len(its.open))
+	for ti := range its.open {
+		open = append(open, ti)
+	}
+	its.mu.Unlock()
+	for _, ti := range open {
+		logger.Warnw("Force-closing iterator open at close", "purpose", ti.purpose, "age", its.clock.Since(ti.openedAt))
+		ti.forceClose()
+	}
+}
+
+func (its *iterators) metrics() *metrics.PebbleIteratorMetrics {
+	its.mu.Lock()
+	defer its.mu.Unlock()
+	m := &metrics.PebbleIteratorMetrics{
+		Open:     int64(len(its.open)),
+		Leaked:   its.leaked.Load(),
+		Rejected: its.rejected.Load(),
+	}
+	for ti := range its.open {
+		if age := its.clock.Since(ti.openedAt); age > m.OldestAge {
+			m.OldestAge = age
+		}
+	}
+	return m
+}
+
+// IteratorMetrics returns a snapshot of the iterators open on the store.
+func (s *PebbleDHStore) IteratorMetrics() *metrics.PebbleIteratorMetrics {
+	return s.iterators.metrics()
+}
+
+// forceClose closes the iterator and returns true if it was open.
+func (ti *trackedIter) forceClose() bool {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.closed {
+		return false
+	}
+	ti.forced = true
+	_ = ti.closeLocked()
+	return true
+}
+
+func (ti *trackedIter) closeLocked() error {
+	ti.closed = true
+	ti.owner.mu.Lock()
+	delete(ti.owner.open, ti)
+	ti.owner.mu.Unlock()
+	return ti.iter.Close()
+}
+
+func (ti *trackedIter) touch() {
+	ti.lastUsed.Store(ti.owner.clock.Now().UnixNano())
+}
+
+func (ti *trackedIter) First() bool {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.touch()
+	return !ti.closed && ti.iter.First()
+}
+
+func (ti *trackedIter) Next() bool {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.touch()
+	return !ti.closed && ti.iter.Next()
+}
+
+func (ti *trackedIter) Valid() bool {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return !ti.closed && ti.iter.Valid()
+}
+
+// Key returns the key at the current position. The returned slice is only
+// valid until the next call that moves or closes the iterator.
+func (ti *trackedIter) Key() []byte {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.closed {
+		return nil
+	}
+	return ti.iter.Key()
+}
+
+// ValueAndErr returns the value at the current position. The returned slice is
+// only valid until the next call that moves or closes the iterator.
+func (ti *trackedIter) ValueAndErr() ([]byte, error) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.closed {
+		return nil, ti.closedErr()
+	}
+	return ti.iter.ValueAndErr()
+}
+
+func (ti *trackedIter) Error() error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.closed {
+		return ti.closedErr()
+	}
+	return ti.iter.Error()
+}
+
+func (ti *trackedIter) Close() error {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.closed {
+		return nil
+	}
+	return ti.closeLocked()
+}
+
+func (ti *trackedIter) closedErr() error {
+	if ti.forced {
+		return errIteratorForceClosed
+	}
+	return pebble.ErrClosed
+}
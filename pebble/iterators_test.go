@@ -0,0 +1,73 @@
+package pebble_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/clock"
+	dhpebble "github.com/ipni/dhstore/pebble"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func putIndexes(t *testing.T, subject *dhpebble.PebbleDHStore, count int) {
+	indexes := make([]dhstore.Index, 0, count)
+	for i := 0; i < count; i++ {
+		mh, err := multihash.Sum([]byte(fmt.Sprint("fish-", i)), multihash.DBL_SHA2_256, -1)
+		require.NoError(t, err)
+		indexes = append(indexes, dhstore.Index{Key: mh, Value: []byte{byte(i)}})
+	}
+	require.NoError(t, subject.MergeIndexes(indexes))
+}
+
+func TestPebbleDHStore_MaxIterators(t *testing.T) {
+	subject, err := dhpebble.NewPebbleDHStore(t.TempDir(), nil, dhpebble.WithMaxIterators(1))
+	require.NoError(t, err)
+	defer subject.Close()
+	putIndexes(t, subject, 2)
+
+	ctx := context.Background()
+	var nestedErr error
+	require.NoError(t, subject.Export(ctx, dhstore.ExportOptions{}, func(dhstore.ExportRecord) error {
+		if nestedErr == nil {
+			require.Equal(t, int64(1), subject.IteratorMetrics().Open)
+			nestedErr = subject.Export(ctx, dhstore.ExportOptions{}, func(dhstore.ExportRecord) error { return nil })
+		}
+		return nil
+	}))
+	require.ErrorAs(t, nestedErr, &dhstore.ErrTooManyIterators{})
+
+	got := subject.IteratorMetrics()
+	require.Equal(t, int64(0), got.Open)
+	require.Equal(t, int64(1), got.Rejected)
+
+	// The slot is released once the iterator is closed.
+	require.NoError(t, subject.Export(ctx, dhstore.ExportOptions{}, func(dhstore.ExportRecord) error { return nil }))
+}
+
+func TestPebbleDHStore_ForceClosesLeakedIterators(t *testing.T) {
+	const leakTimeout = time.Minute
+	clk := clock.NewMock(time.Unix(1_000, 0))
+	subject, err := dhpebble.NewPebbleDHStore(t.TempDir(), nil, dhpebble.WithIteratorLeakTimeout(leakTimeout), dhpebble.WithClock(clk))
+	require.NoError(t, err)
+	defer subject.Close()
+	putIndexes(t, subject, 2)
+
+	var seen int
+	err = subject.Export(context.Background(), dhstore.ExportOptions{}, func(dhstore.ExportRecord) error {
+		seen++
+		clk.Add(2 * leakTimeout)
+		require.Eventually(t, func() bool { return subject.IteratorMetrics().Leaked == 1 }, time.Second, time.Millisecond)
+		return nil
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "force-closed")
+	require.Equal(t, 1, seen)
+
+	got := subject.IteratorMetrics()
+	require.Equal(t, int64(0), got.Open)
+	require.Equal(t, int64(1), got.Leaked)
+}
@@ -38,6 +38,12 @@ const (
 	// hashedValueKeyKeyPrefix represents the prefix of a key that is associated to hashed value-key
 	// key.
 	hashedValueKeyKeyPrefix
+	// provenanceKeyPrefix represents the prefix of a key that is associated to the provenance record
+	// of a merged batch.
+	provenanceKeyPrefix
+	// providerInfosKeyPrefix represents the prefix of the key at which the snapshot of provider
+	// information of dhfind is persisted.
+	providerInfosKeyPrefix
 )
 
 func (k *key) append(b ...byte) {
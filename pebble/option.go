@@ -0,0 +1,67 @@
+package pebble
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+)
+
+// config contains all options for the store.
+type config struct {
+	maxIterators        int
+	iteratorLeakTimeout time.Duration
+	clock               clock.Clock
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	cfg := config{
+		clock: clock.New(),
+	}
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d error: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithMaxIterators caps the number of iterators open at once, e.g. by exports
+// and provenance scans. Opening an iterator beyond the cap fails with
+// dhstore.ErrTooManyIterators. Zero removes the cap. Defaults to zero.
+func WithMaxIterators(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("max iterators must not be negative, got: %d", n)
+		}
+		c.maxIterators = n
+		return nil
+	}
+}
+
+// WithIteratorLeakTimeout sets the time an open iterator may go unused before
+// it is considered leaked, logged and force-closed. Leaked iterators pin
+// memtables and SSTs, which would otherwise cause the store to grow on disk.
+// Zero disables force-closing. Defaults to zero.
+func WithIteratorLeakTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout < 0 {
+			return fmt.Errorf("iterator leak timeout must not be negative, got: %s", timeout)
+		}
+		c.iteratorLeakTimeout = timeout
+		return nil
+	}
+}
+
+// WithClock sets the clock used to sample write pressure and to find leaked
+// iterators. Defaults to the system clock.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) error {
+		cfg.clock = c
+		return nil
+	}
+}
@@ -5,14 +5,21 @@ import (
 	"errors"
 	"io"
 	"slices"
+	"sync"
+	"sync/atomic"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/metrics"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
 )
 
-var _ dhstore.DHStore = (*PebbleDHStore)(nil)
+var (
+	_ dhstore.DHStore             = (*PebbleDHStore)(nil)
+	_ dhstore.MetadataBatchPutter = (*PebbleDHStore)(nil)
+)
 
 const (
 	encValueKeysCap          = 5
@@ -23,13 +30,39 @@ type PebbleDHStore struct {
 	db     *pebble.DB
 	p      *pool
 	closed bool
+	// provenanceSeq disambiguates provenance records committed at the same time.
+	provenanceSeq atomic.Uint64
+	writePressure writePressure
+	// path and opts are retained to build SSTs for ingestion.
+	path string
+	opts *pebble.Options
+	// ingestBarrier is held exclusively while SSTs are ingested, and shared by
+	// live writes. See Ingest.
+	ingestBarrier sync.RWMutex
+	// ingestSeq disambiguates the names of SSTs built for ingestion.
+	ingestSeq atomic.Uint64
+	// ingestHook, if set, is called by Ingest between building an SST and
+	// ingesting it. Only set by tests.
+	ingestHook func()
+	// iterators tracks the iterators open on the DB.
+	iterators *iterators
+	// recordCounts caches the estimated number of records reported as
+	// metrics.
+	recordCounts recordCounts
+	clock        clock.Clock
 }
 
 // NewPebbleDHStore instantiates a new instance of a store backed by Pebble.
 // Note that any Merger value specified in the given options will be overridden.
-func NewPebbleDHStore(path string, opts *pebble.Options) (*PebbleDHStore, error) {
+func NewPebbleDHStore(path string, opts *pebble.Options, options ...Option) (*PebbleDHStore, error) {
+	cfg, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
 	dhs := &PebbleDHStore{
-		p: newPool(),
+		p:     newPool(),
+		path:  path,
+		clock: cfg.clock,
 	}
 
 	if opts == nil {
@@ -39,16 +72,23 @@ func NewPebbleDHStore(path string, opts *pebble.Options) (*PebbleDHStore, error)
 	// Override Merger since the store relies on a specific implementation of it
 	// to handle read-free writing of value-keys; see: valueKeysValueMerger.
 	opts.Merger = dhs.newValueKeysMerger()
+	dhs.writePressure.l0StopWritesThreshold = opts.L0StopWritesThreshold
+	dhs.writePressure.memTableStopWritesThreshold = opts.MemTableStopWritesThreshold
 	db, err := pebble.Open(path, opts)
 	if err != nil {
 		return nil, err
 	}
 	dhs.db = db
+	dhs.opts = opts
+	dhs.iterators = newIterators(cfg.maxIterators, cfg.iteratorLeakTimeout, cfg.clock)
 
 	return dhs, nil
 }
 
 func (s *PebbleDHStore) MergeIndexes(indexes []dhstore.Index) error {
+	s.ingestBarrier.RLock()
+	defer s.ingestBarrier.RUnlock()
+
 	// Sort indexes to reduce cursor churn.
 	slices.SortFunc(indexes, func(a, b dhstore.Index) int {
 		return bytes.Compare(a.Key, b.Key)
@@ -89,6 +129,9 @@ func (s *PebbleDHStore) MergeIndexes(indexes []dhstore.Index) error {
 // DeleteIndexes removes dh-multihash to encrypted-valueKey mappings. This is
 // the inverse of MergeIndexes.
 func (s *PebbleDHStore) DeleteIndexes(indexes []dhstore.Index) error {
+	s.ingestBarrier.RLock()
+	defer s.ingestBarrier.RUnlock()
+
 	// Sort indexes to reduce cursor churn.
 	slices.SortFunc(indexes, func(a, b dhstore.Index) int {
 		return bytes.Compare(a.Key, b.Key)
@@ -173,6 +216,9 @@ func (s *PebbleDHStore) DeleteIndexes(indexes []dhstore.Index) error {
 }
 
 func (s *PebbleDHStore) PutMetadata(hvk dhstore.HashedValueKey, em dhstore.EncryptedMetadata) error {
+	s.ingestBarrier.RLock()
+	defer s.ingestBarrier.RUnlock()
+
 	keygen := s.p.leaseSimpleKeyer()
 	defer keygen.Close()
 	hvkk, err := keygen.hashedValueKeyKey(hvk)
@@ -183,6 +229,29 @@ func (s *PebbleDHStore) PutMetadata(hvk dhstore.HashedValueKey, em dhstore.Encry
 	return s.db.Set(hvkk.buf, em, pebble.NoSync)
 }
 
+// PutMetadataBatch stores the given metadata records in a single batch.
+func (s *PebbleDHStore) PutMetadataBatch(records []dhstore.Metadata) error {
+	s.ingestBarrier.RLock()
+	defer s.ingestBarrier.RUnlock()
+
+	keygen := s.p.leaseSimpleKeyer()
+	defer keygen.Close()
+	batch := s.db.NewBatch()
+	defer batch.Close()
+	for _, record := range records {
+		hvkk, err := keygen.hashedValueKeyKey(record.Key)
+		if err != nil {
+			return err
+		}
+		err = batch.Set(hvkk.buf, record.Value, pebble.NoSync)
+		_ = hvkk.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Commit(pebble.NoSync)
+}
+
 func (s *PebbleDHStore) Lookup(mh multihash.Multihash) ([]dhstore.EncryptedValueKey, error) {
 	dmh, err := multihash.Decode(mh)
 	if err != nil {
@@ -234,6 +303,9 @@ func (s *PebbleDHStore) GetMetadata(hvk dhstore.HashedValueKey) (dhstore.Encrypt
 }
 
 func (s *PebbleDHStore) DeleteMetadata(hvk dhstore.HashedValueKey) error {
+	s.ingestBarrier.RLock()
+	defer s.ingestBarrier.RUnlock()
+
 	keygen := s.p.leaseSimpleKeyer()
 	defer keygen.Close()
 	hvkk, err := keygen.hashedValueKeyKey(hvk)
@@ -244,19 +316,103 @@ func (s *PebbleDHStore) DeleteMetadata(hvk dhstore.HashedValueKey) error {
 	return s.db.Delete(hvkk.buf, pebble.NoSync)
 }
 
+// DeleteMetadataBatch deletes the metadata of the given keys in a single batch.
+func (s *PebbleDHStore) DeleteMetadataBatch(hvks []dhstore.HashedValueKey) error {
+	s.ingestBarrier.RLock()
+	defer s.ingestBarrier.RUnlock()
+
+	keygen := s.p.leaseSimpleKeyer()
+	defer keygen.Close()
+	batch := s.db.NewBatch()
+	defer batch.Close()
+	for _, hvk := range hvks {
+		hvkk, err := keygen.hashedValueKeyKey(hvk)
+		if err != nil {
+			return err
+		}
+		err = batch.Delete(hvkk.buf, pebble.NoSync)
+		_ = hvkk.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Commit(pebble.NoSync)
+}
+
 func (s *PebbleDHStore) Size() (int64, error) {
 	sizeEstimate, err := s.db.EstimateDiskUsage([]byte{0}, []byte{0xff})
 	return int64(sizeEstimate), err
 }
 
+// DiskUsage returns the estimated size of the store, and the space available on
+// the volume it is stored on, or nil if either cannot be read.
+func (s *PebbleDHStore) DiskUsage() *metrics.DiskUsageMetrics {
+	size, err := s.Size()
+	if err != nil {
+		logger.Errorw("Failed to estimate store size", "err", err)
+		return nil
+	}
+	usage, err := s.opts.FS.GetDiskUsage(s.path)
+	if err != nil {
+		logger.Errorw("Failed to get disk usage of store volume", "path", s.path, "err", err)
+		return nil
+	}
+	return &metrics.DiskUsageMetrics{
+		Size:            size,
+		VolumeAvailable: int64(usage.AvailBytes),
+		VolumeTotal:     int64(usage.TotalBytes),
+	}
+}
+
 func (s *PebbleDHStore) Flush() error {
 	return s.db.Flush()
 }
 
+// Compact manually compacts the entire key space, e.g. to reclaim the space of
+// deleted records. It blocks until the compaction completes.
+func (s *PebbleDHStore) Compact() error {
+	return s.db.Compact([]byte{0}, []byte{0xff}, true)
+}
+
+// Checkpoint writes a consistent, openable copy of the store to the given
+// directory, which must not exist. Files are hard-linked where possible.
+func (s *PebbleDHStore) Checkpoint(dir string) error {
+	return s.db.Checkpoint(dir, pebble.WithFlushedWAL())
+}
+
+// Check verifies the consistency of the store by reading every key of every
+// level of the LSM, so that corruption is detected before it is served. It
+// returns the number of keys checked.
+func (s *PebbleDHStore) Check() (int64, error) {
+	var stats pebble.CheckLevelsStats
+	if err := s.db.CheckLevels(&stats); err != nil {
+		return 0, err
+	}
+	return stats.NumPoints, nil
+}
+
+// UpgradeFormat upgrades the on-disk format of the store to the newest one
+// supported, after which the store can no longer be opened by versions of
+// dhstore that predate it. It returns the format before and after upgrade.
+func (s *PebbleDHStore) UpgradeFormat() (from, to pebble.FormatMajorVersion, err error) {
+	from = s.db.FormatMajorVersion()
+	if err = s.db.RatchetFormatMajorVersion(pebble.FormatNewest); err != nil {
+		return from, from, err
+	}
+	return from, s.db.FormatMajorVersion(), nil
+}
+
+// StoreFormat returns the on-disk format of the store, as upgraded to by
+// UpgradeFormat.
+func (s *PebbleDHStore) StoreFormat() string {
+	return "pebble " + s.db.FormatMajorVersion().String()
+}
+
 func (s *PebbleDHStore) Close() error {
 	if s.closed {
 		return nil
 	}
+	s.iterators.closeAll()
 	ferr := s.db.Flush()
 	cerr := s.db.Close()
 	s.closed = true
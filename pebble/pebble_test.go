@@ -1,7 +1,11 @@
 package pebble_test
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/ipni/dhstore"
 	"github.com/ipni/dhstore/pebble"
@@ -47,3 +51,63 @@ func TestPebbleDHStore_MultihashCheck(t *testing.T) {
 		})
 	}
 }
+
+func TestPebbleDHStore_ProviderInfos(t *testing.T) {
+	subject, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	got, err := subject.ProviderInfos()
+	require.NoError(t, err)
+	require.Nil(t, got)
+
+	for _, want := range []dhstore.ProviderInfoSnapshot{
+		{Time: time.Unix(1, 0).UTC(), Infos: []json.RawMessage{json.RawMessage(`{"AddrInfo":{"ID":"fish"}}`)}},
+		{Time: time.Unix(2, 0).UTC(), Infos: []json.RawMessage{}},
+	} {
+		require.NoError(t, subject.PutProviderInfos(want))
+		got, err = subject.ProviderInfos()
+		require.NoError(t, err)
+		require.Equal(t, want, *got)
+	}
+
+	// The snapshot is not exported along with records.
+	require.NoError(t, subject.Export(context.Background(), dhstore.ExportOptions{}, func(record dhstore.ExportRecord) error {
+		return fmt.Errorf("unexpected record: %+v", record)
+	}))
+}
+
+func TestPebbleDHStore_DiskUsage(t *testing.T) {
+	subject, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	got := subject.DiskUsage()
+	require.NotNil(t, got)
+	require.Positive(t, got.VolumeTotal)
+	require.LessOrEqual(t, got.VolumeAvailable, got.VolumeTotal)
+	size, err := subject.Size()
+	require.NoError(t, err)
+	require.Equal(t, size, got.Size)
+}
+
+func TestPebbleDHStore_CheckAndUpgradeFormat(t *testing.T) {
+	subject, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	mh, err := multihash.Sum([]byte("fish"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{{Key: mh, Value: dhstore.EncryptedValueKey("lobster")}}))
+	require.NoError(t, subject.Flush())
+
+	checked, err := subject.Check()
+	require.NoError(t, err)
+	require.Positive(t, checked)
+
+	from, to, err := subject.UpgradeFormat()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, to, from)
+	_, err = subject.Check()
+	require.NoError(t, err)
+}
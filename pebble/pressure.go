@@ -0,0 +1,52 @@
+package pebble
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ipni/dhstore"
+)
+
+var _ dhstore.WritePressureReporter = (*PebbleDHStore)(nil)
+
+// writePressureSampleInterval is the minimum interval between samples of the
+// pebble metrics used to compute write pressure, since computing the metrics
+// is not free and write pressure is checked on every write request.
+const writePressureSampleInterval = 250 * time.Millisecond
+
+type writePressure struct {
+	l0StopWritesThreshold       int
+	memTableStopWritesThreshold int
+
+	mu        sync.Mutex
+	sampledAt time.Time
+	value     float64
+}
+
+// WritePressure returns the proximity of the store to its stop-writes
+// threshold as a value between 0 and 1, where 1 means that writes are stopped.
+//
+// Pebble stops writes when either the number of L0 sublevels reaches
+// L0StopWritesThreshold, or the number of queued memtables reaches
+// MemTableStopWritesThreshold. The returned value is the higher of the two
+// ratios.
+func (s *PebbleDHStore) WritePressure() float64 {
+	wp := &s.writePressure
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if s.clock.Since(wp.sampledAt) < writePressureSampleInterval {
+		return wp.value
+	}
+
+	m := s.db.Metrics()
+	var pressure float64
+	if wp.l0StopWritesThreshold > 0 {
+		pressure = float64(m.Levels[0].Sublevels) / float64(wp.l0StopWritesThreshold)
+	}
+	if wp.memTableStopWritesThreshold > 0 {
+		pressure = max(pressure, float64(m.MemTable.Count)/float64(wp.memTableStopWritesThreshold))
+	}
+	wp.value = min(pressure, 1)
+	wp.sampledAt = s.clock.Now()
+	return wp.value
+}
@@ -0,0 +1,36 @@
+package pebble_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipni/dhstore"
+	dhpebble "github.com/ipni/dhstore/pebble"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebbleDHStore_WritePressure(t *testing.T) {
+	opts := &pebble.Options{
+		L0StopWritesThreshold:       4,
+		MemTableStopWritesThreshold: 8,
+		DisableAutomaticCompactions: true,
+	}
+	subject, err := dhpebble.NewPebbleDHStore(t.TempDir(), opts)
+	require.NoError(t, err)
+	defer subject.Close()
+
+	require.Less(t, subject.WritePressure(), 0.5)
+
+	// Flush overlapping merges to stack up L0 sublevels.
+	mh, err := multihash.Sum([]byte("fish"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, subject.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte{byte(i)}}}))
+		require.NoError(t, subject.Flush())
+	}
+	require.Eventually(t, func() bool {
+		return subject.WritePressure() == 0.75
+	}, time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,63 @@
+package pebble
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipni/dhstore"
+)
+
+var _ dhstore.ProvenanceRecorder = (*PebbleDHStore)(nil)
+
+// RecordProvenance persists the given provenance in the provenance keyspace,
+// keyed by its time.
+func (s *PebbleDHStore) RecordProvenance(p dhstore.Provenance) error {
+	value, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	k := s.provenanceKey(p.Time, s.provenanceSeq.Add(1))
+	return s.db.Set(k, value, pebble.NoSync)
+}
+
+// Provenance returns the provenance records with time in the range of
+// [from, to], ordered by time.
+func (s *PebbleDHStore) Provenance(from, to time.Time) ([]dhstore.Provenance, error) {
+	iter, err := s.newIter("provenance", &pebble.IterOptions{
+		LowerBound: s.provenanceKey(from, 0),
+		UpperBound: s.provenanceKey(to, math.MaxUint64),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var records []dhstore.Provenance
+	for iter.First(); iter.Valid(); iter.Next() {
+		var p dhstore.Provenance
+		value, err := iter.ValueAndErr()
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(value, &p); err != nil {
+			return nil, err
+		}
+		records = append(records, p)
+	}
+	return records, iter.Error()
+}
+
+// provenanceKey returns the key at which a provenance record is stored. The
+// key is made up of the prefix, followed by the big-endian time in
+// nanoseconds so that records are ordered by time, followed by a sequence
+// number to disambiguate records with the same time.
+func (s *PebbleDHStore) provenanceKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 1+8+8)
+	k[0] = byte(provenanceKeyPrefix)
+	binary.BigEndian.PutUint64(k[1:], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[9:], seq)
+	return k
+}
@@ -0,0 +1,43 @@
+package pebble
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipni/dhstore"
+)
+
+var _ dhstore.ProviderInfoStore = (*PebbleDHStore)(nil)
+
+// providerInfosKey is the key at which the snapshot of provider information is
+// stored, alone in its keyspace.
+var providerInfosKey = []byte{byte(providerInfosKeyPrefix)}
+
+// PutProviderInfos persists the given snapshot in the provider information
+// keyspace, replacing the previous one.
+func (s *PebbleDHStore) PutProviderInfos(snapshot dhstore.ProviderInfoSnapshot) error {
+	value, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return s.db.Set(providerInfosKey, value, pebble.NoSync)
+}
+
+// ProviderInfos returns the persisted snapshot of provider information, or nil
+// if there is none.
+func (s *PebbleDHStore) ProviderInfos() (*dhstore.ProviderInfoSnapshot, error) {
+	value, closer, err := s.db.Get(providerInfosKey)
+	if err != nil {
+		if errors.Is(err, pebble.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer closer.Close()
+	var snapshot dhstore.ProviderInfoSnapshot
+	if err := json.Unmarshal(value, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
@@ -0,0 +1,75 @@
+package pebble
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipni/dhstore/metrics"
+)
+
+// recordCountsMaxAge is how long estimated record counts are reused, since
+// estimating them reads the properties of every SST.
+const recordCountsMaxAge = time.Minute
+
+// recordCounts caches the estimated number of records of each keyspace.
+type recordCounts struct {
+	mu          sync.Mutex
+	estimatedAt time.Time
+	counts      metrics.RecordCountMetrics
+}
+
+// RecordCounts returns the estimated number of multihash index and metadata
+// records in the store, re-estimated at most once every recordCountsMaxAge.
+//
+// Counts are estimated from the properties of SSTs, and therefore exclude
+// records not yet flushed from memtables, and include deleted records and
+// merges of the same multihash that are not yet compacted.
+func (s *PebbleDHStore) RecordCounts() *metrics.RecordCountMetrics {
+	s.recordCounts.mu.Lock()
+	defer s.recordCounts.mu.Unlock()
+	if !s.recordCounts.estimatedAt.IsZero() && s.clock.Since(s.recordCounts.estimatedAt) < recordCountsMaxAge {
+		counts := s.recordCounts.counts
+		return &counts
+	}
+	counts, err := s.estimateRecordCounts()
+	if err != nil {
+		logger.Errorw("Failed to estimate record counts", "err", err)
+		counts = s.recordCounts.counts
+	} else {
+		s.recordCounts.counts = counts
+		s.recordCounts.estimatedAt = s.clock.Now()
+	}
+	return &counts
+}
+
+// estimateRecordCounts sums the number of live entries of the SSTs of each
+// keyspace. SSTs that span keyspaces are attributed to the keyspace of their
+// smallest key, which only skews counts by the SSTs flushed to L0 and the one
+// SST per level at each keyspace boundary.
+func (s *PebbleDHStore) estimateRecordCounts() (metrics.RecordCountMetrics, error) {
+	var counts metrics.RecordCountMetrics
+	levels, err := s.db.SSTables(pebble.WithProperties())
+	if err != nil {
+		return counts, err
+	}
+	for _, tables := range levels {
+		for _, table := range tables {
+			if table.Properties == nil || len(table.Smallest.UserKey) == 0 {
+				continue
+			}
+			props := table.Properties
+			live := int64(props.NumEntries) - int64(props.NumDeletions)
+			if live <= 0 {
+				continue
+			}
+			switch keyPrefix(table.Smallest.UserKey[0]) {
+			case multihashKeyPrefix:
+				counts.Multihashes += live
+			case hashedValueKeyKeyPrefix:
+				counts.Metadata += live
+			}
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,34 @@
+package pebble_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/metrics"
+	dhpebble "github.com/ipni/dhstore/pebble"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPebbleDHStore_RecordCounts(t *testing.T) {
+	clk := clock.NewMock(time.Unix(0, 0))
+	subject, err := dhpebble.NewPebbleDHStore(t.TempDir(), nil, dhpebble.WithClock(clk))
+	require.NoError(t, err)
+	defer subject.Close()
+
+	// Records that are not flushed are not counted.
+	putIndexes(t, subject, 10)
+	require.Equal(t, &metrics.RecordCountMetrics{}, subject.RecordCounts())
+	require.NoError(t, subject.Flush())
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, subject.PutMetadata([]byte(fmt.Sprint("lobster-", i)), []byte("fish")))
+	}
+	require.NoError(t, subject.Flush())
+
+	// Counts are only re-estimated once they are a minute old.
+	require.Equal(t, &metrics.RecordCountMetrics{}, subject.RecordCounts())
+	clk.Add(time.Minute)
+	require.Equal(t, &metrics.RecordCountMetrics{Multihashes: 10, Metadata: 3}, subject.RecordCounts())
+}
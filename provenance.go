@@ -0,0 +1,71 @@
+package dhstore
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// MaxProvenanceTagLen is the maximum length of a recorded writer tag. Longer
+// tags are truncated.
+const MaxProvenanceTagLen = 64
+
+type (
+	// Provenance records which writer committed a batch of index merges.
+	//
+	// Provenance is recorded per batch rather than per key, so that operators
+	// can trace the origin of bad data during incidents without significantly
+	// increasing the store size.
+	Provenance struct {
+		// Tag identifies the writer of the batch, e.g. the indexer instance.
+		Tag string `json:"tag"`
+		// Time is the time at which the batch was committed.
+		Time time.Time `json:"time"`
+		// Count is the number of merges in the batch.
+		Count int `json:"count"`
+		// FirstKey is the smallest multihash in the batch.
+		FirstKey multihash.Multihash `json:"firstKey,omitempty"`
+		// LastKey is the largest multihash in the batch.
+		LastKey multihash.Multihash `json:"lastKey,omitempty"`
+	}
+	// ProvenanceRecorder is optionally implemented by DHStore implementations
+	// that can persist the provenance of merged batches in a keyspace separate
+	// from the index records.
+	ProvenanceRecorder interface {
+		// RecordProvenance persists the given provenance.
+		RecordProvenance(Provenance) error
+		// Provenance returns the provenance records with time in the range of
+		// [from, to], ordered by time.
+		Provenance(from, to time.Time) ([]Provenance, error)
+	}
+)
+
+// NewProvenance returns the provenance of the given merges committed at the
+// given time by the writer with the given tag, which is truncated to
+// MaxProvenanceTagLen.
+func NewProvenance(tag string, t time.Time, merges []Index) Provenance {
+	p := Provenance{
+		Tag:   TruncateProvenanceTag(tag),
+		Time:  t,
+		Count: len(merges),
+	}
+	for _, merge := range merges {
+		if p.FirstKey == nil || bytes.Compare(merge.Key, p.FirstKey) < 0 {
+			p.FirstKey = merge.Key
+		}
+		if p.LastKey == nil || bytes.Compare(merge.Key, p.LastKey) > 0 {
+			p.LastKey = merge.Key
+		}
+	}
+	return p
+}
+
+// TruncateProvenanceTag returns the given writer tag truncated to
+// MaxProvenanceTagLen.
+func TruncateProvenanceTag(tag string) string {
+	if len(tag) > MaxProvenanceTagLen {
+		return tag[:MaxProvenanceTagLen]
+	}
+	return tag
+}
@@ -0,0 +1,28 @@
+package dhstore
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type (
+	// ProviderInfoSnapshot is the information of all providers, as fetched
+	// from the providers URLs of dhfind at a point in time.
+	ProviderInfoSnapshot struct {
+		// Time is the time at which the information was fetched.
+		Time time.Time `json:"time"`
+		// Infos are the JSON encoded model.ProviderInfo of each provider.
+		Infos []json.RawMessage `json:"infos"`
+	}
+	// ProviderInfoStore is optionally implemented by DHStore implementations
+	// that can persist provider information in a keyspace separate from the
+	// index records, so that the provider cache of dhfind survives restarts.
+	ProviderInfoStore interface {
+		// PutProviderInfos replaces the persisted provider information with
+		// the given snapshot.
+		PutProviderInfos(ProviderInfoSnapshot) error
+		// ProviderInfos returns the persisted provider information, or nil if
+		// there is none.
+		ProviderInfos() (*ProviderInfoSnapshot, error)
+	}
+)
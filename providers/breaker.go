@@ -0,0 +1,57 @@
+package providers
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+)
+
+// ErrCircuitOpen is returned by requests of a Pool whose circuit breaker is
+// open, without sending them to any endpoint.
+var ErrCircuitOpen = errors.New("providers circuit breaker is open")
+
+// breaker fails requests fast for a cooldown once a number of consecutive
+// requests failed on all endpoints, so that lookups do not each wait for
+// endpoints that are all down. Once the cooldown elapses, requests are sent
+// again; the first that fails opens the breaker for another cooldown, and the
+// first that succeeds closes it.
+type breaker struct {
+	clock    clock.Clock
+	failures int
+	cooldown time.Duration
+
+	mu          sync.Mutex
+	consecutive int
+	openUntil   time.Time
+}
+
+// remaining returns how long requests are failed fast for, or zero if they
+// are sent to endpoints.
+func (b *breaker) remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.consecutive < b.failures {
+		return 0
+	}
+	return max(b.openUntil.Sub(b.clock.Now()), 0)
+}
+
+// record records the outcome of a request sent to endpoints.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.consecutive >= b.failures {
+			log.Info("Providers circuit breaker closed")
+		}
+		b.consecutive = 0
+		return
+	}
+	b.consecutive++
+	if b.consecutive >= b.failures {
+		b.openUntil = b.clock.Now().Add(b.cooldown)
+		log.Warnw("Providers circuit breaker open; failing requests fast", "failures", b.consecutive, "cooldown", b.cooldown, "err", err)
+	}
+}
@@ -0,0 +1,119 @@
+package providers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+)
+
+const (
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 5 * time.Second
+	defaultHealthPath    = "health"
+)
+
+// config contains all options for the pool.
+type config struct {
+	clock         clock.Clock
+	httpClient    *http.Client
+	checkInterval time.Duration
+	checkTimeout  time.Duration
+	healthPath    string
+
+	breakerFailures int
+	breakerCooldown time.Duration
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	cfg := config{
+		clock:         clock.New(),
+		httpClient:    http.DefaultClient,
+		checkInterval: defaultCheckInterval,
+		checkTimeout:  defaultCheckTimeout,
+		healthPath:    defaultHealthPath,
+	}
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d error: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithClock sets the clock used to schedule health checks. Defaults to the
+// system clock.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) error {
+		cfg.clock = c
+		return nil
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to fetch providers and to check the
+// health of endpoints.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cfg *config) error {
+		if c != nil {
+			cfg.httpClient = c
+		}
+		return nil
+	}
+}
+
+// WithCheckInterval sets the interval at which the health of endpoints is
+// checked. Zero disables health checks, in which case endpoints are only
+// considered down when requests to them fail, and up again once a request
+// succeeds. Defaults to 10 seconds.
+func WithCheckInterval(interval time.Duration) Option {
+	return func(cfg *config) error {
+		if interval < 0 {
+			return fmt.Errorf("check interval cannot be negative, got: %s", interval)
+		}
+		cfg.checkInterval = interval
+		return nil
+	}
+}
+
+// WithCheckTimeout sets the timeout of health checks. Defaults to 5 seconds.
+func WithCheckTimeout(timeout time.Duration) Option {
+	return func(cfg *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("check timeout must be positive, got: %s", timeout)
+		}
+		cfg.checkTimeout = timeout
+		return nil
+	}
+}
+
+// WithHealthPath sets the path, relative to the root of each endpoint, that
+// responds with 200 when the endpoint is healthy. Defaults to "health".
+func WithHealthPath(path string) Option {
+	return func(cfg *config) error {
+		cfg.healthPath = path
+		return nil
+	}
+}
+
+// WithCircuitBreaker fails requests fast with ErrCircuitOpen for the given
+// cooldown once the given number of consecutive requests failed on all
+// endpoints, rather than sending each to endpoints that are all down. Zero
+// failures disables the breaker, which is the default.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(cfg *config) error {
+		if failures < 0 {
+			return fmt.Errorf("circuit breaker failures cannot be negative, got: %d", failures)
+		}
+		if failures > 0 && cooldown <= 0 {
+			return fmt.Errorf("circuit breaker cooldown must be positive, got: %s", cooldown)
+		}
+		cfg.breakerFailures = failures
+		cfg.breakerCooldown = cooldown
+		return nil
+	}
+}
@@ -0,0 +1,397 @@
+// Package providers fetches provider information from replicas of an indexer
+// providers endpoint, i.e. /providers and /providers/<pid>, on behalf of
+// dhfind.
+//
+// A Pool spreads requests across the healthy endpoints in proportion to their
+// weight, and fails over to the next endpoint when a request fails, so that
+// dhfind keeps resolving providers while an endpoint is down. The health of
+// endpoints is checked periodically, and updated by the outcome of requests.
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/go-libipni/apierror"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/pcache"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var log = logging.Logger("providers")
+
+const (
+	providersPath = "providers"
+	weightParam   = ";weight="
+)
+
+var _ pcache.ProviderSource = (*Pool)(nil)
+
+type (
+	// Endpoint is the root URL of an indexer that serves provider information,
+	// and the relative weight at which it is selected among healthy
+	// endpoints. Endpoints of zero weight are backups, only selected when all
+	// weighted endpoints are down.
+	Endpoint struct {
+		URL    string `json:"url"`
+		Weight int    `json:"weight"`
+	}
+	// EndpointStatus is the health of an endpoint as last observed.
+	EndpointStatus struct {
+		Endpoint
+		Healthy bool `json:"healthy"`
+	}
+	// Pool fetches provider information from one of a number of endpoints
+	// that serve the same providers, failing over to another endpoint when
+	// one is down.
+	Pool struct {
+		clock         clock.Clock
+		httpClient    *http.Client
+		checkInterval time.Duration
+		checkTimeout  time.Duration
+		endpoints     []*endpoint
+		// breaker optionally fails requests fast while all endpoints are down.
+		breaker *breaker
+
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+	endpoint struct {
+		Endpoint
+		providersURL *url.URL
+		healthURL    *url.URL
+		healthy      atomic.Bool
+	}
+)
+
+// ParseEndpoint parses an endpoint given as its URL, optionally followed by
+// ";weight=" and its weight, e.g. "https://cid.contact;weight=3". The weight
+// defaults to 1.
+func ParseEndpoint(s string) (Endpoint, error) {
+	ep := Endpoint{URL: s, Weight: 1}
+	if i := strings.LastIndex(s, weightParam); i != -1 {
+		weight, err := strconv.Atoi(s[i+len(weightParam):])
+		if err != nil {
+			return Endpoint{}, fmt.Errorf("invalid weight of providers endpoint %s: %w", s, err)
+		}
+		ep.URL, ep.Weight = s[:i], weight
+	}
+	if _, err := ep.root(); err != nil {
+		return Endpoint{}, err
+	}
+	return ep, nil
+}
+
+// root validates the endpoint and returns its URL stripped of any path.
+func (ep Endpoint) root() (*url.URL, error) {
+	if ep.Weight < 0 {
+		return nil, fmt.Errorf("weight of providers endpoint %s cannot be negative", ep.URL)
+	}
+	u, err := url.Parse(ep.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("url must have http or https scheme: %s", ep.URL)
+	}
+	u.Path = ""
+	return u, nil
+}
+
+// ParseEndpoints parses each of the given endpoints via ParseEndpoint.
+func ParseEndpoints(ss []string) ([]Endpoint, error) {
+	eps := make([]Endpoint, 0, len(ss))
+	for _, s := range ss {
+		ep, err := ParseEndpoint(s)
+		if err != nil {
+			return nil, err
+		}
+		eps = append(eps, ep)
+	}
+	return eps, nil
+}
+
+// New instantiates a new Pool of the given endpoints, which are all
+// considered healthy until checked otherwise.
+func New(endpoints []Endpoint, options ...Option) (*Pool, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("at least one providers endpoint must be specified")
+	}
+	opts, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pool{
+		clock:         opts.clock,
+		httpClient:    opts.httpClient,
+		checkInterval: opts.checkInterval,
+		checkTimeout:  opts.checkTimeout,
+	}
+	if opts.breakerFailures > 0 {
+		p.breaker = &breaker{clock: opts.clock, failures: opts.breakerFailures, cooldown: opts.breakerCooldown}
+	}
+	for _, ep := range endpoints {
+		root, err := ep.root()
+		if err != nil {
+			return nil, err
+		}
+		e := &endpoint{
+			Endpoint:     ep,
+			providersURL: root.JoinPath(providersPath),
+			healthURL:    root.JoinPath(opts.healthPath),
+		}
+		e.healthy.Store(true)
+		p.endpoints = append(p.endpoints, e)
+	}
+	return p, nil
+}
+
+// Start starts periodically checking the health of endpoints in the
+// background, unless health checks are disabled.
+func (p *Pool) Start(ctx context.Context) {
+	if p.checkInterval == 0 {
+		return
+	}
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		ticker := p.clock.NewTicker(p.checkInterval)
+		defer ticker.Stop()
+		for {
+			p.Check(ctx)
+			select {
+			case <-ticker.C():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the background health checks started by Start.
+func (p *Pool) Close() error {
+	if p.cancel != nil {
+		p.cancel()
+		<-p.done
+	}
+	return nil
+}
+
+// Check checks the health of all endpoints concurrently. An endpoint is
+// healthy if its health path responds with 200 within the check timeout.
+func (p *Pool) Check(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, e := range p.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, p.checkTimeout)
+			defer cancel()
+			err := p.check(checkCtx, e)
+			if ctx.Err() != nil {
+				return
+			}
+			e.setHealthy(err)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Pool) check(ctx context.Context, e *endpoint) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.healthURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Status returns the health of each endpoint, in the order given to New.
+func (p *Pool) Status() []EndpointStatus {
+	status := make([]EndpointStatus, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		status = append(status, EndpointStatus{Endpoint: e.Endpoint, Healthy: e.healthy.Load()})
+	}
+	return status
+}
+
+// Cooldown returns how long requests fail fast with ErrCircuitOpen, or zero if
+// the circuit breaker is closed or disabled.
+func (p *Pool) Cooldown() time.Duration {
+	if p.breaker == nil {
+		return 0
+	}
+	return p.breaker.remaining()
+}
+
+// Fetch gets the information of the given provider from the first endpoint
+// that responds, in the order of selection.
+func (p *Pool) Fetch(ctx context.Context, pid peer.ID) (*model.ProviderInfo, error) {
+	var info model.ProviderInfo
+	if err := p.get(ctx, pid.String(), &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// FetchAll gets the information of all providers from the first endpoint that
+// responds, in the order of selection.
+func (p *Pool) FetchAll(ctx context.Context) ([]*model.ProviderInfo, error) {
+	var infos []*model.ProviderInfo
+	if err := p.get(ctx, "", &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+func (p *Pool) String() string {
+	urls := make([]string, 0, len(p.endpoints))
+	for _, e := range p.endpoints {
+		urls = append(urls, e.URL)
+	}
+	return strings.Join(urls, ",")
+}
+
+// get decodes the response to the given path under /providers of the first
+// endpoint that responds into v. Client errors such as 404 are returned as is,
+// since replicas would respond alike. Endpoints that are unreachable or respond
+// with a server error are considered down, and the request is retried on the
+// next endpoint, as it is for responses that cannot be decoded. Requests fail
+// fast with ErrCircuitOpen while the circuit breaker is open.
+func (p *Pool) get(ctx context.Context, path string, v any) error {
+	if p.breaker == nil {
+		return p.getAny(ctx, path, v)
+	}
+	if p.breaker.remaining() > 0 {
+		return ErrCircuitOpen
+	}
+	err := p.getAny(ctx, path, v)
+	var apiErr *apierror.Error
+	switch {
+	case ctx.Err() != nil:
+		// The outcome says nothing about the endpoints.
+	case errors.As(err, &apiErr) && apiErr.Status() < http.StatusInternalServerError:
+		p.breaker.record(nil)
+	default:
+		p.breaker.record(err)
+	}
+	return err
+}
+
+func (p *Pool) getAny(ctx context.Context, path string, v any) error {
+	var errs []error
+	for _, e := range p.order() {
+		err := p.getFrom(ctx, e, path, v)
+		var apiErr *apierror.Error
+		switch {
+		case err == nil:
+			e.setHealthy(nil)
+			return nil
+		case errors.As(err, &apiErr) && apiErr.Status() < http.StatusInternalServerError:
+			e.setHealthy(nil)
+			return err
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.As(err, new(*json.SyntaxError)), errors.As(err, new(*json.UnmarshalTypeError)):
+			log.Warnw("Invalid response from providers endpoint", "url", e.URL, "err", err)
+		default:
+			e.setHealthy(err)
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("all %d providers endpoints failed: %w", len(errs), errors.Join(errs...))
+}
+
+func (p *Pool) getFrom(ctx context.Context, e *endpoint, path string, v any) error {
+	u := e.providersURL
+	if path != "" {
+		u = u.JoinPath(path)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return apierror.FromResponse(resp.StatusCode, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// order returns the endpoints in the order in which to try them: healthy
+// weighted endpoints in a random order biased by weight, then healthy backup
+// endpoints, then the remaining endpoints as a last resort.
+func (p *Pool) order() []*endpoint {
+	var weighted, backups, down []*endpoint
+	var total int
+	for _, e := range p.endpoints {
+		switch {
+		case !e.healthy.Load():
+			down = append(down, e)
+		case e.Weight == 0:
+			backups = append(backups, e)
+		default:
+			weighted = append(weighted, e)
+			total += e.Weight
+		}
+	}
+	order := make([]*endpoint, 0, len(p.endpoints))
+	for len(weighted) != 0 {
+		n := rand.IntN(total)
+		for i, e := range weighted {
+			if n -= e.Weight; n < 0 {
+				order = append(order, e)
+				total -= e.Weight
+				weighted = append(weighted[:i], weighted[i+1:]...)
+				break
+			}
+		}
+	}
+	order = append(order, backups...)
+	return append(order, down...)
+}
+
+// setHealthy marks the endpoint as healthy if err is nil, and as down
+// otherwise, logging changes in health.
+func (e *endpoint) setHealthy(err error) {
+	healthy := err == nil
+	if e.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		log.Infow("Providers endpoint is up", "url", e.URL)
+	} else {
+		log.Warnw("Providers endpoint is down; failing over", "url", e.URL, "err", err)
+	}
+}
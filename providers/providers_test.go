@@ -0,0 +1,241 @@
+package providers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/providers"
+	"github.com/ipni/go-libipni/apierror"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+const providerID = "12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA"
+
+// replica serves the same provider at /providers, and responds to all
+// requests with 503 while down.
+type replica struct {
+	info     model.ProviderInfo
+	down     atomic.Bool
+	status   atomic.Int32
+	requests atomic.Int32
+}
+
+func (rp *replica) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rp.down.Load() {
+		http.Error(w, "", http.StatusServiceUnavailable)
+		return
+	}
+	if status := rp.status.Load(); status != 0 && r.URL.Path != "/health" {
+		rp.requests.Add(1)
+		http.Error(w, "", int(status))
+		return
+	}
+	switch r.URL.Path {
+	case "/health":
+		return
+	case "/providers":
+		rp.requests.Add(1)
+		_ = json.NewEncoder(w).Encode([]model.ProviderInfo{rp.info})
+	case "/providers/" + rp.info.AddrInfo.ID.String():
+		rp.requests.Add(1)
+		_ = json.NewEncoder(w).Encode(rp.info)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newReplica(t *testing.T) (*replica, string) {
+	pid, err := peer.Decode(providerID)
+	require.NoError(t, err)
+	rp := &replica{info: model.ProviderInfo{AddrInfo: peer.AddrInfo{ID: pid}}}
+	srv := httptest.NewServer(rp)
+	t.Cleanup(srv.Close)
+	return rp, srv.URL
+}
+
+func TestParseEndpoint(t *testing.T) {
+	ep, err := providers.ParseEndpoint("https://cid.contact")
+	require.NoError(t, err)
+	require.Equal(t, providers.Endpoint{URL: "https://cid.contact", Weight: 1}, ep)
+	ep, err = providers.ParseEndpoint("https://cid.contact/;weight=0")
+	require.NoError(t, err)
+	require.Equal(t, providers.Endpoint{URL: "https://cid.contact/", Weight: 0}, ep)
+
+	_, err = providers.ParseEndpoint("https://cid.contact;weight=fish")
+	require.ErrorContains(t, err, "invalid weight")
+	_, err = providers.ParseEndpoint("https://cid.contact;weight=-1")
+	require.ErrorContains(t, err, "cannot be negative")
+	_, err = providers.ParseEndpoint("cid.contact")
+	require.ErrorContains(t, err, "http or https scheme")
+	_, err = providers.New(nil)
+	require.ErrorContains(t, err, "at least one")
+}
+
+func TestPool_FailsOver(t *testing.T) {
+	rp1, url1 := newReplica(t)
+	rp2, url2 := newReplica(t)
+	subject, err := providers.New([]providers.Endpoint{{URL: url1, Weight: 1}, {URL: url2, Weight: 1}}, providers.WithCheckInterval(0))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	rp1.down.Store(true)
+	for i := 0; i < 10; i++ {
+		info, err := subject.Fetch(ctx, rp1.info.AddrInfo.ID)
+		require.NoError(t, err)
+		require.Equal(t, rp1.info.AddrInfo.ID, info.AddrInfo.ID)
+	}
+	require.Zero(t, rp1.requests.Load())
+	require.Equal(t, int32(10), rp2.requests.Load())
+	require.Equal(t, []providers.EndpointStatus{
+		{Endpoint: providers.Endpoint{URL: url1, Weight: 1}, Healthy: false},
+		{Endpoint: providers.Endpoint{URL: url2, Weight: 1}, Healthy: true},
+	}, subject.Status())
+
+	// Down endpoints are still tried as a last resort.
+	rp1.down.Store(false)
+	rp2.down.Store(true)
+	infos, err := subject.FetchAll(ctx)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, int32(1), rp1.requests.Load())
+	require.True(t, subject.Status()[0].Healthy)
+	require.False(t, subject.Status()[1].Healthy)
+
+	rp1.down.Store(true)
+	_, err = subject.FetchAll(ctx)
+	require.ErrorContains(t, err, "all 2 providers endpoints failed")
+
+	// Not found is a valid response, and is not failed over.
+	rp1.down.Store(false)
+	_, err = subject.Fetch(ctx, "fish")
+	var apiErr *apierror.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusNotFound, apiErr.Status())
+}
+
+func TestPool_ClientErrorsKeepEndpointsUp(t *testing.T) {
+	rp1, url1 := newReplica(t)
+	rp2, url2 := newReplica(t)
+	subject, err := providers.New([]providers.Endpoint{{URL: url1, Weight: 1}, {URL: url2, Weight: 0}}, providers.WithCheckInterval(0))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// Client errors are returned without failing over, since replicas would
+	// respond alike.
+	rp1.status.Store(http.StatusBadRequest)
+	_, err = subject.Fetch(ctx, rp1.info.AddrInfo.ID)
+	var apiErr *apierror.Error
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusBadRequest, apiErr.Status())
+	require.Equal(t, int32(1), rp1.requests.Load())
+	require.Zero(t, rp2.requests.Load())
+	require.True(t, subject.Status()[0].Healthy)
+
+	// Server errors take the endpoint down.
+	rp1.status.Store(http.StatusInternalServerError)
+	info, err := subject.Fetch(ctx, rp1.info.AddrInfo.ID)
+	require.NoError(t, err)
+	require.Equal(t, rp1.info.AddrInfo.ID, info.AddrInfo.ID)
+	require.Equal(t, int32(1), rp2.requests.Load())
+	require.False(t, subject.Status()[0].Healthy)
+	require.True(t, subject.Status()[1].Healthy)
+}
+
+func TestPool_SelectsByWeight(t *testing.T) {
+	rp1, url1 := newReplica(t)
+	rp2, url2 := newReplica(t)
+	rp3, url3 := newReplica(t)
+	subject, err := providers.New([]providers.Endpoint{{URL: url1, Weight: 3}, {URL: url2, Weight: 1}, {URL: url3, Weight: 0}}, providers.WithCheckInterval(0))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	for i := 0; i < 400; i++ {
+		_, err := subject.FetchAll(ctx)
+		require.NoError(t, err)
+	}
+	require.Greater(t, rp1.requests.Load(), 2*rp2.requests.Load())
+	require.NotZero(t, rp2.requests.Load())
+	require.Zero(t, rp3.requests.Load())
+
+	// Backups are selected once all weighted endpoints are down.
+	rp1.down.Store(true)
+	rp2.down.Store(true)
+	_, err = subject.FetchAll(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), rp3.requests.Load())
+}
+
+func TestPool_Check(t *testing.T) {
+	rp1, url1 := newReplica(t)
+	_, url2 := newReplica(t)
+	subject, err := providers.New([]providers.Endpoint{{URL: url1, Weight: 1}, {URL: url2, Weight: 1}})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	rp1.down.Store(true)
+	subject.Check(ctx)
+	require.False(t, subject.Status()[0].Healthy)
+	require.True(t, subject.Status()[1].Healthy)
+	for i := 0; i < 10; i++ {
+		_, err := subject.FetchAll(ctx)
+		require.NoError(t, err)
+	}
+
+	rp1.down.Store(false)
+	subject.Check(ctx)
+	require.True(t, subject.Status()[0].Healthy)
+
+	subject.Start(ctx)
+	require.NoError(t, subject.Close())
+}
+
+func TestPool_CircuitBreaker(t *testing.T) {
+	rp, url := newReplica(t)
+	clk := clock.NewMock(time.Unix(0, 0))
+	_, err := providers.New([]providers.Endpoint{{URL: url, Weight: 1}}, providers.WithCircuitBreaker(2, 0))
+	require.ErrorContains(t, err, "cooldown must be positive")
+	subject, err := providers.New([]providers.Endpoint{{URL: url, Weight: 1}}, providers.WithCheckInterval(0), providers.WithClock(clk),
+		providers.WithCircuitBreaker(2, time.Minute))
+	require.NoError(t, err)
+	ctx := context.Background()
+	pid := rp.info.AddrInfo.ID
+
+	// The breaker opens after consecutive failures, and then fails requests
+	// without sending them.
+	rp.status.Store(http.StatusInternalServerError)
+	for i := 0; i < 2; i++ {
+		_, err = subject.Fetch(ctx, pid)
+		require.ErrorContains(t, err, "all 1 providers endpoints failed")
+		require.NotErrorIs(t, err, providers.ErrCircuitOpen)
+	}
+	require.Equal(t, time.Minute, subject.Cooldown())
+	_, err = subject.FetchAll(ctx)
+	require.ErrorIs(t, err, providers.ErrCircuitOpen)
+	require.Equal(t, int32(2), rp.requests.Load())
+
+	// Once the cooldown elapses, a failure opens it again.
+	clk.Add(time.Minute)
+	require.Zero(t, subject.Cooldown())
+	_, err = subject.Fetch(ctx, pid)
+	require.NotErrorIs(t, err, providers.ErrCircuitOpen)
+	require.Equal(t, int32(3), rp.requests.Load())
+	require.Equal(t, time.Minute, subject.Cooldown())
+
+	// And a success closes it.
+	clk.Add(time.Minute)
+	rp.status.Store(0)
+	_, err = subject.Fetch(ctx, pid)
+	require.NoError(t, err)
+	rp.status.Store(http.StatusInternalServerError)
+	_, err = subject.Fetch(ctx, pid)
+	require.NotErrorIs(t, err, providers.ErrCircuitOpen)
+	require.Zero(t, subject.Cooldown())
+}
@@ -0,0 +1,103 @@
+package prune
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+)
+
+const (
+	defaultInterval     = time.Hour
+	defaultRemovalGrace = 24 * time.Hour
+)
+
+// config contains all options for the pruner.
+type config struct {
+	clock        clock.Clock
+	httpClient   *http.Client
+	interval     time.Duration
+	maxAge       time.Duration
+	removalGrace time.Duration
+	dryRun       bool
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	cfg := config{
+		clock:        clock.New(),
+		httpClient:   http.DefaultClient,
+		interval:     defaultInterval,
+		removalGrace: defaultRemovalGrace,
+	}
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d error: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithClock sets the clock used to schedule refreshes and to determine
+// staleness. Defaults to the system clock.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) error {
+		cfg.clock = c
+		return nil
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to fetch providers.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cfg *config) error {
+		if c != nil {
+			cfg.httpClient = c
+		}
+		return nil
+	}
+}
+
+// WithInterval sets the interval at which providers are fetched. Defaults to
+// one hour.
+func WithInterval(interval time.Duration) Option {
+	return func(cfg *config) error {
+		if interval <= 0 {
+			return fmt.Errorf("interval must be positive, got: %s", interval)
+		}
+		cfg.interval = interval
+		return nil
+	}
+}
+
+// WithMaxAge sets the maximum time since the last advertisement of a provider
+// after which the provider is considered expired. Zero, which is the default,
+// disables expiry; only removed providers are then considered stale.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(cfg *config) error {
+		cfg.maxAge = maxAge
+		return nil
+	}
+}
+
+// WithRemovalGrace sets how long a previously listed provider must be absent
+// from all providers endpoints before it is considered removed. Defaults to 24
+// hours.
+func WithRemovalGrace(grace time.Duration) Option {
+	return func(cfg *config) error {
+		cfg.removalGrace = grace
+		return nil
+	}
+}
+
+// WithDryRun sets whether the records of stale providers are only reported
+// rather than deleted.
+func WithDryRun(dryRun bool) Option {
+	return func(cfg *config) error {
+		cfg.dryRun = dryRun
+		return nil
+	}
+}
@@ -0,0 +1,276 @@
+// Package prune identifies providers that have been removed from, or expired
+// on, the indexer so that their records can be pruned from dhstore.
+//
+// Records in dhstore are encrypted, so the provider that a record belongs to
+// is only known once the record is decrypted during a dhfind lookup. A
+// deletion campaign is therefore launched for each stale provider, and the
+// records of that provider are deleted as they are encountered by lookups.
+package prune
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/providers"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/pcache"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var log = logging.Logger("prune")
+
+const (
+	// ReasonRemoved indicates that the provider is no longer listed by any of
+	// the providers endpoints.
+	ReasonRemoved = "removed"
+	// ReasonExpired indicates that the provider has not published an
+	// advertisement for longer than the configured max age.
+	ReasonExpired = "expired"
+)
+
+type (
+	// Pruner periodically fetches the list of providers from the configured
+	// providers URLs and launches deletion campaigns for providers that are
+	// removed or expired.
+	Pruner struct {
+		httpClient *http.Client
+		clock      clock.Clock
+
+		interval     time.Duration
+		maxAge       time.Duration
+		removalGrace time.Duration
+		dryRun       bool
+
+		mu      sync.RWMutex
+		sources []pcache.ProviderSource
+		// lastSeen is the last time each provider was listed by a providers
+		// endpoint.
+		lastSeen  map[peer.ID]time.Time
+		campaigns map[peer.ID]*Campaign
+
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+	// Campaign describes the deletion campaign for the records of a stale
+	// provider.
+	Campaign struct {
+		Provider peer.ID   `json:"provider"`
+		Reason   string    `json:"reason"`
+		Since    time.Time `json:"since"`
+		// Pruned is the number of records pruned so far. In dry-run mode, it
+		// is the number of records that would have been pruned.
+		Pruned int64 `json:"pruned"`
+	}
+)
+
+// New instantiates a new Pruner that fetches provider information from the
+// given providers URLs.
+func New(providersURLs []string, options ...Option) (*Pruner, error) {
+	opts, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pruner{
+		httpClient:   opts.httpClient,
+		clock:        opts.clock,
+		interval:     opts.interval,
+		maxAge:       opts.maxAge,
+		removalGrace: opts.removalGrace,
+		dryRun:       opts.dryRun,
+		lastSeen:     make(map[peer.ID]time.Time),
+		campaigns:    make(map[peer.ID]*Campaign),
+	}
+	if err := p.SetProvidersURLs(providersURLs); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetProvidersURLs changes the providers URLs from which providers are fetched
+// as of the next refresh. The weights of URLs, as parsed by
+// providers.ParseEndpoint, are ignored. Providers only listed by the previous URLs are
+// considered removed once absent for the removal grace period.
+func (p *Pruner) SetProvidersURLs(providersURLs []string) error {
+	sources, err := p.newSources(providersURLs)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sources = sources
+	return nil
+}
+
+// ValidateProvidersURLs returns the error that SetProvidersURLs would return
+// for the given providers URLs, without changing them.
+func (p *Pruner) ValidateProvidersURLs(providersURLs []string) error {
+	_, err := p.newSources(providersURLs)
+	return err
+}
+
+func (p *Pruner) newSources(providersURLs []string) ([]pcache.ProviderSource, error) {
+	if len(providersURLs) == 0 {
+		return nil, fmt.Errorf("at least one providers URL must be specified")
+	}
+	eps, err := providers.ParseEndpoints(providersURLs)
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]pcache.ProviderSource, 0, len(eps))
+	for _, ep := range eps {
+		src, err := pcache.NewHTTPSource(ep.URL, p.httpClient)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// Start starts periodically refreshing the list of stale providers in the
+// background.
+func (p *Pruner) Start(ctx context.Context) {
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		ticker := p.clock.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			if err := p.Refresh(ctx); err != nil {
+				log.Warnw("Failed to refresh stale providers", "err", err)
+			}
+			select {
+			case <-ticker.C():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	log.Infow("Stale provider pruning started", "interval", p.interval, "maxAge", p.maxAge, "dryRun", p.dryRun)
+}
+
+// Close stops the background refresh started by Start.
+func (p *Pruner) Close() error {
+	if p.cancel != nil {
+		p.cancel()
+		<-p.done
+	}
+	return nil
+}
+
+// Refresh fetches the providers from all providers URLs and updates the set of
+// stale providers accordingly.
+func (p *Pruner) Refresh(ctx context.Context) error {
+	p.mu.RLock()
+	sources := p.sources
+	p.mu.RUnlock()
+	infos := make(map[peer.ID]*model.ProviderInfo)
+	var failed int
+	for _, src := range sources {
+		fetched, err := src.FetchAll(ctx)
+		if err != nil {
+			log.Warnw("Failed to fetch providers", "source", src.String(), "err", err)
+			failed++
+			continue
+		}
+		for _, info := range fetched {
+			infos[info.AddrInfo.ID] = info
+		}
+	}
+	if failed == len(sources) {
+		return fmt.Errorf("failed to fetch providers from all %d sources", failed)
+	}
+
+	now := p.clock.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for pid, info := range infos {
+		p.lastSeen[pid] = now
+		if p.expired(info, now) {
+			p.launch(pid, ReasonExpired, now)
+		} else if c, ok := p.campaigns[pid]; ok {
+			log.Infow("Stopping deletion campaign for provider that is no longer stale", "provider", pid, "reason", c.Reason, "pruned", c.Pruned)
+			delete(p.campaigns, pid)
+		}
+	}
+
+	// Only detect removals when all sources responded, since a provider
+	// missing from a failed source is not necessarily removed.
+	if failed != 0 {
+		return nil
+	}
+	for pid, seen := range p.lastSeen {
+		if _, ok := infos[pid]; ok {
+			continue
+		}
+		if now.Sub(seen) >= p.removalGrace {
+			p.launch(pid, ReasonRemoved, now)
+			delete(p.lastSeen, pid)
+		}
+	}
+	return nil
+}
+
+func (p *Pruner) expired(info *model.ProviderInfo, now time.Time) bool {
+	if p.maxAge == 0 || info.LastAdvertisementTime == "" {
+		return false
+	}
+	lastAdTime, err := time.Parse(time.RFC3339, info.LastAdvertisementTime)
+	if err != nil {
+		return false
+	}
+	return now.Sub(lastAdTime) > p.maxAge
+}
+
+func (p *Pruner) launch(pid peer.ID, reason string, now time.Time) {
+	if _, ok := p.campaigns[pid]; ok {
+		return
+	}
+	p.campaigns[pid] = &Campaign{
+		Provider: pid,
+		Reason:   reason,
+		Since:    now,
+	}
+	log.Infow("Launched deletion campaign for stale provider", "provider", pid, "reason", reason, "dryRun", p.dryRun)
+}
+
+// IsStale returns whether there is a deletion campaign for the given provider.
+func (p *Pruner) IsStale(pid peer.ID) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.campaigns[pid]
+	return ok
+}
+
+// DryRun returns whether the pruner is in dry-run mode, in which records of
+// stale providers are only reported and never deleted.
+func (p *Pruner) DryRun() bool {
+	return p.dryRun
+}
+
+// Pruned records that count records of the given provider have been pruned.
+func (p *Pruner) Pruned(pid peer.ID, count int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.campaigns[pid]; ok {
+		c.Pruned += int64(count)
+	}
+}
+
+// Campaigns returns the currently active deletion campaigns.
+func (p *Pruner) Campaigns() []Campaign {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	campaigns := make([]Campaign, 0, len(p.campaigns))
+	for _, c := range p.campaigns {
+		campaigns = append(campaigns, *c)
+	}
+	return campaigns
+}
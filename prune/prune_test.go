@@ -0,0 +1,130 @@
+package prune_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/prune"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	providerID1 = "12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA"
+	providerID2 = "12D3KooWQk7r5WKUfTn9dVntWnmvfHfVBaghWtDdZNkRExQ7NwK1"
+)
+
+type providersSource struct {
+	mu    sync.Mutex
+	infos []model.ProviderInfo
+}
+
+func (ps *providersSource) set(infos ...model.ProviderInfo) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.infos = infos
+}
+
+func (ps *providersSource) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ps.infos)
+}
+
+func TestPruner_DetectsRemovedProviders(t *testing.T) {
+	pid1, err := peer.Decode(providerID1)
+	require.NoError(t, err)
+	pid2, err := peer.Decode(providerID2)
+	require.NoError(t, err)
+
+	var src providersSource
+	src.set(model.ProviderInfo{AddrInfo: peer.AddrInfo{ID: pid1}}, model.ProviderInfo{AddrInfo: peer.AddrInfo{ID: pid2}})
+	srv := httptest.NewServer(&src)
+	defer srv.Close()
+
+	clk := clock.NewMock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	subject, err := prune.New([]string{srv.URL}, prune.WithClock(clk), prune.WithRemovalGrace(time.Hour))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, subject.Refresh(ctx))
+	require.False(t, subject.IsStale(pid1))
+	require.False(t, subject.IsStale(pid2))
+
+	// Provider 2 is removed, but not stale until the grace period passes.
+	src.set(model.ProviderInfo{AddrInfo: peer.AddrInfo{ID: pid1}})
+	clk.Add(30 * time.Minute)
+	require.NoError(t, subject.Refresh(ctx))
+	require.False(t, subject.IsStale(pid2))
+
+	clk.Add(30 * time.Minute)
+	require.NoError(t, subject.Refresh(ctx))
+	require.False(t, subject.IsStale(pid1))
+	require.True(t, subject.IsStale(pid2))
+
+	campaigns := subject.Campaigns()
+	require.Len(t, campaigns, 1)
+	require.Equal(t, pid2, campaigns[0].Provider)
+	require.Equal(t, prune.ReasonRemoved, campaigns[0].Reason)
+
+	// Provider 2 reappears and is no longer stale.
+	src.set(model.ProviderInfo{AddrInfo: peer.AddrInfo{ID: pid1}}, model.ProviderInfo{AddrInfo: peer.AddrInfo{ID: pid2}})
+	require.NoError(t, subject.Refresh(ctx))
+	require.False(t, subject.IsStale(pid2))
+	require.Empty(t, subject.Campaigns())
+}
+
+func TestPruner_DetectsExpiredProviders(t *testing.T) {
+	pid1, err := peer.Decode(providerID1)
+	require.NoError(t, err)
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var src providersSource
+	src.set(model.ProviderInfo{AddrInfo: peer.AddrInfo{ID: pid1}, LastAdvertisementTime: now.Format(time.RFC3339)})
+	srv := httptest.NewServer(&src)
+	defer srv.Close()
+
+	clk := clock.NewMock(now)
+	subject, err := prune.New([]string{srv.URL}, prune.WithClock(clk), prune.WithMaxAge(48*time.Hour), prune.WithDryRun(true))
+	require.NoError(t, err)
+	require.True(t, subject.DryRun())
+
+	ctx := context.Background()
+	require.NoError(t, subject.Refresh(ctx))
+	require.False(t, subject.IsStale(pid1))
+
+	clk.Add(49 * time.Hour)
+	require.NoError(t, subject.Refresh(ctx))
+	require.True(t, subject.IsStale(pid1))
+	require.Equal(t, prune.ReasonExpired, subject.Campaigns()[0].Reason)
+
+	subject.Pruned(pid1, 3)
+	require.Equal(t, int64(3), subject.Campaigns()[0].Pruned)
+}
+
+func TestPruner_FailedFetchDoesNotRemove(t *testing.T) {
+	pid1, err := peer.Decode(providerID1)
+	require.NoError(t, err)
+
+	var src providersSource
+	src.set(model.ProviderInfo{AddrInfo: peer.AddrInfo{ID: pid1}})
+	srv := httptest.NewServer(&src)
+
+	clk := clock.NewMock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	subject, err := prune.New([]string{srv.URL}, prune.WithClock(clk), prune.WithRemovalGrace(0))
+	require.NoError(t, err)
+	require.NoError(t, subject.Refresh(context.Background()))
+
+	srv.Close()
+	clk.Add(time.Hour)
+	require.Error(t, subject.Refresh(context.Background()))
+	require.False(t, subject.IsStale(pid1))
+}
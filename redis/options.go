@@ -0,0 +1,123 @@
+package redis
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultKeyPrefix is the default prefix of the keys of the store.
+	defaultKeyPrefix = "dhstore/"
+	// defaultTimeout is the default timeout of commands.
+	defaultTimeout = 5 * time.Second
+	// defaultMaxBatchSize is the default maximum number of commands sent in a
+	// single pipeline.
+	defaultMaxBatchSize = 100
+)
+
+type (
+	Option  func(*options) error
+	options struct {
+		addrs        []string
+		masterName   string
+		db           int
+		username     string
+		password     string
+		keyPrefix    string
+		timeout      time.Duration
+		maxBatchSize int
+	}
+)
+
+func newOptions(o ...Option) (*options, error) {
+	opts := options{
+		keyPrefix:    defaultKeyPrefix,
+		timeout:      defaultTimeout,
+		maxBatchSize: defaultMaxBatchSize,
+	}
+	for _, apply := range o {
+		if err := apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.addrs) == 0 {
+		return nil, fmt.Errorf("at least one address must be specified")
+	}
+	return &opts, nil
+}
+
+// WithAddrs sets the addresses of the Redis servers to connect to. A single
+// address connects to a standalone server, and multiple addresses to a Redis
+// Cluster, unless WithMasterName is set. Required.
+func WithAddrs(addrs ...string) Option {
+	return func(o *options) error {
+		o.addrs = addrs
+		return nil
+	}
+}
+
+// WithMasterName sets the name of the master monitored by the Redis Sentinels
+// at the addresses set by WithAddrs, so that writes fail over to a replica
+// promoted by the Sentinels. Disabled when empty, which is the default.
+func WithMasterName(name string) Option {
+	return func(o *options) error {
+		o.masterName = name
+		return nil
+	}
+}
+
+// WithDB sets the logical database in which keys are stored. Not supported by
+// Redis Cluster. Defaults to 0.
+func WithDB(db int) Option {
+	return func(o *options) error {
+		if db < 0 {
+			return fmt.Errorf("db must not be negative, got: %d", db)
+		}
+		o.db = db
+		return nil
+	}
+}
+
+// WithCredentials sets the username and password with which to authenticate.
+// A password without a username authenticates as the default user.
+// Authentication is disabled when both are empty, which is the default.
+func WithCredentials(username, password string) Option {
+	return func(o *options) error {
+		o.username = username
+		o.password = password
+		return nil
+	}
+}
+
+// WithKeyPrefix sets the prefix of the keys of the store, so that it can share
+// a database with other applications. Defaults to "dhstore/".
+func WithKeyPrefix(prefix string) Option {
+	return func(o *options) error {
+		o.keyPrefix = prefix
+		return nil
+	}
+}
+
+// WithTimeout sets the timeout of commands. Defaults to 5 seconds.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout must be positive, got: %s", timeout)
+		}
+		o.timeout = timeout
+		return nil
+	}
+}
+
+// WithMaxBatchSize sets the maximum number of commands sent in a single
+// pipeline. Larger batches of writes are split across multiple pipelines.
+// Defaults to 100.
+func WithMaxBatchSize(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return fmt.Errorf("max batch size must be positive, got: %d", n)
+		}
+		o.maxBatchSize = n
+		return nil
+	}
+}
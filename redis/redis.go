@@ -0,0 +1,193 @@
+// Package redis implements a DHStore backed by Redis, or a Redis compatible
+// server such as KeyDB, keeping all data in memory.
+//
+// The encrypted value keys of each multihash are stored as members of a set,
+// so that merging and deleting value keys are blind writes via SADD and SREM.
+// Redis deletes sets left empty, and so multihashes with no remaining value
+// keys. Metadata is stored as strings.
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	_ dhstore.DHStore              = (*RedisDHStore)(nil)
+	_ dhstore.MetadataBatchPutter  = (*RedisDHStore)(nil)
+	_ dhstore.MetadataBatchDeleter = (*RedisDHStore)(nil)
+
+	logger = logging.Logger("store/redis")
+)
+
+type RedisDHStore struct {
+	client       redis.UniversalClient
+	maxBatchSize int
+
+	// multihashPrefix and metadataPrefix are the prefixes of the keys of
+	// multihash sets and metadata strings respectively.
+	multihashPrefix string
+	metadataPrefix  string
+}
+
+// NewRedisDHStore connects to the Redis servers at the given addresses, and
+// checks that they are reachable.
+func NewRedisDHStore(o ...Option) (*RedisDHStore, error) {
+	opts, err := newOptions(o...)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:        opts.addrs,
+		MasterName:   opts.masterName,
+		DB:           opts.db,
+		Username:     opts.username,
+		Password:     opts.password,
+		DialTimeout:  opts.timeout,
+		ReadTimeout:  opts.timeout,
+		WriteTimeout: opts.timeout,
+	})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+	logger.Infow("Connected to Redis", "addrs", opts.addrs, "masterName", opts.masterName, "db", opts.db)
+	return &RedisDHStore{
+		client:          client,
+		maxBatchSize:    opts.maxBatchSize,
+		multihashPrefix: opts.keyPrefix + "mh/",
+		metadataPrefix:  opts.keyPrefix + "md/",
+	}, nil
+}
+
+func (s *RedisDHStore) MergeIndexes(indexes []dhstore.Index) error {
+	return s.writeIndexes(indexes, func(ctx context.Context, pipe redis.Pipeliner, index dhstore.Index) {
+		pipe.SAdd(ctx, s.multihashKey(index.Key), []byte(index.Value))
+	})
+}
+
+func (s *RedisDHStore) DeleteIndexes(indexes []dhstore.Index) error {
+	return s.writeIndexes(indexes, func(ctx context.Context, pipe redis.Pipeliner, index dhstore.Index) {
+		pipe.SRem(ctx, s.multihashKey(index.Key), []byte(index.Value))
+	})
+}
+
+// writeIndexes validates the given indexes and queues the command of each
+// in pipelines of at most maxBatchSize commands.
+func (s *RedisDHStore) writeIndexes(indexes []dhstore.Index, queue func(context.Context, redis.Pipeliner, dhstore.Index)) error {
+	for _, index := range indexes {
+		if err := checkMultihash(index.Key); err != nil {
+			return err
+		}
+	}
+	return s.pipeline(len(indexes), func(ctx context.Context, pipe redis.Pipeliner, i int) {
+		queue(ctx, pipe, indexes[i])
+	})
+}
+
+// pipeline queues a command for each of n items in pipelines of at most
+// maxBatchSize commands. Returns dhstore.ErrPartialWrite if a pipeline fails
+// after others were written.
+func (s *RedisDHStore) pipeline(n int, queue func(ctx context.Context, pipe redis.Pipeliner, i int)) error {
+	ctx := context.Background()
+	var written int
+	for written < n {
+		end := min(written+s.maxBatchSize, n)
+		if _, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i := written; i < end; i++ {
+				queue(ctx, pipe, i)
+			}
+			return nil
+		}); err != nil {
+			if written == 0 {
+				return err
+			}
+			return dhstore.ErrPartialWrite{Written: written, Total: n, Err: err}
+		}
+		written = end
+	}
+	return nil
+}
+
+func (s *RedisDHStore) PutMetadata(hvk dhstore.HashedValueKey, em dhstore.EncryptedMetadata) error {
+	return s.client.Set(context.Background(), s.metadataKey(hvk), []byte(em), 0).Err()
+}
+
+// PutMetadataBatch stores the given metadata records in pipelines of at most
+// maxBatchSize commands.
+func (s *RedisDHStore) PutMetadataBatch(records []dhstore.Metadata) error {
+	return s.pipeline(len(records), func(ctx context.Context, pipe redis.Pipeliner, i int) {
+		pipe.Set(ctx, s.metadataKey(records[i].Key), []byte(records[i].Value), 0)
+	})
+}
+
+func (s *RedisDHStore) Lookup(mh multihash.Multihash) ([]dhstore.EncryptedValueKey, error) {
+	if err := checkMultihash(mh); err != nil {
+		return nil, err
+	}
+	members, err := s.client.SMembers(context.Background(), s.multihashKey(mh)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, nil
+	}
+	evks := make([]dhstore.EncryptedValueKey, 0, len(members))
+	for _, member := range members {
+		evks = append(evks, dhstore.EncryptedValueKey(member))
+	}
+	return evks, nil
+}
+
+func (s *RedisDHStore) GetMetadata(hvk dhstore.HashedValueKey) (dhstore.EncryptedMetadata, error) {
+	value, err := s.client.Get(context.Background(), s.metadataKey(hvk)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return value, nil
+}
+
+// DeleteMetadataBatch deletes the metadata of the given keys in pipelines of
+// at most maxBatchSize commands.
+func (s *RedisDHStore) DeleteMetadataBatch(hvks []dhstore.HashedValueKey) error {
+	return s.pipeline(len(hvks), func(ctx context.Context, pipe redis.Pipeliner, i int) {
+		pipe.Del(ctx, s.metadataKey(hvks[i]))
+	})
+}
+
+func (s *RedisDHStore) DeleteMetadata(hvk dhstore.HashedValueKey) error {
+	return s.client.Del(context.Background(), s.metadataKey(hvk)).Err()
+}
+
+func (s *RedisDHStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisDHStore) multihashKey(mh multihash.Multihash) string {
+	return s.multihashPrefix + string(mh)
+}
+
+func (s *RedisDHStore) metadataKey(hvk dhstore.HashedValueKey) string {
+	return s.metadataPrefix + string(hvk)
+}
+
+func checkMultihash(mh multihash.Multihash) error {
+	dmh, err := multihash.Decode(mh)
+	if err != nil {
+		return dhstore.ErrMultihashDecode{Err: err, Mh: mh}
+	}
+	if dmh.Code != multihash.DBL_SHA2_256 {
+		return dhstore.ErrUnsupportedMulticodecCode{Code: multicodec.Code(dmh.Code)}
+	}
+	return nil
+}
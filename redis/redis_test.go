@@ -0,0 +1,86 @@
+package redis_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/internal/testutil"
+	"github.com/ipni/dhstore/redis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRedisDHStore_RejectsInvalidOptions(t *testing.T) {
+	_, err := redis.NewRedisDHStore()
+	require.ErrorContains(t, err, "address")
+
+	_, err = redis.NewRedisDHStore(redis.WithAddrs("127.0.0.1:6379"), redis.WithDB(-1))
+	require.ErrorContains(t, err, "db must not be negative")
+
+	_, err = redis.NewRedisDHStore(redis.WithAddrs("127.0.0.1:6379"), redis.WithMaxBatchSize(0))
+	require.ErrorContains(t, err, "max batch size")
+}
+
+// newTestStore connects to the Redis server at DHSTORE_TEST_REDIS_ADDR, or
+// skips the test if unset. Keys are written under a prefix unique to the test.
+func newTestStore(t *testing.T) *redis.RedisDHStore {
+	addr := os.Getenv("DHSTORE_TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("DHSTORE_TEST_REDIS_ADDR is not set")
+	}
+	subject, err := redis.NewRedisDHStore(redis.WithAddrs(addr), redis.WithKeyPrefix(t.Name()+"/"), redis.WithMaxBatchSize(2))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	return subject
+}
+
+func TestRedisDHStore_MergeAndDeleteIndexes(t *testing.T) {
+	subject := newTestStore(t)
+	fish, lobster := testutil.RandomDblSha256(t), testutil.RandomDblSha256(t)
+
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("barreleye")},
+		{Key: lobster, Value: []byte("squat")},
+		{Key: fish, Value: []byte("barreleye")},
+		{Key: fish, Value: []byte("anglerfish")},
+	}))
+	got, err := subject.Lookup(fish)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []dhstore.EncryptedValueKey{[]byte("barreleye"), []byte("anglerfish")}, got)
+
+	require.NoError(t, subject.DeleteIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("anglerfish")},
+		{Key: lobster, Value: []byte("squat")},
+	}))
+	got, err = subject.Lookup(fish)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("barreleye")}, got)
+	got, err = subject.Lookup(lobster)
+	require.NoError(t, err)
+	require.Nil(t, got)
+}
+
+func TestRedisDHStore_Metadata(t *testing.T) {
+	subject := newTestStore(t)
+
+	require.NoError(t, subject.PutMetadata([]byte("fish"), []byte("barreleye")))
+	require.NoError(t, subject.PutMetadataBatch([]dhstore.Metadata{
+		{Key: []byte("lobster"), Value: []byte("squat")},
+		{Key: []byte("fish"), Value: []byte("anglerfish")},
+	}))
+	for key, want := range map[string]string{"fish": "anglerfish", "lobster": "squat"} {
+		got, err := subject.GetMetadata([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, dhstore.EncryptedMetadata(want), got)
+	}
+
+	require.NoError(t, subject.DeleteMetadata([]byte("fish")))
+	got, err := subject.GetMetadata([]byte("fish"))
+	require.NoError(t, err)
+	require.Nil(t, got)
+
+	require.NoError(t, subject.DeleteMetadataBatch([]dhstore.HashedValueKey{[]byte("lobster"), []byte("fish")}))
+	got, err = subject.GetMetadata([]byte("lobster"))
+	require.NoError(t, err)
+	require.Nil(t, got)
+}
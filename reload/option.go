@@ -0,0 +1,69 @@
+package reload
+
+import (
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipni/dhstore/limit"
+	"github.com/ipni/dhstore/prune"
+	"github.com/ipni/dhstore/throttle"
+)
+
+// config contains all options for the reloader.
+type config struct {
+	limiter     *limit.Limiter
+	maintenance *throttle.Throttle
+	pruner      *prune.Pruner
+	blockCache  *pebble.Cache
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	var cfg config
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d error: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithLimiter applies the concurrencyLimit and concurrencyQueueTimeout
+// tunables to the given limiter. Without it, these tunables are rejected.
+func WithLimiter(l *limit.Limiter) Option {
+	return func(cfg *config) error {
+		cfg.limiter = l
+		return nil
+	}
+}
+
+// WithMaintenanceThrottle applies the maintenanceRate tunable to the given
+// throttle. Without it, the tunable is rejected.
+func WithMaintenanceThrottle(t *throttle.Throttle) Option {
+	return func(cfg *config) error {
+		cfg.maintenance = t
+		return nil
+	}
+}
+
+// WithPruner applies the providersURLs tunable to the given pruner, in
+// addition to the server.
+func WithPruner(p *prune.Pruner) Option {
+	return func(cfg *config) error {
+		cfg.pruner = p
+		return nil
+	}
+}
+
+// WithBlockCache applies the blockCacheSize tunable to the given pebble block
+// cache, whose size at startup is the largest it can be set to. Without it,
+// the tunable is rejected.
+func WithBlockCache(c *pebble.Cache) Option {
+	return func(cfg *config) error {
+		cfg.blockCache = c
+		return nil
+	}
+}
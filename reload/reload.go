@@ -0,0 +1,189 @@
+// Package reload applies settings that can be changed while dhstore is
+// running, such as the concurrency limit or the providers URLs, without
+// restarting and re-opening the store.
+//
+// A set of settings is validated as a whole before any of it is applied, so
+// that a reload with an invalid setting leaves the running configuration
+// unchanged rather than half applied.
+package reload
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore/limit"
+	"github.com/ipni/dhstore/prune"
+	"github.com/ipni/dhstore/throttle"
+)
+
+type (
+	// Tunables are the settings that can be changed while running. Unset
+	// settings are left unchanged.
+	Tunables struct {
+		LogLevel                *string
+		ConcurrencyLimit        *int
+		ConcurrencyQueueTimeout *time.Duration
+		MaintenanceRate         *float64
+		ProvidersURLs           *[]string
+		BlockCacheSize          *int64
+	}
+
+	// ProvidersSetter changes the providers URLs of dhfind, e.g. a
+	// server.Server.
+	ProvidersSetter interface {
+		ValidateProvidersURLs(providersURLs []string) error
+		SetProvidersURLs(providersURLs []string) error
+	}
+
+	// Reloader applies Tunables to the components of a running dhstore.
+	Reloader struct {
+		mu          sync.Mutex
+		limiter     *limit.Limiter
+		maintenance *throttle.Throttle
+		pruner      *prune.Pruner
+		providers   ProvidersSetter
+		blockCache  *pebble.Cache
+		// releaseBlockCache releases the block cache reserved to shrink it,
+		// or is nil if the cache is not shrunk.
+		releaseBlockCache func()
+	}
+)
+
+// New instantiates a Reloader of the components given as options.
+func New(options ...Option) (*Reloader, error) {
+	opts, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Reloader{
+		limiter:     opts.limiter,
+		maintenance: opts.maintenance,
+		pruner:      opts.pruner,
+		blockCache:  opts.blockCache,
+	}, nil
+}
+
+// SetProvidersSetter sets where the providersURLs tunable is applied, in
+// addition to the pruner. It is set separately since the server is typically
+// created after the components it depends on.
+func (r *Reloader) SetProvidersSetter(p ProvidersSetter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers = p
+}
+
+// Apply validates the given tunables, and applies them only if all are valid.
+// The returned error joins the errors of all invalid tunables.
+func (r *Reloader) Apply(t *Tunables) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.validate(t); err != nil {
+		return err
+	}
+
+	if t.LogLevel != nil {
+		if err := logging.SetLogLevel("*", *t.LogLevel); err != nil {
+			return fmt.Errorf("logLevel: %w", err)
+		}
+	}
+	if t.ConcurrencyLimit != nil {
+		if err := r.limiter.SetLimit(*t.ConcurrencyLimit); err != nil {
+			return fmt.Errorf("concurrencyLimit: %w", err)
+		}
+	}
+	if t.ConcurrencyQueueTimeout != nil {
+		if err := r.limiter.SetQueueTimeout(*t.ConcurrencyQueueTimeout); err != nil {
+			return fmt.Errorf("concurrencyQueueTimeout: %w", err)
+		}
+	}
+	if t.MaintenanceRate != nil {
+		if err := r.maintenance.SetRate(*t.MaintenanceRate, throttle.BurstForRate(*t.MaintenanceRate)); err != nil {
+			return fmt.Errorf("maintenanceRate: %w", err)
+		}
+	}
+	if t.ProvidersURLs != nil {
+		if r.pruner != nil {
+			if err := r.pruner.SetProvidersURLs(*t.ProvidersURLs); err != nil {
+				return fmt.Errorf("providersURLs: %w", err)
+			}
+		}
+		if r.providers != nil {
+			if err := r.providers.SetProvidersURLs(*t.ProvidersURLs); err != nil {
+				return fmt.Errorf("providersURLs: %w", err)
+			}
+		}
+	}
+	if t.BlockCacheSize != nil {
+		r.setBlockCacheSize(*t.BlockCacheSize)
+	}
+	return nil
+}
+
+// validate returns the errors of all the given tunables that cannot be
+// applied.
+func (r *Reloader) validate(t *Tunables) error {
+	var errs []error
+	if t.LogLevel != nil {
+		if _, err := logging.LevelFromString(*t.LogLevel); err != nil {
+			errs = append(errs, fmt.Errorf("logLevel: %w", err))
+		}
+	}
+	if (t.ConcurrencyLimit != nil || t.ConcurrencyQueueTimeout != nil) && r.limiter == nil {
+		errs = append(errs, errors.New("concurrencyLimit: concurrency limit must be enabled at startup"))
+	} else {
+		if t.ConcurrencyLimit != nil && *t.ConcurrencyLimit < 1 {
+			errs = append(errs, fmt.Errorf("concurrencyLimit: must be at least 1, got: %d", *t.ConcurrencyLimit))
+		}
+		if t.ConcurrencyQueueTimeout != nil && *t.ConcurrencyQueueTimeout < 0 {
+			errs = append(errs, fmt.Errorf("concurrencyQueueTimeout: must not be negative, got: %s", *t.ConcurrencyQueueTimeout))
+		}
+	}
+	if t.MaintenanceRate != nil {
+		switch {
+		case r.maintenance == nil:
+			errs = append(errs, errors.New("maintenanceRate: pruning must be enabled at startup"))
+		case *t.MaintenanceRate <= 0:
+			errs = append(errs, fmt.Errorf("maintenanceRate: must be greater than zero, got: %f", *t.MaintenanceRate))
+		}
+	}
+	if t.ProvidersURLs != nil {
+		if r.pruner != nil {
+			if err := r.pruner.ValidateProvidersURLs(*t.ProvidersURLs); err != nil {
+				errs = append(errs, fmt.Errorf("providersURLs: pruning stale providers: %w", err))
+			}
+		}
+		if r.providers != nil {
+			if err := r.providers.ValidateProvidersURLs(*t.ProvidersURLs); err != nil {
+				errs = append(errs, fmt.Errorf("providersURLs: %w", err))
+			}
+		}
+	}
+	if t.BlockCacheSize != nil {
+		size := *t.BlockCacheSize
+		switch {
+		case r.blockCache == nil:
+			errs = append(errs, errors.New("blockCacheSize: block cache is only supported by pebble"))
+		case size <= 0:
+			errs = append(errs, fmt.Errorf("blockCacheSize: must be positive, got: %d", size))
+		case size > r.blockCache.MaxSize():
+			errs = append(errs, fmt.Errorf("blockCacheSize: must be at most the startup size of %d, got: %d", r.blockCache.MaxSize(), size))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setBlockCacheSize resizes the block cache by reserving the difference to its
+// size at startup. The size must have been validated.
+func (r *Reloader) setBlockCacheSize(size int64) {
+	if r.releaseBlockCache != nil {
+		r.releaseBlockCache()
+		r.releaseBlockCache = nil
+	}
+	if maxSize := r.blockCache.MaxSize(); size < maxSize {
+		r.releaseBlockCache = r.blockCache.Reserve(int(maxSize - size))
+	}
+}
@@ -0,0 +1,123 @@
+package reload_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/ipni/dhstore/limit"
+	"github.com/ipni/dhstore/prune"
+	"github.com/ipni/dhstore/reload"
+	"github.com/ipni/dhstore/throttle"
+	"github.com/stretchr/testify/require"
+)
+
+// providersSetter records the providers URLs set, and fails validation with
+// invalid if set.
+type providersSetter struct {
+	invalid error
+	urls    []string
+}
+
+func (p *providersSetter) ValidateProvidersURLs([]string) error { return p.invalid }
+
+func (p *providersSetter) SetProvidersURLs(providersURLs []string) error {
+	p.urls = providersURLs
+	return nil
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func newSubject(t *testing.T) (*reload.Reloader, *limit.Limiter, *throttle.Throttle, *providersSetter) {
+	limiter, err := limit.New(1, 0)
+	require.NoError(t, err)
+	maintenance, err := throttle.New(throttle.WithRate(10, 1))
+	require.NoError(t, err)
+	pruner, err := prune.New([]string{"http://fish.invalid"})
+	require.NoError(t, err)
+	cache := pebble.NewCache(1 << 20)
+	t.Cleanup(cache.Unref)
+
+	subject, err := reload.New(
+		reload.WithLimiter(limiter),
+		reload.WithMaintenanceThrottle(maintenance),
+		reload.WithPruner(pruner),
+		reload.WithBlockCache(cache))
+	require.NoError(t, err)
+	providers := &providersSetter{}
+	subject.SetProvidersSetter(providers)
+	return subject, limiter, maintenance, providers
+}
+
+func TestReloader_Apply(t *testing.T) {
+	subject, limiter, maintenance, providers := newSubject(t)
+
+	require.NoError(t, subject.Apply(&reload.Tunables{
+		LogLevel:                ptr("info"),
+		ConcurrencyLimit:        ptr(4),
+		ConcurrencyQueueTimeout: ptr(time.Second),
+		MaintenanceRate:         ptr(50.0),
+		ProvidersURLs:           ptr([]string{"http://lobster.invalid"}),
+		BlockCacheSize:          ptr(int64(1 << 19)),
+	}))
+	require.Equal(t, int64(4), limiter.Metrics().Limit)
+	require.Equal(t, 50.0, maintenance.Rate())
+	require.Equal(t, []string{"http://lobster.invalid"}, providers.urls)
+
+	// Unset tunables are left unchanged, and the block cache can grow back to
+	// its startup size.
+	require.NoError(t, subject.Apply(&reload.Tunables{BlockCacheSize: ptr(int64(1 << 20))}))
+	require.Equal(t, int64(4), limiter.Metrics().Limit)
+	require.Equal(t, 50.0, maintenance.Rate())
+}
+
+func TestReloader_FailedApplyChangesNothing(t *testing.T) {
+	subject, limiter, maintenance, providers := newSubject(t)
+
+	err := subject.Apply(&reload.Tunables{
+		LogLevel:         ptr("fish"),
+		ConcurrencyLimit: ptr(4),
+		MaintenanceRate:  ptr(-1.0),
+		ProvidersURLs:    ptr([]string{"http://lobster.invalid"}),
+		BlockCacheSize:   ptr(int64(1 << 21)),
+	})
+	require.ErrorContains(t, err, "logLevel")
+	require.ErrorContains(t, err, "maintenanceRate: must be greater than zero")
+	require.ErrorContains(t, err, "blockCacheSize: must be at most the startup size")
+	require.NotContains(t, err.Error(), "concurrencyLimit")
+	require.Equal(t, int64(1), limiter.Metrics().Limit)
+	require.Equal(t, 10.0, maintenance.Rate())
+	require.Nil(t, providers.urls)
+
+	// Providers URLs are applied to neither the pruner nor the server unless
+	// valid for both.
+	err = subject.Apply(&reload.Tunables{ProvidersURLs: ptr([]string{})})
+	require.ErrorContains(t, err, "providersURLs: pruning stale providers")
+	require.Nil(t, providers.urls)
+	providers.invalid = errors.New("dhfind requires unencrypted lookups")
+	err = subject.Apply(&reload.Tunables{
+		ConcurrencyLimit: ptr(4),
+		ProvidersURLs:    ptr([]string{"http://lobster.invalid"}),
+	})
+	require.ErrorContains(t, err, "providersURLs: dhfind requires unencrypted lookups")
+	require.Nil(t, providers.urls)
+	require.Equal(t, int64(1), limiter.Metrics().Limit)
+}
+
+func TestReloader_RejectsTunablesOfDisabledComponents(t *testing.T) {
+	subject, err := reload.New()
+	require.NoError(t, err)
+
+	err = subject.Apply(&reload.Tunables{
+		ConcurrencyQueueTimeout: ptr(time.Second),
+		MaintenanceRate:         ptr(50.0),
+		BlockCacheSize:          ptr(int64(1 << 20)),
+	})
+	require.ErrorContains(t, err, "concurrency limit must be enabled at startup")
+	require.ErrorContains(t, err, "pruning must be enabled at startup")
+	require.ErrorContains(t, err, "block cache is only supported by pebble")
+
+	// Providers URLs apply to whichever components are configured.
+	require.NoError(t, subject.Apply(&reload.Tunables{ProvidersURLs: ptr([]string{"http://lobster.invalid"})}))
+}
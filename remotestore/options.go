@@ -0,0 +1,75 @@
+package remotestore
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultTimeout is the default timeout of requests, excluding exports.
+	defaultTimeout = 30 * time.Second
+	// defaultMaxBatchSize is the default maximum number of records sent in a
+	// single request.
+	defaultMaxBatchSize = 1024
+)
+
+type (
+	Option  func(*options) error
+	options struct {
+		httpClient   *http.Client
+		timeout      time.Duration
+		maxBatchSize int
+	}
+)
+
+func newOptions(o ...Option) (*options, error) {
+	opts := options{
+		httpClient:   http.DefaultClient,
+		timeout:      defaultTimeout,
+		maxBatchSize: defaultMaxBatchSize,
+	}
+	for _, apply := range o {
+		if err := apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	return &opts, nil
+}
+
+// WithHTTPClient sets the HTTP client with which requests are sent. Defaults
+// to http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) error {
+		if c == nil {
+			return fmt.Errorf("http client must not be nil")
+		}
+		o.httpClient = c
+		return nil
+	}
+}
+
+// WithTimeout sets the timeout of requests. Exports are not subject to the
+// timeout, since they stream for as long as there are records to export.
+// Defaults to 30 seconds.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout must be positive; got: %s", timeout)
+		}
+		o.timeout = timeout
+		return nil
+	}
+}
+
+// WithMaxBatchSize sets the maximum number of records sent in a single
+// request when importing records. Defaults to 1024.
+func WithMaxBatchSize(size int) Option {
+	return func(o *options) error {
+		if size <= 0 {
+			return fmt.Errorf("max batch size must be positive; got: %d", size)
+		}
+		o.maxBatchSize = size
+		return nil
+	}
+}
@@ -0,0 +1,305 @@
+// Package remotestore implements a DHStore that talks to the HTTP API of
+// another dhstore node, so that a node can proxy to another one, and tooling
+// such as import and export can treat remote nodes like local stores.
+//
+// Errors returned by the remote node are surfaced as dhstore errors where the
+// status code allows it, i.e. dhstore.ErrUnavailable for 503 and unreachable
+// nodes, dhstore.ErrReadOnly for writes rejected as read-only, and
+// dhstore.ErrHttpResponse otherwise.
+package remotestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/server"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/mr-tron/base58"
+	"github.com/multiformats/go-multihash"
+)
+
+var (
+	_ dhstore.DHStore             = (*RemoteDHStore)(nil)
+	_ dhstore.MetadataBatchPutter = (*RemoteDHStore)(nil)
+	_ dhstore.HealthReporter      = (*RemoteDHStore)(nil)
+	_ dhstore.Exporter            = (*RemoteDHStore)(nil)
+	_ dhstore.Importer            = (*RemoteDHStore)(nil)
+)
+
+type RemoteDHStore struct {
+	url          *url.URL
+	client       *http.Client
+	timeout      time.Duration
+	maxBatchSize int
+}
+
+// NewRemoteDHStore returns a store backed by the dhstore node at the given
+// base URL, e.g. http://dhstore:40080.
+func NewRemoteDHStore(baseURL string, o ...Option) (*RemoteDHStore, error) {
+	opts, err := newOptions(o...)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("url scheme must be http or https; got: %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	// Exports stream for as long as there are records; apply the timeout to
+	// all other requests via their context instead of the client.
+	client := *opts.httpClient
+	client.Timeout = 0
+	return &RemoteDHStore{
+		url:          u,
+		client:       &client,
+		timeout:      opts.timeout,
+		maxBatchSize: opts.maxBatchSize,
+	}, nil
+}
+
+func (s *RemoteDHStore) MergeIndexes(indexes []dhstore.Index) error {
+	return s.send(http.MethodPut, "/multihash", server.MergeIndexRequest{Merges: indexes})
+}
+
+func (s *RemoteDHStore) DeleteIndexes(indexes []dhstore.Index) error {
+	return s.send(http.MethodDelete, "/multihash", server.MergeIndexRequest{Merges: indexes})
+}
+
+func (s *RemoteDHStore) PutMetadata(hvk dhstore.HashedValueKey, em dhstore.EncryptedMetadata) error {
+	return s.send(http.MethodPut, "/metadata", server.PutMetadataRequest{Key: hvk, Value: em})
+}
+
+func (s *RemoteDHStore) PutMetadataBatch(records []dhstore.Metadata) error {
+	return s.send(http.MethodPut, "/metadata", server.PutMetadataRequest{Metadata: records})
+}
+
+func (s *RemoteDHStore) DeleteMetadata(hvk dhstore.HashedValueKey) error {
+	return s.send(http.MethodDelete, "/metadata/"+base58.Encode(hvk), nil)
+}
+
+func (s *RemoteDHStore) DeleteMetadataBatch(hvks []dhstore.HashedValueKey) error {
+	return s.send(http.MethodDelete, "/metadata", server.DeleteMetadataRequest{Keys: hvks})
+}
+
+func (s *RemoteDHStore) Lookup(mh multihash.Multihash) ([]dhstore.EncryptedValueKey, error) {
+	var resp model.FindResponse
+	found, err := s.get("/encrypted/multihash/"+mh.B58String(), &resp)
+	if err != nil || !found {
+		return nil, err
+	}
+	var evks []dhstore.EncryptedValueKey
+	for _, result := range resp.EncryptedMultihashResults {
+		for _, evk := range result.EncryptedValueKeys {
+			evks = append(evks, evk)
+		}
+	}
+	return evks, nil
+}
+
+func (s *RemoteDHStore) GetMetadata(hvk dhstore.HashedValueKey) (dhstore.EncryptedMetadata, error) {
+	var resp server.GetMetadataResponse
+	found, err := s.get("/metadata/"+base58.Encode(hvk), &resp)
+	if err != nil || !found {
+		return nil, err
+	}
+	return resp.EncryptedMetadata, nil
+}
+
+// Healthy checks that the remote node is ready to serve requests.
+func (s *RemoteDHStore) Healthy() error {
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.do(ctx, http.MethodGet, "/ready", nil, nil)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// Export streams the records of the remote node, which must serve exports.
+func (s *RemoteDHStore) Export(ctx context.Context, opts dhstore.ExportOptions, fn func(dhstore.ExportRecord) error) error {
+	query := url.Values{}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+	if len(opts.Start) != 0 {
+		query.Set("start", hex.EncodeToString(opts.Start))
+	}
+	if len(opts.End) != 0 {
+		query.Set("end", hex.EncodeToString(opts.End))
+	}
+	path := "/export"
+	if len(query) != 0 {
+		path += "?" + query.Encode()
+	}
+	resp, err := s.do(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var record dhstore.ExportRecord
+		if err := dec.Decode(&record); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to decode exported record: %w", err)
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// Import writes the given records to the remote node in batches through its
+// regular write path. Metadata records without a hashed value key, i.e. ones
+// exported by stores that only persist a hash of it, are not supported.
+func (s *RemoteDHStore) Import(records []dhstore.ExportRecord) error {
+	var indexes []dhstore.Index
+	var metadata []dhstore.Metadata
+	flush := func() error {
+		if len(indexes) != 0 {
+			if err := s.MergeIndexes(indexes); err != nil {
+				return err
+			}
+			indexes = indexes[:0]
+		}
+		if len(metadata) != 0 {
+			if err := s.PutMetadataBatch(metadata); err != nil {
+				return err
+			}
+			metadata = metadata[:0]
+		}
+		return nil
+	}
+	for _, record := range records {
+		switch {
+		case len(record.Multihash) != 0:
+			for _, evk := range record.EncryptedValueKeys {
+				indexes = append(indexes, dhstore.Index{Key: record.Multihash, Value: evk})
+			}
+		case len(record.HashedValueKey) != 0:
+			metadata = append(metadata, dhstore.Metadata{Key: record.HashedValueKey, Value: record.EncryptedMetadata})
+		default:
+			return fmt.Errorf("cannot import metadata record without hashed value key")
+		}
+		if len(indexes)+len(metadata) >= s.maxBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+func (s *RemoteDHStore) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// context returns the context of a request, bound by the configured timeout.
+func (s *RemoteDHStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+// send sends a request with the given body encoded as JSON, if any, and
+// discards the response.
+func (s *RemoteDHStore) send(method, path string, body any) error {
+	var header http.Header
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+		header = http.Header{"Content-Type": {"application/json"}}
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.do(ctx, method, path, header, r)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// get decodes the JSON response to a GET request into v, and returns false if
+// the remote node has no record at the given path.
+func (s *RemoteDHStore) get(path string, v any) (bool, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.do(ctx, http.MethodGet, path, http.Header{"Accept": {"application/json"}}, nil)
+	if err != nil {
+		var httpErr dhstore.ErrHttpResponse
+		if errors.As(err, &httpErr) && httpErr.Status == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("failed to decode response of %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// do sends a request to the given path of the remote node, and returns the
+// response if it is successful. The caller must close the response body.
+func (s *RemoteDHStore) do(ctx context.Context, method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url.String()+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, dhstore.ErrUnavailable{Err: err}
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	message := strings.TrimSpace(string(msg))
+	// Errors are JSON encoded as dhstore.ErrorResponse, or plain text by
+	// older servers.
+	var errResp dhstore.ErrorResponse
+	if json.Unmarshal(msg, &errResp) == nil && errResp.Code != "" {
+		message = errResp.Message
+	}
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+	switch resp.StatusCode {
+	case http.StatusServiceUnavailable:
+		return nil, dhstore.ErrUnavailable{Err: errors.New(message)}
+	case http.StatusForbidden:
+		if errResp.Code == dhstore.ErrorCodeReadOnly {
+			return nil, dhstore.ErrReadOnly{}
+		}
+	case http.StatusMethodNotAllowed:
+		// Older servers reject writes to read-only stores with 405.
+		return nil, dhstore.ErrReadOnly{}
+	}
+	return nil, dhstore.ErrHttpResponse{Message: message, Status: resp.StatusCode, Code: errResp.Code}
+}
@@ -0,0 +1,121 @@
+package remotestore_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/internal/testutil"
+	"github.com/ipni/dhstore/pebble"
+	"github.com/ipni/dhstore/remotestore"
+	"github.com/ipni/dhstore/server"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+// newRemote starts a dhstore server backed by a pebble store, and returns a
+// remote store talking to it.
+func newRemote(t *testing.T) *remotestore.RemoteDHStore {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = store.Close() })
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	httpServer := httptest.NewServer(s.Handler())
+	t.Cleanup(httpServer.Close)
+	subject, err := remotestore.NewRemoteDHStore(httpServer.URL)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = subject.Close() })
+	return subject
+}
+
+func TestRemoteDHStore_RoundTrip(t *testing.T) {
+	subject := newRemote(t)
+	require.NoError(t, subject.Healthy())
+
+	mh := testutil.RandomDblSha256(t)
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}, {Key: mh, Value: []byte("lobster")}}))
+	got, err := subject.Lookup(mh)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []dhstore.EncryptedValueKey{[]byte("fish"), []byte("lobster")}, got)
+	require.NoError(t, subject.DeleteIndexes([]dhstore.Index{{Key: mh, Value: []byte("lobster")}}))
+	got, err = subject.Lookup(mh)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("fish")}, got)
+	got, err = subject.Lookup(testutil.RandomDblSha256(t))
+	require.NoError(t, err)
+	require.Nil(t, got)
+
+	require.NoError(t, subject.PutMetadata([]byte("barreleye"), []byte("anglerfish")))
+	require.NoError(t, subject.PutMetadataBatch([]dhstore.Metadata{{Key: []byte("squid"), Value: []byte("cuttlefish")}}))
+	md, err := subject.GetMetadata([]byte("squid"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("cuttlefish"), md)
+	require.NoError(t, subject.DeleteMetadata([]byte("squid")))
+	md, err = subject.GetMetadata([]byte("squid"))
+	require.NoError(t, err)
+	require.Nil(t, md)
+	require.NoError(t, subject.PutMetadata([]byte("octopus"), []byte("dumbo")))
+	require.NoError(t, subject.DeleteMetadataBatch([]dhstore.HashedValueKey{[]byte("octopus"), []byte("squid")}))
+	md, err = subject.GetMetadata([]byte("octopus"))
+	require.NoError(t, err)
+	require.Nil(t, md)
+
+	// Records exported from one remote node can be imported into another.
+	var records []dhstore.ExportRecord
+	require.NoError(t, subject.Export(context.Background(), dhstore.ExportOptions{}, func(record dhstore.ExportRecord) error {
+		records = append(records, record)
+		return nil
+	}))
+	require.Len(t, records, 2)
+	other := newRemote(t)
+	err = other.Import(records)
+	require.ErrorContains(t, err, "without hashed value key")
+	require.NoError(t, other.Import(records[:1]))
+	got, err = other.Lookup(mh)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("fish")}, got)
+}
+
+func TestRemoteDHStore_MapsErrors(t *testing.T) {
+	subject := newRemote(t)
+	notDblMh, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	err = subject.MergeIndexes([]dhstore.Index{{Key: notDblMh, Value: []byte("fish")}})
+	var httpErr dhstore.ErrHttpResponse
+	require.ErrorAs(t, err, &httpErr)
+	require.Equal(t, 400, httpErr.Status)
+	// The error code and message are relayed from the JSON error response.
+	require.Equal(t, dhstore.ErrorCodeUnsupportedCodec, httpErr.Code)
+	require.Equal(t, "multihash must be of code dbl-sha2-256, got: sha2-256", httpErr.Message)
+
+	// Writes rejected by read-only nodes are surfaced as ErrReadOnly.
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	s, err := server.New(store, "", server.WithReadOnly(func() bool { return true }))
+	require.NoError(t, err)
+	readOnlyServer := httptest.NewServer(s.Handler())
+	defer readOnlyServer.Close()
+	readOnly, err := remotestore.NewRemoteDHStore(readOnlyServer.URL)
+	require.NoError(t, err)
+	defer readOnly.Close()
+	err = readOnly.MergeIndexes([]dhstore.Index{{Key: testutil.RandomDblSha256(t), Value: []byte("fish")}})
+	require.ErrorIs(t, err, dhstore.ErrReadOnly{})
+
+	unreachable, err := remotestore.NewRemoteDHStore("http://127.0.0.1:1")
+	require.NoError(t, err)
+	require.IsType(t, dhstore.ErrUnavailable{}, unreachable.Healthy())
+	_, err = unreachable.Lookup(testutil.RandomDblSha256(t))
+	require.IsType(t, dhstore.ErrUnavailable{}, err)
+}
+
+func TestNewRemoteDHStore_RejectsInvalidOptions(t *testing.T) {
+	_, err := remotestore.NewRemoteDHStore("ftp://fish")
+	require.ErrorContains(t, err, "scheme")
+	_, err = remotestore.NewRemoteDHStore("http://fish", remotestore.WithTimeout(0))
+	require.ErrorContains(t, err, "timeout")
+	_, err = remotestore.NewRemoteDHStore("http://fish", remotestore.WithMaxBatchSize(0))
+	require.ErrorContains(t, err, "batch size")
+}
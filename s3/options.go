@@ -0,0 +1,142 @@
+package s3
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	// defaultRegion is the default region of the bucket.
+	defaultRegion = "us-east-1"
+	// defaultTimeout is the default timeout of requests.
+	defaultTimeout = 30 * time.Second
+	// defaultRefreshInterval is the default interval at which the bucket is
+	// listed for new segments.
+	defaultRefreshInterval = 10 * time.Minute
+)
+
+type (
+	Option  func(*options) error
+	options struct {
+		endpoint        *url.URL
+		bucket          string
+		prefix          string
+		region          string
+		accessKeyID     string
+		secretAccessKey string
+		cacheDir        string
+		timeout         time.Duration
+		refreshInterval time.Duration
+	}
+)
+
+func newOptions(o ...Option) (*options, error) {
+	opts := options{
+		region:          defaultRegion,
+		timeout:         defaultTimeout,
+		refreshInterval: defaultRefreshInterval,
+	}
+	for _, apply := range o {
+		if err := apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.endpoint == nil {
+		return nil, fmt.Errorf("endpoint must be specified")
+	}
+	if opts.bucket == "" {
+		return nil, fmt.Errorf("bucket must be specified")
+	}
+	return &opts, nil
+}
+
+// WithEndpoint sets the URL of the S3 compatible service, e.g.
+// "https://s3.us-east-1.amazonaws.com". Objects are addressed path-style.
+// Required.
+func WithEndpoint(endpoint string) Option {
+	return func(o *options) error {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("endpoint scheme must be http or https, got: %q", u.Scheme)
+		}
+		o.endpoint = u
+		return nil
+	}
+}
+
+// WithBucket sets the bucket in which segments are stored. Required.
+func WithBucket(bucket string) Option {
+	return func(o *options) error {
+		o.bucket = bucket
+		return nil
+	}
+}
+
+// WithPrefix sets the prefix of the keys of the segments in the bucket. All
+// objects under the prefix with the SegmentExt extension are served.
+// Defaults to no prefix.
+func WithPrefix(prefix string) Option {
+	return func(o *options) error {
+		o.prefix = prefix
+		return nil
+	}
+}
+
+// WithRegion sets the region of the bucket, with which requests are signed.
+// Defaults to "us-east-1".
+func WithRegion(region string) Option {
+	return func(o *options) error {
+		o.region = region
+		return nil
+	}
+}
+
+// WithCredentials sets the access key with which requests are signed.
+// Requests are sent anonymously when the access key ID is empty, which is the
+// default.
+func WithCredentials(accessKeyID, secretAccessKey string) Option {
+	return func(o *options) error {
+		o.accessKeyID = accessKeyID
+		o.secretAccessKey = secretAccessKey
+		return nil
+	}
+}
+
+// WithCacheDir sets the local directory in which the index and bloom filter
+// of each segment are cached, so that they are not fetched again on restart.
+// Caching is disabled when empty, which is the default.
+func WithCacheDir(dir string) Option {
+	return func(o *options) error {
+		o.cacheDir = dir
+		return nil
+	}
+}
+
+// WithTimeout sets the timeout of requests to the S3 service. Defaults to 30
+// seconds.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout must be positive, got: %s", timeout)
+		}
+		o.timeout = timeout
+		return nil
+	}
+}
+
+// WithRefreshInterval sets the interval at which the bucket is listed to pick
+// up segments that were added or removed. Disabled when zero. Defaults to 10
+// minutes.
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(o *options) error {
+		if interval < 0 {
+			return fmt.Errorf("refresh interval must not be negative, got: %s", interval)
+		}
+		o.refreshInterval = interval
+		return nil
+	}
+}
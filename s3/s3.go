@@ -0,0 +1,285 @@
+// Package s3 implements a read-only DHStore that serves lookups from immutable
+// segment files stored in an S3 compatible bucket, intended for archived
+// snapshots of the index that must stay queryable cheaply.
+//
+// Segments are built from pebble exports with SegmentWriter, e.g. by running
+// dhstore with -exportFormat=segment, and uploaded to the bucket. The index
+// and bloom filter of each segment are kept in memory and optionally cached
+// on local disk, so that a lookup fetches at most one block of each segment
+// that may contain the key via a ranged GET. The encrypted value keys of a
+// multihash found in multiple segments are merged, and the metadata of the
+// segment with the greatest key wins.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+var (
+	_ dhstore.DHStore = (*S3DHStore)(nil)
+
+	logger = logging.Logger("store/s3")
+)
+
+type S3DHStore struct {
+	client   *client
+	prefix   string
+	cacheDir string
+
+	// mu guards segments, which are sorted by key.
+	mu       sync.RWMutex
+	segments []*segment
+
+	// cancel stops the background refresh of segments, and wg waits for it
+	// to return.
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewS3DHStore lists the segments in the configured bucket and loads their
+// indexes and bloom filters.
+func NewS3DHStore(o ...Option) (*S3DHStore, error) {
+	opts, err := newOptions(o...)
+	if err != nil {
+		return nil, err
+	}
+	if opts.cacheDir != "" {
+		if err := os.MkdirAll(opts.cacheDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	s := &S3DHStore{
+		client: &client{
+			http:            &http.Client{Timeout: opts.timeout},
+			endpoint:        opts.endpoint,
+			bucket:          opts.bucket,
+			region:          opts.region,
+			accessKeyID:     opts.accessKeyID,
+			secretAccessKey: opts.secretAccessKey,
+		},
+		prefix:   opts.prefix,
+		cacheDir: opts.cacheDir,
+	}
+	if err := s.refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	if opts.refreshInterval > 0 {
+		s.wg.Add(1)
+		go s.runRefresh(ctx, opts.refreshInterval)
+	}
+	return s, nil
+}
+
+func (s *S3DHStore) runRefresh(ctx context.Context, interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.refresh(ctx); err != nil {
+				logger.Warnw("Failed to refresh segments", "err", err)
+			}
+		}
+	}
+}
+
+// refresh lists the segments in the bucket, opens the ones that are new and
+// drops the ones that were removed.
+func (s *S3DHStore) refresh(ctx context.Context) error {
+	objects, err := s.client.list(ctx, s.prefix)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	// Segments are immutable, but may be replaced by uploading them again.
+	open := make(map[object]*segment, len(s.segments))
+	for _, seg := range s.segments {
+		open[seg.object] = seg
+	}
+	s.mu.RUnlock()
+
+	segments := make([]*segment, 0, len(objects))
+	var added int
+	for _, obj := range objects {
+		if !strings.HasSuffix(obj.Key, SegmentExt) {
+			continue
+		}
+		seg, ok := open[obj]
+		if !ok {
+			if seg, err = s.openSegment(ctx, obj); err != nil {
+				return fmt.Errorf("failed to open segment %s: %w", obj.Key, err)
+			}
+			added++
+		}
+		segments = append(segments, seg)
+	}
+	slices.SortFunc(segments, func(a, b *segment) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	s.mu.Lock()
+	removed := len(s.segments) + added - len(segments)
+	s.segments = segments
+	s.mu.Unlock()
+	logger.Infow("Refreshed segments", "count", len(segments), "added", added, "removed", removed)
+	return nil
+}
+
+// openSegment loads the tail of the given segment object from the local cache,
+// or fetches it from the bucket.
+func (s *S3DHStore) openSegment(ctx context.Context, obj object) (*segment, error) {
+	fetch := func(ctx context.Context, offset, length int64) ([]byte, error) {
+		return s.client.get(ctx, obj.Key, offset, length)
+	}
+	var cachePath string
+	if s.cacheDir != "" {
+		sum := sha256.Sum256([]byte(obj.Key + "\x00" + obj.ETag))
+		cachePath = filepath.Join(s.cacheDir, hex.EncodeToString(sum[:])+".tail")
+		if tail, err := os.ReadFile(cachePath); err == nil {
+			if seg, err := openSegment(obj.Key, tail, fetch); err == nil {
+				seg.object = obj
+				return seg, nil
+			}
+			logger.Warnw("Ignoring corrupt cached segment tail", "segment", obj.Key, "path", cachePath)
+		}
+	}
+
+	if obj.Size < footerLen {
+		return nil, errCorruptSegment
+	}
+	footer, err := fetch(ctx, obj.Size-footerLen, footerLen)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := tailOffset(footer, obj.Size)
+	if err != nil {
+		return nil, err
+	}
+	tail, err := fetch(ctx, offset, obj.Size-offset)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := openSegment(obj.Key, tail, fetch)
+	if err != nil {
+		return nil, err
+	}
+	seg.object = obj
+	if cachePath != "" {
+		if err := writeFileAtomic(cachePath, tail); err != nil {
+			logger.Warnw("Failed to cache segment tail", "segment", obj.Key, "err", err)
+		}
+	}
+	return seg, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *S3DHStore) openSegments() []*segment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.segments
+}
+
+func (s *S3DHStore) Lookup(mh multihash.Multihash) ([]dhstore.EncryptedValueKey, error) {
+	if err := checkMultihash(mh); err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	key := append([]byte{multihashKeyPrefix}, mh...)
+	var evks []dhstore.EncryptedValueKey
+	for _, seg := range s.openSegments() {
+		value, err := seg.get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment %s: %w", seg.name, err)
+		}
+		if value == nil {
+			continue
+		}
+		found, err := unmarshalValueKeys(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment %s: %w", seg.name, err)
+		}
+		for _, evk := range found {
+			if !slices.ContainsFunc(evks, func(v dhstore.EncryptedValueKey) bool { return bytes.Equal(v, evk) }) {
+				evks = append(evks, evk)
+			}
+		}
+	}
+	return evks, nil
+}
+
+func (s *S3DHStore) GetMetadata(hvk dhstore.HashedValueKey) (dhstore.EncryptedMetadata, error) {
+	ctx := context.Background()
+	key := metadataKey(hvk)
+	segments := s.openSegments()
+	for i := len(segments) - 1; i >= 0; i-- {
+		value, err := segments[i].get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment %s: %w", segments[i].name, err)
+		}
+		if value != nil {
+			return value, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *S3DHStore) MergeIndexes([]dhstore.Index) error {
+	return dhstore.ErrReadOnly{}
+}
+
+func (s *S3DHStore) DeleteIndexes([]dhstore.Index) error {
+	return dhstore.ErrReadOnly{}
+}
+
+func (s *S3DHStore) PutMetadata(dhstore.HashedValueKey, dhstore.EncryptedMetadata) error {
+	return dhstore.ErrReadOnly{}
+}
+
+func (s *S3DHStore) DeleteMetadata(dhstore.HashedValueKey) error {
+	return dhstore.ErrReadOnly{}
+}
+
+func (s *S3DHStore) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+func checkMultihash(mh multihash.Multihash) error {
+	dmh, err := multihash.Decode(mh)
+	if err != nil {
+		return dhstore.ErrMultihashDecode{Err: err, Mh: mh}
+	}
+	if dmh.Code != multihash.DBL_SHA2_256 {
+		return dhstore.ErrUnsupportedMulticodecCode{Code: multicodec.Code(dmh.Code)}
+	}
+	return nil
+}
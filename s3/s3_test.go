@@ -0,0 +1,165 @@
+package s3_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/internal/testutil"
+	"github.com/ipni/dhstore/s3"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"lukechampine.com/blake3"
+)
+
+// fakeS3 serves the objects of a single bucket, supporting ListObjectsV2 and
+// ranged GETs.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	gets    int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/bucket")
+	if key == "" || key == "/" {
+		type contents struct {
+			Key  string
+			Size int
+			ETag string
+		}
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []contents
+		}
+		for k, v := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, contents{Key: k, Size: len(v), ETag: fmt.Sprintf(`"%x"`, blake3.Sum256(v))})
+			}
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		_ = xml.NewEncoder(w).Encode(result)
+		return
+	}
+	data, ok := f.objects[strings.TrimPrefix(key, "/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f.gets++
+	http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+}
+
+func (f *fakeS3) put(key string, records ...dhstore.ExportRecord) error {
+	var buf bytes.Buffer
+	sw := s3.NewSegmentWriter(&buf)
+	for _, record := range records {
+		if err := sw.Add(record); err != nil {
+			return err
+		}
+	}
+	if err := sw.Close(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = buf.Bytes()
+	return nil
+}
+
+func TestS3DHStore_ServesSegments(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	// Enough multihashes to span multiple blocks.
+	mhs := make([]multihash.Multihash, 5000)
+	for i := range mhs {
+		mhs[i] = testutil.RandomDblSha256(t)
+	}
+	sort.Slice(mhs, func(i, j int) bool { return bytes.Compare(mhs[i], mhs[j]) < 0 })
+	var older []dhstore.ExportRecord
+	for i, mh := range mhs {
+		older = append(older, dhstore.ExportRecord{
+			Multihash:          mh,
+			EncryptedValueKeys: []dhstore.EncryptedValueKey{[]byte(fmt.Sprintf("fish-%d", i))},
+		})
+	}
+	older = append(older, dhstore.ExportRecord{HashedValueKey: []byte("lobster"), EncryptedMetadata: []byte("squat")})
+	require.NoError(t, fake.put("snapshots/2026-01/shard-000.seg", older...))
+	require.NoError(t, fake.put("snapshots/2026-02/shard-000.seg",
+		dhstore.ExportRecord{Multihash: mhs[42], EncryptedValueKeys: []dhstore.EncryptedValueKey{[]byte("fish-42"), []byte("anglerfish")}},
+		dhstore.ExportRecord{HashedValueKey: []byte("lobster"), EncryptedMetadata: []byte("spiny")}))
+	fake.objects["snapshots/README"] = []byte("not a segment")
+
+	cacheDir := t.TempDir()
+	subject, err := s3.NewS3DHStore(
+		s3.WithEndpoint(server.URL),
+		s3.WithBucket("bucket"),
+		s3.WithPrefix("snapshots/"),
+		s3.WithCredentials("AKIDEXAMPLE", "secret"),
+		s3.WithCacheDir(cacheDir),
+		s3.WithRefreshInterval(0))
+	require.NoError(t, err)
+	defer subject.Close()
+
+	got, err := subject.Lookup(mhs[4321])
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("fish-4321")}, got)
+	got, err = subject.Lookup(mhs[42])
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("fish-42"), []byte("anglerfish")}, got)
+	got, err = subject.Lookup(testutil.RandomDblSha256(t))
+	require.NoError(t, err)
+	require.Nil(t, got)
+
+	md, err := subject.GetMetadata([]byte("lobster"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("spiny"), md)
+	md, err = subject.GetMetadata([]byte("squid"))
+	require.NoError(t, err)
+	require.Nil(t, md)
+
+	require.ErrorIs(t, subject.PutMetadata([]byte("lobster"), []byte("squat")), dhstore.ErrReadOnly{})
+
+	// Reopening loads the index and filter of segments from the cache.
+	fake.gets = 0
+	reopened, err := s3.NewS3DHStore(
+		s3.WithEndpoint(server.URL),
+		s3.WithBucket("bucket"),
+		s3.WithPrefix("snapshots/"),
+		s3.WithCacheDir(cacheDir),
+		s3.WithRefreshInterval(0))
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Zero(t, fake.gets)
+	got, err = reopened.Lookup(mhs[0])
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("fish-0")}, got)
+}
+
+func TestSegmentWriter_RejectsUnorderedRecords(t *testing.T) {
+	sw := s3.NewSegmentWriter(&bytes.Buffer{})
+	require.NoError(t, sw.Add(dhstore.ExportRecord{MetadataKey: []byte("lobster"), EncryptedMetadata: []byte("squat")}))
+	err := sw.Add(dhstore.ExportRecord{MetadataKey: []byte("fish"), EncryptedMetadata: []byte("barreleye")})
+	require.ErrorContains(t, err, "increasing key order")
+}
+
+func TestNewS3DHStore_RejectsInvalidOptions(t *testing.T) {
+	_, err := s3.NewS3DHStore(s3.WithBucket("bucket"))
+	require.ErrorContains(t, err, "endpoint")
+	_, err = s3.NewS3DHStore(s3.WithEndpoint("ftp://fish"), s3.WithBucket("bucket"))
+	require.ErrorContains(t, err, "scheme")
+	_, err = s3.NewS3DHStore(s3.WithEndpoint("http://127.0.0.1:9000"))
+	require.ErrorContains(t, err, "bucket")
+}
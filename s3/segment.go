@@ -0,0 +1,311 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/cockroachdb/pebble/bloom"
+	"github.com/ipni/dhstore"
+	"github.com/multiformats/go-varint"
+	"lukechampine.com/blake3"
+)
+
+// A segment is an immutable file of key-value records sorted by key, laid out
+// as follows:
+//
+//	[block]...[index][filter][footer]
+//
+// Blocks hold varint length-prefixed keys and values. The index holds the last
+// key of the segment followed by the first key, offset and length of each
+// block. The filter is a bloom filter of all keys, and the fixed size footer
+// holds the offsets and lengths of the index and filter. The index and filter
+// are kept in memory, so that looking up a key fetches at most one block.
+//
+// Keys are laid out in the same way as the pebble store, i.e. a prefix byte
+// followed by the multihash of index records, or the BLAKE3 hash of the hashed
+// value key of metadata records.
+
+const (
+	// SegmentExt is the file extension of segments.
+	SegmentExt = ".seg"
+
+	segmentMagic    uint64 = 0x6468736567000001 // "dhseg", version 1
+	footerLen              = 5 * 8
+	bloomBitsPerKey        = 10
+
+	// defaultBlockSize is the size at which blocks are cut.
+	defaultBlockSize = 64 << 10
+
+	multihashKeyPrefix byte = 1
+	metadataKeyPrefix  byte = 2
+)
+
+var (
+	filterPolicy = bloom.FilterPolicy(bloomBitsPerKey)
+
+	errCorruptSegment = errors.New("corrupt segment")
+)
+
+// SegmentWriter writes exported records as a segment.
+type SegmentWriter struct {
+	w         io.Writer
+	blockSize int
+	offset    uint64
+
+	block    []byte
+	firstKey []byte
+	lastKey  []byte
+	index    []byte
+	filter   pebble.FilterWriter
+}
+
+// NewSegmentWriter returns a writer of a segment to w.
+func NewSegmentWriter(w io.Writer) *SegmentWriter {
+	return &SegmentWriter{
+		w:         w,
+		blockSize: defaultBlockSize,
+		filter:    filterPolicy.NewWriter(pebble.TableFilter),
+	}
+}
+
+// Add writes the given record. Records must be added in increasing key order,
+// i.e. index records in digest order followed by metadata records in digest
+// order, as exported by the pebble store. Metadata records exported by other
+// stores are not supported, since their metadata keys differ.
+func (sw *SegmentWriter) Add(record dhstore.ExportRecord) error {
+	var key, value []byte
+	switch {
+	case len(record.Multihash) != 0:
+		key = append([]byte{multihashKeyPrefix}, record.Multihash...)
+		for _, evk := range record.EncryptedValueKeys {
+			value = append(value, varint.ToUvarint(uint64(len(evk)))...)
+			value = append(value, evk...)
+		}
+	case len(record.HashedValueKey) != 0:
+		key = metadataKey(record.HashedValueKey)
+		value = record.EncryptedMetadata
+	case len(record.MetadataKey) != 0:
+		key = append([]byte{metadataKeyPrefix}, record.MetadataKey...)
+		value = record.EncryptedMetadata
+	default:
+		return errors.New("record has no key")
+	}
+	if sw.lastKey != nil && bytes.Compare(key, sw.lastKey) <= 0 {
+		return fmt.Errorf("records must be added in increasing key order")
+	}
+	if sw.firstKey == nil {
+		sw.firstKey = key
+	}
+	sw.lastKey = key
+	sw.filter.AddKey(key)
+	sw.block = appendSection(sw.block, key)
+	sw.block = appendSection(sw.block, value)
+	if len(sw.block) >= sw.blockSize {
+		return sw.flushBlock()
+	}
+	return nil
+}
+
+func (sw *SegmentWriter) flushBlock() error {
+	if len(sw.block) == 0 {
+		return nil
+	}
+	if err := sw.write(sw.block); err != nil {
+		return err
+	}
+	sw.index = appendSection(sw.index, sw.firstKey)
+	sw.index = append(sw.index, varint.ToUvarint(sw.offset-uint64(len(sw.block)))...)
+	sw.index = append(sw.index, varint.ToUvarint(uint64(len(sw.block)))...)
+	sw.block = sw.block[:0]
+	sw.firstKey = nil
+	return nil
+}
+
+func (sw *SegmentWriter) write(b []byte) error {
+	n, err := sw.w.Write(b)
+	sw.offset += uint64(n)
+	return err
+}
+
+// Close writes the last block, index, filter and footer of the segment. It
+// does not close the underlying writer.
+func (sw *SegmentWriter) Close() error {
+	if err := sw.flushBlock(); err != nil {
+		return err
+	}
+	indexOffset := sw.offset
+	if err := sw.write(appendSection(nil, sw.lastKey)); err != nil {
+		return err
+	}
+	if err := sw.write(sw.index); err != nil {
+		return err
+	}
+	filterOffset := sw.offset
+	if err := sw.write(sw.filter.Finish(nil)); err != nil {
+		return err
+	}
+	footer := make([]byte, 0, footerLen)
+	footer = binary.LittleEndian.AppendUint64(footer, indexOffset)
+	footer = binary.LittleEndian.AppendUint64(footer, filterOffset-indexOffset)
+	footer = binary.LittleEndian.AppendUint64(footer, filterOffset)
+	footer = binary.LittleEndian.AppendUint64(footer, sw.offset-filterOffset)
+	footer = binary.LittleEndian.AppendUint64(footer, segmentMagic)
+	return sw.write(footer)
+}
+
+// blockHandle locates a block of a segment.
+type blockHandle struct {
+	firstKey []byte
+	offset   int64
+	length   int64
+}
+
+// segment reads the records of a segment, fetching blocks on demand.
+type segment struct {
+	name    string
+	object  object
+	index   []blockHandle
+	lastKey []byte
+	filter  []byte
+	fetch   func(ctx context.Context, offset, length int64) ([]byte, error)
+}
+
+// tailOffset returns the offset of the index of a segment of the given size,
+// from which its tail, i.e. the index, filter and footer, spans to its end.
+func tailOffset(footer []byte, size int64) (int64, error) {
+	if len(footer) != footerLen || binary.LittleEndian.Uint64(footer[32:]) != segmentMagic {
+		return 0, errCorruptSegment
+	}
+	offset := int64(binary.LittleEndian.Uint64(footer))
+	if offset < 0 || offset > size-footerLen {
+		return 0, errCorruptSegment
+	}
+	return offset, nil
+}
+
+// openSegment decodes the given tail of a segment, i.e. its bytes from the
+// offset returned by tailOffset to its end.
+func openSegment(name string, tail []byte, fetch func(ctx context.Context, offset, length int64) ([]byte, error)) (*segment, error) {
+	if len(tail) < footerLen {
+		return nil, errCorruptSegment
+	}
+	footer := tail[len(tail)-footerLen:]
+	if binary.LittleEndian.Uint64(footer[32:]) != segmentMagic {
+		return nil, errCorruptSegment
+	}
+	base := binary.LittleEndian.Uint64(footer)
+	indexLen := binary.LittleEndian.Uint64(footer[8:])
+	filterOffset := binary.LittleEndian.Uint64(footer[16:]) - base
+	filterLen := binary.LittleEndian.Uint64(footer[24:])
+	if indexLen != filterOffset || filterOffset+filterLen+footerLen != uint64(len(tail)) {
+		return nil, errCorruptSegment
+	}
+	s := &segment{
+		name:   name,
+		filter: tail[filterOffset : filterOffset+filterLen],
+		fetch:  fetch,
+	}
+	index := tail[:indexLen]
+	var err error
+	if s.lastKey, index, err = nextSection(index); err != nil {
+		return nil, err
+	}
+	for len(index) != 0 {
+		var h blockHandle
+		if h.firstKey, index, err = nextSection(index); err != nil {
+			return nil, err
+		}
+		offset, n, err := varint.FromUvarint(index)
+		if err != nil {
+			return nil, err
+		}
+		index = index[n:]
+		length, n, err := varint.FromUvarint(index)
+		if err != nil {
+			return nil, err
+		}
+		index = index[n:]
+		h.offset, h.length = int64(offset), int64(length)
+		s.index = append(s.index, h)
+	}
+	return s, nil
+}
+
+// get returns the value of the given key, or nil if the segment does not
+// contain it.
+func (s *segment) get(ctx context.Context, key []byte) ([]byte, error) {
+	if len(s.index) == 0 || bytes.Compare(key, s.index[0].firstKey) < 0 || bytes.Compare(key, s.lastKey) > 0 {
+		return nil, nil
+	}
+	if !filterPolicy.MayContain(pebble.TableFilter, s.filter, key) {
+		return nil, nil
+	}
+	// Find the last block whose first key is at most the key.
+	i := sort.Search(len(s.index), func(i int) bool {
+		return bytes.Compare(s.index[i].firstKey, key) > 0
+	}) - 1
+	block, err := s.fetch(ctx, s.index[i].offset, s.index[i].length)
+	if err != nil {
+		return nil, err
+	}
+	for len(block) != 0 {
+		var k, v []byte
+		if k, block, err = nextSection(block); err != nil {
+			return nil, err
+		}
+		if v, block, err = nextSection(block); err != nil {
+			return nil, err
+		}
+		switch bytes.Compare(k, key) {
+		case 0:
+			return v, nil
+		case 1:
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+func metadataKey(hvk dhstore.HashedValueKey) []byte {
+	sum := blake3.Sum256(hvk)
+	return append([]byte{metadataKeyPrefix}, sum[:]...)
+}
+
+func appendSection(b, section []byte) []byte {
+	b = append(b, varint.ToUvarint(uint64(len(section)))...)
+	return append(b, section...)
+}
+
+// nextSection returns the varint length-prefixed section at the start of b,
+// and the rest of b.
+func nextSection(b []byte) ([]byte, []byte, error) {
+	size, n, err := varint.FromUvarint(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	b = b[n:]
+	if size > uint64(len(b)) {
+		return nil, nil, errCorruptSegment
+	}
+	return b[:size], b[size:], nil
+}
+
+// unmarshalValueKeys decodes the encrypted value keys of an index record.
+func unmarshalValueKeys(b []byte) ([]dhstore.EncryptedValueKey, error) {
+	var evks []dhstore.EncryptedValueKey
+	for len(b) != 0 {
+		var evk []byte
+		var err error
+		if evk, b, err = nextSection(b); err != nil {
+			return nil, err
+		}
+		evks = append(evks, evk)
+	}
+	return evks, nil
+}
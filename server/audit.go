@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/audit"
+	"github.com/ipni/dhstore/auth"
+)
+
+// auditIndexes records the mutation of indexes made by the request in the
+// audit log, if enabled.
+func (s *Server) auditIndexes(r *http.Request, op audit.Op, indexes []dhstore.Index, err error) {
+	if s.auditLog != nil {
+		s.auditLog.RecordIndexes(op, s.auditClient(r), indexes, err)
+	}
+}
+
+// auditMetadata records the mutation of metadata made by the request in the
+// audit log, if enabled.
+func (s *Server) auditMetadata(r *http.Request, op audit.Op, hvks []dhstore.HashedValueKey, err error) {
+	if s.auditLog != nil {
+		s.auditLog.RecordMetadata(op, s.auditClient(r), hvks, err)
+	}
+}
+
+// auditClient identifies the client of the request by its address, request
+// ID, verified client certificate, writer tag and authorizer annotations.
+func (s *Server) auditClient(r *http.Request) audit.Client {
+	client := audit.Client{
+		API:         "http",
+		Addr:        r.RemoteAddr,
+		RequestID:   RequestIDFromContext(r.Context()),
+		Annotations: auth.AnnotationsFrom(r.Context()),
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+		client.Subject = r.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	if s.provenance != nil {
+		client.Tag = dhstore.TruncateProvenanceTag(r.Header.Get(s.provenance.header))
+	}
+	return client
+}
+
+// pruneClient identifies the deletions of stale records made while serving
+// the dhfind lookup of the given context.
+func pruneClient(ctx context.Context) audit.Client {
+	return audit.Client{API: "prune", RequestID: RequestIDFromContext(ctx)}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/auth"
+)
+
+// requireWriteClientCerts wraps the given handler such that requests other
+// than reads are rejected with 403 Forbidden unless the client presented a
+// certificate verified against the configured client CAs. Reads remain open
+// to clients without certificates.
+func requireWriteClientCerts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isRead(r) && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			logger(r.Context()).Warnw("Rejecting write without verified client certificate", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			dhstore.HTTPError(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeGroup returns the group of tokens authorized to make the given request.
+func routeGroup(r *http.Request) auth.Group {
+	switch pathLabel(r.URL.Path) {
+	case "ready", "openapi.json":
+		// Left open for health checks and API discovery.
+		return ""
+	case "export", "import", "provenance":
+		return auth.GroupAdmin
+	}
+	if isRead(r) {
+		return auth.GroupRead
+	}
+	return auth.GroupWrite
+}
+
+// authorizerGroup returns the group of the given request if it is subject to
+// authorizers, i.e. writes and admin requests, or empty otherwise.
+func authorizerGroup(r *http.Request) auth.Group {
+	if group := routeGroup(r); group != auth.GroupRead {
+		return group
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/ipni/dhstore"
+)
+
+// writeBackpressure rejects writes while the store is near its stop-writes
+// threshold, so that clients back off instead of having their requests hang
+// until the store catches up.
+type writeBackpressure struct {
+	reporter   dhstore.WritePressureReporter
+	threshold  float64
+	retryAfter time.Duration
+}
+
+// rejectWrite writes a 503 response with Retry-After header and returns true
+// if the store write pressure is at or above the threshold. Otherwise, it
+// returns false without writing anything.
+func (s *Server) rejectWrite(w http.ResponseWriter, r *http.Request) bool {
+	bp := s.writeBackpressure
+	if bp == nil {
+		return false
+	}
+	pressure := bp.reporter.WritePressure()
+	if pressure < bp.threshold {
+		return false
+	}
+	retryAfter := bp.retryAfterAt(pressure)
+	logger(r.Context()).Warnw("Rejecting write due to store write pressure", "pressure", pressure, "threshold", bp.threshold, "retryAfter", retryAfter)
+	if s.metrics != nil {
+		s.metrics.RecordHttpShed(context.Background(), r.Method, pathLabel(r.URL.Path), "write_pressure")
+	}
+	writeOverloaded(w, "store is near its stop-writes threshold", retryAfter)
+	return true
+}
+
+// retryAfterAt returns the Retry-After duration at the given write pressure,
+// which grows linearly from retryAfter at the threshold to twice retryAfter
+// once writes are stopped, so that clients back off for longer the closer the
+// store is to stalling.
+func (bp *writeBackpressure) retryAfterAt(pressure float64) time.Duration {
+	if bp.threshold >= 1 {
+		return bp.retryAfter
+	}
+	excess := min((pressure-bp.threshold)/(1-bp.threshold), 1)
+	return bp.retryAfter + time.Duration(excess*float64(bp.retryAfter))
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/dhstore"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// batchFindPath is the path at which batches of unencrypted lookups are
+	// resolved via dhfind.
+	batchFindPath = "/multihash/batch"
+	// batchFindMaxMultihashes bounds the number of multihashes and CIDs of a
+	// batch find.
+	batchFindMaxMultihashes = 1000
+	// batchFindConcurrency bounds the number of multihashes of a batch find
+	// that are resolved concurrently.
+	batchFindConcurrency = 8
+)
+
+// batchFindRequest is the body of batch finds, listing the multihashes to
+// find, and the CIDs whose multihashes to find.
+type batchFindRequest struct {
+	Multihashes []multihash.Multihash
+	CIDs        []string
+}
+
+// isBatchFind reports whether the given request is a batch find, which only
+// reads from the store despite being a POST.
+func isBatchFind(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.URL.Path == batchFindPath
+}
+
+// handleBatchFind resolves the multihashes of a batch find via dhfind, up to
+// batchFindConcurrency at a time, and streams a model.MultihashResult per
+// multihash with results as NDJSON as soon as it is resolved. Results are
+// therefore in no particular order, and multihashes without results, or whose
+// lookup fails, are omitted.
+func (s *Server) handleBatchFind(w http.ResponseWriter, r *http.Request) {
+	if s.metrics != nil {
+		ws := newResponseWriterWithStatus(w)
+		w = ws
+		start := s.clock.Now()
+		defer func() {
+			s.metrics.RecordDHFindLatency(r.Context(), s.clock.Since(start), r.Method, "multihash_batch", ws.status, false)
+		}()
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	dhfind := s.dhfind.Load()
+	if dhfind == nil {
+		dhstore.HTTPError(w, "batch find not available when dhfind not enabled", http.StatusNotImplemented)
+		return
+	}
+	filter, err := parseProtocolFilter(r)
+	if err != nil {
+		dhstore.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req batchFindRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger(r.Context()).Errorw("Cannot decode batch find request", "err", err)
+		dhstore.HTTPError(w, "", http.StatusBadRequest)
+		return
+	}
+	mhs := req.Multihashes
+	for _, c := range req.CIDs {
+		decoded, err := cid.Decode(c)
+		if err != nil {
+			dhstore.ErrorResponse{Code: dhstore.ErrorCodeBadMultihash, Message: fmt.Sprintf("invalid cid: %s", err)}.Write(w, http.StatusBadRequest)
+			return
+		}
+		mhs = append(mhs, decoded.Hash())
+	}
+	if len(mhs) == 0 {
+		dhstore.HTTPError(w, "at least one multihash or CID must be specified", http.StatusBadRequest)
+		return
+	}
+	if len(mhs) > batchFindMaxMultihashes {
+		dhstore.HTTPError(w, fmt.Sprintf("at most %d multihashes and CIDs can be found at once", batchFindMaxMultihashes), http.StatusBadRequest)
+		return
+	}
+	for _, mh := range mhs {
+		if _, err := multihash.Decode(mh); err != nil {
+			dhstore.ErrorResponse{Code: dhstore.ErrorCodeBadMultihash, Message: err.Error()}.Write(w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	work := make(chan multihash.Multihash)
+	results := make(chan model.MultihashResult)
+	var wg sync.WaitGroup
+	for i := 0; i < min(batchFindConcurrency, len(mhs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for mh := range work {
+				prs, err := dhfind.findAll(context.WithValue(ctx, origMultihashKey{}, mh), mh)
+				if err != nil {
+					logger(ctx).Warnw("Failed dhfind multihash lookup in batch", "multihash", mh.B58String(), "err", err)
+					continue
+				}
+				if prs = filter.apply(prs); len(prs) == 0 {
+					continue
+				}
+				select {
+				case results <- model.MultihashResult{Multihash: mh, ProviderResults: prs}:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(results)
+		defer wg.Wait()
+		defer close(work)
+		for _, mh := range mhs {
+			select {
+			case work <- mh:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", mediaTypeNDJSON)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	var found int
+	for result := range results {
+		if err := enc.Encode(result); err != nil {
+			logger(r.Context()).Errorw("Failed to write batch find result", "found", found, "err", err)
+			// Stop resolving the remaining multihashes, and drain the results
+			// of those in flight.
+			cancel()
+			for range results {
+			}
+			return
+		}
+		_ = rc.Flush()
+		found++
+	}
+	logger(r.Context()).Debugw("Found multihash batch", "multihashes", len(mhs), "found", found)
+}
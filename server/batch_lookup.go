@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// batchLookupPath is the path at which encrypted lookups of binary lists
+	// of multihashes are served.
+	batchLookupPath = "/encrypted/multihash/batch"
+	// mediaTypeOctetStream is the media type of binary lists of multihashes.
+	mediaTypeOctetStream = "application/octet-stream"
+	// batchLookupMaxMultihashLen bounds the length prefix of multihashes, so
+	// that malformed lists do not cause large allocations.
+	batchLookupMaxMultihashLen = 1 << 10
+)
+
+// isBatchLookup reports whether the given request is a batch lookup, which
+// only reads from the store despite being a POST.
+func isBatchLookup(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.URL.Path == batchLookupPath
+}
+
+// handleBatchLookup looks up the encrypted value keys of a binary list of
+// multihashes, each prefixed by its length as an unsigned varint, and streams
+// an EncryptedMultihashResult per found multihash as NDJSON while the list is
+// still being read. Multihashes without records are omitted. Since the
+// response has started by the time a malformed multihash may be read, the
+// response is then truncated, unless no result has been written yet.
+func (s *Server) handleBatchLookup(w http.ResponseWriter, r *http.Request) {
+	if s.metrics != nil {
+		ws := newResponseWriterWithStatus(w)
+		w = ws
+		start := s.clock.Now()
+		defer func() {
+			s.metrics.RecordHttpLatency(r.Context(), s.clock.Since(start), r.Method, "multihash_batch", ws.status)
+		}()
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Results are written while the request body is still being read.
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil {
+		logger(r.Context()).Debugw("Full duplex not supported", "err", err)
+	}
+	w.Header().Set("Content-Type", mediaTypeNDJSON)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	enc := json.NewEncoder(w)
+
+	br := bufio.NewReader(r.Body)
+	var looked, found int
+	for {
+		if br.Buffered() == 0 && found != 0 {
+			// Write out results before waiting for more multihashes.
+			_ = rc.Flush()
+		}
+		mh, err := readMultihash(br)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			looked++
+			var evks []dhstore.EncryptedValueKey
+			if evks, err = s.dhs.Lookup(mh); err == nil && len(evks) != 0 {
+				result := model.EncryptedMultihashResult{Multihash: mh, EncryptedValueKeys: make([][]byte, 0, len(evks))}
+				for _, evk := range evks {
+					result.EncryptedValueKeys = append(result.EncryptedValueKeys, evk)
+				}
+				if err = enc.Encode(result); err != nil {
+					logger(r.Context()).Errorw("Failed to write batch lookup result", "looked", looked, "err", err)
+					return
+				}
+				found++
+			}
+		}
+		if err != nil {
+			if found == 0 {
+				s.handleError(w, err)
+				return
+			}
+			// There is no way to signal the error other than truncating the
+			// response.
+			logger(r.Context()).Errorw("Batch lookup interrupted", "looked", looked, "found", found, "err", err)
+			return
+		}
+	}
+	if found == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	logger(r.Context()).Debugw("Looked up multihash batch", "looked", looked, "found", found)
+}
+
+// readMultihash reads a varint length-prefixed multihash, returning io.EOF
+// only at the end of the list.
+func readMultihash(br *bufio.Reader) (multihash.Multihash, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		return nil, dhstore.ErrMultihashDecode{Err: fmt.Errorf("cannot read length: %w", err)}
+	}
+	if n > batchLookupMaxMultihashLen {
+		return nil, dhstore.ErrMultihashDecode{Err: fmt.Errorf("length %d exceeds %d", n, batchLookupMaxMultihashLen)}
+	}
+	mh := make(multihash.Multihash, n)
+	if _, err := io.ReadFull(br, mh); err != nil {
+		return nil, dhstore.ErrMultihashDecode{Err: fmt.Errorf("cannot read multihash: %w", err)}
+	}
+	if _, err := multihash.Decode(mh); err != nil {
+		return nil, dhstore.ErrMultihashDecode{Mh: mh, Err: err}
+	}
+	return mh, nil
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/metrics"
+	"github.com/ipni/dhstore/providers"
+	"github.com/ipni/go-libipni/dhash"
+	"github.com/ipni/go-libipni/find/client"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/pcache"
+	"github.com/multiformats/go-multihash"
+)
+
+// dhFind looks up the providers of unencrypted multihashes by decrypting the
+// value keys and metadata in the store, and resolving the provider information
+// of each via a pool of providers endpoints.
+type dhFind struct {
+	api    client.DHStoreAPI
+	pcache *pcache.ProviderCache
+	pool   *providers.Pool
+	// misses optionally caches the multihashes that recently resolved to no
+	// results.
+	misses *missCache
+	// providers caches the list of all providers served at /providers.
+	providers providersList
+
+	// timeout bounds the duration of each lookup, if positive.
+	timeout time.Duration
+	// parallelism is the number of value keys whose metadata and provider
+	// information are fetched concurrently per lookup.
+	parallelism int
+	// maxValueKeys bounds the number of value keys decrypted per lookup, if
+	// positive.
+	maxValueKeys int
+	// noExtendedProviders omits the results of extended providers.
+	noExtendedProviders bool
+
+	metrics *metrics.Metrics
+	clock   clock.Clock
+}
+
+// SetProvidersURLs changes the providers URLs of dhfind, which is enabled by
+// any URLs and disabled by none. Lookups in flight complete with the previous
+// URLs. See WithDHFind for the format of URLs.
+func (s *Server) SetProvidersURLs(providersURLs []string) error {
+	eps, err := s.parseProvidersURLs(providersURLs)
+	if err != nil {
+		return err
+	}
+	return s.setProviders(eps)
+}
+
+// ValidateProvidersURLs returns the error that SetProvidersURLs would return
+// for the given providers URLs, without changing them.
+func (s *Server) ValidateProvidersURLs(providersURLs []string) error {
+	_, err := s.parseProvidersURLs(providersURLs)
+	return err
+}
+
+func (s *Server) parseProvidersURLs(providersURLs []string) ([]providers.Endpoint, error) {
+	eps, err := providers.ParseEndpoints(providersURLs)
+	if err != nil {
+		return nil, err
+	}
+	if len(eps) != 0 && s.encryptedLookupsOnly {
+		return nil, errors.New("dhfind requires unencrypted lookups")
+	}
+	return eps, nil
+}
+
+func (s *Server) setProviders(eps []providers.Endpoint) error {
+	if len(eps) == 0 {
+		if dhfind := s.dhfind.Swap(nil); dhfind != nil {
+			log.Info("dhfind disabled")
+			return dhfind.close()
+		}
+		return nil
+	}
+	if s.encryptedLookupsOnly {
+		return errors.New("dhfind requires unencrypted lookups")
+	}
+	pool, err := providers.New(eps, providers.WithCheckInterval(s.providersCheckInterval), providers.WithHTTPClient(s.httpClient),
+		providers.WithClock(s.clock), providers.WithCircuitBreaker(s.breakerFailures, s.breakerCooldown))
+	if err != nil {
+		return err
+	}
+	// Provider information is resolved via pc, so that it is fetched from the
+	// pool rather than from each providers URL in turn.
+	var src pcache.ProviderSource = pool
+	if s.providerInfos != nil {
+		src = &persistentSource{pool: pool, store: s.providerInfos, maxAge: s.providerCacheMaxAge, clock: s.clock}
+	}
+	pc, err := pcache.New(pcache.WithSource(src))
+	if err != nil {
+		return err
+	}
+	d := &dhFind{
+		api:          s,
+		pcache:       pc,
+		pool:         pool,
+		timeout:      s.dhfindTimeout,
+		parallelism:  s.dhfindParallelism,
+		maxValueKeys: s.dhfindMaxValueKeys,
+		metrics:      s.metrics,
+		clock:        s.clock,
+
+		noExtendedProviders: s.noExtendedProviders,
+	}
+	if s.dhfindMissTTL > 0 {
+		d.misses = newMissCache(s.clock, s.dhfindMissTTL)
+	}
+	pool.Start(context.Background())
+	if prev := s.dhfind.Swap(d); prev != nil {
+		_ = prev.close()
+	}
+	log.Infow("dhfind enabled", "providers", eps)
+	return nil
+}
+
+// FindAsync returns the provider results of the given multihash on resChan,
+// which is closed once there are no more results or upon error. Multihashes
+// that recently resolved to no results are not looked up again until the miss
+// cache TTL elapses.
+//
+// The metadata and provider information of up to parallelism value keys are
+// fetched concurrently, so results are returned in no particular order unless
+// parallelism is 1. Lookups that exceed the timeout return the results found
+// until then, or context.DeadlineExceeded if there are none. Lookups fail fast
+// with providers.ErrCircuitOpen while the circuit breaker of the providers
+// URLs is open.
+func (d *dhFind) FindAsync(ctx context.Context, mh multihash.Multihash, resChan chan<- model.ProviderResult) error {
+	defer close(resChan)
+	if d.misses != nil && d.misses.has(mh) {
+		return nil
+	}
+	if cooldown := d.pool.Cooldown(); cooldown > 0 {
+		return fmt.Errorf("%w for %s", providers.ErrCircuitOpen, cooldown.Round(time.Second))
+	}
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	start := d.clock.Now()
+	emrs, err := d.api.FindMultihash(ctx, dhash.SecondMultihash(mh))
+	d.observe(metrics.DHFindStageStoreLookup, start, err)
+	if err != nil {
+		return err
+	}
+	var evks [][]byte
+	for _, emr := range emrs {
+		evks = append(evks, emr.EncryptedValueKeys...)
+	}
+	if len(evks) == 0 {
+		if d.misses != nil {
+			d.misses.add(mh)
+		}
+		return nil
+	}
+	if d.maxValueKeys > 0 && len(evks) > d.maxValueKeys {
+		logger(ctx).Warnw("Too many value keys to decrypt, ignoring excess", "multihash", mh.B58String(), "count", len(evks), "max", d.maxValueKeys)
+		evks = evks[:d.maxValueKeys]
+	}
+
+	var found atomic.Bool
+	work := make(chan []byte)
+	var wg sync.WaitGroup
+	for i := 0; i < min(d.parallelism, len(evks)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for evk := range work {
+				if d.resolve(ctx, mh, evk, resChan) {
+					found.Store(true)
+				}
+			}
+		}()
+	}
+feed:
+	for _, evk := range evks {
+		select {
+		case work <- evk:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err = ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && found.Load() {
+			logger(ctx).Warnw("dhfind lookup timed out, returning partial results", "multihash", mh.B58String(), "timeout", d.timeout)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// resolve writes the provider results of the given encrypted value key of mh
+// to resChan, and reports whether there were any. Value keys that cannot be
+// resolved are skipped rather than failing the whole lookup.
+func (d *dhFind) resolve(ctx context.Context, mh multihash.Multihash, evk []byte, resChan chan<- model.ProviderResult) bool {
+	start := d.clock.Now()
+	vk, err := dhash.DecryptValueKey(evk, mh)
+	if err != nil {
+		d.observe(metrics.DHFindStageDecrypt, start, err)
+		logger(ctx).Warnw("Error decrypting value key", "multihash", mh.B58String(), "err", err)
+		return false
+	}
+	pid, ctxID, err := dhash.SplitValueKey(vk)
+	d.observe(metrics.DHFindStageDecrypt, start, err)
+	if err != nil {
+		logger(ctx).Warnw("Error splitting value key", "multihash", mh.B58String(), "err", err)
+		return false
+	}
+
+	start = d.clock.Now()
+	encMetadata, err := d.api.FindMetadata(ctx, dhash.SHA256(vk, nil))
+	d.observe(metrics.DHFindStageMetadata, start, err)
+	if err != nil {
+		logger(ctx).Warnw("Error fetching metadata", "multihash", mh.B58String(), "provider", pid, "err", err)
+		return false
+	}
+	if len(encMetadata) == 0 {
+		// The metadata was probably deleted by context ID without removing
+		// the value keys of its multihashes.
+		return false
+	}
+
+	start = d.clock.Now()
+	metadata, err := dhash.DecryptMetadata(encMetadata, vk)
+	d.observe(metrics.DHFindStageDecrypt, start, err)
+	if err != nil {
+		logger(ctx).Warnw("Error decrypting metadata", "multihash", mh.B58String(), "provider", pid, "err", err)
+		return false
+	}
+
+	start = d.clock.Now()
+	prs, err := d.pcache.GetResults(ctx, pid, ctxID, metadata)
+	d.observe(metrics.DHFindStageProviders, start, err)
+	if err != nil {
+		logger(ctx).Warnw("Error fetching provider infos", "multihash", mh.B58String(), "provider", pid, "err", err)
+		return false
+	}
+	if d.noExtendedProviders && len(prs) > 1 {
+		// The result of the provider itself comes first.
+		prs = prs[:1]
+	}
+	for _, pr := range prs {
+		select {
+		case resChan <- pr:
+		case <-ctx.Done():
+			return true
+		}
+	}
+	return len(prs) != 0
+}
+
+// observe records the latency of the given stage of a lookup started at start,
+// and whether it failed with err.
+func (d *dhFind) observe(stage string, start time.Time, err error) {
+	if d.metrics != nil {
+		d.metrics.RecordDHFindStage(context.Background(), stage, d.clock.Since(start), err != nil)
+	}
+}
+
+// findAll returns all the provider results of the given multihash.
+func (d *dhFind) findAll(ctx context.Context, mh multihash.Multihash) ([]model.ProviderResult, error) {
+	resChan := make(chan model.ProviderResult)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- d.FindAsync(ctx, mh, resChan)
+	}()
+	var prs []model.ProviderResult
+	for pr := range resChan {
+		prs = append(prs, pr)
+	}
+	return prs, <-errChan
+}
+
+// close stops checking the health of the providers endpoints. Lookups in
+// flight may still fetch provider information.
+func (d *dhFind) close() error {
+	return d.pool.Close()
+}
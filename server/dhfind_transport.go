@@ -0,0 +1,74 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// dhfindTransport tunes the transport via which dhfind fetches provider
+// information. Zero values keep the setting of the transport of the HTTP
+// client.
+type dhfindTransport struct {
+	maxIdleConnsPerHost   int
+	idleConnTimeout       time.Duration
+	keepAlive             time.Duration
+	tlsSessionCacheSize   int
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+}
+
+// apply returns a transport that makes requests as the given one does, tuned
+// by t. The given transport is not modified.
+func (t dhfindTransport) apply(base http.RoundTripper) (http.RoundTripper, error) {
+	if t == (dhfindTransport{}) {
+		return base, nil
+	}
+	if rt, ok := base.(RequestIDTransport); ok {
+		base = rt.Base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ht, ok := base.(*http.Transport)
+	if !ok {
+		return nil, errors.New("dhfind transport can only be tuned for HTTP clients of *http.Transport")
+	}
+	ht = ht.Clone()
+	if t.maxIdleConnsPerHost != 0 {
+		ht.MaxIdleConnsPerHost = t.maxIdleConnsPerHost
+		if ht.MaxIdleConns != 0 {
+			ht.MaxIdleConns = max(ht.MaxIdleConns, t.maxIdleConnsPerHost)
+		}
+	}
+	if t.idleConnTimeout != 0 {
+		ht.IdleConnTimeout = t.idleConnTimeout
+	}
+	if t.keepAlive != 0 || t.dialTimeout != 0 {
+		// The defaults of http.DefaultTransport.
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		if t.keepAlive != 0 {
+			dialer.KeepAlive = t.keepAlive
+		}
+		if t.dialTimeout != 0 {
+			dialer.Timeout = t.dialTimeout
+		}
+		ht.DialContext = dialer.DialContext
+	}
+	if t.tlsSessionCacheSize != 0 {
+		if ht.TLSClientConfig == nil {
+			ht.TLSClientConfig = &tls.Config{}
+		}
+		ht.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(t.tlsSessionCacheSize)
+	}
+	if t.tlsHandshakeTimeout != 0 {
+		ht.TLSHandshakeTimeout = t.tlsHandshakeTimeout
+	}
+	if t.responseHeaderTimeout != 0 {
+		ht.ResponseHeaderTimeout = t.responseHeaderTimeout
+	}
+	return ht, nil
+}
@@ -2,22 +2,42 @@ package server
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/pb"
 	"github.com/ipni/go-libipni/apierror"
 	"github.com/ipni/go-libipni/find/model"
 	"github.com/ipni/go-libipni/rwriter"
+	"google.golang.org/protobuf/proto"
 )
 
+const mediaTypeProtobuf = "application/protobuf"
+
 type encResponseWriter struct {
 	rwriter.ResponseWriter
 	count     int
 	encResult model.EncryptedMultihashResult
+	// protobuf is set when the results are encoded as a pb.LookupResponse.
+	protobuf bool
+	// written optionally counts the bytes of the response.
+	written *countingResponseWriter
+
+	// flushInterval is the minimum interval between flushes of NDJSON lines,
+	// if positive, as measured by clock since lastFlush.
+	flushInterval time.Duration
+	clock         clock.Clock
+	lastFlush     time.Time
 }
 
-func newEncResponseWriter(w *rwriter.ResponseWriter) *encResponseWriter {
+func (s *Server) newEncResponseWriter(w *rwriter.ResponseWriter, protobuf bool, written *countingResponseWriter) *encResponseWriter {
 	return &encResponseWriter{
 		ResponseWriter: *w,
+		protobuf:       protobuf,
+		written:        written,
+		flushInterval:  s.ndjsonFlushInterval,
+		clock:          s.clock,
 		encResult: model.EncryptedMultihashResult{
 			Multihash: w.Multihash(),
 		},
@@ -32,7 +52,12 @@ func (ew *encResponseWriter) writeEncryptedValueKey(evk dhstore.EncryptedValueKe
 		if err != nil {
 			return err
 		}
-		ew.Flush()
+		if ew.flushInterval <= 0 {
+			ew.Flush()
+		} else if now := ew.clock.Now(); now.Sub(ew.lastFlush) >= ew.flushInterval {
+			ew.Flush()
+			ew.lastFlush = now
+		}
 	} else {
 		ew.encResult.EncryptedValueKeys = append(ew.encResult.EncryptedValueKeys, evk)
 	}
@@ -47,6 +72,17 @@ func (ew *encResponseWriter) close() error {
 	if ew.IsND() {
 		return nil
 	}
+	if ew.protobuf {
+		b, err := proto.Marshal(&pb.LookupResponse{
+			Multihash:          ew.encResult.Multihash,
+			EncryptedValueKeys: ew.encResult.EncryptedValueKeys,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = ew.Write(b)
+		return err
+	}
 	return ew.Encoder().Encode(model.FindResponse{
 		EncryptedMultihashResults: []model.EncryptedMultihashResult{ew.encResult},
 	})
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// mediaTypeEventStream is the media type of lookup responses streamed as
+// Server-Sent Events.
+const mediaTypeEventStream = "text/event-stream"
+
+// eventStreamWriter writes the NDJSON written to it as Server-Sent Events,
+// one event per line, so that lookups stream to browsers by way of the NDJSON
+// writers. Only successful responses with the event stream content type are
+// framed, so that errors are written as is.
+type eventStreamWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	framed      bool
+	events      int
+}
+
+func newEventStreamWriter(w http.ResponseWriter) *eventStreamWriter {
+	return &eventStreamWriter{ResponseWriter: w}
+}
+
+func (ew *eventStreamWriter) WriteHeader(code int) {
+	if !ew.wroteHeader {
+		ew.wroteHeader = true
+		ew.framed = code == http.StatusOK && ew.Header().Get("Content-Type") == mediaTypeEventStream
+		if ew.framed {
+			ew.Header().Set("Cache-Control", "no-cache")
+		}
+	}
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+// Write writes each line of p as the data of an event. Empty lines, written
+// by watches to keep connections alive, are written as comments.
+func (ew *eventStreamWriter) Write(p []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if !ew.framed {
+		return ew.ResponseWriter.Write(p)
+	}
+	var buf bytes.Buffer
+	for _, line := range bytes.Split(bytes.TrimSuffix(p, []byte("\n")), []byte("\n")) {
+		if len(line) == 0 {
+			buf.WriteString(":\n\n")
+			continue
+		}
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteString("\n\n")
+		ew.events++
+	}
+	if _, err := ew.ResponseWriter.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ew *eventStreamWriter) Flush() {
+	_ = http.NewResponseController(ew.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying ResponseWriter, so that http.ResponseController
+// can flush it.
+func (ew *eventStreamWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// end writes an end event carrying the number of events written, if the
+// response is an event stream, so that clients can close the stream rather
+// than have EventSource reconnect once the response ends.
+func (ew *eventStreamWriter) end() {
+	if !ew.framed {
+		return
+	}
+	_, _ = fmt.Fprintf(ew.ResponseWriter, "event: end\ndata: {\"count\":%d}\n\n", ew.events)
+	ew.Flush()
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/load"
+)
+
+// exportFlushEvery is the number of exported records after which the response
+// is flushed to the client.
+const exportFlushEvery = 1024
+
+var errExportLimitReached = errors.New("export limit reached")
+
+// handleExport streams the records of the store as newline delimited JSON,
+// in digest order. Each record carries a cursor that, when passed as the
+// cursor query parameter, resumes the export right after that record. The
+// start and end query parameters optionally bound the exported digests as
+// hex, so that consumers can export disjoint ranges in parallel. The format
+// query parameter set to binary streams the records in the compact binary
+// format of the load package instead, which carries no cursors.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	opts := dhstore.ExportOptions{
+		Cursor: query.Get("cursor"),
+	}
+	var err error
+	if v := query.Get("start"); v != "" {
+		if opts.Start, err = hex.DecodeString(v); err != nil {
+			dhstore.HTTPError(w, "invalid start: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("end"); v != "" {
+		if opts.End, err = hex.DecodeString(v); err != nil {
+			dhstore.HTTPError(w, "invalid end: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	contentType := mediaTypeNDJSON
+	if v := query.Get("format"); v == "binary" {
+		contentType = mediaTypeBinaryRecords
+	} else if v != "" && v != "ndjson" {
+		dhstore.HTTPError(w, "invalid format", http.StatusBadRequest)
+		return
+	}
+	var limit int
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			dhstore.HTTPError(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	encode := func(record dhstore.ExportRecord) error { return enc.Encode(record) }
+	flush := func() error { return nil }
+	if contentType == mediaTypeBinaryRecords {
+		bw := load.NewBinaryWriter(w)
+		encode, flush = bw.Write, bw.Flush
+	}
+	var count int
+	err = s.exporter.Export(r.Context(), opts, func(record dhstore.ExportRecord) error {
+		if count == 0 {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if err := encode(record); err != nil {
+			return err
+		}
+		count++
+		if flusher != nil && count%exportFlushEvery == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+		if limit != 0 && count == limit {
+			return errExportLimitReached
+		}
+		return nil
+	})
+	switch {
+	case err == nil, errors.Is(err, errExportLimitReached):
+		if count == 0 {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(http.StatusOK)
+		}
+		if err := flush(); err != nil {
+			logger(r.Context()).Errorw("Failed to flush export", "err", err)
+		}
+	case count == 0:
+		logger(r.Context()).Errorw("Failed to export", "err", err)
+		s.handleError(w, err)
+	default:
+		// The response has already started; the client resumes from the
+		// cursor of the last record it received.
+		_ = flush()
+		logger(r.Context()).Errorw("Export interrupted", "exported", count, "err", err)
+	}
+}
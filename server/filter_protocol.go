@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/metadata"
+	"github.com/multiformats/go-multicodec"
+)
+
+const (
+	// filterProtocolParam is the query parameter that lists the transport
+	// protocols to which dhfind results are restricted.
+	filterProtocolParam = "filter-protocol"
+	// unknownProtocol matches results whose metadata cannot be decoded, or
+	// lists a protocol that metadata.Default does not know.
+	unknownProtocol = "unknown"
+)
+
+// protocolFilter restricts dhfind results to those whose metadata lists any of
+// its protocols. A nil filter matches all results.
+type protocolFilter struct {
+	codes   map[multicodec.Code]struct{}
+	unknown bool
+}
+
+// parseProtocolFilter returns the filter of the filter-protocol query
+// parameters of the given request, each of which is a comma separated list of
+// multicodec names such as transport-bitswap, or "unknown". It returns nil if
+// there are none.
+func parseProtocolFilter(r *http.Request) (*protocolFilter, error) {
+	values := r.URL.Query()[filterProtocolParam]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	f := &protocolFilter{codes: make(map[multicodec.Code]struct{})}
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == unknownProtocol {
+				f.unknown = true
+				continue
+			}
+			var code multicodec.Code
+			if err := code.Set(name); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", filterProtocolParam, err)
+			}
+			f.codes[code] = struct{}{}
+		}
+	}
+	return f, nil
+}
+
+// match reports whether the metadata of the given result lists any of the
+// protocols of the filter.
+func (f *protocolFilter) match(pr model.ProviderResult) bool {
+	if f == nil {
+		return true
+	}
+	md := metadata.Default.New()
+	if err := md.UnmarshalBinary(pr.Metadata); err != nil || md.Len() == 0 {
+		return f.unknown
+	}
+	for _, code := range md.Protocols() {
+		if _, ok := md.Get(code).(*metadata.Unknown); ok {
+			if f.unknown {
+				return true
+			}
+			continue
+		}
+		if _, ok := f.codes[code]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns the results that match the filter, reusing the given slice.
+func (f *protocolFilter) apply(prs []model.ProviderResult) []model.ProviderResult {
+	if f == nil {
+		return prs
+	}
+	matched := prs[:0]
+	for _, pr := range prs {
+		if f.match(pr) {
+			matched = append(matched, pr)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,42 @@
+//go:build http3
+
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+type quicListener struct {
+	s *http3.Server
+}
+
+func newHTTP3Listener(addr string, handler http.Handler, tlsConfig *tls.Config) (http3Listener, error) {
+	return &quicListener{
+		s: &http3.Server{
+			Addr:      addr,
+			Handler:   handler,
+			TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+		},
+	}, nil
+}
+
+func (l *quicListener) start() (net.Addr, error) {
+	conn, err := net.ListenPacket("udp", l.s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() { _ = l.s.Serve(conn) }()
+	return conn.LocalAddr(), nil
+}
+
+func (l *quicListener) advertise(hdr http.Header) error {
+	return l.s.SetQUICHeaders(hdr)
+}
+
+func (l *quicListener) close() error {
+	return l.s.Close()
+}
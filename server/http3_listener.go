@@ -0,0 +1,30 @@
+package server
+
+import (
+	"net"
+	"net/http"
+)
+
+// http3Listener serves the lookup API over HTTP/3, i.e. over QUIC, which is
+// only available when built with the http3 build tag.
+type http3Listener interface {
+	// start listens on UDP and serves in the background.
+	start() (net.Addr, error)
+	// advertise sets the Alt-Svc header of the given response headers, so that
+	// clients of the TCP listener discover the HTTP/3 listener.
+	advertise(http.Header) error
+	close() error
+}
+
+// advertiseHTTP3 wraps the given handler such that responses to reads
+// advertise the given HTTP/3 listener.
+func advertiseHTTP3(h3 http3Listener, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isRead(r) {
+			if err := h3.advertise(w.Header()); err != nil {
+				log.Debugw("Failed to advertise HTTP/3", "err", err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/load"
+)
+
+// mediaTypeBinaryRecords is the media type of records in the binary format of
+// the load package.
+const mediaTypeBinaryRecords = "application/vnd.ipni.dhstore-records"
+
+// handleImport bulk loads the records of the request body into the store, as
+// exported by another dhstore or an indexer snapshot, in either newline
+// delimited JSON or the binary format. Records are decoded as the body is
+// read and imported in bounded batches straight into the store, bypassing the
+// merge API. The ingest query parameter set to true writes larger batches to
+// SSTs that are ingested directly, which is faster for bulk loads, at the cost
+// of holding live writes back behind a barrier while each SST is built and
+// ingested. Stores that do not support ingestion import instead.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.rejectWrite(w, r) {
+		return
+	}
+
+	var ingest bool
+	if v := r.URL.Query().Get("ingest"); v != "" {
+		var err error
+		if ingest, err = strconv.ParseBool(v); err != nil {
+			dhstore.HTTPError(w, "invalid ingest", http.StatusBadRequest)
+			return
+		}
+	}
+	opts := []load.Option{load.WithClock(s.clock), load.WithIngest(ingest), load.WithMaxValueKeySize(s.maxValueKeySize)}
+	if ingest {
+		// Ingested SSTs are best kept large.
+		opts = append(opts, load.WithBatchSize(1<<20, 64<<20))
+	}
+	if bp := s.writeBackpressure; bp != nil {
+		opts = append(opts, load.WithWritePressure(bp.threshold, bp.retryAfter))
+	}
+	if s.auditLog != nil {
+		client := s.auditClient(r)
+		opts = append(opts, load.WithOnBatch(func(batch []dhstore.ExportRecord, err error) {
+			s.auditLog.RecordImport(client, batch, err)
+		}))
+	}
+	loader, err := load.New(s.importer, opts...)
+	if err != nil {
+		logger(r.Context()).Errorw("Failed to instantiate loader", "err", err)
+		dhstore.HTTPError(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	stats, err := loader.Load(r.Context(), r.Body)
+	if err != nil {
+		// Records of batches imported before the failure remain in the store;
+		// since imports are idempotent the client may retry the whole body.
+		logger(r.Context()).Errorw("Import failed", "imported", stats.Records, "err", err)
+		if errors.As(err, &load.ErrDecode{}) {
+			dhstore.HTTPError(w, err.Error(), http.StatusBadRequest)
+		} else {
+			s.handleError(w, err)
+		}
+		return
+	}
+	logger(r.Context()).Infow("Imported records", "records", stats.Records, "batches", stats.Batches, "throttled", stats.Throttled)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ImportResponse{
+		Records:   stats.Records,
+		Batches:   stats.Batches,
+		Throttled: stats.Throttled.String(),
+	}); err != nil {
+		logger(r.Context()).Errorw("Failed to write import response", "err", err)
+	}
+}
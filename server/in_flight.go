@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+// countInFlight wraps the given handler such that the number of requests being
+// served is reported to metrics, labelled by method and by the route of the
+// given mux that serves them, so that latency spikes can be correlated with
+// concurrency. Requests are counted from the moment they are received, i.e.
+// including the time they spend waiting for the concurrency limiter.
+func (s *Server) countInFlight(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Label requests by route rather than by path, so that clients cannot
+		// blow up the cardinality of the gauge with arbitrary paths.
+		_, pattern := mux.Handler(r)
+		method, path := methodLabel(r.Method), pathLabel(pattern)
+		if path == "" {
+			path = "other"
+		}
+		s.metrics.RecordHttpInFlight(context.Background(), method, path, 1)
+		defer s.metrics.RecordHttpInFlight(context.Background(), method, path, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// methodLabel returns the given method if it is a standard HTTP method, or
+// "other" otherwise, since clients may send arbitrary methods.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
+)
+
+// legacyFindMaxMultihashes bounds the number of multihashes of a legacy batch
+// find, each of which may be resolved via dhfind.
+const legacyFindMaxMultihashes = 1000
+
+// legacyFindRequest is the body of batch finds of the storetheindex find API,
+// i.e. POST /multihash.
+type legacyFindRequest struct {
+	Multihashes []multihash.Multihash
+}
+
+// isLegacyFind reports whether the given request is a batch find of the
+// storetheindex find API, which only reads from the store despite being a
+// POST.
+func isLegacyFind(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.URL.Path == "/multihash"
+}
+
+// handleLegacyFind resolves the multihashes of a batch find of the
+// storetheindex find API, and responds with a single model.FindResponse of
+// those found, or 404 Not Found if none are. Each multihash is looked up as
+// GET /multihash/<multihash> would, i.e. DBL_SHA2_256 multihashes as
+// encrypted lookups first, and others via dhfind if enabled.
+func (s *Server) handleLegacyFind(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseProtocolFilter(r)
+	if err != nil {
+		dhstore.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req legacyFindRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger(r.Context()).Errorw("Cannot decode find request", "err", err)
+		dhstore.HTTPError(w, "", http.StatusBadRequest)
+		return
+	}
+	if len(req.Multihashes) == 0 {
+		dhstore.HTTPError(w, "at least one multihash must be specified", http.StatusBadRequest)
+		return
+	}
+	if len(req.Multihashes) > legacyFindMaxMultihashes {
+		dhstore.HTTPError(w, fmt.Sprintf("at most %d multihashes can be found at once", legacyFindMaxMultihashes), http.StatusBadRequest)
+		return
+	}
+
+	var rsp model.FindResponse
+	dhfind := s.dhfind.Load()
+	for _, mh := range req.Multihashes {
+		dmh, err := multihash.Decode(mh)
+		if err != nil {
+			dhstore.ErrorResponse{Code: dhstore.ErrorCodeBadMultihash, Message: err.Error()}.Write(w, http.StatusBadRequest)
+			return
+		}
+		if dmh.Code == multihash.DBL_SHA2_256 {
+			evks, err := s.dhs.Lookup(mh)
+			if err != nil {
+				s.handleError(w, err)
+				return
+			}
+			if len(evks) != 0 {
+				result := model.EncryptedMultihashResult{Multihash: mh, EncryptedValueKeys: make([][]byte, 0, len(evks))}
+				for _, evk := range evks {
+					result.EncryptedValueKeys = append(result.EncryptedValueKeys, evk)
+				}
+				rsp.EncryptedMultihashResults = append(rsp.EncryptedMultihashResults, result)
+				continue
+			}
+		}
+		if dhfind == nil {
+			continue
+		}
+		prs, err := dhfind.findAll(context.WithValue(r.Context(), origMultihashKey{}, mh), mh)
+		if err != nil {
+			logger(r.Context()).Errorw("Failed dhfind multihash lookup", "err", err)
+			s.handleError(w, err)
+			return
+		}
+		if prs = filter.apply(prs); len(prs) != 0 {
+			rsp.MultihashResults = append(rsp.MultihashResults, model.MultihashResult{Multihash: mh, ProviderResults: prs})
+		}
+	}
+	if len(rsp.MultihashResults) == 0 && len(rsp.EncryptedMultihashResults) == 0 {
+		dhstore.HTTPError(w, "", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		logger(r.Context()).Errorw("Failed to write find response", "err", err)
+	}
+}
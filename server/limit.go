@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/limit"
+)
+
+// limitConcurrency wraps the given handler such that requests wait for a slot
+// of the given limiter, and are rejected with 503 Service Unavailable if none
+// becomes available within its queue timeout. Rejected responses carry a
+// Retry-After header estimated by the limiter. GET /ready is not limited, so
+// that health checks reflect the store rather than load, and neither are
+// watches, which are bounded by the watch hub instead, nor WebSocket
+// connections, whose lookups are limited individually.
+func (s *Server) limitConcurrency(limiter *limit.Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pathLabel(r.URL.Path) == "ready" || isWatch(r) || isWebSocketLookup(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		release, err := limiter.Acquire(r.Context())
+		if err != nil {
+			if errors.Is(err, limit.ErrLimited) {
+				retryAfter := limiter.RetryAfter()
+				logger(r.Context()).Warnw("Rejecting request due to concurrency limit", "method", r.Method, "path", r.URL.Path, "retryAfter", retryAfter)
+				if s.metrics != nil {
+					s.metrics.RecordHttpShed(context.Background(), r.Method, pathLabel(r.URL.Path), "concurrency")
+				}
+				writeOverloaded(w, err.Error(), retryAfter)
+			}
+			// Otherwise, the client is gone.
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeOverloaded responds to a request that is shed due to load with 503
+// Service Unavailable, and the duration after which to retry both as the
+// Retry-After header and in the error details. The duration is rounded up to
+// whole seconds, and is at least a second so that clients never retry
+// immediately.
+func writeOverloaded(w http.ResponseWriter, message string, retryAfter time.Duration) {
+	seconds := max(int((retryAfter+time.Second-1)/time.Second), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	dhstore.ErrorResponse{
+		Code:    dhstore.ErrorCodeOverloaded,
+		Message: message,
+		Details: map[string]any{"retryAfterSeconds": seconds},
+	}.Write(w, http.StatusServiceUnavailable)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+	"github.com/multiformats/go-multihash"
+)
+
+// missCacheMaxEntries bounds the number of multihashes remembered by a
+// missCache, so that lookups of many distinct unindexed multihashes cannot
+// grow it without bound.
+const missCacheMaxEntries = 1 << 16
+
+// missCache remembers the multihashes that recently resolved to no results via
+// dhfind, so that repeated lookups of a popular multihash that is not indexed
+// are answered without looking it up in the store and fetching provider
+// information again.
+type missCache struct {
+	clock clock.Clock
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func newMissCache(c clock.Clock, ttl time.Duration) *missCache {
+	return &missCache{
+		clock:   c,
+		ttl:     ttl,
+		expires: make(map[string]time.Time),
+	}
+}
+
+// has reports whether the given multihash resolved to no results within the
+// TTL of the cache.
+func (c *missCache) has(mh multihash.Multihash) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.expires[string(mh)]
+	if !ok {
+		return false
+	}
+	if !c.clock.Now().Before(expires) {
+		delete(c.expires, string(mh))
+		return false
+	}
+	return true
+}
+
+// add remembers that the given multihash resolved to no results. Once the
+// cache is full of unexpired entries, misses are no longer remembered until
+// some expire.
+func (c *missCache) add(mh multihash.Multihash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.clock.Now()
+	if len(c.expires) >= missCacheMaxEntries {
+		for k, expires := range c.expires {
+			if !now.Before(expires) {
+				delete(c.expires, k)
+			}
+		}
+		if len(c.expires) >= missCacheMaxEntries {
+			return
+		}
+	}
+	c.expires[string(mh)] = now.Add(c.ttl)
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"github.com/ipni/dhstore"
 	"github.com/ipni/go-libipni/find/model"
+	"github.com/multiformats/go-multihash"
 )
 
 type (
@@ -12,6 +13,14 @@ type (
 	PutMetadataRequest struct {
 		Key   dhstore.HashedValueKey    `json:"key"`
 		Value dhstore.EncryptedMetadata `json:"value"`
+		// Metadata optionally puts many records at once, in which case Key and
+		// Value are ignored.
+		Metadata []dhstore.Metadata `json:"metadata,omitempty"`
+	}
+	// DeleteMetadataRequest deletes the metadata of many hashed value keys at
+	// once.
+	DeleteMetadataRequest struct {
+		Keys []dhstore.HashedValueKey `json:"keys"`
 	}
 	LookupResponse struct {
 		EncryptedMultihashResults []model.EncryptedMultihashResult `json:"EncryptedMultihashResults"`
@@ -22,4 +31,45 @@ type (
 	EncryptedValueKeyResult struct {
 		EncryptedValueKey dhstore.EncryptedValueKey `json:"EncryptedValueKey"`
 	}
+	// StreamBatchResult is the result of a batch of merges applied by a
+	// streamed ingest, written as a line of the response.
+	StreamBatchResult struct {
+		// Batch is the sequence number of the batch, starting at 1.
+		Batch int `json:"batch"`
+		// Merged is the number of merges applied by the batch.
+		Merged int `json:"merged"`
+		// Applied is the total number of merges applied by the stream so far.
+		Applied int `json:"applied"`
+		// Error is set when the batch failed, in which case no further
+		// batches are applied.
+		Error string `json:"error,omitempty"`
+	}
+	// ImportResponse summarises the records loaded by a bulk import.
+	ImportResponse struct {
+		// Records is the number of imported records.
+		Records int64 `json:"records"`
+		// Batches is the number of batches the records were imported in.
+		Batches int64 `json:"batches"`
+		// Throttled is the time spent backing off due to write pressure.
+		Throttled string `json:"throttled"`
+	}
+	// WebSocketLookupRequest is a message sent over a WebSocket lookup
+	// connection to look up the encrypted value keys of a multihash.
+	WebSocketLookupRequest struct {
+		// ID is optionally set by the client to correlate the result with the
+		// request, since results are sent as lookups complete.
+		ID        string              `json:"id,omitempty"`
+		Multihash multihash.Multihash `json:"multihash"`
+	}
+	// WebSocketLookupResult is a message sent over a WebSocket lookup
+	// connection with the result of a lookup.
+	WebSocketLookupResult struct {
+		ID                 string                      `json:"id,omitempty"`
+		Multihash          multihash.Multihash         `json:"multihash,omitempty"`
+		EncryptedValueKeys []dhstore.EncryptedValueKey `json:"encryptedValueKeys,omitempty"`
+		// Status is the HTTP status with which the equivalent GET lookup
+		// would have been responded to, e.g. 404 when no keys are found.
+		Status int    `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
 )
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mr-tron/base58"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+)
+
+// normalizeMultihashPath rewrites a multibase encoded multihash in the path of
+// the given lookup request, e.g. base32, base36 or base64url as derived from
+// CIDv1 strings, to base58btc, which is understood by the response writer.
+// Multihashes that decode as raw base58btc or hex are left as is, since their
+// first character may coincide with a multibase prefix.
+func normalizeMultihashPath(r *http.Request) *http.Request {
+	dir, segment := path.Split(r.URL.Path)
+	if path.Base(dir) != "multihash" {
+		return r
+	}
+	segment = strings.TrimSpace(segment)
+	if isMultihash(base58.Decode(segment)) || isMultihash(hex.DecodeString(segment)) {
+		return r
+	}
+	_, b, err := multibase.Decode(segment)
+	if !isMultihash(b, err) {
+		// Leave the error to the response writer.
+		return r
+	}
+	r = r.Clone(r.Context())
+	r.URL.Path = dir + base58.Encode(b)
+	r.URL.RawPath = ""
+	return r
+}
+
+// isMultihash reports whether the given decoded bytes are a valid multihash.
+func isMultihash(b []byte, err error) bool {
+	if err != nil {
+		return false
+	}
+	_, err = multihash.Decode(b)
+	return err == nil
+}
@@ -0,0 +1,13 @@
+//go:build !http3
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+)
+
+func newHTTP3Listener(string, http.Handler, *tls.Config) (http3Listener, error) {
+	return nil, errors.New("dhstore built without http3 support")
+}
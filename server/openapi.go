@@ -0,0 +1,647 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ipni/dhstore"
+)
+
+// mediaTypeNDJSON is the media type of streamed lookup responses.
+const mediaTypeNDJSON = "application/x-ndjson"
+
+// schema is the subset of the OpenAPI 3 schema object used to describe and
+// validate the API. Schemas are inlined rather than referenced, so that they
+// can be validated without resolving references.
+type schema struct {
+	Description string             `json:"description,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Pattern     string             `json:"pattern,omitempty"`
+	Properties  map[string]*schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *schema            `json:"items,omitempty"`
+	MinItems    int                `json:"minItems,omitempty"`
+	Minimum     int                `json:"minimum,omitempty"`
+	AnyOf       []*schema          `json:"anyOf,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// operation describes a single method of an API path.
+type operation struct {
+	method    string
+	path      string
+	id        string
+	summary   string
+	pathParam *parameter
+	// queryParams are only documented, and validated by the handlers.
+	queryParams []*parameter
+	requestBody *schema
+	// streamed is set when the request body is an NDJSON stream of
+	// requestBody records, which is only documented and not validated, since
+	// validation would buffer the stream.
+	streamed bool
+	// requestMediaType optionally overrides the media type of a streamed
+	// requestBody.
+	requestMediaType string
+	responses        map[int]response
+
+	pathRegexp *regexp.Regexp
+}
+
+type parameter struct {
+	name        string
+	description string
+	schema      *schema
+	// invalidCode is the error code of requests with an invalid value of the
+	// parameter, which defaults to dhstore.ErrorCodeBadRequest.
+	invalidCode string
+}
+
+type response struct {
+	description string
+	// content maps media types to the schema of the response body.
+	content map[string]*schema
+	// headers maps response headers to their description.
+	headers map[string]string
+}
+
+var (
+	bytesSchema = &schema{Type: "string", Format: "byte", Description: "Base64 encoded bytes."}
+	base58Param = patternSchema("^[1-9A-HJ-NP-Za-km-z]+$")
+
+	filterProtocolQueryParam = &parameter{name: filterProtocolParam, description: "A comma separated list of transport protocols, e.g. transport-bitswap, or unknown, to which the results of lookups via dhfind are restricted. Not applied to encrypted value keys.", schema: &schema{Type: "string"}}
+
+	errorResponseSchema = &schema{
+		Type:     "object",
+		Required: []string{"code", "message"},
+		Properties: map[string]*schema{
+			"code":    {Type: "string", Description: "The stable code of the error, e.g. bad_multihash, unsupported_codec, overloaded or not_found."},
+			"message": {Type: "string", Description: "The human readable description of the error."},
+			"details": {Type: "object", Description: "Optional details specific to the error."},
+		},
+	}
+
+	indexSchema = &schema{
+		Type: "object",
+		Properties: map[string]*schema{
+			"key":   {Type: "string", Format: "byte", Description: "The base64 encoded multihash."},
+			"value": {Type: "string", Format: "byte", Description: "The base64 encoded encrypted value key."},
+		},
+		Required: []string{"key", "value"},
+	}
+	mergeIndexRequestSchema = &schema{
+		Type: "object",
+		Properties: map[string]*schema{
+			"merges": {Type: "array", Items: indexSchema, MinItems: 1},
+		},
+		Required: []string{"merges"},
+	}
+	metadataSchema = &schema{
+		Type: "object",
+		Properties: map[string]*schema{
+			"key":   {Type: "string", Format: "byte", Description: "The base64 encoded hashed value key."},
+			"value": {Type: "string", Format: "byte", Description: "The base64 encoded encrypted metadata."},
+		},
+		Required: []string{"key", "value"},
+	}
+	putMetadataRequestSchema = &schema{
+		Description: "Either a single key and value, or a batch of metadata records.",
+		Type:        "object",
+		Properties: map[string]*schema{
+			"key":      metadataSchema.Properties["key"],
+			"value":    metadataSchema.Properties["value"],
+			"metadata": {Type: "array", Items: metadataSchema},
+		},
+		AnyOf: []*schema{
+			{Type: "object", Required: []string{"key", "value"}},
+			{Type: "object", Required: []string{"metadata"}},
+		},
+	}
+	deleteMetadataRequestSchema = &schema{
+		Type: "object",
+		Properties: map[string]*schema{
+			"keys": {Type: "array", Items: &schema{Type: "string", Format: "byte", Description: "The base64 encoded hashed value key."}, MinItems: 1},
+		},
+		Required: []string{"keys"},
+	}
+	lookupResponseSchema = &schema{
+		Type: "object",
+		Properties: map[string]*schema{
+			"EncryptedMultihashResults": {
+				Type: "array",
+				Items: &schema{
+					Type: "object",
+					Properties: map[string]*schema{
+						"Multihash":          bytesSchema,
+						"EncryptedValueKeys": {Type: "array", Items: bytesSchema},
+					},
+				},
+			},
+		},
+	}
+	getMetadataResponseSchema = &schema{
+		Type: "object",
+		Properties: map[string]*schema{
+			"EncryptedMetadata": bytesSchema,
+		},
+	}
+)
+
+// apiOperations describes the multihash and metadata endpoints, from which
+// both the OpenAPI document and request validation are derived.
+var apiOperations = func() []*operation {
+	lookup := func(path, id, summary string, param *parameter) *operation {
+		return &operation{
+			method:    http.MethodGet,
+			path:      path,
+			id:        id,
+			summary:   summary,
+			pathParam: param,
+			queryParams: []*parameter{
+				{name: "limit", description: "The maximum number of encrypted value keys to return, in which case keys are sorted by their bytes.", schema: &schema{Type: "integer", Minimum: 1}},
+				{name: "cursor", description: "The cursor of the page to return, as returned in the X-Next-Cursor header of the previous page.", schema: &schema{Type: "string"}},
+				{name: "watch", description: "Whether to keep streaming encrypted value keys as NDJSON or events as they are merged, if enabled. Only supported by encrypted lookups.", schema: &schema{Type: "boolean"}},
+				filterProtocolQueryParam,
+			},
+			responses: map[int]response{
+				http.StatusOK: {
+					description: "The encrypted value keys of the multihash.",
+					headers:     map[string]string{nextCursorHeader: "The cursor of the next page, absent on the last page."},
+					content: map[string]*schema{
+						"application/json":   lookupResponseSchema,
+						mediaTypeNDJSON:      {Type: "object", Description: "One EncryptedMultihashResult per line."},
+						mediaTypeEventStream: {Type: "string", Description: "One EncryptedMultihashResult per event, followed by an end event carrying the count of results."},
+						mediaTypeProtobuf:    {Type: "string", Format: "binary"},
+					},
+				},
+				http.StatusBadRequest: {description: "The multihash or CID cannot be decoded."},
+				http.StatusNotFound:   {description: "No records were found."},
+			},
+		}
+	}
+	probe := func(path, id, summary string, param *parameter) *operation {
+		return &operation{
+			method:    http.MethodHead,
+			path:      path,
+			id:        id,
+			summary:   summary,
+			pathParam: param,
+			responses: map[int]response{
+				http.StatusOK:         {description: "Records were found.", headers: map[string]string{resultCountHeader: "The number of results."}},
+				http.StatusBadRequest: {description: "The multihash or CID cannot be decoded."},
+				http.StatusNotFound:   {description: "No records were found.", headers: map[string]string{resultCountHeader: "Zero."}},
+			},
+		}
+	}
+	mhParam := &parameter{name: "multihash", description: "The base58 encoded multihash, or the multihash encoded as multibase, e.g. base32, base36 or base64url.", schema: patternSchema("^[0-9A-Za-z_=-]+$"), invalidCode: dhstore.ErrorCodeBadMultihash}
+	cidParam := &parameter{name: "cid", description: "The CID whose multihash to look up.", schema: &schema{Type: "string"}, invalidCode: dhstore.ErrorCodeBadMultihash}
+	hvkParam := &parameter{name: "key", description: "The base58 encoded hashed value key.", schema: base58Param, invalidCode: dhstore.ErrorCodeBadKey}
+	writeResponses := map[int]response{
+		http.StatusAccepted:   {description: "The write was applied."},
+		http.StatusBadRequest: {description: "The request body is invalid."},
+		http.StatusForbidden:  {description: "The store is read-only."},
+	}
+
+	var ops []*operation
+	for _, prefix := range []string{"", "/encrypted"} {
+		ops = append(ops,
+			&operation{
+				method:      http.MethodPut,
+				path:        prefix + "/multihash",
+				id:          "put" + operationIDSuffix(prefix, "Multihashes"),
+				summary:     "Merges encrypted value keys into the records of multihashes.",
+				requestBody: mergeIndexRequestSchema,
+				responses:   writeResponses,
+			},
+			&operation{
+				method:      http.MethodDelete,
+				path:        prefix + "/multihash",
+				id:          "delete" + operationIDSuffix(prefix, "Multihashes"),
+				summary:     "Deletes encrypted value keys from the records of multihashes.",
+				requestBody: mergeIndexRequestSchema,
+				responses:   writeResponses,
+			},
+			lookup(prefix+"/multihash/{multihash}", "lookup"+operationIDSuffix(prefix, "Multihash"), "Looks up the encrypted value keys of a multihash.", mhParam),
+			lookup(prefix+"/cid/{cid}", "lookup"+operationIDSuffix(prefix, "CID"), "Looks up the encrypted value keys of the multihash of a CID.", cidParam),
+			probe(prefix+"/multihash/{multihash}", "probe"+operationIDSuffix(prefix, "Multihash"), "Counts the results of a multihash lookup without returning them.", mhParam),
+			probe(prefix+"/cid/{cid}", "probe"+operationIDSuffix(prefix, "CID"), "Counts the results of a CID lookup without returning them.", cidParam),
+		)
+	}
+	ops = append(ops,
+		&operation{
+			method:      http.MethodGet,
+			path:        routingProvidersPath + "{cid}",
+			id:          "routingProviders",
+			summary:     "Looks up the providers of a CID via dhfind, as specified by Delegated Routing V1.",
+			pathParam:   cidParam,
+			queryParams: []*parameter{filterProtocolQueryParam},
+			responses: map[int]response{
+				http.StatusOK: {
+					description: "The peer schema records of the providers.",
+					content: map[string]*schema{
+						"application/json": {Type: "object", Properties: map[string]*schema{"Providers": {Type: "array", Items: &schema{Type: "object"}}}},
+						mediaTypeNDJSON:    {Type: "object", Description: "One peer schema record per line."},
+					},
+				},
+				http.StatusBadRequest:     {description: "The CID cannot be decoded, or is of a double hashed multihash."},
+				http.StatusNotFound:       {description: "No providers were found."},
+				http.StatusNotImplemented: {description: "dhfind is not enabled."},
+			},
+		},
+		&operation{
+			method:  http.MethodPost,
+			path:    batchFindPath,
+			id:      "findMultihashBatch",
+			summary: "Looks up the providers of a batch of multihashes and CIDs via dhfind, streaming the results of each multihash as it is resolved.",
+			requestBody: &schema{
+				Type: "object",
+				Properties: map[string]*schema{
+					"Multihashes": {Type: "array", Items: &schema{Type: "string", Format: "byte", Description: "The base64 encoded multihash."}},
+					"CIDs":        {Type: "array", Items: &schema{Type: "string", Description: "The CID whose multihash to look up."}},
+				},
+			},
+			queryParams: []*parameter{filterProtocolQueryParam},
+			responses: map[int]response{
+				http.StatusOK: {
+					description: "The provider results of the multihashes with results, in no particular order.",
+					content:     map[string]*schema{mediaTypeNDJSON: {Type: "object", Description: "One MultihashResult per line."}},
+				},
+				http.StatusBadRequest:     {description: "A multihash or CID cannot be decoded, or there are none or too many."},
+				http.StatusNotImplemented: {description: "dhfind is not enabled."},
+			},
+		},
+		&operation{
+			method:  http.MethodGet,
+			path:    providersPath,
+			id:      "listProviders",
+			summary: "Lists the information of all providers, as served by the providers URLs of dhfind.",
+			responses: map[int]response{
+				http.StatusOK:             {description: "The information of the providers.", content: map[string]*schema{"application/json": {Type: "array", Items: &schema{Type: "object"}}}},
+				http.StatusNotImplemented: {description: "dhfind is not enabled."},
+			},
+		},
+		&operation{
+			method:    http.MethodGet,
+			path:      providersPath + "/{peerid}",
+			id:        "getProvider",
+			summary:   "Gets the information of a provider, as served by the providers URLs of dhfind.",
+			pathParam: &parameter{name: "peerid", description: "The peer ID of the provider.", schema: &schema{Type: "string"}},
+			responses: map[int]response{
+				http.StatusOK:             {description: "The information of the provider.", content: map[string]*schema{"application/json": {Type: "object"}}},
+				http.StatusBadRequest:     {description: "The peer ID cannot be decoded."},
+				http.StatusNotFound:       {description: "The provider is not known."},
+				http.StatusNotImplemented: {description: "dhfind is not enabled."},
+			},
+		},
+		&operation{
+			method:      http.MethodPost,
+			path:        "/multihash/stream",
+			id:          "streamMultihashes",
+			summary:     "Merges an NDJSON stream of encrypted value keys into the records of multihashes, in batches as they arrive.",
+			requestBody: indexSchema,
+			streamed:    true,
+			responses: map[int]response{
+				http.StatusOK: {
+					description: "The result of each applied batch, up to the first batch that failed.",
+					content: map[string]*schema{mediaTypeNDJSON: {
+						Type: "object",
+						Properties: map[string]*schema{
+							"batch":   {Type: "integer"},
+							"merged":  {Type: "integer"},
+							"applied": {Type: "integer"},
+							"error":   {Type: "string"},
+						},
+					}},
+				},
+				http.StatusServiceUnavailable: {description: "The store is near its stop-writes threshold."},
+			},
+		},
+		&operation{
+			method:           http.MethodPost,
+			path:             batchLookupPath,
+			id:               "lookupEncryptedMultihashBatch",
+			summary:          "Looks up the encrypted value keys of a list of multihashes, streaming results as the list is read.",
+			requestBody:      &schema{Type: "string", Format: "binary", Description: "Concatenated multihashes, each prefixed by its length as an unsigned varint."},
+			streamed:         true,
+			requestMediaType: mediaTypeOctetStream,
+			responses: map[int]response{
+				http.StatusOK: {
+					description: "The encrypted value keys of the found multihashes, truncated if a malformed multihash is read after the first result.",
+					content:     map[string]*schema{mediaTypeNDJSON: {Type: "object", Description: "One EncryptedMultihashResult per line."}},
+				},
+				http.StatusBadRequest: {description: "A multihash cannot be decoded."},
+			},
+		},
+		&operation{
+			method:      http.MethodPut,
+			path:        "/metadata",
+			id:          "putMetadata",
+			summary:     "Puts encrypted metadata.",
+			requestBody: putMetadataRequestSchema,
+			responses:   writeResponses,
+		},
+		&operation{
+			method:      http.MethodDelete,
+			path:        "/metadata",
+			id:          "deleteMetadataBatch",
+			summary:     "Deletes the encrypted metadata of many hashed value keys.",
+			requestBody: deleteMetadataRequestSchema,
+			responses:   writeResponses,
+		},
+		&operation{
+			method:    http.MethodGet,
+			path:      "/metadata/{key}",
+			id:        "getMetadata",
+			summary:   "Gets the encrypted metadata of a hashed value key.",
+			pathParam: hvkParam,
+			responses: map[int]response{
+				http.StatusOK:         {description: "The encrypted metadata.", content: map[string]*schema{"application/json": getMetadataResponseSchema}},
+				http.StatusBadRequest: {description: "The key cannot be decoded."},
+				http.StatusNotFound:   {description: "No metadata was found."},
+			},
+		},
+		&operation{
+			method:    http.MethodDelete,
+			path:      "/metadata/{key}",
+			id:        "deleteMetadata",
+			summary:   "Deletes the encrypted metadata of a hashed value key.",
+			pathParam: hvkParam,
+			responses: map[int]response{
+				http.StatusOK:         {description: "The metadata was deleted."},
+				http.StatusBadRequest: {description: "The key cannot be decoded."},
+				http.StatusForbidden:  {description: "The store is read-only."},
+			},
+		},
+		&operation{
+			method:  http.MethodGet,
+			path:    "/ready",
+			id:      "ready",
+			summary: "Reports whether the server is ready to serve requests.",
+			responses: map[int]response{
+				http.StatusOK:                 {description: "The server is ready, with its version, build information and store format as body."},
+				http.StatusServiceUnavailable: {description: "The server is not ready, e.g. the store is unavailable or the server is shutting down."},
+			},
+		},
+	)
+	for _, op := range ops {
+		template := regexp.QuoteMeta(op.path)
+		if op.pathParam != nil {
+			template = strings.Replace(template, regexp.QuoteMeta("{"+op.pathParam.name+"}"), "([^/]+)", 1)
+		}
+		op.pathRegexp = regexp.MustCompile("^" + template + "$")
+	}
+	return ops
+}()
+
+// patternSchema returns a string schema matching the given pattern.
+func patternSchema(pattern string) *schema {
+	return &schema{Type: "string", Pattern: pattern, pattern: regexp.MustCompile(pattern)}
+}
+
+// isUnencryptedLookup reports whether the given operation path is that of an
+// unencrypted lookup, or of the providers served alongside them via dhfind.
+func isUnencryptedLookup(path string) bool {
+	return strings.HasPrefix(path, "/multihash/{") || path == batchFindPath || strings.HasPrefix(path, "/cid/") || strings.HasPrefix(path, routingProvidersPath) ||
+		strings.HasPrefix(path, providersPath)
+}
+
+func operationIDSuffix(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return "Encrypted" + name
+}
+
+// openAPIDocument generates the OpenAPI 3 document describing apiOperations.
+// Unencrypted lookups are omitted unless enabled.
+func openAPIDocument(unencryptedLookups bool) ([]byte, error) {
+	paths := make(map[string]map[string]any)
+	for _, op := range apiOperations {
+		if !unencryptedLookups && isUnencryptedLookup(op.path) {
+			continue
+		}
+		o := map[string]any{
+			"operationId": op.id,
+			"summary":     op.summary,
+		}
+		var params []map[string]any
+		if op.pathParam != nil {
+			params = append(params, map[string]any{
+				"name":        op.pathParam.name,
+				"in":          "path",
+				"required":    true,
+				"description": op.pathParam.description,
+				"schema":      op.pathParam.schema,
+			})
+		}
+		for _, p := range op.queryParams {
+			params = append(params, map[string]any{
+				"name":        p.name,
+				"in":          "query",
+				"description": p.description,
+				"schema":      p.schema,
+			})
+		}
+		if len(params) != 0 {
+			o["parameters"] = params
+		}
+		if op.requestBody != nil {
+			mediaType := "application/json"
+			if op.streamed {
+				mediaType = mediaTypeNDJSON
+				if op.requestMediaType != "" {
+					mediaType = op.requestMediaType
+				}
+			}
+			o["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{mediaType: map[string]any{"schema": op.requestBody}},
+			}
+		}
+		responses := make(map[string]any, len(op.responses))
+		for status, rsp := range op.responses {
+			r := map[string]any{"description": rsp.description}
+			if status >= 400 && op.method != http.MethodHead {
+				// Errors are described by ErrorResponse, whereas responses to
+				// HEAD requests have no body.
+				r["content"] = map[string]any{"application/json": map[string]any{"schema": errorResponseSchema}}
+			} else if len(rsp.content) != 0 {
+				content := make(map[string]any, len(rsp.content))
+				for mediaType, s := range rsp.content {
+					content[mediaType] = map[string]any{"schema": s}
+				}
+				r["content"] = content
+			}
+			if len(rsp.headers) != 0 {
+				headers := make(map[string]any, len(rsp.headers))
+				for name, description := range rsp.headers {
+					headers[name] = map[string]any{"description": description, "schema": map[string]string{"type": "string"}}
+				}
+				r["headers"] = headers
+			}
+			responses[fmt.Sprint(status)] = r
+		}
+		o["responses"] = responses
+		if paths[op.path] == nil {
+			paths[op.path] = make(map[string]any)
+		}
+		paths[op.path][strings.ToLower(op.method)] = o
+	}
+	return json.MarshalIndent(map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "dhstore",
+			"version": dhstore.Version,
+			"description": "Stores encrypted multihash records and metadata of double hashed lookups. " +
+				"See https://github.com/ipni/specs/blob/main/IPNI_HTTP_DH_PROVIDER.md",
+		},
+		"paths": paths,
+	}, "", "  ")
+}
+
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet)
+		w.Header().Add("Allow", http.MethodHead)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(s.openAPI)
+}
+
+// validateRequests rejects requests to documented operations with 400 Bad
+// Request unless their path parameters and body conform to the OpenAPI
+// document. Requests to undocumented paths and methods are let through, so
+// that they are handled as before.
+func validateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, pathValue := findOperation(r)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if op.pathParam != nil {
+			if err := op.pathParam.schema.validate(pathValue); err != nil {
+				code := op.pathParam.invalidCode
+				if code == "" {
+					code = dhstore.ErrorCodeBadRequest
+				}
+				dhstore.ErrorResponse{
+					Code:    code,
+					Message: fmt.Sprintf("invalid path parameter %s: %s", op.pathParam.name, err),
+				}.Write(w, http.StatusBadRequest)
+				return
+			}
+		}
+		if op.requestBody != nil && !op.streamed {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				dhstore.HTTPError(w, "", http.StatusBadRequest)
+				return
+			}
+			var v any
+			if err := json.Unmarshal(body, &v); err != nil {
+				dhstore.HTTPError(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+				return
+			}
+			if err := op.requestBody.validate(v); err != nil {
+				dhstore.HTTPError(w, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// findOperation returns the operation matching the given request, along with
+// the value of its path parameter, if any.
+func findOperation(r *http.Request) (*operation, string) {
+	for _, op := range apiOperations {
+		if op.method != r.Method {
+			continue
+		}
+		if m := op.pathRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+			if len(m) > 1 {
+				return op, m[1]
+			}
+			return op, ""
+		}
+	}
+	return nil, ""
+}
+
+// validate checks that the given value, as decoded by encoding/json, conforms
+// to the schema.
+func (s *schema) validate(v any) error {
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("expected object")
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if pv, ok := obj[name]; ok {
+				if err := s.Properties[name].validate(pv); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("expected array")
+		}
+		if len(arr) < s.MinItems {
+			return fmt.Errorf("expected at least %d items", s.MinItems)
+		}
+		for i, item := range arr {
+			if err := s.Items.validate(item); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected string")
+		}
+		if s.Format == "byte" {
+			if _, err := base64.StdEncoding.DecodeString(str); err != nil {
+				return fmt.Errorf("expected base64 encoded bytes")
+			}
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return fmt.Errorf("does not match pattern %s", s.Pattern)
+		}
+	}
+	if len(s.AnyOf) != 0 {
+		var err error
+		for _, alt := range s.AnyOf {
+			if err = alt.validate(v); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+	return nil
+}
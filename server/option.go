@@ -1,16 +1,92 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"net/http"
+	"time"
 
+	"github.com/ipni/dhstore/audit"
+	"github.com/ipni/dhstore/auth"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/limit"
 	"github.com/ipni/dhstore/metrics"
+	"github.com/ipni/dhstore/providers"
+	"github.com/ipni/dhstore/prune"
+	"github.com/ipni/dhstore/throttle"
+	"github.com/ipni/dhstore/watch"
+)
+
+const (
+	defaultProvidersCheckInterval = 10 * time.Second
+	defaultDHFindParallelism      = 1
 )
 
 // config contains all options for the server.
 type config struct {
-	metrics       *metrics.Metrics
-	providersURLs []string
-	preferJSON    bool
+	metrics    *metrics.Metrics
+	preferJSON bool
+	clock      clock.Clock
+
+	defaultAccept       string
+	ndjsonFlushInterval time.Duration
+	maxValueKeySize     int
+
+	providers              []providers.Endpoint
+	providersCheckInterval time.Duration
+	dhfindMissTTL          time.Duration
+	providerCacheMaxAge    time.Duration
+	dhfindTimeout          time.Duration
+	dhfindParallelism      int
+	dhfindMaxValueKeys     int
+	breakerFailures        int
+	noExtendedProviders    bool
+	breakerCooldown        time.Duration
+	httpClient             *http.Client
+	dhfindTransport        dhfindTransport
+
+	provenanceHeader      string
+	provenanceSampleEvery int
+
+	auditLog *audit.Log
+
+	pruner      *prune.Pruner
+	maintenance *throttle.Throttle
+
+	writePressureThreshold float64
+	writeRetryAfter        time.Duration
+
+	tlsConfig      *tls.Config
+	writeClientCAs *x509.CertPool
+
+	tokens      *auth.Tokens
+	authorizers []auth.Authorizer
+
+	limiter *limit.Limiter
+
+	writeListenAddr string
+
+	readOnly func() bool
+
+	validateRequests bool
+
+	strictMerges *strictMerges
+
+	http3ListenAddr string
+
+	lookupPageLimit int
+
+	encryptedLookupsOnly bool
+
+	legacyFindAPI bool
+
+	watchHub *watch.Hub
+
+	maxWebSockets int
+
+	middlewares []func(http.Handler) http.Handler
 }
 
 // Option is a function that sets a value in a config.
@@ -19,7 +95,10 @@ type Option func(*config) error
 // getOpts creates a config and applies Options to it.
 func getOpts(opts []Option) (config, error) {
 	cfg := config{
-		preferJSON: true,
+		preferJSON:             true,
+		clock:                  clock.New(),
+		providersCheckInterval: defaultProvidersCheckInterval,
+		dhfindParallelism:      defaultDHFindParallelism,
 	}
 	for i, opt := range opts {
 		if err := opt(&cfg); err != nil {
@@ -37,10 +116,209 @@ func WithMetrics(m *metrics.Metrics) Option {
 	}
 }
 
-// WithDHFind enables dhfind functionality.
+// WithDHFind enables dhfind functionality, fetching provider information from
+// the given providers URLs. The URLs are replicas serving the same providers,
+// among which requests are spread by weight and failed over when one is down.
+// A URL may be followed by ";weight=" and its weight, which defaults to 1. See
+// providers.ParseEndpoint.
 func WithDHFind(providersURLs ...string) Option {
 	return func(c *config) error {
-		c.providersURLs = append(c.providersURLs, providersURLs...)
+		eps, err := providers.ParseEndpoints(providersURLs)
+		if err != nil {
+			return err
+		}
+		c.providers = append(c.providers, eps...)
+		return nil
+	}
+}
+
+// WithProvidersCheckInterval sets the interval at which the health of dhfind
+// providers URLs is checked via their /health endpoint. Zero disables health
+// checks, in which case providers URLs are only considered down when requests
+// to them fail. Defaults to 10 seconds.
+func WithProvidersCheckInterval(interval time.Duration) Option {
+	return func(c *config) error {
+		if interval < 0 {
+			return fmt.Errorf("providers check interval cannot be negative, got: %s", interval)
+		}
+		c.providersCheckInterval = interval
+		return nil
+	}
+}
+
+// WithExtendedProviders sets whether dhfind lookups return a result for each
+// extended provider of a provider, i.e. the additional peers and protocols by
+// which its content is retrievable, along with the result of the provider
+// itself, as full IPNI find endpoints do. Defaults to true.
+func WithExtendedProviders(on bool) Option {
+	return func(c *config) error {
+		c.noExtendedProviders = !on
+		return nil
+	}
+}
+
+// WithProvidersCircuitBreaker fails dhfind lookups fast with 503 for the given
+// cooldown once the given number of consecutive requests for provider
+// information failed on all providers URLs, rather than having each lookup
+// wait for providers URLs that are all down. Encrypted lookups are served
+// meanwhile. Zero failures disables the breaker, which is the default.
+func WithProvidersCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(c *config) error {
+		if failures < 0 {
+			return fmt.Errorf("providers circuit breaker failures cannot be negative, got: %d", failures)
+		}
+		if failures > 0 && cooldown <= 0 {
+			return fmt.Errorf("providers circuit breaker cooldown must be positive, got: %s", cooldown)
+		}
+		c.breakerFailures = failures
+		c.breakerCooldown = cooldown
+		return nil
+	}
+}
+
+// WithDHFindMissTTL enables caching the multihashes that resolve to no results
+// via dhfind for the given TTL, so that repeated lookups of a popular
+// multihash that is not indexed neither hit the store nor the providers URLs.
+// Multihashes indexed meanwhile are only found once the TTL elapses. Zero
+// disables the cache, which is the default.
+func WithDHFindMissTTL(ttl time.Duration) Option {
+	return func(c *config) error {
+		if ttl < 0 {
+			return fmt.Errorf("dhfind miss TTL cannot be negative, got: %s", ttl)
+		}
+		c.dhfindMissTTL = ttl
+		return nil
+	}
+}
+
+// WithPersistentProviderCache persists the provider cache of dhfind in the
+// store, so that a restarted server does not begin with a cold cache. On
+// start, the cache is loaded from the store instead of the providers URLs if
+// the persisted information is at most maxAge old. The persisted information
+// is also served while all providers URLs fail, regardless of its age.
+//
+// The provider cache is only persisted if the store implements
+// dhstore.ProviderInfoStore. Zero disables persistence, which is the default.
+func WithPersistentProviderCache(maxAge time.Duration) Option {
+	return func(c *config) error {
+		if maxAge < 0 {
+			return fmt.Errorf("persistent provider cache max age cannot be negative, got: %s", maxAge)
+		}
+		c.providerCacheMaxAge = maxAge
+		return nil
+	}
+}
+
+// WithDHFindTimeout bounds the duration of each lookup via dhfind, including
+// fetching metadata and provider information. Lookups that time out respond
+// with the results found until then, or with 504 Gateway Timeout if there are
+// none. Zero disables the timeout, which is the default.
+func WithDHFindTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout < 0 {
+			return fmt.Errorf("dhfind timeout cannot be negative, got: %s", timeout)
+		}
+		c.dhfindTimeout = timeout
+		return nil
+	}
+}
+
+// WithDHFindParallelism sets the number of value keys whose metadata and
+// provider information are fetched concurrently by each lookup via dhfind.
+// Results are returned in no particular order when greater than 1. Defaults to
+// 1.
+func WithDHFindParallelism(n int) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return fmt.Errorf("dhfind parallelism must be at least 1, got: %d", n)
+		}
+		c.dhfindParallelism = n
+		return nil
+	}
+}
+
+// WithDHFindMaxValueKeys bounds the number of value keys decrypted by each
+// lookup via dhfind, beyond which the value keys of a multihash are ignored.
+// Zero disables the bound, which is the default.
+func WithDHFindMaxValueKeys(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("dhfind max value keys cannot be negative, got: %d", n)
+		}
+		c.dhfindMaxValueKeys = n
+		return nil
+	}
+}
+
+// WithHTTPClient sets the HTTP client with which dhfind fetches provider
+// information. Requests are sent via a copy of the client whose transport is
+// wrapped in RequestIDTransport, so that they carry the ID of the lookup they
+// are made for. Defaults to a client of http.DefaultTransport.
+//
+// The transport of the client must be an *http.Transport, optionally wrapped in
+// RequestIDTransport, if it is tuned via WithDHFindConnections,
+// WithDHFindTLSSessionCache or WithDHFindTransportTimeouts.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cfg *config) error {
+		if c == nil {
+			return errors.New("http client cannot be nil")
+		}
+		cfg.httpClient = c
+		return nil
+	}
+}
+
+// WithDHFindConnections tunes the connections via which dhfind fetches
+// provider information, so that deployments with many lookups per second
+// reuse connections to the providers URLs rather than churning them. Up to
+// maxIdlePerHost idle connections are kept per providers URL for idleTimeout,
+// and TCP keep-alive probes are sent every keepAlive. Zero keeps the setting
+// of the transport of the HTTP client, which is the default.
+func WithDHFindConnections(maxIdlePerHost int, idleTimeout, keepAlive time.Duration) Option {
+	return func(c *config) error {
+		if maxIdlePerHost < 0 {
+			return fmt.Errorf("dhfind max idle connections per host cannot be negative, got: %d", maxIdlePerHost)
+		}
+		if idleTimeout < 0 {
+			return fmt.Errorf("dhfind idle connection timeout cannot be negative, got: %s", idleTimeout)
+		}
+		if keepAlive < 0 {
+			return fmt.Errorf("dhfind keep-alive cannot be negative, got: %s", keepAlive)
+		}
+		c.dhfindTransport.maxIdleConnsPerHost = maxIdlePerHost
+		c.dhfindTransport.idleConnTimeout = idleTimeout
+		c.dhfindTransport.keepAlive = keepAlive
+		return nil
+	}
+}
+
+// WithDHFindTLSSessionCache caches up to the given number of TLS sessions of
+// the connections via which dhfind fetches provider information, so that new
+// connections to providers URLs resume sessions rather than making full
+// handshakes. Zero keeps the setting of the transport of the HTTP client, which
+// is the default.
+func WithDHFindTLSSessionCache(size int) Option {
+	return func(c *config) error {
+		if size < 0 {
+			return fmt.Errorf("dhfind TLS session cache size cannot be negative, got: %d", size)
+		}
+		c.dhfindTransport.tlsSessionCacheSize = size
+		return nil
+	}
+}
+
+// WithDHFindTransportTimeouts bounds how long dhfind waits to connect to a
+// providers URL, to complete TLS handshakes with it, and for the headers of its
+// responses. Zero keeps the setting of the transport of the HTTP client, which
+// is the default.
+func WithDHFindTransportTimeouts(dial, tlsHandshake, responseHeader time.Duration) Option {
+	return func(c *config) error {
+		if dial < 0 || tlsHandshake < 0 || responseHeader < 0 {
+			return fmt.Errorf("dhfind transport timeouts cannot be negative, got: %s, %s, %s", dial, tlsHandshake, responseHeader)
+		}
+		c.dhfindTransport.dialTimeout = dial
+		c.dhfindTransport.tlsHandshakeTimeout = tlsHandshake
+		c.dhfindTransport.responseHeaderTimeout = responseHeader
 		return nil
 	}
 }
@@ -54,3 +332,379 @@ func WithPreferJSON(on bool) Option {
 		return nil
 	}
 }
+
+// WithDefaultAccept sets the media type of lookup responses to requests
+// without an `Accept` header; one of application/json, application/x-ndjson,
+// application/protobuf or text/event-stream. When empty, which is the default,
+// such requests are responded to with JSON if JSON is preferred, or else
+// rejected with 400 Bad Request. See WithPreferJSON.
+func WithDefaultAccept(mediaType string) Option {
+	return func(c *config) error {
+		switch mediaType {
+		case "", "application/json", mediaTypeNDJSON, mediaTypeProtobuf, mediaTypeEventStream:
+		default:
+			return fmt.Errorf("unsupported default accept media type: %s", mediaType)
+		}
+		c.defaultAccept = mediaType
+		return nil
+	}
+}
+
+// WithNDJSONFlushInterval sets the minimum interval between flushes of NDJSON
+// lookup responses, so that results found in quick succession are written to
+// clients in fewer, larger writes. Each line is flushed as soon as it is
+// written when zero, which is the default. Lines written in between are
+// flushed along with the next line written after the interval, or once the
+// response ends.
+func WithNDJSONFlushInterval(d time.Duration) Option {
+	return func(c *config) error {
+		if d < 0 {
+			return fmt.Errorf("NDJSON flush interval cannot be negative, got: %s", d)
+		}
+		c.ndjsonFlushInterval = d
+		return nil
+	}
+}
+
+// WithMaxValueKeySize rejects merges of encrypted value keys larger than the
+// given number of bytes with 400 Bad Request, regardless of the limits of the
+// store, if any. Sizes are unbounded when zero, which is the default.
+func WithMaxValueKeySize(size int) Option {
+	return func(c *config) error {
+		if size < 0 {
+			return fmt.Errorf("maximum value key size cannot be negative, got: %d", size)
+		}
+		c.maxValueKeySize = size
+		return nil
+	}
+}
+
+// WithClock sets the clock used for all time-dependent behaviour of the
+// server, such as latency measurement. Defaults to the system clock.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) error {
+		if c == nil {
+			return fmt.Errorf("clock must not be nil")
+		}
+		cfg.clock = c
+		return nil
+	}
+}
+
+// WithProvenance enables recording of the writer tag of merged batches, so
+// that operators can trace where data came from. The tag is taken from the
+// given request header, and is recorded once every sampleEvery batches that
+// carry it. A sampleEvery of 1 records every batch.
+//
+// Provenance only covers merges of PUT /multihash requests; batches merged
+// via streamed ingest or imports carry none, and the gRPC server records its
+// own via grpcserver.WithProvenance. New returns an error if the store does
+// not implement dhstore.ProvenanceRecorder. Disabled by default.
+func WithProvenance(header string, sampleEvery int) Option {
+	return func(cfg *config) error {
+		if header == "" {
+			return fmt.Errorf("provenance header must be specified")
+		}
+		if sampleEvery < 1 {
+			return fmt.Errorf("provenance sample rate must be at least 1, got: %d", sampleEvery)
+		}
+		cfg.provenanceHeader = header
+		cfg.provenanceSampleEvery = sampleEvery
+		return nil
+	}
+}
+
+// WithAuditLog records every merge and deletion of indexes, and every put
+// and deletion of metadata, made via the API or by pruning in the given log,
+// along with the identity of the client. Bulk imports are recorded per
+// imported batch. Disabled by default.
+func WithAuditLog(l *audit.Log) Option {
+	return func(cfg *config) error {
+		if l == nil {
+			return errors.New("audit log cannot be nil")
+		}
+		cfg.auditLog = l
+		return nil
+	}
+}
+
+// WithPruner enables pruning of the records of stale providers identified by
+// the given pruner. Records are pruned as they are decrypted by dhfind
+// lookups, and so pruning requires dhfind to be enabled.
+func WithPruner(p *prune.Pruner) Option {
+	return func(cfg *config) error {
+		cfg.pruner = p
+		return nil
+	}
+}
+
+// WithMaintenanceThrottle paces background maintenance, such as pruning the
+// records of stale providers, using the given throttle. The latency of lookups
+// is reported to the throttle, so that maintenance is slowed down or paused
+// when lookups degrade. Unthrottled by default.
+func WithMaintenanceThrottle(t *throttle.Throttle) Option {
+	return func(cfg *config) error {
+		cfg.maintenance = t
+		return nil
+	}
+}
+
+// WithWriteBackpressure rejects PUT /multihash requests with 503 Service
+// Unavailable when the store write pressure reaches the given threshold, i.e.
+// when the store is near its stop-writes threshold. Rejected responses carry
+// a Retry-After header of retryAfter at the threshold, growing linearly to
+// twice retryAfter once writes are stopped.
+//
+// The threshold is a value between 0 and 1, where 1 means writes are stopped.
+// Backpressure is only applied if the store implements
+// dhstore.WritePressureReporter. Disabled by default.
+func WithWriteBackpressure(threshold float64, retryAfter time.Duration) Option {
+	return func(cfg *config) error {
+		if threshold <= 0 || threshold > 1 {
+			return fmt.Errorf("write pressure threshold must be in range (0, 1], got: %f", threshold)
+		}
+		if retryAfter < time.Second {
+			return fmt.Errorf("retry after must be at least one second, got: %s", retryAfter)
+		}
+		cfg.writePressureThreshold = threshold
+		cfg.writeRetryAfter = retryAfter
+		return nil
+	}
+}
+
+// WithTLSConfig serves the API over HTTPS using the given TLS configuration,
+// which must provide a certificate, e.g. via Certificates or GetCertificate.
+// Served over plain HTTP by default.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(cfg *config) error {
+		if tlsConfig == nil {
+			return fmt.Errorf("tls config must not be nil")
+		}
+		if len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil {
+			return fmt.Errorf("tls config must provide a certificate")
+		}
+		cfg.tlsConfig = tlsConfig
+		return nil
+	}
+}
+
+// WithWriteClientCAs requires clients to present a certificate signed by one
+// of the given CAs in order to write to the store, i.e. for requests other
+// than GET, HEAD and OPTIONS. Requests without a verified certificate are
+// rejected with 403 Forbidden, while reads remain open to all clients.
+//
+// Requires the API to be served over HTTPS via WithTLSConfig. Disabled by
+// default.
+func WithWriteClientCAs(pool *x509.CertPool) Option {
+	return func(cfg *config) error {
+		if pool == nil {
+			return fmt.Errorf("write client CA pool must not be nil")
+		}
+		cfg.writeClientCAs = pool
+		return nil
+	}
+}
+
+// WithAuth requires requests to carry a token authorized for the group of the
+// requested route, as a bearer token in the Authorization header or in the
+// X-Api-Key header. Lookups belong to the read group, exports, imports and
+// provenance to the admin group, and all other requests but GET /ready and
+// /openapi.json to the write group. Groups without tokens remain open.
+// Disabled by default.
+func WithAuth(tokens *auth.Tokens) Option {
+	return func(cfg *config) error {
+		if tokens == nil {
+			return fmt.Errorf("tokens must not be nil")
+		}
+		cfg.tokens = tokens
+		return nil
+	}
+}
+
+// WithAuthorizer invokes the given authorizer on writes, exports, imports and
+// provenance requests, i.e. all requests but lookups, GET /ready and
+// /openapi.json, which are rejected unless allowed. Authorizers are invoked
+// after tokens are checked, in the order in which they are given.
+func WithAuthorizer(a auth.Authorizer) Option {
+	return func(cfg *config) error {
+		if a == nil {
+			return errors.New("authorizer must not be nil")
+		}
+		cfg.authorizers = append(cfg.authorizers, a)
+		return nil
+	}
+}
+
+// WithConcurrencyLimiter bounds the number of requests served concurrently
+// using the given limiter, which may be shared with other servers to bound
+// requests across APIs. Requests for which no slot becomes available within
+// the limiter queue timeout are rejected with 503 Service Unavailable.
+// Unlimited by default.
+func WithConcurrencyLimiter(l *limit.Limiter) Option {
+	return func(cfg *config) error {
+		if l == nil {
+			return fmt.Errorf("limiter must not be nil")
+		}
+		cfg.limiter = l
+		return nil
+	}
+}
+
+// WithWriteListenAddr serves writes, i.e. requests other than GET, HEAD and
+// OPTIONS, on a separate listener at the given address, so that writes can be
+// firewalled separately from reads. The write listener serves reads too, while
+// the main listener rejects writes with 405 Method Not Allowed. Writes are
+// served on the main listener by default.
+func WithWriteListenAddr(addr string) Option {
+	return func(cfg *config) error {
+		if addr == "" {
+			return fmt.Errorf("write listen address must not be empty")
+		}
+		cfg.writeListenAddr = addr
+		return nil
+	}
+}
+
+// WithReadOnly rejects writes as if the store was read-only, i.e. with 403
+// Forbidden and the read_only error code, while the given function returns
+// true, so that read-only mode can be toggled at runtime.
+func WithReadOnly(readOnly func() bool) Option {
+	return func(cfg *config) error {
+		if readOnly == nil {
+			return fmt.Errorf("read-only function must not be nil")
+		}
+		cfg.readOnly = readOnly
+		return nil
+	}
+}
+
+// WithRequestValidation rejects requests to the multihash and metadata
+// endpoints with 400 Bad Request unless their path parameters and body conform
+// to the OpenAPI document served at /openapi.json. Disabled by default.
+func WithRequestValidation(on bool) Option {
+	return func(cfg *config) error {
+		cfg.validateRequests = on
+		return nil
+	}
+}
+
+// WithHTTP3ListenAddr serves lookups over HTTP/3, i.e. over QUIC, on the given
+// UDP address, in order to avoid head-of-line blocking and reduce handshake
+// latency for distant clients. Responses to reads over TCP advertise the
+// HTTP/3 listener via the Alt-Svc header, and writes are rejected with 405
+// Method Not Allowed over HTTP/3.
+//
+// Requires the API to be served over HTTPS via WithTLSConfig, and dhstore to
+// be built with the http3 build tag. Disabled by default.
+func WithHTTP3ListenAddr(addr string) Option {
+	return func(cfg *config) error {
+		if addr == "" {
+			return fmt.Errorf("http3 listen address must not be empty")
+		}
+		cfg.http3ListenAddr = addr
+		return nil
+	}
+}
+
+// WithLookupPageLimit bounds the number of encrypted value keys returned per
+// lookup response to the given limit, including when a larger limit query
+// parameter is requested. Clients page through the remaining keys using the
+// cursor returned in the X-Next-Cursor response header. Since pages are cut
+// from the sorted keys, NDJSON lookups are then no longer streamed from stores
+// that support it. Unbounded by default.
+func WithLookupPageLimit(limit int) Option {
+	return func(cfg *config) error {
+		if limit < 1 {
+			return fmt.Errorf("lookup page limit must be at least 1, got: %d", limit)
+		}
+		cfg.lookupPageLimit = limit
+		return nil
+	}
+}
+
+// WithEncryptedLookupsOnly disables the unencrypted lookup endpoints, i.e.
+// /multihash/<multihash> and /cid/<cid>, which then respond with 404 Not Found
+// even for DBL_SHA2_256 multihashes, so that only the encrypted API is
+// exposed. Unencrypted lookups are also omitted from the OpenAPI document.
+// Cannot be combined with WithDHFind. Disabled by default.
+func WithEncryptedLookupsOnly(on bool) Option {
+	return func(cfg *config) error {
+		cfg.encryptedLookupsOnly = on
+		return nil
+	}
+}
+
+// WithLegacyFindAPI enables compatibility with clients of the storetheindex
+// find API, so that they can be pointed at dhstore during a migration: batch
+// finds via POST /multihash are served, and unencrypted lookups without an
+// Accept header are responded to as JSON even if JSON is not preferred.
+// Cannot be combined with WithEncryptedLookupsOnly. Disabled by default.
+func WithLegacyFindAPI(on bool) Option {
+	return func(cfg *config) error {
+		cfg.legacyFindAPI = on
+		return nil
+	}
+}
+
+// WithWatchHub enables watching multihashes via the watch query parameter of
+// encrypted lookups, which streams their encrypted value keys merged through
+// the API as they arrive. The hub may be shared with other servers, so that
+// merges via any of them reach watchers. Disabled by default.
+func WithWatchHub(h *watch.Hub) Option {
+	return func(cfg *config) error {
+		if h == nil {
+			return fmt.Errorf("watch hub must not be nil")
+		}
+		cfg.watchHub = h
+		return nil
+	}
+}
+
+// WithMaxWebSockets enables WebSocket lookups at /encrypted/multihash/ws, over
+// which clients submit many multihashes on one connection and receive their
+// results as they complete, bounded to the given number of concurrent
+// connections. Each lookup counts towards the concurrency limit, if any.
+// Disabled by default.
+func WithMaxWebSockets(n int) Option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return fmt.Errorf("max web sockets must not be negative: %d", n)
+		}
+		cfg.maxWebSockets = n
+		return nil
+	}
+}
+
+// WithMiddleware wraps the handler of all requests with the given middleware,
+// e.g. to add authentication, logging or tracing. Middlewares run after
+// request IDs are assigned and before the built-in authorization, concurrency
+// limiting and validation. When given multiple times, the first middleware is
+// outermost.
+func WithMiddleware(middleware func(http.Handler) http.Handler) Option {
+	return func(c *config) error {
+		if middleware == nil {
+			return errors.New("middleware cannot be nil")
+		}
+		c.middlewares = append(c.middlewares, middleware)
+		return nil
+	}
+}
+
+// WithStrictMerges validates each merge of PUT /multihash and
+// PUT /encrypted/multihash requests before any is applied, rejecting requests
+// with duplicate key and value pairs, keys that are not DBL_SHA2_256
+// multihashes, or encrypted value keys shorter than minValueLen or longer than
+// maxValueLen bytes. Rejected requests are responded to with 400 Bad Request,
+// detailing the error of each invalid merge. Disabled by default.
+func WithStrictMerges(minValueLen, maxValueLen int) Option {
+	return func(cfg *config) error {
+		if minValueLen < 1 {
+			return fmt.Errorf("minimum value length must be at least 1, got: %d", minValueLen)
+		}
+		if maxValueLen < minValueLen {
+			return fmt.Errorf("maximum value length must be at least %d, got: %d", minValueLen, maxValueLen)
+		}
+		cfg.strictMerges = &strictMerges{minValueLen: minValueLen, maxValueLen: maxValueLen}
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/ipni/dhstore"
+)
+
+// nextCursorHeader is the response header carrying the cursor of the next page
+// of a paged lookup, which is absent on the last page.
+const nextCursorHeader = "X-Next-Cursor"
+
+// lookupPage is a page of encrypted value keys requested via the limit and
+// cursor query parameters of a lookup.
+type lookupPage struct {
+	// limit is the maximum number of keys in the page, or zero if unbounded.
+	limit int
+	// after is the last key of the previous page.
+	after dhstore.EncryptedValueKey
+}
+
+// parseLookupPage parses the page requested by the given lookup, bounded by
+// the configured lookup page limit, if any. It returns nil if no page was
+// requested and pages are unbounded, in which case all keys are returned.
+func (s *Server) parseLookupPage(r *http.Request) (*lookupPage, error) {
+	query := r.URL.Query()
+	var page lookupPage
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return nil, errors.New("invalid limit")
+		}
+		page.limit = limit
+	}
+	if s.lookupPageLimit != 0 && (page.limit == 0 || page.limit > s.lookupPageLimit) {
+		page.limit = s.lookupPageLimit
+	}
+	if v := query.Get("cursor"); v != "" {
+		after, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || len(after) == 0 {
+			return nil, errors.New("invalid cursor")
+		}
+		page.after = after
+	}
+	if page.limit == 0 && page.after == nil {
+		return nil, nil
+	}
+	return &page, nil
+}
+
+// apply returns the keys of the page, ordered by their bytes, along with the
+// cursor of the next page, or an empty cursor if this is the last page. Keys
+// merged after the cursor was issued are included in later pages only if they
+// sort after it.
+func (p *lookupPage) apply(evks []dhstore.EncryptedValueKey) ([]dhstore.EncryptedValueKey, string) {
+	evks = slices.Clone(evks)
+	slices.SortFunc(evks, func(a, b dhstore.EncryptedValueKey) int {
+		return bytes.Compare(a, b)
+	})
+	if p.after != nil {
+		evks = evks[sort.Search(len(evks), func(i int) bool {
+			return bytes.Compare(evks[i], p.after) > 0
+		}):]
+	}
+	if p.limit == 0 || len(evks) <= p.limit {
+		return evks, ""
+	}
+	evks = evks[:p.limit]
+	return evks, base64.RawURLEncoding.EncodeToString(evks[len(evks)-1])
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/go-libipni/dhash"
+	"github.com/ipni/go-libipni/rwriter"
+	"github.com/multiformats/go-multihash"
+)
+
+// resultCountHeader is the response header of HEAD lookups carrying the
+// number of results the equivalent GET lookup would return.
+const resultCountHeader = "X-Result-Count"
+
+// probeMh responds to a HEAD lookup with the status of the equivalent GET
+// lookup and its number of results, without encoding them, so that crawlers
+// can cheaply test the presence of a multihash in the index. Pagination is
+// ignored; the count is of all results. Unencrypted lookups that fall back to
+// dhfind count the providers of the multihash in the store, without fetching
+// their provider information.
+func (s *Server) probeMh(w http.ResponseWriter, r *http.Request, rw *rwriter.ResponseWriter, encrypted bool) {
+	if s.metrics != nil {
+		ws := newResponseWriterWithStatus(w)
+		w = ws
+		start := s.clock.Now()
+		defer func() {
+			s.metrics.RecordHttpLatency(r.Context(), s.clock.Since(start), r.Method, rw.PathType(), ws.status)
+		}()
+	}
+
+	var count int
+	if encrypted || rw.MultihashCode() == multihash.DBL_SHA2_256 {
+		evks, err := s.dhs.Lookup(rw.Multihash())
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		count = len(evks)
+	}
+	if count == 0 && !encrypted {
+		switch {
+		case s.dhfind.Load() != nil:
+			// Count the encrypted value keys dhfind would decrypt, rather than
+			// resolving their metadata and provider information.
+			evks, err := s.dhs.Lookup(dhash.SecondMultihash(rw.Multihash()))
+			if err != nil {
+				s.handleError(w, err)
+				return
+			}
+			count = len(evks)
+		case rw.MultihashCode() != multihash.DBL_SHA2_256:
+			dhstore.ErrorResponse{
+				Code:    dhstore.ErrorCodeUnsupportedCodec,
+				Message: "unencrypted lookup not available when dhfind not enabled",
+			}.Write(w, http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set(resultCountHeader, strconv.Itoa(count))
+	if count == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipni/dhstore"
+)
+
+// defaultProvenanceWindow is the time range of provenance records returned
+// when no range is specified.
+const defaultProvenanceWindow = time.Hour
+
+// provenance records the writer tag of merged batches.
+type provenance struct {
+	recorder    dhstore.ProvenanceRecorder
+	header      string
+	sampleEvery uint64
+	batches     atomic.Uint64
+}
+
+// recordProvenance persists the provenance of the given merges if the request carries a
+// writer tag and the batch is sampled. Failure to record provenance does not
+// fail the merge, since the merges are already committed.
+func (s *Server) recordProvenance(r *http.Request, merges []dhstore.Index) {
+	p := s.provenance
+	if p == nil {
+		return
+	}
+	tag := r.Header.Get(p.header)
+	if tag == "" {
+		return
+	}
+	if p.batches.Add(1)%p.sampleEvery != 0 {
+		return
+	}
+	record := dhstore.NewProvenance(tag, s.clock.Now(), merges)
+	if err := p.recorder.RecordProvenance(record); err != nil {
+		logger(r.Context()).Warnw("Failed to record provenance", "tag", record.Tag, "count", len(merges), "err", err)
+	}
+}
+
+func (s *Server) handleProvenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	to := s.clock.Now()
+	from := to.Add(-defaultProvenanceWindow)
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			dhstore.HTTPError(w, "invalid from time: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			dhstore.HTTPError(w, "invalid to time: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := s.provenance.recorder.Provenance(from, to)
+	if err != nil {
+		logger(r.Context()).Errorw("Failed to get provenance", "err", err)
+		s.handleError(w, err)
+		return
+	}
+	if records == nil {
+		records = []dhstore.Provenance{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(records); err != nil {
+		logger(r.Context()).Errorw("Failed to write provenance response", "err", err)
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/providers"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// persistentSource is the source of the provider cache of dhfind when provider
+// information is persisted in the store. It persists the information of all
+// providers each time it is fetched from the pool, so that the cache of a
+// restarted server is loaded from the store rather than from the providers
+// URLs, and serves the persisted information while the providers URLs fail.
+type persistentSource struct {
+	pool  *providers.Pool
+	store dhstore.ProviderInfoStore
+	// maxAge is how old persisted information may be to preload the cache
+	// instead of fetching it from the pool.
+	maxAge time.Duration
+	clock  clock.Clock
+	// preloaded is set once the cache is preloaded, after which information
+	// is only served from the store if the pool fails.
+	preloaded atomic.Bool
+}
+
+func (s *persistentSource) Fetch(ctx context.Context, pid peer.ID) (*model.ProviderInfo, error) {
+	return s.pool.Fetch(ctx, pid)
+}
+
+func (s *persistentSource) FetchAll(ctx context.Context) ([]*model.ProviderInfo, error) {
+	if !s.preloaded.Swap(true) {
+		if infos, age, ok := s.load(); ok && age <= s.maxAge {
+			log.Infow("Preloaded provider cache from store", "providers", len(infos), "age", age)
+			return infos, nil
+		}
+	}
+	infos, err := s.pool.FetchAll(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if persisted, age, ok := s.load(); ok {
+			log.Warnw("Failed to fetch providers; using provider information from store", "providers", len(persisted), "age", age, "err", err)
+			return persisted, nil
+		}
+		return nil, err
+	}
+	s.save(infos)
+	return infos, nil
+}
+
+func (s *persistentSource) String() string {
+	return s.pool.String()
+}
+
+// load returns the provider information persisted in the store and its age, or
+// false if there is none or it cannot be read.
+func (s *persistentSource) load() ([]*model.ProviderInfo, time.Duration, bool) {
+	snapshot, err := s.store.ProviderInfos()
+	if err != nil {
+		log.Errorw("Failed to load provider information from store", "err", err)
+		return nil, 0, false
+	}
+	if snapshot == nil {
+		return nil, 0, false
+	}
+	infos := make([]*model.ProviderInfo, 0, len(snapshot.Infos))
+	for _, raw := range snapshot.Infos {
+		var info model.ProviderInfo
+		if err := json.Unmarshal(raw, &info); err != nil {
+			log.Errorw("Failed to decode provider information from store", "err", err)
+			return nil, 0, false
+		}
+		infos = append(infos, &info)
+	}
+	return infos, s.clock.Since(snapshot.Time), true
+}
+
+// save persists the given provider information in the store, logging rather
+// than returning errors since the information is persisted again once it is
+// refreshed.
+func (s *persistentSource) save(infos []*model.ProviderInfo) {
+	snapshot := dhstore.ProviderInfoSnapshot{
+		Time:  s.clock.Now(),
+		Infos: make([]json.RawMessage, 0, len(infos)),
+	}
+	for _, info := range infos {
+		raw, err := json.Marshal(info)
+		if err != nil {
+			log.Errorw("Failed to encode provider information", "provider", info.AddrInfo.ID, "err", err)
+			return
+		}
+		snapshot.Infos = append(snapshot.Infos, raw)
+	}
+	if err := s.store.PutProviderInfos(snapshot); err != nil {
+		log.Errorw("Failed to persist provider information in store", "err", err)
+	}
+}
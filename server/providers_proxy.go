@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/providers"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// providersPath is the path at which the providers of the providers URLs
+	// of dhfind are served.
+	providersPath = "/providers"
+	// providersMaxAge is how long the list of all providers is cached, and
+	// how long clients may cache provider information.
+	providersMaxAge = time.Minute
+)
+
+// providersList caches the information of all providers fetched from the
+// providers URLs of dhfind.
+type providersList struct {
+	mu      sync.Mutex
+	infos   []*model.ProviderInfo
+	expires time.Time
+}
+
+// handleProviders proxies GET /providers and GET /providers/<peer-id> to the
+// providers URLs of dhfind, so that lookup clients that also need the address
+// information of providers can use dhstore as their single endpoint. The
+// information of a single provider is served from the provider cache of
+// dhfind, and the list of all providers is cached for providersMaxAge.
+func (s *Server) handleProviders(w http.ResponseWriter, r *http.Request) {
+	if s.metrics != nil {
+		ws := newResponseWriterWithStatus(w)
+		w = ws
+		start := s.clock.Now()
+		defer func() {
+			s.metrics.RecordHttpLatency(r.Context(), s.clock.Since(start), r.Method, "providers", ws.status)
+		}()
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	dhfind := s.dhfind.Load()
+	if dhfind == nil {
+		dhstore.HTTPError(w, "providers not available when dhfind not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	pidStr := strings.Trim(strings.TrimPrefix(r.URL.Path, providersPath), "/")
+	if pidStr == "" {
+		infos, err := dhfind.listProviders(r.Context(), s.clock.Now())
+		if err != nil {
+			logger(r.Context()).Errorw("Failed to fetch providers", "err", err)
+			if errors.Is(err, providers.ErrCircuitOpen) {
+				s.handleError(w, err)
+				return
+			}
+			writeError(w, err)
+			return
+		}
+		writeProviders(w, r, infos)
+		return
+	}
+	pid, err := peer.Decode(pidStr)
+	if err != nil {
+		dhstore.HTTPError(w, fmt.Sprintf("invalid peer id: %s", err), http.StatusBadRequest)
+		return
+	}
+	info, err := dhfind.pcache.Get(r.Context(), pid)
+	if err != nil {
+		logger(r.Context()).Errorw("Failed to fetch provider", "provider", pid, "err", err)
+		writeError(w, err)
+		return
+	}
+	if info == nil {
+		dhstore.HTTPError(w, "", http.StatusNotFound)
+		return
+	}
+	writeProviders(w, r, info)
+}
+
+func writeProviders(w http.ResponseWriter, r *http.Request, v any) {
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(providersMaxAge.Seconds())))
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger(r.Context()).Errorw("Failed to write providers response", "err", err)
+	}
+}
+
+// listProviders returns the information of all providers, fetched from the
+// providers URLs unless fetched within providersMaxAge of now.
+func (d *dhFind) listProviders(ctx context.Context, now time.Time) ([]*model.ProviderInfo, error) {
+	d.providers.mu.Lock()
+	defer d.providers.mu.Unlock()
+	if d.providers.infos != nil && now.Before(d.providers.expires) {
+		return d.providers.infos, nil
+	}
+	infos, err := d.pool.FetchAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if infos == nil {
+		infos = []*model.ProviderInfo{}
+	}
+	d.providers.infos = infos
+	d.providers.expires = now.Add(providersMaxAge)
+	return infos, nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/audit"
+	"github.com/ipni/go-libipni/dhash"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multihash"
+)
+
+// origMultihashKey is the context key under which the original multihash of a
+// dhfind lookup is stored, so that encrypted value keys can be decrypted when
+// pruning stale providers.
+type origMultihashKey struct{}
+
+// pruneStale removes the encrypted value keys that belong to stale providers
+// from the given lookup results, and deletes their records from the store
+// unless the pruner is in dry-run mode. Deletion is deferred when the
+// maintenance throttle is out of tokens.
+//
+// Value keys can only be attributed to a provider once decrypted, which
+// requires the original multihash. Results are returned as is when the
+// original multihash is not known.
+func (s *Server) pruneStale(ctx context.Context, dhmh multihash.Multihash, evks []dhstore.EncryptedValueKey) []dhstore.EncryptedValueKey {
+	origMh, ok := ctx.Value(origMultihashKey{}).(multihash.Multihash)
+	if !ok {
+		return evks
+	}
+
+	dryRun := s.pruner.DryRun()
+	var stale []dhstore.Index
+	var staleMetadata []dhstore.HashedValueKey
+	prunedByProvider := make(map[peer.ID]int)
+	kept := evks[:0]
+	for _, evk := range evks {
+		vk, err := dhash.DecryptValueKey(multihash.Multihash(evk), origMh)
+		if err != nil {
+			kept = append(kept, evk)
+			continue
+		}
+		pid, _, err := dhash.SplitValueKey(vk)
+		if err != nil || !s.pruner.IsStale(pid) {
+			kept = append(kept, evk)
+			continue
+		}
+		prunedByProvider[pid]++
+		if dryRun {
+			kept = append(kept, evk)
+			continue
+		}
+		stale = append(stale, dhstore.Index{Key: dhmh, Value: evk})
+		staleMetadata = append(staleMetadata, dhash.SHA256(vk, nil))
+	}
+	if len(prunedByProvider) == 0 {
+		return evks
+	}
+	if !dryRun && s.maintenance != nil && !s.maintenance.Allow() {
+		// Stale records are still omitted from the results, and are deleted
+		// when encountered again once lookup latency allows.
+		logger(ctx).Debugw("Deferring pruning of stale records", "count", len(stale), "multihash", dhmh.B58String())
+		return kept
+	}
+
+	for pid, count := range prunedByProvider {
+		s.pruner.Pruned(pid, count)
+		if dryRun {
+			logger(ctx).Infow("Would prune records of stale provider", "provider", pid, "count", count, "multihash", dhmh.B58String())
+		} else {
+			logger(ctx).Infow("Pruning records of stale provider", "provider", pid, "count", count, "multihash", dhmh.B58String())
+		}
+	}
+	if dryRun {
+		return evks
+	}
+	err := s.dhs.DeleteIndexes(stale)
+	if s.auditLog != nil {
+		s.auditLog.RecordIndexes(audit.OpDeleteIndexes, pruneClient(ctx), stale, err)
+	}
+	if err != nil {
+		logger(ctx).Errorw("Failed to delete indexes of stale providers", "err", err)
+	}
+	for _, hvk := range staleMetadata {
+		err := s.dhs.DeleteMetadata(hvk)
+		if s.auditLog != nil {
+			s.auditLog.RecordMetadata(audit.OpDeleteMetadata, pruneClient(ctx), []dhstore.HashedValueKey{hvk}, err)
+		}
+		if err != nil {
+			logger(ctx).Errorw("Failed to delete metadata of stale provider", "err", err)
+		}
+	}
+	return kept
+}
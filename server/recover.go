@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/ipni/dhstore"
+)
+
+// panicRecovery tracks the signatures of recovered panics, so that the stack
+// of each unique panic is only logged once.
+type panicRecovery struct {
+	seen sync.Map
+}
+
+// recoverPanics wraps the given handler such that panics in it are recovered
+// and responded to with a 500 status code that carries the request ID, rather
+// than killing the connection.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// ErrAbortHandler is used deliberately to abort a response, and is
+			// handled by net/http.
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			requestID := r.Header.Get(requestIDHeader)
+			if requestID == "" {
+				requestID = newRequestID()
+			}
+			path := pathLabel(r.URL.Path)
+			if s.metrics != nil {
+				s.metrics.RecordHttpPanic(context.Background(), r.Method, path)
+			}
+			signature := panicSignature()
+			if _, seen := s.panics.seen.LoadOrStore(signature, struct{}{}); seen {
+				log.Errorw("Recovered panic in handler", "requestID", requestID, "method", r.Method, "path", r.URL.Path, "panic", v, "signature", signature)
+			} else {
+				log.Errorw("Recovered panic in handler", "requestID", requestID, "method", r.Method, "path", r.URL.Path, "panic", v, "signature", signature, "stack", string(debug.Stack()))
+			}
+			w.Header().Set(requestIDHeader, requestID)
+			dhstore.ErrorResponse{
+				Code:    dhstore.ErrorCodeInternal,
+				Message: fmt.Sprintf("internal error; request ID: %s", requestID),
+				Details: map[string]any{"requestID": requestID},
+			}.Write(w, http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// panicSignature identifies a panic by the functions and lines on the stack
+// between the panic and the recovering handler, so that the same panic
+// recovered from different requests has the same signature.
+func panicSignature() string {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(0, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	h := fnv.New64a()
+	var panicked bool
+	for {
+		frame, more := frames.Next()
+		switch {
+		case frame.Function == "runtime.gopanic":
+			panicked = true
+		case strings.HasSuffix(frame.Function, ".recoverPanics.func1"):
+			more = false
+		case panicked && !strings.HasPrefix(frame.Function, "runtime."):
+			_, _ = fmt.Fprintf(h, "%s:%d\n", frame.Function, frame.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// pathLabel returns the first segment of the given URL path, so that paths
+// carrying keys do not blow up the cardinality of metrics.
+func pathLabel(urlPath string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(urlPath, "/"), "/")
+	return segment
+}
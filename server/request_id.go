@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// requestIDHeader is the header from which the ID of a request is taken if
+// set by the client, and in which it is returned with every response.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the length of request IDs accepted from clients,
+// so that they cannot bloat logs.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// withRequestID wraps the given handler such that every request carries an
+// ID, taken from the X-Request-Id header if set by the client or generated
+// otherwise. The ID is returned in the X-Request-Id response header, attached
+// to the log lines of the request, and propagated to outgoing requests made
+// via RequestIDTransport on its behalf, such as those of dhfind.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+			r.Header.Set(requestIDHeader, requestID)
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+	})
+}
+
+// validRequestID reports whether the given ID taken from a client is
+// non-empty, bounded in length and consists of printable ASCII characters
+// other than space.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// RequestIDFromContext returns the ID of the request being served with the
+// given context, or an empty string if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logger returns the logger of the request being served with the given
+// context, which attaches the request ID to its log lines.
+func logger(ctx context.Context) *zap.SugaredLogger {
+	if id := RequestIDFromContext(ctx); id != "" {
+		return log.With("requestID", id)
+	}
+	return &log.SugaredLogger
+}
+
+// RequestIDTransport sets the X-Request-Id header of outgoing requests made on
+// behalf of a request being served, such as the provider lookups of dhfind, so
+// that a single lookup can be traced across services.
+type RequestIDTransport struct {
+	// Base is the transport that makes requests, or http.DefaultTransport if
+	// nil.
+	Base http.RoundTripper
+}
+
+func (t RequestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if id := RequestIDFromContext(req.Context()); id != "" && req.Header.Get(requestIDHeader) == "" {
+		// Round trippers must not modify the given request.
+		req = req.Clone(req.Context())
+		req.Header.Set(requestIDHeader, id)
+	}
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipni/dhstore"
+	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/metadata"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// routingProvidersPath is the path prefix of Delegated Routing V1
+	// provider lookups, as specified by
+	// https://specs.ipfs.tech/routing/http-routing-v1/
+	routingProvidersPath = "/routing/v1/providers/"
+	// routingMaxAge is how long clients may cache found providers.
+	routingMaxAge = 5 * time.Minute
+	// routingNotFoundMaxAge is how long clients may cache the absence of
+	// providers, which is short so that newly advertised content is found.
+	routingNotFoundMaxAge = 15 * time.Second
+)
+
+// routingProviders is the JSON response to Delegated Routing V1 provider
+// lookups.
+type routingProviders struct {
+	Providers []map[string]any `json:"Providers"`
+}
+
+// handleRoutingProviders serves the Delegated Routing V1 providers of a CID,
+// which are resolved via dhfind, so that IPFS clients such as Kubo can query
+// dhstore without an indexer frontend. Records are of the peer schema, listing
+// the retrieval protocols of the provider along with their metadata. Records
+// are streamed as NDJSON if accepted, and written as JSON otherwise.
+func (s *Server) handleRoutingProviders(w http.ResponseWriter, r *http.Request) {
+	if s.metrics != nil {
+		ws := newResponseWriterWithStatus(w)
+		w = ws
+		start := s.clock.Now()
+		defer func() {
+			s.metrics.RecordDHFindLatency(r.Context(), s.clock.Since(start), r.Method, "routing", ws.status, false)
+		}()
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	c, err := cid.Decode(strings.TrimPrefix(r.URL.Path, routingProvidersPath))
+	if err != nil {
+		dhstore.ErrorResponse{Code: dhstore.ErrorCodeBadMultihash, Message: fmt.Sprintf("invalid cid: %s", err)}.Write(w, http.StatusBadRequest)
+		return
+	}
+	mh := c.Hash()
+	if c.Prefix().MhType == multihash.DBL_SHA2_256 {
+		dhstore.ErrorResponse{
+			Code:    dhstore.ErrorCodeUnsupportedCodec,
+			Message: "delegated routing requires the original multihash rather than its double hash",
+		}.Write(w, http.StatusBadRequest)
+		return
+	}
+	dhfind := s.dhfind.Load()
+	if dhfind == nil {
+		dhstore.HTTPError(w, "delegated routing not available when dhfind not enabled", http.StatusNotImplemented)
+		return
+	}
+	filter, err := parseProtocolFilter(r)
+	if err != nil {
+		dhstore.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resChan := make(chan model.ProviderResult)
+	errChan := make(chan error, 1)
+	go func() {
+		ctx := context.WithValue(r.Context(), origMultihashKey{}, mh)
+		errChan <- dhfind.FindAsync(ctx, mh, resChan)
+	}()
+
+	ndjson := accepts(r, mediaTypeNDJSON)
+	enc := json.NewEncoder(w)
+	var records []map[string]any
+	seen := make(map[string]struct{})
+	for pr := range resChan {
+		if !filter.match(pr) {
+			continue
+		}
+		record, key := routingRecord(pr)
+		if record == nil {
+			continue
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if !ndjson {
+			records = append(records, record)
+			continue
+		}
+		if len(seen) == 1 {
+			writeRoutingHeaders(w, mediaTypeNDJSON)
+		}
+		if err := enc.Encode(record); err != nil {
+			// The client is gone; drain the results until the lookup is
+			// canceled along with the request context.
+			logger(r.Context()).Errorw("Failed to write routing record", "err", err)
+			continue
+		}
+		_ = http.NewResponseController(w).Flush()
+	}
+	if err := <-errChan; err != nil {
+		logger(r.Context()).Errorw("Failed delegated routing lookup", "err", err)
+		if len(seen) == 0 || !ndjson {
+			s.handleError(w, err)
+		}
+		return
+	}
+	if len(seen) == 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(routingNotFoundMaxAge.Seconds())))
+		dhstore.HTTPError(w, "", http.StatusNotFound)
+		return
+	}
+	if !ndjson {
+		writeRoutingHeaders(w, "application/json")
+		if err := enc.Encode(routingProviders{Providers: records}); err != nil {
+			logger(r.Context()).Errorw("Failed to write routing response", "err", err)
+		}
+	}
+}
+
+func writeRoutingHeaders(w http.ResponseWriter, mediaType string) {
+	h := w.Header()
+	h.Set("Content-Type", mediaType)
+	h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(routingMaxAge.Seconds())))
+	h.Set("Vary", "Accept")
+}
+
+// routingRecord returns the peer schema record of the given provider result,
+// and the key by which it is deduplicated, i.e. the provider ID and protocols.
+// Each protocol carries its base64 encoded metadata, e.g. the graphsync piece
+// CID. The record is nil if the result has no provider.
+func routingRecord(pr model.ProviderResult) (map[string]any, string) {
+	if pr.Provider == nil {
+		return nil, ""
+	}
+	record := map[string]any{
+		"Schema": "peer",
+		"ID":     pr.Provider.ID.String(),
+	}
+	addrs := make([]string, 0, len(pr.Provider.Addrs))
+	for _, addr := range pr.Provider.Addrs {
+		addrs = append(addrs, addr.String())
+	}
+	record["Addrs"] = addrs
+
+	md := metadata.Default.New()
+	var protocols []string
+	// Results of unknown metadata are still listed, without protocols.
+	if err := md.UnmarshalBinary(pr.Metadata); err == nil {
+		for _, code := range md.Protocols() {
+			name := code.String()
+			protocols = append(protocols, name)
+			if b, err := md.Get(code).MarshalBinary(); err == nil {
+				record[name] = base64.StdEncoding.EncodeToString(b)
+			}
+		}
+	}
+	sort.Strings(protocols)
+	if len(protocols) != 0 {
+		record["Protocols"] = protocols
+	}
+	return record, pr.Provider.ID.String() + "/" + strings.Join(protocols, ",")
+}
@@ -2,19 +2,31 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net"
 	"net/http"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/audit"
+	"github.com/ipni/dhstore/auth"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/limit"
 	"github.com/ipni/dhstore/metrics"
+	"github.com/ipni/dhstore/providers"
+	"github.com/ipni/dhstore/prune"
+	"github.com/ipni/dhstore/throttle"
+	"github.com/ipni/dhstore/watch"
 	"github.com/ipni/go-libipni/apierror"
-	"github.com/ipni/go-libipni/find/client"
 	"github.com/ipni/go-libipni/find/model"
 	"github.com/ipni/go-libipni/rwriter"
 	"github.com/mr-tron/base58"
@@ -24,14 +36,114 @@ import (
 var log = logging.Logger("server/http")
 
 type Server struct {
-	s          *http.Server
+	s *http.Server
+	// ws optionally serves writes on a separate listener, in which case s
+	// only serves reads.
+	ws *http.Server
+	// h3 optionally serves lookups over HTTP/3.
+	h3         http3Listener
 	metrics    *metrics.Metrics
 	dhs        dhstore.DHStore
 	preferJSON bool
+	clock      clock.Clock
+	// defaultAccept is the media type of lookup responses to requests without
+	// an Accept header, unless empty.
+	defaultAccept string
+	// ndjsonFlushInterval is the minimum interval between flushes of NDJSON
+	// lookup responses, if positive.
+	ndjsonFlushInterval time.Duration
+	// maxValueKeySize is the maximum size of merged encrypted value keys, if
+	// positive.
+	maxValueKeySize int
 
 	// dhfind is a dh client that is optionally enabled to allow non-dh
-	// lookups. If is enabled by providing a valid providersURL.
-	dhfind *client.DHashClient
+	// lookups. If is enabled by providing a valid providersURL, and may be
+	// swapped via SetProvidersURLs.
+	dhfind atomic.Pointer[dhFind]
+	// providersCheckInterval is the interval at which the health of dhfind
+	// providers endpoints is checked.
+	providersCheckInterval time.Duration
+	// dhfindMissTTL is how long multihashes that resolved to no results via
+	// dhfind are not looked up again, if positive.
+	dhfindMissTTL time.Duration
+	// providerInfos optionally persists the provider cache of dhfind, which
+	// is preloaded from it if at most providerCacheMaxAge old.
+	providerInfos       dhstore.ProviderInfoStore
+	providerCacheMaxAge time.Duration
+	// dhfindTimeout, dhfindParallelism and dhfindMaxValueKeys bound the work
+	// of each lookup via dhfind.
+	dhfindTimeout      time.Duration
+	dhfindParallelism  int
+	dhfindMaxValueKeys int
+	// breakerFailures and breakerCooldown configure the circuit breaker of
+	// the providers URLs of dhfind, if breakerFailures is positive.
+	breakerFailures int
+	breakerCooldown time.Duration
+	// noExtendedProviders is set when dhfind lookups only return the results
+	// of providers themselves, omitting those of their extended providers.
+	noExtendedProviders bool
+	// httpClient fetches the provider information of dhfind, propagating the
+	// IDs of lookups.
+	httpClient *http.Client
+	// encryptedLookupsOnly is set when unencrypted lookups are disabled, in
+	// which case dhfind cannot be enabled.
+	encryptedLookupsOnly bool
+	// legacyFindAPI is set when the storetheindex find API is served for
+	// compatibility with its clients.
+	legacyFindAPI bool
+	// provenance is optionally enabled to record the writer of merged batches.
+	provenance *provenance
+	// pruner optionally identifies stale providers whose records are pruned
+	// as they are encountered by dhfind lookups.
+	pruner *prune.Pruner
+	// maintenance optionally paces pruning according to lookup latency.
+	maintenance *throttle.Throttle
+	// writeBackpressure optionally rejects writes when the store is near its
+	// stop-writes threshold.
+	writeBackpressure *writeBackpressure
+	// auditLog optionally records the mutations of the store.
+	auditLog *audit.Log
+	// strictMerges optionally validates each merge of requests to put
+	// multihashes before any is applied.
+	strictMerges *strictMerges
+	// exporter is set when the store supports exporting its records.
+	exporter dhstore.Exporter
+	// importer is set when the store supports bulk importing records.
+	importer dhstore.Importer
+	// streamingLookuper is set when the store supports streaming lookups, in
+	// which case NDJSON lookup responses are written as they are read.
+	streamingLookuper dhstore.StreamingLookuper
+	// lookupPageLimit optionally bounds the number of encrypted value keys
+	// per lookup response.
+	lookupPageLimit int
+	// panics tracks recovered handler panics.
+	panics panicRecovery
+	// openAPI is the OpenAPI document served at /openapi.json.
+	openAPI []byte
+	// watchHub optionally streams merges to the watchers of multihashes.
+	watchHub *watch.Hub
+	// streamsCtx is canceled upon shutdown to end watch responses and stop
+	// reading WebSocket lookups, so that they do not hold up draining.
+	streamsCtx  context.Context
+	stopStreams context.CancelFunc
+	// limiter optionally bounds concurrent requests, and lookups over
+	// WebSocket connections which are exempt from the request limit.
+	limiter *limit.Limiter
+	// maxWebSockets bounds the number of WebSocket lookup connections, which
+	// are disabled when zero.
+	maxWebSockets int
+	// webSocketsMu guards webSockets, the number of open WebSocket lookup
+	// connections, and adding to webSocketsDone once draining has begun.
+	webSocketsMu sync.Mutex
+	webSockets   int
+	// webSocketsDone tracks WebSocket connections, which are hijacked and
+	// hence not drained by http.Server.Shutdown.
+	webSocketsDone sync.WaitGroup
+	// draining is set once shutdown has begun, upon which /ready responds
+	// with 503 so that load balancers stop routing requests to the server.
+	draining atomic.Bool
+	// buildInfo is the build information of dhstore, as reported by /ready.
+	buildInfo string
 }
 
 // responseWriterWithStatus is required to capture status code from
@@ -57,6 +169,35 @@ func (rec *responseWriterWithStatus) WriteHeader(code int) {
 	}
 }
 
+// Unwrap returns the underlying ResponseWriter, so that http.ResponseController
+// can flush it.
+func (rec *responseWriterWithStatus) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// countingResponseWriter counts the bytes written to the body of a response,
+// so that the size of lookup responses can be reported to metrics.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (cw *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.written += int64(n)
+	return n, err
+}
+
+func (cw *countingResponseWriter) Flush() {
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying ResponseWriter, so that http.ResponseController
+// can flush it.
+func (cw *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
 func New(dhs dhstore.DHStore, addr string, options ...Option) (*Server, error) {
 	opts, err := getOpts(options)
 	if err != nil {
@@ -65,32 +206,185 @@ func New(dhs dhstore.DHStore, addr string, options ...Option) (*Server, error) {
 
 	mux := http.NewServeMux()
 	s := &Server{
-		dhs:        dhs,
-		metrics:    opts.metrics,
-		preferJSON: opts.preferJSON,
-		s: &http.Server{
-			Addr:    addr,
-			Handler: mux,
-		},
+		buildInfo:   dhstore.ReadBuildInfo().String(),
+		dhs:         dhs,
+		metrics:     opts.metrics,
+		preferJSON:  opts.preferJSON,
+		clock:       opts.clock,
+		pruner:      opts.pruner,
+		maintenance: opts.maintenance,
+
+		defaultAccept:        opts.defaultAccept,
+		ndjsonFlushInterval:  opts.ndjsonFlushInterval,
+		maxValueKeySize:      opts.maxValueKeySize,
+		lookupPageLimit:      opts.lookupPageLimit,
+		encryptedLookupsOnly: opts.encryptedLookupsOnly,
+		legacyFindAPI:        opts.legacyFindAPI,
+		watchHub:             opts.watchHub,
+		limiter:              opts.limiter,
+		maxWebSockets:        opts.maxWebSockets,
+		strictMerges:         opts.strictMerges,
+		auditLog:             opts.auditLog,
+
+		providersCheckInterval: opts.providersCheckInterval,
+		dhfindMissTTL:          opts.dhfindMissTTL,
+		providerCacheMaxAge:    opts.providerCacheMaxAge,
+		dhfindTimeout:          opts.dhfindTimeout,
+		dhfindParallelism:      opts.dhfindParallelism,
+		dhfindMaxValueKeys:     opts.dhfindMaxValueKeys,
+		breakerFailures:        opts.breakerFailures,
+		breakerCooldown:        opts.breakerCooldown,
+		noExtendedProviders:    opts.noExtendedProviders,
+	}
+	if opts.legacyFindAPI && opts.encryptedLookupsOnly {
+		return nil, errors.New("legacy find API requires unencrypted lookups")
+	}
+	s.httpClient = &http.Client{}
+	if opts.httpClient != nil {
+		*s.httpClient = *opts.httpClient
+	}
+	base, err := opts.dhfindTransport.apply(s.httpClient.Transport)
+	if err != nil {
+		return nil, err
+	}
+	s.httpClient.Transport = RequestIDTransport{Base: base}
+	s.streamsCtx, s.stopStreams = context.WithCancel(context.Background())
+	if s.openAPI, err = openAPIDocument(!opts.encryptedLookupsOnly); err != nil {
+		return nil, err
+	}
+	var handler http.Handler = mux
+	if opts.validateRequests {
+		handler = validateRequests(handler)
+	}
+	if opts.readOnly != nil {
+		handler = s.rejectWritesWhen(opts.readOnly, handler)
+	}
+	if opts.limiter != nil {
+		handler = s.limitConcurrency(opts.limiter, handler)
+	}
+	tlsConfig := opts.tlsConfig
+	if opts.writeClientCAs != nil {
+		if tlsConfig == nil {
+			return nil, errors.New("write client authentication requires TLS")
+		}
+		// Only verify client certificates when given, so that reads do not
+		// require one.
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ClientCAs = opts.writeClientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		handler = requireWriteClientCerts(handler)
+		log.Info("Client certificates required for writes")
+	}
+	// Authorizers are invoked in the order given, once tokens are checked.
+	for i := len(opts.authorizers) - 1; i >= 0; i-- {
+		handler = auth.Authorize(opts.authorizers[i], authorizerGroup, handler)
+	}
+	if opts.tokens != nil {
+		handler = opts.tokens.Handler(routeGroup, handler)
+	}
+	// Apply middlewares in reverse, so that the first is outermost.
+	for i := len(opts.middlewares) - 1; i >= 0; i-- {
+		handler = opts.middlewares[i](handler)
+	}
+	if s.metrics != nil {
+		handler = withTraceContext(s.countInFlight(mux, handler))
+	}
+	if opts.writeListenAddr != "" {
+		s.ws = &http.Server{
+			Addr:      opts.writeListenAddr,
+			Handler:   withRequestID(s.recoverPanics(handler)),
+			TLSConfig: tlsConfig,
+		}
+		handler = rejectWrites(handler)
+	}
+	if opts.http3ListenAddr != "" {
+		if tlsConfig == nil {
+			return nil, errors.New("http3 requires TLS")
+		}
+		// Only lookups are served over HTTP/3.
+		s.h3, err = newHTTP3Listener(opts.http3ListenAddr, withRequestID(s.recoverPanics(rejectWrites(handler))), tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		handler = advertiseHTTP3(s.h3, handler)
+	}
+	s.s = &http.Server{
+		Addr:      addr,
+		Handler:   withRequestID(s.recoverPanics(handler)),
+		TLSConfig: tlsConfig,
 	}
 
-	mux.HandleFunc("/cid/", s.handleNoEncMhOrCidSubtree)
+	if !opts.encryptedLookupsOnly {
+		mux.HandleFunc("/cid/", s.handleNoEncMhOrCidSubtree)
+		mux.HandleFunc("/multihash/", s.handleNoEncMhOrCidSubtree)
+		mux.HandleFunc(routingProvidersPath, s.handleRoutingProviders)
+		mux.HandleFunc(providersPath, s.handleProviders)
+		mux.HandleFunc(batchFindPath, s.handleBatchFind)
+		mux.HandleFunc(providersPath+"/", s.handleProviders)
+	}
 	mux.HandleFunc("/encrypted/cid/", s.handleEncMhOrCidSubtree)
 	mux.HandleFunc("/multihash", s.handleMh)
 	mux.HandleFunc("/encrypted/multihash", s.handleMh)
-	mux.HandleFunc("/multihash/", s.handleNoEncMhOrCidSubtree)
+	mux.HandleFunc("/multihash/stream", s.handleMhStream)
 	mux.HandleFunc("/encrypted/multihash/", s.handleEncMhOrCidSubtree)
+	mux.HandleFunc(batchLookupPath, s.handleBatchLookup)
+	if opts.maxWebSockets != 0 {
+		mux.HandleFunc(webSocketLookupPath, s.handleWebSocketLookup)
+	}
 	mux.HandleFunc("/metadata", s.handleMetadata)
 	mux.HandleFunc("/metadata/", s.handleMetadataSubtree)
 	mux.HandleFunc("/ready", s.handleReady)
+	mux.HandleFunc("/openapi.json", s.handleOpenAPI)
+
+	if opts.provenanceHeader != "" {
+		recorder, ok := dhs.(dhstore.ProvenanceRecorder)
+		if !ok {
+			return nil, errors.New("provenance is not supported by store")
+		}
+		s.provenance = &provenance{
+			recorder:    recorder,
+			header:      opts.provenanceHeader,
+			sampleEvery: uint64(opts.provenanceSampleEvery),
+		}
+		mux.HandleFunc("/provenance", s.handleProvenance)
+		log.Infow("Provenance recording enabled", "header", opts.provenanceHeader, "sampleEvery", opts.provenanceSampleEvery)
+	}
+	s.streamingLookuper, _ = dhs.(dhstore.StreamingLookuper)
+	if exporter, ok := dhs.(dhstore.Exporter); ok {
+		s.exporter = exporter
+		mux.HandleFunc("/export", s.handleExport)
+	}
+	if importer, ok := dhs.(dhstore.Importer); ok {
+		s.importer = importer
+		mux.HandleFunc("/import", s.handleImport)
+	}
 	mux.HandleFunc("/", s.handleCatchAll)
 
-	if len(opts.providersURLs) != 0 {
-		s.dhfind, err = client.NewDHashClient(client.WithProvidersURL(opts.providersURLs...), client.WithDHStoreAPI(s))
-		if err != nil {
+	if opts.writePressureThreshold != 0 {
+		reporter, ok := dhs.(dhstore.WritePressureReporter)
+		if ok {
+			s.writeBackpressure = &writeBackpressure{
+				reporter:   reporter,
+				threshold:  opts.writePressureThreshold,
+				retryAfter: opts.writeRetryAfter,
+			}
+		} else {
+			log.Warn("Write backpressure is not supported by store; ignoring")
+		}
+	}
+
+	if opts.providerCacheMaxAge != 0 {
+		store, ok := dhs.(dhstore.ProviderInfoStore)
+		if !ok {
+			return nil, errors.New("persistent provider cache is not supported by store")
+		}
+		s.providerInfos = store
+	}
+
+	if len(opts.providers) != 0 {
+		if err := s.setProviders(opts.providers); err != nil {
 			return nil, err
 		}
-		log.Infow("dhfind enabled", "providersURLs", opts.providersURLs)
 	}
 
 	return s, nil
@@ -100,41 +394,165 @@ func (s *Server) Handler() http.Handler {
 	return s.s.Handler
 }
 
+// WriteHandler returns the handler of the write listener, or nil if writes
+// are served by Handler.
+func (s *Server) WriteHandler() http.Handler {
+	if s.ws == nil {
+		return nil
+	}
+	return s.ws.Handler
+}
+
 func (s *Server) Start(_ context.Context) error {
-	ln, err := net.Listen("tcp", s.s.Addr)
+	ln, err := serve(s.s)
 	if err != nil {
 		return err
 	}
-	go func() { _ = s.s.Serve(ln) }()
+	logArgs := []any{"addr", ln.Addr(), "tls", s.s.TLSConfig != nil}
+	if s.ws != nil {
+		wln, err := serve(s.ws)
+		if err != nil {
+			_ = s.s.Close()
+			return err
+		}
+		logArgs = append(logArgs, "writeAddr", wln.Addr())
+	}
+	if s.h3 != nil {
+		h3Addr, err := s.h3.start()
+		if err != nil {
+			_ = s.s.Close()
+			if s.ws != nil {
+				_ = s.ws.Close()
+			}
+			return err
+		}
+		logArgs = append(logArgs, "http3Addr", h3Addr)
+	}
 
-	log.Infow("Server started", "addr", ln.Addr())
+	log.Infow("Server started", logArgs...)
 	return nil
 }
 
+// serve listens on the address of the given server and serves it in the
+// background.
+func serve(srv *http.Server) (net.Listener, error) {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if srv.TLSConfig != nil {
+		// Certificates are provided by the TLS config, hence no files.
+		go func() { _ = srv.ServeTLS(ln, "", "") }()
+	} else {
+		go func() { _ = srv.Serve(ln) }()
+	}
+	return ln, nil
+}
+
+// Shutdown gracefully shuts down the server: /ready immediately responds with
+// 503, listeners stop accepting new connections, and in-flight requests,
+// including streamed responses, are served until done or until ctx is done.
+// Connections still active once ctx is done are closed forcibly.
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.s.Shutdown(ctx)
+	s.draining.Store(true)
+	s.stopStreams()
+	servers := []*http.Server{s.s}
+	if s.ws != nil {
+		servers = append(servers, s.ws)
+	}
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, srv := range servers {
+		wg.Add(1)
+		go func(i int, srv *http.Server) {
+			defer wg.Done()
+			if errs[i] = srv.Shutdown(ctx); errs[i] != nil && ctx.Err() != nil {
+				log.Warnw("Drain timed out; closing active connections", "addr", srv.Addr)
+				_ = srv.Close()
+			}
+		}(i, srv)
+	}
+	wg.Wait()
+	errs = append(errs, s.drainWebSockets(ctx))
+	if dhfind := s.dhfind.Swap(nil); dhfind != nil {
+		errs = append(errs, dhfind.close())
+	}
+	if s.h3 != nil {
+		// In-flight HTTP/3 requests are not drained, since QUIC connections
+		// are closed immediately.
+		errs = append(errs, s.h3.close())
+	}
+	return errors.Join(errs...)
+}
+
+// Live returns nil once the server has served a request to /ready through its
+// handlers, regardless of the response, or the error of ctx if it is done
+// first, e.g. since handlers are wedged. It suits liveness checks, such as
+// those of watchdogs, which must not fail while the store is merely
+// unavailable.
+func (s *Server) Live(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/ready", nil)
+	if err != nil {
+		return err
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		s.s.Handler.ServeHTTP(discardResponseWriter{header: make(http.Header)}, req)
+	}()
+	select {
+	case <-served:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
+// discardResponseWriter discards responses.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header         { return w.header }
+func (w discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardResponseWriter) WriteHeader(int)             {}
+
 func (s *Server) handleMh(w http.ResponseWriter, r *http.Request) {
 	if s.metrics != nil {
 		ws := newResponseWriterWithStatus(w)
 		w = ws
-		start := time.Now()
+		start := s.clock.Now()
 		defer func() {
-			s.metrics.RecordHttpLatency(context.Background(), time.Since(start), r.Method, "multihash", ws.status)
+			s.metrics.RecordHttpLatency(r.Context(), s.clock.Since(start), r.Method, "multihash", ws.status)
 		}()
 	}
 
 	switch r.Method {
 	case http.MethodPut:
+		if s.rejectWrite(w, r) {
+			return
+		}
 		s.handlePutMhs(w, r)
 	case http.MethodDelete:
 		s.handleDeleteMhs(w, r)
+	case http.MethodPost:
+		if !s.legacyFindAPI || !isLegacyFind(r) {
+			s.methodNotAllowedMh(w)
+			return
+		}
+		s.handleLegacyFind(w, r)
 	default:
-		w.Header().Set("Allow", http.MethodPut)
-		w.Header().Add("Allow", http.MethodDelete)
-		http.Error(w, "", http.StatusMethodNotAllowed)
+		s.methodNotAllowedMh(w)
+	}
+}
+
+func (s *Server) methodNotAllowedMh(w http.ResponseWriter) {
+	w.Header().Set("Allow", http.MethodPut)
+	w.Header().Add("Allow", http.MethodDelete)
+	if s.legacyFindAPI {
+		w.Header().Add("Allow", http.MethodPost)
 	}
+	dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
 }
 
 func (s *Server) handleEncMhOrCidSubtree(w http.ResponseWriter, r *http.Request) {
@@ -146,27 +564,97 @@ func (s *Server) handleNoEncMhOrCidSubtree(w http.ResponseWriter, r *http.Reques
 }
 
 func (s *Server) handleMhOrCidSubtree(w http.ResponseWriter, r *http.Request, encrypted bool) {
-	if r.Method != http.MethodGet {
+	head := r.Method == http.MethodHead
+	if r.Method != http.MethodGet && !head {
 		w.Header().Set("Allow", http.MethodGet)
-		http.Error(w, "", http.StatusMethodNotAllowed)
+		w.Header().Add("Allow", http.MethodHead)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
 		return
 	}
+	r = normalizeMultihashPath(r)
+	if len(r.Header.Values("Accept")) == 0 {
+		accept := s.defaultAccept
+		if head || (s.legacyFindAPI && !encrypted) {
+			// There is no body to negotiate the media type of, so spare
+			// crawlers from having to specify one. Likewise, clients of the
+			// storetheindex find API expect JSON without asking for it.
+			accept = "application/json"
+		}
+		if accept != "" {
+			r = r.Clone(r.Context())
+			r.Header.Set("Accept", accept)
+		}
+	}
 
+	var counter *countingResponseWriter
+	if s.metrics != nil {
+		counter = &countingResponseWriter{ResponseWriter: w}
+		w = counter
+	}
+	protobuf := accepts(r, mediaTypeProtobuf)
+	eventStream := !protobuf && accepts(r, mediaTypeEventStream)
+	if protobuf {
+		// The response writer only negotiates JSON media types, so have it
+		// parse the request as JSON and override the content type.
+		r = r.Clone(r.Context())
+		r.Header.Set("Accept", "application/json")
+	}
+	var events *eventStreamWriter
+	if eventStream {
+		// Likewise, have the response writer stream NDJSON, whose lines are
+		// then written as events.
+		r = r.Clone(r.Context())
+		r.Header.Set("Accept", mediaTypeNDJSON)
+		events = newEventStreamWriter(w)
+		w = events
+	}
 	rspWriter, err := rwriter.New(w, r, rwriter.WithPreferJson(s.preferJSON))
 	if err != nil {
-		log.Errorw("Failed to accept lookup request", "err", err)
+		logger(r.Context()).Errorw("Failed to accept lookup request", "err", err)
+		var apiErr *apierror.Error
+		if errors.As(err, &apiErr) && apiErr.Status() == http.StatusBadRequest {
+			// The multihash or CID of the path cannot be decoded.
+			dhstore.ErrorResponse{Code: dhstore.ErrorCodeBadMultihash, Message: apiErr.Error()}.Write(w, http.StatusBadRequest)
+			return
+		}
 		writeError(w, err)
 		return
 	}
+	if protobuf {
+		w.Header().Set("Content-Type", mediaTypeProtobuf)
+	}
+	if eventStream {
+		w.Header().Set("Content-Type", mediaTypeEventStream)
+	}
+	if head {
+		s.probeMh(w, r, rspWriter, encrypted)
+		return
+	}
+	if isWatch(r) {
+		if !encrypted || protobuf {
+			dhstore.HTTPError(w, "watch is only supported by encrypted NDJSON or JSON lookups", http.StatusBadRequest)
+			return
+		}
+		s.watchMh(w, r, rspWriter)
+		return
+	}
+	if events != nil {
+		defer events.end()
+	}
 
 	if encrypted {
-		s.lookupMh(newEncResponseWriter(rspWriter), r, true)
+		s.lookupMh(s.newEncResponseWriter(rspWriter, protobuf, counter), r, true)
 		return
 	}
 	// If multihash is DBL_SHA2_256, then this is probably an encrypted lookup,
 	// so try that first. If no results found, then do a non-encrypted lookup.
 	// It is possible for a non-encrypted multihash to be DBL_SHA2_256.
-	if rspWriter.MultihashCode() == multihash.DBL_SHA2_256 && s.lookupMh(newEncResponseWriter(rspWriter), r, s.dhfind == nil) {
+	if rspWriter.MultihashCode() == multihash.DBL_SHA2_256 && s.lookupMh(s.newEncResponseWriter(rspWriter, protobuf, counter), r, s.dhfind.Load() == nil || protobuf) {
+		return
+	}
+	if protobuf {
+		// There is no protobuf representation of provider results.
+		dhstore.HTTPError(w, "protobuf encoding only supported for encrypted lookups", http.StatusNotAcceptable)
 		return
 	}
 	// Do non-encrypted lookup. All encrypted multihashes are DBL_SHA2_256, so
@@ -177,16 +665,40 @@ func (s *Server) handleMhOrCidSubtree(w http.ResponseWriter, r *http.Request, en
 
 func (s *Server) lookupMh(w *encResponseWriter, r *http.Request, writeIfNotFound bool) bool {
 	var start time.Time
-	if s.metrics != nil {
-		start = time.Now()
+	if s.metrics != nil || s.maintenance != nil {
+		start = s.clock.Now()
 		defer func() {
 			if start.IsZero() {
 				return // metrics skipped
 			}
-			s.metrics.RecordHttpLatency(context.Background(), time.Since(start), r.Method, w.PathType(), w.StatusCode())
+			latency := s.clock.Since(start)
+			if s.metrics != nil {
+				s.metrics.RecordHttpLatency(r.Context(), latency, r.Method, w.PathType(), w.StatusCode())
+				if w.written != nil {
+					s.metrics.RecordLookupSize(r.Context(), w.PathType(), w.count, w.written.written)
+				}
+			}
+			if s.maintenance != nil {
+				s.maintenance.Observe(latency)
+			}
 		}()
 	}
 
+	page, err := s.parseLookupPage(r)
+	if err != nil {
+		dhstore.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	// Pages are cut from the sorted keys, which requires all of them.
+	if s.streamingLookuper != nil && w.IsND() && page == nil {
+		if !s.streamLookupMh(w, r, writeIfNotFound) {
+			start = time.Time{} // skip mettics
+			return false
+		}
+		return true
+	}
+
 	evks, err := s.dhs.Lookup(w.Multihash())
 	if err != nil {
 		s.handleError(w, err)
@@ -196,31 +708,72 @@ func (s *Server) lookupMh(w *encResponseWriter, r *http.Request, writeIfNotFound
 		start = time.Time{} // skip mettics
 		return false
 	}
+	if page != nil {
+		var next string
+		if evks, next = page.apply(evks); next != "" {
+			w.Header().Set(nextCursorHeader, next)
+		}
+	}
 	for _, evk := range evks {
 		if err = w.writeEncryptedValueKey(evk); err != nil {
-			log.Errorw("Failed to encode encrypted value key", "err", err)
-			http.Error(w, "", http.StatusInternalServerError)
+			logger(r.Context()).Errorw("Failed to encode encrypted value key", "err", err)
+			dhstore.HTTPError(w, "", http.StatusInternalServerError)
 			return true
 		}
 	}
 	if err = w.close(); err != nil {
-		log.Errorw("Failed to finalize lookup results", "err", err)
+		logger(r.Context()).Errorw("Failed to finalize lookup results", "err", err)
+		writeError(w, err)
+	}
+	return true
+}
+
+// streamLookupMh writes the encrypted value keys of a multihash to the
+// response as they are read from the store. It returns false without writing
+// anything if there are no keys and writeIfNotFound is false.
+func (s *Server) streamLookupMh(w *encResponseWriter, r *http.Request, writeIfNotFound bool) bool {
+	err := s.streamingLookuper.LookupStream(r.Context(), w.Multihash(), w.writeEncryptedValueKey)
+	switch {
+	case err == nil:
+	case w.count == 0:
+		s.handleError(w, err)
+		return true
+	default:
+		// The response has already started; there is no way to signal the
+		// error other than truncating the response.
+		logger(r.Context()).Errorw("Lookup stream interrupted", "written", w.count, "err", err)
+		return true
+	}
+	if w.count == 0 && !writeIfNotFound {
+		return false
+	}
+	if err = w.close(); err != nil {
+		logger(r.Context()).Errorw("Failed to finalize lookup results", "err", err)
 		writeError(w, err)
 	}
 	return true
 }
 
 func (s *Server) dhfindMh(w *rwriter.ProviderResponseWriter, r *http.Request) {
-	if s.dhfind == nil {
-		http.Error(w, "unencrypted lookup not available when dhfind not enabled", http.StatusBadRequest)
+	dhfind := s.dhfind.Load()
+	if dhfind == nil {
+		dhstore.ErrorResponse{
+			Code:    dhstore.ErrorCodeUnsupportedCodec,
+			Message: "unencrypted lookup not available when dhfind not enabled",
+		}.Write(w, http.StatusBadRequest)
+		return
+	}
+	filter, err := parseProtocolFilter(r)
+	if err != nil {
+		dhstore.HTTPError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	var start time.Time
 	if s.metrics != nil {
-		start = time.Now()
+		start = s.clock.Now()
 		defer func() {
-			s.metrics.RecordDHFindLatency(context.Background(), time.Since(start), r.Method, w.PathType(), w.StatusCode(), false)
+			s.metrics.RecordDHFindLatency(r.Context(), s.clock.Since(start), r.Method, w.PathType(), w.StatusCode(), false)
 		}()
 	}
 
@@ -232,20 +785,23 @@ func (s *Server) dhfindMh(w *rwriter.ProviderResponseWriter, r *http.Request) {
 	go func() {
 		// FindAsync returns results on resChan until there are no more results
 		// or error. When finished, returns the error or nil.
-		errChan <- s.dhfind.FindAsync(r.Context(), w.Multihash(), resChan)
+		ctx := context.WithValue(r.Context(), origMultihashKey{}, w.Multihash())
+		errChan <- dhfind.FindAsync(ctx, w.Multihash(), resChan)
 	}()
 
 	var haveResults bool
-	var err error
 	for pr := range resChan {
+		if !filter.match(pr) {
+			continue
+		}
 		if !haveResults {
 			haveResults = true
 			if s.metrics != nil {
-				s.metrics.RecordDHFindLatency(context.Background(), time.Since(start), r.Method, w.PathType(), http.StatusOK, true)
+				s.metrics.RecordDHFindLatency(r.Context(), s.clock.Since(start), r.Method, w.PathType(), http.StatusOK, true)
 			}
 		}
 		if err = w.WriteProviderResult(pr); err != nil {
-			log.Errorw("Failed to encode provider result", "err", err)
+			logger(r.Context()).Errorw("Failed to encode provider result", "err", err)
 			// This error is due to the client disconnecting. Continue reading
 			// from resChan until it is done due to the client context being
 			// canceled. The canceled context prevents this error from
@@ -257,7 +813,7 @@ func (s *Server) dhfindMh(w *rwriter.ProviderResponseWriter, r *http.Request) {
 	// FindAsync finished, check for error.
 	err = <-errChan
 	if err != nil {
-		log.Errorw("Failed dhfind multihash lookup", "err", err)
+		logger(r.Context()).Errorw("Failed dhfind multihash lookup", "err", err)
 		s.handleError(w, err)
 		return
 	}
@@ -265,32 +821,52 @@ func (s *Server) dhfindMh(w *rwriter.ProviderResponseWriter, r *http.Request) {
 	// If there were no results - return 404, otherwise finalize the response
 	// and return 200.
 	if !haveResults {
-		http.Error(w, "", http.StatusNotFound)
+		dhstore.HTTPError(w, "", http.StatusNotFound)
 		return
 	}
 
 	if err = w.Close(); err != nil {
-		log.Errorw("Failed to finalize lookup results", "err", err)
+		logger(r.Context()).Errorw("Failed to finalize lookup results", "err", err)
 		writeError(w, err)
 		return
 	}
 }
 
+// accepts reports whether the request explicitly accepts the given media type.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, amt := range strings.Split(accept, ",") {
+			mt, _, err := mime.ParseMediaType(amt)
+			if err == nil && mt == mediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func writeError(w http.ResponseWriter, err error) {
 	var apiErr *apierror.Error
 	if errors.As(err, &apiErr) {
-		http.Error(w, apiErr.Error(), apiErr.Status())
+		dhstore.HTTPError(w, apiErr.Error(), apiErr.Status())
 	} else {
-		http.Error(w, "", http.StatusInternalServerError)
+		dhstore.HTTPError(w, "", http.StatusInternalServerError)
 	}
 }
 
 // FindMultihash implements client.DHStoreAPI interface.
 func (s *Server) FindMultihash(ctx context.Context, dhmh multihash.Multihash) ([]model.EncryptedMultihashResult, error) {
+	start := s.clock.Now()
 	evks, err := s.dhs.Lookup(dhmh)
 	if err != nil {
 		return nil, err
 	}
+	if s.maintenance != nil {
+		s.maintenance.Observe(s.clock.Since(start))
+	}
+	if s.pruner != nil {
+		evks = s.pruneStale(ctx, dhmh, evks)
+	}
 
 	result := model.EncryptedMultihashResult{
 		Multihash: dhmh,
@@ -314,72 +890,164 @@ func (s *Server) handlePutMhs(w http.ResponseWriter, r *http.Request) {
 	var mir MergeIndexRequest
 	err := json.NewDecoder(r.Body).Decode(&mir)
 	if err != nil {
-		log.Errorw("Cannot decode merge index request", "err", err)
-		http.Error(w, "", http.StatusBadRequest)
+		logger(r.Context()).Errorw("Cannot decode merge index request", "err", err)
+		dhstore.HTTPError(w, "", http.StatusBadRequest)
 		return
 	}
 	if len(mir.Merges) == 0 {
-		log.Error("Cannot put multihashes with no merges specified")
-		http.Error(w, "at least one merge must be specified", http.StatusBadRequest)
+		logger(r.Context()).Error("Cannot put multihashes with no merges specified")
+		dhstore.HTTPError(w, "at least one merge must be specified", http.StatusBadRequest)
+		return
+	}
+	if s.strictMerges != nil {
+		if invalid := s.strictMerges.check(w, r, mir.Merges); len(invalid) != 0 {
+			for code, count := range invalid {
+				s.recordFailedWrite(r, "merge", "put", code, count)
+			}
+			return
+		}
+	}
+	if err := dhstore.CheckValueKeySizes(mir.Merges, s.maxValueKeySize); err != nil {
+		logger(r.Context()).Warnw("Rejecting oversized merges", "err", err)
+		s.recordFailedWrite(r, "merge", "put", errorCode(err), len(mir.Merges))
+		s.handleError(w, err)
 		return
 	}
-	if err = s.dhs.MergeIndexes(mir.Merges); err != nil {
-		log.Errorw("Failed to merge indexes", "err", err)
+	err = s.dhs.MergeIndexes(mir.Merges)
+	s.auditIndexes(r, audit.OpMergeIndexes, mir.Merges, err)
+	if err != nil {
+		logger(r.Context()).Errorw("Failed to merge indexes", "err", err)
+		s.recordFailedWrite(r, "merge", "put", errorCode(err), len(mir.Merges))
 		s.handleError(w, err)
 		return
 	}
+	s.recordMergeBatch(r, "put", mir.Merges)
+	s.recordProvenance(r, mir.Merges)
+	s.publishMerges(mir.Merges)
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// recordMergeBatch records the size of a batch of merges committed to the
+// store via the given source, if metrics are enabled.
+func (s *Server) recordMergeBatch(r *http.Request, source string, merges []dhstore.Index) {
+	if s.metrics == nil {
+		return
+	}
+	var bytes int64
+	for _, merge := range merges {
+		bytes += int64(len(merge.Key) + len(merge.Value))
+	}
+	s.metrics.RecordMergeBatch(r.Context(), source, len(merges), bytes)
+}
+
+// recordFailedWrite records count merges or metadata writes, as per op, that
+// were rejected or failed to commit with the given error code, if metrics are
+// enabled.
+func (s *Server) recordFailedWrite(r *http.Request, op, source, code string, count int) {
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.RecordFailedWrite(r.Context(), op, source, code, count)
+}
+
 func (s *Server) handleDeleteMhs(w http.ResponseWriter, r *http.Request) {
 	var mir MergeIndexRequest
 	err := json.NewDecoder(r.Body).Decode(&mir)
 	if err != nil {
-		log.Errorw("Cannot decode delete index request", "err", err)
-		http.Error(w, "", http.StatusBadRequest)
+		logger(r.Context()).Errorw("Cannot decode delete index request", "err", err)
+		dhstore.HTTPError(w, "", http.StatusBadRequest)
 		return
 	}
 	if len(mir.Merges) == 0 {
-		log.Error("Cannot delete multihashes with no merges specified")
-		http.Error(w, "at least one merge must be specified", http.StatusBadRequest)
+		logger(r.Context()).Error("Cannot delete multihashes with no merges specified")
+		dhstore.HTTPError(w, "at least one merge must be specified", http.StatusBadRequest)
 		return
 	}
-	if err = s.dhs.DeleteIndexes(mir.Merges); err != nil {
-		log.Errorw("Failed to delete indexes", "err", err)
+	err = s.dhs.DeleteIndexes(mir.Merges)
+	s.auditIndexes(r, audit.OpDeleteIndexes, mir.Merges, err)
+	if err != nil {
+		logger(r.Context()).Errorw("Failed to delete indexes", "err", err)
 		s.handleError(w, err)
 		return
 	}
-	log.Infow("Deleted indexes", "count", len(mir.Merges))
+	logger(r.Context()).Infow("Deleted indexes", "count", len(mir.Merges))
 	w.WriteHeader(http.StatusAccepted)
 }
 
 func (s *Server) handleError(w http.ResponseWriter, err error) {
-	var status int
-	switch err.(type) {
-	case dhstore.ErrUnsupportedMulticodecCode, dhstore.ErrMultihashDecode, dhstore.ErrInvalidHashedValueKey:
-		status = http.StatusBadRequest
+	dhstore.ErrorResponse{Code: errorCode(err), Message: err.Error()}.Write(w, errorStatus(err))
+}
+
+// errorCode returns the error code with which to respond to the given error,
+// which may wrap one of the dhstore errors, e.g. as an ErrPartialWrite.
+func errorCode(err error) string {
+	var httpErr dhstore.ErrHttpResponse
+	switch {
+	case errors.As(err, &dhstore.ErrUnsupportedMulticodecCode{}):
+		return dhstore.ErrorCodeUnsupportedCodec
+	case errors.As(err, &dhstore.ErrMultihashDecode{}):
+		return dhstore.ErrorCodeBadMultihash
+	case errors.As(err, &dhstore.ErrInvalidHashedValueKey{}):
+		return dhstore.ErrorCodeBadKey
+	case errors.As(err, &dhstore.ErrValueKeyTooLarge{}):
+		return dhstore.ErrorCodeBadValueLength
+	case errors.As(err, &dhstore.ErrTooManyIterators{}):
+		return dhstore.ErrorCodeOverloaded
+	case errors.As(err, &dhstore.ErrUnavailable{}):
+		return dhstore.ErrorCodeUnavailable
+	case errors.As(err, &dhstore.ErrReadOnly{}):
+		return dhstore.ErrorCodeReadOnly
+	case errors.As(err, &httpErr) && httpErr.Code != "":
+		// Relay the code of errors returned by remote stores.
+		return httpErr.Code
+	}
+	return dhstore.ErrorCodeOf(errorStatus(err))
+}
+
+// errorStatus returns the HTTP status with which to respond to the given
+// error, which may wrap one of the dhstore errors.
+func errorStatus(err error) int {
+	var httpErr dhstore.ErrHttpResponse
+	switch {
+	case errors.As(err, &dhstore.ErrUnsupportedMulticodecCode{}),
+		errors.As(err, &dhstore.ErrMultihashDecode{}),
+		errors.As(err, &dhstore.ErrInvalidHashedValueKey{}),
+		errors.As(err, &dhstore.ErrValueKeyTooLarge{}),
+		errors.As(err, &dhstore.ErrInvalidExportCursor{}):
+		return http.StatusBadRequest
+	case errors.As(err, &dhstore.ErrTooManyIterators{}), errors.As(err, &dhstore.ErrUnavailable{}), errors.Is(err, providers.ErrCircuitOpen):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &dhstore.ErrReadOnly{}):
+		return http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &httpErr):
+		// Relay the status of errors returned by remote stores.
+		return httpErr.Status
 	default:
-		status = http.StatusInternalServerError
+		return http.StatusInternalServerError
 	}
-	http.Error(w, err.Error(), status)
 }
 
 func (s *Server) handleMetadata(w http.ResponseWriter, r *http.Request) {
 	if s.metrics != nil {
 		ws := newResponseWriterWithStatus(w)
 		w = ws
-		start := time.Now()
+		start := s.clock.Now()
 		defer func() {
-			s.metrics.RecordHttpLatency(context.Background(), time.Since(start), r.Method, "metadata", ws.status)
+			s.metrics.RecordHttpLatency(r.Context(), s.clock.Since(start), r.Method, "metadata", ws.status)
 		}()
 	}
 
 	switch r.Method {
 	case http.MethodPut:
 		s.handlePutMetadata(w, r)
+	case http.MethodDelete:
+		s.handleDeleteMetadataBatch(w, r)
 	default:
-		w.Header().Set("Allow", http.MethodPut)
-		http.Error(w, "", http.StatusMethodNotAllowed)
+		w.Header().Add("Allow", http.MethodPut)
+		w.Header().Add("Allow", http.MethodDelete)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -387,25 +1055,86 @@ func (s *Server) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
 	var pmr PutMetadataRequest
 	err := json.NewDecoder(r.Body).Decode(&pmr)
 	if err != nil {
-		log.Errorw("Cannot decode put metadata request", "err", err)
-		http.Error(w, "", http.StatusBadRequest)
+		logger(r.Context()).Errorw("Cannot decode put metadata request", "err", err)
+		dhstore.HTTPError(w, "", http.StatusBadRequest)
+		return
+	}
+	var hvks []dhstore.HashedValueKey
+	count := 1
+	if len(pmr.Metadata) != 0 {
+		count = len(pmr.Metadata)
+		err = s.putMetadataBatch(pmr.Metadata)
+		for _, record := range pmr.Metadata {
+			hvks = append(hvks, record.Key)
+		}
+	} else {
+		err = s.dhs.PutMetadata(pmr.Key, pmr.Value)
+		hvks = []dhstore.HashedValueKey{pmr.Key}
+	}
+	s.auditMetadata(r, audit.OpPutMetadata, hvks, err)
+	if err != nil {
+		logger(r.Context()).Errorw("Failed to put metadata", "err", err)
+		s.recordFailedWrite(r, "metadata", "put", errorCode(err), count)
+		s.handleError(w, err)
 		return
 	}
-	if err = s.dhs.PutMetadata(pmr.Key, pmr.Value); err != nil {
-		log.Errorw("Failed to put metadata", "err", err)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) putMetadataBatch(records []dhstore.Metadata) error {
+	if bp, ok := s.dhs.(dhstore.MetadataBatchPutter); ok {
+		return bp.PutMetadataBatch(records)
+	}
+	for _, record := range records {
+		if err := s.dhs.PutMetadata(record.Key, record.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleDeleteMetadataBatch deletes the metadata of many hashed value keys at
+// once, e.g. all records invalidated by the removal of a context.
+func (s *Server) handleDeleteMetadataBatch(w http.ResponseWriter, r *http.Request) {
+	var dmr DeleteMetadataRequest
+	if err := json.NewDecoder(r.Body).Decode(&dmr); err != nil {
+		logger(r.Context()).Errorw("Cannot decode delete metadata request", "err", err)
+		dhstore.HTTPError(w, "", http.StatusBadRequest)
+		return
+	}
+	if len(dmr.Keys) == 0 {
+		dhstore.HTTPError(w, "at least one key must be specified", http.StatusBadRequest)
+		return
+	}
+	err := s.deleteMetadataBatch(dmr.Keys)
+	s.auditMetadata(r, audit.OpDeleteMetadata, dmr.Keys, err)
+	if err != nil {
+		logger(r.Context()).Errorw("Failed to delete metadata", "count", len(dmr.Keys), "err", err)
 		s.handleError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusAccepted)
 }
 
+func (s *Server) deleteMetadataBatch(hvks []dhstore.HashedValueKey) error {
+	if bd, ok := s.dhs.(dhstore.MetadataBatchDeleter); ok {
+		return bd.DeleteMetadataBatch(hvks)
+	}
+	for _, hvk := range hvks {
+		if err := s.dhs.DeleteMetadata(hvk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *Server) handleMetadataSubtree(w http.ResponseWriter, r *http.Request) {
 	if s.metrics != nil {
 		ws := newResponseWriterWithStatus(w)
 		w = ws
-		start := time.Now()
+		start := s.clock.Now()
 		defer func() {
-			s.metrics.RecordHttpLatency(context.Background(), time.Since(start), r.Method, "metadata", ws.status)
+			s.metrics.RecordHttpLatency(r.Context(), s.clock.Since(start), r.Method, "metadata", ws.status)
 		}()
 	}
 
@@ -417,7 +1146,7 @@ func (s *Server) handleMetadataSubtree(w http.ResponseWriter, r *http.Request) {
 	default:
 		w.Header().Add("Allow", http.MethodGet)
 		w.Header().Add("Allow", http.MethodDelete)
-		http.Error(w, "", http.StatusMethodNotAllowed)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -425,25 +1154,28 @@ func (s *Server) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
 	sk := path.Base(r.URL.Path)
 	hvk, err := base58.Decode(sk)
 	if err != nil {
-		log.Errorw("Cannot decode metadata key as base58", "err", err, "key", sk)
-		http.Error(w, fmt.Sprintf("cannot decode key %s as base58: %s", sk, err.Error()), http.StatusBadRequest)
+		logger(r.Context()).Errorw("Cannot decode metadata key as base58", "err", err, "key", sk)
+		dhstore.ErrorResponse{
+			Code:    dhstore.ErrorCodeBadKey,
+			Message: fmt.Sprintf("cannot decode key %s as base58: %s", sk, err.Error()),
+		}.Write(w, http.StatusBadRequest)
 		return
 	}
 	emd, err := s.FindMetadata(r.Context(), hvk)
 	if err != nil {
-		log.Errorw("Failed to find metadata", "err", err)
+		logger(r.Context()).Errorw("Failed to find metadata", "err", err)
 		s.handleError(w, err)
 		return
 	}
 	if len(emd) == 0 {
-		http.Error(w, "", http.StatusNotFound)
+		dhstore.HTTPError(w, "", http.StatusNotFound)
 		return
 	}
 	gmr := GetMetadataResponse{
 		EncryptedMetadata: emd,
 	}
 	if err = json.NewEncoder(w).Encode(gmr); err != nil {
-		log.Errorw("Failed to write get metadata response", "err", err, "key", sk)
+		logger(r.Context()).Errorw("Failed to write get metadata response", "err", err, "key", sk)
 	}
 }
 
@@ -451,13 +1183,18 @@ func (s *Server) handleDeleteMetadata(w http.ResponseWriter, r *http.Request) {
 	sk := path.Base(r.URL.Path)
 	b, err := base58.Decode(sk)
 	if err != nil {
-		log.Errorw("Cannot decode metadata key as base58", "err", err, "key", sk)
-		http.Error(w, fmt.Sprintf("cannot decode key %s as base58: %s", sk, err.Error()), http.StatusBadRequest)
+		logger(r.Context()).Errorw("Cannot decode metadata key as base58", "err", err, "key", sk)
+		dhstore.ErrorResponse{
+			Code:    dhstore.ErrorCodeBadKey,
+			Message: fmt.Sprintf("cannot decode key %s as base58: %s", sk, err.Error()),
+		}.Write(w, http.StatusBadRequest)
 		return
 	}
 	hvk := dhstore.HashedValueKey(b)
-	if err = s.dhs.DeleteMetadata(hvk); err != nil {
-		log.Errorw("Failed to delete metadata", "err", err)
+	err = s.dhs.DeleteMetadata(hvk)
+	s.auditMetadata(r, audit.OpDeleteMetadata, []dhstore.HashedValueKey{hvk}, err)
+	if err != nil {
+		logger(r.Context()).Errorw("Failed to delete metadata", "err", err)
 		s.handleError(w, err)
 		return
 	}
@@ -466,14 +1203,31 @@ func (s *Server) handleDeleteMetadata(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.Header().Set("Allow", http.MethodGet)
-		http.Error(w, "", http.StatusMethodNotAllowed)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
 		return
 	}
 
 	w.Header().Set("Cache-Control", "no-cache")
-	http.Error(w, dhstore.Version, http.StatusOK)
+	if s.draining.Load() {
+		dhstore.HTTPError(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if hr, ok := s.dhs.(dhstore.HealthReporter); ok {
+		if err := hr.Healthy(); err != nil {
+			logger(r.Context()).Warnw("Store is not ready", "err", err)
+			dhstore.HTTPError(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	// The build and store format are reported along with readiness, so that
+	// they can be included in bug reports.
+	body := s.buildInfo
+	if fr, ok := s.dhs.(dhstore.FormatReporter); ok {
+		body += "\nstore format: " + fr.StoreFormat()
+	}
+	http.Error(w, body, http.StatusOK)
 }
 
 func (s *Server) handleCatchAll(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "", http.StatusNotFound)
+	dhstore.HTTPError(w, "", http.StatusNotFound)
 }
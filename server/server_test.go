@@ -1,27 +1,53 @@
 package server_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/audit"
+	"github.com/ipni/dhstore/auth"
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/internal/testutil"
+	"github.com/ipni/dhstore/limit"
+	"github.com/ipni/dhstore/load"
 	"github.com/ipni/dhstore/metrics"
+	"github.com/ipni/dhstore/pb"
 	"github.com/ipni/dhstore/pebble"
+	"github.com/ipni/dhstore/prune"
 	"github.com/ipni/dhstore/server"
+	"github.com/ipni/dhstore/watch"
 	"github.com/ipni/go-libipni/dhash"
 	"github.com/ipni/go-libipni/find/model"
+	"github.com/ipni/go-libipni/metadata"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/mr-tron/base58"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multibase"
 	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestNewServeMux(t *testing.T) {
@@ -68,7 +94,8 @@ func TestNewServeMux(t *testing.T) {
 			onTarget:     "/multihash",
 			onBody:       "{}",
 			expectStatus: http.StatusBadRequest,
-			expectBody:   "at least one merge must be specified",
+			expectBody:   `{"code": "bad_request", "message": "at least one merge must be specified"}`,
+			expectJSON:   true,
 		},
 		{
 			name:         "PUT /multihash with no merges is 400",
@@ -76,7 +103,8 @@ func TestNewServeMux(t *testing.T) {
 			onTarget:     "/multihash",
 			onBody:       "{}",
 			expectStatus: http.StatusBadRequest,
-			expectBody:   "at least one merge must be specified",
+			expectBody:   `{"code": "bad_request", "message": "at least one merge must be specified"}`,
+			expectJSON:   true,
 		},
 		{
 			name:         "PUT /multihash with invalid multihash is 400",
@@ -91,7 +119,8 @@ func TestNewServeMux(t *testing.T) {
 			onTarget:     "/multihash",
 			onBody:       `{ "merges": [{ "key": "EiC0dKmaJwXiPPkFpITsbRTvWLVrvmLpKSeDRm7DY7UHLQ==", "value": "ZmlzaA==" }] }`,
 			expectStatus: http.StatusBadRequest,
-			expectBody:   "multihash must be of code dbl-sha2-256, got: sha2-256",
+			expectBody:   `{"code": "unsupported_codec", "message": "multihash must be of code dbl-sha2-256, got: sha2-256"}`,
+			expectJSON:   true,
 		},
 		{
 			name:         "DELETE /multihash with valid non-dbl-sha2-256 multihash is 400",
@@ -99,7 +128,8 @@ func TestNewServeMux(t *testing.T) {
 			onTarget:     "/multihash",
 			onBody:       `{ "merges": [{ "key": "EiC0dKmaJwXiPPkFpITsbRTvWLVrvmLpKSeDRm7DY7UHLQ==", "value": "ZmlzaA==" }] }`,
 			expectStatus: http.StatusBadRequest,
-			expectBody:   "multihash must be of code dbl-sha2-256, got: sha2-256",
+			expectBody:   `{"code": "unsupported_codec", "message": "multihash must be of code dbl-sha2-256, got: sha2-256"}`,
+			expectJSON:   true,
 		},
 		{
 			name:         "PUT /multihash with invalid value is 400",
@@ -133,28 +163,32 @@ func TestNewServeMux(t *testing.T) {
 			onMethod:     http.MethodGet,
 			onTarget:     "/multihash/asda",
 			expectStatus: http.StatusBadRequest,
-			expectBody:   "length greater than remaining number of bytes in buffer",
+			expectBody:   `{"code": "bad_multihash", "message": "length greater than remaining number of bytes in buffer"}`,
+			expectJSON:   true,
 		},
 		{
 			name:         "GET /multihash/subtree with invalid varint is 400",
 			onMethod:     http.MethodGet,
 			onTarget:     "/multihash/Quickfish",
 			expectStatus: http.StatusBadRequest,
-			expectBody:   "varint not minimally encoded",
+			expectBody:   `{"code": "bad_multihash", "message": "varint not minimally encoded"}`,
+			expectJSON:   true,
 		},
 		{
 			name:         "GET /multihash/subtree with invalid multihash is 400",
 			onMethod:     http.MethodGet,
 			onTarget:     "/multihash/Qmackerel",
 			expectStatus: http.StatusBadRequest,
-			expectBody:   "input isn't valid multihash",
+			expectBody:   `{"code": "bad_multihash", "message": "input isn't valid multihash"}`,
+			expectJSON:   true,
 		},
 		{
 			name:         "GET /multihash/subtree with valid non-dbl-sha2-256 multihash an no dhfind is 400",
 			onMethod:     http.MethodGet,
 			onTarget:     "/multihash/QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH",
 			expectStatus: http.StatusBadRequest,
-			expectBody:   "unencrypted lookup not available when dhfind not enabled",
+			expectBody:   `{"code": "unsupported_codec", "message": "unencrypted lookup not available when dhfind not enabled"}`,
+			expectJSON:   true,
 		},
 		{
 			name:         "GET /multihash/subtree with valid non-dbl-sha2-256 multihash and dhfind is 404",
@@ -208,7 +242,8 @@ func TestNewServeMux(t *testing.T) {
 			onMethod:       http.MethodGet,
 			onTarget:       "/multihash/asda",
 			expectStatus:   http.StatusBadRequest,
-			expectBody:     "length greater than remaining number of bytes in buffer",
+			expectBody:     `{"code": "bad_multihash", "message": "length greater than remaining number of bytes in buffer"}`,
+			expectJSON:     true,
 		},
 		{
 			name:           "streaming GET /multihash/subtree with invalid varint is 400",
@@ -216,7 +251,8 @@ func TestNewServeMux(t *testing.T) {
 			onMethod:       http.MethodGet,
 			onTarget:       "/multihash/Quickfish",
 			expectStatus:   http.StatusBadRequest,
-			expectBody:     "varint not minimally encoded",
+			expectBody:     `{"code": "bad_multihash", "message": "varint not minimally encoded"}`,
+			expectJSON:     true,
 		},
 		{
 			name:           "streaming GET /encrypted/multihash/subtree with bad length is 400",
@@ -224,7 +260,8 @@ func TestNewServeMux(t *testing.T) {
 			onMethod:       http.MethodGet,
 			onTarget:       "/encrypted/multihash/asda",
 			expectStatus:   http.StatusBadRequest,
-			expectBody:     "length greater than remaining number of bytes in buffer",
+			expectBody:     `{"code": "bad_multihash", "message": "length greater than remaining number of bytes in buffer"}`,
+			expectJSON:     true,
 		},
 		{
 			name:           "streaming GET /encrypted/multihash/subtree with invalid varint is 400",
@@ -232,7 +269,8 @@ func TestNewServeMux(t *testing.T) {
 			onMethod:       http.MethodGet,
 			onTarget:       "/encrypted/multihash/Quickfish",
 			expectStatus:   http.StatusBadRequest,
-			expectBody:     "varint not minimally encoded",
+			expectBody:     `{"code": "bad_multihash", "message": "varint not minimally encoded"}`,
+			expectJSON:     true,
 		},
 		{
 			name:           "streaming GET /multihash/subtree with invalid multihash is 400",
@@ -240,7 +278,8 @@ func TestNewServeMux(t *testing.T) {
 			onMethod:       http.MethodGet,
 			onTarget:       "/multihash/Qmackerel",
 			expectStatus:   http.StatusBadRequest,
-			expectBody:     "input isn't valid multihash",
+			expectBody:     `{"code": "bad_multihash", "message": "input isn't valid multihash"}`,
+			expectJSON:     true,
 		},
 		{
 			name:           "streaming GET /encrypted/multihash/subtree with invalid multihash is 400",
@@ -248,7 +287,8 @@ func TestNewServeMux(t *testing.T) {
 			onMethod:       http.MethodGet,
 			onTarget:       "/encrypted/multihash/Qmackerel",
 			expectStatus:   http.StatusBadRequest,
-			expectBody:     "input isn't valid multihash",
+			expectBody:     `{"code": "bad_multihash", "message": "input isn't valid multihash"}`,
+			expectJSON:     true,
 		},
 		{
 			name:           "streaming GET /multihash/subtree with valid non-dbl-sha2-256 multihash is 400",
@@ -256,7 +296,8 @@ func TestNewServeMux(t *testing.T) {
 			onMethod:       http.MethodGet,
 			onTarget:       "/multihash/QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH",
 			expectStatus:   http.StatusBadRequest,
-			expectBody:     "unencrypted lookup not available when dhfind not enabled",
+			expectBody:     `{"code": "unsupported_codec", "message": "unencrypted lookup not available when dhfind not enabled"}`,
+			expectJSON:     true,
 		},
 		{
 			name:           "streaming GET /multihash/subtree with valid non-dbl-sha2-256 multihash and dhfind is 404",
@@ -359,6 +400,64 @@ func TestNewServeMux(t *testing.T) {
 	}
 }
 
+func TestInFlightMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	m, err := metrics.New(addr, nil)
+	require.NoError(t, err)
+	require.NoError(t, m.Start(context.Background()))
+	defer m.Shutdown(context.Background())
+	scrape := func() string {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return string(body)
+	}
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	block := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entered <- struct{}{}
+			<-release
+			next.ServeHTTP(w, r)
+		})
+	}
+	s, err := server.New(store, "", server.WithMetrics(m), server.WithMiddleware(block))
+	require.NoError(t, err)
+
+	// Requests are labelled by route and standard method, so that arbitrary
+	// paths and methods do not each get a series.
+	var wg sync.WaitGroup
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPatch, "/metadata/fish", nil),
+		httptest.NewRequest("BREW", "/metadata/lobster", nil),
+		httptest.NewRequest(http.MethodPatch, "/no/such/route", nil),
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+		}()
+		<-entered
+	}
+	body := scrape()
+	require.Contains(t, body, `ipni_dhstore_http_in_flight{method="PATCH",path="metadata"} 1`)
+	require.Contains(t, body, `ipni_dhstore_http_in_flight{method="other",path="metadata"} 1`)
+	require.Contains(t, body, `ipni_dhstore_http_in_flight{method="PATCH",path="other"} 1`)
+
+	close(release)
+	wg.Wait()
+	require.Contains(t, scrape(), `ipni_dhstore_http_in_flight{method="PATCH",path="metadata"} 0`)
+}
+
 func TestDHFind(t *testing.T) {
 	provServ := httptest.NewServer(http.HandlerFunc(providersHandler))
 
@@ -439,10 +538,21 @@ func TestDHFind(t *testing.T) {
 	got = httptest.NewRecorder()
 	subject.ServeHTTP(got, given)
 	require.Equal(t, http.StatusNotFound, got.Code)
+
+	// dhfind can be disabled and re-enabled at runtime.
+	require.NoError(t, s.SetProvidersURLs(nil))
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String(), nil))
+	require.Equal(t, http.StatusBadRequest, got.Code)
+	require.NoError(t, s.SetProvidersURLs([]string{provServ.URL}))
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String(), nil))
+	require.Equal(t, http.StatusNotFound, got.Code)
 }
 
-func TestGetDeleteIndexes(t *testing.T) {
+func TestLegacyFindAPI(t *testing.T) {
 	provServ := httptest.NewServer(http.HandlerFunc(providersHandler))
+	defer provServ.Close()
 
 	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
 	require.NoError(t, err)
@@ -450,205 +560,3006 @@ func TestGetDeleteIndexes(t *testing.T) {
 
 	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
 	require.NoError(t, err)
-
-	const providerID = "12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA"
-	pid, err := peer.Decode(providerID)
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
 	require.NoError(t, err)
-	const providerID2 = "12D3KooWQk7r5WKUfTn9dVntWnmvfHfVBaghWtDdZNkRExQ7NwK1"
-	pid2, err := peer.Decode(providerID2)
+	loadStore(t, origMh, []byte("fish"), []byte("lobster"), pid, store)
+	absentMh, err := multihash.Sum([]byte("barreleye"), multihash.SHA2_256, -1)
 	require.NoError(t, err)
 
-	ctxID := []byte("fish")
-	metadata := []byte("lobster")
-	ctxID2 := []byte("rodent")
-	metadata2 := []byte("squirrel")
-
-	dhMh := loadStore(t, origMh, ctxID, metadata, pid, store)
-	dhMh2 := loadStore(t, origMh, ctxID2, metadata2, pid2, store)
+	_, err = server.New(store, "", server.WithLegacyFindAPI(true), server.WithEncryptedLookupsOnly(true))
+	require.ErrorContains(t, err, "requires unencrypted lookups")
 
-	s, err := server.New(store, "", server.WithDHFind(provServ.URL))
+	s, err := server.New(store, "", server.WithDHFind(provServ.URL), server.WithLegacyFindAPI(true), server.WithPreferJSON(false))
 	require.NoError(t, err)
 	subject := s.Handler()
+	find := func(body string) *httptest.ResponseRecorder {
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodPost, "/multihash", strings.NewReader(body)))
+		return got
+	}
 
-	// Get encrypted multihash find response.
-	given := httptest.NewRequest(http.MethodGet, "/encrypted/multihash/"+dhMh.B58String(), nil)
-	got := httptest.NewRecorder()
-	subject.ServeHTTP(got, given)
+	// Batch finds respond with the results of the found multihashes only.
+	body, err := json.Marshal(map[string][]multihash.Multihash{"Multihashes": {absentMh, origMh}})
+	require.NoError(t, err)
+	got := find(string(body))
 	require.Equal(t, http.StatusOK, got.Code)
-	gotBody, err := io.ReadAll(got.Body)
+	findRsp, err := model.UnmarshalFindResponse(got.Body.Bytes())
 	require.NoError(t, err)
-	t.Log("Got encrypted find response using double-hashed multihash:", string(gotBody))
-	findRsp, err := model.UnmarshalFindResponse(gotBody)
+	require.Len(t, findRsp.MultihashResults, 1)
+	require.Equal(t, origMh, findRsp.MultihashResults[0].Multihash)
+	require.Len(t, findRsp.MultihashResults[0].ProviderResults, 1)
+	require.Equal(t, pid, findRsp.MultihashResults[0].ProviderResults[0].Provider.ID)
+
+	body, err = json.Marshal(map[string][]multihash.Multihash{"Multihashes": {absentMh}})
 	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, find(string(body)).Code)
+	require.Equal(t, http.StatusBadRequest, find(`{"Multihashes": []}`).Code)
+	require.Equal(t, http.StatusBadRequest, find(`{"Multihashes": ["ZmlzaA=="]}`).Code)
 
-	// Check that encrypted find response is correct.
-	require.Len(t, findRsp.MultihashResults, 0)
-	require.Len(t, findRsp.EncryptedMultihashResults, 1)
-	encMhResult := findRsp.EncryptedMultihashResults[0]
-	require.Len(t, encMhResult.EncryptedValueKeys, 2)
-	evk := encMhResult.EncryptedValueKeys[0]
-	vk, err := dhash.DecryptValueKey(evk, origMh)
+	// Single lookups without an Accept header are responded to as JSON
+	// despite JSON not being preferred.
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String(), nil))
+	require.Equal(t, http.StatusOK, got.Code)
+	findRsp, err = model.UnmarshalFindResponse(got.Body.Bytes())
 	require.NoError(t, err)
-	respPid, respCtxID, err := dhash.SplitValueKey(vk)
+	require.Len(t, findRsp.MultihashResults, 1)
+
+	// Batch finds are reads, and are otherwise not allowed.
+	s, err = server.New(store, "", server.WithDHFind(provServ.URL), server.WithLegacyFindAPI(true), server.WithWriteListenAddr("127.0.0.1:0"))
 	require.NoError(t, err)
-	require.Equal(t, pid, respPid)
-	require.Equal(t, ctxID, respCtxID)
+	got = httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodPost, "/multihash", bytes.NewReader(body)))
+	require.Equal(t, http.StatusNotFound, got.Code)
+	s, err = server.New(store, "", server.WithDHFind(provServ.URL))
+	require.NoError(t, err)
+	got = httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodPost, "/multihash", bytes.NewReader(body)))
+	require.Equal(t, http.StatusMethodNotAllowed, got.Code)
+}
 
-	evk2 := encMhResult.EncryptedValueKeys[1]
-	vk2, err := dhash.DecryptValueKey(evk2, origMh)
+func TestProvidersProxy(t *testing.T) {
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
 	require.NoError(t, err)
-	respPid2, respCtxID2, err := dhash.SplitValueKey(vk2)
+	var lists atomic.Int32
+	provServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/providers" {
+			providersHandler(w, r)
+			return
+		}
+		lists.Add(1)
+		data, err := json.Marshal([]model.ProviderInfo{{AddrInfo: peer.AddrInfo{ID: pid}}})
+		if err != nil {
+			panic(err.Error())
+		}
+		writeJsonResponse(w, http.StatusOK, data)
+	}))
+	defer provServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
 	require.NoError(t, err)
-	require.Equal(t, pid2, respPid2)
-	require.Equal(t, ctxID2, respCtxID2)
+	defer store.Close()
 
-	// Get metadata for find response.
-	hvk := dhash.SHA256(vk, nil)
-	given = httptest.NewRequest(http.MethodGet, "/metadata/"+base58.Encode(hvk), nil)
-	given.Header.Add("Accept", "application/json")
-	got = httptest.NewRecorder()
-	subject.ServeHTTP(got, given)
-	require.Equal(t, http.StatusOK, got.Code)
-	gotBody, err = io.ReadAll(got.Body)
+	s, err := server.New(store, "")
 	require.NoError(t, err)
-	require.NotZero(t, len(gotBody))
+	got := httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/providers", nil))
+	require.Equal(t, http.StatusNotImplemented, got.Code)
 
-	type GetMetadataResponse struct {
-		EncryptedMetadata []byte `json:"EncryptedMetadata"`
+	s, err = server.New(store, "", server.WithDHFind(provServ.URL))
+	require.NoError(t, err)
+	subject := s.Handler()
+	get := func(target string) *httptest.ResponseRecorder {
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, target, nil))
+		return got
 	}
 
-	// Check that metadata descrypts and is correct.
-	findResponse := &GetMetadataResponse{}
-	err = json.Unmarshal(gotBody, findResponse)
+	// The list of providers is fetched once and then served from cache.
+	got = get("/providers")
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, "public, max-age=60", got.Header().Get("Cache-Control"))
+	var infos []model.ProviderInfo
+	require.NoError(t, json.Unmarshal(got.Body.Bytes(), &infos))
+	require.Len(t, infos, 1)
+	before := lists.Load()
+	require.Equal(t, http.StatusOK, get("/providers").Code)
+	require.Equal(t, before, lists.Load())
+
+	got = get("/providers/" + pid.String())
+	require.Equal(t, http.StatusOK, got.Code)
+	var info model.ProviderInfo
+	require.NoError(t, json.Unmarshal(got.Body.Bytes(), &info))
+	require.Equal(t, pid, info.AddrInfo.ID)
+
+	require.Equal(t, http.StatusBadRequest, get("/providers/fish").Code)
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, httptest.NewRequest(http.MethodPost, "/providers", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, got.Code)
+}
+
+func TestBatchFind(t *testing.T) {
+	provServ := httptest.NewServer(http.HandlerFunc(providersHandler))
+	defer provServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
 	require.NoError(t, err)
-	encMetadata := findResponse.EncryptedMetadata
-	require.NotZero(t, len(encMetadata))
-	respMeta, err := dhash.DecryptMetadata(encMetadata, vk)
+	defer store.Close()
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
 	require.NoError(t, err)
-	require.Equal(t, metadata, respMeta)
-
-	// Delete first provider from from index.
-	mergeReq := makeMergeReq(dhMh, evk)
-	reqData, err := json.Marshal(mergeReq)
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	loadStore(t, origMh, []byte("fish"), []byte("lobster"), pid, store)
+	cidMh, err := multihash.Sum([]byte("anglerfish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	loadStore(t, cidMh, []byte("crab"), []byte("lobster"), pid, store)
+	absentMh, err := multihash.Sum([]byte("barreleye"), multihash.SHA2_256, -1)
 	require.NoError(t, err)
-	given = httptest.NewRequest(http.MethodDelete, "/multihash", bytes.NewBuffer(reqData))
-	got = httptest.NewRecorder()
-	subject.ServeHTTP(got, given)
-	require.Equal(t, http.StatusAccepted, got.Code)
 
-	// Check that first provider is deleted
-	given = httptest.NewRequest(http.MethodGet, "/encrypted/multihash/"+dhMh.B58String(), nil)
-	got = httptest.NewRecorder()
-	subject.ServeHTTP(got, given)
-	require.Equal(t, http.StatusOK, got.Code)
-	gotBody, err = io.ReadAll(got.Body)
+	find := func(s *server.Server, body string) *httptest.ResponseRecorder {
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodPost, "/multihash/batch", strings.NewReader(body)))
+		return got
+	}
+	s, err := server.New(store, "")
 	require.NoError(t, err)
-	t.Log("Got encrypted find response using double-hashed multihash:", string(gotBody))
-	findRsp, err = model.UnmarshalFindResponse(gotBody)
+	require.Equal(t, http.StatusNotImplemented, find(s, `{"CIDs": []}`).Code)
+
+	// Batch finds are reads.
+	s, err = server.New(store, "", server.WithDHFind(provServ.URL), server.WithWriteListenAddr("127.0.0.1:0"))
 	require.NoError(t, err)
-	require.Len(t, findRsp.EncryptedMultihashResults, 1)
-	encMhResult = findRsp.EncryptedMultihashResults[0]
-	require.Len(t, encMhResult.EncryptedValueKeys, 1)
-	require.Equal(t, evk2, encMhResult.EncryptedValueKeys[0])
+	defer s.Shutdown(context.Background())
 
-	// Delete 2nd provider from index.
-	mergeReq = makeMergeReq(dhMh2, evk2)
-	reqData, err = json.Marshal(mergeReq)
+	body, err := json.Marshal(map[string]any{
+		"Multihashes": []multihash.Multihash{absentMh, origMh},
+		"CIDs":        []string{cid.NewCidV1(cid.Raw, cidMh).String()},
+	})
 	require.NoError(t, err)
-	given = httptest.NewRequest(http.MethodDelete, "/multihash", bytes.NewBuffer(reqData))
-	got = httptest.NewRecorder()
-	subject.ServeHTTP(got, given)
-	require.Equal(t, http.StatusAccepted, got.Code)
+	got := find(s, string(body))
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, "application/x-ndjson", got.Header().Get("Content-Type"))
+	found := make(map[string][]byte)
+	scanner := bufio.NewScanner(got.Body)
+	for scanner.Scan() {
+		var result model.MultihashResult
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &result))
+		require.Len(t, result.ProviderResults, 1)
+		require.Equal(t, pid, result.ProviderResults[0].Provider.ID)
+		found[result.Multihash.B58String()] = result.ProviderResults[0].ContextID
+	}
+	require.Equal(t, map[string][]byte{origMh.B58String(): []byte("fish"), cidMh.B58String(): []byte("crab")}, found)
 
-	// Check that index is now completely deleted.
-	given = httptest.NewRequest(http.MethodGet, "/encrypted/multihash/"+dhMh.B58String(), nil)
-	got = httptest.NewRecorder()
-	subject.ServeHTTP(got, given)
-	require.Equal(t, http.StatusNotFound, got.Code)
+	require.Equal(t, http.StatusBadRequest, find(s, `{}`).Code)
+	require.Equal(t, http.StatusBadRequest, find(s, `{"CIDs": ["fish"]}`).Code)
+	require.Equal(t, http.StatusBadRequest, find(s, `{"Multihashes": ["ZmlzaA=="]}`).Code)
 }
 
-func makeMergeReq(dhMh multihash.Multihash, evk dhstore.EncryptedValueKey) server.MergeIndexRequest {
-	idx := dhstore.Index{
-		Key:   dhMh,
-		Value: evk,
-	}
-	return server.MergeIndexRequest{
-		Merges: []dhstore.Index{idx},
+func TestProvidersCircuitBreaker(t *testing.T) {
+	downServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "", http.StatusServiceUnavailable)
+	}))
+	defer downServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	require.NoError(t, err)
+	dhMh := loadStore(t, origMh, []byte("fish"), []byte("lobster"), pid, store)
+
+	_, err = server.New(store, "", server.WithProvidersCircuitBreaker(1, 0))
+	require.ErrorContains(t, err, "cooldown must be positive")
+
+	// Preloading the provider cache fails, which opens the breaker.
+	clk := clock.NewMock(time.Unix(0, 0))
+	s, err := server.New(store, "", server.WithDHFind(downServ.URL), server.WithProvidersCheckInterval(0), server.WithClock(clk),
+		server.WithProvidersCircuitBreaker(1, time.Minute))
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+	get := func(target string) *httptest.ResponseRecorder {
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, target, nil))
+		return got
 	}
+
+	got := get("/multihash/" + origMh.B58String())
+	require.Equal(t, http.StatusServiceUnavailable, got.Code)
+	var errRsp dhstore.ErrorResponse
+	require.NoError(t, json.Unmarshal(got.Body.Bytes(), &errRsp))
+	require.Equal(t, dhstore.ErrorCodeUnavailable, errRsp.Code)
+	require.Equal(t, http.StatusOK, get("/encrypted/multihash/"+dhMh.B58String()).Code)
+
+	// Lookups are resolved again once the cooldown elapses.
+	clk.Add(time.Minute)
+	require.Equal(t, http.StatusNotFound, get("/multihash/"+origMh.B58String()).Code)
+	require.Equal(t, http.StatusServiceUnavailable, get("/multihash/"+origMh.B58String()).Code)
 }
 
-func loadStore(t *testing.T, origMh multihash.Multihash, ctxID, metadata []byte, providerID peer.ID, store *pebble.PebbleDHStore) multihash.Multihash {
-	vk := dhash.CreateValueKey(providerID, ctxID)
+func TestDHFindFilterProtocol(t *testing.T) {
+	provServ := httptest.NewServer(http.HandlerFunc(providersHandler))
+	defer provServ.Close()
 
-	encMeta, err := dhash.EncryptMetadata(metadata, vk)
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
 	require.NoError(t, err)
-
-	err = store.PutMetadata(dhash.SHA256(vk, nil), encMeta)
+	defer store.Close()
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
 	require.NoError(t, err)
+	bitswapMd := metadata.Default.New(metadata.Bitswap{})
+	bitswap, err := bitswapMd.MarshalBinary()
+	require.NoError(t, err)
+	gatewayMd := metadata.Default.New(metadata.IpfsGatewayHttp{})
+	gateway, err := gatewayMd.MarshalBinary()
+	require.NoError(t, err)
+	loadStore(t, origMh, []byte("fish"), bitswap, pid, store)
+	loadStore(t, origMh, []byte("crab"), gateway, pid, store)
+	loadStore(t, origMh, []byte("lobster"), []byte("lobster"), pid, store)
 
-	// Encrypt value key with original multihash.
-	encValueKey, err := dhash.EncryptValueKey(vk, origMh)
+	s, err := server.New(store, "", server.WithDHFind(provServ.URL))
 	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+	lookup := func(query string) *httptest.ResponseRecorder {
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String()+query, nil))
+		return got
+	}
+	ctxIDs := func(query string) []string {
+		got := lookup(query)
+		require.Equal(t, http.StatusOK, got.Code)
+		findRsp, err := model.UnmarshalFindResponse(got.Body.Bytes())
+		require.NoError(t, err)
+		require.Len(t, findRsp.MultihashResults, 1)
+		var ctxIDs []string
+		for _, pr := range findRsp.MultihashResults[0].ProviderResults {
+			ctxIDs = append(ctxIDs, string(pr.ContextID))
+		}
+		return ctxIDs
+	}
 
-	mh2 := dhash.SecondMultihash(origMh)
-	err = store.MergeIndexes([]dhstore.Index{
-		{
-			Key:   mh2,
-			Value: []byte(encValueKey),
+	require.ElementsMatch(t, []string{"fish", "crab", "lobster"}, ctxIDs(""))
+	require.ElementsMatch(t, []string{"fish"}, ctxIDs("?filter-protocol=transport-bitswap"))
+	require.ElementsMatch(t, []string{"fish", "crab"}, ctxIDs("?filter-protocol=transport-bitswap,transport-ipfs-gateway-http"))
+	require.ElementsMatch(t, []string{"crab", "lobster"}, ctxIDs("?filter-protocol=transport-ipfs-gateway-http&filter-protocol=unknown"))
+	require.Equal(t, http.StatusNotFound, lookup("?filter-protocol=transport-graphsync-filecoinv1").Code)
+	require.Equal(t, http.StatusBadRequest, lookup("?filter-protocol=fish").Code)
+
+	got := httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/routing/v1/providers/"+cid.NewCidV1(cid.Raw, origMh).String()+"?filter-protocol=transport-bitswap", nil))
+	require.Equal(t, http.StatusOK, got.Code)
+	var routing struct{ Providers []map[string]any }
+	require.NoError(t, json.Unmarshal(got.Body.Bytes(), &routing))
+	require.Len(t, routing.Providers, 1)
+	require.Equal(t, []any{"transport-bitswap"}, routing.Providers[0]["Protocols"])
+}
+
+func TestDHFindExtendedProviders(t *testing.T) {
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	require.NoError(t, err)
+	xpid, err := peer.Decode("12D3KooWQk7r5WKUfTn9dVntWnmvfHfVBaghWtDdZNkRExQ7NwK1")
+	require.NoError(t, err)
+	xaddr, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/8080/http")
+	require.NoError(t, err)
+	bitswapMd := metadata.Default.New(metadata.Bitswap{})
+	bitswap, err := bitswapMd.MarshalBinary()
+	require.NoError(t, err)
+	gatewayMd := metadata.Default.New(metadata.IpfsGatewayHttp{})
+	gateway, err := gatewayMd.MarshalBinary()
+	require.NoError(t, err)
+	info := model.ProviderInfo{
+		AddrInfo: peer.AddrInfo{ID: pid},
+		ExtendedProviders: &model.ExtendedProviders{
+			Providers: []peer.AddrInfo{{ID: xpid, Addrs: []multiaddr.Multiaddr{xaddr}}},
+			Metadatas: [][]byte{gateway},
 		},
-	})
+	}
+	provServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v any = info
+		if r.URL.Path == "/providers" {
+			v = []model.ProviderInfo{info}
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			panic(err.Error())
+		}
+		writeJsonResponse(w, http.StatusOK, data)
+	}))
+	defer provServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
 	require.NoError(t, err)
+	loadStore(t, origMh, []byte("fish"), bitswap, pid, store)
 
-	return mh2
+	lookup := func(opts ...server.Option) []model.ProviderResult {
+		s, err := server.New(store, "", append(opts, server.WithDHFind(provServ.URL))...)
+		require.NoError(t, err)
+		defer s.Shutdown(context.Background())
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String(), nil))
+		require.Equal(t, http.StatusOK, got.Code)
+		findRsp, err := model.UnmarshalFindResponse(got.Body.Bytes())
+		require.NoError(t, err)
+		require.Len(t, findRsp.MultihashResults, 1)
+		return findRsp.MultihashResults[0].ProviderResults
+	}
+
+	prs := lookup()
+	require.Len(t, prs, 2)
+	require.Equal(t, pid, prs[0].Provider.ID)
+	require.Equal(t, bitswap, []byte(prs[0].Metadata))
+	require.Equal(t, xpid, prs[1].Provider.ID)
+	require.Equal(t, []multiaddr.Multiaddr{xaddr}, prs[1].Provider.Addrs)
+	require.Equal(t, gateway, []byte(prs[1].Metadata))
+
+	prs = lookup(server.WithExtendedProviders(false))
+	require.Len(t, prs, 1)
+	require.Equal(t, pid, prs[0].Provider.ID)
 }
 
-func deleteMetadata(t *testing.T, ctxID []byte, providerID peer.ID, store *pebble.PebbleDHStore) {
-	vk := dhash.CreateValueKey(providerID, ctxID)
+func TestDHFindMissCache(t *testing.T) {
+	provServ := httptest.NewServer(http.HandlerFunc(providersHandler))
+	defer provServ.Close()
 
-	err := store.DeleteMetadata(dhash.SHA256(vk, nil))
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
 	require.NoError(t, err)
-}
 
-func providersHandler(w http.ResponseWriter, req *http.Request) {
-	defer req.Body.Close()
+	_, err = server.New(store, "", server.WithDHFindMissTTL(-time.Second))
+	require.ErrorContains(t, err, "cannot be negative")
 
-	providerID, err := peer.Decode(path.Base(req.URL.Path))
-	if err != nil {
-		fmt.Println("Cannot get provider ID:", err)
+	clk := clock.NewMock(time.Unix(0, 0))
+	s, err := server.New(store, "", server.WithDHFind(provServ.URL), server.WithDHFindMissTTL(time.Minute), server.WithClock(clk))
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+	subject := s.Handler()
+	lookup := func() int {
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String(), nil))
+		return got.Code
 	}
 
-	maddr, _ := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9876")
+	// Multihashes indexed after a miss are only found once it expires.
+	require.Equal(t, http.StatusNotFound, lookup())
+	loadStore(t, origMh, []byte("fish"), []byte("lobster"), pid, store)
+	require.Equal(t, http.StatusNotFound, lookup())
+	clk.Add(time.Minute)
+	require.Equal(t, http.StatusOK, lookup())
+	require.Equal(t, http.StatusOK, lookup())
+}
 
-	ai := peer.AddrInfo{
-		ID:    providerID,
-		Addrs: []multiaddr.Multiaddr{maddr},
+func TestDHFindLimits(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	provServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "12D3KooWQk7r5WKUfTn9dVntWnmvfHfVBaghWtDdZNkRExQ7NwK1") {
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		providersHandler(w, r)
+	}))
+	defer provServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	require.NoError(t, err)
+	for _, ctxID := range []string{"fish", "lobster", "crab"} {
+		loadStore(t, origMh, []byte(ctxID), []byte("barreleye"), pid, store)
 	}
+	slowMh, err := multihash.Sum([]byte("anglerfish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	slowPid, err := peer.Decode("12D3KooWQk7r5WKUfTn9dVntWnmvfHfVBaghWtDdZNkRExQ7NwK1")
+	require.NoError(t, err)
+	loadStore(t, slowMh, []byte("fish"), []byte("barreleye"), slowPid, store)
 
-	pinfo := model.ProviderInfo{
-		AddrInfo:  ai,
-		Publisher: &ai,
+	_, err = server.New(store, "", server.WithDHFindTimeout(-time.Second))
+	require.ErrorContains(t, err, "cannot be negative")
+	_, err = server.New(store, "", server.WithDHFindParallelism(0))
+	require.ErrorContains(t, err, "at least 1")
+	_, err = server.New(store, "", server.WithDHFindMaxValueKeys(-1))
+	require.ErrorContains(t, err, "cannot be negative")
+
+	lookup := func(s *server.Server, mh multihash.Multihash) *httptest.ResponseRecorder {
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/multihash/"+mh.B58String(), nil))
+		return got
 	}
-	data, err := json.Marshal(pinfo)
-	if err != nil {
-		panic(err.Error())
+	results := func(got *httptest.ResponseRecorder) []model.ProviderResult {
+		require.Equal(t, http.StatusOK, got.Code)
+		findRsp, err := model.UnmarshalFindResponse(got.Body.Bytes())
+		require.NoError(t, err)
+		require.Len(t, findRsp.MultihashResults, 1)
+		return findRsp.MultihashResults[0].ProviderResults
 	}
 
-	if req.URL.Path == "/providers" {
-		var buf bytes.Buffer
-		buf.Grow(len(data) + 2)
-		buf.Write([]byte("["))
+	// Value keys are resolved concurrently, up to the maximum.
+	s, err := server.New(store, "", server.WithDHFind(provServ.URL), server.WithDHFindParallelism(3))
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+	prs := results(lookup(s, origMh))
+	var ctxIDs []string
+	for _, pr := range prs {
+		ctxIDs = append(ctxIDs, string(pr.ContextID))
+	}
+	require.ElementsMatch(t, []string{"fish", "lobster", "crab"}, ctxIDs)
+
+	s, err = server.New(store, "", server.WithDHFind(provServ.URL), server.WithDHFindMaxValueKeys(2))
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+	require.Len(t, results(lookup(s, origMh)), 2)
+
+	// Lookups whose provider information cannot be fetched in time time out.
+	s, err = server.New(store, "", server.WithDHFind(provServ.URL), server.WithDHFindTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+	require.Equal(t, http.StatusGatewayTimeout, lookup(s, slowMh).Code)
+	require.Len(t, results(lookup(s, origMh)), 3)
+}
+
+func TestDHFindTransport(t *testing.T) {
+	provServ := httptest.NewTLSServer(http.HandlerFunc(providersHandler))
+	defer provServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	require.NoError(t, err)
+	loadStore(t, origMh, []byte("fish"), []byte("lobster"), pid, store)
+
+	_, err = server.New(store, "", server.WithDHFindConnections(-1, 0, 0))
+	require.ErrorContains(t, err, "cannot be negative")
+	_, err = server.New(store, "", server.WithDHFindTransportTimeouts(0, -time.Second, 0))
+	require.ErrorContains(t, err, "cannot be negative")
+	custom := &http.Client{Transport: roundTripperFunc(http.DefaultTransport.RoundTrip)}
+	_, err = server.New(store, "", server.WithHTTPClient(custom), server.WithDHFindTLSSessionCache(8))
+	require.ErrorContains(t, err, "can only be tuned")
+
+	// The tuned transport keeps the TLS configuration of the client, which
+	// trusts the certificate of the providers URL.
+	s, err := server.New(store, "", server.WithDHFind(provServ.URL), server.WithHTTPClient(provServ.Client()),
+		server.WithDHFindConnections(100, time.Minute, 15*time.Second), server.WithDHFindTLSSessionCache(8),
+		server.WithDHFindTransportTimeouts(time.Second, time.Second, time.Second))
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+	got := httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String(), nil))
+	require.Equal(t, http.StatusOK, got.Code)
+}
+
+func TestDHFindFailover(t *testing.T) {
+	provServ := httptest.NewServer(http.HandlerFunc(providersHandler))
+	defer provServ.Close()
+	downServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "", http.StatusServiceUnavailable)
+	}))
+	defer downServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	require.NoError(t, err)
+	loadStore(t, origMh, []byte("fish"), []byte("lobster"), pid, store)
+
+	_, err = server.New(store, "", server.WithDHFind(provServ.URL+";weight=fish"))
+	require.ErrorContains(t, err, "invalid weight")
+	_, err = server.New(store, "", server.WithProvidersCheckInterval(-time.Second))
+	require.ErrorContains(t, err, "cannot be negative")
+
+	// Lookups fail over from the preferred providers URL while it is down.
+	s, err := server.New(store, "", server.WithDHFind(downServ.URL+";weight=100", provServ.URL), server.WithProvidersCheckInterval(0))
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+	for i := 0; i < 3; i++ {
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String(), nil))
+		require.Equal(t, http.StatusOK, got.Code)
+		findRsp, err := model.UnmarshalFindResponse(got.Body.Bytes())
+		require.NoError(t, err)
+		require.Len(t, findRsp.MultihashResults, 1)
+		require.Len(t, findRsp.MultihashResults[0].ProviderResults, 1)
+		require.Equal(t, pid, findRsp.MultihashResults[0].ProviderResults[0].Provider.ID)
+	}
+}
+
+func TestRoutingProviders(t *testing.T) {
+	provServ := httptest.NewServer(http.HandlerFunc(providersHandler))
+	defer provServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	require.NoError(t, err)
+	md := metadata.Default.New(metadata.Bitswap{})
+	mdBytes, err := md.MarshalBinary()
+	require.NoError(t, err)
+	loadStore(t, origMh, []byte("fish"), mdBytes, pid, store)
+	c := cid.NewCidV1(cid.Raw, origMh)
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	got := httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/routing/v1/providers/"+c.String(), nil))
+	require.Equal(t, http.StatusNotImplemented, got.Code)
+
+	s, err = server.New(store, "", server.WithDHFind(provServ.URL))
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	const wantRecord = `{"Addrs":["/ip4/127.0.0.1/tcp/9876"],"ID":"12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA","Protocols":["transport-bitswap"],"Schema":"peer","transport-bitswap":"gBI="}`
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/routing/v1/providers/"+c.String(), nil))
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, "application/json", got.Header().Get("Content-Type"))
+	require.Equal(t, "public, max-age=300", got.Header().Get("Cache-Control"))
+	require.JSONEq(t, `{"Providers":[`+wantRecord+`]}`, got.Body.String())
+
+	given := httptest.NewRequest(http.MethodGet, "/routing/v1/providers/"+c.String(), nil)
+	given.Header.Set("Accept", "application/x-ndjson")
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, "application/x-ndjson", got.Header().Get("Content-Type"))
+	require.JSONEq(t, wantRecord, got.Body.String())
+
+	// The double hash of a multihash cannot be resolved via dhfind.
+	dhCid := cid.NewCidV1(cid.Raw, dhash.SecondMultihash(origMh))
+	for path, want := range map[string]string{
+		"/routing/v1/providers/fish":              dhstore.ErrorCodeBadMultihash,
+		"/routing/v1/providers/" + dhCid.String(): dhstore.ErrorCodeUnsupportedCodec,
+	} {
+		got = httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusBadRequest, got.Code, path)
+		require.Equal(t, "application/json", got.Header().Get("Content-Type"), path)
+		var rsp dhstore.ErrorResponse
+		require.NoError(t, json.Unmarshal(got.Body.Bytes(), &rsp), path)
+		require.Equal(t, want, rsp.Code, path)
+	}
+
+	missing, err := multihash.Sum([]byte("lobster"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	unknown := cid.NewCidV1(cid.Raw, missing)
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/routing/v1/providers/"+unknown.String(), nil))
+	require.Equal(t, http.StatusNotFound, got.Code)
+	require.Equal(t, "public, max-age=15", got.Header().Get("Cache-Control"))
+
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, httptest.NewRequest(http.MethodPost, "/routing/v1/providers/"+c.String(), nil))
+	require.Equal(t, http.StatusMethodNotAllowed, got.Code)
+
+	// The route is not registered when only encrypted lookups are served.
+	s, err = server.New(store, "", server.WithEncryptedLookupsOnly(true))
+	require.NoError(t, err)
+	got = httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/routing/v1/providers/"+c.String(), nil))
+	require.Equal(t, http.StatusNotFound, got.Code)
+}
+
+func TestGetDeleteIndexes(t *testing.T) {
+	provServ := httptest.NewServer(http.HandlerFunc(providersHandler))
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+
+	const providerID = "12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA"
+	pid, err := peer.Decode(providerID)
+	require.NoError(t, err)
+	const providerID2 = "12D3KooWQk7r5WKUfTn9dVntWnmvfHfVBaghWtDdZNkRExQ7NwK1"
+	pid2, err := peer.Decode(providerID2)
+	require.NoError(t, err)
+
+	ctxID := []byte("fish")
+	metadata := []byte("lobster")
+	ctxID2 := []byte("rodent")
+	metadata2 := []byte("squirrel")
+
+	dhMh := loadStore(t, origMh, ctxID, metadata, pid, store)
+	dhMh2 := loadStore(t, origMh, ctxID2, metadata2, pid2, store)
+
+	s, err := server.New(store, "", server.WithDHFind(provServ.URL))
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	// Get encrypted multihash find response.
+	given := httptest.NewRequest(http.MethodGet, "/encrypted/multihash/"+dhMh.B58String(), nil)
+	got := httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusOK, got.Code)
+	gotBody, err := io.ReadAll(got.Body)
+	require.NoError(t, err)
+	t.Log("Got encrypted find response using double-hashed multihash:", string(gotBody))
+	findRsp, err := model.UnmarshalFindResponse(gotBody)
+	require.NoError(t, err)
+
+	// Check that encrypted find response is correct.
+	require.Len(t, findRsp.MultihashResults, 0)
+	require.Len(t, findRsp.EncryptedMultihashResults, 1)
+	encMhResult := findRsp.EncryptedMultihashResults[0]
+	require.Len(t, encMhResult.EncryptedValueKeys, 2)
+	evk := encMhResult.EncryptedValueKeys[0]
+	vk, err := dhash.DecryptValueKey(evk, origMh)
+	require.NoError(t, err)
+	respPid, respCtxID, err := dhash.SplitValueKey(vk)
+	require.NoError(t, err)
+	require.Equal(t, pid, respPid)
+	require.Equal(t, ctxID, respCtxID)
+
+	evk2 := encMhResult.EncryptedValueKeys[1]
+	vk2, err := dhash.DecryptValueKey(evk2, origMh)
+	require.NoError(t, err)
+	respPid2, respCtxID2, err := dhash.SplitValueKey(vk2)
+	require.NoError(t, err)
+	require.Equal(t, pid2, respPid2)
+	require.Equal(t, ctxID2, respCtxID2)
+
+	// Get metadata for find response.
+	hvk := dhash.SHA256(vk, nil)
+	given = httptest.NewRequest(http.MethodGet, "/metadata/"+base58.Encode(hvk), nil)
+	given.Header.Add("Accept", "application/json")
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusOK, got.Code)
+	gotBody, err = io.ReadAll(got.Body)
+	require.NoError(t, err)
+	require.NotZero(t, len(gotBody))
+
+	type GetMetadataResponse struct {
+		EncryptedMetadata []byte `json:"EncryptedMetadata"`
+	}
+
+	// Check that metadata descrypts and is correct.
+	findResponse := &GetMetadataResponse{}
+	err = json.Unmarshal(gotBody, findResponse)
+	require.NoError(t, err)
+	encMetadata := findResponse.EncryptedMetadata
+	require.NotZero(t, len(encMetadata))
+	respMeta, err := dhash.DecryptMetadata(encMetadata, vk)
+	require.NoError(t, err)
+	require.Equal(t, metadata, respMeta)
+
+	// Delete first provider from from index.
+	mergeReq := makeMergeReq(dhMh, evk)
+	reqData, err := json.Marshal(mergeReq)
+	require.NoError(t, err)
+	given = httptest.NewRequest(http.MethodDelete, "/multihash", bytes.NewBuffer(reqData))
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusAccepted, got.Code)
+
+	// Check that first provider is deleted
+	given = httptest.NewRequest(http.MethodGet, "/encrypted/multihash/"+dhMh.B58String(), nil)
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusOK, got.Code)
+	gotBody, err = io.ReadAll(got.Body)
+	require.NoError(t, err)
+	t.Log("Got encrypted find response using double-hashed multihash:", string(gotBody))
+	findRsp, err = model.UnmarshalFindResponse(gotBody)
+	require.NoError(t, err)
+	require.Len(t, findRsp.EncryptedMultihashResults, 1)
+	encMhResult = findRsp.EncryptedMultihashResults[0]
+	require.Len(t, encMhResult.EncryptedValueKeys, 1)
+	require.Equal(t, evk2, encMhResult.EncryptedValueKeys[0])
+
+	// Delete 2nd provider from index.
+	mergeReq = makeMergeReq(dhMh2, evk2)
+	reqData, err = json.Marshal(mergeReq)
+	require.NoError(t, err)
+	given = httptest.NewRequest(http.MethodDelete, "/multihash", bytes.NewBuffer(reqData))
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusAccepted, got.Code)
+
+	// Check that index is now completely deleted.
+	given = httptest.NewRequest(http.MethodGet, "/encrypted/multihash/"+dhMh.B58String(), nil)
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusNotFound, got.Code)
+}
+
+func makeMergeReq(dhMh multihash.Multihash, evk dhstore.EncryptedValueKey) server.MergeIndexRequest {
+	idx := dhstore.Index{
+		Key:   dhMh,
+		Value: evk,
+	}
+	return server.MergeIndexRequest{
+		Merges: []dhstore.Index{idx},
+	}
+}
+
+func loadStore(t *testing.T, origMh multihash.Multihash, ctxID, metadata []byte, providerID peer.ID, store *pebble.PebbleDHStore) multihash.Multihash {
+	vk := dhash.CreateValueKey(providerID, ctxID)
+
+	encMeta, err := dhash.EncryptMetadata(metadata, vk)
+	require.NoError(t, err)
+
+	err = store.PutMetadata(dhash.SHA256(vk, nil), encMeta)
+	require.NoError(t, err)
+
+	// Encrypt value key with original multihash.
+	encValueKey, err := dhash.EncryptValueKey(vk, origMh)
+	require.NoError(t, err)
+
+	mh2 := dhash.SecondMultihash(origMh)
+	err = store.MergeIndexes([]dhstore.Index{
+		{
+			Key:   mh2,
+			Value: []byte(encValueKey),
+		},
+	})
+	require.NoError(t, err)
+
+	return mh2
+}
+
+func deleteMetadata(t *testing.T, ctxID []byte, providerID peer.ID, store *pebble.PebbleDHStore) {
+	vk := dhash.CreateValueKey(providerID, ctxID)
+
+	err := store.DeleteMetadata(dhash.SHA256(vk, nil))
+	require.NoError(t, err)
+}
+
+func TestPersistentProviderCache(t *testing.T) {
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	require.NoError(t, err)
+	var requests atomic.Int32
+	provServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/providers" {
+			providersHandler(w, r)
+			return
+		}
+		data, err := json.Marshal([]model.ProviderInfo{{AddrInfo: peer.AddrInfo{ID: pid}}})
+		if err != nil {
+			panic(err.Error())
+		}
+		writeJsonResponse(w, http.StatusOK, data)
+	}))
+	defer provServ.Close()
+	downServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "", http.StatusServiceUnavailable)
+	}))
+	defer downServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	loadStore(t, origMh, []byte("fish"), []byte("lobster"), pid, store)
+
+	_, err = server.New(store, "", server.WithPersistentProviderCache(-time.Hour))
+	require.ErrorContains(t, err, "cannot be negative")
+	_, err = server.New(struct{ dhstore.DHStore }{store}, "", server.WithPersistentProviderCache(time.Hour))
+	require.ErrorContains(t, err, "not supported by store")
+
+	clk := clock.NewMock(time.Unix(0, 0))
+	lookup := func(providersURL string) int {
+		s, err := server.New(store, "", server.WithDHFind(providersURL), server.WithProvidersCheckInterval(0), server.WithClock(clk),
+			server.WithPersistentProviderCache(time.Hour))
+		require.NoError(t, err)
+		defer s.Shutdown(context.Background())
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String(), nil))
+		return got.Code
+	}
+
+	// The provider cache is preloaded from the providers URL, and persisted.
+	require.Equal(t, http.StatusOK, lookup(provServ.URL))
+	require.Equal(t, int32(1), requests.Load())
+
+	// Once restarted, the cache is preloaded from the store while at most an
+	// hour old.
+	clk.Add(time.Hour)
+	require.Equal(t, http.StatusOK, lookup(provServ.URL))
+	require.Equal(t, int32(1), requests.Load())
+
+	// Older provider information is only used while the providers URL fails.
+	clk.Add(time.Second)
+	require.Equal(t, http.StatusOK, lookup(downServ.URL))
+	require.Equal(t, http.StatusOK, lookup(provServ.URL))
+	require.Equal(t, int32(2), requests.Load())
+}
+
+func providersHandler(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	providerID, err := peer.Decode(path.Base(req.URL.Path))
+	if err != nil {
+		fmt.Println("Cannot get provider ID:", err)
+	}
+
+	maddr, _ := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/9876")
+
+	ai := peer.AddrInfo{
+		ID:    providerID,
+		Addrs: []multiaddr.Multiaddr{maddr},
+	}
+
+	pinfo := model.ProviderInfo{
+		AddrInfo:  ai,
+		Publisher: &ai,
+	}
+	data, err := json.Marshal(pinfo)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	if req.URL.Path == "/providers" {
+		var buf bytes.Buffer
+		buf.Grow(len(data) + 2)
+		buf.Write([]byte("["))
 		buf.Write(data)
 		buf.Write([]byte("]"))
 		writeJsonResponse(w, http.StatusOK, buf.Bytes())
 		return
 	}
-	writeJsonResponse(w, http.StatusOK, data)
+	writeJsonResponse(w, http.StatusOK, data)
+}
+
+func writeJsonResponse(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewMock(start)
+	s, err := server.New(store, "", server.WithClock(clk), server.WithProvenance("X-Writer", 1))
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	mh1, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	mh2 := dhash.SecondMultihash(mh1)
+	reqData, err := json.Marshal(server.MergeIndexRequest{
+		Merges: []dhstore.Index{{Key: mh2, Value: []byte("fish")}, {Key: mh1, Value: []byte("lobster")}},
+	})
+	require.NoError(t, err)
+
+	// Batch without writer tag is not recorded.
+	given := httptest.NewRequest(http.MethodPut, "/multihash", bytes.NewBuffer(reqData))
+	got := httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusAccepted, got.Code)
+
+	clk.Add(time.Minute)
+	given = httptest.NewRequest(http.MethodPut, "/multihash", bytes.NewBuffer(reqData))
+	given.Header.Set("X-Writer", "indexer-1")
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusAccepted, got.Code)
+
+	given = httptest.NewRequest(http.MethodGet, "/provenance", nil)
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusOK, got.Code)
+
+	var records []dhstore.Provenance
+	require.NoError(t, json.Unmarshal(got.Body.Bytes(), &records))
+	require.Len(t, records, 1)
+	require.Equal(t, "indexer-1", records[0].Tag)
+	require.Equal(t, 2, records[0].Count)
+	require.True(t, start.Add(time.Minute).Equal(records[0].Time))
+	first, last := mh1, mh2
+	if bytes.Compare(first, last) > 0 {
+		first, last = last, first
+	}
+	require.Equal(t, first, records[0].FirstKey)
+	require.Equal(t, last, records[0].LastKey)
+
+	// Records outside the requested range are not returned.
+	given = httptest.NewRequest(http.MethodGet, "/provenance?to="+start.Add(time.Second).Format(time.RFC3339), nil)
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusOK, got.Code)
+	require.JSONEq(t, "[]", got.Body.String())
+}
+
+func TestPruneStaleProviders(t *testing.T) {
+	provServ := httptest.NewServer(http.HandlerFunc(providersHandler))
+	defer provServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	require.NoError(t, err)
+	pid2, err := peer.Decode("12D3KooWQk7r5WKUfTn9dVntWnmvfHfVBaghWtDdZNkRExQ7NwK1")
+	require.NoError(t, err)
+	dhMh := loadStore(t, origMh, []byte("fish"), []byte("lobster"), pid, store)
+	loadStore(t, origMh, []byte("rodent"), []byte("squirrel"), pid2, store)
+
+	// Serve both providers, then only the second one so that the first is
+	// considered removed.
+	listed := []peer.ID{pid, pid2}
+	pruneProvServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		infos := make([]model.ProviderInfo, 0, len(listed))
+		for _, p := range listed {
+			infos = append(infos, model.ProviderInfo{AddrInfo: peer.AddrInfo{ID: p}})
+		}
+		data, err := json.Marshal(infos)
+		require.NoError(t, err)
+		writeJsonResponse(w, http.StatusOK, data)
+	}))
+	defer pruneProvServ.Close()
+
+	pruner, err := prune.New([]string{pruneProvServ.URL}, prune.WithRemovalGrace(0))
+	require.NoError(t, err)
+	require.NoError(t, pruner.Refresh(context.Background()))
+	listed = listed[1:]
+	require.NoError(t, pruner.Refresh(context.Background()))
+	require.True(t, pruner.IsStale(pid))
+
+	s, err := server.New(store, "", server.WithDHFind(provServ.URL), server.WithPruner(pruner))
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	given := httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String(), nil)
+	got := httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusOK, got.Code)
+	findRsp, err := model.UnmarshalFindResponse(got.Body.Bytes())
+	require.NoError(t, err)
+	require.Len(t, findRsp.MultihashResults, 1)
+	require.Len(t, findRsp.MultihashResults[0].ProviderResults, 1)
+	require.Equal(t, pid2, findRsp.MultihashResults[0].ProviderResults[0].Provider.ID)
+
+	// Records of the stale provider are deleted from the store.
+	evks, err := store.Lookup(dhMh)
+	require.NoError(t, err)
+	require.Len(t, evks, 1)
+	vk, err := dhash.DecryptValueKey(multihash.Multihash(evks[0]), origMh)
+	require.NoError(t, err)
+	gotPid, _, err := dhash.SplitValueKey(vk)
+	require.NoError(t, err)
+	require.Equal(t, pid2, gotPid)
+	md, err := store.GetMetadata(dhash.SHA256(dhash.CreateValueKey(pid, []byte("fish")), nil))
+	require.NoError(t, err)
+	require.Nil(t, md)
+	require.Equal(t, int64(1), pruner.Campaigns()[0].Pruned)
+}
+
+type pressuredStore struct {
+	*pebble.PebbleDHStore
+	pressure float64
+}
+
+func (ps *pressuredStore) WritePressure() float64 {
+	return ps.pressure
+}
+
+func TestWriteBackpressure(t *testing.T) {
+	pstore, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer pstore.Close()
+	store := &pressuredStore{PebbleDHStore: pstore, pressure: 0.95}
+
+	s, err := server.New(store, "", server.WithWriteBackpressure(0.9, 5*time.Second))
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	const body = `{ "merges": [{ "key": "ViAJKqT0hRtxENbtjWwvnRogQknxUnhswNrose3ZjEP8Iw==", "value": "ZmlzaA==" }] }`
+	// Retry-After grows from writeRetryAfter at the threshold to twice that
+	// once writes are stopped, rounded up to whole seconds.
+	for pressure, want := range map[float64]string{0.9: "5", 0.95: "8", 1: "10"} {
+		store.pressure = pressure
+		given := httptest.NewRequest(http.MethodPut, "/multihash", bytes.NewBufferString(body))
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, given)
+		require.Equal(t, http.StatusServiceUnavailable, got.Code)
+		require.Equal(t, want, got.Header().Get("Retry-After"))
+	}
+
+	store.pressure = 0.5
+	given := httptest.NewRequest(http.MethodPut, "/multihash", bytes.NewBufferString(body))
+	got := httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusAccepted, got.Code)
+}
+
+func TestExport(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	mh1, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	mh2 := dhash.SecondMultihash(mh1)
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: mh1, Value: []byte("fish")}, {Key: mh2, Value: []byte("lobster")}}))
+
+	export := func(query string) []dhstore.ExportRecord {
+		given := httptest.NewRequest(http.MethodGet, "/export"+query, nil)
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, given)
+		require.Equal(t, http.StatusOK, got.Code)
+		var records []dhstore.ExportRecord
+		dec := json.NewDecoder(got.Body)
+		for dec.More() {
+			var record dhstore.ExportRecord
+			require.NoError(t, dec.Decode(&record))
+			records = append(records, record)
+		}
+		return records
+	}
+
+	first := export("?limit=1")
+	require.Len(t, first, 1)
+	rest := export("?cursor=" + first[0].Cursor)
+	require.Len(t, rest, 1)
+	require.Equal(t, export(""), append(first, rest...))
+
+	given := httptest.NewRequest(http.MethodGet, "/export?cursor=fish", nil)
+	got := httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusBadRequest, got.Code)
+}
+
+func TestImport(t *testing.T) {
+	source, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer source.Close()
+	target, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer target.Close()
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	require.NoError(t, source.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}}))
+	require.NoError(t, source.PutMetadata([]byte("lobster"), []byte("barreleye")))
+
+	s, err := server.New(source, "")
+	require.NoError(t, err)
+	given := httptest.NewRequest(http.MethodGet, "/export?format=binary", nil)
+	exported := httptest.NewRecorder()
+	s.Handler().ServeHTTP(exported, given)
+	require.Equal(t, http.StatusOK, exported.Code)
+	require.Equal(t, "application/vnd.ipni.dhstore-records", exported.Header().Get("Content-Type"))
+	require.True(t, bytes.HasPrefix(exported.Body.Bytes(), []byte(load.BinaryMagic)))
+
+	s, err = server.New(target, "")
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	given = httptest.NewRequest(http.MethodGet, "/import", nil)
+	got := httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusMethodNotAllowed, got.Code)
+
+	given = httptest.NewRequest(http.MethodPost, "/import", bytes.NewReader(exported.Body.Bytes()))
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusOK, got.Code)
+	var response server.ImportResponse
+	require.NoError(t, json.NewDecoder(got.Body).Decode(&response))
+	require.Equal(t, int64(2), response.Records)
+
+	evks, err := target.Lookup(mh)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("fish")}, evks)
+	md, err := target.GetMetadata([]byte("lobster"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("barreleye"), md)
+
+	given = httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(load.BinaryMagic+"\xff"))
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusBadRequest, got.Code)
+
+	// Failures of the store are not blamed on the client.
+	s, err = server.New(&failingImporter{PebbleDHStore: target, err: dhstore.ErrUnavailable{Err: errors.New("fish")}}, "")
+	require.NoError(t, err)
+	given = httptest.NewRequest(http.MethodPost, "/import", bytes.NewReader(exported.Body.Bytes()))
+	got = httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, given)
+	require.Equal(t, http.StatusServiceUnavailable, got.Code)
+	var errResp dhstore.ErrorResponse
+	require.NoError(t, json.Unmarshal(got.Body.Bytes(), &errResp))
+	require.Equal(t, dhstore.ErrorCodeUnavailable, errResp.Code)
+}
+
+// failingImporter fails imports with err.
+type failingImporter struct {
+	*pebble.PebbleDHStore
+	err error
+}
+
+func (fi *failingImporter) Import([]dhstore.ExportRecord) error {
+	return fi.err
+}
+
+func TestImport_MaxValueKeySize(t *testing.T) {
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	body, err := json.Marshal(dhstore.ExportRecord{
+		Multihash:          mh,
+		EncryptedValueKeys: []dhstore.EncryptedValueKey{[]byte("fish"), bytes.Repeat([]byte("f"), 9)},
+	})
+	require.NoError(t, err)
+
+	for _, ingest := range []bool{false, true} {
+		t.Run(fmt.Sprint("ingest=", ingest), func(t *testing.T) {
+			store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+			require.NoError(t, err)
+			defer store.Close()
+			s, err := server.New(store, "", server.WithMaxValueKeySize(8))
+			require.NoError(t, err)
+
+			given := httptest.NewRequest(http.MethodPost, fmt.Sprint("/import?ingest=", ingest), bytes.NewReader(body))
+			got := httptest.NewRecorder()
+			s.Handler().ServeHTTP(got, given)
+			require.Equal(t, http.StatusBadRequest, got.Code)
+			var errResp dhstore.ErrorResponse
+			require.NoError(t, json.Unmarshal(got.Body.Bytes(), &errResp))
+			require.Equal(t, dhstore.ErrorCodeBadValueLength, errResp.Code)
+
+			// The batch holding the oversized key is not written.
+			evks, err := store.Lookup(mh)
+			require.NoError(t, err)
+			require.Empty(t, evks)
+		})
+	}
+}
+
+// streamingStore yields the encrypted value keys of the underlying store one at
+// a time, failing after failAfter keys if fail is set.
+type streamingStore struct {
+	*pebble.PebbleDHStore
+	streamed  int
+	fail      bool
+	failAfter int
+}
+
+func (s *streamingStore) LookupStream(_ context.Context, mh multihash.Multihash, fn func(dhstore.EncryptedValueKey) error) error {
+	evks, err := s.Lookup(mh)
+	if err != nil {
+		return err
+	}
+	for _, evk := range evks {
+		if s.fail && s.streamed == s.failAfter {
+			return fmt.Errorf("fish")
+		}
+		if err := fn(evk); err != nil {
+			return err
+		}
+		s.streamed++
+	}
+	return nil
+}
+
+func TestStreamingLookup(t *testing.T) {
+	pbstore, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer pbstore.Close()
+	store := &streamingStore{PebbleDHStore: pbstore}
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	dhmh := dhash.SecondMultihash(mh)
+	target := "/encrypted/multihash/" + dhmh.B58String()
+
+	lookup := func() *httptest.ResponseRecorder {
+		given := httptest.NewRequest(http.MethodGet, target, nil)
+		given.Header.Set("Accept", "application/x-ndjson")
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, given)
+		return got
+	}
+
+	require.Equal(t, http.StatusNotFound, lookup().Code)
+
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: dhmh, Value: []byte("fish")}, {Key: dhmh, Value: []byte("lobster")}}))
+	got := lookup()
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, 2, store.streamed)
+	var results []dhstore.EncryptedValueKeyResult
+	dec := json.NewDecoder(got.Body)
+	for dec.More() {
+		var result dhstore.EncryptedValueKeyResult
+		require.NoError(t, dec.Decode(&result))
+		results = append(results, result)
+	}
+	require.Equal(t, []dhstore.EncryptedValueKeyResult{{EncryptedValueKey: []byte("fish")}, {EncryptedValueKey: []byte("lobster")}}, results)
+
+	// Failure before anything is written is reported as an error.
+	store.streamed, store.fail = 0, true
+	require.Equal(t, http.StatusInternalServerError, lookup().Code)
+
+	// Failure midway truncates the response.
+	store.streamed, store.failAfter = 0, 1
+	got = lookup()
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, 1, strings.Count(got.Body.String(), "\n"))
+}
+
+func TestProtobufLookup(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	dhmh := dhash.SecondMultihash(mh)
+
+	lookup := func(target string) *httptest.ResponseRecorder {
+		given := httptest.NewRequest(http.MethodGet, target, nil)
+		given.Header.Set("Accept", "application/protobuf")
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, given)
+		return got
+	}
+
+	require.Equal(t, http.StatusNotFound, lookup("/encrypted/multihash/"+dhmh.B58String()).Code)
+
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: dhmh, Value: []byte("fish")}, {Key: dhmh, Value: []byte("lobster")}}))
+	for _, target := range []string{"/encrypted/multihash/", "/multihash/"} {
+		got := lookup(target + dhmh.B58String())
+		require.Equal(t, http.StatusOK, got.Code)
+		require.Equal(t, "application/protobuf", got.Header().Get("Content-Type"))
+		var rsp pb.LookupResponse
+		require.NoError(t, proto.Unmarshal(got.Body.Bytes(), &rsp))
+		require.Equal(t, []byte(dhmh), rsp.GetMultihash())
+		require.Equal(t, [][]byte{[]byte("fish"), []byte("lobster")}, rsp.GetEncryptedValueKeys())
+	}
+
+	// Unencrypted lookups have no protobuf representation.
+	mh, err = multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotAcceptable, lookup("/multihash/"+mh.B58String()).Code)
+}
+
+type panickingStore struct {
+	*pebble.PebbleDHStore
+}
+
+func (ps *panickingStore) GetMetadata(dhstore.HashedValueKey) (dhstore.EncryptedMetadata, error) {
+	panic("fish")
+}
+
+func TestRecoverPanics(t *testing.T) {
+	pstore, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer pstore.Close()
+
+	s, err := server.New(&panickingStore{PebbleDHStore: pstore}, "")
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	given := httptest.NewRequest(http.MethodGet, "/metadata/2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82", nil)
+	got := httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusInternalServerError, got.Code)
+	requestID := got.Header().Get("X-Request-Id")
+	require.NotEmpty(t, requestID)
+	require.Contains(t, got.Body.String(), requestID)
+
+	// The request ID is taken from the request if present.
+	given = httptest.NewRequest(http.MethodGet, "/metadata/2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82", nil)
+	given.Header.Set("X-Request-Id", "lobster")
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusInternalServerError, got.Code)
+	require.Equal(t, "lobster", got.Header().Get("X-Request-Id"))
+}
+
+func TestPutMetadataBatch(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	body, err := json.Marshal(server.PutMetadataRequest{
+		Metadata: []dhstore.Metadata{
+			{Key: []byte("fish"), Value: []byte("barreleye")},
+			{Key: []byte("lobster"), Value: []byte("squat")},
+		},
+	})
+	require.NoError(t, err)
+	given := httptest.NewRequest(http.MethodPut, "/metadata", bytes.NewReader(body))
+	got := httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusAccepted, got.Code)
+
+	md, err := store.GetMetadata([]byte("fish"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("barreleye"), md)
+	md, err = store.GetMetadata([]byte("lobster"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("squat"), md)
+}
+
+func TestEventStreamLookup(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}, {Key: mh, Value: []byte("lobster")}}))
+	missing, err := multihash.Sum([]byte("lobster"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	lookup := func(target string) *httptest.ResponseRecorder {
+		given := httptest.NewRequest(http.MethodGet, target, nil)
+		given.Header.Set("Accept", "text/event-stream")
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, given)
+		return got
+	}
+
+	for _, target := range []string{"/encrypted/multihash/" + mh.B58String(), "/multihash/" + mh.B58String()} {
+		got := lookup(target)
+		require.Equal(t, http.StatusOK, got.Code, target)
+		require.Equal(t, "text/event-stream", got.Header().Get("Content-Type"))
+		require.Equal(t, "no-cache", got.Header().Get("Cache-Control"))
+		require.Equal(t, `data: {"EncryptedValueKey":"ZmlzaA=="}`+"\n\n"+
+			`data: {"EncryptedValueKey":"bG9ic3Rlcg=="}`+"\n\n"+
+			"event: end\n"+`data: {"count":2}`+"\n\n", got.Body.String())
+	}
+
+	// Errors are not written as events.
+	got := lookup("/encrypted/multihash/" + missing.B58String())
+	require.Equal(t, http.StatusNotFound, got.Code)
+	require.NotContains(t, got.Body.String(), "data:")
+}
+
+func TestMultibaseLookup(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}}))
+
+	s, err := server.New(store, "", server.WithRequestValidation(true))
+	require.NoError(t, err)
+	for _, encoding := range []multibase.Encoding{multibase.Base32, multibase.Base36, multibase.Base64url, multibase.Base58BTC} {
+		encoded, err := multibase.Encode(encoding, mh)
+		require.NoError(t, err)
+		for _, prefix := range []string{"/encrypted/multihash/", "/multihash/"} {
+			given := httptest.NewRequest(http.MethodGet, prefix+encoded, nil)
+			given.Header.Set("Accept", "application/json")
+			got := httptest.NewRecorder()
+			s.Handler().ServeHTTP(got, given)
+			require.Equal(t, http.StatusOK, got.Code, prefix+encoded)
+			var resp server.LookupResponse
+			require.NoError(t, json.Unmarshal(got.Body.Bytes(), &resp))
+			require.Len(t, resp.EncryptedMultihashResults, 1)
+			require.Equal(t, mh, resp.EncryptedMultihashResults[0].Multihash)
+			require.Equal(t, [][]byte{[]byte("fish")}, resp.EncryptedMultihashResults[0].EncryptedValueKeys)
+		}
+	}
+
+	// Multibase strings that do not decode to a multihash are rejected.
+	encoded, err := multibase.Encode(multibase.Base32, []byte("fish"))
+	require.NoError(t, err)
+	given := httptest.NewRequest(http.MethodGet, "/encrypted/multihash/"+encoded, nil)
+	given.Header.Set("Accept", "application/json")
+	got := httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, given)
+	require.Equal(t, http.StatusBadRequest, got.Code)
+}
+
+func TestBatchLookup(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}}))
+	missing, err := multihash.Sum([]byte("lobster"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+
+	// Batch lookups are not rejected in read-only mode, since they are reads.
+	s, err := server.New(store, "", server.WithReadOnly(func() bool { return true }))
+	require.NoError(t, err)
+	list := func(mhs ...[]byte) []byte {
+		var b []byte
+		for _, mh := range mhs {
+			b = binary.AppendUvarint(b, uint64(len(mh)))
+			b = append(b, mh...)
+		}
+		return b
+	}
+	lookup := func(body []byte) *httptest.ResponseRecorder {
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodPost, "/encrypted/multihash/batch", bytes.NewReader(body)))
+		return got
+	}
+
+	got := lookup(list(mh, missing, mh))
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, "application/x-ndjson", got.Header().Get("Content-Type"))
+	dec := json.NewDecoder(got.Body)
+	for i := 0; i < 2; i++ {
+		var result model.EncryptedMultihashResult
+		require.NoError(t, dec.Decode(&result))
+		require.Equal(t, mh, result.Multihash)
+		require.Equal(t, [][]byte{[]byte("fish")}, result.EncryptedValueKeys)
+	}
+	require.False(t, dec.More())
+
+	got = lookup(list(missing))
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Empty(t, got.Body.String())
+
+	// Malformed lists are rejected unless results have been written.
+	got = lookup(list([]byte("fish")))
+	require.Equal(t, http.StatusBadRequest, got.Code)
+	got = lookup(append(list(mh), 0xff))
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, 1, strings.Count(got.Body.String(), "\n"))
+
+	got = httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/encrypted/multihash/batch", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, got.Code)
+}
+
+func TestProbeLookup(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}, {Key: mh, Value: []byte("lobster")}}))
+	missing := dhash.SecondMultihash(mh)
+	unencrypted, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		path       string
+		wantStatus int
+		wantCount  string
+	}{
+		{path: "/encrypted/multihash/" + mh.B58String(), wantStatus: http.StatusOK, wantCount: "2"},
+		{path: "/multihash/" + mh.B58String(), wantStatus: http.StatusOK, wantCount: "2"},
+		{path: "/encrypted/multihash/" + missing.B58String(), wantStatus: http.StatusNotFound, wantCount: "0"},
+		{path: "/multihash/" + missing.B58String(), wantStatus: http.StatusNotFound, wantCount: "0"},
+		{path: "/multihash/" + unencrypted.B58String(), wantStatus: http.StatusBadRequest},
+		{path: "/encrypted/multihash/fish", wantStatus: http.StatusBadRequest},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			given := httptest.NewRequest(http.MethodHead, test.path, nil)
+			got := httptest.NewRecorder()
+			subject.ServeHTTP(got, given)
+			require.Equal(t, test.wantStatus, got.Code)
+			require.Equal(t, test.wantCount, got.Header().Get("X-Result-Count"))
+			if test.wantStatus != http.StatusBadRequest {
+				require.Zero(t, got.Body.Len())
+			}
+		})
+	}
+}
+
+func TestProbeLookup_DHFind(t *testing.T) {
+	var fetches atomic.Int32
+	provServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/providers" && r.URL.Path != "/health" {
+			fetches.Add(1)
+		}
+		providersHandler(w, r)
+	}))
+	defer provServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	require.NoError(t, err)
+	loadStore(t, origMh, []byte("fish"), []byte("lobster"), pid, store)
+	loadStore(t, origMh, []byte("crab"), []byte("lobster"), pid, store)
+	missing, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+
+	s, err := server.New(store, "", server.WithDHFind(provServ.URL))
+	require.NoError(t, err)
+	defer s.Shutdown(context.Background())
+
+	got := httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodHead, "/multihash/"+origMh.B58String(), nil))
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, "2", got.Header().Get("X-Result-Count"))
+	require.Zero(t, got.Body.Len())
+
+	got = httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodHead, "/multihash/"+missing.B58String(), nil))
+	require.Equal(t, http.StatusNotFound, got.Code)
+	require.Equal(t, "0", got.Header().Get("X-Result-Count"))
+
+	// Provider information is never fetched for probes.
+	require.Zero(t, fetches.Load())
+}
+
+func TestDeleteMetadataBatch(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	require.NoError(t, store.PutMetadataBatch([]dhstore.Metadata{
+		{Key: []byte("fish"), Value: []byte("barreleye")},
+		{Key: []byte("lobster"), Value: []byte("squat")},
+		{Key: []byte("squid"), Value: []byte("cuttlefish")},
+	}))
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	body, err := json.Marshal(server.DeleteMetadataRequest{
+		Keys: []dhstore.HashedValueKey{[]byte("fish"), []byte("lobster"), []byte("octopus")},
+	})
+	require.NoError(t, err)
+	given := httptest.NewRequest(http.MethodDelete, "/metadata", bytes.NewReader(body))
+	got := httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusAccepted, got.Code)
+
+	for _, key := range []string{"fish", "lobster"} {
+		md, err := store.GetMetadata([]byte(key))
+		require.NoError(t, err)
+		require.Nil(t, md)
+	}
+	md, err := store.GetMetadata([]byte("squid"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("cuttlefish"), md)
+
+	given = httptest.NewRequest(http.MethodDelete, "/metadata", strings.NewReader(`{"keys":[]}`))
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, given)
+	require.Equal(t, http.StatusBadRequest, got.Code)
+}
+
+type unavailableStore struct {
+	*pebble.PebbleDHStore
+	err error
+}
+
+func (us *unavailableStore) Healthy() error {
+	return us.err
+}
+
+func (us *unavailableStore) MergeIndexes(indexes []dhstore.Index) error {
+	if us.err != nil {
+		return us.err
+	}
+	return us.PebbleDHStore.MergeIndexes(indexes)
+}
+
+func TestUnavailableStore(t *testing.T) {
+	pstore, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer pstore.Close()
+	store := &unavailableStore{PebbleDHStore: pstore, err: dhstore.ErrUnavailable{Err: errors.New("fish")}}
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	ready := func() *httptest.ResponseRecorder {
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return got
+	}
+	merge := func() *httptest.ResponseRecorder {
+		const body = `{ "merges": [{ "key": "ViAJKqT0hRtxENbtjWwvnRogQknxUnhswNrose3ZjEP8Iw==", "value": "ZmlzaA==" }] }`
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodPut, "/multihash", bytes.NewBufferString(body)))
+		return got
+	}
+
+	got := ready()
+	require.Equal(t, http.StatusServiceUnavailable, got.Code)
+	require.Contains(t, got.Body.String(), "fish")
+	require.Equal(t, http.StatusServiceUnavailable, merge().Code)
+
+	store.err = nil
+	require.Equal(t, http.StatusOK, ready().Code)
+	require.Equal(t, http.StatusAccepted, merge().Code)
+}
+
+func TestWrappedStoreErrors(t *testing.T) {
+	pstore, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer pstore.Close()
+	store := &unavailableStore{PebbleDHStore: pstore}
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	const body = `{ "merges": [{ "key": "ViAJKqT0hRtxENbtjWwvnRogQknxUnhswNrose3ZjEP8Iw==", "value": "ZmlzaA==" }] }`
+	for _, test := range []struct {
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			err:        dhstore.ErrPartialWrite{Written: 1, Total: 2, Err: dhstore.ErrUnavailable{Err: errors.New("fish")}},
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   dhstore.ErrorCodeUnavailable,
+		},
+		{
+			err:        fmt.Errorf("failed to write to lobster: %w", dhstore.ErrReadOnly{}),
+			wantStatus: http.StatusForbidden,
+			wantCode:   dhstore.ErrorCodeReadOnly,
+		},
+		{
+			err:        fmt.Errorf("failed to write to lobster: %w", dhstore.ErrHttpResponse{Status: http.StatusBadRequest, Code: dhstore.ErrorCodeBadValueLength}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   dhstore.ErrorCodeBadValueLength,
+		},
+		{
+			err:        errors.New("fish"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   dhstore.ErrorCodeInternal,
+		},
+	} {
+		store.err = test.err
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodPut, "/multihash", bytes.NewBufferString(body)))
+		require.Equal(t, test.wantStatus, got.Code, test.err.Error())
+		var errResp dhstore.ErrorResponse
+		require.NoError(t, json.Unmarshal(got.Body.Bytes(), &errResp))
+		require.Equal(t, test.wantCode, errResp.Code, test.err.Error())
+	}
+}
+
+func TestTLS(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	// Borrow the self-signed certificate of an httptest TLS server, along
+	// with a client that trusts it.
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	_, err = server.New(store, addr, server.WithTLSConfig(&tls.Config{}))
+	require.ErrorContains(t, err, "certificate")
+
+	s, err := server.New(store, addr, server.WithTLSConfig(&tls.Config{Certificates: ts.TLS.Certificates}))
+	require.NoError(t, err)
+	require.NoError(t, s.Start(context.Background()))
+	defer s.Shutdown(context.Background())
+
+	got, err := ts.Client().Get("https://" + addr + "/ready")
+	require.NoError(t, err)
+	defer got.Body.Close()
+	require.Equal(t, http.StatusOK, got.StatusCode)
+
+	// Plain HTTP requests are rejected.
+	got, err = http.Get("http://" + addr + "/ready")
+	require.NoError(t, err)
+	defer got.Body.Close()
+	require.Equal(t, http.StatusBadRequest, got.StatusCode)
+}
+
+func TestWriteClientCerts(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	_, err = server.New(store, "", server.WithWriteClientCAs(x509.NewCertPool()))
+	require.ErrorContains(t, err, "requires TLS")
+
+	clientCert, cas := testutil.NewClientCert(t, "indexer")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	s, err := server.New(store, addr,
+		server.WithTLSConfig(&tls.Config{Certificates: ts.TLS.Certificates}),
+		server.WithWriteClientCAs(cas))
+	require.NoError(t, err)
+	require.NoError(t, s.Start(context.Background()))
+	defer s.Shutdown(context.Background())
+
+	anonymous := ts.Client()
+	authorized := &http.Client{Transport: anonymous.Transport.(*http.Transport).Clone()}
+	authorized.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	dhmh := dhash.SecondMultihash(mh)
+	merge := func(c *http.Client) int {
+		body, err := json.Marshal(server.MergeIndexRequest{Merges: []dhstore.Index{{Key: dhmh, Value: []byte("lobster")}}})
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPut, "https://"+addr+"/multihash", bytes.NewReader(body))
+		require.NoError(t, err)
+		got, err := c.Do(req)
+		require.NoError(t, err)
+		defer got.Body.Close()
+		return got.StatusCode
+	}
+	require.Equal(t, http.StatusForbidden, merge(anonymous))
+	require.Equal(t, http.StatusAccepted, merge(authorized))
+
+	// Reads need no client certificate.
+	got, err := anonymous.Get("https://" + addr + "/ready")
+	require.NoError(t, err)
+	defer got.Body.Close()
+	require.Equal(t, http.StatusOK, got.StatusCode)
+}
+
+func TestAuth(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	tokens, err := auth.NewTokens(map[auth.Group][]string{
+		auth.GroupRead:  {"reader"},
+		auth.GroupWrite: {"indexer"},
+		auth.GroupAdmin: {"operator"},
+	})
+	require.NoError(t, err)
+	s, err := server.New(store, "", server.WithAuth(tokens))
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	serve := func(method, target, token string) int {
+		given := httptest.NewRequest(method, target, nil)
+		given.Header.Set("Accept", "application/json")
+		if token != "" {
+			given.Header.Set("Authorization", "Bearer "+token)
+		}
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, given)
+		return got.Code
+	}
+
+	hvk := base58.Encode([]byte("fish"))
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodDelete, "/metadata/"+hvk, ""))
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodDelete, "/metadata/"+hvk, "reader"))
+	require.Equal(t, http.StatusOK, serve(http.MethodDelete, "/metadata/"+hvk, "indexer"))
+	require.Equal(t, http.StatusOK, serve(http.MethodDelete, "/metadata/"+hvk, "operator"))
+
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/metadata/"+hvk, "indexer"))
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/metadata/"+hvk, "reader"))
+
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, "/export", "reader"))
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodPost, "/import", "indexer"))
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/ready", ""))
+
+	// Batch lookups are reads despite being a POST.
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodPost, "/encrypted/multihash/batch", "indexer"))
+	require.Equal(t, http.StatusOK, serve(http.MethodPost, "/encrypted/multihash/batch", "reader"))
+}
+
+func TestAuthorizer(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = server.New(store, "", server.WithAuthorizer(nil))
+	require.ErrorContains(t, err, "must not be nil")
+
+	tokens, err := auth.NewTokens(map[auth.Group][]string{auth.GroupWrite: {"indexer"}})
+	require.NoError(t, err)
+	var groups []auth.Group
+	authorizer := auth.AuthorizerFunc(func(r *http.Request, group auth.Group) auth.Decision {
+		groups = append(groups, group)
+		return auth.Decision{Allow: r.Header.Get("X-Signature") == "fish"}
+	})
+	s, err := server.New(store, "", server.WithAuth(tokens), server.WithAuthorizer(authorizer))
+	require.NoError(t, err)
+	serve := func(method, target, token, signature string) int {
+		given := httptest.NewRequest(method, target, nil)
+		given.Header.Set("Accept", "application/json")
+		if token != "" {
+			given.Header.Set("Authorization", "Bearer "+token)
+		}
+		if signature != "" {
+			given.Header.Set("X-Signature", signature)
+		}
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, given)
+		return got.Code
+	}
+
+	hvk := base58.Encode([]byte("fish"))
+	// Authorizers are invoked once tokens are checked.
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodDelete, "/metadata/"+hvk, "", "fish"))
+	require.Empty(t, groups)
+	require.Equal(t, http.StatusForbidden, serve(http.MethodDelete, "/metadata/"+hvk, "indexer", ""))
+	require.Equal(t, http.StatusOK, serve(http.MethodDelete, "/metadata/"+hvk, "indexer", "fish"))
+	require.Equal(t, http.StatusForbidden, serve(http.MethodGet, "/export", "", ""))
+	require.Equal(t, []auth.Group{auth.GroupWrite, auth.GroupWrite, auth.GroupAdmin}, groups)
+
+	// Reads are not subject to authorizers.
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/metadata/"+hvk, "", ""))
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/ready", "", ""))
+	require.Len(t, groups, 3)
+}
+
+type blockingStore struct {
+	*pebble.PebbleDHStore
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func (bs *blockingStore) GetMetadata(hvk dhstore.HashedValueKey) (dhstore.EncryptedMetadata, error) {
+	bs.entered <- struct{}{}
+	<-bs.unblock
+	return bs.PebbleDHStore.GetMetadata(hvk)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	pbstore, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer pbstore.Close()
+	store := &blockingStore{PebbleDHStore: pbstore, entered: make(chan struct{}), unblock: make(chan struct{})}
+
+	limiter, err := limit.New(1, 0)
+	require.NoError(t, err)
+	s, err := server.New(store, "", server.WithConcurrencyLimiter(limiter))
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, target, nil))
+		return got
+	}
+	target := "/metadata/" + base58.Encode([]byte("fish"))
+
+	done := make(chan int)
+	go func() { done <- serve(target).Code }()
+	<-store.entered
+
+	got := serve(target)
+	require.Equal(t, http.StatusServiceUnavailable, got.Code)
+	require.Equal(t, "1", got.Header().Get("Retry-After"))
+	var errResp dhstore.ErrorResponse
+	require.NoError(t, json.Unmarshal(got.Body.Bytes(), &errResp))
+	require.Equal(t, dhstore.ErrorCodeOverloaded, errResp.Code)
+	require.Equal(t, map[string]any{"retryAfterSeconds": 1.0}, errResp.Details)
+	// Health checks are not limited.
+	require.Equal(t, http.StatusOK, serve("/ready").Code)
+
+	close(store.unblock)
+	require.Equal(t, http.StatusNotFound, <-done)
+	go func() { <-store.entered }()
+	got = serve(target)
+	require.Equal(t, http.StatusNotFound, got.Code)
+	require.JSONEq(t, `{"code":"not_found","message":"Not Found"}`, got.Body.String())
+}
+
+func TestWriteListener(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	s, err := server.New(store, "", server.WithWriteListenAddr("127.0.0.1:0"))
+	require.NoError(t, err)
+	reads := s.Handler()
+	writes := s.WriteHandler()
+	require.NotNil(t, writes)
+
+	hvk := base58.Encode([]byte("fish"))
+	put := func(h http.Handler) int {
+		body, err := json.Marshal(server.PutMetadataRequest{Key: []byte("fish"), Value: []byte("lobster")})
+		require.NoError(t, err)
+		got := httptest.NewRecorder()
+		h.ServeHTTP(got, httptest.NewRequest(http.MethodPut, "/metadata", bytes.NewReader(body)))
+		return got.Code
+	}
+	get := func(h http.Handler) int {
+		got := httptest.NewRecorder()
+		h.ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/metadata/"+hvk, nil))
+		return got.Code
+	}
+
+	require.Equal(t, http.StatusMethodNotAllowed, put(reads))
+	require.Equal(t, http.StatusNotFound, get(reads))
+	require.Equal(t, http.StatusAccepted, put(writes))
+	require.Equal(t, http.StatusOK, get(reads))
+	require.Equal(t, http.StatusOK, get(writes))
+
+	s, err = server.New(store, "")
+	require.NoError(t, err)
+	require.Nil(t, s.WriteHandler())
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	var readOnly atomic.Bool
+	readOnly.Store(true)
+	s, err := server.New(store, "", server.WithReadOnly(readOnly.Load))
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	hvk := base58.Encode([]byte("fish"))
+	serve := func(method string) int {
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(method, "/metadata/"+hvk, nil))
+		return got.Code
+	}
+	require.Equal(t, http.StatusForbidden, serve(http.MethodDelete))
+	require.Equal(t, http.StatusNotFound, serve(http.MethodGet))
+
+	readOnly.Store(false)
+	require.Equal(t, http.StatusOK, serve(http.MethodDelete))
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	entered := make(chan struct{}, 1)
+	s, err := server.New(store, addr, server.WithMiddleware(signalEntered(entered)))
+	require.NoError(t, err)
+	require.NoError(t, s.Start(context.Background()))
+
+	// Start a write whose body is withheld, so that it is in flight when
+	// shutdown begins.
+	body, err := json.Marshal(server.PutMetadataRequest{Key: []byte("fish"), Value: []byte("lobster")})
+	require.NoError(t, err)
+	pr, pw := io.Pipe()
+	responses := make(chan *http.Response, 1)
+	go func() {
+		req, err := http.NewRequest(http.MethodPut, "http://"+addr+"/metadata", pr)
+		if err != nil {
+			panic(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			panic(err)
+		}
+		responses <- resp
+	}()
+	_, err = pw.Write(body[:1])
+	require.NoError(t, err)
+	// Let the request reach the server before shutting down.
+	<-entered
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	require.Eventually(t, func() bool {
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return got.Code == http.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		_, err := http.Get("http://" + addr + "/ready")
+		return err != nil
+	}, time.Second, 10*time.Millisecond, "new connections must be refused")
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before in-flight request completed: %v", err)
+	default:
+	}
+
+	_, err = pw.Write(body[1:])
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+	resp := <-responses
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.NoError(t, <-shutdown)
+}
+
+func TestShutdownClosesConnectionsAfterDrainTimeout(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	entered := make(chan struct{}, 1)
+	s, err := server.New(store, addr, server.WithMiddleware(signalEntered(entered)))
+	require.NoError(t, err)
+	require.NoError(t, s.Start(context.Background()))
+
+	pr, pw := io.Pipe()
+	failed := make(chan error, 1)
+	go func() {
+		req, err := http.NewRequest(http.MethodPut, "http://"+addr+"/metadata", pr)
+		if err != nil {
+			panic(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		failed <- err
+	}()
+	_, err = pw.Write([]byte("{"))
+	require.NoError(t, err)
+	// Let the request reach the server before shutting down.
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	require.NoError(t, pw.Close())
+	require.Error(t, <-failed)
+}
+
+// signalEntered returns a middleware that signals on entered once a request
+// reaches the server.
+func signalEntered(entered chan<- struct{}) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case entered <- struct{}{}:
+			default:
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	got := httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, "application/json", got.Header().Get("Content-Type"))
+	var doc struct {
+		OpenAPI string                               `json:"openapi"`
+		Paths   map[string]map[string]map[string]any `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(got.Body.Bytes(), &doc))
+	require.Equal(t, "3.0.3", doc.OpenAPI)
+	for path, methods := range map[string][]string{
+		"/multihash":                       {"put", "delete"},
+		"/multihash/{multihash}":           {"get"},
+		"/encrypted/multihash":             {"put", "delete"},
+		"/encrypted/multihash/{multihash}": {"get"},
+		"/cid/{cid}":                       {"get"},
+		"/metadata":                        {"put"},
+		"/metadata/{key}":                  {"get", "delete"},
+		"/ready":                           {"get"},
+	} {
+		require.Contains(t, doc.Paths, path)
+		for _, method := range methods {
+			require.Contains(t, doc.Paths[path], method, path)
+			require.NotEmpty(t, doc.Paths[path][method]["operationId"])
+		}
+	}
+}
+
+func TestEncryptedLookupsOnly(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = server.New(store, "", server.WithEncryptedLookupsOnly(true), server.WithDHFind("http://localhost"))
+	require.ErrorContains(t, err, "dhfind requires unencrypted lookups")
+
+	s, err := server.New(store, "", server.WithEncryptedLookupsOnly(true))
+	require.NoError(t, err)
+	require.ErrorContains(t, s.SetProvidersURLs([]string{"http://localhost"}), "dhfind requires unencrypted lookups")
+	subject := s.Handler()
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}}))
+	c := cid.NewCidV1(cid.Raw, mh)
+
+	for path, want := range map[string]int{
+		"/multihash/" + mh.B58String():           http.StatusNotFound,
+		"/cid/" + c.String():                     http.StatusNotFound,
+		"/encrypted/multihash/" + mh.B58String(): http.StatusOK,
+		"/encrypted/cid/" + c.String():           http.StatusOK,
+	} {
+		given := httptest.NewRequest(http.MethodGet, path, nil)
+		given.Header.Set("Accept", "application/json")
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, given)
+		require.Equal(t, want, got.Code, path)
+	}
+
+	got := httptest.NewRecorder()
+	subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	require.Equal(t, http.StatusOK, got.Code)
+	require.NotContains(t, got.Body.String(), `"/multihash/{multihash}"`)
+	require.NotContains(t, got.Body.String(), `"/cid/{cid}"`)
+	require.NotContains(t, got.Body.String(), `"/routing/v1/providers/{cid}"`)
+	require.Contains(t, got.Body.String(), `"/encrypted/multihash/{multihash}"`)
+}
+
+func TestWatch(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}}))
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	given := httptest.NewRequest(http.MethodGet, "/encrypted/multihash/"+mh.B58String()+"?watch=true", nil)
+	given.Header.Set("Accept", "application/x-ndjson")
+	got := httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, given)
+	require.Equal(t, http.StatusBadRequest, got.Code)
+
+	hub, err := watch.New(1)
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+	s, err = server.New(store, addr, server.WithWatchHub(hub))
+	require.NoError(t, err)
+	require.NoError(t, s.Start(context.Background()))
+	url := "http://" + addr + "/encrypted/multihash/" + mh.B58String() + "?watch=true"
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	dec := json.NewDecoder(resp.Body)
+	var result dhstore.EncryptedValueKeyResult
+	require.NoError(t, dec.Decode(&result))
+	require.Equal(t, dhstore.EncryptedValueKey("fish"), result.EncryptedValueKey)
+
+	// Beyond the watcher limit watches are rejected.
+	second, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	second.Header.Set("Accept", "application/x-ndjson")
+	rejected, err := http.DefaultClient.Do(second)
+	require.NoError(t, err)
+	require.NoError(t, rejected.Body.Close())
+	require.Equal(t, http.StatusServiceUnavailable, rejected.StatusCode)
+
+	body, err := json.Marshal(server.MergeIndexRequest{Merges: []dhstore.Index{{Key: mh, Value: []byte("lobster")}}})
+	require.NoError(t, err)
+	put, err := http.NewRequest(http.MethodPut, "http://"+addr+"/encrypted/multihash", bytes.NewReader(body))
+	require.NoError(t, err)
+	putResp, err := http.DefaultClient.Do(put)
+	require.NoError(t, err)
+	require.NoError(t, putResp.Body.Close())
+	require.Equal(t, http.StatusAccepted, putResp.StatusCode)
+
+	require.NoError(t, dec.Decode(&result))
+	require.Equal(t, dhstore.EncryptedValueKey("lobster"), result.EncryptedValueKey)
+
+	// Shutdown ends watches rather than waiting for them to drain.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	require.ErrorIs(t, dec.Decode(&result), io.EOF)
+}
+
+func TestWebSocketLookups(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}}))
+	missing, err := multihash.Sum([]byte("lobster"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+	s, err := server.New(store, addr, server.WithMaxWebSockets(1))
+	require.NoError(t, err)
+	require.NoError(t, s.Start(context.Background()))
+	url := "ws://" + addr + "/encrypted/multihash/ws"
+
+	conn, err := websocket.Dial(url, "", "http://"+addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Beyond the connection limit connections are rejected.
+	_, err = websocket.Dial(url, "", "http://"+addr)
+	require.ErrorContains(t, err, "bad status")
+
+	require.NoError(t, websocket.JSON.Send(conn, server.WebSocketLookupRequest{ID: "found", Multihash: mh}))
+	require.NoError(t, websocket.JSON.Send(conn, server.WebSocketLookupRequest{ID: "missing", Multihash: missing}))
+	require.NoError(t, websocket.JSON.Send(conn, server.WebSocketLookupRequest{ID: "invalid", Multihash: []byte("fish")}))
+	require.NoError(t, websocket.Message.Send(conn, "not json"))
+
+	got := make(map[string]server.WebSocketLookupResult)
+	for i := 0; i < 4; i++ {
+		var result server.WebSocketLookupResult
+		require.NoError(t, websocket.JSON.Receive(conn, &result))
+		got[result.ID] = result
+	}
+	require.Equal(t, http.StatusOK, got["found"].Status)
+	require.Equal(t, mh, got["found"].Multihash)
+	require.Equal(t, []dhstore.EncryptedValueKey{dhstore.EncryptedValueKey("fish")}, got["found"].EncryptedValueKeys)
+	require.Equal(t, http.StatusNotFound, got["missing"].Status)
+	require.Empty(t, got["missing"].EncryptedValueKeys)
+	require.Equal(t, http.StatusBadRequest, got["invalid"].Status)
+	require.Equal(t, http.StatusBadRequest, got[""].Status)
+	require.Contains(t, got[""].Error, "invalid request")
+
+	// Shutdown stops reading lookups and closes the connection.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+	var result server.WebSocketLookupResult
+	require.ErrorIs(t, websocket.JSON.Receive(conn, &result), io.EOF)
 }
 
-func writeJsonResponse(w http.ResponseWriter, status int, body []byte) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(status)
-	if _, err := w.Write(body); err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
+func TestAuditLog(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	var buf bytes.Buffer
+	auditLog, err := audit.New(&buf)
+	require.NoError(t, err)
+	_, err = server.New(store, "", server.WithAuditLog(nil))
+	require.ErrorContains(t, err, "audit log cannot be nil")
+	s, err := server.New(store, "", server.WithAuditLog(auditLog), server.WithProvenance("X-Writer", 1))
+	require.NoError(t, err)
+	subject := s.Handler()
+	serve := func(method, target, body string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-Writer", "indexer-1")
+		subject.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	mh, err := multihash.Sum([]byte("fish"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+	merge := fmt.Sprintf(`{"merges":[{"key":%q,"value":"ZmlzaA=="},{"key":%q,"value":"bG9ic3Rlcg=="}]}`, base64.StdEncoding.EncodeToString(mh), base64.StdEncoding.EncodeToString(mh))
+	serve(http.MethodPut, "/multihash", merge)
+	serve(http.MethodDelete, "/encrypted/multihash", merge)
+	serve(http.MethodPut, "/metadata", `{"key":"ZmlzaA==","value":"bG9ic3Rlcg=="}`)
+	serve(http.MethodDelete, "/metadata/"+base58.Encode([]byte("fish")), "")
+	// Reads are not recorded.
+	serve(http.MethodGet, "/metadata/"+base58.Encode([]byte("fish")), "")
+
+	var entries []audit.Entry
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var entry audit.Entry
+		require.NoError(t, dec.Decode(&entry))
+		require.Equal(t, "http", entry.Client.API)
+		require.Equal(t, "indexer-1", entry.Client.Tag)
+		require.NotEmpty(t, entry.Client.RequestID)
+		require.Empty(t, entry.Error)
+		entries = append(entries, entry)
+	}
+	require.Len(t, entries, 4)
+	for i, want := range []struct {
+		op    audit.Op
+		count int
+		key   string
+	}{
+		{audit.OpMergeIndexes, 2, mh.B58String()},
+		{audit.OpDeleteIndexes, 2, mh.B58String()},
+		{audit.OpPutMetadata, 1, base58.Encode([]byte("fish"))},
+		{audit.OpDeleteMetadata, 1, base58.Encode([]byte("fish"))},
+	} {
+		require.Equal(t, want.op, entries[i].Op)
+		require.Equal(t, want.count, entries[i].Count)
+		require.Equal(t, []string{want.key}, entries[i].Keys)
+	}
+
+	// Imports are recorded per batch, including failed ones.
+	buf.Reset()
+	exported := load.BinaryMagic + "\x03\x02\x01\x02\x04fish"
+	s, err = server.New(&failingImporter{PebbleDHStore: store, err: errors.New("lobster")}, "", server.WithAuditLog(auditLog))
+	require.NoError(t, err)
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/import", strings.NewReader(exported)))
+	var entry audit.Entry
+	require.NoError(t, json.NewDecoder(&buf).Decode(&entry))
+	require.Equal(t, audit.OpImport, entry.Op)
+	require.Equal(t, "http", entry.Client.API)
+	require.NotEmpty(t, entry.Client.RequestID)
+	require.Equal(t, 1, entry.Count)
+	require.Equal(t, []string{base58.Encode([]byte{1, 2})}, entry.Keys)
+	require.Equal(t, "lobster", entry.Error)
+}
+
+func TestStrictMerges(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = server.New(store, "", server.WithStrictMerges(0, 10))
+	require.ErrorContains(t, err, "minimum value length")
+	_, err = server.New(store, "", server.WithStrictMerges(10, 9))
+	require.ErrorContains(t, err, "maximum value length")
+
+	s, err := server.New(store, "", server.WithStrictMerges(4, 8))
+	require.NoError(t, err)
+	subject := s.Handler()
+	put := func(merges ...dhstore.Index) *httptest.ResponseRecorder {
+		body, err := json.Marshal(server.MergeIndexRequest{Merges: merges})
+		require.NoError(t, err)
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodPut, "/multihash", bytes.NewReader(body)))
+		return got
+	}
+
+	mh, err := multihash.Sum([]byte("fish"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+	notDblMh, err := multihash.Sum([]byte("fish"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+
+	got := put(
+		dhstore.Index{Key: mh, Value: []byte("fish")},
+		dhstore.Index{Key: mh, Value: []byte("lobster!!")},
+		dhstore.Index{Key: notDblMh, Value: []byte("fish")},
+		dhstore.Index{Key: []byte("fish"), Value: []byte("fish")},
+		dhstore.Index{Key: mh, Value: []byte("fish")},
+		dhstore.Index{Key: mh, Value: []byte("cod!")},
+	)
+	require.Equal(t, http.StatusBadRequest, got.Code)
+	require.JSONEq(t, `{
+		"code": "bad_request",
+		"message": "4 of 6 merges are invalid",
+		"details": {
+			"invalid": 4,
+			"merges": [
+				{"index": 1, "code": "bad_value_length", "message": "encrypted value key length must be between 4 and 8 bytes, got: 9"},
+				{"index": 2, "code": "unsupported_codec", "message": "multihash must be of code dbl-sha2-256, got: sha2-256"},
+				{"index": 3, "code": "bad_multihash", "message": "failed to decode multihash 3cqA6K: length greater than remaining number of bytes in buffer"},
+				{"index": 4, "code": "duplicate_merge", "message": "duplicate of merge 0"}
+			]
+		}
+	}`, got.Body.String())
+	// Nothing is merged from rejected requests.
+	evks, err := store.Lookup(mh)
+	require.NoError(t, err)
+	require.Empty(t, evks)
+
+	// The same value may be merged under different keys.
+	otherMh, err := multihash.Sum([]byte("lobster"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusAccepted, put(dhstore.Index{Key: mh, Value: []byte("fish")}, dhstore.Index{Key: otherMh, Value: []byte("fish")}).Code)
+	evks, err = store.Lookup(mh)
+	require.NoError(t, err)
+	require.Len(t, evks, 1)
+}
+
+func TestRequestValidation(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	s, err := server.New(store, "", server.WithRequestValidation(true))
+	require.NoError(t, err)
+	subject := s.Handler()
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return got
+	}
+
+	mh, err := multihash.Sum([]byte("fish"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+	hvk := base58.Encode([]byte("fish"))
+
+	for _, test := range []struct {
+		name, method, target, body string
+		wantErr                    string
+		wantCode                   string
+	}{
+		{
+			name:    "missing merges",
+			method:  http.MethodPut,
+			target:  "/multihash",
+			body:    `{}`,
+			wantErr: `missing required property "merges"`,
+		},
+		{
+			name:    "empty merges",
+			method:  http.MethodPut,
+			target:  "/encrypted/multihash",
+			body:    `{"merges":[]}`,
+			wantErr: "merges: expected at least 1 items",
+		},
+		{
+			name:    "missing merge key",
+			method:  http.MethodDelete,
+			target:  "/multihash",
+			body:    `{"merges":[{"value":"ZmlzaA=="}]}`,
+			wantErr: `merges: [0]: missing required property "key"`,
+		},
+		{
+			name:    "non-base64 value",
+			method:  http.MethodPut,
+			target:  "/multihash",
+			body:    `{"merges":[{"key":"ZmlzaA==","value":"!"}]}`,
+			wantErr: "merges: [0]: value: expected base64 encoded bytes",
+		},
+		{
+			name:    "malformed JSON",
+			method:  http.MethodPut,
+			target:  "/metadata",
+			body:    `{`,
+			wantErr: "invalid request body",
+		},
+		{
+			name:    "metadata without key",
+			method:  http.MethodPut,
+			target:  "/metadata",
+			body:    `{"value":"ZmlzaA=="}`,
+			wantErr: `missing required property`,
+		},
+		{
+			name:     "non-multibase multihash",
+			method:   http.MethodGet,
+			target:   "/multihash/fish+",
+			wantErr:  "invalid path parameter multihash",
+			wantCode: dhstore.ErrorCodeBadMultihash,
+		},
+		{
+			name:     "non-base58 metadata key",
+			method:   http.MethodDelete,
+			target:   "/metadata/0OIl",
+			wantErr:  "invalid path parameter key",
+			wantCode: dhstore.ErrorCodeBadKey,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := serve(test.method, test.target, test.body)
+			require.Equal(t, http.StatusBadRequest, got.Code)
+			require.Equal(t, "application/json", got.Header().Get("Content-Type"))
+			var errResp dhstore.ErrorResponse
+			require.NoError(t, json.Unmarshal(got.Body.Bytes(), &errResp))
+			require.Contains(t, errResp.Message, test.wantErr)
+			wantCode := test.wantCode
+			if wantCode == "" {
+				wantCode = dhstore.ErrorCodeBadRequest
+			}
+			require.Equal(t, wantCode, errResp.Code)
+		})
+	}
+
+	merge := fmt.Sprintf(`{"merges":[{"key":%q,"value":"ZmlzaA=="}]}`, base64.StdEncoding.EncodeToString(mh))
+	require.Equal(t, http.StatusAccepted, serve(http.MethodPut, "/multihash", merge).Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/multihash/"+mh.B58String(), "").Code)
+	require.Equal(t, http.StatusAccepted, serve(http.MethodPut, "/metadata", `{"key":"ZmlzaA==","value":"bG9ic3Rlcg=="}`).Code)
+	require.Equal(t, http.StatusAccepted, serve(http.MethodPut, "/metadata", `{"metadata":[{"key":"ZmlzaA==","value":"bG9ic3Rlcg=="}]}`).Code)
+	require.Equal(t, http.StatusOK, serve(http.MethodGet, "/metadata/"+hvk, "").Code)
+	// Undocumented methods are left to the handlers.
+	require.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodPost, "/multihash", "").Code)
+}
+
+func TestHTTP3RequiresTLS(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = server.New(store, "", server.WithHTTP3ListenAddr("127.0.0.1:0"))
+	require.ErrorContains(t, err, "requires TLS")
+	_, err = server.New(store, "", server.WithHTTP3ListenAddr(""))
+	require.Error(t, err)
+}
+
+func TestRequestID(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	serve := func(target, requestID string) *httptest.ResponseRecorder {
+		given := httptest.NewRequest(http.MethodGet, target, nil)
+		if requestID != "" {
+			given.Header.Set("X-Request-Id", requestID)
+		}
+		got := httptest.NewRecorder()
+		s.Handler().ServeHTTP(got, given)
+		return got
+	}
+
+	got := serve("/ready", "")
+	require.Len(t, got.Header().Get("X-Request-Id"), 16)
+	require.NotEqual(t, got.Header().Get("X-Request-Id"), serve("/ready", "").Header().Get("X-Request-Id"))
+
+	require.Equal(t, "fish-42", serve("/ready", "fish-42").Header().Get("X-Request-Id"))
+	got = serve("/metadata/"+base58.Encode([]byte("fish")), "fish-43")
+	require.Equal(t, http.StatusNotFound, got.Code)
+	require.Equal(t, "fish-43", got.Header().Get("X-Request-Id"))
+
+	// Invalid IDs are replaced.
+	for _, invalid := range []string{"fish lobster", strings.Repeat("a", 129)} {
+		got := serve("/ready", invalid).Header().Get("X-Request-Id")
+		require.NotEqual(t, invalid, got)
+		require.Len(t, got, 16)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = server.New(store, "", server.WithMiddleware(nil))
+	require.ErrorContains(t, err, "cannot be nil")
+
+	var order []string
+	middleware := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name+":"+r.Header.Get("X-Request-Id"))
+				if r.Header.Get("Authorization") != "Bearer fish" {
+					http.Error(w, "", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	s, err := server.New(store, "", server.WithMiddleware(middleware("outer")), server.WithMiddleware(middleware("inner")))
+	require.NoError(t, err)
+
+	given := httptest.NewRequest(http.MethodGet, "/ready", nil)
+	given.Header.Set("X-Request-Id", "lobster")
+	got := httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, given)
+	require.Equal(t, http.StatusUnauthorized, got.Code)
+	require.Equal(t, []string{"outer:lobster"}, order)
+
+	order = nil
+	given.Header.Set("Authorization", "Bearer fish")
+	got = httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, given)
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, []string{"outer:lobster", "inner:lobster"}, order)
+}
+
+func TestRequestIDPropagatedToDHFind(t *testing.T) {
+	var mu sync.Mutex
+	var requestIDs []string
+	provServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/providers" {
+			mu.Lock()
+			requestIDs = append(requestIDs, r.Header.Get("X-Request-Id"))
+			mu.Unlock()
+		}
+		providersHandler(w, r)
+	}))
+	defer provServ.Close()
+
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	origMh, err := multihash.FromB58String("QmcgwdNjFQVhKt6aWWtSPgdLbNvULRoFMU6CCYwHsN3EEH")
+	require.NoError(t, err)
+	pid, err := peer.Decode("12D3KooWKRyzVWW6ChFjQjK4miCty85Niy48tpPV95XdKu1BcvMA")
+	require.NoError(t, err)
+	loadStore(t, origMh, []byte("fish"), []byte("lobster"), pid, store)
+
+	s, err := server.New(store, "", server.WithDHFind(provServ.URL))
+	require.NoError(t, err)
+
+	given := httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String(), nil)
+	given.Header.Set("X-Request-Id", "fish-44")
+	got := httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, given)
+	require.Equal(t, http.StatusOK, got.Code)
+	mu.Lock()
+	require.Contains(t, requestIDs, "fish-44")
+	mu.Unlock()
+
+	// IDs are also propagated via a given client, whose transport is wrapped.
+	var sent atomic.Int32
+	client := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		sent.Add(1)
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	_, err = server.New(store, "", server.WithHTTPClient(nil))
+	require.ErrorContains(t, err, "http client cannot be nil")
+	s, err = server.New(store, "", server.WithDHFind(provServ.URL), server.WithHTTPClient(client))
+	require.NoError(t, err)
+	given = httptest.NewRequest(http.MethodGet, "/multihash/"+origMh.B58String(), nil)
+	given.Header.Set("X-Request-Id", "fish-45")
+	got = httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, given)
+	require.Equal(t, http.StatusOK, got.Code)
+	mu.Lock()
+	require.Contains(t, requestIDs, "fish-45")
+	mu.Unlock()
+	require.NotZero(t, sent.Load())
+	// The given client is left untouched.
+	require.IsType(t, roundTripperFunc(nil), client.Transport)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestLookupPagination(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	mh, err := multihash.Sum([]byte("fish"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+	var want []dhstore.EncryptedValueKey
+	merges := make([]dhstore.Index, 0, 5)
+	for _, evk := range []string{"lobster", "crab", "squid", "eel", "octopus"} {
+		merges = append(merges, dhstore.Index{Key: mh, Value: dhstore.EncryptedValueKey(evk)})
+	}
+	require.NoError(t, store.MergeIndexes(merges))
+	for _, evk := range []string{"crab", "eel", "lobster", "octopus", "squid"} {
+		want = append(want, dhstore.EncryptedValueKey(evk))
+	}
+
+	lookup := func(subject http.Handler, query string) ([]dhstore.EncryptedValueKey, string, int) {
+		got := httptest.NewRecorder()
+		subject.ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/encrypted/multihash/"+mh.B58String()+query, nil))
+		if got.Code != http.StatusOK {
+			return nil, "", got.Code
+		}
+		findRsp, err := model.UnmarshalFindResponse(got.Body.Bytes())
+		require.NoError(t, err)
+		require.Len(t, findRsp.EncryptedMultihashResults, 1)
+		var evks []dhstore.EncryptedValueKey
+		for _, evk := range findRsp.EncryptedMultihashResults[0].EncryptedValueKeys {
+			evks = append(evks, evk)
+		}
+		return evks, got.Header().Get("X-Next-Cursor"), got.Code
+	}
+	pageAll := func(subject http.Handler, query string) ([]dhstore.EncryptedValueKey, int) {
+		var all []dhstore.EncryptedValueKey
+		var pages int
+		for cursor := ""; ; pages++ {
+			q := query
+			if cursor != "" {
+				q += "&cursor=" + cursor
+			}
+			evks, next, status := lookup(subject, q)
+			require.Equal(t, http.StatusOK, status)
+			all = append(all, evks...)
+			if next == "" {
+				return all, pages + 1
+			}
+			cursor = next
+		}
+	}
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	subject := s.Handler()
+
+	evks, next, _ := lookup(subject, "")
+	require.Len(t, evks, 5)
+	require.Empty(t, next)
+
+	all, pages := pageAll(subject, "?limit=2")
+	require.Equal(t, want, all)
+	require.Equal(t, 3, pages)
+
+	_, _, status := lookup(subject, "?limit=0")
+	require.Equal(t, http.StatusBadRequest, status)
+	_, _, status = lookup(subject, "?cursor=!")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// The server bounds pages regardless of the requested limit.
+	s, err = server.New(store, "", server.WithLookupPageLimit(4))
+	require.NoError(t, err)
+	subject = s.Handler()
+	evks, next, _ = lookup(subject, "")
+	require.Equal(t, want[:4], evks)
+	require.NotEmpty(t, next)
+	all, pages = pageAll(subject, "?limit=10")
+	require.Equal(t, want, all)
+	require.Equal(t, 2, pages)
+
+	_, err = server.New(store, "", server.WithLookupPageLimit(0))
+	require.Error(t, err)
+}
+
+func TestMhStream(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	stream := func(body io.Reader) []server.StreamBatchResult {
+		resp, err := http.Post(ts.URL+"/multihash/stream", "application/x-ndjson", body)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		var results []server.StreamBatchResult
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var result server.StreamBatchResult
+			err := dec.Decode(&result)
+			if err == io.EOF {
+				return results
+			}
+			require.NoError(t, err)
+			results = append(results, result)
+		}
+	}
+
+	const count = 5000
+	mhs := make([]multihash.Multihash, count)
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for i := range mhs {
+		mhs[i], err = multihash.Sum([]byte(fmt.Sprint("fish", i)), multihash.DBL_SHA2_256, -1)
+		require.NoError(t, err)
+		require.NoError(t, enc.Encode(dhstore.Index{Key: mhs[i], Value: dhstore.EncryptedValueKey("lobster")}))
+	}
+
+	// Stream the records through a pipe, so that they are not buffered.
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(pw, &body)
+		_ = pw.CloseWithError(err)
+	}()
+	require.Equal(t, []server.StreamBatchResult{
+		{Batch: 1, Merged: 4096, Applied: 4096},
+		{Batch: 2, Merged: count - 4096, Applied: count},
+	}, stream(pr))
+	for _, i := range []int{0, 4095, 4096, count - 1} {
+		evks, err := store.Lookup(mhs[i])
+		require.NoError(t, err)
+		require.Equal(t, []dhstore.EncryptedValueKey{dhstore.EncryptedValueKey("lobster")}, evks)
+	}
+
+	require.Empty(t, stream(strings.NewReader("")))
+
+	results := stream(strings.NewReader(`{"key":"ZmlzaA==","value":"ZmlzaA=="}`))
+	require.Len(t, results, 1)
+	require.Equal(t, 0, results[0].Applied)
+	require.Contains(t, results[0].Error, "multihash")
+
+	body.Reset()
+	require.NoError(t, enc.Encode(dhstore.Index{Key: mhs[0], Value: dhstore.EncryptedValueKey("crab")}))
+	body.WriteString("not json\n")
+	results = stream(&body)
+	require.Len(t, results, 1)
+	require.Contains(t, results[0].Error, "cannot decode merge")
+
+	resp, err := http.Get(ts.URL + "/multihash/stream")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestLive(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	release := make(chan struct{})
+	var wedged atomic.Bool
+	block := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if wedged.Load() {
+				<-release
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	s, err := server.New(&unavailableStore{PebbleDHStore: store, err: dhstore.ErrUnavailable{Err: errors.New("fish")}}, "",
+		server.WithMiddleware(block))
+	require.NoError(t, err)
+
+	// Unavailable stores do not fail liveness, since restarts do not help.
+	require.NoError(t, s.Live(context.Background()))
+
+	wedged.Store(true)
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Live(ctx), context.DeadlineExceeded)
+}
+
+func TestReadyReportsBuildInfo(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+	s, err := server.New(store, "")
+	require.NoError(t, err)
+
+	got := httptest.NewRecorder()
+	s.Handler().ServeHTTP(got, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	require.Equal(t, http.StatusOK, got.Code)
+	lines := strings.Split(strings.TrimSpace(got.Body.String()), "\n")
+	require.Equal(t, dhstore.Version, lines[0])
+	require.Contains(t, lines, "go version: "+runtime.Version())
+	require.Contains(t, lines, "store format: "+store.StoreFormat())
+	require.True(t, strings.HasPrefix(store.StoreFormat(), "pebble "))
+}
+
+// flushCountingRecorder counts the flushes of a response.
+type flushCountingRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (r *flushCountingRecorder) Flush() {
+	r.flushes++
+	r.ResponseRecorder.Flush()
+}
+
+func TestResponseDefaults(t *testing.T) {
+	pbstore, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer pbstore.Close()
+	store := &streamingStore{PebbleDHStore: pbstore}
+
+	_, err = server.New(store, "", server.WithDefaultAccept("text/html"))
+	require.ErrorContains(t, err, "unsupported default accept")
+	_, err = server.New(store, "", server.WithNDJSONFlushInterval(-time.Second))
+	require.ErrorContains(t, err, "cannot be negative")
+
+	mh, err := multihash.FromB58String("2wvdp9y1J63yDvaPawP4kUjXezRLcu9x9u2DAB154dwai82")
+	require.NoError(t, err)
+	dhmh := dhash.SecondMultihash(mh)
+	require.NoError(t, store.MergeIndexes([]dhstore.Index{{Key: dhmh, Value: []byte("fish")}, {Key: dhmh, Value: []byte("lobster")}, {Key: dhmh, Value: []byte("undersea")}}))
+	lookup := func(s *server.Server, accept string) *flushCountingRecorder {
+		given := httptest.NewRequest(http.MethodGet, "/encrypted/multihash/"+dhmh.B58String(), nil)
+		if accept != "" {
+			given.Header.Set("Accept", accept)
+		}
+		got := &flushCountingRecorder{ResponseRecorder: httptest.NewRecorder()}
+		s.Handler().ServeHTTP(got, given)
+		return got
 	}
+
+	// Without a default, requests without an Accept header are rejected
+	// unless JSON is preferred.
+	s, err := server.New(store, "", server.WithPreferJSON(false))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, lookup(s, "").Code)
+	s, err = server.New(store, "", server.WithPreferJSON(false), server.WithDefaultAccept("application/x-ndjson"))
+	require.NoError(t, err)
+	got := lookup(s, "")
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, "application/x-ndjson", got.Header().Get("Content-Type"))
+	require.Equal(t, 3, strings.Count(got.Body.String(), "\n"))
+	require.Equal(t, 3, got.flushes)
+
+	// The Accept header of requests takes precedence over the default.
+	got = lookup(s, "application/json")
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, "application/json", got.Header().Get("Content-Type"))
+
+	// Lines written within the flush interval are not flushed until the next
+	// line written after it.
+	clk := clock.NewMock(time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC))
+	s, err = server.New(store, "", server.WithClock(clk), server.WithNDJSONFlushInterval(time.Second))
+	require.NoError(t, err)
+	got = lookup(s, "application/x-ndjson")
+	require.Equal(t, http.StatusOK, got.Code)
+	require.Equal(t, 3, strings.Count(got.Body.String(), "\n"))
+	require.Equal(t, 1, got.flushes)
+}
+
+func TestMaxValueKeySize(t *testing.T) {
+	store, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = server.New(store, "", server.WithMaxValueKeySize(-1))
+	require.ErrorContains(t, err, "cannot be negative")
+
+	s, err := server.New(store, "", server.WithMaxValueKeySize(4))
+	require.NoError(t, err)
+	subject := s.Handler()
+	mh, err := multihash.Sum([]byte("fish"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+
+	body, err := json.Marshal(server.MergeIndexRequest{Merges: []dhstore.Index{{Key: mh, Value: []byte("fish")}, {Key: mh, Value: []byte("lobster")}}})
+	require.NoError(t, err)
+	got := httptest.NewRecorder()
+	subject.ServeHTTP(got, httptest.NewRequest(http.MethodPut, "/multihash", bytes.NewReader(body)))
+	require.Equal(t, http.StatusBadRequest, got.Code)
+	require.JSONEq(t, `{"code": "bad_value_length", "message": "encrypted value key cannot be larger than 4 bytes, got: 7"}`, got.Body.String())
+	evks, err := store.Lookup(mh)
+	require.NoError(t, err)
+	require.Empty(t, evks)
+
+	body, err = json.Marshal(server.MergeIndexRequest{Merges: []dhstore.Index{{Key: mh, Value: []byte("fish")}}})
+	require.NoError(t, err)
+	got = httptest.NewRecorder()
+	subject.ServeHTTP(got, httptest.NewRequest(http.MethodPut, "/multihash", bytes.NewReader(body)))
+	require.Equal(t, http.StatusAccepted, got.Code)
 }
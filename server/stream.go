@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/audit"
+)
+
+const (
+	// streamBatchMaxRecords is the maximum number of merges applied per batch
+	// of a streamed ingest.
+	streamBatchMaxRecords = 4096
+	// streamBatchMaxBytes is the maximum total size of the keys and values of
+	// the merges applied per batch of a streamed ingest.
+	streamBatchMaxBytes = 4 << 20
+)
+
+// handleMhStream merges an unbounded NDJSON stream of {key,value} records into
+// the store, applying them in size-bounded batches as they arrive so that
+// neither end needs to buffer the whole stream. The result of each batch is
+// written back as a line of NDJSON once applied. Ingest stops at the first
+// batch that fails, whose result carries the error; the records of all prior
+// batches are applied, and so the client can resume right after them.
+func (s *Server) handleMhStream(w http.ResponseWriter, r *http.Request) {
+	if s.metrics != nil {
+		ws := newResponseWriterWithStatus(w)
+		w = ws
+		start := s.clock.Now()
+		defer func() {
+			s.metrics.RecordHttpLatency(r.Context(), s.clock.Since(start), r.Method, "multihash_stream", ws.status)
+		}()
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.rejectWrite(w, r) {
+		return
+	}
+
+	// Results are written while the request body is still being read.
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil {
+		logger(r.Context()).Debugw("Full duplex not supported", "err", err)
+	}
+	w.Header().Set("Content-Type", mediaTypeNDJSON)
+	enc := json.NewEncoder(w)
+
+	dec := json.NewDecoder(r.Body)
+	result := StreamBatchResult{}
+	batch := make([]dhstore.Index, 0, streamBatchMaxRecords)
+	var batchBytes int
+	for {
+		var merge dhstore.Index
+		err := dec.Decode(&merge)
+		if err == nil {
+			batch = append(batch, merge)
+			batchBytes += len(merge.Key) + len(merge.Value)
+			if len(batch) < streamBatchMaxRecords && batchBytes < streamBatchMaxBytes {
+				continue
+			}
+		} else if !errors.Is(err, io.EOF) {
+			logger(r.Context()).Errorw("Cannot decode merge stream", "applied", result.Applied, "err", err)
+			result.Batch++
+			result.Merged = 0
+			result.Error = "cannot decode merge: " + err.Error()
+			_ = enc.Encode(result)
+			return
+		}
+
+		if len(batch) != 0 {
+			result.Batch++
+			result.Merged = len(batch)
+			if err := s.applyStreamBatch(r, batch); err != nil {
+				result.Merged = 0
+				result.Error = err.Error()
+				_ = enc.Encode(result)
+				return
+			}
+			result.Applied += len(batch)
+			if err := enc.Encode(result); err != nil {
+				logger(r.Context()).Errorw("Failed to write merge stream result", "applied", result.Applied, "err", err)
+				return
+			}
+			_ = rc.Flush()
+			batch = batch[:0]
+			batchBytes = 0
+		}
+		if err != nil {
+			// End of stream.
+			if result.Batch == 0 {
+				w.WriteHeader(http.StatusOK)
+			}
+			logger(r.Context()).Infow("Merged stream", "batches", result.Batch, "applied", result.Applied)
+			return
+		}
+	}
+}
+
+// applyStreamBatch merges the given batch of a streamed ingest, unless the
+// store has come under write pressure since the stream started.
+func (s *Server) applyStreamBatch(r *http.Request, batch []dhstore.Index) error {
+	if bp := s.writeBackpressure; bp != nil && bp.reporter.WritePressure() >= bp.threshold {
+		return errors.New("store is near its stop-writes threshold")
+	}
+	if err := dhstore.CheckValueKeySizes(batch, s.maxValueKeySize); err != nil {
+		s.recordFailedWrite(r, "merge", "stream", errorCode(err), len(batch))
+		return err
+	}
+	err := s.dhs.MergeIndexes(batch)
+	s.auditIndexes(r, audit.OpMergeIndexes, batch, err)
+	if err != nil {
+		logger(r.Context()).Errorw("Failed to merge stream batch", "count", len(batch), "err", err)
+		s.recordFailedWrite(r, "merge", "stream", errorCode(err), len(batch))
+		return err
+	}
+	s.recordMergeBatch(r, "stream", batch)
+	s.recordProvenance(r, batch)
+	s.publishMerges(batch)
+	return nil
+}
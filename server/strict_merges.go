@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ipni/dhstore"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+// maxMergeErrors bounds the number of invalid merges detailed in the response
+// to a request rejected by strict merge validation.
+const maxMergeErrors = 100
+
+// strictMerges validates each merge of a request before any is applied, so
+// that clients learn which of their merges are invalid rather than the store
+// failing on the first.
+type strictMerges struct {
+	minValueLen int
+	maxValueLen int
+}
+
+// mergeError is the error of a single merge of a request, identified by its
+// index in the request.
+type mergeError struct {
+	Index   int    `json:"index"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// check responds with 400 Bad Request unless all merges are valid, and returns
+// the number of invalid merges by error code, which is empty if all are valid.
+// The details of the response list the errors of up to maxMergeErrors invalid
+// merges, along with the total count of invalid merges.
+func (sm *strictMerges) check(w http.ResponseWriter, r *http.Request, merges []dhstore.Index) map[string]int {
+	errs, invalid := sm.validate(merges)
+	if len(invalid) == 0 {
+		return nil
+	}
+	var total int
+	for _, count := range invalid {
+		total += count
+	}
+	logger(r.Context()).Warnw("Rejecting invalid merges", "invalid", total, "merges", len(merges))
+	dhstore.ErrorResponse{
+		Code:    dhstore.ErrorCodeBadRequest,
+		Message: fmt.Sprintf("%d of %d merges are invalid", total, len(merges)),
+		Details: map[string]any{"merges": errs, "invalid": total},
+	}.Write(w, http.StatusBadRequest)
+	return invalid
+}
+
+// validate returns the errors of up to maxMergeErrors invalid merges, and the
+// number of invalid merges by error code.
+func (sm *strictMerges) validate(merges []dhstore.Index) ([]mergeError, map[string]int) {
+	var errs []mergeError
+	var invalid map[string]int
+	// Maps the key and value of each valid merge to its index. Since keys are
+	// valid multihashes, which encode their length, their concatenation with
+	// values is unambiguous.
+	seen := make(map[string]int, len(merges))
+	for i, merge := range merges {
+		err := sm.validateMerge(merge, i, seen)
+		if err == nil {
+			continue
+		}
+		if invalid == nil {
+			invalid = make(map[string]int)
+		}
+		invalid[err.Code]++
+		if len(errs) < maxMergeErrors {
+			errs = append(errs, *err)
+		}
+	}
+	return errs, invalid
+}
+
+func (sm *strictMerges) validateMerge(merge dhstore.Index, i int, seen map[string]int) *mergeError {
+	dmh, err := multihash.Decode(merge.Key)
+	if err != nil {
+		err = dhstore.ErrMultihashDecode{Err: err, Mh: merge.Key}
+		return &mergeError{Index: i, Code: dhstore.ErrorCodeBadMultihash, Message: err.Error()}
+	}
+	if dmh.Code != multihash.DBL_SHA2_256 {
+		err = dhstore.ErrUnsupportedMulticodecCode{Code: multicodec.Code(dmh.Code)}
+		return &mergeError{Index: i, Code: dhstore.ErrorCodeUnsupportedCodec, Message: err.Error()}
+	}
+	if n := len(merge.Value); n < sm.minValueLen || n > sm.maxValueLen {
+		return &mergeError{
+			Index:   i,
+			Code:    dhstore.ErrorCodeBadValueLength,
+			Message: fmt.Sprintf("encrypted value key length must be between %d and %d bytes, got: %d", sm.minValueLen, sm.maxValueLen, n),
+		}
+	}
+	key := string(merge.Key) + string(merge.Value)
+	if j, ok := seen[key]; ok {
+		return &mergeError{Index: i, Code: dhstore.ErrorCodeDuplicateMerge, Message: fmt.Sprintf("duplicate of merge %d", j)}
+	}
+	seen[key] = i
+	return nil
+}
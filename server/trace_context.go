@@ -0,0 +1,22 @@
+package server
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// traceContext extracts the W3C trace context of requests.
+var traceContext propagation.TraceContext
+
+// withTraceContext wraps the given handler such that the context of every
+// request carries the trace context set by the client in its traceparent
+// header, if any, e.g. by a tracing proxy in front of dhstore. The latencies of
+// sampled requests are then recorded with exemplars that link them to their
+// traces.
+func withTraceContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/watch"
+	"github.com/ipni/go-libipni/rwriter"
+)
+
+// watchHeartbeatInterval is the interval at which an empty line is written to
+// idle watch responses, so that intermediaries do not time out the connection.
+const watchHeartbeatInterval = 30 * time.Second
+
+// isWatch reports whether the given request asks to watch a multihash, in
+// which case it is not subject to the concurrency limit since it stays open
+// for as long as the client watches.
+func isWatch(r *http.Request) bool {
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, "/encrypted/") {
+		return false
+	}
+	watch, _ := strconv.ParseBool(r.URL.Query().Get("watch"))
+	return watch
+}
+
+// watchMh streams the encrypted value keys of a multihash as NDJSON, starting
+// with the current keys followed by newly merged keys as they arrive, until
+// the client disconnects or the server shuts down. Since watching starts
+// before the current keys are looked up, keys merged in between may be
+// written twice. The response ends early if the client does not keep up with
+// merges, upon which it is expected to watch again.
+func (s *Server) watchMh(w http.ResponseWriter, r *http.Request, rw *rwriter.ResponseWriter) {
+	if s.watchHub == nil {
+		dhstore.HTTPError(w, "watch is not enabled", http.StatusBadRequest)
+		return
+	}
+	watcher, err := s.watchHub.Watch(rw.Multihash())
+	if err != nil {
+		if errors.Is(err, watch.ErrTooManyWatchers) {
+			logger(r.Context()).Warnw("Rejecting watch due to watcher limit", "err", err)
+			writeOverloaded(w, err.Error(), watchHeartbeatInterval)
+			return
+		}
+		s.handleError(w, err)
+		return
+	}
+	defer watcher.Close()
+
+	evks, err := s.dhs.Lookup(rw.Multihash())
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	// Results are written as they arrive regardless of the accepted media
+	// type, since a watch never completes a JSON document, unless streamed as
+	// events.
+	if w.Header().Get("Content-Type") != mediaTypeEventStream {
+		w.Header().Set("Content-Type", mediaTypeNDJSON)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	write := func(evk dhstore.EncryptedValueKey) error {
+		return enc.Encode(dhstore.EncryptedValueKeyResult{EncryptedValueKey: evk})
+	}
+	for _, evk := range evks {
+		if err := write(evk); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := s.clock.NewTicker(watchHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case evk, ok := <-watcher.C():
+			if !ok {
+				if watcher.Dropped() {
+					logger(r.Context()).Warnw("Ending watch that did not keep up with merges", "multihash", rw.Multihash().B58String())
+				}
+				return
+			}
+			if err := write(evk); err != nil {
+				return
+			}
+			// Write out any other keys already received before flushing.
+			for drained := false; !drained; {
+				select {
+				case evk, ok := <-watcher.C():
+					if !ok {
+						drained = true
+						break
+					}
+					if err := write(evk); err != nil {
+						return
+					}
+				default:
+					drained = true
+				}
+			}
+		case <-heartbeat.C():
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.streamsCtx.Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// publishMerges notifies watchers of the given applied merges.
+func (s *Server) publishMerges(merges []dhstore.Index) {
+	if s.watchHub != nil {
+		s.watchHub.Publish(merges)
+	}
+}
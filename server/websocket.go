@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/limit"
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// webSocketLookupPath is the path at which WebSocket lookups are served.
+	webSocketLookupPath = "/encrypted/multihash/ws"
+	// webSocketMaxMessageSize bounds the size of lookup requests, which only
+	// carry a multihash and an ID.
+	webSocketMaxMessageSize = 4 << 10
+	// webSocketLookupConcurrency is the number of lookups served concurrently
+	// per connection, beyond which requests are not read until one completes.
+	webSocketLookupConcurrency = 16
+	// webSocketWriteTimeout bounds how long a result waits for the client to
+	// read it, so that stalled clients do not hold up draining.
+	webSocketWriteTimeout = 10 * time.Second
+)
+
+// isWebSocketLookup reports whether the given request opens a WebSocket lookup
+// connection, in which case it is not subject to the concurrency limit since
+// it stays open for as long as the client looks up.
+func isWebSocketLookup(r *http.Request) bool {
+	return r.URL.Path == webSocketLookupPath
+}
+
+// hijackableResponseWriter exposes the hijacking of a wrapped ResponseWriter,
+// which the websocket package requires the ResponseWriter to implement.
+type hijackableResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w hijackableResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// handleWebSocketLookup upgrades the request to a WebSocket connection over
+// which WebSocketLookupRequest messages are read and answered with a
+// WebSocketLookupResult each, in the order lookups complete.
+func (s *Server) handleWebSocketLookup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		dhstore.HTTPError(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ProtoMajor != 1 {
+		// Connections cannot be upgraded over HTTP/2 and HTTP/3.
+		dhstore.HTTPError(w, "WebSocket lookups require HTTP/1.1", http.StatusBadRequest)
+		return
+	}
+	if err := s.openWebSocket(); err != nil {
+		logger(r.Context()).Warnw("Rejecting WebSocket lookups", "err", err)
+		code := dhstore.ErrorCodeOverloaded
+		if s.draining.Load() {
+			code = dhstore.ErrorCodeUnavailable
+		}
+		dhstore.ErrorResponse{Code: code, Message: err.Error()}.Write(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer s.closeWebSocket()
+	websocket.Server{Handler: s.serveWebSocketLookups}.ServeHTTP(hijackableResponseWriter{w}, r)
+}
+
+// openWebSocket counts a new WebSocket connection, unless the server is
+// draining or maxWebSockets connections are already open.
+func (s *Server) openWebSocket() error {
+	s.webSocketsMu.Lock()
+	defer s.webSocketsMu.Unlock()
+	if s.draining.Load() {
+		return errors.New("server is shutting down")
+	}
+	if s.webSockets >= s.maxWebSockets {
+		return fmt.Errorf("too many WebSocket connections: %d", s.webSockets)
+	}
+	s.webSockets++
+	s.webSocketsDone.Add(1)
+	return nil
+}
+
+func (s *Server) closeWebSocket() {
+	s.webSocketsMu.Lock()
+	defer s.webSocketsMu.Unlock()
+	s.webSockets--
+	s.webSocketsDone.Done()
+}
+
+// drainWebSockets waits for open WebSocket connections to complete their
+// lookups in flight, which stop reading requests once streamsCtx is canceled.
+func (s *Server) drainWebSockets(ctx context.Context) error {
+	// Synchronise with openWebSocket, so that no connections are added once
+	// waiting has begun.
+	s.webSocketsMu.Lock()
+	s.webSocketsMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		s.webSocketsDone.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		log.Warn("Drain timed out with WebSocket lookups in flight")
+		return ctx.Err()
+	}
+}
+
+// serveWebSocketLookups reads lookup requests off the given connection and
+// serves up to webSocketLookupConcurrency of them at once, until the client
+// closes the connection or the server shuts down.
+func (s *Server) serveWebSocketLookups(conn *websocket.Conn) {
+	defer conn.Close()
+	conn.MaxPayloadBytes = webSocketMaxMessageSize
+	ctx := conn.Request().Context()
+	stop := context.AfterFunc(s.streamsCtx, func() {
+		// Stop reading requests, while lookups in flight complete.
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, webSocketLookupConcurrency)
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(conn, &msg); err != nil {
+			if errors.Is(err, websocket.ErrFrameTooLarge) {
+				s.sendWebSocketResult(conn, WebSocketLookupResult{Status: http.StatusBadRequest, Error: err.Error()})
+				continue
+			}
+			if !errors.Is(err, io.EOF) && s.streamsCtx.Err() == nil {
+				logger(ctx).Debugw("Failed to read WebSocket lookup", "err", err)
+			}
+			return
+		}
+		var req WebSocketLookupRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			s.sendWebSocketResult(conn, WebSocketLookupResult{Status: http.StatusBadRequest, Error: fmt.Sprintf("invalid request: %s", err)})
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			s.sendWebSocketResult(conn, s.webSocketLookup(ctx, req))
+		}()
+	}
+}
+
+// webSocketLookup looks up the encrypted value keys of the requested
+// multihash, waiting for a slot of the concurrency limiter if any.
+func (s *Server) webSocketLookup(ctx context.Context, req WebSocketLookupRequest) (result WebSocketLookupResult) {
+	result = WebSocketLookupResult{ID: req.ID, Multihash: req.Multihash}
+	if s.metrics != nil {
+		start := s.clock.Now()
+		defer func() {
+			s.metrics.RecordHttpLatency(ctx, s.clock.Since(start), http.MethodGet, "multihash_ws", result.Status)
+		}()
+	}
+	if s.limiter != nil {
+		release, err := s.limiter.Acquire(ctx)
+		if err != nil {
+			if errors.Is(err, limit.ErrLimited) && s.metrics != nil {
+				s.metrics.RecordHttpShed(context.Background(), http.MethodGet, "encrypted", "concurrency")
+			}
+			result.Status = http.StatusServiceUnavailable
+			result.Error = err.Error()
+			return
+		}
+		defer release()
+	}
+	if _, err := multihash.Decode(req.Multihash); err != nil {
+		result.Status = http.StatusBadRequest
+		result.Error = dhstore.ErrMultihashDecode{Mh: req.Multihash, Err: err}.Error()
+		return
+	}
+	evks, err := s.dhs.Lookup(req.Multihash)
+	if err != nil {
+		result.Status = errorStatus(err)
+		result.Error = err.Error()
+		return
+	}
+	if len(evks) == 0 {
+		result.Status = http.StatusNotFound
+		return
+	}
+	result.Status = http.StatusOK
+	result.EncryptedValueKeys = evks
+	return
+}
+
+func (s *Server) sendWebSocketResult(conn *websocket.Conn, result WebSocketLookupResult) {
+	_ = conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	if err := websocket.JSON.Send(conn, result); err != nil {
+		logger(conn.Request().Context()).Debugw("Failed to send WebSocket lookup result", "err", err)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/ipni/dhstore"
+)
+
+// isRead reports whether the given request only reads from the store, as
+// opposed to writes, which are requests with any other method except for batch
+// lookups and legacy batch finds.
+func isRead(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return isBatchLookup(r) || isBatchFind(r) || isLegacyFind(r)
+	}
+}
+
+// rejectWrites wraps the given handler such that requests other than reads
+// are rejected with 405 Method Not Allowed, since they are served by the write
+// listener.
+func rejectWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isRead(r) {
+			w.Header().Set("Allow", http.MethodGet)
+			w.Header().Add("Allow", http.MethodHead)
+			dhstore.HTTPError(w, "writes are served on a separate listener", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectWritesWhen wraps the given handler such that writes are rejected as if
+// the store was read-only while readOnly returns true, e.g. to toggle
+// read-only mode at runtime.
+func (s *Server) rejectWritesWhen(readOnly func() bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isRead(r) && readOnly() {
+			s.handleError(w, dhstore.ErrReadOnly{})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
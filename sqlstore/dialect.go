@@ -0,0 +1,88 @@
+package sqlstore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Dialect captures the differences between the SQL databases supported by
+// the store.
+type Dialect struct {
+	// Name identifies the dialect.
+	Name string
+	// keyClause is the primary key clause of tables keyed by their key
+	// column.
+	keyClause string
+	// splitClause returns the clause appended to CREATE TABLE statements to
+	// pre-split tables into the given number of tablets, or an empty string
+	// if the dialect does not support it.
+	splitClause func(tablets int) string
+	// retryable reports whether a transaction that failed with the given
+	// error should be retried.
+	retryable func(error) bool
+}
+
+var (
+	// Postgres is the dialect of vanilla PostgreSQL.
+	Postgres = Dialect{
+		Name:        "postgres",
+		keyClause:   "PRIMARY KEY (key)",
+		splitClause: noSplit,
+		retryable:   isConflict,
+	}
+	// CockroachDB is the dialect of CockroachDB, which runs transactions at
+	// serializable isolation, and expects clients to retry transactions that
+	// fail to serialize.
+	CockroachDB = Dialect{
+		Name:        "cockroachdb",
+		keyClause:   "PRIMARY KEY (key)",
+		splitClause: noSplit,
+		retryable:   isConflict,
+	}
+	// YugabyteDB is the dialect of the PostgreSQL compatible YSQL API of
+	// YugabyteDB. Keys are hash partitioned, so that writes spread across
+	// tablets rather than funnel into the tablet of the lowest keys, and
+	// tables can be pre-split into a given number of tablets.
+	YugabyteDB = Dialect{
+		Name:        "yugabytedb",
+		keyClause:   "PRIMARY KEY (key HASH)",
+		splitClause: splitIntoTablets,
+		retryable:   isConflict,
+	}
+
+	dialects = []Dialect{Postgres, CockroachDB, YugabyteDB}
+)
+
+// DialectByName returns the supported dialect with the given name.
+func DialectByName(name string) (Dialect, error) {
+	for _, d := range dialects {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return Dialect{}, fmt.Errorf("unknown SQL dialect: %s", name)
+}
+
+func noSplit(int) string { return "" }
+
+func splitIntoTablets(tablets int) string {
+	return fmt.Sprintf(" SPLIT INTO %d TABLETS", tablets)
+}
+
+// isConflict reports whether the given error signals a serialization failure
+// or a deadlock, after which a transaction can be retried as is.
+func isConflict(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code {
+	case "40001", // serialization_failure
+		"40P01": // deadlock_detected
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,154 @@
+package sqlstore
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultMaxBatchSize is the default maximum number of rows written in a
+	// single transaction.
+	defaultMaxBatchSize = 100
+	// defaultMaxRetries is the default maximum number of times a transaction
+	// is retried after a conflict.
+	defaultMaxRetries = 10
+	// defaultMaxIdleConns is the default maximum number of idle connections
+	// kept open, i.e. that of database/sql.
+	defaultMaxIdleConns = 2
+)
+
+type (
+	Option  func(*options) error
+	options struct {
+		dialect      Dialect
+		maxBatchSize int
+		maxRetries   int
+		tablets      int
+
+		maxOpenConns     int
+		maxIdleConns     int
+		connMaxLifetime  time.Duration
+		statementTimeout time.Duration
+	}
+)
+
+func newOptions(o ...Option) (*options, error) {
+	opts := options{
+		dialect:      Postgres,
+		maxBatchSize: defaultMaxBatchSize,
+		maxRetries:   defaultMaxRetries,
+		maxIdleConns: defaultMaxIdleConns,
+	}
+	for _, apply := range o {
+		if err := apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	return &opts, nil
+}
+
+// WithDialect sets the dialect of the database by name; one of "postgres",
+// "cockroachdb" or "yugabytedb". See DialectByName. Defaults to "postgres".
+func WithDialect(name string) Option {
+	return func(o *options) error {
+		d, err := DialectByName(name)
+		if err != nil {
+			return err
+		}
+		o.dialect = d
+		return nil
+	}
+}
+
+// WithMaxBatchSize sets the maximum number of rows written in a single
+// transaction. Larger batches are split across multiple transactions.
+// Defaults to 100.
+func WithMaxBatchSize(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return fmt.Errorf("max batch size must be positive, got: %d", n)
+		}
+		o.maxBatchSize = n
+		return nil
+	}
+}
+
+// WithMaxRetries sets the maximum number of times a transaction is retried
+// after failing due to a conflict with concurrent transactions. Defaults to
+// 10.
+func WithMaxRetries(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("max retries must not be negative, got: %d", n)
+		}
+		o.maxRetries = n
+		return nil
+	}
+}
+
+// WithTablets sets the number of tablets into which the tables of the store
+// are split when created, so that writes of large deployments spread across
+// nodes from the start. Only supported by the "yugabytedb" dialect, and
+// ignored by others. Existing tables are left as is. Defaults to zero, i.e.
+// the database default.
+func WithTablets(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("tablets must not be negative, got: %d", n)
+		}
+		o.tablets = n
+		return nil
+	}
+}
+
+// WithMaxOpenConns sets the maximum number of connections open to the
+// database at once. Defaults to zero, i.e. unlimited.
+func WithMaxOpenConns(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("max open conns must not be negative, got: %d", n)
+		}
+		o.maxOpenConns = n
+		return nil
+	}
+}
+
+// WithMaxIdleConns sets the maximum number of idle connections kept open to
+// the database for reuse. No idle connections are kept when zero. Defaults to
+// 2.
+func WithMaxIdleConns(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return fmt.Errorf("max idle conns must not be negative, got: %d", n)
+		}
+		o.maxIdleConns = n
+		return nil
+	}
+}
+
+// WithConnMaxLifetime sets the maximum amount of time a connection to the
+// database is reused for, e.g. so that connections are rebalanced across the
+// nodes of a cluster. Defaults to zero, i.e. connections are reused forever.
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(o *options) error {
+		if d < 0 {
+			return fmt.Errorf("conn max lifetime must not be negative, got: %s", d)
+		}
+		o.connMaxLifetime = d
+		return nil
+	}
+}
+
+// WithStatementTimeout sets the maximum amount of time the database spends
+// executing any one statement before aborting it, by setting the
+// statement_timeout parameter of connections. Defaults to zero, i.e. the
+// timeout configured by the database.
+func WithStatementTimeout(d time.Duration) Option {
+	return func(o *options) error {
+		if d < 0 {
+			return fmt.Errorf("statement timeout must not be negative, got: %s", d)
+		}
+		o.statementTimeout = d
+		return nil
+	}
+}
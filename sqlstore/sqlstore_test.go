@@ -0,0 +1,166 @@
+package sqlstore_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/internal/testutil"
+	"github.com/ipni/dhstore/sqlstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialectByName(t *testing.T) {
+	for _, want := range []sqlstore.Dialect{sqlstore.Postgres, sqlstore.CockroachDB, sqlstore.YugabyteDB} {
+		got, err := sqlstore.DialectByName(want.Name)
+		require.NoError(t, err)
+		require.Equal(t, want.Name, got.Name)
+	}
+	_, err := sqlstore.DialectByName("fish")
+	require.ErrorContains(t, err, "unknown SQL dialect")
+}
+
+// newTestStore connects to the database at DHSTORE_TEST_SQL_DSN, in the
+// dialect named by DHSTORE_TEST_SQL_DIALECT, or skips the test if unset.
+func newTestStore(t *testing.T) *sqlstore.SQLDHStore {
+	dsn := os.Getenv("DHSTORE_TEST_SQL_DSN")
+	if dsn == "" {
+		t.Skip("DHSTORE_TEST_SQL_DSN is not set")
+	}
+	dialect := os.Getenv("DHSTORE_TEST_SQL_DIALECT")
+	if dialect == "" {
+		dialect = sqlstore.Postgres.Name
+	}
+	subject, err := sqlstore.NewSQLDHStore(dsn, sqlstore.WithDialect(dialect), sqlstore.WithMaxBatchSize(2))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	return subject
+}
+
+func TestSQLDHStore_MergeIndexesAppendsUniqueValueKeys(t *testing.T) {
+	subject := newTestStore(t)
+	fish, lobster := testutil.RandomDblSha256(t), testutil.RandomDblSha256(t)
+
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("barreleye")},
+		{Key: lobster, Value: []byte("squat")},
+		{Key: fish, Value: []byte("barreleye")},
+	}))
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("anglerfish")},
+		{Key: fish, Value: []byte("barreleye")},
+		{Key: testutil.RandomDblSha256(t), Value: []byte("dragonfish")},
+	}))
+
+	got, err := subject.Lookup(fish)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("barreleye"), []byte("anglerfish")}, got)
+	got, err = subject.Lookup(lobster)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("squat")}, got)
+	got, err = subject.Lookup(testutil.RandomDblSha256(t))
+	require.NoError(t, err)
+	require.Nil(t, got)
+}
+
+func TestSQLDHStore_MergeIndexesInsertsRowsOfNewMultihashes(t *testing.T) {
+	subject := newTestStore(t)
+	fish := testutil.RandomDblSha256(t)
+
+	// Merges must insert the row of a multihash not yet stored, including
+	// one whose row was deleted once left with no value keys, rather than
+	// only update existing rows.
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{{Key: fish, Value: []byte("barreleye")}}))
+	require.NoError(t, subject.DeleteIndexes([]dhstore.Index{{Key: fish, Value: []byte("barreleye")}}))
+	got, err := subject.Lookup(fish)
+	require.NoError(t, err)
+	require.Nil(t, got)
+
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("anglerfish")},
+		{Key: fish, Value: []byte("anglerfish")},
+	}))
+	got, err = subject.Lookup(fish)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("anglerfish")}, got)
+}
+
+func TestSQLDHStore_ConcurrentMergesOfNewMultihash(t *testing.T) {
+	subject := newTestStore(t)
+	fish := testutil.RandomDblSha256(t)
+
+	// Concurrent merges all insert the row of a multihash not yet stored,
+	// none of which may be lost.
+	const writers = 8
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			errs <- subject.MergeIndexes([]dhstore.Index{{Key: fish, Value: []byte(fmt.Sprint("barreleye-", i))}})
+		}(i)
+	}
+	want := make([]dhstore.EncryptedValueKey, 0, writers)
+	for i := 0; i < writers; i++ {
+		require.NoError(t, <-errs)
+		want = append(want, []byte(fmt.Sprint("barreleye-", i)))
+	}
+
+	got, err := subject.Lookup(fish)
+	require.NoError(t, err)
+	require.ElementsMatch(t, want, got)
+}
+
+func TestSQLDHStore_DeleteIndexesRemovesEmptyRows(t *testing.T) {
+	subject := newTestStore(t)
+	fish, lobster := testutil.RandomDblSha256(t), testutil.RandomDblSha256(t)
+
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("barreleye")},
+		{Key: fish, Value: []byte("anglerfish")},
+		{Key: lobster, Value: []byte("squat")},
+	}))
+	require.NoError(t, subject.DeleteIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("barreleye")},
+		{Key: lobster, Value: []byte("squat")},
+		{Key: lobster, Value: []byte("spiny")},
+		{Key: testutil.RandomDblSha256(t), Value: []byte("dragonfish")},
+	}))
+
+	got, err := subject.Lookup(fish)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("anglerfish")}, got)
+	got, err = subject.Lookup(lobster)
+	require.NoError(t, err)
+	require.Nil(t, got)
+}
+
+func TestSQLDHStore_Metadata(t *testing.T) {
+	subject := newTestStore(t)
+	fish, lobster, squid := testutil.RandomDblSha256(t), testutil.RandomDblSha256(t), testutil.RandomDblSha256(t)
+
+	require.NoError(t, subject.PutMetadata([]byte(fish), []byte("barreleye")))
+	require.NoError(t, subject.PutMetadataBatch([]dhstore.Metadata{
+		{Key: []byte(lobster), Value: []byte("squat")},
+		{Key: []byte(squid), Value: []byte("vampire")},
+		{Key: []byte(fish), Value: []byte("anglerfish")},
+		{Key: []byte(lobster), Value: []byte("spiny")},
+	}))
+
+	for key, want := range map[string]string{string(fish): "anglerfish", string(lobster): "spiny", string(squid): "vampire"} {
+		got, err := subject.GetMetadata([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, dhstore.EncryptedMetadata(want), got)
+	}
+
+	require.NoError(t, subject.DeleteMetadata([]byte(fish)))
+	got, err := subject.GetMetadata([]byte(fish))
+	require.NoError(t, err)
+	require.Nil(t, got)
+}
+
+func TestNewSQLDHStore_RejectsInvalidOptions(t *testing.T) {
+	_, err := sqlstore.NewSQLDHStore("", sqlstore.WithTablets(-1))
+	require.ErrorContains(t, err, "tablets must not be negative")
+	_, err = sqlstore.NewSQLDHStore("", sqlstore.WithDialect("fish"))
+	require.ErrorContains(t, err, "unknown SQL dialect")
+}
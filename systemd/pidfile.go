@@ -0,0 +1,30 @@
+package systemd
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// WritePIDFile writes the ID of the process to the file at path, e.g. for the
+// PIDFile of units, replacing any file left behind by a previous process. The
+// file is written atomically, so that readers never see a partial ID.
+func WritePIDFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.Itoa(os.Getpid()) + "\n"); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
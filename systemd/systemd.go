@@ -0,0 +1,101 @@
+// Package systemd integrates dhstore with the systemd service manager, so that
+// units can use Type=notify to be considered started only once dhstore serves,
+// and WatchdogSec to be restarted once dhstore stops serving requests.
+//
+// The notification protocol is implemented directly, as documented in
+// sd_notify(3), rather than by linking libsystemd.
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("systemd")
+
+// The states sent to the service manager.
+const (
+	// Ready signals that startup is complete.
+	Ready = "READY=1"
+	// Stopping signals that shutdown has begun.
+	Stopping = "STOPPING=1"
+	// Watchdog pings the watchdog of the service manager.
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends state to the service manager at the socket named by the
+// NOTIFY_SOCKET environment variable. It returns false if the variable is
+// unset, i.e. if not run by a service manager that expects notifications.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	// Names starting with @ are in the abstract namespace.
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval within which the service manager
+// expects watchdog pings, as set by the WATCHDOG_USEC environment variable, or
+// zero if the watchdog is disabled or not meant for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC: %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// StartWatchdog pings the watchdog of the service manager every half of the
+// given interval, for as long as live succeeds within that time, until ctx is
+// done. Pings are withheld while live fails or hangs, so that the service
+// manager considers the service failed once the interval elapses without one.
+func StartWatchdog(ctx context.Context, interval time.Duration, live func(context.Context) error) {
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			liveCtx, cancel := context.WithTimeout(ctx, interval/2)
+			err := live(liveCtx)
+			cancel()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorw("Liveness check failed; withholding watchdog ping", "err", err)
+				}
+				continue
+			}
+			if _, err := Notify(Watchdog); err != nil {
+				log.Warnw("Failed to ping watchdog", "err", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+package systemd_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore/systemd"
+	"github.com/stretchr/testify/require"
+)
+
+// listenNotify listens on a notification socket named by NOTIFY_SOCKET for the
+// duration of the test.
+func listenNotify(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func readState(t *testing.T, conn *net.UnixConn) string {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sent, err := systemd.Notify(systemd.Ready)
+	require.NoError(t, err)
+	require.False(t, sent)
+
+	conn := listenNotify(t)
+	sent, err = systemd.Notify(systemd.Ready)
+	require.NoError(t, err)
+	require.True(t, sent)
+	require.Equal(t, "READY=1", readState(t, conn))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	got, err := systemd.WatchdogInterval()
+	require.NoError(t, err)
+	require.Zero(t, got)
+
+	t.Setenv("WATCHDOG_USEC", "3000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	got, err = systemd.WatchdogInterval()
+	require.NoError(t, err)
+	require.Equal(t, 3*time.Second, got)
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	got, err = systemd.WatchdogInterval()
+	require.NoError(t, err)
+	require.Zero(t, got)
+
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "fish")
+	_, err = systemd.WatchdogInterval()
+	require.ErrorContains(t, err, "invalid")
+}
+
+func TestStartWatchdog_WithholdsPingsWhileNotLive(t *testing.T) {
+	conn := listenNotify(t)
+	var live atomic.Bool
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	systemd.StartWatchdog(ctx, 20*time.Millisecond, func(context.Context) error {
+		if !live.Load() {
+			return errors.New("wedged")
+		}
+		return nil
+	})
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err := conn.Read(make([]byte, 64))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	live.Store(true)
+	require.Equal(t, "WATCHDOG=1", readState(t, conn))
+}
+
+func TestWritePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhstore.pid")
+	require.NoError(t, os.WriteFile(path, []byte("1\n"), 0o644))
+
+	require.NoError(t, systemd.WritePIDFile(path))
+	got, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(os.Getpid())+"\n", string(got))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
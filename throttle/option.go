@@ -0,0 +1,106 @@
+package throttle
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+)
+
+const (
+	defaultRate          = 100
+	defaultBurst         = 10
+	defaultTargetLatency = 100 * time.Millisecond
+	defaultWindow        = time.Minute
+	defaultMaxSamples    = 4096
+)
+
+// config contains all options for the throttle.
+type config struct {
+	clock         clock.Clock
+	rate          float64
+	burst         int
+	targetLatency time.Duration
+	window        time.Duration
+	maxSamples    int
+}
+
+// Option is a function that sets a value in a config.
+type Option func(*config) error
+
+// getOpts creates a config and applies Options to it.
+func getOpts(opts []Option) (config, error) {
+	cfg := config{
+		clock:         clock.New(),
+		rate:          defaultRate,
+		burst:         defaultBurst,
+		targetLatency: defaultTargetLatency,
+		window:        defaultWindow,
+		maxSamples:    defaultMaxSamples,
+	}
+	for i, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, fmt.Errorf("option %d error: %s", i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// WithClock sets the clock used to refill tokens and to age out latency
+// samples. Defaults to the system clock.
+func WithClock(c clock.Clock) Option {
+	return func(cfg *config) error {
+		cfg.clock = c
+		return nil
+	}
+}
+
+// WithRate sets the maximum rate, in operations per second, at which
+// maintenance operations are allowed while foreground latency is healthy, and
+// the maximum number of operations allowed in a burst. Defaults to 100
+// operations per second in bursts of up to 10.
+func WithRate(opsPerSecond float64, burst int) Option {
+	return func(cfg *config) error {
+		if opsPerSecond <= 0 {
+			return fmt.Errorf("rate must be greater than zero, got: %f", opsPerSecond)
+		}
+		if burst < 1 {
+			return fmt.Errorf("burst must be at least 1, got: %d", burst)
+		}
+		cfg.rate = opsPerSecond
+		cfg.burst = burst
+		return nil
+	}
+}
+
+// WithTargetLatency sets the p99 foreground latency at or above which
+// maintenance is paused. The rate of maintenance is scaled down linearly as
+// p99 latency grows from half the target to the target. Zero disables
+// scaling, in which case maintenance always runs at the maximum rate.
+// Defaults to 100ms.
+func WithTargetLatency(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d < 0 {
+			return fmt.Errorf("target latency must not be negative, got: %s", d)
+		}
+		cfg.targetLatency = d
+		return nil
+	}
+}
+
+// WithWindow sets the time window over which foreground latency is observed,
+// and the maximum number of latency samples retained within it. Defaults to
+// one minute and 4096 samples.
+func WithWindow(window time.Duration, maxSamples int) Option {
+	return func(cfg *config) error {
+		if window <= 0 {
+			return fmt.Errorf("window must be greater than zero, got: %s", window)
+		}
+		if maxSamples < 1 {
+			return fmt.Errorf("max samples must be at least 1, got: %d", maxSamples)
+		}
+		cfg.window = window
+		cfg.maxSamples = maxSamples
+		return nil
+	}
+}
@@ -0,0 +1,212 @@
+// Package throttle rate-limits background maintenance operations, such as
+// pruning the records of stale providers, according to the latency observed by
+// foreground operations.
+//
+// Maintenance running at a fixed rate either runs too slowly when the store is
+// idle, or hurts serving when it is busy. Instead, a Throttle hands out tokens
+// from a bucket refilled at a rate that shrinks as p99 foreground latency
+// approaches a target, and stops altogether when the target is exceeded.
+package throttle
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore/clock"
+)
+
+var log = logging.Logger("throttle")
+
+// p99RefreshInterval is the minimum interval between computations of p99
+// latency, since it requires sorting the samples.
+const p99RefreshInterval = time.Second
+
+type (
+	// Throttle paces maintenance operations by handing out tokens at a rate
+	// tied to observed foreground latency.
+	Throttle struct {
+		clock         clock.Clock
+		rate          float64
+		burst         float64
+		targetLatency time.Duration
+		window        time.Duration
+
+		mu       sync.Mutex
+		tokens   float64
+		refillAt time.Time
+		samples  []sample
+		next     int
+		p99      time.Duration
+		p99At    time.Time
+		paused   bool
+	}
+	sample struct {
+		at      time.Time
+		latency time.Duration
+	}
+)
+
+// New instantiates a new Throttle with a full bucket of tokens.
+func New(options ...Option) (*Throttle, error) {
+	opts, err := getOpts(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Throttle{
+		clock:         opts.clock,
+		rate:          opts.rate,
+		burst:         float64(opts.burst),
+		targetLatency: opts.targetLatency,
+		window:        opts.window,
+		tokens:        float64(opts.burst),
+		refillAt:      opts.clock.Now(),
+		samples:       make([]sample, 0, opts.maxSamples),
+	}, nil
+}
+
+// Observe records the latency of a foreground operation.
+func (t *Throttle) Observe(latency time.Duration) {
+	s := sample{at: t.clock.Now(), latency: latency}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < cap(t.samples) {
+		t.samples = append(t.samples, s)
+		return
+	}
+	t.samples[t.next] = s
+	t.next = (t.next + 1) % len(t.samples)
+}
+
+// Allow takes a token and returns true if one is available. Otherwise, it
+// returns false without blocking.
+func (t *Throttle) Allow() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refill()
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// Wait blocks until a token is available and takes it, or until the context is
+// done.
+func (t *Throttle) Wait(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		rate := t.refill()
+		if t.tokens >= 1 {
+			t.tokens--
+			t.mu.Unlock()
+			return nil
+		}
+		// While paused, check again once latency may have recovered.
+		delay := p99RefreshInterval
+		if rate > 0 {
+			delay = time.Duration((1 - t.tokens) / rate * float64(time.Second))
+		}
+		t.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.clock.After(delay):
+		}
+	}
+}
+
+// BurstForRate returns a burst size suited to the given rate, in operations
+// per second: the operations allowed in a tenth of a second, and at least one.
+func BurstForRate(opsPerSecond float64) int {
+	return max(1, int(opsPerSecond/10))
+}
+
+// SetRate changes the maximum rate, in operations per second, at which
+// maintenance operations are allowed while foreground latency is healthy, and
+// the maximum number of operations allowed in a burst.
+func (t *Throttle) SetRate(opsPerSecond float64, burst int) error {
+	var cfg config
+	if err := WithRate(opsPerSecond, burst)(&cfg); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Tokens accrued so far count at the previous rate.
+	t.refill()
+	t.rate = cfg.rate
+	t.burst = float64(cfg.burst)
+	t.tokens = min(t.tokens, t.burst)
+	return nil
+}
+
+// Rate returns the current rate, in operations per second, at which tokens are
+// handed out. Zero means that maintenance is paused.
+func (t *Throttle) Rate() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.currentRate(t.clock.Now())
+}
+
+// refill adds the tokens accrued since the last refill at the current rate,
+// and returns the rate.
+func (t *Throttle) refill() float64 {
+	now := t.clock.Now()
+	rate := t.currentRate(now)
+	if elapsed := now.Sub(t.refillAt); elapsed > 0 {
+		t.tokens = min(t.burst, t.tokens+elapsed.Seconds()*rate)
+	}
+	t.refillAt = now
+	return rate
+}
+
+// currentRate returns the rate scaled according to p99 foreground latency.
+func (t *Throttle) currentRate(now time.Time) float64 {
+	if t.targetLatency == 0 {
+		return t.rate
+	}
+	p99 := t.latencyP99(now)
+	paused := p99 >= t.targetLatency
+	if paused != t.paused {
+		t.paused = paused
+		if paused {
+			log.Warnw("Pausing maintenance due to foreground latency", "p99", p99, "target", t.targetLatency)
+		} else {
+			log.Infow("Resuming maintenance", "p99", p99, "target", t.targetLatency)
+		}
+	}
+	half := t.targetLatency / 2
+	switch {
+	case paused:
+		return 0
+	case p99 <= half:
+		return t.rate
+	default:
+		return t.rate * float64(t.targetLatency-p99) / float64(t.targetLatency-half)
+	}
+}
+
+// latencyP99 returns the p99 latency of the samples observed within the
+// window, recomputed at most once every p99RefreshInterval.
+func (t *Throttle) latencyP99(now time.Time) time.Duration {
+	if !t.p99At.IsZero() && now.Sub(t.p99At) < p99RefreshInterval {
+		return t.p99
+	}
+	t.p99At = now
+	latencies := make([]time.Duration, 0, len(t.samples))
+	for _, s := range t.samples {
+		if now.Sub(s.at) <= t.window {
+			latencies = append(latencies, s.latency)
+		}
+	}
+	if len(latencies) == 0 {
+		t.p99 = 0
+		return 0
+	}
+	slices.Sort(latencies)
+	t.p99 = latencies[(len(latencies)*99+99)/100-1]
+	return t.p99
+}
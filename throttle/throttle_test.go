@@ -0,0 +1,96 @@
+package throttle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipni/dhstore/clock"
+	"github.com/ipni/dhstore/throttle"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottle_RefillsAtRate(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1_000, 0))
+	subject, err := throttle.New(throttle.WithClock(clk), throttle.WithRate(10, 2))
+	require.NoError(t, err)
+
+	require.True(t, subject.Allow())
+	require.True(t, subject.Allow())
+	require.False(t, subject.Allow())
+
+	clk.Add(100 * time.Millisecond)
+	require.True(t, subject.Allow())
+	require.False(t, subject.Allow())
+
+	// Tokens accrue up to the burst.
+	clk.Add(time.Hour)
+	require.True(t, subject.Allow())
+	require.True(t, subject.Allow())
+	require.False(t, subject.Allow())
+}
+
+func TestThrottle_SetRate(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1_000, 0))
+	subject, err := throttle.New(throttle.WithClock(clk), throttle.WithRate(10, 2))
+	require.NoError(t, err)
+	require.ErrorContains(t, subject.SetRate(0, 1), "greater than zero")
+
+	require.NoError(t, subject.SetRate(1, 1))
+	require.Equal(t, float64(1), subject.Rate())
+	// Tokens beyond the new burst are dropped.
+	require.True(t, subject.Allow())
+	require.False(t, subject.Allow())
+
+	clk.Add(100 * time.Millisecond)
+	require.False(t, subject.Allow())
+	clk.Add(900 * time.Millisecond)
+	require.True(t, subject.Allow())
+}
+
+func TestBurstForRate(t *testing.T) {
+	require.Equal(t, 1, throttle.BurstForRate(0.5))
+	require.Equal(t, 1, throttle.BurstForRate(10))
+	require.Equal(t, 10, throttle.BurstForRate(100))
+}
+
+func TestThrottle_ScalesWithForegroundLatency(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1_000, 0))
+	subject, err := throttle.New(
+		throttle.WithClock(clk),
+		throttle.WithRate(100, 1),
+		throttle.WithTargetLatency(100*time.Millisecond),
+		throttle.WithWindow(time.Minute, 100))
+	require.NoError(t, err)
+	require.Equal(t, float64(100), subject.Rate())
+
+	for i := 0; i < 100; i++ {
+		subject.Observe(75 * time.Millisecond)
+	}
+	clk.Add(time.Second)
+	require.InDelta(t, 50, subject.Rate(), 0.001)
+
+	// Maintenance is paused when p99 latency reaches the target.
+	subject.Observe(200 * time.Millisecond)
+	subject.Observe(200 * time.Millisecond)
+	clk.Add(time.Second)
+	require.Zero(t, subject.Rate())
+	require.True(t, subject.Allow(), "bucket starts full")
+	clk.Add(time.Minute / 2)
+	require.False(t, subject.Allow())
+
+	// Maintenance resumes once slow samples age out of the window.
+	clk.Add(time.Minute)
+	require.Equal(t, float64(100), subject.Rate())
+}
+
+func TestThrottle_WaitHonoursContext(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1_000, 0))
+	subject, err := throttle.New(throttle.WithClock(clk), throttle.WithRate(1, 1))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, subject.Wait(ctx))
+	cancel()
+	require.ErrorIs(t, subject.Wait(ctx), context.Canceled)
+}
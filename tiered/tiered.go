@@ -0,0 +1,269 @@
+// Package tiered implements a composite DHStore that keeps recent records in
+// a fast hot store, and falls back on a slower cold store for lookups that
+// miss it.
+//
+// All writes go to the hot store. Deletes are applied to both stores. When
+// the cold store is read-only, e.g. when it serves archived S3 segments,
+// deletes instead leave tombstones in the hot store that hide the deleted
+// records of the cold store from lookups. Hot and cold hits are counted
+// separately so that the fraction of lookups served from the cold store can be
+// monitored.
+package tiered
+
+import (
+	"crypto/sha256"
+	"errors"
+	"slices"
+	"sync/atomic"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/metrics"
+	"github.com/multiformats/go-multihash"
+)
+
+var (
+	_ dhstore.DHStore               = (*TieredDHStore)(nil)
+	_ dhstore.MetadataBatchPutter   = (*TieredDHStore)(nil)
+	_ dhstore.WritePressureReporter = (*TieredDHStore)(nil)
+	_ dhstore.HealthReporter        = (*TieredDHStore)(nil)
+)
+
+// tombstonePrefix prefixes the keys from which the keys of tombstones are
+// derived, so that tombstones never collide with records.
+var tombstonePrefix = []byte("/dhstore/tiered/tombstone/")
+
+// tombstoneMetadata is the value of metadata tombstones, which only need to be
+// non-empty.
+var tombstoneMetadata = dhstore.EncryptedMetadata{1}
+
+type TieredDHStore struct {
+	hot  dhstore.DHStore
+	cold dhstore.DHStore
+
+	mhLookups    lookupCounters
+	mdLookups    lookupCounters
+	coldFailures atomic.Int64
+}
+
+type lookupCounters struct {
+	hot  atomic.Int64
+	cold atomic.Int64
+	miss atomic.Int64
+}
+
+func (c *lookupCounters) snapshot() metrics.TieredLookups {
+	return metrics.TieredLookups{
+		Hot:  c.hot.Load(),
+		Cold: c.cold.Load(),
+		Miss: c.miss.Load(),
+	}
+}
+
+// NewTieredDHStore returns a store that writes to hot and serves lookups from
+// hot, falling back on cold when hot has no records for the looked up key.
+// Closing the returned store closes both hot and cold.
+func NewTieredDHStore(hot, cold dhstore.DHStore) *TieredDHStore {
+	return &TieredDHStore{
+		hot:  hot,
+		cold: cold,
+	}
+}
+
+func (s *TieredDHStore) MergeIndexes(indexes []dhstore.Index) error {
+	return s.hot.MergeIndexes(indexes)
+}
+
+// DeleteIndexes deletes the given indexes from the hot store, then from the
+// cold store. If the cold store is read-only, tombstones of the indexes are
+// merged into the hot store instead.
+func (s *TieredDHStore) DeleteIndexes(indexes []dhstore.Index) error {
+	if err := s.hot.DeleteIndexes(indexes); err != nil {
+		return err
+	}
+	if readOnly, err := s.coldWrite(s.cold.DeleteIndexes(indexes)); err != nil || !readOnly {
+		return err
+	}
+	tombstones := make([]dhstore.Index, 0, len(indexes))
+	for _, index := range indexes {
+		tombstones = append(tombstones, dhstore.Index{Key: tombstoneKey(index.Key), Value: index.Value})
+	}
+	return s.hot.MergeIndexes(tombstones)
+}
+
+func (s *TieredDHStore) PutMetadata(hvk dhstore.HashedValueKey, em dhstore.EncryptedMetadata) error {
+	return s.hot.PutMetadata(hvk, em)
+}
+
+func (s *TieredDHStore) PutMetadataBatch(records []dhstore.Metadata) error {
+	if batcher, ok := s.hot.(dhstore.MetadataBatchPutter); ok {
+		return batcher.PutMetadataBatch(records)
+	}
+	for _, record := range records {
+		if err := s.hot.PutMetadata(record.Key, record.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *TieredDHStore) Lookup(mh multihash.Multihash) ([]dhstore.EncryptedValueKey, error) {
+	evks, err := s.hot.Lookup(mh)
+	if err != nil {
+		return nil, err
+	}
+	if len(evks) != 0 {
+		s.mhLookups.hot.Add(1)
+		return evks, nil
+	}
+	if evks, err = s.cold.Lookup(mh); err != nil {
+		s.coldFailures.Add(1)
+		return nil, err
+	}
+	if len(evks) != 0 {
+		deleted, err := s.hot.Lookup(tombstoneKey(mh))
+		if err != nil {
+			return nil, err
+		}
+		evks = slices.DeleteFunc(evks, func(evk dhstore.EncryptedValueKey) bool {
+			return slices.ContainsFunc(deleted, func(d dhstore.EncryptedValueKey) bool {
+				return string(d) == string(evk)
+			})
+		})
+	}
+	if len(evks) == 0 {
+		s.mhLookups.miss.Add(1)
+		return nil, nil
+	}
+	s.mhLookups.cold.Add(1)
+	return evks, nil
+}
+
+func (s *TieredDHStore) GetMetadata(hvk dhstore.HashedValueKey) (dhstore.EncryptedMetadata, error) {
+	md, err := s.hot.GetMetadata(hvk)
+	if err != nil {
+		return nil, err
+	}
+	if len(md) != 0 {
+		s.mdLookups.hot.Add(1)
+		return md, nil
+	}
+	if md, err = s.cold.GetMetadata(hvk); err != nil {
+		s.coldFailures.Add(1)
+		return nil, err
+	}
+	if len(md) != 0 {
+		tombstone, err := s.hot.GetMetadata(dhstore.HashedValueKey(tombstoneKey(hvk)))
+		if err != nil {
+			return nil, err
+		}
+		if len(tombstone) != 0 {
+			md = nil
+		}
+	}
+	if len(md) == 0 {
+		s.mdLookups.miss.Add(1)
+		return nil, nil
+	}
+	s.mdLookups.cold.Add(1)
+	return md, nil
+}
+
+// DeleteMetadata deletes the given metadata from the hot store, then from the
+// cold store. If the cold store is read-only, a tombstone of the metadata is put
+// into the hot store instead.
+func (s *TieredDHStore) DeleteMetadata(hvk dhstore.HashedValueKey) error {
+	if err := s.hot.DeleteMetadata(hvk); err != nil {
+		return err
+	}
+	if readOnly, err := s.coldWrite(s.cold.DeleteMetadata(hvk)); err != nil || !readOnly {
+		return err
+	}
+	return s.hot.PutMetadata(dhstore.HashedValueKey(tombstoneKey(hvk)), tombstoneMetadata)
+}
+
+// DeleteMetadataBatch deletes the metadata of the given keys from the hot
+// store, then from the cold store. If the cold store is read-only, tombstones
+// of the metadata are put into the hot store instead.
+func (s *TieredDHStore) DeleteMetadataBatch(hvks []dhstore.HashedValueKey) error {
+	if err := deleteMetadataBatch(s.hot, hvks); err != nil {
+		return err
+	}
+	if readOnly, err := s.coldWrite(deleteMetadataBatch(s.cold, hvks)); err != nil || !readOnly {
+		return err
+	}
+	tombstones := make([]dhstore.Metadata, 0, len(hvks))
+	for _, hvk := range hvks {
+		tombstones = append(tombstones, dhstore.Metadata{Key: dhstore.HashedValueKey(tombstoneKey(hvk)), Value: tombstoneMetadata})
+	}
+	return s.PutMetadataBatch(tombstones)
+}
+
+func deleteMetadataBatch(store dhstore.DHStore, hvks []dhstore.HashedValueKey) error {
+	if batcher, ok := store.(dhstore.MetadataBatchDeleter); ok {
+		return batcher.DeleteMetadataBatch(hvks)
+	}
+	for _, hvk := range hvks {
+		if err := store.DeleteMetadata(hvk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coldWrite filters the error of a write to the cold store, returning whether
+// the write was rejected because the cold store is read-only rather than as an
+// error.
+func (s *TieredDHStore) coldWrite(err error) (bool, error) {
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.As(err, &dhstore.ErrReadOnly{}):
+		return true, nil
+	default:
+		s.coldFailures.Add(1)
+		return false, err
+	}
+}
+
+// tombstoneKey derives the key of the tombstone of the records of the given
+// key, as a multihash like those of indexes so that any hot store accepts it.
+func tombstoneKey(key []byte) multihash.Multihash {
+	digest := sha256.Sum256(append(slices.Clip(tombstonePrefix), key...))
+	mh, _ := multihash.Encode(digest[:], multihash.DBL_SHA2_256)
+	return mh
+}
+
+// WritePressure reports the write pressure of the hot store, since it receives
+// all writes.
+func (s *TieredDHStore) WritePressure() float64 {
+	if reporter, ok := s.hot.(dhstore.WritePressureReporter); ok {
+		return reporter.WritePressure()
+	}
+	return 0
+}
+
+// Healthy returns the first error reported by the hot or cold store, if any of
+// them is a dhstore.HealthReporter.
+func (s *TieredDHStore) Healthy() error {
+	for _, store := range []dhstore.DHStore{s.hot, s.cold} {
+		if reporter, ok := store.(dhstore.HealthReporter); ok {
+			if err := reporter.Healthy(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Metrics returns a snapshot of the lookup counters of the store.
+func (s *TieredDHStore) Metrics() *metrics.TieredMetrics {
+	return &metrics.TieredMetrics{
+		Multihash:    s.mhLookups.snapshot(),
+		Metadata:     s.mdLookups.snapshot(),
+		ColdFailures: s.coldFailures.Load(),
+	}
+}
+
+func (s *TieredDHStore) Close() error {
+	return errors.Join(s.hot.Close(), s.cold.Close())
+}
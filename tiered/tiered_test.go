@@ -0,0 +1,129 @@
+package tiered_test
+
+import (
+	"testing"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/internal/testutil"
+	"github.com/ipni/dhstore/metrics"
+	"github.com/ipni/dhstore/pebble"
+	"github.com/ipni/dhstore/tiered"
+	"github.com/stretchr/testify/require"
+)
+
+// readOnlyStore is a cold store that serves the records of a pebble store,
+// and rejects writes like an S3 segment store does.
+type readOnlyStore struct {
+	*pebble.PebbleDHStore
+}
+
+func (readOnlyStore) MergeIndexes([]dhstore.Index) error  { return dhstore.ErrReadOnly{} }
+func (readOnlyStore) DeleteIndexes([]dhstore.Index) error { return dhstore.ErrReadOnly{} }
+func (readOnlyStore) DeleteMetadata(dhstore.HashedValueKey) error {
+	return dhstore.ErrReadOnly{}
+}
+func (readOnlyStore) DeleteMetadataBatch([]dhstore.HashedValueKey) error {
+	return dhstore.ErrReadOnly{}
+}
+
+func newPebbleStore(t *testing.T) *pebble.PebbleDHStore {
+	s, err := pebble.NewPebbleDHStore(t.TempDir(), nil)
+	require.NoError(t, err)
+	return s
+}
+
+func TestTieredDHStore_FallsBackOnCold(t *testing.T) {
+	hot, cold := newPebbleStore(t), newPebbleStore(t)
+	subject := tiered.NewTieredDHStore(hot, readOnlyStore{cold})
+	defer subject.Close()
+
+	recent, archived := testutil.RandomDblSha256(t), testutil.RandomDblSha256(t)
+	require.NoError(t, cold.MergeIndexes([]dhstore.Index{{Key: archived, Value: []byte("barreleye")}}))
+	require.NoError(t, cold.PutMetadata([]byte("lobster"), []byte("squat")))
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{{Key: recent, Value: []byte("fish")}}))
+	require.NoError(t, subject.PutMetadata([]byte("lobster"), []byte("spiny")))
+
+	got, err := subject.Lookup(recent)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("fish")}, got)
+	got, err = subject.Lookup(archived)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("barreleye")}, got)
+	got, err = subject.Lookup(testutil.RandomDblSha256(t))
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	md, err := subject.GetMetadata([]byte("lobster"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("spiny"), md)
+
+	require.Equal(t, &metrics.TieredMetrics{
+		Multihash: metrics.TieredLookups{Hot: 1, Cold: 1, Miss: 1},
+		Metadata:  metrics.TieredLookups{Hot: 1},
+	}, subject.Metrics())
+}
+
+func TestTieredDHStore_DeletesFromReadOnlyColdStayDeleted(t *testing.T) {
+	hot, cold := newPebbleStore(t), newPebbleStore(t)
+	subject := tiered.NewTieredDHStore(hot, readOnlyStore{cold})
+	defer subject.Close()
+
+	fish, lobster := testutil.RandomDblSha256(t), testutil.RandomDblSha256(t)
+	require.NoError(t, cold.MergeIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("barreleye")},
+		{Key: fish, Value: []byte("anglerfish")},
+		{Key: lobster, Value: []byte("squat")},
+	}))
+	for _, hvk := range []string{"squat", "spiny", "slipper"} {
+		require.NoError(t, cold.PutMetadata([]byte(hvk), []byte("archived")))
+	}
+	require.NoError(t, subject.PutMetadata([]byte("squat"), []byte("recent")))
+
+	// Deletes succeed despite the cold store being read-only, and the deleted
+	// records of the cold store are no longer looked up.
+	require.NoError(t, subject.DeleteIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("barreleye")},
+		{Key: lobster, Value: []byte("squat")},
+	}))
+	require.NoError(t, subject.DeleteMetadata([]byte("squat")))
+	require.NoError(t, subject.DeleteMetadataBatch([]dhstore.HashedValueKey{[]byte("spiny")}))
+
+	got, err := subject.Lookup(fish)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("anglerfish")}, got)
+	got, err = subject.Lookup(lobster)
+	require.NoError(t, err)
+	require.Empty(t, got)
+	for _, hvk := range []string{"squat", "spiny"} {
+		md, err := subject.GetMetadata([]byte(hvk))
+		require.NoError(t, err)
+		require.Nil(t, md, hvk)
+	}
+	md, err := subject.GetMetadata([]byte("slipper"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("archived"), md)
+
+	// Records written again after their deletion are looked up from the hot
+	// store.
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{{Key: lobster, Value: []byte("squat")}}))
+	require.NoError(t, subject.PutMetadata([]byte("squat"), []byte("recent")))
+	got, err = subject.Lookup(lobster)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("squat")}, got)
+	md, err = subject.GetMetadata([]byte("squat"))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("recent"), md)
+}
+
+func TestTieredDHStore_DeletesFromWritableCold(t *testing.T) {
+	hot, cold := newPebbleStore(t), newPebbleStore(t)
+	subject := tiered.NewTieredDHStore(hot, cold)
+	defer subject.Close()
+
+	mh := testutil.RandomDblSha256(t)
+	require.NoError(t, cold.MergeIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}}))
+	require.NoError(t, subject.DeleteIndexes([]dhstore.Index{{Key: mh, Value: []byte("fish")}}))
+	got, err := subject.Lookup(mh)
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
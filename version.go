@@ -4,15 +4,102 @@ import (
 	_ "embed"
 	"encoding/json"
 	"fmt"
+	"runtime"
 	"runtime/debug"
+	"strings"
 	"time"
 )
 
 //go:embed version.json
 var versionJSON []byte
 
+// commit and buildDate may be set via ldflags, e.g.
+// -X github.com/ipni/dhstore.buildDate=2024-01-02T15:04:05Z, in which case
+// they take precedence over the VCS information embedded by the Go toolchain,
+// e.g. for builds from source archives without VCS information.
+var (
+	commit    string
+	buildDate string
+)
+
 var Version = buildVersion()
 
+// BuildInfo describes the build of the running binary, so that bug reports
+// can be traced to the exact source and toolchain.
+type BuildInfo struct {
+	// Version is the release and, if known, the commit of the build, as
+	// Version.
+	Version string `json:"version"`
+	// Commit is the full VCS revision of the source, if known.
+	Commit string `json:"commit,omitempty"`
+	// Modified is whether the source had uncommitted changes.
+	Modified bool `json:"modified,omitempty"`
+	// CommitDate is the time of Commit, if known.
+	CommitDate string `json:"commitDate,omitempty"`
+	// BuildDate is the time of the build, if set via ldflags.
+	BuildDate string `json:"buildDate,omitempty"`
+	// GoVersion is the version of the Go toolchain of the build.
+	GoVersion string `json:"goVersion"`
+	// Tags are the build tags of the build, e.g. fdb.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// ReadBuildInfo returns the build information of the running binary.
+func ReadBuildInfo() BuildInfo {
+	b := BuildInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+	}
+	info, _ := debug.ReadBuildInfo()
+	for _, kv := range buildSettings(info) {
+		switch kv.Key {
+		case "vcs.revision":
+			b.Commit = kv.Value
+		case "vcs.time":
+			b.CommitDate = kv.Value
+		case "vcs.modified":
+			b.Modified = kv.Value == "true"
+		case "-tags":
+			b.Tags = strings.Split(kv.Value, ",")
+		}
+	}
+	if commit != "" {
+		b.Commit = commit
+	}
+	b.BuildDate = buildDate
+	return b
+}
+
+// String formats the build information as lines, the first of which is
+// Version, followed by a line per known field formatted as name: value.
+func (b BuildInfo) String() string {
+	var sb strings.Builder
+	sb.WriteString(b.Version)
+	line := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&sb, "\n%s: %s", name, value)
+		}
+	}
+	if b.Modified {
+		line("commit", b.Commit+" (modified)")
+	} else {
+		line("commit", b.Commit)
+	}
+	line("commit date", b.CommitDate)
+	line("build date", b.BuildDate)
+	line("go version", b.GoVersion)
+	line("build tags", strings.Join(b.Tags, ","))
+	return sb.String()
+}
+
+// buildSettings returns the settings of the given build information, if any.
+func buildSettings(info *debug.BuildInfo) []debug.BuildSetting {
+	if info == nil {
+		return nil
+	}
+	return info.Settings
+}
+
 func buildVersion() string {
 	// Read version from embedded JSON file.
 	var verMap map[string]string
@@ -24,10 +111,10 @@ func buildVersion() string {
 	var dirty bool
 
 	info, ok := debug.ReadBuildInfo()
-	if !ok {
+	if !ok && commit == "" {
 		return release + " dev-build"
 	}
-	for _, kv := range info.Settings {
+	for _, kv := range buildSettings(info) {
 		switch kv.Key {
 		case "vcs.revision":
 			revision = kv.Value[:7]
@@ -38,11 +125,17 @@ func buildVersion() string {
 			dirty = kv.Value == "true"
 		}
 	}
+	if len(commit) >= 7 {
+		revision = commit[:7]
+	}
 	if dirty {
 		revision += "-dirty"
 	}
-	if revision != "" {
+	switch {
+	case revision != "" && day != "":
 		return fmt.Sprintf("%s %s-%s", release, day, revision)
+	case revision != "":
+		return fmt.Sprintf("%s %s", release, revision)
 	}
 	return release + " dev-build"
 }
@@ -0,0 +1,143 @@
+// Package watch fans out newly merged encrypted value keys to the clients
+// watching their multihash, so that gateways can react to index updates
+// without polling.
+//
+// Watchers that do not keep up are dropped rather than slowing down writes,
+// upon which they are expected to look up the multihash again and resume
+// watching.
+package watch
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ipni/dhstore"
+	"github.com/multiformats/go-multihash"
+)
+
+// watcherBufferSize is the number of encrypted value keys buffered per
+// watcher, beyond which the watcher is dropped.
+const watcherBufferSize = 1024
+
+// ErrTooManyWatchers is returned by Watch when the maximum number of watchers
+// is reached.
+var ErrTooManyWatchers = errors.New("too many watchers")
+
+type (
+	// Hub publishes merged encrypted value keys to the watchers of their
+	// multihash.
+	Hub struct {
+		maxWatchers int
+
+		mu       sync.Mutex
+		watchers map[string]map[*Watcher]struct{}
+		count    int
+	}
+	// Watcher receives the encrypted value keys merged into the records of a
+	// multihash.
+	Watcher struct {
+		hub     *Hub
+		key     string
+		c       chan dhstore.EncryptedValueKey
+		dropped atomic.Bool
+		closed  bool
+	}
+)
+
+// New returns a Hub that serves up to maxWatchers concurrent watchers.
+func New(maxWatchers int) (*Hub, error) {
+	if maxWatchers < 1 {
+		return nil, fmt.Errorf("max watchers must be at least 1, got: %d", maxWatchers)
+	}
+	return &Hub{
+		maxWatchers: maxWatchers,
+		watchers:    make(map[string]map[*Watcher]struct{}),
+	}, nil
+}
+
+// Watch returns a watcher of the encrypted value keys merged into the records
+// of the given multihash from now on. The watcher must be closed once done.
+func (h *Hub) Watch(mh multihash.Multihash) (*Watcher, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count >= h.maxWatchers {
+		return nil, ErrTooManyWatchers
+	}
+	w := &Watcher{
+		hub: h,
+		key: string(mh),
+		c:   make(chan dhstore.EncryptedValueKey, watcherBufferSize),
+	}
+	watchers, ok := h.watchers[w.key]
+	if !ok {
+		watchers = make(map[*Watcher]struct{})
+		h.watchers[w.key] = watchers
+	}
+	watchers[w] = struct{}{}
+	h.count++
+	return w, nil
+}
+
+// Publish notifies the watchers of the multihashes of the given merges, once
+// they are applied. Watchers whose buffer is full are dropped.
+func (h *Hub) Publish(merges []dhstore.Index) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return
+	}
+	for _, merge := range merges {
+		for w := range h.watchers[string(merge.Key)] {
+			select {
+			case w.c <- merge.Value:
+			default:
+				w.dropped.Store(true)
+				h.remove(w)
+			}
+		}
+	}
+}
+
+// Watchers returns the number of current watchers.
+func (h *Hub) Watchers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// remove removes the given watcher and closes its channel. It must be called
+// with the lock held.
+func (h *Hub) remove(w *Watcher) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	close(w.c)
+	watchers := h.watchers[w.key]
+	delete(watchers, w)
+	if len(watchers) == 0 {
+		delete(h.watchers, w.key)
+	}
+	h.count--
+}
+
+// C returns the channel on which merged encrypted value keys are received. It
+// is closed once the watcher is closed or dropped.
+func (w *Watcher) C() <-chan dhstore.EncryptedValueKey {
+	return w.c
+}
+
+// Dropped reports whether the watcher was dropped because it did not keep up
+// with merges, in which case merges may have been missed.
+func (w *Watcher) Dropped() bool {
+	return w.dropped.Load()
+}
+
+// Close stops the watcher. It is safe to call more than once.
+func (w *Watcher) Close() {
+	w.hub.mu.Lock()
+	defer w.hub.mu.Unlock()
+	w.hub.remove(w)
+}
@@ -0,0 +1,69 @@
+package watch_test
+
+import (
+	"testing"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/watch"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	_, err := watch.New(0)
+	require.ErrorContains(t, err, "at least 1")
+}
+
+func TestHub_PublishesToWatchersOfMultihash(t *testing.T) {
+	subject, err := watch.New(2)
+	require.NoError(t, err)
+	fish, err := multihash.Sum([]byte("fish"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+	lobster, err := multihash.Sum([]byte("lobster"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+
+	w, err := subject.Watch(fish)
+	require.NoError(t, err)
+	other, err := subject.Watch(lobster)
+	require.NoError(t, err)
+	_, err = subject.Watch(fish)
+	require.ErrorIs(t, err, watch.ErrTooManyWatchers)
+
+	subject.Publish([]dhstore.Index{{Key: fish, Value: []byte("barreleye")}, {Key: fish, Value: []byte("anglerfish")}})
+	require.Equal(t, dhstore.EncryptedValueKey("barreleye"), <-w.C())
+	require.Equal(t, dhstore.EncryptedValueKey("anglerfish"), <-w.C())
+	require.Empty(t, other.C())
+
+	w.Close()
+	w.Close()
+	_, open := <-w.C()
+	require.False(t, open)
+	require.False(t, w.Dropped())
+	require.Equal(t, 1, subject.Watchers())
+	other.Close()
+	require.Zero(t, subject.Watchers())
+}
+
+func TestHub_DropsWatchersThatDoNotKeepUp(t *testing.T) {
+	subject, err := watch.New(1)
+	require.NoError(t, err)
+	fish, err := multihash.Sum([]byte("fish"), multihash.DBL_SHA2_256, -1)
+	require.NoError(t, err)
+
+	w, err := subject.Watch(fish)
+	require.NoError(t, err)
+	merges := make([]dhstore.Index, 2000)
+	for i := range merges {
+		merges[i] = dhstore.Index{Key: fish, Value: []byte{byte(i)}}
+	}
+	subject.Publish(merges)
+	require.True(t, w.Dropped())
+	require.Zero(t, subject.Watchers())
+
+	var received int
+	for range w.C() {
+		received++
+	}
+	require.Equal(t, 1024, received)
+	w.Close()
+}
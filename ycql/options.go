@@ -0,0 +1,196 @@
+package ycql
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+const (
+	// SSLModeDisable connects without TLS.
+	SSLModeDisable = "disable"
+	// SSLModeRequire connects over TLS without verifying the server
+	// certificate.
+	SSLModeRequire = "require"
+	// SSLModeVerifyCA connects over TLS and verifies that the server
+	// certificate is signed by a trusted CA.
+	SSLModeVerifyCA = "verify-ca"
+	// SSLModeVerifyFull connects over TLS and verifies that the server
+	// certificate is signed by a trusted CA and matches the server host name.
+	SSLModeVerifyFull = "verify-full"
+)
+
+const (
+	// defaultKeyspace is the default keyspace in which tables are created.
+	defaultKeyspace = "dhstore"
+	// defaultTimeout is the default timeout of queries.
+	defaultTimeout = 10 * time.Second
+	// defaultMaxBatchSize is the default maximum number of statements sent in
+	// a single batch.
+	defaultMaxBatchSize = 100
+)
+
+// keyspacePattern matches valid unquoted CQL identifiers.
+var keyspacePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,47}$`)
+
+type (
+	Option  func(*options) error
+	options struct {
+		hosts             []string
+		keyspace          string
+		consistency       gocql.Consistency
+		timeout           time.Duration
+		maxBatchSize      int
+		replicationFactor int
+		sslMode           string
+		sslRootCert       string
+		sslCert           string
+		sslKey            string
+		username          string
+		password          string
+	}
+)
+
+func newOptions(o ...Option) (*options, error) {
+	opts := options{
+		keyspace:          defaultKeyspace,
+		consistency:       gocql.Quorum,
+		timeout:           defaultTimeout,
+		maxBatchSize:      defaultMaxBatchSize,
+		replicationFactor: 3,
+		sslMode:           SSLModeDisable,
+	}
+	for _, apply := range o {
+		if err := apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.hosts) == 0 {
+		return nil, fmt.Errorf("at least one host must be specified")
+	}
+	if opts.sslMode == SSLModeDisable && (opts.sslRootCert != "" || opts.sslCert != "") {
+		return nil, fmt.Errorf("SSL certificates require an SSL mode other than %s", SSLModeDisable)
+	}
+	return &opts, nil
+}
+
+// WithHosts sets the addresses of the YCQL servers to connect to initially.
+// The rest of the cluster is discovered from them. Required.
+func WithHosts(hosts ...string) Option {
+	return func(o *options) error {
+		o.hosts = hosts
+		return nil
+	}
+}
+
+// WithKeyspace sets the keyspace in which tables are created. Defaults to
+// "dhstore".
+func WithKeyspace(keyspace string) Option {
+	return func(o *options) error {
+		if !keyspacePattern.MatchString(keyspace) {
+			return fmt.Errorf("invalid keyspace: %q", keyspace)
+		}
+		o.keyspace = keyspace
+		return nil
+	}
+}
+
+// WithConsistency sets the consistency level of queries, e.g. "QUORUM" or
+// "ONE". Defaults to "QUORUM".
+func WithConsistency(consistency string) Option {
+	return func(o *options) error {
+		c, err := gocql.ParseConsistencyWrapper(consistency)
+		if err != nil {
+			return err
+		}
+		o.consistency = c
+		return nil
+	}
+}
+
+// WithTimeout sets the timeout of queries. Defaults to 10 seconds.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout must be positive, got: %s", timeout)
+		}
+		o.timeout = timeout
+		return nil
+	}
+}
+
+// WithMaxBatchSize sets the maximum number of statements sent in a single
+// batch. Larger batches of index merges or deletions are split across
+// multiple batches. Defaults to 100.
+func WithMaxBatchSize(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return fmt.Errorf("max batch size must be positive, got: %d", n)
+		}
+		o.maxBatchSize = n
+		return nil
+	}
+}
+
+// WithReplicationFactor sets the replication factor of the keyspace, if it is
+// created. It has no effect on an existing keyspace. Defaults to 3.
+func WithReplicationFactor(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return fmt.Errorf("replication factor must be positive, got: %d", n)
+		}
+		o.replicationFactor = n
+		return nil
+	}
+}
+
+// WithSSLMode sets whether to connect over TLS, and how the server
+// certificate is verified; one of SSLModeDisable, SSLModeRequire,
+// SSLModeVerifyCA or SSLModeVerifyFull. Defaults to SSLModeDisable.
+func WithSSLMode(mode string) Option {
+	return func(o *options) error {
+		switch mode {
+		case SSLModeDisable, SSLModeRequire, SSLModeVerifyCA, SSLModeVerifyFull:
+			o.sslMode = mode
+			return nil
+		default:
+			return fmt.Errorf("unknown SSL mode: %s", mode)
+		}
+	}
+}
+
+// WithSSLRootCert sets the path to the PEM encoded certificates of the CAs
+// trusted to sign the server certificate. The system CAs are trusted when
+// unset.
+func WithSSLRootCert(path string) Option {
+	return func(o *options) error {
+		o.sslRootCert = path
+		return nil
+	}
+}
+
+// WithSSLClientCert sets the paths to the PEM encoded client certificate and
+// key presented to the server. Both must be set, or neither.
+func WithSSLClientCert(certPath, keyPath string) Option {
+	return func(o *options) error {
+		if (certPath == "") != (keyPath == "") {
+			return fmt.Errorf("both SSL client certificate and key must be set, or neither")
+		}
+		o.sslCert = certPath
+		o.sslKey = keyPath
+		return nil
+	}
+}
+
+// WithCredentials sets the username and password with which to authenticate.
+// Authentication is disabled when the username is empty, which is the
+// default.
+func WithCredentials(username, password string) Option {
+	return func(o *options) error {
+		o.username = username
+		o.password = password
+		return nil
+	}
+}
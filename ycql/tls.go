@@ -0,0 +1,60 @@
+package ycql
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// tlsConfig returns the TLS configuration of the given SSL options, or nil if
+// TLS is disabled.
+func tlsConfig(opts *options) (*tls.Config, error) {
+	if opts.sslMode == SSLModeDisable {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.sslRootCert != "" {
+		pem, err := os.ReadFile(opts.sslRootCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSL root certificate: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in SSL root certificate %s", opts.sslRootCert)
+		}
+	}
+	if opts.sslCert != "" {
+		cert, err := tls.LoadX509KeyPair(opts.sslCert, opts.sslKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SSL client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch opts.sslMode {
+	case SSLModeRequire:
+		config.InsecureSkipVerify = true
+	case SSLModeVerifyCA:
+		// Skip the default verification, which checks the host name, and
+		// verify the certificate chain only.
+		config.InsecureSkipVerify = true
+		roots := config.RootCAs
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			return err
+		}
+	}
+	return config, nil
+}
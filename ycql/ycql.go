@@ -0,0 +1,212 @@
+// Package ycql implements a DHStore backed by YugabyteDB, using its Cassandra
+// compatible YCQL API.
+//
+// The encrypted value keys of each multihash are stored as a set in a single
+// row, so that merging and deleting value keys are blind writes that append
+// to or remove from the set without reading it first.
+package ycql
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gocql/gocql"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipni/dhstore"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+var (
+	_ dhstore.DHStore             = (*YCQLDHStore)(nil)
+	_ dhstore.MetadataBatchPutter = (*YCQLDHStore)(nil)
+
+	logger = logging.Logger("store/ycql")
+)
+
+type YCQLDHStore struct {
+	session      *gocql.Session
+	maxBatchSize int
+
+	mergeStmt    string
+	deleteStmt   string
+	lookupStmt   string
+	putMdStmt    string
+	getMdStmt    string
+	deleteMdStmt string
+}
+
+// NewYCQLDHStore connects to the given YCQL cluster and creates the keyspace
+// and tables of the store if they do not exist.
+func NewYCQLDHStore(o ...Option) (*YCQLDHStore, error) {
+	opts, err := newOptions(o...)
+	if err != nil {
+		return nil, err
+	}
+	cluster := gocql.NewCluster(opts.hosts...)
+	cluster.Consistency = opts.consistency
+	cluster.Timeout = opts.timeout
+	config, err := tlsConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		cluster.SslOpts = &gocql.SslOptions{
+			Config:                 config,
+			EnableHostVerification: opts.sslMode == SSLModeVerifyFull,
+		}
+	}
+	if opts.username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: opts.username,
+			Password: opts.password,
+		}
+	}
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to YCQL cluster: %w", err)
+	}
+	if err := createSchema(session, opts); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	logger.Infow("Connected to YCQL cluster", "hosts", opts.hosts, "keyspace", opts.keyspace, "sslMode", opts.sslMode)
+
+	ks := opts.keyspace
+	return &YCQLDHStore{
+		session:      session,
+		maxBatchSize: opts.maxBatchSize,
+		mergeStmt:    fmt.Sprintf("UPDATE %s.multihash SET value_keys = value_keys + ? WHERE key = ?", ks),
+		deleteStmt:   fmt.Sprintf("UPDATE %s.multihash SET value_keys = value_keys - ? WHERE key = ?", ks),
+		lookupStmt:   fmt.Sprintf("SELECT value_keys FROM %s.multihash WHERE key = ?", ks),
+		putMdStmt:    fmt.Sprintf("INSERT INTO %s.metadata (key, value) VALUES (?, ?)", ks),
+		getMdStmt:    fmt.Sprintf("SELECT value FROM %s.metadata WHERE key = ?", ks),
+		deleteMdStmt: fmt.Sprintf("DELETE FROM %s.metadata WHERE key = ?", ks),
+	}, nil
+}
+
+func createSchema(session *gocql.Session, opts *options) error {
+	stmts := []string{
+		fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH replication = {'class': 'SimpleStrategy', 'replication_factor': %d}", opts.keyspace, opts.replicationFactor),
+		// A row without value keys, i.e. whose set is empty, does not exist
+		// since rows are only ever written by UPDATE.
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.multihash (key blob PRIMARY KEY, value_keys set<blob>)", opts.keyspace),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.metadata (key blob PRIMARY KEY, value blob)", opts.keyspace),
+	}
+	for _, stmt := range stmts {
+		if err := session.Query(stmt).Exec(); err != nil {
+			return fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *YCQLDHStore) MergeIndexes(indexes []dhstore.Index) error {
+	return s.writeIndexes(s.mergeStmt, indexes)
+}
+
+func (s *YCQLDHStore) DeleteIndexes(indexes []dhstore.Index) error {
+	return s.writeIndexes(s.deleteStmt, indexes)
+}
+
+// writeIndexes applies the given statement to each index in unlogged batches
+// of at most maxBatchSize statements. Returns dhstore.ErrPartialWrite if a
+// batch fails after others were written.
+func (s *YCQLDHStore) writeIndexes(stmt string, indexes []dhstore.Index) error {
+	for _, index := range indexes {
+		if err := checkMultihash(index.Key); err != nil {
+			return err
+		}
+	}
+	var written int
+	for written < len(indexes) {
+		end := min(written+s.maxBatchSize, len(indexes))
+		batch := s.session.NewBatch(gocql.UnloggedBatch)
+		for _, index := range indexes[written:end] {
+			batch.Query(stmt, [][]byte{index.Value}, []byte(index.Key))
+		}
+		if err := s.session.ExecuteBatch(batch); err != nil {
+			if written == 0 {
+				return err
+			}
+			return dhstore.ErrPartialWrite{Written: written, Total: len(indexes), Err: err}
+		}
+		written = end
+	}
+	return nil
+}
+
+func (s *YCQLDHStore) PutMetadata(hvk dhstore.HashedValueKey, em dhstore.EncryptedMetadata) error {
+	return s.session.Query(s.putMdStmt, []byte(hvk), []byte(em)).Exec()
+}
+
+// PutMetadataBatch stores the given metadata records in unlogged batches of
+// at most maxBatchSize statements.
+func (s *YCQLDHStore) PutMetadataBatch(records []dhstore.Metadata) error {
+	var written int
+	for written < len(records) {
+		end := min(written+s.maxBatchSize, len(records))
+		batch := s.session.NewBatch(gocql.UnloggedBatch)
+		for _, record := range records[written:end] {
+			batch.Query(s.putMdStmt, []byte(record.Key), []byte(record.Value))
+		}
+		if err := s.session.ExecuteBatch(batch); err != nil {
+			if written == 0 {
+				return err
+			}
+			return dhstore.ErrPartialWrite{Written: written, Total: len(records), Err: err}
+		}
+		written = end
+	}
+	return nil
+}
+
+func (s *YCQLDHStore) Lookup(mh multihash.Multihash) ([]dhstore.EncryptedValueKey, error) {
+	if err := checkMultihash(mh); err != nil {
+		return nil, err
+	}
+	var values [][]byte
+	if err := s.session.Query(s.lookupStmt, []byte(mh)).Scan(&values); err != nil {
+		if errors.Is(err, gocql.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	evks := make([]dhstore.EncryptedValueKey, 0, len(values))
+	for _, value := range values {
+		evks = append(evks, value)
+	}
+	return evks, nil
+}
+
+func (s *YCQLDHStore) GetMetadata(hvk dhstore.HashedValueKey) (dhstore.EncryptedMetadata, error) {
+	var value []byte
+	if err := s.session.Query(s.getMdStmt, []byte(hvk)).Scan(&value); err != nil {
+		if errors.Is(err, gocql.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return value, nil
+}
+
+func (s *YCQLDHStore) DeleteMetadata(hvk dhstore.HashedValueKey) error {
+	return s.session.Query(s.deleteMdStmt, []byte(hvk)).Exec()
+}
+
+func (s *YCQLDHStore) Close() error {
+	s.session.Close()
+	return nil
+}
+
+func checkMultihash(mh multihash.Multihash) error {
+	dmh, err := multihash.Decode(mh)
+	if err != nil {
+		return dhstore.ErrMultihashDecode{Err: err, Mh: mh}
+	}
+	if dmh.Code != multihash.DBL_SHA2_256 {
+		return dhstore.ErrUnsupportedMulticodecCode{Code: multicodec.Code(dmh.Code)}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package ycql_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ipni/dhstore"
+	"github.com/ipni/dhstore/internal/testutil"
+	"github.com/ipni/dhstore/ycql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewYCQLDHStore_RejectsInvalidOptions(t *testing.T) {
+	_, err := ycql.NewYCQLDHStore()
+	require.ErrorContains(t, err, "host")
+
+	_, err = ycql.NewYCQLDHStore(ycql.WithHosts("127.0.0.1"), ycql.WithKeyspace("fish; DROP"))
+	require.ErrorContains(t, err, "invalid keyspace")
+
+	_, err = ycql.NewYCQLDHStore(ycql.WithHosts("127.0.0.1"), ycql.WithConsistency("lobster"))
+	require.Error(t, err)
+
+	_, err = ycql.NewYCQLDHStore(ycql.WithHosts("127.0.0.1"), ycql.WithSSLMode("lobster"))
+	require.ErrorContains(t, err, "unknown SSL mode")
+
+	_, err = ycql.NewYCQLDHStore(ycql.WithHosts("127.0.0.1"), ycql.WithSSLClientCert("fish.pem", ""))
+	require.ErrorContains(t, err, "both SSL client certificate and key")
+
+	_, err = ycql.NewYCQLDHStore(ycql.WithHosts("127.0.0.1"), ycql.WithSSLRootCert("fish.pem"))
+	require.ErrorContains(t, err, "SSL mode")
+
+	_, err = ycql.NewYCQLDHStore(ycql.WithHosts("127.0.0.1"), ycql.WithSSLMode(ycql.SSLModeVerifyFull), ycql.WithSSLRootCert(filepath.Join(t.TempDir(), "fish.pem")))
+	require.ErrorContains(t, err, "failed to read SSL root certificate")
+}
+
+// newTestStore connects to the YCQL servers at the comma separated
+// DHSTORE_TEST_YCQL_HOSTS, or skips the test if unset. Tables are created in
+// the keyspace DHSTORE_TEST_YCQL_KEYSPACE, or dhstore_test if unset.
+func newTestStore(t *testing.T) *ycql.YCQLDHStore {
+	hosts := os.Getenv("DHSTORE_TEST_YCQL_HOSTS")
+	if hosts == "" {
+		t.Skip("DHSTORE_TEST_YCQL_HOSTS is not set")
+	}
+	keyspace := os.Getenv("DHSTORE_TEST_YCQL_KEYSPACE")
+	if keyspace == "" {
+		keyspace = "dhstore_test"
+	}
+	subject, err := ycql.NewYCQLDHStore(
+		ycql.WithHosts(strings.Split(hosts, ",")...),
+		ycql.WithKeyspace(keyspace),
+		ycql.WithReplicationFactor(1),
+		ycql.WithMaxBatchSize(2))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, subject.Close()) })
+	return subject
+}
+
+func TestYCQLDHStore_MergeAndDeleteIndexes(t *testing.T) {
+	subject := newTestStore(t)
+	fish, lobster := testutil.RandomDblSha256(t), testutil.RandomDblSha256(t)
+
+	// Merges create the rows of multihashes not yet stored, and skip value
+	// keys already stored.
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("barreleye")},
+		{Key: lobster, Value: []byte("squat")},
+		{Key: fish, Value: []byte("barreleye")},
+	}))
+	require.NoError(t, subject.MergeIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("anglerfish")},
+		{Key: fish, Value: []byte("barreleye")},
+	}))
+	got, err := subject.Lookup(fish)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []dhstore.EncryptedValueKey{[]byte("barreleye"), []byte("anglerfish")}, got)
+
+	require.NoError(t, subject.DeleteIndexes([]dhstore.Index{
+		{Key: fish, Value: []byte("barreleye")},
+		{Key: lobster, Value: []byte("squat")},
+		{Key: testutil.RandomDblSha256(t), Value: []byte("dragonfish")},
+	}))
+	got, err = subject.Lookup(fish)
+	require.NoError(t, err)
+	require.Equal(t, []dhstore.EncryptedValueKey{[]byte("anglerfish")}, got)
+	got, err = subject.Lookup(lobster)
+	require.NoError(t, err)
+	require.Empty(t, got)
+	got, err = subject.Lookup(testutil.RandomDblSha256(t))
+	require.NoError(t, err)
+	require.Nil(t, got)
+}
+
+func TestYCQLDHStore_Metadata(t *testing.T) {
+	subject := newTestStore(t)
+	squat, spiny := testutil.RandomDblSha256(t), testutil.RandomDblSha256(t)
+
+	require.NoError(t, subject.PutMetadata([]byte(squat), []byte("fish")))
+	require.NoError(t, subject.PutMetadataBatch([]dhstore.Metadata{
+		{Key: []byte(squat), Value: []byte("lobster")},
+		{Key: []byte(spiny), Value: []byte("urchin")},
+	}))
+	md, err := subject.GetMetadata([]byte(squat))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("lobster"), md)
+
+	require.NoError(t, subject.DeleteMetadata([]byte(squat)))
+	md, err = subject.GetMetadata([]byte(squat))
+	require.NoError(t, err)
+	require.Nil(t, md)
+	md, err = subject.GetMetadata([]byte(spiny))
+	require.NoError(t, err)
+	require.Equal(t, dhstore.EncryptedMetadata("urchin"), md)
+}